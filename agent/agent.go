@@ -0,0 +1,373 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zombiezen/mcm/agent/agentlib"
+	"github.com/zombiezen/mcm/agent/agentrpc"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/catcrypt"
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/internal/history"
+	"github.com/zombiezen/mcm/internal/selfupdate"
+	"github.com/zombiezen/mcm/internal/state"
+	"github.com/zombiezen/mcm/internal/system"
+	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/internal/window"
+	"github.com/zombiezen/mcm/third_party/golang/crypto/ed25519"
+	"github.com/zombiezen/mcm/third_party/golang/grpc"
+	"github.com/zombiezen/mcm/third_party/golang/grpc/credentials"
+)
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s [options] URL\n", name)
+	for _, line := range strings.Split(history.CommandUsage, "\n") {
+		fmt.Fprintf(os.Stderr, "       %s [-history DIR] %s\n", name, line)
+	}
+	flag.PrintDefaults()
+}
+
+func main() {
+	logs := new(agentlib.LogHub)
+	log := &logger{hub: logs}
+	fetcher := &agentlib.Fetcher{Log: log}
+	opts := &execlib.Options{Log: log}
+	hist := new(history.Store)
+	stateStore := new(state.Store)
+	agent := &agentlib.Agent{
+		Fetcher: fetcher,
+		System:  system.Local{},
+		Options: opts,
+		History: hist,
+		State:   stateStore,
+	}
+	flag.StringVar(&fetcher.CacheDir, "cache", "/var/cache/mcm-agent", "directory to store the last good catalog in")
+	flag.BoolVar(&fetcher.Delta, "delta", false, "ask the server for a delta from the cached catalog instead of the full catalog")
+	keyPath := flag.String("key", "", "path to base64-encoded Ed25519 public key that catalogs must be signed with")
+	decryptKeyPath := flag.String("decrypt_key", "", "path to base64-encoded key to decrypt encrypted catalogs with")
+	proxy := flag.String("proxy", "", "URL of the HTTP(S) proxy to fetch through (default from $HTTPS_PROXY/$HTTP_PROXY)")
+	credentialsPath := flag.String("credentials", "", "path to file of HOST basic USER:PASSWORD or HOST bearer TOKEN lines to authenticate fetches with")
+	var mirrors download.Mirrors
+	flag.Var(&mirrors, "mirror", "PREFIX=URL mirror to fetch from when the server for URLs beginning with PREFIX is unreachable (repeatable)")
+	decryptKeyCommand := flag.String("decrypt_key_command", "", "shell command that prints the base64-encoded key to decrypt encrypted catalogs with")
+	flag.StringVar(&hist.Dir, "history", "/var/lib/mcm-agent/history", "directory to record run reports in")
+	flag.IntVar(&hist.Max, "keep", history.DefaultMax, "number of run reports to keep in the -history directory")
+	flag.StringVar(&stateStore.Path, "state", "/var/lib/mcm-agent/state.json", "path to file to keep resource durations in between runs")
+	flag.StringVar(&agent.FactsURL, "facts_url", "", "URL to upload the host's facts to with a PUT request before each fetch")
+	flag.StringVar(&agent.FactsDir, "facts_dir", "/etc/mcm-agent/facts.d", "directory of NAME.json files to upload as custom facts")
+	flag.StringVar(&agent.ReportURL, "report_url", "", "URL to send the report of each run to with a POST request")
+	flag.Float64Var(&opts.SlowFactor, "slow", execlib.DefaultSlowFactor, "log resources that take this many times longer than their average")
+	flag.BoolVar(&opts.FastHash, "fast_hash", false, "hash large files with xxHash instead of SHA-256 to detect changes between runs")
+	flag.StringVar(&agent.LockPath, "lock", "", "hold an exclusive lock on this file while applying, waiting for any mcm-exec run that holds it")
+	interval := flag.Duration("interval", 30*time.Minute, "time between runs")
+	once := flag.Bool("once", false, "apply the catalog once and exit")
+	httpAddr := flag.String("http", "", "address to serve metrics (at /debug/vars), profiles (at /debug/pprof/), and the resource graph (at /graph) on")
+	controlAddr := flag.String("control", "", "address to serve the control interface on (requires -tls_cert, -tls_key, and -tls_client_ca)")
+	certPath := flag.String("tls_cert", "", "path to PEM-encoded certificate for the control interface")
+	tlsKeyPath := flag.String("tls_key", "", "path to PEM-encoded private key for -tls_cert")
+	clientCAPath := flag.String("tls_client_ca", "", "path to PEM-encoded CA certificates that control clients must present a certificate from")
+	flag.IntVar(&opts.ConcurrentJobs, "j", 1, "set the maximum number of resources to apply simultaneously")
+	maxMemory := flag.Int64("max_memory_mb", 0, "MiB of file content and command output that the resources applied at once may buffer before no more are started (0 for no limit)")
+	flag.StringVar(&opts.Bash, "bash", execlib.DefaultBashPath, "path to bash shell")
+	flag.IntVar(&opts.MaxOutput, "max_output", execlib.DefaultMaxOutput, "maximum number of bytes of output to keep from each command (negative for no limit)")
+	flag.BoolVar(&opts.CriticalPath, "critical_path", false, "apply resources on the longest dependency chain first (weighted by -state durations)")
+	umask := flag.String("umask", "", "octal file creation mask to use during runs instead of the inherited one")
+	schedule := new(window.Schedule)
+	flag.Var(&schedule.Windows, "window", "\"[DAYS ]HH:MM-HH:MM\" maintenance window to limit runs to, like \"Mon-Fri 02:00-05:00\" (repeatable)")
+	flag.Var(&schedule.Blackouts, "blackout", "YYYY-MM-DD or YYYY-MM-DD..YYYY-MM-DD dates to skip runs on, even during a -window (repeatable)")
+	windowTZ := flag.String("window_tz", "", "time zone of -window and -blackout, like America/New_York (default local)")
+	ignoreWindow := flag.Bool("ignore_window", false, "run even outside -window or during a -blackout")
+	updateURL := flag.String("update_url", "", "URL of the signed release manifest to update mcm-agent from after each run")
+	updateKeyPath := flag.String("update_key", "", "path to base64-encoded Ed25519 public key that -update_url and its binaries must be signed with (default -key)")
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if *umask != "" {
+		mask, err := strconv.ParseUint(*umask, 8, 32)
+		if err != nil || mask > 0777 {
+			fmt.Fprintf(os.Stderr, "mcm-agent: invalid -umask %q\n", *umask)
+			os.Exit(2)
+		}
+		m := os.FileMode(mask)
+		opts.Umask = &m
+	}
+	if *maxMemory < 0 {
+		fmt.Fprintln(os.Stderr, "mcm-agent: -max_memory_mb must not be negative")
+		os.Exit(2)
+	}
+	opts.MemoryLimit = *maxMemory << 20
+	opts.CredentialsDirectory = os.Getenv("CREDENTIALS_DIRECTORY")
+	if *windowTZ != "" {
+		loc, err := time.LoadLocation(*windowTZ)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mcm-agent: -window_tz: %v\n", err)
+			os.Exit(2)
+		}
+		schedule.Location = loc
+	}
+	if !*ignoreWindow && !schedule.IsZero() {
+		agent.Schedule = schedule
+	}
+	ctx := context.Background()
+	if flag.Arg(0) == "history" {
+		err := history.Command(os.Stdout, hist, flag.Args()[1:])
+		if err == history.ErrUsage {
+			usage()
+			os.Exit(2)
+		}
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		return
+	}
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+	fetcher.URL = flag.Arg(0)
+	if d, err := download.New(*proxy, *credentialsPath, mirrors); err != nil {
+		log.Fatal(ctx, err)
+	} else {
+		fetcher.Downloader = d
+		opts.Downloader = d
+	}
+	if *keyPath != "" {
+		var err error
+		fetcher.PublicKey, err = readPublicKey(*keyPath)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+	}
+	var updater *selfupdate.Updater
+	if *updateURL != "" {
+		if *updateKeyPath == "" {
+			*updateKeyPath = *keyPath
+		}
+		if *updateKeyPath == "" {
+			fmt.Fprintln(os.Stderr, "mcm-agent: -update_url requires -update_key or -key")
+			os.Exit(2)
+		}
+		key, err := readPublicKey(*updateKeyPath)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		updater = &selfupdate.Updater{
+			URL:        *updateURL,
+			PublicKey:  key,
+			Program:    "mcm-agent",
+			Version:    version.Label,
+			Downloader: fetcher.Downloader,
+		}
+	}
+	if key, err := catcrypt.LoadKey(ctx, *decryptKeyPath, *decryptKeyCommand); err != nil {
+		log.Fatal(ctx, err)
+	} else {
+		fetcher.Key = key
+	}
+	if *httpAddr != "" {
+		if err := serveHTTP(ctx, log, *httpAddr, agent, fetcher); err != nil {
+			log.Fatal(ctx, err)
+		}
+	}
+	if *controlAddr != "" {
+		tlsConfig, err := controlTLSConfig(*certPath, *tlsKeyPath, *clientCAPath)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		l, err := net.Listen("tcp", *controlAddr)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		cs := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsConfig)))
+		agentrpc.RegisterAgentServer(cs, &agentlib.ControlServer{Agent: agent, Logs: logs})
+		go func() {
+			log.Fatal(ctx, cs.Serve(l))
+		}()
+	}
+
+	for {
+		report, err := agent.Run(ctx)
+		if report != nil && report.Summary != nil {
+			log.Infof(ctx, "%v", report.Summary)
+		}
+		if _, closed := err.(*window.ClosedError); closed {
+			log.Infof(ctx, "skipping run: %v", err)
+		} else if err != nil {
+			log.Error(ctx, err)
+			if *once {
+				os.Exit(1)
+			}
+		}
+		if _, closed := err.(*window.ClosedError); updater != nil && !closed {
+			update(ctx, log, updater, !*once)
+		}
+		if *once {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// update installs a new release of mcm-agent if there is one, then
+// restarts the agent to run it if restart is true.  Errors are logged,
+// and the agent keeps running the old version.
+func update(ctx context.Context, log *logger, u *selfupdate.Updater, restart bool) {
+	rel, err := u.Update(ctx)
+	if err != nil {
+		log.Error(ctx, err)
+		return
+	}
+	if rel == nil {
+		return
+	}
+	if !restart {
+		log.Infof(ctx, "updated mcm-agent to %s; it will be used the next time the agent starts", rel.Version)
+		return
+	}
+	path := u.Path
+	if path == "" {
+		var err error
+		if path, err = selfupdate.Executable(); err != nil {
+			log.Error(ctx, fmt.Errorf("updated mcm-agent to %s, but can't restart: %v", rel.Version, err))
+			return
+		}
+	}
+	log.Infof(ctx, "updated mcm-agent to %s; restarting", rel.Version)
+	if err := selfupdate.Restart(path); err != nil {
+		log.Error(ctx, fmt.Errorf("updated mcm-agent to %s, but can't restart: %v", rel.Version, err))
+	}
+}
+
+// controlTLSConfig returns a server configuration that requires
+// clients to present a certificate signed by one of the CAs in
+// clientCAPath.
+func controlTLSConfig(certPath, keyPath, clientCAPath string) (*tls.Config, error) {
+	if certPath == "" || keyPath == "" || clientCAPath == "" {
+		return nil, errors.New("-control requires -tls_cert, -tls_key, and -tls_client_ca")
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("load control certificate: %v", err)
+	}
+	caData, err := ioutil.ReadFile(clientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("load client CAs: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("load client CAs: no certificates found in %s", clientCAPath)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func readPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read public key: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("read public key %s: %v", path, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("read public key %s: wrong size %d", path, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+type logger struct {
+	mu  sync.Mutex
+	hub *agentlib.LogHub
+}
+
+func (l *logger) Infof(ctx context.Context, format string, args ...interface{}) {
+	l.write(ctx, "INFO", fmt.Sprintf(format, args...), nil)
+}
+
+func (l *logger) Error(ctx context.Context, err error) {
+	var output []byte
+	if err, ok := err.(*execlib.Error); ok {
+		output = err.Output
+	}
+	l.write(ctx, "ERROR", err.Error(), output)
+}
+
+func (l *logger) Fatal(ctx context.Context, err error) {
+	l.Error(ctx, err)
+	os.Exit(1)
+}
+
+func (l *logger) write(ctx context.Context, severity string, msg string, output []byte) {
+	now := time.Now()
+	ent := agentlib.LogEntry{Time: now, Severity: severity, Message: msg, RunID: execlib.RunIDFromContext(ctx)}
+	if ev := execlib.EventFromContext(ctx); ev != nil {
+		ent.SpanID = ev.SpanID
+	}
+	if len(output) > 0 {
+		ent.Message = msg + "\n" + string(output)
+	}
+	l.hub.Publish(ent)
+	var line bytes.Buffer
+	line.WriteString("mcm-agent: ")
+	line.WriteString(now.Format("2006-01-02T15:04:05"))
+	fmt.Fprintf(&line, " %5s: ", severity)
+	line.WriteString(strings.TrimSuffix(msg, "\n"))
+	switch {
+	case ent.SpanID != "":
+		fmt.Fprintf(&line, " (run=%s span=%s)", ent.RunID, ent.SpanID)
+	case ent.RunID != "":
+		fmt.Fprintf(&line, " (run=%s)", ent.RunID)
+	}
+	line.WriteByte('\n')
+	if len(output) > 0 {
+		line.Write(output)
+		if output[len(output)-1] != '\n' {
+			line.WriteByte('\n')
+		}
+	}
+	defer l.mu.Unlock()
+	l.mu.Lock()
+	os.Stderr.Write(line.Bytes())
+}
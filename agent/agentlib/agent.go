@@ -0,0 +1,317 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentlib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/facts"
+	"github.com/zombiezen/mcm/internal/history"
+	"github.com/zombiezen/mcm/internal/state"
+	"github.com/zombiezen/mcm/internal/system"
+	"github.com/zombiezen/mcm/internal/window"
+)
+
+// An Agent fetches and applies catalogs, keeping track of the outcome
+// of its runs.  Its methods are safe to call from multiple goroutines.
+type Agent struct {
+	Fetcher *Fetcher
+	System  system.System
+
+	// Options is passed to execlib.Apply.  Its Report and Pauser fields
+	// are ignored, and the host's facts are gathered before each run and added to
+	// its Vars (see facts.Facts.Vars).
+	Options *execlib.Options
+
+	// History records the report of each run if non-nil.
+	History *history.Store
+
+	// State keeps resource durations between runs if non-nil.
+	State *state.Store
+
+	// FactsURL is where the host's facts are uploaded with a PUT
+	// request before each fetch, if non-empty.  A failed upload is
+	// logged, and the run continues.
+	FactsURL string
+
+	// FactsDir is the directory of custom facts to upload along with
+	// the gathered ones.  See facts.Gather.
+	FactsDir string
+
+	// ReportURL is where the report of each run is sent with a POST
+	// request, if non-empty.  A failed upload is logged.
+	ReportURL string
+
+	// LockPath is a file that is locked while each run applies its
+	// catalog, if non-empty, so that runs don't overlap with mcm-exec
+	// runs that use the same -lock file.  System must be a
+	// system.Locker.
+	LockPath string
+
+	// Schedule restricts when runs may start, if non-nil.  Run returns a
+	// *window.ClosedError outside of it.
+	Schedule *window.Schedule
+
+	// runMu is held for the duration of a run.
+	runMu sync.Mutex
+
+	pauser execlib.Pauser
+
+	mu         sync.Mutex
+	running    bool
+	runCount   uint64
+	lastStart  time.Time
+	lastEnd    time.Time
+	lastErr    error
+	lastReport *execlib.Report
+	graph      *liveGraph
+}
+
+// Status is a snapshot of an Agent's state.
+type Status struct {
+	Running  bool
+	Paused   bool
+	RunCount uint64
+
+	// LastRunStart and LastRunEnd are zero if no run has finished.
+	LastRunStart time.Time
+	LastRunEnd   time.Time
+
+	// LastError is the error from the most recent run.
+	LastError error
+
+	CatalogFallbacks int64
+}
+
+// Run fetches and applies the catalog.  If Run is called while another
+// run is in progress, then it waits for the other run to finish before
+// starting.  The returned report is non-nil if the catalog was applied,
+// even if the application failed.
+func (a *Agent) Run(ctx context.Context) (*execlib.Report, error) {
+	a.runMu.Lock()
+	defer a.runMu.Unlock()
+	if err := a.Schedule.Check(time.Now()); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	a.running = true
+	a.mu.Unlock()
+
+	start := time.Now()
+	report, err := a.run(ctx)
+	end := time.Now()
+	if report != nil && a.History != nil {
+		if _, herr := a.History.Save(report); herr != nil {
+			a.logError(ctx, herr)
+		}
+	}
+	if report != nil && a.ReportURL != "" {
+		if uerr := a.uploadReport(ctx, report); uerr != nil {
+			a.logError(ctx, uerr)
+		}
+	}
+	if report != nil && report.Reboot != nil {
+		a.reboot(ctx, report.Reboot, err)
+	}
+
+	a.mu.Lock()
+	a.running = false
+	a.runCount++
+	a.lastStart, a.lastEnd = start, end
+	a.lastErr = err
+	if report != nil {
+		a.lastReport = report
+	}
+	a.mu.Unlock()
+	return report, err
+}
+
+func (a *Agent) run(ctx context.Context) (*execlib.Report, error) {
+	f, err := facts.Gather(a.FactsDir)
+	if err != nil {
+		a.logError(ctx, err)
+	} else if a.FactsURL != "" {
+		if err := a.uploadFacts(ctx, f); err != nil {
+			a.logError(ctx, err)
+		}
+	}
+	r, err := a.Fetcher.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts := new(execlib.Options)
+	if a.Options != nil {
+		*opts = *a.Options
+	}
+	if f != nil {
+		if opts.Vars, err = factVars(opts.Vars, f); err != nil {
+			a.logError(ctx, err)
+		}
+	}
+	// If the graph can't be built, then Apply reports the same error.
+	if lg, err := newLiveGraph(r.Catalog); err == nil {
+		defer lg.finish()
+		a.mu.Lock()
+		a.graph = lg
+		a.mu.Unlock()
+		opts.Log = &graphLogger{log: opts.Log, graph: lg}
+	}
+	opts.Report = new(execlib.Report)
+	opts.Pauser = &a.pauser
+	if a.State != nil {
+		opts.State, err = a.State.Load()
+		if err != nil && opts.State != nil {
+			a.logf(ctx, "warning: %v; starting over", err)
+		} else if err != nil {
+			a.logError(ctx, err)
+		}
+	}
+	if a.LockPath != "" {
+		l, ok := a.System.(system.Locker)
+		if !ok {
+			return nil, errors.New("lock: system cannot lock files")
+		}
+		lock, err := l.Lock(ctx, a.LockPath, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("lock: %v", err)
+		}
+		defer lock.Unlock()
+	}
+	err = execlib.Apply(ctx, a.System, r.Catalog, opts)
+	if opts.State != nil {
+		if serr := a.State.Save(opts.State); serr != nil {
+			a.logError(ctx, serr)
+		}
+	}
+	return opts.Report, err
+}
+
+// factVars returns vars with the variables of the host's facts added.
+// Variables in vars take precedence.
+func factVars(vars map[string]string, f *facts.Facts) (map[string]string, error) {
+	fv, err := f.Vars()
+	if err != nil {
+		return vars, err
+	}
+	for k, v := range vars {
+		fv[k] = v
+	}
+	return fv, nil
+}
+
+// uploadFacts sends the host's facts to a.FactsURL.
+func (a *Agent) uploadFacts(ctx context.Context, f *facts.Facts) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("upload facts: %v", err)
+	}
+	if err := a.Fetcher.downloader().Put(ctx, a.FactsURL, "application/json", data); err != nil {
+		return fmt.Errorf("upload facts: %v", err)
+	}
+	return nil
+}
+
+// uploadReport sends the report of a run to a.ReportURL.
+func (a *Agent) uploadReport(ctx context.Context, r *execlib.Report) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("upload report: %v", err)
+	}
+	if err := a.Fetcher.downloader().Post(ctx, a.ReportURL, "application/json", data); err != nil {
+		return fmt.Errorf("upload report: %v", err)
+	}
+	return nil
+}
+
+// reboot schedules the reboot requested by a run, unless the run failed.
+func (a *Agent) reboot(ctx context.Context, req *execlib.RebootRequest, runErr error) {
+	if runErr != nil {
+		a.logf(ctx, "warning: not rebooting because the run failed")
+		return
+	}
+	if err := execlib.ScheduleReboot(ctx, a.System, req); err != nil {
+		a.logError(ctx, err)
+		return
+	}
+	a.logf(ctx, "reboot scheduled in %v", req.Delay)
+}
+
+func (a *Agent) logf(ctx context.Context, format string, args ...interface{}) {
+	if a.Options == nil || a.Options.Log == nil {
+		return
+	}
+	a.Options.Log.Infof(ctx, format, args...)
+}
+
+func (a *Agent) logError(ctx context.Context, err error) {
+	if a.Options == nil || a.Options.Log == nil {
+		return
+	}
+	a.Options.Log.Error(ctx, err)
+}
+
+// Pause stops the agent from starting any more resources until Resume
+// is called.  Resources being applied finish normally.  If no run is in
+// progress, then the next run waits after fetching its catalog.
+func (a *Agent) Pause() {
+	a.pauser.Pause()
+}
+
+// Resume lets a paused agent continue applying resources.
+func (a *Agent) Resume() {
+	a.pauser.Resume()
+}
+
+// Status returns the agent's current state.
+func (a *Agent) Status() Status {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return Status{
+		Running:          a.running,
+		Paused:           a.pauser.Paused(),
+		RunCount:         a.runCount,
+		LastRunStart:     a.lastStart,
+		LastRunEnd:       a.lastEnd,
+		LastError:        a.lastErr,
+		CatalogFallbacks: a.Fetcher.Fallbacks(),
+	}
+}
+
+// LastReport returns the report of the most recent run that applied a
+// catalog or nil if there has not been one.
+func (a *Agent) LastReport() *execlib.Report {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lastReport
+}
+
+// Graph returns the resource graph of the catalog in the current run,
+// or the most recent run if none is in progress.  It returns nil if the
+// agent has not fetched a catalog yet.
+func (a *Agent) Graph() *Graph {
+	a.mu.Lock()
+	lg := a.graph
+	a.mu.Unlock()
+	if lg == nil {
+		return nil
+	}
+	return lg.snapshot()
+}
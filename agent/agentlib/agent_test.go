@@ -0,0 +1,251 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentlib
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/catpogs"
+	"github.com/zombiezen/mcm/internal/facts"
+	"github.com/zombiezen/mcm/internal/system/fakesystem"
+	"github.com/zombiezen/mcm/internal/window"
+)
+
+func TestAgentUploadFacts(t *testing.T) {
+	catalogSrv := new(fakeServer)
+	catalogSrv.set(marshalTestCatalog(t), "", time.Time{})
+	var mu sync.Mutex
+	var uploads [][]byte
+	mux := http.NewServeMux()
+	mux.Handle("/catalog", catalogSrv)
+	mux.HandleFunc("/facts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "want PUT", http.StatusMethodNotAllowed)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		uploads = append(uploads, data)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "agentlib_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "role.json"), []byte(`"web"`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	a := &Agent{
+		Fetcher:  &Fetcher{URL: hs.URL + "/catalog"},
+		System:   new(fakesystem.System),
+		FactsURL: hs.URL + "/facts",
+		FactsDir: dir,
+	}
+	if _, err := a.Run(ctx); err != nil {
+		t.Fatal("Run:", err)
+	}
+	mu.Lock()
+	n := len(uploads)
+	var f facts.Facts
+	if n > 0 {
+		if err := json.Unmarshal(uploads[0], &f); err != nil {
+			t.Errorf("uploaded facts = %q: %v", uploads[0], err)
+		}
+	}
+	mu.Unlock()
+	if n != 1 {
+		t.Fatalf("facts uploaded %d times; want 1", n)
+	}
+	if host, _ := os.Hostname(); f.Hostname != host {
+		t.Errorf("uploaded hostname = %q; want %q", f.Hostname, host)
+	}
+	if string(f.Custom["role"]) != `"web"` {
+		t.Errorf("uploaded custom facts = %s; want role = \"web\"", f.Custom)
+	}
+
+	// A failed upload does not stop the run.
+	a.FactsURL = hs.URL + "/nope"
+	if _, err := a.Run(ctx); err != nil {
+		t.Error("Run with failing facts upload:", err)
+	}
+}
+
+func TestAgentUploadReport(t *testing.T) {
+	catalogSrv := new(fakeServer)
+	catalogSrv.set(marshalTestCatalog(t), "", time.Time{})
+	var mu sync.Mutex
+	var uploads [][]byte
+	mux := http.NewServeMux()
+	mux.Handle("/catalog", catalogSrv)
+	mux.HandleFunc("/reports/web1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		uploads = append(uploads, data)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	ctx := context.Background()
+	a := &Agent{
+		Fetcher:   &Fetcher{URL: hs.URL + "/catalog"},
+		System:    new(fakesystem.System),
+		ReportURL: hs.URL + "/reports/web1",
+	}
+	report, err := a.Run(ctx)
+	if err != nil {
+		t.Fatal("Run:", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(uploads) != 1 {
+		t.Fatalf("report uploaded %d times; want 1", len(uploads))
+	}
+	got := new(execlib.Report)
+	if err := json.Unmarshal(uploads[0], got); err != nil {
+		t.Fatalf("uploaded report = %q: %v", uploads[0], err)
+	}
+	if got.RunID != report.RunID || len(got.Resources) != len(report.Resources) {
+		t.Errorf("uploaded report has run %q with %d resources; want run %q with %d", got.RunID, len(got.Resources), report.RunID, len(report.Resources))
+	}
+}
+
+func TestAgentFactVars(t *testing.T) {
+	progPath := filepath.Join(fakesystem.Root, "setup")
+	c, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "exec",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which:  catalog.Exec_Command_Which_argv,
+						Argv:   []string{progPath, "${facts.custom.role}", "${name}"},
+						Expand: true,
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	data, err := c.Segment().Message().Marshal()
+	if err != nil {
+		t.Fatal("Marshal:", err)
+	}
+	srv := new(fakeServer)
+	srv.set(data, "", time.Time{})
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "agentlib_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "role.json"), []byte(`"web"`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	sys := new(fakesystem.System)
+	var args []string
+	err = sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		args = pc.Args
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+
+	a := &Agent{
+		Fetcher:  &Fetcher{URL: hs.URL + "/catalog"},
+		System:   sys,
+		Options:  &execlib.Options{Vars: map[string]string{"name": "frontend"}},
+		FactsDir: dir,
+	}
+	if _, err := a.Run(context.Background()); err != nil {
+		t.Fatal("Run:", err)
+	}
+	if want := []string{progPath, "web", "frontend"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %q; want %q", args, want)
+	}
+}
+
+func TestAgentSchedule(t *testing.T) {
+	srv := new(fakeServer)
+	srv.set(marshalTestCatalog(t), "", time.Time{})
+	var mu sync.Mutex
+	fetches := 0
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		srv.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	now := time.Now().UTC()
+	a := &Agent{
+		Fetcher: &Fetcher{URL: hs.URL + "/catalog"},
+		System:  new(fakesystem.System),
+		Schedule: &window.Schedule{
+			Blackouts: window.Blackouts{{First: now.AddDate(0, 0, -1), Last: now.AddDate(0, 0, 1)}},
+			Location:  time.UTC,
+		},
+	}
+	report, err := a.Run(context.Background())
+	if _, ok := err.(*window.ClosedError); !ok {
+		t.Errorf("Run during blackout = _, %v; want *window.ClosedError", err)
+	}
+	if report != nil {
+		t.Error("Run during blackout returned a report")
+	}
+	mu.Lock()
+	n := fetches
+	mu.Unlock()
+	if n != 0 {
+		t.Errorf("Run during blackout fetched the catalog %d times; want 0", n)
+	}
+	if status := a.Status(); status.RunCount != 0 {
+		t.Errorf("RunCount = %d after run during blackout; want 0", status.RunCount)
+	}
+
+	a.Schedule = nil
+	if _, err := a.Run(context.Background()); err != nil {
+		t.Error("Run without schedule:", err)
+	}
+}
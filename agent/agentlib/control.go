@@ -0,0 +1,131 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentlib
+
+import (
+	"encoding/json"
+
+	"github.com/zombiezen/mcm/agent/agentrpc"
+	"github.com/zombiezen/mcm/third_party/golang/grpc"
+	"github.com/zombiezen/mcm/third_party/golang/grpc/codes"
+	"github.com/zombiezen/mcm/third_party/golang/net/context"
+)
+
+// A ControlServer implements the Agent gRPC service, which allows
+// other programs to drive and observe an agent.  It does not perform
+// any authentication: callers should configure the grpc.Server (e.g.
+// with TLS credentials) to restrict access.
+type ControlServer struct {
+	Agent *Agent
+
+	// Logs is the source of entries for StreamLogs.  If nil, then
+	// StreamLogs returns immediately.
+	Logs *LogHub
+}
+
+var _ agentrpc.AgentServer = (*ControlServer)(nil)
+
+// TriggerRun runs the agent and returns the run's report.
+func (cs *ControlServer) TriggerRun(ctx context.Context, req *agentrpc.TriggerRunRequest) (*agentrpc.Report, error) {
+	report, err := cs.Agent.Run(ctx)
+	if report == nil {
+		return nil, err
+	}
+	// A failed application is still reported, since the report has the
+	// details of what failed.
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	return &agentrpc.Report{Json: data}, nil
+}
+
+// GetStatus returns the agent's status.
+func (cs *ControlServer) GetStatus(ctx context.Context, req *agentrpc.GetStatusRequest) (*agentrpc.Status, error) {
+	stat := cs.Agent.Status()
+	s := &agentrpc.Status{
+		RunCount:         stat.RunCount,
+		CatalogFallbacks: stat.CatalogFallbacks,
+		Paused:           stat.Paused,
+	}
+	if stat.Running {
+		s.State = agentrpc.Status_RUNNING
+	}
+	if !stat.LastRunStart.IsZero() {
+		s.LastRunStart = stat.LastRunStart.UnixNano()
+		s.LastRunEnd = stat.LastRunEnd.UnixNano()
+	}
+	if stat.LastError != nil {
+		s.LastError = stat.LastError.Error()
+	}
+	return s, nil
+}
+
+// StreamLogs sends the entries published to cs.Logs until the call is
+// canceled.
+func (cs *ControlServer) StreamLogs(req *agentrpc.StreamLogsRequest, stream agentrpc.Agent_StreamLogsServer) error {
+	if cs.Logs == nil {
+		return nil
+	}
+	entries, cancel := cs.Logs.Subscribe()
+	defer cancel()
+	// Send the headers so that the client knows the stream has started.
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	for {
+		select {
+		case e := <-entries:
+			err := stream.Send(&agentrpc.LogEntry{
+				Time:     e.Time.UnixNano(),
+				Severity: e.Severity,
+				Message:  e.Message,
+				RunId:    e.RunID,
+				SpanId:   e.SpanID,
+			})
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// GetLastReport returns the report of the agent's most recent run.
+func (cs *ControlServer) GetLastReport(ctx context.Context, req *agentrpc.GetLastReportRequest) (*agentrpc.Report, error) {
+	report := cs.Agent.LastReport()
+	if report == nil {
+		return nil, grpc.Errorf(codes.NotFound, "no run has finished")
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	return &agentrpc.Report{Json: data}, nil
+}
+
+// Pause pauses the agent.
+func (cs *ControlServer) Pause(ctx context.Context, req *agentrpc.PauseRequest) (*agentrpc.PauseResponse, error) {
+	cs.Agent.Pause()
+	return new(agentrpc.PauseResponse), nil
+}
+
+// Resume resumes the agent.
+func (cs *ControlServer) Resume(ctx context.Context, req *agentrpc.ResumeRequest) (*agentrpc.ResumeResponse, error) {
+	cs.Agent.Resume()
+	return new(agentrpc.ResumeResponse), nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentlib
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zombiezen/mcm/agent/agentrpc"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/system/fakesystem"
+	"github.com/zombiezen/mcm/third_party/golang/grpc"
+	"github.com/zombiezen/mcm/third_party/golang/grpc/codes"
+	"github.com/zombiezen/mcm/third_party/golang/net/context"
+)
+
+func TestControlServer(t *testing.T) {
+	srv := new(fakeServer)
+	srv.set(marshalTestCatalog(t), "", time.Time{})
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	cs := &ControlServer{
+		Agent: &Agent{
+			Fetcher: &Fetcher{URL: hs.URL + "/catalog"},
+			System:  new(fakesystem.System),
+		},
+		Logs: new(LogHub),
+	}
+	client, cleanup := startControlServer(t, cs)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := client.GetLastReport(ctx, new(agentrpc.GetLastReportRequest)); grpc.Code(err) != codes.NotFound {
+		t.Errorf("GetLastReport before run error = %v; want code %v", err, codes.NotFound)
+	}
+
+	triggerRun, err := client.TriggerRun(ctx, new(agentrpc.TriggerRunRequest))
+	if err != nil {
+		t.Fatal("TriggerRun:", err)
+	}
+	report := new(execlib.Report)
+	if err := json.Unmarshal(triggerRun.Json, report); err != nil {
+		t.Fatalf("TriggerRun report = %q: %v", triggerRun.Json, err)
+	}
+	if rr := report.Resource(42); rr == nil || rr.Status != execlib.StatusUnchanged {
+		t.Errorf("TriggerRun report for resource 42 = %+v; want status %q", rr, execlib.StatusUnchanged)
+	}
+
+	status, err := client.GetStatus(ctx, new(agentrpc.GetStatusRequest))
+	if err != nil {
+		t.Fatal("GetStatus:", err)
+	}
+	if status.State != agentrpc.Status_IDLE || status.RunCount != 1 || status.LastError != "" {
+		t.Errorf("status = {state: %v, run_count: %d, last_error: %q}; want {state: IDLE, run_count: 1, last_error: \"\"}", status.State, status.RunCount, status.LastError)
+	}
+	if status.LastRunStart == 0 || status.LastRunEnd < status.LastRunStart {
+		t.Errorf("status = {last_run_start: %d, last_run_end: %d}; want non-zero, ordered times", status.LastRunStart, status.LastRunEnd)
+	}
+
+	if status.Paused {
+		t.Error("status.paused = true before Pause")
+	}
+	if _, err := client.Pause(ctx, new(agentrpc.PauseRequest)); err != nil {
+		t.Fatal("Pause:", err)
+	}
+	if !cs.Agent.Status().Paused {
+		t.Error("agent not paused after Pause")
+	}
+	if status, err := client.GetStatus(ctx, new(agentrpc.GetStatusRequest)); err != nil {
+		t.Error("GetStatus after Pause:", err)
+	} else if !status.Paused {
+		t.Error("status.paused = false after Pause")
+	}
+	if _, err := client.Resume(ctx, new(agentrpc.ResumeRequest)); err != nil {
+		t.Fatal("Resume:", err)
+	}
+	if cs.Agent.Status().Paused {
+		t.Error("agent still paused after Resume")
+	}
+
+	lastReport, err := client.GetLastReport(ctx, new(agentrpc.GetLastReportRequest))
+	if err != nil {
+		t.Fatal("GetLastReport:", err)
+	}
+	if len(lastReport.Json) == 0 {
+		t.Error("GetLastReport after run returned an empty report")
+	}
+}
+
+func TestControlServerStreamLogs(t *testing.T) {
+	logs := new(LogHub)
+	cs := &ControlServer{
+		Agent: &Agent{Fetcher: new(Fetcher)},
+		Logs:  logs,
+	}
+	client, cleanup := startControlServer(t, cs)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.StreamLogs(ctx, new(agentrpc.StreamLogsRequest))
+	if err != nil {
+		t.Fatal("StreamLogs:", err)
+	}
+	// Wait for the stream to start before publishing.  The server sends
+	// its headers once it has subscribed.
+	if _, err := stream.Header(); err != nil {
+		t.Fatal("StreamLogs header:", err)
+	}
+	const want = "Hello, World!"
+	logs.Publish(LogEntry{Time: time.Now(), Severity: "INFO", Message: want, RunID: "run-1"})
+	e, err := stream.Recv()
+	if err != nil {
+		t.Fatal("StreamLogs receive:", err)
+	}
+	if e.Message != want || e.RunId != "run-1" {
+		t.Errorf("log message and run ID = %q, %q; want %q, %q", e.Message, e.RunId, want, "run-1")
+	}
+}
+
+// startControlServer serves cs on a local port and returns a client
+// connected to it.
+func startControlServer(t *testing.T, cs *ControlServer) (client agentrpc.AgentClient, cleanup func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer()
+	agentrpc.RegisterAgentServer(s, cs)
+	go s.Serve(l)
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		s.Stop()
+		t.Fatal(err)
+	}
+	return agentrpc.NewAgentClient(conn), func() {
+		conn.Close()
+		s.Stop()
+	}
+}
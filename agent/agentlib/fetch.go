@@ -0,0 +1,383 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package agentlib provides the functionality of the mcm-agent tool.
+package agentlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catcrypt"
+	"github.com/zombiezen/mcm/internal/delta"
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+	"github.com/zombiezen/mcm/third_party/golang/crypto/ed25519"
+)
+
+// Cache file names inside of Fetcher.CacheDir.
+const (
+	cacheCatalogName = "catalog.bin"
+	cacheMetaName    = "catalog.json"
+)
+
+// SignatureSuffix is appended to a catalog's URL to obtain the
+// location of its signature.
+const SignatureSuffix = ".sig"
+
+// A Fetcher downloads catalogs from a server, keeping the last good
+// catalog on disk to reduce transfers and to survive server outages.
+type Fetcher struct {
+	// URL is the location of the catalog.
+	URL string
+
+	// CacheDir is the directory where the last good catalog is stored.
+	// If empty, then no caching is performed.
+	CacheDir string
+
+	// PublicKey is the Ed25519 key that catalogs must be signed with.
+	// If nil, then signatures are not checked.
+	PublicKey ed25519.PublicKey
+
+	// Key decrypts catalogs that were encrypted with catcrypt.  If nil,
+	// then encrypted catalogs cannot be read.  Catalogs are cached in the
+	// form they were downloaded, so they stay encrypted at rest.
+	Key *catcrypt.Key
+
+	// Downloader makes the HTTP requests.  If nil, then a zero
+	// download.Downloader is used.
+	Downloader *download.Downloader
+
+	// Delta requests that the server send only a delta from the cached
+	// catalog (see package delta).  Servers that don't support deltas
+	// send the full catalog.
+	Delta bool
+
+	// Log receives warnings if non-nil.
+	Log Logger
+
+	fallbacks int64
+	deltas    int64
+}
+
+// Logger collects messages from a Fetcher.  A Logger must be safe to
+// call from multiple goroutines.
+type Logger interface {
+	Infof(ctx context.Context, format string, args ...interface{})
+	Error(ctx context.Context, err error)
+}
+
+// FetchResult is a catalog returned from a successful Fetch.
+type FetchResult struct {
+	Catalog catalog.Catalog
+
+	// Data is the catalog's serialized form, as it was downloaded.  It
+	// may be encrypted.
+	Data []byte
+
+	// Cached is true if the catalog was read from the cache instead of
+	// being downloaded.
+	Cached bool
+
+	// Fallback is true if the catalog was read from the cache because
+	// the server could not be reached.
+	Fallback bool
+}
+
+// cacheMeta is the JSON structure stored alongside the cached catalog.
+type cacheMeta struct {
+	URL          string `json:"url"`
+	LastModified string `json:"lastModified,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+}
+
+// Fetch obtains the latest catalog.  If the server reports that the
+// catalog has not changed since the last fetch, or the server cannot be
+// reached, then the cached catalog is returned.
+func (f *Fetcher) Fetch(ctx context.Context) (*FetchResult, error) {
+	meta, cached := f.readCache()
+	data, newMeta, err := f.download(ctx, meta, cached, f.Delta)
+	if _, bad := err.(*badDeltaError); bad {
+		f.logf(ctx, "fetch %s: %v; fetching full catalog", f.URL, err)
+		data, newMeta, err = f.download(ctx, meta, cached, false)
+	}
+	if err == errNotModified {
+		r, err := f.parseResult(cached)
+		if err != nil {
+			return nil, fmt.Errorf("fetch %s: read cache: %v", f.URL, err)
+		}
+		r.Cached = true
+		return r, nil
+	}
+	if _, unreachable := err.(*unreachableError); unreachable && cached != nil {
+		atomic.AddInt64(&f.fallbacks, 1)
+		f.warnf(ctx, "fetch %s: %v; using cached catalog", f.URL, err)
+		r, cerr := f.parseResult(cached)
+		if cerr != nil {
+			return nil, fmt.Errorf("fetch %s: %v (cache unusable: %v)", f.URL, err, cerr)
+		}
+		r.Cached = true
+		r.Fallback = true
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", f.URL, err)
+	}
+	r, err := f.parseResult(data)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", f.URL, err)
+	}
+	if err := f.writeCache(newMeta, data); err != nil {
+		f.logf(ctx, "fetch %s: write cache: %v", f.URL, err)
+	}
+	return r, nil
+}
+
+// Fallbacks returns the number of times that Fetch has returned a
+// cached catalog because the server was unreachable.
+func (f *Fetcher) Fallbacks() int64 {
+	return atomic.LoadInt64(&f.fallbacks)
+}
+
+// Deltas returns the number of times that Fetch has downloaded a delta
+// instead of the full catalog.
+func (f *Fetcher) Deltas() int64 {
+	return atomic.LoadInt64(&f.deltas)
+}
+
+var errNotModified = errors.New("not modified")
+
+// badDeltaError is returned by download when the server sent a delta
+// that couldn't be applied to the cached catalog.
+type badDeltaError struct {
+	err error
+}
+
+func (e *badDeltaError) Error() string {
+	return e.err.Error()
+}
+
+// unreachableError is returned by download when the failure is likely
+// transient and using a cached catalog is appropriate.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string {
+	return e.err.Error()
+}
+
+// download fetches the catalog, or a delta from cached if wantDelta is
+// true and the cache has an ETag.
+func (f *Fetcher) download(ctx context.Context, meta *cacheMeta, cached []byte, wantDelta bool) ([]byte, *cacheMeta, error) {
+	header := make(http.Header)
+	if meta != nil && meta.URL == f.URL {
+		if meta.LastModified != "" {
+			header.Set("If-Modified-Since", meta.LastModified)
+		}
+		if meta.ETag != "" {
+			header.Set("If-None-Match", meta.ETag)
+			if wantDelta && cached != nil {
+				header.Set("A-IM", delta.Encoding)
+			}
+		}
+	}
+	resp, err := f.downloader().Get(ctx, f.URL, header)
+	if err != nil {
+		if isUnreachable(err) {
+			return nil, nil, &unreachableError{err}
+		}
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	isDelta := false
+	switch {
+	case resp.StatusCode == http.StatusNotModified && meta != nil:
+		return nil, nil, errNotModified
+	case resp.StatusCode == http.StatusIMUsed && header.Get("A-IM") != "":
+		if im := resp.Header.Get("IM"); im != delta.Encoding {
+			return nil, nil, &badDeltaError{fmt.Errorf("server used unknown instance manipulation %q", im)}
+		}
+		isDelta = true
+	case resp.StatusCode != http.StatusOK:
+		return nil, nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, &unreachableError{err}
+	}
+	if isDelta {
+		data, err = delta.Patch(cached, data)
+		if err != nil {
+			return nil, nil, &badDeltaError{err}
+		}
+		atomic.AddInt64(&f.deltas, 1)
+	}
+	if f.PublicKey != nil {
+		if err := f.verify(ctx, data); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, &cacheMeta{
+		URL:          f.URL,
+		LastModified: resp.Header.Get("Last-Modified"),
+		ETag:         resp.Header.Get("ETag"),
+	}, nil
+}
+
+// verify downloads the catalog's signature and checks it against data.
+// The signature is expected to be base64-encoded.
+func (f *Fetcher) verify(ctx context.Context, data []byte) error {
+	encSig, err := f.downloader().Fetch(ctx, f.URL+SignatureSuffix)
+	if isUnreachable(err) {
+		return &unreachableError{fmt.Errorf("signature: %v", err)}
+	}
+	if err != nil {
+		return fmt.Errorf("signature: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encSig)))
+	if err != nil {
+		return fmt.Errorf("signature: %v", err)
+	}
+	if !ed25519.Verify(f.PublicKey, data, sig) {
+		return errors.New("signature does not match catalog")
+	}
+	return nil
+}
+
+// isUnreachable reports whether the downloader considers err
+// transient.
+func isUnreachable(err error) bool {
+	_, ok := err.(*download.UnreachableError)
+	return ok
+}
+
+func (f *Fetcher) downloader() *download.Downloader {
+	if f.Downloader == nil {
+		return defaultDownloader
+	}
+	return f.Downloader
+}
+
+var defaultDownloader = new(download.Downloader)
+
+func (f *Fetcher) logf(ctx context.Context, format string, args ...interface{}) {
+	if f.Log == nil {
+		return
+	}
+	f.Log.Infof(ctx, format, args...)
+}
+
+func (f *Fetcher) warnf(ctx context.Context, format string, args ...interface{}) {
+	f.logf(ctx, "warning: "+format, args...)
+}
+
+// readCache returns the cached catalog and its metadata or nils if the
+// cache is empty or unreadable.
+func (f *Fetcher) readCache() (*cacheMeta, []byte) {
+	if f.CacheDir == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(f.CacheDir, cacheCatalogName))
+	if err != nil {
+		return nil, nil
+	}
+	metaData, err := ioutil.ReadFile(filepath.Join(f.CacheDir, cacheMetaName))
+	if err != nil {
+		return nil, data
+	}
+	meta := new(cacheMeta)
+	if err := json.Unmarshal(metaData, meta); err != nil {
+		return nil, data
+	}
+	return meta, data
+}
+
+func (f *Fetcher) writeCache(meta *cacheMeta, data []byte) error {
+	if f.CacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(f.CacheDir, 0700); err != nil {
+		return err
+	}
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// Write the catalog before the metadata so that a partial write
+	// never pairs new validators with an old catalog.
+	if err := writeFileAtomic(filepath.Join(f.CacheDir, cacheCatalogName), data); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(f.CacheDir, cacheMetaName), metaData)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// as path, then renames it into place.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (f *Fetcher) parseResult(data []byte) (*FetchResult, error) {
+	if data == nil {
+		return nil, errors.New("no cached catalog")
+	}
+	plain := data
+	if catcrypt.IsEncrypted(data) {
+		if f.Key == nil {
+			return nil, errors.New("catalog is encrypted, but no key was given")
+		}
+		var err error
+		plain, err = catcrypt.Decrypt(f.Key, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	msg, err := capnp.NewDecoder(bytes.NewReader(plain)).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("read catalog: %v", err)
+	}
+	c, err := catalog.ReadRootCatalog(msg)
+	if err != nil {
+		return nil, fmt.Errorf("read catalog: %v", err)
+	}
+	return &FetchResult{Catalog: c, Data: data}, nil
+}
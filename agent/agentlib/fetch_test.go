@@ -0,0 +1,326 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catcrypt"
+	"github.com/zombiezen/mcm/internal/catpogs"
+	"github.com/zombiezen/mcm/internal/delta"
+	"github.com/zombiezen/mcm/third_party/golang/crypto/ed25519"
+)
+
+func TestFetch(t *testing.T) {
+	data := marshalTestCatalog(t)
+	modTime := time.Date(2017, time.March, 1, 0, 0, 0, 0, time.UTC)
+	srv := new(fakeServer)
+	srv.set(data, "", modTime)
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "agentlib_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	f := &Fetcher{URL: hs.URL + "/catalog", CacheDir: dir}
+	r, err := f.Fetch(ctx)
+	if err != nil {
+		t.Fatal("first Fetch:", err)
+	}
+	if r.Cached || !bytes.Equal(r.Data, data) {
+		t.Errorf("first Fetch = {Cached: %t, Data: %q}; want {Cached: false, Data: %q}", r.Cached, r.Data, data)
+	}
+
+	r, err = f.Fetch(ctx)
+	if err != nil {
+		t.Fatal("second Fetch:", err)
+	}
+	if !r.Cached || r.Fallback || !bytes.Equal(r.Data, data) {
+		t.Errorf("second Fetch = {Cached: %t, Fallback: %t}; want {Cached: true, Fallback: false}", r.Cached, r.Fallback)
+	}
+	if n := srv.notModifiedCount(); n != 1 {
+		t.Errorf("server sent %d Not Modified responses; want 1", n)
+	}
+
+	srv.fail(true)
+	r, err = f.Fetch(ctx)
+	if err != nil {
+		t.Fatal("Fetch with server down:", err)
+	}
+	if !r.Fallback || !bytes.Equal(r.Data, data) {
+		t.Errorf("Fetch with server down = {Fallback: %t}; want {Fallback: true}", r.Fallback)
+	}
+	if n := f.Fallbacks(); n != 1 {
+		t.Errorf("f.Fallbacks() = %d; want 1", n)
+	}
+}
+
+func TestFetchNoCacheUnreachable(t *testing.T) {
+	srv := new(fakeServer)
+	srv.fail(true)
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "agentlib_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &Fetcher{URL: hs.URL + "/catalog", CacheDir: dir}
+	if _, err := f.Fetch(context.Background()); err == nil {
+		t.Error("Fetch succeeded with server down and no cache")
+	}
+}
+
+func TestFetchSignature(t *testing.T) {
+	data := marshalTestCatalog(t)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Good", func(t *testing.T) {
+		srv := new(fakeServer)
+		srv.set(data, base64.StdEncoding.EncodeToString(ed25519.Sign(priv, data)), time.Time{})
+		hs := httptest.NewServer(srv)
+		defer hs.Close()
+		f := &Fetcher{URL: hs.URL + "/catalog", PublicKey: pub}
+		if _, err := f.Fetch(context.Background()); err != nil {
+			t.Error("Fetch:", err)
+		}
+	})
+	t.Run("Bad", func(t *testing.T) {
+		srv := new(fakeServer)
+		srv.set(data, base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte("foo"))), time.Time{})
+		hs := httptest.NewServer(srv)
+		defer hs.Close()
+		f := &Fetcher{URL: hs.URL + "/catalog", PublicKey: pub}
+		if _, err := f.Fetch(context.Background()); err == nil {
+			t.Error("Fetch succeeded with bad signature")
+		}
+	})
+}
+
+func TestFetchEncrypted(t *testing.T) {
+	data := marshalTestCatalog(t)
+	key, err := catcrypt.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := catcrypt.Encrypt(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := new(fakeServer)
+	srv.set(enc, "", time.Time{})
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "agentlib_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := &Fetcher{URL: hs.URL + "/catalog", CacheDir: dir, Key: key}
+	r, err := f.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("Fetch:", err)
+	}
+	res, _ := r.Catalog.Resources()
+	if res.Len() != 1 || res.At(0).ID() != 42 {
+		t.Error("Fetch returned wrong catalog")
+	}
+	cached, err := ioutil.ReadFile(filepath.Join(dir, cacheCatalogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, enc) {
+		t.Error("cached catalog is not the encrypted catalog")
+	}
+
+	f = &Fetcher{URL: hs.URL + "/catalog"}
+	if _, err := f.Fetch(context.Background()); err == nil {
+		t.Error("Fetch of encrypted catalog without key succeeded")
+	}
+}
+
+func TestFetchDelta(t *testing.T) {
+	old := marshalNoopCatalog(t, "noop")
+	cur := marshalNoopCatalog(t, "new noop")
+	srv := &deltaServer{base: old, data: cur}
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "agentlib_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := (&Fetcher{URL: hs.URL + "/catalog", CacheDir: dir}).writeCache(&cacheMeta{URL: hs.URL + "/catalog", ETag: etagOf(old)}, old); err != nil {
+		t.Fatal("writeCache:", err)
+	}
+
+	ctx := context.Background()
+	f := &Fetcher{URL: hs.URL + "/catalog", CacheDir: dir, Delta: true}
+	r, err := f.Fetch(ctx)
+	if err != nil {
+		t.Fatal("Fetch:", err)
+	}
+	if r.Cached || !bytes.Equal(r.Data, cur) {
+		t.Errorf("Fetch = {Cached: %t, Data: %q}; want {Cached: false, Data: %q}", r.Cached, r.Data, cur)
+	}
+	if n := f.Deltas(); n != 1 {
+		t.Errorf("f.Deltas() = %d; want 1", n)
+	}
+	cached, err := ioutil.ReadFile(filepath.Join(dir, cacheCatalogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, cur) {
+		t.Error("cached catalog is not the patched catalog")
+	}
+
+	// A delta that doesn't apply is retried as a full fetch.
+	if err := f.writeCache(&cacheMeta{URL: hs.URL + "/catalog", ETag: etagOf(old)}, old); err != nil {
+		t.Fatal("writeCache:", err)
+	}
+	srv.corrupt = true
+	r, err = f.Fetch(ctx)
+	if err != nil {
+		t.Fatal("Fetch with corrupt delta:", err)
+	}
+	if !bytes.Equal(r.Data, cur) {
+		t.Errorf("Fetch with corrupt delta Data = %q; want %q", r.Data, cur)
+	}
+	if n := f.Deltas(); n != 1 {
+		t.Errorf("after corrupt delta, f.Deltas() = %d; want 1", n)
+	}
+}
+
+// deltaServer serves data, sending deltas to clients that have base.
+type deltaServer struct {
+	base    []byte
+	data    []byte
+	corrupt bool
+}
+
+func (srv *deltaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", etagOf(srv.data))
+	if r.Header.Get("A-IM") == delta.Encoding && r.Header.Get("If-None-Match") == etagOf(srv.base) {
+		d := delta.Diff(srv.base, srv.data)
+		if srv.corrupt {
+			d = d[:len(d)-1]
+		}
+		w.Header().Set("IM", delta.Encoding)
+		w.WriteHeader(http.StatusIMUsed)
+		w.Write(d)
+		return
+	}
+	w.Write(srv.data)
+}
+
+func etagOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func marshalTestCatalog(t *testing.T) []byte {
+	return marshalNoopCatalog(t, "noop")
+}
+
+func marshalNoopCatalog(t *testing.T, comment string) []byte {
+	c, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: comment,
+				Which:   catalog.Resource_Which_noop,
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	data, err := c.Segment().Message().Marshal()
+	if err != nil {
+		t.Fatal("Marshal:", err)
+	}
+	return data
+}
+
+type fakeServer struct {
+	mu          sync.Mutex
+	data        []byte
+	sig         string
+	modTime     time.Time
+	down        bool
+	notModified int
+}
+
+func (srv *fakeServer) set(data []byte, sig string, modTime time.Time) {
+	srv.mu.Lock()
+	srv.data = data
+	srv.sig = sig
+	srv.modTime = modTime
+	srv.mu.Unlock()
+}
+
+func (srv *fakeServer) fail(down bool) {
+	srv.mu.Lock()
+	srv.down = down
+	srv.mu.Unlock()
+}
+
+func (srv *fakeServer) notModifiedCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.notModified
+}
+
+func (srv *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.down {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path == "/catalog"+SignatureSuffix {
+		w.Write([]byte(srv.sig))
+		return
+	}
+	if !srv.modTime.IsZero() {
+		if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !srv.modTime.After(t) {
+			srv.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", srv.modTime.Format(http.TimeFormat))
+	}
+	w.Write(srv.data)
+}
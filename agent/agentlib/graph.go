@@ -0,0 +1,227 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentlib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/depgraph"
+)
+
+// A Graph is the resource graph of the catalog in an agent's current or
+// most recent run, along with the status of each resource in that run.
+// It has the same nodes and edges that mcm-dot draws.  Graphs can be
+// serialized with encoding/json.
+type Graph struct {
+	// Running is true if the run is still in progress.
+	Running bool `json:"running"`
+
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// A GraphNode is a resource in a Graph.
+type GraphNode struct {
+	ID uint64 `json:"id"`
+
+	// Label is the resource's name, comment, or ID, in that order of
+	// preference.
+	Label   string `json:"label"`
+	Barrier bool   `json:"barrier,omitempty"`
+
+	// Status is NodePending, NodeRunning, or the resource's
+	// execlib.ResourceStatus once it has finished.
+	Status string `json:"status"`
+
+	// Error is the failure message for a failed resource.
+	Error string `json:"error,omitempty"`
+}
+
+// Graph node statuses for resources that have not finished.
+const (
+	NodePending = "pending"
+	NodeRunning = "running"
+)
+
+// A GraphEdge is a dependency of resource From on resource To.
+type GraphEdge struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+
+	// Implicit is true for dependencies added by barriers.
+	Implicit bool `json:"implicit,omitempty"`
+}
+
+// liveGraph is a Graph that is updated as a run progresses.
+type liveGraph struct {
+	mu    sync.Mutex
+	g     Graph
+	index map[uint64]int
+}
+
+func newLiveGraph(c catalog.Catalog) (*liveGraph, error) {
+	resources, err := c.Resources()
+	if err != nil {
+		return nil, err
+	}
+	dg, err := depgraph.New(resources)
+	if err != nil {
+		return nil, err
+	}
+	n := resources.Len()
+	lg := &liveGraph{
+		g: Graph{
+			Running: true,
+			Nodes:   make([]GraphNode, 0, n),
+		},
+		index: make(map[uint64]int, n),
+	}
+	for i := 0; i < n; i++ {
+		r := resources.At(i)
+		id := r.ID()
+		node := GraphNode{
+			ID:      id,
+			Barrier: r.Which() == catalog.Resource_Which_barrier,
+			Status:  NodePending,
+		}
+		if name, _ := r.Name(); name != "" {
+			node.Label = name
+		} else if c, _ := r.Comment(); c != "" {
+			node.Label = c
+		} else {
+			node.Label = strconv.FormatUint(id, 10)
+		}
+		lg.index[id] = len(lg.g.Nodes)
+		lg.g.Nodes = append(lg.g.Nodes, node)
+		deps, _ := r.Dependencies()
+		for j := 0; j < deps.Len(); j++ {
+			lg.g.Edges = append(lg.g.Edges, GraphEdge{From: id, To: deps.At(j)})
+		}
+		for _, d := range dg.ImplicitDependencies(id) {
+			lg.g.Edges = append(lg.g.Edges, GraphEdge{From: id, To: d, Implicit: true})
+		}
+	}
+	return lg, nil
+}
+
+func (lg *liveGraph) setStatus(id uint64, status string, msg string) {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if i, ok := lg.index[id]; ok {
+		lg.g.Nodes[i].Status = status
+		lg.g.Nodes[i].Error = msg
+	}
+}
+
+func (lg *liveGraph) finish() {
+	lg.mu.Lock()
+	lg.g.Running = false
+	lg.mu.Unlock()
+}
+
+// snapshot returns a copy of the graph's current state.
+func (lg *liveGraph) snapshot() *Graph {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	g := &Graph{
+		Running: lg.g.Running,
+		Nodes:   make([]GraphNode, len(lg.g.Nodes)),
+		Edges:   lg.g.Edges,
+	}
+	copy(g.Nodes, lg.g.Nodes)
+	return g
+}
+
+// graphLogger is an execlib.LeveledLogger that updates a liveGraph from
+// the events of the messages it receives, then passes the messages on
+// to log if it is non-nil.
+type graphLogger struct {
+	log   execlib.Logger
+	graph *liveGraph
+}
+
+func (gl *graphLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	gl.observe(ctx, "")
+	if gl.log != nil {
+		gl.log.Infof(ctx, format, args...)
+	}
+}
+
+func (gl *graphLogger) Debugf(ctx context.Context, v execlib.Verbosity, format string, args ...interface{}) {
+	gl.observe(ctx, "")
+	if ll, ok := gl.log.(execlib.LeveledLogger); ok {
+		ll.Debugf(ctx, v, format, args...)
+	}
+}
+
+func (gl *graphLogger) Error(ctx context.Context, err error) {
+	gl.observe(ctx, err.Error())
+	if gl.log != nil {
+		gl.log.Error(ctx, err)
+	}
+}
+
+func (gl *graphLogger) observe(ctx context.Context, msg string) {
+	ev := execlib.EventFromContext(ctx)
+	if ev == nil {
+		return
+	}
+	switch ev.Kind {
+	case execlib.EventStart:
+		gl.graph.setStatus(ev.ResourceID, NodeRunning, "")
+	case execlib.EventResult, execlib.EventError:
+		gl.graph.setStatus(ev.ResourceID, string(ev.Status), msg)
+	case execlib.EventSkip:
+		for _, id := range ev.Skipped {
+			gl.graph.setStatus(id, string(execlib.StatusSkipped), "")
+		}
+	}
+}
+
+// GraphServer is an HTTP handler that serves a web page drawing an
+// agent's Graph, colored by the status of each resource and refreshed
+// while a run is in progress.  Requests with the query parameter
+// format=json get the Graph as JSON instead, or null if the agent has
+// not fetched a catalog yet.
+type GraphServer struct {
+	Agent *Agent
+}
+
+func (gs *GraphServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.URL.Query().Get("format") != "json" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(graphPage))
+		return
+	}
+	data, err := json.Marshal(gs.Agent.Graph())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentlib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catpogs"
+	"github.com/zombiezen/mcm/internal/system/fakesystem"
+)
+
+func TestAgentGraph(t *testing.T) {
+	c, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:    1,
+				Name:  "ok",
+				Which: catalog.Resource_Which_noop,
+			},
+			{
+				ID:    2,
+				Which: catalog.Resource_Which_barrier,
+			},
+			{
+				ID:      3,
+				Comment: "no parent directory",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(fakesystem.Root+"nonexistent/foo", []byte("hi")),
+			},
+			{
+				ID:    4,
+				Deps:  []uint64{3},
+				Which: catalog.Resource_Which_noop,
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	data, err := c.Segment().Message().Marshal()
+	if err != nil {
+		t.Fatal("Marshal:", err)
+	}
+	catalogSrv := new(fakeServer)
+	catalogSrv.set(data, "", time.Time{})
+	hs := httptest.NewServer(catalogSrv)
+	defer hs.Close()
+
+	a := &Agent{
+		Fetcher: &Fetcher{URL: hs.URL},
+		System:  new(fakesystem.System),
+	}
+	if g := a.Graph(); g != nil {
+		t.Errorf("Graph() before run = %+v; want nil", g)
+	}
+	if _, err := a.Run(context.Background()); err == nil {
+		t.Error("Run did not return an error")
+	}
+	g := a.Graph()
+	if g == nil {
+		t.Fatal("Graph() after run = nil")
+	}
+	if g.Running {
+		t.Error("Graph().Running = true after run")
+	}
+	wantNodes := []GraphNode{
+		{ID: 1, Label: "ok", Status: "unchanged"},
+		{ID: 2, Label: "2", Barrier: true, Status: "unchanged"},
+		{ID: 3, Label: "no parent directory", Status: "failed"},
+		{ID: 4, Label: "4", Status: "skipped"},
+	}
+	if len(g.Nodes) != len(wantNodes) {
+		t.Fatalf("Graph().Nodes = %+v; want %+v", g.Nodes, wantNodes)
+	}
+	for i, want := range wantNodes {
+		got := g.Nodes[i]
+		if got.Error == "" && want.Status == "failed" {
+			t.Errorf("Nodes[%d].Error is empty", i)
+		}
+		got.Error = ""
+		if got != want {
+			t.Errorf("Nodes[%d] = %+v; want %+v", i, got, want)
+		}
+	}
+	wantEdges := map[GraphEdge]bool{
+		{From: 2, To: 1, Implicit: true}: true,
+		{From: 3, To: 2, Implicit: true}: true,
+		{From: 4, To: 2, Implicit: true}: true,
+		{From: 4, To: 3}:                 true,
+	}
+	for _, e := range g.Edges {
+		if !wantEdges[e] {
+			t.Errorf("unexpected edge %+v", e)
+		}
+		delete(wantEdges, e)
+	}
+	for e := range wantEdges {
+		t.Errorf("missing edge %+v", e)
+	}
+
+	gs := httptest.NewServer(&GraphServer{Agent: a})
+	defer gs.Close()
+	resp, err := http.Get(gs.URL + "/?format=json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var served Graph
+	err = json.NewDecoder(resp.Body).Decode(&served)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal("decode graph JSON:", err)
+	}
+	if len(served.Nodes) != len(g.Nodes) || len(served.Edges) != len(g.Edges) {
+		t.Errorf("served graph has %d nodes and %d edges; want %d and %d", len(served.Nodes), len(served.Edges), len(g.Nodes), len(g.Edges))
+	}
+	resp, err = http.Get(gs.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("page Content-Type = %q; want text/html", ct)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentlib
+
+// graphPage is the web page served by GraphServer.  It polls the
+// server for the graph as JSON and lays the resources out in columns,
+// with each resource to the right of everything it depends on.
+const graphPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mcm-agent resource graph</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+#status { margin-bottom: 1em; }
+.legend span { display: inline-block; padding: 0.1em 0.5em; margin-right: 0.5em; border: 1px solid #666; }
+svg text { font-size: 12px; pointer-events: none; }
+svg line { stroke: #666; }
+svg line.implicit { stroke-dasharray: 4 3; }
+</style>
+</head>
+<body>
+<div id="status">Loading&hellip;</div>
+<div class="legend" id="legend"></div>
+<svg id="graph" xmlns="http://www.w3.org/2000/svg">
+<defs>
+<marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto">
+<path d="M 0 0 L 10 5 L 0 10 z" fill="#666"/>
+</marker>
+</defs>
+<g id="edges"></g>
+<g id="nodes"></g>
+</svg>
+<script>
+"use strict";
+var colors = {
+  pending: "#eeeeee",
+  running: "#ffdd44",
+  unchanged: "#99dd99",
+  changed: "#77aaff",
+  failed: "#ee6666",
+  skipped: "#bbbbbb",
+  disabled: "#dddddd"
+};
+var svgNS = "http://www.w3.org/2000/svg";
+var nodeWidth = 180, nodeHeight = 28, colGap = 60, rowGap = 14, margin = 10;
+
+function el(name, attrs) {
+  var e = document.createElementNS(svgNS, name);
+  for (var k in attrs) {
+    e.setAttribute(k, attrs[k]);
+  }
+  return e;
+}
+
+function layout(graph) {
+  var deps = {}, col = {}, pos = {};
+  graph.nodes.forEach(function(n) { deps[n.id] = []; });
+  graph.edges.forEach(function(e) {
+    if (deps[e.from]) deps[e.from].push(e.to);
+  });
+  function column(id) {
+    if (col[id] !== undefined) return col[id];
+    col[id] = 0;
+    var c = 0;
+    deps[id].forEach(function(d) {
+      if (deps[d]) c = Math.max(c, column(d) + 1);
+    });
+    col[id] = c;
+    return c;
+  }
+  var rows = [];
+  graph.nodes.forEach(function(n) {
+    var c = column(n.id);
+    rows[c] = (rows[c] || 0);
+    pos[n.id] = {
+      x: margin + c * (nodeWidth + colGap),
+      y: margin + rows[c] * (nodeHeight + rowGap)
+    };
+    rows[c]++;
+  });
+  var maxRows = 0;
+  rows.forEach(function(r) { maxRows = Math.max(maxRows, r || 0); });
+  return {
+    pos: pos,
+    width: 2 * margin + rows.length * (nodeWidth + colGap),
+    height: 2 * margin + maxRows * (nodeHeight + rowGap)
+  };
+}
+
+function draw(graph) {
+  var svg = document.getElementById("graph");
+  var nodes = document.getElementById("nodes");
+  var edges = document.getElementById("edges");
+  nodes.textContent = "";
+  edges.textContent = "";
+  var l = layout(graph);
+  svg.setAttribute("width", l.width);
+  svg.setAttribute("height", l.height);
+  graph.edges.forEach(function(e) {
+    var from = l.pos[e.from], to = l.pos[e.to];
+    if (!from || !to) return;
+    edges.appendChild(el("line", {
+      x1: from.x, y1: from.y + nodeHeight / 2,
+      x2: to.x + nodeWidth, y2: to.y + nodeHeight / 2,
+      "class": e.implicit ? "implicit" : "",
+      "marker-end": "url(#arrow)"
+    }));
+  });
+  var counts = {};
+  graph.nodes.forEach(function(n) {
+    counts[n.status] = (counts[n.status] || 0) + 1;
+    var p = l.pos[n.id];
+    var g = el("g", {});
+    var rect = el("rect", {
+      x: p.x, y: p.y, width: nodeWidth, height: nodeHeight,
+      rx: n.barrier ? 0 : 6,
+      fill: colors[n.status] || "#ffffff", stroke: "#333"
+    });
+    var title = el("title", {});
+    title.textContent = n.label + " (" + n.id + "): " + n.status + (n.error ? "\n" + n.error : "");
+    rect.appendChild(title);
+    g.appendChild(rect);
+    var label = n.label.length > 26 ? n.label.slice(0, 25) + "…" : n.label;
+    var text = el("text", {x: p.x + 6, y: p.y + nodeHeight / 2 + 4});
+    text.textContent = label;
+    g.appendChild(text);
+    nodes.appendChild(g);
+  });
+  var legend = document.getElementById("legend");
+  legend.textContent = "";
+  Object.keys(colors).forEach(function(s) {
+    var span = document.createElement("span");
+    span.style.background = colors[s];
+    span.textContent = s + ": " + (counts[s] || 0);
+    legend.appendChild(span);
+  });
+}
+
+function refresh() {
+  var req = new XMLHttpRequest();
+  req.onload = function() {
+    var graph, delay = 10000;
+    try {
+      graph = JSON.parse(req.responseText);
+    } catch (e) {
+      document.getElementById("status").textContent = "Error: " + e;
+      setTimeout(refresh, delay);
+      return;
+    }
+    if (graph === null) {
+      document.getElementById("status").textContent = "No catalog has been fetched yet.";
+    } else {
+      document.getElementById("status").textContent = graph.running ? "Run in progress" : "Last run finished";
+      draw(graph);
+      if (graph.running) delay = 1000;
+    }
+    setTimeout(refresh, delay);
+  };
+  req.onerror = function() {
+    document.getElementById("status").textContent = "Could not reach the agent.";
+    setTimeout(refresh, 10000);
+  };
+  req.open("GET", "?format=json");
+  req.send();
+}
+
+refresh();
+</script>
+</body>
+</html>
+`
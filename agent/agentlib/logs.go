@@ -0,0 +1,80 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agentlib
+
+import (
+	"sync"
+	"time"
+)
+
+// A LogEntry is a single message from the agent's log.
+type LogEntry struct {
+	Time     time.Time
+	Severity string
+	Message  string
+
+	// RunID and SpanID identify the run and resource that the message
+	// is about, if any.  See execlib.RunIDFromContext and
+	// execlib.Event.
+	RunID  string
+	SpanID string
+}
+
+// logBufferSize is the number of entries that a subscriber can fall
+// behind by before entries are dropped.
+const logBufferSize = 64
+
+// A LogHub distributes log entries to subscribers.  The zero value is
+// an empty hub.  It is safe to call a LogHub's methods from multiple
+// goroutines.
+type LogHub struct {
+	mu   sync.Mutex
+	subs map[chan LogEntry]struct{}
+}
+
+// Publish sends an entry to all current subscribers.  Publish never
+// blocks: subscribers that are not keeping up miss entries.
+func (h *LogHub) Publish(e LogEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives published entries.  The
+// caller must call cancel once it no longer needs entries, which closes
+// the channel.
+func (h *LogHub) Subscribe() (entries <-chan LogEntry, cancel func()) {
+	c := make(chan LogEntry, logBufferSize)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[chan LogEntry]struct{})
+	}
+	h.subs[c] = struct{}{}
+	h.mu.Unlock()
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, c)
+			h.mu.Unlock()
+			close(c)
+		})
+	}
+}
@@ -0,0 +1,611 @@
+// Code generated by protoc-gen-go.
+// source: agent.proto
+// DO NOT EDIT!
+
+/*
+Package agentrpc is a generated protocol buffer package.
+
+It is generated from these files:
+
+	agent.proto
+
+It has these top-level messages:
+
+	TriggerRunRequest
+	GetStatusRequest
+	StreamLogsRequest
+	GetLastReportRequest
+	PauseRequest
+	PauseResponse
+	ResumeRequest
+	ResumeResponse
+	Report
+	Status
+	LogEntry
+*/
+package agentrpc
+
+import proto "github.com/zombiezen/mcm/third_party/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	grpc "github.com/zombiezen/mcm/third_party/golang/grpc"
+	context "github.com/zombiezen/mcm/third_party/golang/net/context"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type Status_State int32
+
+const (
+	Status_IDLE    Status_State = 0
+	Status_RUNNING Status_State = 1
+)
+
+var Status_State_name = map[int32]string{
+	0: "IDLE",
+	1: "RUNNING",
+}
+var Status_State_value = map[string]int32{
+	"IDLE":    0,
+	"RUNNING": 1,
+}
+
+func (x Status_State) String() string {
+	return proto.EnumName(Status_State_name, int32(x))
+}
+func (Status_State) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{9, 0} }
+
+type TriggerRunRequest struct {
+}
+
+func (m *TriggerRunRequest) Reset()                    { *m = TriggerRunRequest{} }
+func (m *TriggerRunRequest) String() string            { return proto.CompactTextString(m) }
+func (*TriggerRunRequest) ProtoMessage()               {}
+func (*TriggerRunRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+type GetStatusRequest struct {
+}
+
+func (m *GetStatusRequest) Reset()                    { *m = GetStatusRequest{} }
+func (m *GetStatusRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetStatusRequest) ProtoMessage()               {}
+func (*GetStatusRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+type StreamLogsRequest struct {
+}
+
+func (m *StreamLogsRequest) Reset()                    { *m = StreamLogsRequest{} }
+func (m *StreamLogsRequest) String() string            { return proto.CompactTextString(m) }
+func (*StreamLogsRequest) ProtoMessage()               {}
+func (*StreamLogsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+type GetLastReportRequest struct {
+}
+
+func (m *GetLastReportRequest) Reset()                    { *m = GetLastReportRequest{} }
+func (m *GetLastReportRequest) String() string            { return proto.CompactTextString(m) }
+func (*GetLastReportRequest) ProtoMessage()               {}
+func (*GetLastReportRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+type PauseRequest struct {
+}
+
+func (m *PauseRequest) Reset()                    { *m = PauseRequest{} }
+func (m *PauseRequest) String() string            { return proto.CompactTextString(m) }
+func (*PauseRequest) ProtoMessage()               {}
+func (*PauseRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+type PauseResponse struct {
+}
+
+func (m *PauseResponse) Reset()                    { *m = PauseResponse{} }
+func (m *PauseResponse) String() string            { return proto.CompactTextString(m) }
+func (*PauseResponse) ProtoMessage()               {}
+func (*PauseResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+type ResumeRequest struct {
+}
+
+func (m *ResumeRequest) Reset()                    { *m = ResumeRequest{} }
+func (m *ResumeRequest) String() string            { return proto.CompactTextString(m) }
+func (*ResumeRequest) ProtoMessage()               {}
+func (*ResumeRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+type ResumeResponse struct {
+}
+
+func (m *ResumeResponse) Reset()                    { *m = ResumeResponse{} }
+func (m *ResumeResponse) String() string            { return proto.CompactTextString(m) }
+func (*ResumeResponse) ProtoMessage()               {}
+func (*ResumeResponse) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+type Report struct {
+	// The JSON-encoded run report.
+	Json []byte `protobuf:"bytes,1,opt,name=json,proto3" json:"json,omitempty"`
+}
+
+func (m *Report) Reset()                    { *m = Report{} }
+func (m *Report) String() string            { return proto.CompactTextString(m) }
+func (*Report) ProtoMessage()               {}
+func (*Report) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *Report) GetJson() []byte {
+	if m != nil {
+		return m.Json
+	}
+	return nil
+}
+
+type Status struct {
+	State Status_State `protobuf:"varint,1,opt,name=state,enum=mcm.agent.Status_State" json:"state,omitempty"`
+	// Number of runs finished since the agent started.
+	RunCount uint64 `protobuf:"varint,2,opt,name=run_count,json=runCount" json:"run_count,omitempty"`
+	// Time bounds of the most recent finished run in nanoseconds since
+	// the Unix epoch.  Zero if no run has finished.
+	LastRunStart int64 `protobuf:"varint,3,opt,name=last_run_start,json=lastRunStart" json:"last_run_start,omitempty"`
+	LastRunEnd   int64 `protobuf:"varint,4,opt,name=last_run_end,json=lastRunEnd" json:"last_run_end,omitempty"`
+	// Error from the most recent run or empty if it succeeded.
+	LastError string `protobuf:"bytes,5,opt,name=last_error,json=lastError" json:"last_error,omitempty"`
+	// Number of times a cached catalog was used because the server
+	// could not be reached.
+	CatalogFallbacks int64 `protobuf:"varint,6,opt,name=catalog_fallbacks,json=catalogFallbacks" json:"catalog_fallbacks,omitempty"`
+	// Whether the agent has been paused and not resumed.
+	Paused bool `protobuf:"varint,7,opt,name=paused" json:"paused,omitempty"`
+}
+
+func (m *Status) Reset()                    { *m = Status{} }
+func (m *Status) String() string            { return proto.CompactTextString(m) }
+func (*Status) ProtoMessage()               {}
+func (*Status) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *Status) GetState() Status_State {
+	if m != nil {
+		return m.State
+	}
+	return Status_IDLE
+}
+
+func (m *Status) GetRunCount() uint64 {
+	if m != nil {
+		return m.RunCount
+	}
+	return 0
+}
+
+func (m *Status) GetLastRunStart() int64 {
+	if m != nil {
+		return m.LastRunStart
+	}
+	return 0
+}
+
+func (m *Status) GetLastRunEnd() int64 {
+	if m != nil {
+		return m.LastRunEnd
+	}
+	return 0
+}
+
+func (m *Status) GetLastError() string {
+	if m != nil {
+		return m.LastError
+	}
+	return ""
+}
+
+func (m *Status) GetCatalogFallbacks() int64 {
+	if m != nil {
+		return m.CatalogFallbacks
+	}
+	return 0
+}
+
+func (m *Status) GetPaused() bool {
+	if m != nil {
+		return m.Paused
+	}
+	return false
+}
+
+type LogEntry struct {
+	// Nanoseconds since the Unix epoch.
+	Time     int64  `protobuf:"varint,1,opt,name=time" json:"time,omitempty"`
+	Severity string `protobuf:"bytes,2,opt,name=severity" json:"severity,omitempty"`
+	Message  string `protobuf:"bytes,3,opt,name=message" json:"message,omitempty"`
+	// The run and resource that the entry is about, or empty.  run_id
+	// matches the run_id of the run's report and span_id the span_id of
+	// the resource's entry in it.
+	RunId  string `protobuf:"bytes,4,opt,name=run_id,json=runId" json:"run_id,omitempty"`
+	SpanId string `protobuf:"bytes,5,opt,name=span_id,json=spanId" json:"span_id,omitempty"`
+}
+
+func (m *LogEntry) Reset()                    { *m = LogEntry{} }
+func (m *LogEntry) String() string            { return proto.CompactTextString(m) }
+func (*LogEntry) ProtoMessage()               {}
+func (*LogEntry) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *LogEntry) GetTime() int64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
+}
+
+func (m *LogEntry) GetSeverity() string {
+	if m != nil {
+		return m.Severity
+	}
+	return ""
+}
+
+func (m *LogEntry) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
+func (m *LogEntry) GetRunId() string {
+	if m != nil {
+		return m.RunId
+	}
+	return ""
+}
+
+func (m *LogEntry) GetSpanId() string {
+	if m != nil {
+		return m.SpanId
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*TriggerRunRequest)(nil), "mcm.agent.TriggerRunRequest")
+	proto.RegisterType((*GetStatusRequest)(nil), "mcm.agent.GetStatusRequest")
+	proto.RegisterType((*StreamLogsRequest)(nil), "mcm.agent.StreamLogsRequest")
+	proto.RegisterType((*GetLastReportRequest)(nil), "mcm.agent.GetLastReportRequest")
+	proto.RegisterType((*PauseRequest)(nil), "mcm.agent.PauseRequest")
+	proto.RegisterType((*PauseResponse)(nil), "mcm.agent.PauseResponse")
+	proto.RegisterType((*ResumeRequest)(nil), "mcm.agent.ResumeRequest")
+	proto.RegisterType((*ResumeResponse)(nil), "mcm.agent.ResumeResponse")
+	proto.RegisterType((*Report)(nil), "mcm.agent.Report")
+	proto.RegisterType((*Status)(nil), "mcm.agent.Status")
+	proto.RegisterType((*LogEntry)(nil), "mcm.agent.LogEntry")
+	proto.RegisterEnum("mcm.agent.Status_State", Status_State_name, Status_State_value)
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for Agent service
+
+type AgentClient interface {
+	// Fetch and apply the catalog now, waiting for the run to finish.
+	// If a run is already in progress, then this waits for it to finish
+	// and starts another.
+	TriggerRun(ctx context.Context, in *TriggerRunRequest, opts ...grpc.CallOption) (*Report, error)
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error)
+	// Send the agent's log entries until the call is canceled.
+	StreamLogs(ctx context.Context, in *StreamLogsRequest, opts ...grpc.CallOption) (Agent_StreamLogsClient, error)
+	// Get the report of the most recent run.  Fails with NOT_FOUND if
+	// the agent has not finished a run yet.
+	GetLastReport(ctx context.Context, in *GetLastReportRequest, opts ...grpc.CallOption) (*Report, error)
+	// Stop starting resources.  Resources that are being applied finish,
+	// and the run waits until Resume is called.  A pause made between
+	// runs holds the next run before its first resource.
+	Pause(ctx context.Context, in *PauseRequest, opts ...grpc.CallOption) (*PauseResponse, error)
+	// Continue applying resources after a pause.
+	Resume(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (*ResumeResponse, error)
+}
+
+type agentClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAgentClient(cc *grpc.ClientConn) AgentClient {
+	return &agentClient{cc}
+}
+
+func (c *agentClient) TriggerRun(ctx context.Context, in *TriggerRunRequest, opts ...grpc.CallOption) (*Report, error) {
+	out := new(Report)
+	err := grpc.Invoke(ctx, "/mcm.agent.Agent/TriggerRun", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := grpc.Invoke(ctx, "/mcm.agent.Agent/GetStatus", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) StreamLogs(ctx context.Context, in *StreamLogsRequest, opts ...grpc.CallOption) (Agent_StreamLogsClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_Agent_serviceDesc.Streams[0], c.cc, "/mcm.agent.Agent/StreamLogs", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentStreamLogsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Agent_StreamLogsClient interface {
+	Recv() (*LogEntry, error)
+	grpc.ClientStream
+}
+
+type agentStreamLogsClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentStreamLogsClient) Recv() (*LogEntry, error) {
+	m := new(LogEntry)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) GetLastReport(ctx context.Context, in *GetLastReportRequest, opts ...grpc.CallOption) (*Report, error) {
+	out := new(Report)
+	err := grpc.Invoke(ctx, "/mcm.agent.Agent/GetLastReport", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) Pause(ctx context.Context, in *PauseRequest, opts ...grpc.CallOption) (*PauseResponse, error) {
+	out := new(PauseResponse)
+	err := grpc.Invoke(ctx, "/mcm.agent.Agent/Pause", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) Resume(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (*ResumeResponse, error) {
+	out := new(ResumeResponse)
+	err := grpc.Invoke(ctx, "/mcm.agent.Agent/Resume", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Server API for Agent service
+
+type AgentServer interface {
+	// Fetch and apply the catalog now, waiting for the run to finish.
+	// If a run is already in progress, then this waits for it to finish
+	// and starts another.
+	TriggerRun(context.Context, *TriggerRunRequest) (*Report, error)
+	GetStatus(context.Context, *GetStatusRequest) (*Status, error)
+	// Send the agent's log entries until the call is canceled.
+	StreamLogs(*StreamLogsRequest, Agent_StreamLogsServer) error
+	// Get the report of the most recent run.  Fails with NOT_FOUND if
+	// the agent has not finished a run yet.
+	GetLastReport(context.Context, *GetLastReportRequest) (*Report, error)
+	// Stop starting resources.  Resources that are being applied finish,
+	// and the run waits until Resume is called.  A pause made between
+	// runs holds the next run before its first resource.
+	Pause(context.Context, *PauseRequest) (*PauseResponse, error)
+	// Continue applying resources after a pause.
+	Resume(context.Context, *ResumeRequest) (*ResumeResponse, error)
+}
+
+func RegisterAgentServer(s *grpc.Server, srv AgentServer) {
+	s.RegisterService(&_Agent_serviceDesc, srv)
+}
+
+func _Agent_TriggerRun_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TriggerRunRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).TriggerRun(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mcm.agent.Agent/TriggerRun",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).TriggerRun(ctx, req.(*TriggerRunRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mcm.agent.Agent/GetStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_StreamLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamLogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServer).StreamLogs(m, &agentStreamLogsServer{stream})
+}
+
+type Agent_StreamLogsServer interface {
+	Send(*LogEntry) error
+	grpc.ServerStream
+}
+
+type agentStreamLogsServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentStreamLogsServer) Send(m *LogEntry) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Agent_GetLastReport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetLastReportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).GetLastReport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mcm.agent.Agent/GetLastReport",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).GetLastReport(ctx, req.(*GetLastReportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_Pause_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PauseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).Pause(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mcm.agent.Agent/Pause",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).Pause(ctx, req.(*PauseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_Resume_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResumeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).Resume(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/mcm.agent.Agent/Resume",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).Resume(ctx, req.(*ResumeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Agent_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "mcm.agent.Agent",
+	HandlerType: (*AgentServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "TriggerRun",
+			Handler:    _Agent_TriggerRun_Handler,
+		},
+		{
+			MethodName: "GetStatus",
+			Handler:    _Agent_GetStatus_Handler,
+		},
+		{
+			MethodName: "GetLastReport",
+			Handler:    _Agent_GetLastReport_Handler,
+		},
+		{
+			MethodName: "Pause",
+			Handler:    _Agent_Pause_Handler,
+		},
+		{
+			MethodName: "Resume",
+			Handler:    _Agent_Resume_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamLogs",
+			Handler:       _Agent_StreamLogs_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "agent.proto",
+}
+
+func init() { proto.RegisterFile("agent.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 541 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x54, 0x4f, 0x6f, 0xd3, 0x30,
+	0x14, 0x27, 0x6b, 0x93, 0x26, 0x6f, 0x5d, 0x69, 0xdf, 0x60, 0x0b, 0xdd, 0x80, 0xa8, 0xe2, 0x50,
+	0x09, 0x51, 0xa1, 0x71, 0x03, 0xed, 0x30, 0x46, 0xa9, 0x2a, 0x55, 0x15, 0x72, 0xe1, 0xc2, 0xa5,
+	0xf2, 0x5a, 0x13, 0x15, 0x1a, 0x27, 0xd8, 0x0e, 0xd2, 0xee, 0x88, 0xcf, 0xc1, 0x47, 0x45, 0xb6,
+	0x93, 0x2c, 0xa5, 0x3b, 0xd5, 0xbf, 0x3f, 0x76, 0xfd, 0x9e, 0x7f, 0x2f, 0x70, 0x48, 0x63, 0xc6,
+	0xd5, 0x28, 0x13, 0xa9, 0x4a, 0x31, 0x48, 0x56, 0xc9, 0xc8, 0x10, 0x83, 0x63, 0xe8, 0x7d, 0x16,
+	0x9b, 0x38, 0x66, 0x82, 0xe4, 0x9c, 0xb0, 0x9f, 0x39, 0x93, 0x6a, 0x80, 0xd0, 0x9d, 0x30, 0xb5,
+	0x50, 0x54, 0xe5, 0xb2, 0xe4, 0x8e, 0xa1, 0xb7, 0x50, 0x82, 0xd1, 0x64, 0x96, 0xc6, 0x15, 0x79,
+	0x02, 0x8f, 0x26, 0x4c, 0xcd, 0xa8, 0x54, 0x84, 0x65, 0xa9, 0x50, 0x25, 0xdf, 0x81, 0xf6, 0x27,
+	0x9a, 0x4b, 0x56, 0xe2, 0x87, 0x70, 0x54, 0x60, 0x99, 0xa5, 0x5c, 0x32, 0x4d, 0x10, 0x26, 0xf3,
+	0xa4, 0x72, 0x74, 0xa1, 0x53, 0x12, 0x85, 0xe5, 0x1c, 0x3c, 0x7b, 0x28, 0x22, 0x34, 0xbf, 0xcb,
+	0x94, 0x87, 0x4e, 0xe4, 0x0c, 0xdb, 0xc4, 0xac, 0x07, 0x7f, 0x0f, 0xc0, 0xb3, 0x17, 0xc4, 0x57,
+	0xe0, 0x4a, 0x45, 0x15, 0x33, 0x7a, 0xe7, 0xe2, 0x74, 0x54, 0x55, 0x37, 0xb2, 0x0e, 0xf3, 0xc3,
+	0x88, 0x75, 0xe1, 0x19, 0x04, 0x22, 0xe7, 0xcb, 0x55, 0x9a, 0x73, 0x15, 0x1e, 0x44, 0xce, 0xb0,
+	0x49, 0x7c, 0x91, 0xf3, 0x6b, 0x8d, 0xf1, 0x05, 0x74, 0xb6, 0x54, 0xaa, 0xa5, 0x76, 0x48, 0x45,
+	0x85, 0x0a, 0x1b, 0x91, 0x33, 0x6c, 0x90, 0xb6, 0x66, 0x49, 0xce, 0x17, 0x9a, 0xc3, 0x08, 0xda,
+	0x95, 0x8b, 0xf1, 0x75, 0xd8, 0x34, 0x1e, 0x28, 0x3c, 0x63, 0xbe, 0xc6, 0xa7, 0x60, 0xd0, 0x92,
+	0x09, 0x91, 0x8a, 0xd0, 0x8d, 0x9c, 0x61, 0x40, 0x02, 0xcd, 0x8c, 0x35, 0x81, 0x2f, 0xa1, 0xb7,
+	0xa2, 0x8a, 0x6e, 0xd3, 0x78, 0xf9, 0x8d, 0x6e, 0xb7, 0x37, 0x74, 0xf5, 0x43, 0x86, 0x9e, 0x39,
+	0xa5, 0x5b, 0x08, 0x1f, 0x4b, 0x1e, 0x4f, 0xc0, 0xcb, 0x74, 0xf3, 0xd6, 0x61, 0x2b, 0x72, 0x86,
+	0x3e, 0x29, 0xd0, 0xe0, 0x19, 0xb8, 0xa6, 0x30, 0xf4, 0xa1, 0x39, 0xfd, 0x30, 0x1b, 0x77, 0x1f,
+	0xe0, 0x21, 0xb4, 0xc8, 0x97, 0xf9, 0x7c, 0x3a, 0x9f, 0x74, 0x9d, 0xc1, 0x6f, 0x07, 0xfc, 0x59,
+	0x1a, 0x8f, 0xb9, 0x12, 0xb7, 0xba, 0x87, 0x6a, 0x93, 0xd8, 0x1e, 0x35, 0x88, 0x59, 0x63, 0x1f,
+	0x7c, 0xc9, 0x7e, 0x31, 0xb1, 0x51, 0xb7, 0xa6, 0x11, 0x01, 0xa9, 0x30, 0x86, 0xd0, 0x4a, 0x98,
+	0x94, 0x34, 0x66, 0xa6, 0x03, 0x01, 0x29, 0x21, 0x3e, 0x06, 0x4f, 0xd7, 0xbd, 0xb1, 0x65, 0x07,
+	0xc4, 0x15, 0x39, 0x9f, 0xae, 0xf1, 0x14, 0x5a, 0x32, 0xa3, 0x86, 0xb7, 0xe5, 0x7a, 0x1a, 0x4e,
+	0xd7, 0x17, 0x7f, 0x1a, 0xe0, 0x5e, 0xe9, 0xd7, 0xc0, 0x4b, 0x80, 0xbb, 0xac, 0xe1, 0x79, 0xed,
+	0x9d, 0xf6, 0x22, 0xd8, 0xef, 0xd5, 0xd4, 0x22, 0x06, 0xef, 0x20, 0xa8, 0x52, 0x89, 0x67, 0x35,
+	0xfd, 0xff, 0xac, 0xee, 0x6c, 0x2e, 0xfc, 0x57, 0x00, 0x77, 0xf1, 0xdd, 0xf9, 0xef, 0xbd, 0x54,
+	0xf7, 0x8f, 0x6b, 0x6a, 0xd9, 0xc0, 0xd7, 0x0e, 0x5e, 0xc3, 0xd1, 0x4e, 0xd8, 0xf1, 0xf9, 0xee,
+	0x1d, 0xf6, 0xc6, 0xe0, 0xbe, 0x22, 0xde, 0x82, 0x6b, 0x26, 0x01, 0xeb, 0x31, 0xad, 0xcf, 0x4a,
+	0x3f, 0xdc, 0x17, 0xec, 0x44, 0xe0, 0x25, 0x78, 0x76, 0x46, 0x30, 0xdc, 0x39, 0xb8, 0x36, 0x47,
+	0xfd, 0x27, 0xf7, 0x28, 0x76, 0xfb, 0x7b, 0xf8, 0xea, 0x1b, 0x5e, 0x64, 0xab, 0x1b, 0xcf, 0x7c,
+	0x08, 0xde, 0xfc, 0x1b, 0x00, 0xd4, 0x0b, 0xa4, 0x17, 0x17, 0x04, 0x00, 0x00,
+}
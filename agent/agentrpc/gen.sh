@@ -0,0 +1,31 @@
+#!/bin/bash
+# Copyright 2017 The Minimal Configuration Manager Authors
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#     http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+# gen.sh - regenerate agent.pb.go from agent.proto
+#
+# rules_go has no protobuf rules, so the generated code is checked in.
+# Requires protoc and protoc-gen-go from github.com/golang/protobuf at
+# the version in third_party/golang/protobuf.
+set -euo pipefail
+
+cd "$(dirname "$0")"
+protoc --go_out=plugins=grpc:. agent.proto
+sed \
+  -e 's,"github.com/golang/protobuf/,"github.com/zombiezen/mcm/third_party/golang/protobuf/,' \
+  -e 's,"golang.org/x/net/,"github.com/zombiezen/mcm/third_party/golang/net/,' \
+  -e 's,"google.golang.org/grpc","github.com/zombiezen/mcm/third_party/golang/grpc",' \
+  agent.pb.go > agent.pb.go.tmp
+mv agent.pb.go.tmp agent.pb.go
+gofmt -w agent.pb.go
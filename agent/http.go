@@ -0,0 +1,47 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !mcm_minimal,!mcm_nohttp
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	_ "net/http/pprof"
+
+	"github.com/zombiezen/mcm/agent/agentlib"
+	"github.com/zombiezen/mcm/internal/features"
+)
+
+func init() {
+	features.Register("http")
+}
+
+// serveHTTP serves metrics, profiles, and the resource graph on addr in
+// the background.  The agent exits if the server stops.
+func serveHTTP(ctx context.Context, log *logger, addr string, agent *agentlib.Agent, fetcher *agentlib.Fetcher) error {
+	expvar.Publish("catalog_cache_fallbacks", expvar.Func(func() interface{} {
+		return fetcher.Fallbacks()
+	}))
+	expvar.Publish("catalog_deltas", expvar.Func(func() interface{} {
+		return fetcher.Deltas()
+	}))
+	http.Handle("/graph", &agentlib.GraphServer{Agent: agent})
+	go func() {
+		log.Fatal(ctx, http.ListenAndServe(addr, nil))
+	}()
+	return nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build mcm_minimal mcm_nohttp
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/zombiezen/mcm/agent/agentlib"
+)
+
+// serveHTTP returns an error, since the build does not include the
+// HTTP server.
+func serveHTTP(ctx context.Context, log *logger, addr string, agent *agentlib.Agent, fetcher *agentlib.Fetcher) error {
+	return errors.New("-http not supported (built with mcm_nohttp)")
+}
@@ -0,0 +1,223 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mcm-bisect narrows a catalog that fails to apply down to a small set
+// of resources that still fail, for triaging large generated catalogs.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/zombiezen/mcm/bisect/bisectlib"
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s [-o OUT] [-keep] [-v] CATALOG COMMAND [ARG...]\n", name)
+	flag.PrintDefaults()
+}
+
+func main() {
+	outPath := flag.String("o", "", "file to write the narrowed catalog to")
+	keep := flag.Bool("keep", false, "keep each trial's scratch directory")
+	verbose := flag.Bool("v", false, "show each trial and the command's output on stderr")
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if flag.NArg() < 2 {
+		usage()
+		os.Exit(2)
+	}
+	c, err := readCatalog(flag.Arg(0))
+	if err != nil {
+		die(err)
+	}
+	t := &trials{
+		argv:    flag.Args()[1:],
+		keep:    *keep,
+		verbose: *verbose,
+	}
+	ids, err := bisectlib.Bisect(context.Background(), c, t.run)
+	if err == bisectlib.ErrNotReproduced {
+		die(fmt.Errorf("%s does not reproduce the failure", flag.Arg(0)))
+	}
+	if err != nil {
+		die(err)
+	}
+	fmt.Fprintf(os.Stderr, "mcm-bisect: %d resources reproduce the failure after %d trials\n", len(ids), t.n)
+	keepIDs := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		keepIDs[id] = true
+	}
+	res, _ := c.Resources()
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		if keepIDs[r.ID()] {
+			fmt.Println(describeResource(r))
+		}
+	}
+	if *outPath == "" {
+		return
+	}
+	sub, err := catalog.Subset(c, keepIDs)
+	if err != nil {
+		die(err)
+	}
+	data, err := sub.Segment().Message().Marshal()
+	if err != nil {
+		die(err)
+	}
+	if err := ioutil.WriteFile(*outPath, data, 0666); err != nil {
+		die(err)
+	}
+}
+
+// trials runs the predicate command on candidate catalogs.
+type trials struct {
+	argv    []string
+	keep    bool
+	verbose bool
+
+	n int
+}
+
+// run writes c to a new scratch directory and runs the command on it.
+// The command reproduces the failure if it exits with a status from 1
+// to 127, other than 125, which means that the catalog could not be
+// tested, as with git bisect run.
+func (t *trials) run(ctx context.Context, c catalog.Catalog) (bool, error) {
+	t.n++
+	res, _ := c.Resources()
+	dir, err := ioutil.TempDir("", "mcm-bisect")
+	if err != nil {
+		return false, err
+	}
+	if t.keep {
+		fmt.Fprintf(os.Stderr, "mcm-bisect: trial %d: %s\n", t.n, dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0777); err != nil {
+		return false, err
+	}
+	catPath := filepath.Join(dir, "trial.cat")
+	data, err := c.Segment().Message().Marshal()
+	if err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(catPath, data, 0666); err != nil {
+		return false, err
+	}
+
+	cmd := exec.CommandContext(ctx, t.argv[0], append(t.argv[1:], catPath)...)
+	cmd.Env = append(os.Environ(), "MCM_BISECT_CATALOG="+catPath, "MCM_BISECT_ROOT="+root)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = ioutil.Discard
+	if t.verbose {
+		fmt.Fprintf(os.Stderr, "mcm-bisect: trial %d: %d resources\n", t.n, res.Len())
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+	}
+	code, err := exitStatus(cmd.Run())
+	if err != nil {
+		return false, fmt.Errorf("trial %d: %s: %v", t.n, t.argv[0], err)
+	}
+	var result string
+	switch {
+	case code == 0:
+		result = "passed"
+	case code == 125:
+		result = "skipped"
+	case code < 128:
+		result = "reproduced"
+	default:
+		return false, fmt.Errorf("trial %d: %s exited with status %d", t.n, t.argv[0], code)
+	}
+	if t.verbose {
+		fmt.Fprintf(os.Stderr, "mcm-bisect: trial %d: %s\n", t.n, result)
+	}
+	return result == "reproduced", nil
+}
+
+// exitStatus returns the exit status of a command from the error
+// returned by running it.  It returns an error if the command could not
+// be run or was killed by a signal.
+func exitStatus(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, err
+	}
+	ws, ok := ee.Sys().(interface {
+		ExitStatus() int
+	})
+	if !ok || ws.ExitStatus() < 0 {
+		return 0, err
+	}
+	return ws.ExitStatus(), nil
+}
+
+// describeResource returns the resource's ID followed by its name or
+// comment, if it has one.
+func describeResource(r catalog.Resource) string {
+	label, _ := r.Name()
+	if label == "" {
+		label, _ = r.Comment()
+	}
+	if label == "" {
+		return fmt.Sprint(r.ID())
+	}
+	return fmt.Sprintf("%d\t%s", r.ID(), label)
+}
+
+// readCatalog reads the catalog at path, or stdin if path is "-".
+func readCatalog(path string) (catalog.Catalog, error) {
+	if path != "-" {
+		// The file stays mapped until mcm-bisect exits.
+		f, err := catalog.OpenFile(path)
+		if err != nil {
+			return catalog.Catalog{}, err
+		}
+		return f.Catalog, nil
+	}
+	msg, err := capnp.NewDecoder(os.Stdin).Decode()
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	return catalog.ReadRootCatalog(msg)
+}
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, "mcm-bisect:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bisectlib provides the functionality of the mcm-bisect tool:
+// narrowing a catalog that fails to apply down to a small set of
+// resources that still fail.
+package bisectlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// A Predicate reports whether applying a catalog reproduces the
+// failure being bisected.  An error stops the bisection.
+type Predicate func(ctx context.Context, c catalog.Catalog) (bool, error)
+
+// ErrNotReproduced is returned by Bisect when the full catalog does not
+// reproduce the failure.
+var ErrNotReproduced = errors.New("bisect: catalog does not reproduce the failure")
+
+// Bisect returns the IDs of a small set of c's resources that
+// reproduces the failure, in sorted order.  Each candidate set is
+// closed over its dependencies and passed to p as a catalog of its
+// own, so the result includes every resource that the failing ones
+// depend on.  The result is minimal in that removing any one resource
+// that isn't a dependency of the others no longer reproduces the
+// failure.
+//
+// Bisect uses the delta debugging algorithm, so a failure caused by a
+// single resource out of n takes about 2 log2(n) calls to p.  Candidate
+// sets with the same closure are only tested once.
+func Bisect(ctx context.Context, c catalog.Catalog, p Predicate) ([]uint64, error) {
+	res, err := c.Resources()
+	if err != nil {
+		return nil, fmt.Errorf("bisect: %v", err)
+	}
+	ids := make([]uint64, res.Len())
+	for i := range ids {
+		ids[i] = res.At(i).ID()
+	}
+	b := &bisector{
+		catalog: c,
+		pred:    p,
+		tested:  make(map[string]bool),
+	}
+	full, ok, err := b.test(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotReproduced
+	}
+	cands := ids
+	n := 2
+	for len(cands) > 1 {
+		if n > len(cands) {
+			n = len(cands)
+		}
+		chunks := split(cands, n)
+		reduced := false
+		for _, chunk := range chunks {
+			if _, ok, err := b.test(ctx, chunk); err != nil {
+				return nil, err
+			} else if ok {
+				cands, n, reduced = chunk, 2, true
+				break
+			}
+		}
+		if !reduced && n > 2 {
+			for i := range chunks {
+				comp := complement(chunks, i)
+				if _, ok, err := b.test(ctx, comp); err != nil {
+					return nil, err
+				} else if ok {
+					cands, n, reduced = comp, n-1, true
+					break
+				}
+			}
+		}
+		if !reduced {
+			if n == len(cands) {
+				break
+			}
+			n *= 2
+		}
+	}
+	if len(cands) == len(ids) {
+		return full, nil
+	}
+	closure, err := catalog.DependencyClosure(c, cands)
+	if err != nil {
+		return nil, fmt.Errorf("bisect: %v", err)
+	}
+	return closure, nil
+}
+
+type bisector struct {
+	catalog catalog.Catalog
+	pred    Predicate
+
+	// tested maps a closure's key to whether it reproduced the failure.
+	tested map[string]bool
+}
+
+// test reports whether the closure of ids reproduces the failure.  It
+// also returns the closure.
+func (b *bisector) test(ctx context.Context, ids []uint64) ([]uint64, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	closure, err := catalog.DependencyClosure(b.catalog, ids)
+	if err != nil {
+		return nil, false, fmt.Errorf("bisect: %v", err)
+	}
+	key := closureKey(closure)
+	if ok, found := b.tested[key]; found {
+		return closure, ok, nil
+	}
+	keep := make(map[uint64]bool, len(closure))
+	for _, id := range closure {
+		keep[id] = true
+	}
+	sub, err := catalog.Subset(b.catalog, keep)
+	if err != nil {
+		return nil, false, fmt.Errorf("bisect: %v", err)
+	}
+	ok, err := b.pred(ctx, sub)
+	if err != nil {
+		return nil, false, fmt.Errorf("bisect: %v", err)
+	}
+	b.tested[key] = ok
+	return closure, ok, nil
+}
+
+func closureKey(ids []uint64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatUint(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// split divides ids into n chunks of nearly equal size.
+func split(ids []uint64, n int) [][]uint64 {
+	chunks := make([][]uint64, 0, n)
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + (len(ids)-start)/(n-i)
+		chunks = append(chunks, ids[start:end])
+		start = end
+	}
+	return chunks
+}
+
+// complement returns the IDs of every chunk except chunks[skip].
+func complement(chunks [][]uint64, skip int) []uint64 {
+	var ids []uint64
+	for i, chunk := range chunks {
+		if i != skip {
+			ids = append(ids, chunk...)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bisectlib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catpogs"
+)
+
+func TestBisect(t *testing.T) {
+	var resources []*catpogs.Resource
+	for id := uint64(1); id <= 16; id++ {
+		r := &catpogs.Resource{
+			ID:    id,
+			Which: catalog.Resource_Which_noop,
+		}
+		if id == 11 {
+			r.Deps = []uint64{10}
+		}
+		resources = append(resources, r)
+	}
+	c := mustCatalog(t, &catpogs.Catalog{Resources: resources})
+
+	// The failure needs both resource 4 and resource 11.
+	calls := 0
+	pred := func(ctx context.Context, c catalog.Catalog) (bool, error) {
+		calls++
+		res, err := c.Resources()
+		if err != nil {
+			return false, err
+		}
+		has4, has11 := false, false
+		for i := 0; i < res.Len(); i++ {
+			switch res.At(i).ID() {
+			case 4:
+				has4 = true
+			case 11:
+				has11 = true
+			}
+		}
+		return has4 && has11, nil
+	}
+	got, err := Bisect(context.Background(), c, pred)
+	if err != nil {
+		t.Fatal("Bisect:", err)
+	}
+	if want := []uint64{4, 10, 11}; !uint64SlicesEqual(got, want) {
+		t.Errorf("Bisect(...) = %v; want %v", got, want)
+	}
+	if calls > 40 {
+		t.Errorf("predicate called %d times; want <= 40", calls)
+	}
+}
+
+func TestBisectNotReproduced(t *testing.T) {
+	c := mustCatalog(t, &catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_noop},
+			{ID: 2, Which: catalog.Resource_Which_noop},
+		},
+	})
+	pred := func(ctx context.Context, c catalog.Catalog) (bool, error) {
+		return false, nil
+	}
+	if _, err := Bisect(context.Background(), c, pred); err != ErrNotReproduced {
+		t.Errorf("Bisect(...) error = %v; want ErrNotReproduced", err)
+	}
+}
+
+func mustCatalog(t *testing.T, c *catpogs.Catalog) catalog.Catalog {
+	cat, err := c.ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	return cat
+}
+
+func uint64SlicesEqual(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// CheckConflicts returns an error if two file or file group resources
+// in the catalogs manage the same path, or if a resource manages a path
+// inside of a path that another resource makes a plain file, symlink,
+// or absent.  Such resources undo each other's changes, so the result
+// depends on the order that they are applied in.  Managing a path
+// inside of a directory is not a conflict.
+func CheckConflicts(cats ...Catalog) error {
+	var files []managedPath
+	byPath := make(map[string]*managedPath)
+	for i, c := range cats {
+		res, err := c.Resources()
+		if err != nil {
+			return fmt.Errorf("check conflicts: %v", err)
+		}
+		for j := 0; j < res.Len(); j++ {
+			r := res.At(j)
+			rfiles, err := resourceFiles(r)
+			if err != nil {
+				return fmt.Errorf("check conflicts: %v", err)
+			}
+			for _, f := range rfiles {
+				p, err := f.Path()
+				if err != nil {
+					return fmt.Errorf("check conflicts: %v", err)
+				}
+				mp := managedPath{
+					path:     filepath.Clean(p),
+					which:    f.Which(),
+					resource: r,
+				}
+				if len(cats) > 1 {
+					mp.catalog = i
+				} else {
+					mp.catalog = -1
+				}
+				files = append(files, mp)
+			}
+		}
+	}
+	sort.Stable(byPathName(files))
+	for i := range files {
+		mp := &files[i]
+		if prev := byPath[mp.path]; prev != nil {
+			return fmt.Errorf("check conflicts: %s and %s both manage %s", prev, mp, mp.path)
+		}
+		byPath[mp.path] = mp
+	}
+	for i := range files {
+		mp := &files[i]
+		for dir := filepath.Dir(mp.path); ; dir = filepath.Dir(dir) {
+			if parent := byPath[dir]; parent != nil && parent != mp && parent.which != File_Which_directory {
+				return fmt.Errorf("check conflicts: %s manages %s, but %s makes %s %s", mp, mp.path, parent, dir, describeWhich(parent.which))
+			}
+			if next := filepath.Dir(dir); next == dir {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// resourceFiles returns the files that r manages: its file if r is a
+// file resource, or its files if r is a file group.
+func resourceFiles(r Resource) ([]File, error) {
+	switch r.Which() {
+	case Resource_Which_file:
+		f, err := r.File()
+		if err != nil {
+			return nil, err
+		}
+		return []File{f}, nil
+	case Resource_Which_fileGroup:
+		g, err := r.FileGroup()
+		if err != nil {
+			return nil, err
+		}
+		list, err := g.Files()
+		if err != nil {
+			return nil, err
+		}
+		files := make([]File, list.Len())
+		for i := range files {
+			files[i] = list.At(i)
+		}
+		return files, nil
+	default:
+		return nil, nil
+	}
+}
+
+// A managedPath is a path managed by a file or file group resource.
+type managedPath struct {
+	path     string
+	which    File_Which
+	resource Resource
+
+	// catalog is the index of the resource's catalog, or -1 if only
+	// one catalog is being checked.
+	catalog int
+}
+
+func (mp *managedPath) String() string {
+	s := describeResource(mp.resource)
+	if mp.catalog >= 0 {
+		s = fmt.Sprintf("catalog %d %s", mp.catalog, s)
+	}
+	return s
+}
+
+type byPathName []managedPath
+
+func (a byPathName) Len() int           { return len(a) }
+func (a byPathName) Less(i, j int) bool { return a[i].path < a[j].path }
+func (a byPathName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func describeWhich(w File_Which) string {
+	switch w {
+	case File_Which_plain:
+		return "a plain file"
+	case File_Which_symlink:
+		return "a symlink"
+	case File_Which_absent:
+		return "absent"
+	default:
+		return w.String()
+	}
+}
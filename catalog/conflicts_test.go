@@ -0,0 +1,132 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func TestCheckConflicts(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []testFile
+		ok    bool
+	}{
+		{
+			name:  "distinct",
+			files: []testFile{{"/etc/a", File_Which_plain}, {"/etc/b", File_Which_absent}},
+			ok:    true,
+		},
+		{
+			name:  "inside directory",
+			files: []testFile{{"/etc/foo", File_Which_directory}, {"/etc/foo/bar", File_Which_plain}},
+			ok:    true,
+		},
+		{
+			name:  "sibling prefix",
+			files: []testFile{{"/etc/foo", File_Which_plain}, {"/etc/foo-bar/baz", File_Which_plain}},
+			ok:    true,
+		},
+		{
+			name:  "same path",
+			files: []testFile{{"/etc/motd", File_Which_plain}, {"/etc/motd", File_Which_absent}},
+		},
+		{
+			name:  "same path after cleaning",
+			files: []testFile{{"/etc/motd", File_Which_plain}, {"/etc//motd/", File_Which_plain}},
+		},
+		{
+			name:  "inside absent",
+			files: []testFile{{"/srv/www/index.html", File_Which_plain}, {"/srv", File_Which_absent}},
+		},
+		{
+			name:  "inside plain file",
+			files: []testFile{{"/etc/foo", File_Which_plain}, {"/etc/foo/bar", File_Which_directory}},
+		},
+		{
+			name:  "inside symlink",
+			files: []testFile{{"/etc/foo", File_Which_symlink}, {"/etc/foo/bar", File_Which_plain}},
+		},
+	}
+	for _, test := range tests {
+		err := CheckConflicts(newFileCatalog(t, test.files...))
+		if test.ok && err != nil {
+			t.Errorf("%s: CheckConflicts = %v; want <nil>", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: CheckConflicts = <nil>; want error", test.name)
+		}
+	}
+}
+
+func TestCheckConflictsAcrossCatalogs(t *testing.T) {
+	a := newFileCatalog(t, testFile{"/etc/motd", File_Which_plain})
+	b := newFileCatalog(t, testFile{"/etc/motd", File_Which_plain})
+	if err := CheckConflicts(a); err != nil {
+		t.Errorf("CheckConflicts(a) = %v; want <nil>", err)
+	}
+	if err := CheckConflicts(a, b); err == nil {
+		t.Error("CheckConflicts(a, b) = <nil>; want error")
+	}
+}
+
+type testFile struct {
+	path  string
+	which File_Which
+}
+
+// newFileCatalog returns a catalog with a file resource for each of
+// files, with IDs starting at 1.
+func newFileCatalog(t *testing.T, files ...testFile) Catalog {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRootCatalog(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.NewResources(int32(len(files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tf := range files {
+		r := res.At(i)
+		r.SetID(uint64(i + 1))
+		f, err := r.NewFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.SetPath(tf.path); err != nil {
+			t.Fatal(err)
+		}
+		switch tf.which {
+		case File_Which_plain:
+			f.SetPlain()
+		case File_Which_directory:
+			f.SetDirectory()
+		case File_Which_symlink:
+			f.SetSymlink()
+			if err := f.Symlink().SetTarget("/dev/null"); err != nil {
+				t.Fatal(err)
+			}
+		case File_Which_absent:
+			f.SetAbsent()
+		}
+	}
+	return c
+}
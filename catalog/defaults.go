@@ -0,0 +1,265 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import "fmt"
+
+// ExpandDefaults returns a catalog like c, but with c's defaults filled
+// into the fields that its resources leave unset and with empty
+// defaults.  If c has no defaults, then c is returned as-is; otherwise
+// the result is a copy in a new message, and c is not changed.
+func ExpandDefaults(c Catalog) (Catalog, error) {
+	d, err := c.Defaults()
+	if err != nil {
+		return Catalog{}, fmt.Errorf("expand defaults: %v", err)
+	}
+	if !d.HasFileMode() && !d.HasDirectoryMode() && !d.HasEnvironment() {
+		return c, nil
+	}
+	out, err := copyCatalog(c)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("expand defaults: %v", err)
+	}
+	res, err := out.Resources()
+	if err != nil {
+		return Catalog{}, fmt.Errorf("expand defaults: %v", err)
+	}
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		if err := expandResource(r, d); err != nil {
+			return Catalog{}, fmt.Errorf("expand defaults: %s: %v", describeResource(r), err)
+		}
+	}
+	if _, err := out.NewDefaults(); err != nil {
+		return Catalog{}, fmt.Errorf("expand defaults: %v", err)
+	}
+	return out, nil
+}
+
+func expandResource(r Resource, d Defaults) error {
+	switch r.Which() {
+	case Resource_Which_file:
+		f, err := r.File()
+		if err != nil {
+			return err
+		}
+		return expandFile(f, d)
+	case Resource_Which_exec:
+		if !d.HasEnvironment() {
+			return nil
+		}
+		env, err := d.Environment()
+		if err != nil {
+			return fmt.Errorf("default environment: %v", err)
+		}
+		e, err := r.Exec()
+		if err != nil {
+			return err
+		}
+		if err := expandCommand(e.Command, env); err != nil {
+			return fmt.Errorf("command: %v", err)
+		}
+		cond := e.Condition()
+		switch cond.Which() {
+		case Exec_condition_Which_onlyIf:
+			if err := expandCommand(cond.OnlyIf, env); err != nil {
+				return fmt.Errorf("onlyIf: %v", err)
+			}
+		case Exec_condition_Which_unless:
+			if err := expandCommand(cond.Unless, env); err != nil {
+				return fmt.Errorf("unless: %v", err)
+			}
+		case Exec_condition_Which_until:
+			u, err := cond.Until()
+			if err != nil {
+				return fmt.Errorf("until: %v", err)
+			}
+			if u.Which() == Exec_Until_Which_command {
+				if err := expandCommand(u.Command, env); err != nil {
+					return fmt.Errorf("until: %v", err)
+				}
+			}
+		}
+		if e.HasSupervise() {
+			sup, err := e.Supervise()
+			if err != nil {
+				return fmt.Errorf("supervise: %v", err)
+			}
+			if sup.HasReadyCommand() {
+				if err := expandCommand(sup.ReadyCommand, env); err != nil {
+					return fmt.Errorf("supervise: %v", err)
+				}
+			}
+		}
+	case Resource_Which_assert:
+		if !d.HasEnvironment() {
+			return nil
+		}
+		env, err := d.Environment()
+		if err != nil {
+			return fmt.Errorf("default environment: %v", err)
+		}
+		a, err := r.Assert()
+		if err != nil {
+			return err
+		}
+		if a.Which() == Assert_Which_command {
+			if err := expandCommand(a.Command, env); err != nil {
+				return fmt.Errorf("command: %v", err)
+			}
+		}
+	case Resource_Which_fileGroup:
+		g, err := r.FileGroup()
+		if err != nil {
+			return err
+		}
+		files, err := g.Files()
+		if err != nil {
+			return fmt.Errorf("files: %v", err)
+		}
+		for i := 0; i < files.Len(); i++ {
+			if err := expandFile(files.At(i), d); err != nil {
+				return fmt.Errorf("files[%d]: %v", i, err)
+			}
+		}
+		if d.HasEnvironment() && g.HasValidate() {
+			env, err := d.Environment()
+			if err != nil {
+				return fmt.Errorf("default environment: %v", err)
+			}
+			if err := expandCommand(g.Validate, env); err != nil {
+				return fmt.Errorf("validate: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// expandFile fills in the mode and verify environment of f from d.
+func expandFile(f File, d Defaults) error {
+	switch f.Which() {
+	case File_Which_plain:
+		p := f.Plain()
+		if d.HasEnvironment() && p.HasVerify() {
+			env, err := d.Environment()
+			if err != nil {
+				return fmt.Errorf("default environment: %v", err)
+			}
+			if err := expandCommand(p.Verify, env); err != nil {
+				return fmt.Errorf("verify: %v", err)
+			}
+		}
+		if !d.HasFileMode() {
+			return nil
+		}
+		def, _ := d.FileMode()
+		if !p.HasMode() {
+			return p.SetMode(def)
+		}
+		mode, err := p.Mode()
+		if err != nil {
+			return fmt.Errorf("mode: %v", err)
+		}
+		return expandMode(mode, def)
+	case File_Which_directory:
+		if !d.HasDirectoryMode() {
+			return nil
+		}
+		dir := f.Directory()
+		def, _ := d.DirectoryMode()
+		if !dir.HasMode() {
+			return dir.SetMode(def)
+		}
+		mode, err := dir.Mode()
+		if err != nil {
+			return fmt.Errorf("mode: %v", err)
+		}
+		return expandMode(mode, def)
+	}
+	return nil
+}
+
+// expandMode fills in the parts of mode that are unset from def.
+func expandMode(mode, def File_Mode) error {
+	if mode.Bits() == File_Mode_unset {
+		mode.SetBits(def.Bits())
+	}
+	if !mode.HasUser() && def.HasUser() {
+		u, err := def.User()
+		if err != nil {
+			return fmt.Errorf("default mode user: %v", err)
+		}
+		if err := mode.SetUser(u); err != nil {
+			return err
+		}
+	}
+	if !mode.HasGroup() && def.HasGroup() {
+		g, err := def.Group()
+		if err != nil {
+			return fmt.Errorf("default mode group: %v", err)
+		}
+		if err := mode.SetGroup(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandCommand prepends the variables in env that the command returned
+// by get doesn't set to its environment.
+func expandCommand(get func() (Exec_Command, error), env Exec_Command_EnvVar_List) error {
+	cmd, err := get()
+	if err != nil {
+		return err
+	}
+	if cmd.Segment() == nil {
+		// Null command.
+		return nil
+	}
+	own, err := cmd.Environment()
+	if err != nil {
+		return fmt.Errorf("environment: %v", err)
+	}
+	set := make(map[string]bool, own.Len())
+	for i := 0; i < own.Len(); i++ {
+		name, _ := own.At(i).Name()
+		set[name] = true
+	}
+	var add []Exec_Command_EnvVar
+	for i := 0; i < env.Len(); i++ {
+		name, _ := env.At(i).Name()
+		if !set[name] {
+			add = append(add, env.At(i))
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+	list, err := cmd.NewEnvironment(int32(len(add) + own.Len()))
+	if err != nil {
+		return err
+	}
+	for i, ev := range add {
+		if err := list.Set(i, ev); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < own.Len(); i++ {
+		if err := list.Set(len(add)+i, own.At(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
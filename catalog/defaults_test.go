@@ -0,0 +1,169 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func TestExpandDefaults(t *testing.T) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRootCatalog(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.NewDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm, err := d.NewFileMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm.SetBits(0644)
+	du, err := dm.NewUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := du.SetName("root"); err != nil {
+		t.Fatal(err)
+	}
+	denv, err := d.NewEnvironment(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEnvVar(t, denv.At(0), "PATH", "/usr/bin:/bin")
+	setEnvVar(t, denv.At(1), "LANG", "C")
+
+	res, err := c.NewResources(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A plain file without a mode.
+	res.At(0).SetID(1)
+	f1, err := res.At(0).NewFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1.SetPlain()
+	if err := f1.SetPath("/etc/a"); err != nil {
+		t.Fatal(err)
+	}
+	// A plain file with its own bits.
+	res.At(1).SetID(2)
+	f2, err := res.At(1).NewFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2.SetPlain()
+	if err := f2.SetPath("/etc/b"); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := f2.Plain().NewMode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2.SetBits(0600)
+	// An exec command with its own PATH.
+	res.At(2).SetID(3)
+	e, err := res.At(2).NewExec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := e.NewCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	argv, err := cmd.NewArgv(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argv.Set(0, "/bin/true")
+	env, err := cmd.NewEnvironment(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEnvVar(t, env.At(0), "PATH", "/opt/bin")
+
+	out, err := ExpandDefaults(c)
+	if err != nil {
+		t.Fatal("ExpandDefaults:", err)
+	}
+	outRes, _ := out.Resources()
+	file1, _ := outRes.At(0).File()
+	gotMode1, _ := file1.Plain().Mode()
+	if gotMode1.Bits() != 0644 {
+		t.Errorf("file 1 mode bits = %#o; want 0644", gotMode1.Bits())
+	}
+	if u, _ := gotMode1.User(); u.Which() != UserRef_Which_name {
+		t.Errorf("file 1 user = %v; want name", u.Which())
+	} else if name, _ := u.Name(); name != "root" {
+		t.Errorf("file 1 user = %q; want \"root\"", name)
+	}
+	file2, _ := outRes.At(1).File()
+	gotMode2, _ := file2.Plain().Mode()
+	if gotMode2.Bits() != 0600 {
+		t.Errorf("file 2 mode bits = %#o; want 0600", gotMode2.Bits())
+	}
+	if !gotMode2.HasUser() {
+		t.Error("file 2 has no user; want default user")
+	}
+	outExec, _ := outRes.At(2).Exec()
+	outCmd, _ := outExec.Command()
+	outEnv, _ := outCmd.Environment()
+	var got []string
+	for i := 0; i < outEnv.Len(); i++ {
+		name, _ := outEnv.At(i).Name()
+		value, _ := outEnv.At(i).Value()
+		got = append(got, name+"="+value)
+	}
+	if want := []string{"LANG=C", "PATH=/opt/bin"}; !stringSlicesEqual(got, want) {
+		t.Errorf("command environment = %q; want %q", got, want)
+	}
+	if d, _ := out.Defaults(); d.HasFileMode() || d.HasEnvironment() {
+		t.Error("expanded catalog still has defaults")
+	}
+
+	// The original catalog is unchanged.
+	if f1.Plain().HasMode() {
+		t.Error("ExpandDefaults changed the original catalog")
+	}
+}
+
+func setEnvVar(t *testing.T, ev Exec_Command_EnvVar, name, value string) {
+	if err := ev.SetName(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := ev.SetValue(value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
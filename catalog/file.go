@@ -0,0 +1,88 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// A MappedFile is a catalog read from a file.  Where possible, the file
+// is memory-mapped instead of read into memory, so only the parts of the
+// catalog that are accessed are loaded, and the pages can be evicted
+// under memory pressure.  The file must not be truncated or rewritten
+// in place while it is open.
+type MappedFile struct {
+	Catalog Catalog
+
+	data  []byte
+	unmap func([]byte) error
+}
+
+// OpenFile opens the serialized catalog at path.  The catalog is valid
+// until the MappedFile is closed.
+func OpenFile(path string) (*MappedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open catalog: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("open catalog: %v", err)
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("open catalog %s: file is empty", path)
+	}
+	if int64(int(info.Size())) != info.Size() {
+		return nil, fmt.Errorf("open catalog %s: file is too large", path)
+	}
+	data, unmap, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("open catalog %s: %v", path, err)
+	}
+	cf := &MappedFile{data: data, unmap: unmap}
+	msg, err := capnp.Unmarshal(data)
+	if err != nil {
+		cf.Close()
+		return nil, fmt.Errorf("open catalog %s: %v", path, err)
+	}
+	cf.Catalog, err = ReadRootCatalog(msg)
+	if err != nil {
+		cf.Close()
+		return nil, fmt.Errorf("open catalog %s: %v", path, err)
+	}
+	return cf, nil
+}
+
+// Close releases the file's memory.  The catalog must not be used
+// afterward.
+func (f *MappedFile) Close() error {
+	if f.data == nil {
+		return errors.New("close catalog: already closed")
+	}
+	data := f.data
+	f.data, f.Catalog = nil, Catalog{}
+	if f.unmap == nil {
+		return nil
+	}
+	if err := f.unmap(data); err != nil {
+		return fmt.Errorf("close catalog: %v", err)
+	}
+	return nil
+}
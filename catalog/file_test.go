@@ -0,0 +1,94 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcm_catalog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := newTestCatalog(t, 2).Segment().Message().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "catalog.bin")
+	if err := ioutil.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatal("OpenFile:", err)
+	}
+	if err := ValidateStructure(f.Catalog, nil); err != nil {
+		t.Error("ValidateStructure:", err)
+	}
+	res, err := f.Catalog.Resources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Len() != 3 {
+		t.Errorf("len(resources) = %d; want 3", res.Len())
+	}
+	file, err := res.At(0).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := file.Plain().Content(); err != nil || string(content) != "Hello" {
+		t.Errorf("content = %q, %v; want \"Hello\", <nil>", content, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Error("Close:", err)
+	}
+	if err := f.Close(); err == nil {
+		t.Error("second Close did not return an error")
+	}
+}
+
+func TestOpenFileInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcm_catalog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"truncated", "\x00\x00\x00\x00\x10\x00\x00\x00"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(path, []byte(test.data), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if f, err := OpenFile(path); err == nil {
+			f.Close()
+			t.Errorf("OpenFile(%s) did not return an error", test.name)
+		}
+	}
+	if _, err := OpenFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("OpenFile(missing) did not return an error")
+	}
+}
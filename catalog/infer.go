@@ -0,0 +1,278 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// An InferredDependency is a dependency that InferDependencies added
+// to a resource.
+type InferredDependency struct {
+	Resource   Resource
+	Dependency Resource
+
+	// Path is the path that Dependency manages.  Resource uses the
+	// path or a path inside of it.
+	Path string
+}
+
+func (d *InferredDependency) String() string {
+	return fmt.Sprintf("%s uses %s, which %s manages", describeResource(d.Resource), d.Path, describeResource(d.Dependency))
+}
+
+// InferDependencies returns a copy of c in a new message where each
+// exec resource depends on the file and file group resources that
+// manage the paths its command uses, and each file and file group
+// resource depends on the directory resource that manages the nearest
+// directory above its path, as well as the dependencies it added.  The
+// paths that a command uses are its working directory and the absolute
+// paths in its argv, including the values of arguments like
+// --config=/etc/app.conf.  A path inside of a managed directory adds a
+// dependency on the directory, unless the path itself is managed.
+//
+// A dependency is not added if the resource already depends on the
+// other resource, directly or indirectly, or if adding it would make a
+// cycle, such as for a file that takes its content from the command's
+// output.  Commands given as bash scripts are not examined.
+func InferDependencies(c Catalog) (Catalog, []*InferredDependency, error) {
+	out, err := copyCatalog(c)
+	if err != nil {
+		return Catalog{}, nil, fmt.Errorf("infer dependencies: %v", err)
+	}
+	res, err := out.Resources()
+	if err != nil {
+		return Catalog{}, nil, fmt.Errorf("infer dependencies: %v", err)
+	}
+	managed := make(map[string]int)
+	g := &reachGraph{
+		edges: make(map[uint64][]uint64, res.Len()),
+		desc:  make(map[uint64]map[uint64]bool, res.Len()),
+	}
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		deps, err := directDependencies(r)
+		if err != nil {
+			return Catalog{}, nil, fmt.Errorf("infer dependencies: %s: %v", describeResource(r), err)
+		}
+		g.edges[r.ID()] = deps
+		files, err := resourceFiles(r)
+		if err != nil {
+			return Catalog{}, nil, fmt.Errorf("infer dependencies: %s: %v", describeResource(r), err)
+		}
+		for _, f := range files {
+			if f.Which() == File_Which_absent {
+				continue
+			}
+			p, err := f.Path()
+			if err != nil {
+				return Catalog{}, nil, fmt.Errorf("infer dependencies: %s: %v", describeResource(r), err)
+			}
+			managed[filepath.Clean(p)] = i
+		}
+	}
+
+	var inferred []*InferredDependency
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		paths, err := usedPaths(r)
+		if err != nil {
+			return Catalog{}, nil, fmt.Errorf("infer dependencies: %s: %v", describeResource(r), err)
+		}
+		var added []uint64
+		for _, p := range paths {
+			j, dir, ok := managingResource(res, managed, p.path, p.parentOnly)
+			if !ok || j == i {
+				continue
+			}
+			dep := res.At(j)
+			need, err := g.needsEdge(r.ID(), dep.ID())
+			if err != nil {
+				return Catalog{}, nil, fmt.Errorf("infer dependencies: %s: %v", describeResource(r), err)
+			}
+			if !need {
+				continue
+			}
+			g.edges[r.ID()] = append(g.edges[r.ID()], dep.ID())
+			// Reachability changed, so start over.
+			g.desc = make(map[uint64]map[uint64]bool, res.Len())
+			added = append(added, dep.ID())
+			inferred = append(inferred, &InferredDependency{Resource: r, Dependency: dep, Path: dir})
+		}
+		if len(added) > 0 {
+			if err := appendDependencies(r, added); err != nil {
+				return Catalog{}, nil, fmt.Errorf("infer dependencies: %s: %v", describeResource(r), err)
+			}
+		}
+	}
+	if len(inferred) == 0 {
+		return out, nil, nil
+	}
+	// Copying again leaves out the replaced dependency lists.
+	out, err = copyCatalog(out)
+	if err != nil {
+		return Catalog{}, nil, fmt.Errorf("infer dependencies: %v", err)
+	}
+	res, _ = out.Resources()
+	byID := make(map[uint64]Resource, res.Len())
+	for i := 0; i < res.Len(); i++ {
+		byID[res.At(i).ID()] = res.At(i)
+	}
+	for _, d := range inferred {
+		d.Resource, d.Dependency = byID[d.Resource.ID()], byID[d.Dependency.ID()]
+	}
+	return out, inferred, nil
+}
+
+// A usedPath is a path that a resource needs to exist.
+type usedPath struct {
+	path string
+
+	// parentOnly is true if only the directories above path need to
+	// exist, as for a file that the resource creates.
+	parentOnly bool
+}
+
+// usedPaths returns the absolute paths that r uses: the paths that its
+// command uses if r is an exec resource, or the paths of its files if
+// r is a file or file group resource.
+func usedPaths(r Resource) ([]usedPath, error) {
+	if r.Which() != Resource_Which_exec {
+		files, err := resourceFiles(r)
+		if err != nil {
+			return nil, err
+		}
+		var paths []usedPath
+		for _, f := range files {
+			if f.Which() == File_Which_absent {
+				continue
+			}
+			p, err := f.Path()
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, usedPath{path: filepath.Clean(p), parentOnly: true})
+		}
+		return paths, nil
+	}
+	e, err := r.Exec()
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := e.Command()
+	if err != nil {
+		return nil, err
+	}
+	var paths []usedPath
+	if dir, err := cmd.WorkingDirectory(); err != nil {
+		return nil, err
+	} else if filepath.IsAbs(dir) {
+		paths = append(paths, usedPath{path: filepath.Clean(dir)})
+	}
+	if cmd.Which() != Exec_Command_Which_argv {
+		return paths, nil
+	}
+	argv, err := cmd.Argv()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < argv.Len(); i++ {
+		arg, err := argv.At(i)
+		if err != nil {
+			return nil, err
+		}
+		if j := strings.IndexByte(arg, '='); j != -1 && !filepath.IsAbs(arg) {
+			arg = arg[j+1:]
+		}
+		if filepath.IsAbs(arg) {
+			paths = append(paths, usedPath{path: filepath.Clean(arg)})
+		}
+	}
+	return paths, nil
+}
+
+// managingResource returns the index of the resource that manages p,
+// or the directory that p is in, along with the path that it manages.
+// If parentOnly is true, then only directories above p are considered.
+func managingResource(res Resource_List, managed map[string]int, p string, parentOnly bool) (int, string, bool) {
+	if i, ok := managed[p]; ok && !parentOnly {
+		return i, p, true
+	}
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if i, ok := managed[dir]; ok {
+			f, err := resourceFileAt(res.At(i), dir)
+			if err != nil || f.Which() != File_Which_directory {
+				return 0, "", false
+			}
+			return i, dir, true
+		}
+		if next := filepath.Dir(dir); next == dir {
+			return 0, "", false
+		}
+	}
+}
+
+// resourceFileAt returns the file that r manages at path p.
+func resourceFileAt(r Resource, p string) (File, error) {
+	files, err := resourceFiles(r)
+	if err != nil {
+		return File{}, err
+	}
+	for _, f := range files {
+		if fp, _ := f.Path(); filepath.Clean(fp) == p {
+			return f, nil
+		}
+	}
+	return File{}, fmt.Errorf("%s does not manage %s", describeResource(r), p)
+}
+
+// needsEdge reports whether adding a dependency from id to dep would
+// order them differently without making a cycle.
+func (g *reachGraph) needsEdge(id, dep uint64) (bool, error) {
+	d, err := g.descendants(id)
+	if err != nil {
+		return false, err
+	}
+	if d[dep] {
+		return false, nil
+	}
+	d, err = g.descendants(dep)
+	if err != nil {
+		return false, err
+	}
+	return !d[id], nil
+}
+
+// appendDependencies replaces r's dependency list with one that has ids
+// at the end.
+func appendDependencies(r Resource, ids []uint64) error {
+	old, err := r.Dependencies()
+	if err != nil {
+		return err
+	}
+	list, err := r.NewDependencies(int32(old.Len() + len(ids)))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < old.Len(); i++ {
+		list.Set(i, old.At(i))
+	}
+	for i, id := range ids {
+		list.Set(old.Len()+i, id)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import "testing"
+
+func TestInferDependencies(t *testing.T) {
+	c := newDepsCatalog(t, [][]uint64{
+		1: nil,
+		2: {1},
+		3: nil,
+		4: nil,
+		5: nil,
+		6: nil,
+		7: nil,
+	})
+	res, _ := c.Resources()
+	setTestFile(t, res.At(0), File_Which_directory, "/etc/app")
+	setTestFile(t, res.At(1), File_Which_plain, "/etc/app/app.conf")
+	// Uses the file, and a path in the directory that the file already
+	// depends on.
+	setTestExec(t, res.At(2), "", "/usr/bin/app", "--config=/etc/app/app.conf", "/etc/app/other")
+	// A file generated by the next command, which writes it.
+	f := setTestFile(t, res.At(3), File_Which_plain, "/etc/gen.conf")
+	f.Plain().SetContentFromOutput(5)
+	setTestExec(t, res.At(4), "", "/usr/bin/gen", "/etc/gen.conf")
+	// Runs in the directory.
+	setTestExec(t, res.At(5), "/etc/app/", "/usr/bin/make")
+	// A file in a directory below the managed one.
+	setTestFile(t, res.At(6), File_Which_plain, "/etc/app/conf.d/extra.conf")
+
+	out, inferred, err := InferDependencies(c)
+	if err != nil {
+		t.Fatal("InferDependencies:", err)
+	}
+	want := [][]uint64{
+		1: nil,
+		2: {1},
+		3: {2},
+		4: nil,
+		5: nil,
+		6: {1},
+		7: {1},
+	}
+	outRes, _ := out.Resources()
+	for i := 0; i < outRes.Len(); i++ {
+		r := outRes.At(i)
+		list, _ := r.Dependencies()
+		var got []uint64
+		for j := 0; j < list.Len(); j++ {
+			got = append(got, list.At(j))
+		}
+		if !uint64SlicesEqual(got, want[r.ID()]) {
+			t.Errorf("resource %d dependencies = %v; want %v", r.ID(), got, want[r.ID()])
+		}
+	}
+	if len(inferred) != 3 {
+		t.Fatalf("len(inferred) = %d; want 3", len(inferred))
+	}
+	if d := inferred[0]; d.Resource.ID() != 3 || d.Dependency.ID() != 2 || d.Path != "/etc/app/app.conf" {
+		t.Errorf("inferred[0] = %v; want resource 3 depends on 2 for /etc/app/app.conf", d)
+	}
+	if d := inferred[1]; d.Resource.ID() != 6 || d.Dependency.ID() != 1 || d.Path != "/etc/app" {
+		t.Errorf("inferred[1] = %v; want resource 6 depends on 1 for /etc/app", d)
+	}
+	if d := inferred[2]; d.Resource.ID() != 7 || d.Dependency.ID() != 1 || d.Path != "/etc/app" {
+		t.Errorf("inferred[2] = %v; want resource 7 depends on 1 for /etc/app", d)
+	}
+	if list, _ := res.At(2).Dependencies(); list.Len() != 0 {
+		t.Errorf("original resource 3 has %d dependencies after InferDependencies; want 0", list.Len())
+	}
+}
+
+func setTestFile(t *testing.T, r Resource, which File_Which, path string) File {
+	f, err := r.NewFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch which {
+	case File_Which_plain:
+		f.SetPlain()
+	case File_Which_directory:
+		f.SetDirectory()
+	default:
+		t.Fatalf("setTestFile: unsupported %v", which)
+	}
+	if err := f.SetPath(path); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func setTestExec(t *testing.T, r Resource, dir string, argv ...string) {
+	e, err := r.NewExec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := e.NewCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := cmd.NewArgv(int32(len(argv)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, arg := range argv {
+		if err := l.Set(i, arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dir != "" {
+		if err := cmd.SetWorkingDirectory(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
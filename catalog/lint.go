@@ -0,0 +1,223 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// Names of the rules that Lint checks.
+const (
+	// LintExecAlways flags exec resources that run their command on
+	// every application: their condition is always and they have no
+	// creates path.  Unless the command is idempotent, the catalog
+	// doesn't converge.
+	LintExecAlways = "exec-always"
+
+	// LintParentDependency flags file and file group resources that
+	// don't depend on the directory resource that manages the nearest
+	// directory above their path.  The file may be written before its
+	// directory is created.
+	LintParentDependency = "parent-dependency"
+)
+
+// lintRules are the rules that Lint checks.  Each check returns a
+// message if the resource violates the rule, or the empty string.
+var lintRules = []struct {
+	name  string
+	check func(lc *lintCatalog, r Resource) (string, error)
+}{
+	{LintExecAlways, lintExecAlways},
+	{LintParentDependency, lintParentDependency},
+}
+
+// LintRules returns the names of the rules that Lint checks, sorted.
+func LintRules() []string {
+	names := make([]string, len(lintRules))
+	for i, rule := range lintRules {
+		names[i] = rule.name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A Finding is a likely mistake that Lint found in a resource.
+type Finding struct {
+	Rule     string
+	Resource Resource
+	Message  string
+}
+
+func (f *Finding) String() string {
+	return fmt.Sprintf("%s: %s (%s)", describeResource(f.Resource), f.Message, f.Rule)
+}
+
+// Lint checks the resources of c against rules for writing catalogs
+// that converge, returning what it finds in catalog order.  Unlike the
+// errors from ValidateStructure and CheckConflicts, findings don't stop
+// a catalog from being applied.  Rules named in a resource's suppress
+// list are not checked for that resource.
+func Lint(c Catalog) ([]*Finding, error) {
+	res, err := c.Resources()
+	if err != nil {
+		return nil, fmt.Errorf("lint: %v", err)
+	}
+	lc, err := newLintCatalog(res)
+	if err != nil {
+		return nil, fmt.Errorf("lint: %v", err)
+	}
+	var findings []*Finding
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		suppress, err := r.Suppress()
+		if err != nil {
+			return nil, fmt.Errorf("lint: %s: suppress: %v", describeResource(r), err)
+		}
+		suppressed := make(map[string]bool, suppress.Len())
+		for j := 0; j < suppress.Len(); j++ {
+			name, err := suppress.At(j)
+			if err != nil {
+				return nil, fmt.Errorf("lint: %s: suppress: %v", describeResource(r), err)
+			}
+			suppressed[name] = true
+		}
+		for _, rule := range lintRules {
+			if suppressed[rule.name] {
+				continue
+			}
+			msg, err := rule.check(lc, r)
+			if err != nil {
+				return nil, fmt.Errorf("lint: %s: %v", describeResource(r), err)
+			}
+			if msg != "" {
+				findings = append(findings, &Finding{Rule: rule.name, Resource: r, Message: msg})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// lintCatalog is the information about a catalog that rules need to
+// check its resources.
+type lintCatalog struct {
+	res     Resource_List
+	graph   *reachGraph
+	managed map[string]int
+
+	// phase is the number of barriers before each resource, by ID.
+	phase map[uint64]int
+}
+
+func newLintCatalog(res Resource_List) (*lintCatalog, error) {
+	lc := &lintCatalog{
+		res: res,
+		graph: &reachGraph{
+			edges: make(map[uint64][]uint64, res.Len()),
+			desc:  make(map[uint64]map[uint64]bool, res.Len()),
+		},
+		managed: make(map[string]int),
+		phase:   make(map[uint64]int, res.Len()),
+	}
+	barriers := 0
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		deps, err := directDependencies(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", describeResource(r), err)
+		}
+		lc.graph.edges[r.ID()] = deps
+		if r.Which() == Resource_Which_barrier {
+			barriers++
+		}
+		lc.phase[r.ID()] = barriers
+		files, err := resourceFiles(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", describeResource(r), err)
+		}
+		for _, f := range files {
+			p, err := f.Path()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", describeResource(r), err)
+			}
+			lc.managed[filepath.Clean(p)] = i
+		}
+	}
+	return lc, nil
+}
+
+func lintExecAlways(lc *lintCatalog, r Resource) (string, error) {
+	if r.Which() != Resource_Which_exec {
+		return "", nil
+	}
+	e, err := r.Exec()
+	if err != nil {
+		return "", err
+	}
+	if e.Condition().Which() != Exec_condition_Which_always || e.HasSupervise() {
+		// Supervised commands are started once per run by design.
+		return "", nil
+	}
+	creates, err := e.Creates()
+	if err != nil {
+		return "", err
+	}
+	if creates != "" {
+		return "", nil
+	}
+	return "command runs on every application; guard it with creates or a condition, or suppress " + LintExecAlways + " if it is idempotent", nil
+}
+
+func lintParentDependency(lc *lintCatalog, r Resource) (string, error) {
+	if r.Which() != Resource_Which_file && r.Which() != Resource_Which_fileGroup {
+		return "", nil
+	}
+	paths, err := usedPaths(r)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range paths {
+		i, dir, ok := managingResource(lc.res, lc.managed, p.path, true)
+		if !ok {
+			continue
+		}
+		parent := lc.res.At(i)
+		if parent.ID() == r.ID() || lc.phase[parent.ID()] < lc.phase[r.ID()] {
+			// A barrier orders the directory first.
+			continue
+		}
+		desc, err := lc.graph.descendants(r.ID())
+		if err != nil {
+			return "", err
+		}
+		if !desc[parent.ID()] {
+			return fmt.Sprintf("%s is in %s, which %s manages, but the resource doesn't depend on it; add the dependency or apply with -infer_deps", p.path, dir, describeResource(parent)), nil
+		}
+	}
+	return "", nil
+}
+
+// describeResource returns a description of r for messages, preferring
+// its name to its comment.
+func describeResource(r Resource) string {
+	if name, _ := r.Name(); name != "" {
+		return fmt.Sprintf("resource %q", name)
+	}
+	if c, _ := r.Comment(); c != "" {
+		return fmt.Sprintf("resource %q (id=%d)", c, r.ID())
+	}
+	return fmt.Sprintf("resource id=%d", r.ID())
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name string
+		exec testExec
+		want []string
+	}{
+		{name: "always", exec: testExec{}, want: []string{LintExecAlways}},
+		{name: "creates", exec: testExec{creates: "/opt/app/installed"}},
+		{name: "fileAbsent", exec: testExec{fileAbsent: "/opt/app/installed"}},
+		{name: "ifDepsChanged", exec: testExec{ifDepsChanged: true}},
+		{name: "supervised", exec: testExec{supervise: true}},
+		{name: "suppressed", exec: testExec{suppress: []string{LintExecAlways}}},
+		{name: "other rule suppressed", exec: testExec{suppress: []string{"bogus"}}, want: []string{LintExecAlways}},
+	}
+	for _, test := range tests {
+		findings, err := Lint(newExecCatalog(t, test.exec))
+		if err != nil {
+			t.Errorf("%s: Lint: %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, f := range findings {
+			got = append(got, f.Rule)
+		}
+		if len(got) != len(test.want) || (len(got) > 0 && got[0] != test.want[0]) {
+			t.Errorf("%s: Lint rules = %q; want %q", test.name, got, test.want)
+		}
+	}
+}
+
+type testExec struct {
+	creates       string
+	fileAbsent    string
+	ifDepsChanged bool
+	supervise     bool
+	suppress      []string
+}
+
+// newExecCatalog returns a catalog with a noop resource with ID 1 and
+// an exec resource with ID 2 that depends on it.
+func newExecCatalog(t *testing.T, te testExec) Catalog {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRootCatalog(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.NewResources(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.At(0).SetID(1)
+	res.At(0).SetNoop()
+	r := res.At(1)
+	r.SetID(2)
+	deps, err := r.NewDependencies(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps.Set(0, 1)
+	if len(te.suppress) > 0 {
+		l, err := r.NewSuppress(int32(len(te.suppress)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, name := range te.suppress {
+			if err := l.Set(i, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	e, err := r.NewExec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := e.NewCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.SetBash("make install"); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case te.fileAbsent != "":
+		if err := e.Condition().SetFileAbsent(te.fileAbsent); err != nil {
+			t.Fatal(err)
+		}
+	case te.ifDepsChanged:
+		l, err := e.Condition().NewIfDepsChanged(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Set(0, 1)
+	default:
+		e.Condition().SetAlways()
+	}
+	if te.creates != "" {
+		if err := e.SetCreates(te.creates); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if te.supervise {
+		if _, err := e.NewSupervise(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+func TestLintParentDependency(t *testing.T) {
+	c := newDepsCatalog(t, [][]uint64{
+		1: nil,
+		2: nil,
+		3: {1},
+		4: nil,
+		5: nil,
+	})
+	res, _ := c.Resources()
+	setTestFile(t, res.At(0), File_Which_directory, "/etc/app")
+	setTestFile(t, res.At(1), File_Which_plain, "/etc/app/a.conf")
+	setTestFile(t, res.At(2), File_Which_plain, "/etc/app/b.conf")
+	res.At(3).SetBarrier()
+	setTestFile(t, res.At(4), File_Which_plain, "/etc/app/c.conf")
+
+	findings, err := Lint(c)
+	if err != nil {
+		t.Fatal("Lint:", err)
+	}
+	if len(findings) != 1 {
+		t.Fatalf("Lint returned %d findings; want 1: %v", len(findings), findings)
+	}
+	if f := findings[0]; f.Rule != LintParentDependency || f.Resource.ID() != 2 {
+		t.Errorf("findings[0] = %v; want %s for resource id=2", f, LintParentDependency)
+	}
+}
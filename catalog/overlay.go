@@ -0,0 +1,194 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// ApplyOverlay returns the catalogs in cats with the overlay's patches
+// applied to their resources.  Each catalog that a patch changes is
+// copied to a new message first, so the catalogs in cats are not
+// changed.  It returns an error if a patch doesn't match any resource
+// or can't be applied to the one it matches.
+func ApplyOverlay(cats []Catalog, o Overlay) ([]Catalog, error) {
+	patches, err := o.Patches()
+	if err != nil {
+		return nil, fmt.Errorf("apply overlay: %v", err)
+	}
+	out := append([]Catalog(nil), cats...)
+	copied := make([]bool, len(out))
+	for i := 0; i < patches.Len(); i++ {
+		p := patches.At(i)
+		name, _ := p.Name()
+		if p.ID() == 0 && name == "" {
+			return nil, fmt.Errorf("apply overlay: patch[%d]: no id or name", i)
+		}
+		ci, ri, err := findPatched(out, p.ID(), name)
+		if err != nil {
+			return nil, fmt.Errorf("apply overlay: patch[%d]: %v", i, err)
+		}
+		if ci == -1 {
+			return nil, fmt.Errorf("apply overlay: patch[%d]: %s not found", i, describePatch(p))
+		}
+		if !copied[ci] {
+			out[ci], err = copyCatalog(out[ci])
+			if err != nil {
+				return nil, fmt.Errorf("apply overlay: %v", err)
+			}
+			copied[ci] = true
+		}
+		res, _ := out[ci].Resources()
+		r := res.At(ri)
+		if err := applyPatch(r, p); err != nil {
+			return nil, fmt.Errorf("apply overlay: patch[%d]: %s: %v", i, describeResource(r), err)
+		}
+	}
+	return out, nil
+}
+
+// findPatched returns the indices of the catalog and resource with the
+// given ID, or if id is zero, the given name.  It returns -1 for the
+// catalog index if there is no such resource.
+func findPatched(cats []Catalog, id uint64, name string) (int, int, error) {
+	for ci, c := range cats {
+		res, err := c.Resources()
+		if err != nil {
+			return -1, -1, fmt.Errorf("catalog %d: %v", ci, err)
+		}
+		for ri := 0; ri < res.Len(); ri++ {
+			r := res.At(ri)
+			if id != 0 {
+				if r.ID() == id {
+					return ci, ri, nil
+				}
+				continue
+			}
+			if rname, _ := r.Name(); rname == name {
+				return ci, ri, nil
+			}
+		}
+	}
+	return -1, -1, nil
+}
+
+// copyCatalog copies c to a new message.
+func copyCatalog(c Catalog) (Catalog, error) {
+	msg, _, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return Catalog{}, err
+	}
+	if err := msg.SetRootPtr(c.Struct.ToPtr()); err != nil {
+		return Catalog{}, err
+	}
+	return ReadRootCatalog(msg)
+}
+
+func applyPatch(r Resource, p Patch) error {
+	if p.Disable() {
+		r.SetDisabled(true)
+	}
+	if p.HasContent() {
+		if r.Which() != Resource_Which_file {
+			return fmt.Errorf("content patch for %v resource", r.Which())
+		}
+		f, err := r.File()
+		if err != nil {
+			return err
+		}
+		if f.Which() != File_Which_plain {
+			return fmt.Errorf("content patch for %v file", f.Which())
+		}
+		content, err := p.Content()
+		if err != nil {
+			return fmt.Errorf("content: %v", err)
+		}
+		plain := f.Plain()
+		if err := plain.SetContent(content); err != nil {
+			return err
+		}
+		if err := plain.SetContentUrl(""); err != nil {
+			return err
+		}
+		if err := plain.SetContentPath(""); err != nil {
+			return err
+		}
+		plain.SetContentFromOutput(0)
+	}
+	if p.HasEnvironment() {
+		if r.Which() != Resource_Which_exec {
+			return fmt.Errorf("environment patch for %v resource", r.Which())
+		}
+		env, err := p.Environment()
+		if err != nil {
+			return fmt.Errorf("environment: %v", err)
+		}
+		e, err := r.Exec()
+		if err != nil {
+			return err
+		}
+		cmd, err := e.Command()
+		if err != nil {
+			return fmt.Errorf("command: %v", err)
+		}
+		if err := setEnvironment(cmd, env); err != nil {
+			return fmt.Errorf("command: %v", err)
+		}
+	}
+	return nil
+}
+
+// setEnvironment replaces the variables in cmd's environment that env
+// also sets and appends the rest.
+func setEnvironment(cmd Exec_Command, env Exec_Command_EnvVar_List) error {
+	own, err := cmd.Environment()
+	if err != nil {
+		return fmt.Errorf("environment: %v", err)
+	}
+	vars := make([]Exec_Command_EnvVar, 0, own.Len()+env.Len())
+	index := make(map[string]int, own.Len()+env.Len())
+	for _, list := range []Exec_Command_EnvVar_List{own, env} {
+		for i := 0; i < list.Len(); i++ {
+			ev := list.At(i)
+			name, _ := ev.Name()
+			if j, ok := index[name]; ok {
+				vars[j] = ev
+				continue
+			}
+			index[name] = len(vars)
+			vars = append(vars, ev)
+		}
+	}
+	list, err := cmd.NewEnvironment(int32(len(vars)))
+	if err != nil {
+		return err
+	}
+	for i, ev := range vars {
+		if err := list.Set(i, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func describePatch(p Patch) string {
+	if p.ID() != 0 {
+		return fmt.Sprintf("resource id=%d", p.ID())
+	}
+	name, _ := p.Name()
+	return fmt.Sprintf("resource %q", name)
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func TestApplyOverlay(t *testing.T) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRootCatalog(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.NewResources(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A plain file downloaded from a URL.
+	res.At(0).SetID(1)
+	if err := res.At(0).SetName("conf"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := res.At(0).NewFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetPlain()
+	if err := f.SetPath("/etc/app.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Plain().SetContentUrl("https://example.com/app.conf"); err != nil {
+		t.Fatal(err)
+	}
+	// An exec command with an environment.
+	res.At(1).SetID(2)
+	e, err := res.At(1).NewExec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := e.NewCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+	argv, err := cmd.NewArgv(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argv.Set(0, "/bin/true")
+	env, err := cmd.NewEnvironment(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEnvVar(t, env.At(0), "A", "1")
+	setEnvVar(t, env.At(1), "B", "2")
+	// A resource to disable.
+	res.At(2).SetID(3)
+	if err := res.At(2).SetName("debug"); err != nil {
+		t.Fatal(err)
+	}
+	deps, err := res.At(2).NewDependencies(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps.Set(0, 2)
+	if _, err := res.At(2).NewExec(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, oseg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewRootOverlay(oseg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patches, err := o.NewPatches(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := patches.At(0).SetName("conf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := patches.At(0).SetContent([]byte("production\n")); err != nil {
+		t.Fatal(err)
+	}
+	patches.At(1).SetID(2)
+	penv, err := patches.At(1).NewEnvironment(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEnvVar(t, penv.At(0), "B", "3")
+	setEnvVar(t, penv.At(1), "C", "4")
+	if err := patches.At(2).SetName("debug"); err != nil {
+		t.Fatal(err)
+	}
+	patches.At(2).SetDisable(true)
+
+	out, err := ApplyOverlay([]Catalog{c}, o)
+	if err != nil {
+		t.Fatal("ApplyOverlay:", err)
+	}
+	outRes, _ := out[0].Resources()
+	outFile, _ := outRes.At(0).File()
+	if content, _ := outFile.Plain().Content(); string(content) != "production\n" {
+		t.Errorf("file content = %q; want \"production\\n\"", content)
+	}
+	if outFile.Plain().HasContentUrl() {
+		t.Error("file still has contentUrl")
+	}
+	outExec, _ := outRes.At(1).Exec()
+	outCmd, _ := outExec.Command()
+	outEnv, _ := outCmd.Environment()
+	var got []string
+	for i := 0; i < outEnv.Len(); i++ {
+		name, _ := outEnv.At(i).Name()
+		value, _ := outEnv.At(i).Value()
+		got = append(got, name+"="+value)
+	}
+	if want := []string{"A=1", "B=3", "C=4"}; !stringSlicesEqual(got, want) {
+		t.Errorf("command environment = %q; want %q", got, want)
+	}
+	if !outRes.At(2).Disabled() {
+		t.Error("resource \"debug\" not disabled")
+	}
+
+	// The original catalog is unchanged.
+	if f.Plain().HasContent() || res.At(2).Disabled() {
+		t.Error("ApplyOverlay changed the original catalog")
+	}
+}
+
+func TestApplyOverlayNotFound(t *testing.T) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRootCatalog(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.NewResources(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.At(0).SetID(1)
+	_, oseg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewRootOverlay(oseg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patches, err := o.NewPatches(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patches.At(0).SetID(42)
+	patches.At(0).SetDisable(true)
+	if _, err := ApplyOverlay([]Catalog{c}, o); err == nil {
+		t.Error("ApplyOverlay with a patch for a missing resource did not return an error")
+	}
+}
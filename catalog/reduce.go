@@ -0,0 +1,232 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import "fmt"
+
+// ReduceDependencies returns a copy of c in a new message with
+// duplicate and redundant dependencies removed, such as from catalogs
+// written by generators that list every resource a resource needs.  A
+// dependency is redundant if the resource also depends on it
+// indirectly, through another of its dependencies, so the order that
+// resources are applied in is unchanged.  Dependencies named by an
+// ifDepsChanged list, and those of a launchd job that reloads if its
+// dependencies changed, are kept, since they change what triggers the
+// resource.  So are all of a no-op's dependencies, since a no-op is
+// changed only if one of its direct dependencies changed.  The result
+// also drops any space that c's message held for data no longer in the
+// catalog.  It returns an error if the dependencies have a cycle.
+func ReduceDependencies(c Catalog) (Catalog, error) {
+	out, err := copyCatalog(c)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("reduce dependencies: %v", err)
+	}
+	res, err := out.Resources()
+	if err != nil {
+		return Catalog{}, fmt.Errorf("reduce dependencies: %v", err)
+	}
+	g := &reachGraph{
+		edges: make(map[uint64][]uint64, res.Len()),
+		desc:  make(map[uint64]map[uint64]bool, res.Len()),
+	}
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		deps, err := directDependencies(r)
+		if err != nil {
+			return Catalog{}, fmt.Errorf("reduce dependencies: %s: %v", describeResource(r), err)
+		}
+		g.edges[r.ID()] = deps
+	}
+	for i := 0; i < res.Len(); i++ {
+		// Check for cycles up front, since resources whose dependencies
+		// are all kept never look at the rest of the graph.
+		if _, err := g.descendants(res.At(i).ID()); err != nil {
+			return Catalog{}, fmt.Errorf("reduce dependencies: %v", err)
+		}
+	}
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		if err := g.reduce(r); err != nil {
+			return Catalog{}, fmt.Errorf("reduce dependencies: %s: %v", describeResource(r), err)
+		}
+	}
+	// Copying again leaves out the replaced dependency lists.
+	out, err = copyCatalog(out)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("reduce dependencies: %v", err)
+	}
+	return out, nil
+}
+
+// reachGraph finds the resources reachable from each resource.
+type reachGraph struct {
+	edges map[uint64][]uint64
+
+	// desc maps a resource ID to the IDs of the resources that it
+	// depends on, directly or indirectly.  A nil entry marks a resource
+	// whose descendants are being found.
+	desc map[uint64]map[uint64]bool
+}
+
+// descendants returns the IDs of the resources that id depends on,
+// directly or indirectly.  IDs that aren't in the catalog, such as
+// ones that refer to another catalog, have no dependencies.
+func (g *reachGraph) descendants(id uint64) (map[uint64]bool, error) {
+	if d, ok := g.desc[id]; ok {
+		if d == nil {
+			return nil, fmt.Errorf("dependency cycle through resource %d", id)
+		}
+		return d, nil
+	}
+	g.desc[id] = nil
+	d := make(map[uint64]bool)
+	for _, dep := range g.edges[id] {
+		d[dep] = true
+		dd, err := g.descendants(dep)
+		if err != nil {
+			return nil, err
+		}
+		for x := range dd {
+			d[x] = true
+		}
+	}
+	g.desc[id] = d
+	return d, nil
+}
+
+// reduce rewrites r's dependencies without duplicates or dependencies
+// that are reachable through its other dependencies.
+func (g *reachGraph) reduce(r Resource) error {
+	list, err := r.Dependencies()
+	if err != nil {
+		return err
+	}
+	keep, err := triggerDependencies(r)
+	if err != nil {
+		return err
+	}
+	var deps []uint64
+	seen := make(map[uint64]bool, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		d := list.At(i)
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		if !keep[d] {
+			redundant, err := g.reachableAround(r.ID(), d)
+			if err != nil {
+				return err
+			}
+			if redundant {
+				continue
+			}
+		}
+		deps = append(deps, d)
+	}
+	if len(deps) == list.Len() {
+		return nil
+	}
+	newList, err := r.NewDependencies(int32(len(deps)))
+	if err != nil {
+		return err
+	}
+	for i, d := range deps {
+		newList.Set(i, d)
+	}
+	return nil
+}
+
+// reachableAround reports whether dep is reachable from id through one
+// of id's other dependencies.
+func (g *reachGraph) reachableAround(id, dep uint64) (bool, error) {
+	for _, e := range g.edges[id] {
+		if e == dep {
+			continue
+		}
+		d, err := g.descendants(e)
+		if err != nil {
+			return false, err
+		}
+		if d[dep] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// triggerDependencies returns the dependencies of r that must stay
+// direct because a change to them triggers r.  It returns a map with
+// every dependency if r is triggered by a change to any of them.
+func triggerDependencies(r Resource) (map[uint64]bool, error) {
+	var ids interface {
+		Len() int
+		At(int) uint64
+	}
+	switch r.Which() {
+	case Resource_Which_exec:
+		e, err := r.Exec()
+		if err != nil {
+			return nil, err
+		}
+		cond := e.Condition()
+		if cond.Which() != Exec_condition_Which_ifDepsChanged {
+			return nil, nil
+		}
+		l, err := cond.IfDepsChanged()
+		if err != nil {
+			return nil, err
+		}
+		ids = l
+	case Resource_Which_reboot:
+		rb, err := r.Reboot()
+		if err != nil {
+			return nil, err
+		}
+		l, err := rb.IfDepsChanged()
+		if err != nil {
+			return nil, err
+		}
+		ids = l
+	case Resource_Which_noop:
+		// A no-op passes on changes to its direct dependencies, so
+		// resources triggered by it would miss changes to the
+		// dependencies that it no longer lists.
+		var err error
+		ids, err = r.Dependencies()
+		if err != nil {
+			return nil, err
+		}
+	case Resource_Which_launchdJob:
+		l, err := r.LaunchdJob()
+		if err != nil {
+			return nil, err
+		}
+		if !l.ReloadIfDepsChanged() {
+			return nil, nil
+		}
+		ids, err = r.Dependencies()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	m := make(map[uint64]bool, ids.Len())
+	for i := 0; i < ids.Len(); i++ {
+		m[ids.At(i)] = true
+	}
+	return m, nil
+}
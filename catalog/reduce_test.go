@@ -0,0 +1,115 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func TestReduceDependencies(t *testing.T) {
+	c := newDepsCatalog(t, [][]uint64{
+		1: nil,
+		2: {1},
+		3: {1, 2, 2},
+		4: {1, 3},
+		5: {4, 3, 2, 1},
+		6: {5, 4, 4},
+	})
+	res, _ := c.Resources()
+	setTestExec(t, res.At(2), "", "/bin/true")
+	setTestExec(t, res.At(4), "", "/bin/true")
+	// Resource 6 is a no-op, which is changed only if one of its direct
+	// dependencies changed, so it keeps resource 4.
+	// Resource 4 runs if resource 1 changed, so the dependency stays.
+	e, err := res.At(3).NewExec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cond := e.Condition()
+	ifDeps, err := cond.NewIfDepsChanged(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifDeps.Set(0, 1)
+
+	out, err := ReduceDependencies(c)
+	if err != nil {
+		t.Fatal("ReduceDependencies:", err)
+	}
+	want := [][]uint64{
+		1: nil,
+		2: {1},
+		3: {2},
+		4: {1, 3},
+		5: {4},
+		6: {5, 4},
+	}
+	outRes, _ := out.Resources()
+	for i := 0; i < outRes.Len(); i++ {
+		r := outRes.At(i)
+		list, _ := r.Dependencies()
+		var got []uint64
+		for j := 0; j < list.Len(); j++ {
+			got = append(got, list.At(j))
+		}
+		if !uint64SlicesEqual(got, want[r.ID()]) {
+			t.Errorf("resource %d dependencies = %v; want %v", r.ID(), got, want[r.ID()])
+		}
+	}
+	if list, _ := res.At(4).Dependencies(); list.Len() != 4 {
+		t.Errorf("original resource 5 has %d dependencies after ReduceDependencies; want 4", list.Len())
+	}
+
+	cycle := newDepsCatalog(t, [][]uint64{
+		1: {3},
+		2: {1},
+		3: {2, 1},
+	})
+	if _, err := ReduceDependencies(cycle); err == nil {
+		t.Error("ReduceDependencies with a cycle did not return an error")
+	}
+}
+
+// newDepsCatalog returns a catalog of no-op resources with IDs from 1
+// to len(deps)-1, where deps[id] lists the dependencies of id.
+func newDepsCatalog(t *testing.T, deps [][]uint64) Catalog {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRootCatalog(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.NewResources(int32(len(deps) - 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 1; id < len(deps); id++ {
+		r := res.At(id - 1)
+		r.SetID(uint64(id))
+		r.SetNoop()
+		list, err := r.NewDependencies(int32(len(deps[id])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, d := range deps[id] {
+			list.Set(i, d)
+		}
+	}
+	return c
+}
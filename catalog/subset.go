@@ -0,0 +1,157 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// Subset returns a copy of c in a new message with only the resources
+// whose IDs are in keep, in their original order, so that part of a
+// catalog can be applied or inspected on its own.  The rest of the
+// catalog, like its metadata and defaults, is copied as-is.  It
+// returns an error if a kept resource depends on a resource that isn't
+// kept.
+func Subset(c Catalog, keep map[uint64]bool) (Catalog, error) {
+	res, err := c.Resources()
+	if err != nil {
+		return Catalog{}, fmt.Errorf("subset: %v", err)
+	}
+	var idx []int
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		if !keep[r.ID()] {
+			continue
+		}
+		deps, err := directDependencies(r)
+		if err != nil {
+			return Catalog{}, fmt.Errorf("subset: %s: %v", describeResource(r), err)
+		}
+		for _, d := range deps {
+			if !keep[d] {
+				return Catalog{}, fmt.Errorf("subset: %s depends on resource %d, which is not kept", describeResource(r), d)
+			}
+		}
+		idx = append(idx, i)
+	}
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return Catalog{}, fmt.Errorf("subset: %v", err)
+	}
+	out, err := NewRootCatalog(seg)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("subset: %v", err)
+	}
+	// Copy every field but the resources, including ones added to the
+	// schema later.  The resources are the first pointer.
+	for i := uint16(1); i < c.Struct.Size().PointerCount && i < out.Struct.Size().PointerCount; i++ {
+		p, err := c.Struct.Ptr(i)
+		if err != nil {
+			return Catalog{}, fmt.Errorf("subset: %v", err)
+		}
+		if err := out.Struct.SetPtr(i, p); err != nil {
+			return Catalog{}, fmt.Errorf("subset: %v", err)
+		}
+	}
+	list, err := out.NewResources(int32(len(idx)))
+	if err != nil {
+		return Catalog{}, fmt.Errorf("subset: %v", err)
+	}
+	for j, i := range idx {
+		if err := list.Set(j, res.At(i)); err != nil {
+			return Catalog{}, fmt.Errorf("subset: %v", err)
+		}
+	}
+	return out, nil
+}
+
+// DependencyClosure returns the IDs in ids along with the IDs of every
+// resource that they depend on, directly or indirectly, so that the
+// result can be passed to Subset.  A plain file that takes its content
+// from an exec resource's output depends on the exec resource.  The
+// implicit dependencies that barriers add are not followed, since
+// barriers only order the resources that are present.  The result is
+// sorted.  It returns an error if an ID isn't in c.
+func DependencyClosure(c Catalog, ids []uint64) ([]uint64, error) {
+	res, err := c.Resources()
+	if err != nil {
+		return nil, fmt.Errorf("dependency closure: %v", err)
+	}
+	byID := make(map[uint64]Resource, res.Len())
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		byID[r.ID()] = r
+	}
+	seen := make(map[uint64]bool, len(ids))
+	stack := append([]uint64(nil), ids...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[id] {
+			continue
+		}
+		r, ok := byID[id]
+		if !ok {
+			return nil, fmt.Errorf("dependency closure: no resource with ID %d", id)
+		}
+		seen[id] = true
+		deps, err := directDependencies(r)
+		if err != nil {
+			return nil, fmt.Errorf("dependency closure: %s: %v", describeResource(r), err)
+		}
+		stack = append(stack, deps...)
+	}
+	closure := make([]uint64, 0, len(seen))
+	for id := range seen {
+		closure = append(closure, id)
+	}
+	sort.Sort(uint64Slice(closure))
+	return closure, nil
+}
+
+type uint64Slice []uint64
+
+func (a uint64Slice) Len() int           { return len(a) }
+func (a uint64Slice) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// directDependencies returns the IDs of the resources that r lists as
+// dependencies, plus its content source if r is a plain file that
+// takes its content from an exec resource's output.
+func directDependencies(r Resource) ([]uint64, error) {
+	list, err := r.Dependencies()
+	if err != nil {
+		return nil, err
+	}
+	deps := make([]uint64, list.Len(), list.Len()+1)
+	for i := range deps {
+		deps[i] = list.At(i)
+	}
+	if r.Which() == Resource_Which_file {
+		f, err := r.File()
+		if err != nil {
+			return nil, err
+		}
+		if f.Which() == File_Which_plain {
+			if src := f.Plain().ContentFromOutput(); src != 0 {
+				deps = append(deps, src)
+			}
+		}
+	}
+	return deps, nil
+}
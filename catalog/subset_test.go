@@ -0,0 +1,129 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"testing"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func TestSubset(t *testing.T) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRootCatalog(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := c.NewMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.SetGenerator("mcm-luacat"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.NewResources(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An exec resource.
+	res.At(0).SetID(1)
+	if _, err := res.At(0).NewExec(); err != nil {
+		t.Fatal(err)
+	}
+	// A file that takes its content from resource 1.
+	res.At(1).SetID(2)
+	f, err := res.At(1).NewFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetPlain()
+	if err := f.SetPath("/etc/generated.conf"); err != nil {
+		t.Fatal(err)
+	}
+	f.Plain().SetContentFromOutput(1)
+	// A resource that depends on resource 2.
+	res.At(2).SetID(3)
+	if err := res.At(2).SetName("reload"); err != nil {
+		t.Fatal(err)
+	}
+	deps, err := res.At(2).NewDependencies(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps.Set(0, 2)
+	if _, err := res.At(2).NewExec(); err != nil {
+		t.Fatal(err)
+	}
+	// An unrelated resource.
+	res.At(3).SetID(4)
+	res.At(3).SetNoop()
+
+	closure, err := DependencyClosure(c, []uint64{3})
+	if err != nil {
+		t.Fatal("DependencyClosure:", err)
+	}
+	if want := []uint64{1, 2, 3}; !uint64SlicesEqual(closure, want) {
+		t.Errorf("DependencyClosure(c, [3]) = %v; want %v", closure, want)
+	}
+	if _, err := DependencyClosure(c, []uint64{5}); err == nil {
+		t.Error("DependencyClosure(c, [5]) did not return an error")
+	}
+
+	keep := make(map[uint64]bool)
+	for _, id := range closure {
+		keep[id] = true
+	}
+	out, err := Subset(c, keep)
+	if err != nil {
+		t.Fatal("Subset:", err)
+	}
+	outRes, _ := out.Resources()
+	var got []uint64
+	for i := 0; i < outRes.Len(); i++ {
+		got = append(got, outRes.At(i).ID())
+	}
+	if want := []uint64{1, 2, 3}; !uint64SlicesEqual(got, want) {
+		t.Errorf("Subset resource IDs = %v; want %v", got, want)
+	}
+	if name, _ := outRes.At(2).Name(); name != "reload" {
+		t.Errorf("resource 3 name = %q; want \"reload\"", name)
+	}
+	outMeta, _ := out.Metadata()
+	if gen, _ := outMeta.Generator(); gen != "mcm-luacat" {
+		t.Errorf("metadata generator = %q; want \"mcm-luacat\"", gen)
+	}
+	if n := res.Len(); n != 4 {
+		t.Errorf("original catalog has %d resources after Subset; want 4", n)
+	}
+
+	if _, err := Subset(c, map[uint64]bool{2: true, 3: true}); err == nil {
+		t.Error("Subset without content source did not return an error")
+	}
+}
+
+func uint64SlicesEqual(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
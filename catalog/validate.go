@@ -0,0 +1,957 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// Limits bounds the size of a catalog accepted by ValidateStructure.
+// A zero field uses the corresponding field of DefaultLimits.
+type Limits struct {
+	// MaxResources is the maximum number of resources in a catalog.
+	MaxResources int
+
+	// MaxListLen is the maximum length of any other list, such as a
+	// resource's dependencies or a command's arguments.
+	MaxListLen int
+
+	// MaxTextSize is the maximum size in bytes of each text field.
+	MaxTextSize int
+
+	// MaxContentSize is the maximum size in bytes of a file's content.
+	MaxContentSize int
+
+	// MaxTraversal is the number of bytes of the message that may be
+	// read while validating, which defends against pointers that
+	// refer to the same data many times.  The message's read limit is
+	// set to the same value afterward, so that validation does not use
+	// up the budget for later reads.
+	MaxTraversal uint64
+}
+
+// DefaultLimits is the set of limits used by ValidateStructure when
+// none are given.  They are far above what a reasonable catalog needs.
+var DefaultLimits = Limits{
+	MaxResources:   100000,
+	MaxListLen:     100000,
+	MaxTextSize:    1 << 20,
+	MaxContentSize: 64 << 20,
+	MaxTraversal:   256 << 20,
+}
+
+func (l *Limits) normalize() *Limits {
+	n := DefaultLimits
+	if l == nil {
+		return &n
+	}
+	if l.MaxResources > 0 {
+		n.MaxResources = l.MaxResources
+	}
+	if l.MaxListLen > 0 {
+		n.MaxListLen = l.MaxListLen
+	}
+	if l.MaxTextSize > 0 {
+		n.MaxTextSize = l.MaxTextSize
+	}
+	if l.MaxContentSize > 0 {
+		n.MaxContentSize = l.MaxContentSize
+	}
+	if l.MaxTraversal > 0 {
+		n.MaxTraversal = l.MaxTraversal
+	}
+	return &n
+}
+
+// ValidateStructure reads every field of c and returns an error if any
+// pointer is malformed, a union holds a member unknown to this version
+// of the schema, or a limit is exceeded.  Passing nil limits is the same
+// as passing DefaultLimits.  Once c has been validated, reading it can't
+// fail, so it is safe to hand to code that ignores read errors.
+func ValidateStructure(c Catalog, limits *Limits) error {
+	v := &validator{limits: limits.normalize()}
+	msg := c.Segment().Message()
+	msg.ReadLimiter().Reset(v.limits.MaxTraversal)
+	if err := v.catalog(c); err != nil {
+		return fmt.Errorf("validate catalog: %v", err)
+	}
+	msg.ReadLimiter().Reset(v.limits.MaxTraversal)
+	return nil
+}
+
+type validator struct {
+	limits *Limits
+}
+
+func (v *validator) catalog(c Catalog) error {
+	md, err := c.Metadata()
+	if err != nil {
+		return fmt.Errorf("metadata: %v", err)
+	}
+	if err := v.metadata(md); err != nil {
+		return fmt.Errorf("metadata: %v", err)
+	}
+	res, err := c.Resources()
+	if err != nil {
+		return fmt.Errorf("resources: %v", err)
+	}
+	if res.Len() > v.limits.MaxResources {
+		return fmt.Errorf("%d resources is over limit of %d", res.Len(), v.limits.MaxResources)
+	}
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		if err := v.resource(r); err != nil {
+			return fmt.Errorf("resource[%d] (id=%d): %v", i, r.ID(), err)
+		}
+	}
+	pre, err := c.Preconditions()
+	if err != nil {
+		return fmt.Errorf("preconditions: %v", err)
+	}
+	if err := v.listLen("preconditions", pre.Len()); err != nil {
+		return err
+	}
+	for i := 0; i < pre.Len(); i++ {
+		if err := v.precondition(pre.At(i)); err != nil {
+			return fmt.Errorf("precondition[%d]: %v", i, err)
+		}
+	}
+	d, err := c.Defaults()
+	if err != nil {
+		return fmt.Errorf("defaults: %v", err)
+	}
+	if err := v.defaults(d); err != nil {
+		return fmt.Errorf("defaults: %v", err)
+	}
+	return nil
+}
+
+func (v *validator) defaults(d Defaults) error {
+	fileMode, err := d.FileMode()
+	if err != nil {
+		return fmt.Errorf("file mode: %v", err)
+	}
+	if err := v.mode(fileMode); err != nil {
+		return fmt.Errorf("file mode: %v", err)
+	}
+	dirMode, err := d.DirectoryMode()
+	if err != nil {
+		return fmt.Errorf("directory mode: %v", err)
+	}
+	if err := v.mode(dirMode); err != nil {
+		return fmt.Errorf("directory mode: %v", err)
+	}
+	env, err := d.Environment()
+	if err != nil {
+		return fmt.Errorf("environment: %v", err)
+	}
+	return v.environment(env)
+}
+
+func (v *validator) precondition(p Precondition) error {
+	switch p.Which() {
+	case Precondition_Which_minDiskFree:
+		return v.text("path", p.MinDiskFree().PathBytes)
+	case Precondition_Which_binary:
+		return v.text("binary", p.BinaryBytes)
+	case Precondition_Which_minKernelVersion:
+		return v.text("min kernel version", p.MinKernelVersionBytes)
+	case Precondition_Which_privileged:
+		return nil
+	default:
+		return fmt.Errorf("unknown precondition %v", p.Which())
+	}
+}
+
+func (v *validator) metadata(md Metadata) error {
+	fields := []struct {
+		name string
+		f    func() ([]byte, error)
+	}{
+		{"generator", md.GeneratorBytes},
+		{"generatorVersion", md.GeneratorVersionBytes},
+		{"sourceRepo", md.SourceRepoBytes},
+		{"sourceCommit", md.SourceCommitBytes},
+		{"author", md.AuthorBytes},
+	}
+	for _, field := range fields {
+		if err := v.text(field.name, field.f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *validator) resource(r Resource) error {
+	if err := v.text("comment", r.CommentBytes); err != nil {
+		return err
+	}
+	if err := v.text("name", r.NameBytes); err != nil {
+		return err
+	}
+	tags, err := r.Tags()
+	if err != nil {
+		return fmt.Errorf("tags: %v", err)
+	}
+	if err := v.textList("tags", tags); err != nil {
+		return err
+	}
+	deps, err := r.Dependencies()
+	if err != nil {
+		return fmt.Errorf("dependencies: %v", err)
+	}
+	if err := v.listLen("dependencies", deps.Len()); err != nil {
+		return err
+	}
+	if err := v.text("deprecated", r.DeprecatedBytes); err != nil {
+		return err
+	}
+	if err := v.text("owner", r.OwnerBytes); err != nil {
+		return err
+	}
+	if err := v.text("docUrl", r.DocUrlBytes); err != nil {
+		return err
+	}
+	replaces, err := r.Replaces()
+	if err != nil {
+		return fmt.Errorf("replaces: %v", err)
+	}
+	if err := v.listLen("replaces", replaces.Len()); err != nil {
+		return err
+	}
+	suppress, err := r.Suppress()
+	if err != nil {
+		return fmt.Errorf("suppress: %v", err)
+	}
+	if err := v.textList("suppress", suppress); err != nil {
+		return err
+	}
+	switch r.Which() {
+	case Resource_Which_noop, Resource_Which_barrier:
+		return nil
+	case Resource_Which_file:
+		f, err := r.File()
+		if err != nil {
+			return fmt.Errorf("file: %v", err)
+		}
+		if err := v.file(f); err != nil {
+			return fmt.Errorf("file: %v", err)
+		}
+	case Resource_Which_exec:
+		e, err := r.Exec()
+		if err != nil {
+			return fmt.Errorf("exec: %v", err)
+		}
+		if err := v.exec(e); err != nil {
+			return fmt.Errorf("exec: %v", err)
+		}
+	case Resource_Which_healthCheck:
+		hc, err := r.HealthCheck()
+		if err != nil {
+			return fmt.Errorf("health check: %v", err)
+		}
+		if err := v.healthCheck(hc); err != nil {
+			return fmt.Errorf("health check: %v", err)
+		}
+	case Resource_Which_registryKey:
+		k, err := r.RegistryKey()
+		if err != nil {
+			return fmt.Errorf("registry key: %v", err)
+		}
+		if err := v.registryKey(k); err != nil {
+			return fmt.Errorf("registry key: %v", err)
+		}
+	case Resource_Which_registryValue:
+		rv, err := r.RegistryValue()
+		if err != nil {
+			return fmt.Errorf("registry value: %v", err)
+		}
+		if err := v.registryValue(rv); err != nil {
+			return fmt.Errorf("registry value: %v", err)
+		}
+	case Resource_Which_service:
+		s, err := r.Service()
+		if err != nil {
+			return fmt.Errorf("service: %v", err)
+		}
+		if err := v.service(s); err != nil {
+			return fmt.Errorf("service: %v", err)
+		}
+	case Resource_Which_launchdJob:
+		l, err := r.LaunchdJob()
+		if err != nil {
+			return fmt.Errorf("launchd job: %v", err)
+		}
+		if err := v.launchdJob(l); err != nil {
+			return fmt.Errorf("launchd job: %v", err)
+		}
+	case Resource_Which_userDefault:
+		d, err := r.UserDefault()
+		if err != nil {
+			return fmt.Errorf("user default: %v", err)
+		}
+		if err := v.userDefault(d); err != nil {
+			return fmt.Errorf("user default: %v", err)
+		}
+	case Resource_Which_packageRepo:
+		pr, err := r.PackageRepo()
+		if err != nil {
+			return fmt.Errorf("package repo: %v", err)
+		}
+		if err := v.packageRepo(pr); err != nil {
+			return fmt.Errorf("package repo: %v", err)
+		}
+	case Resource_Which_alternative:
+		a, err := r.Alternative()
+		if err != nil {
+			return fmt.Errorf("alternative: %v", err)
+		}
+		if err := v.alternative(a); err != nil {
+			return fmt.Errorf("alternative: %v", err)
+		}
+	case Resource_Which_reboot:
+		rb, err := r.Reboot()
+		if err != nil {
+			return fmt.Errorf("reboot: %v", err)
+		}
+		if err := v.reboot(rb); err != nil {
+			return fmt.Errorf("reboot: %v", err)
+		}
+	case Resource_Which_assert:
+		a, err := r.Assert()
+		if err != nil {
+			return fmt.Errorf("assert: %v", err)
+		}
+		if err := v.assert(a); err != nil {
+			return fmt.Errorf("assert: %v", err)
+		}
+	case Resource_Which_fileGroup:
+		g, err := r.FileGroup()
+		if err != nil {
+			return fmt.Errorf("file group: %v", err)
+		}
+		if err := v.fileGroup(g); err != nil {
+			return fmt.Errorf("file group: %v", err)
+		}
+	case Resource_Which_variant:
+		vr, err := r.Variant()
+		if err != nil {
+			return fmt.Errorf("variant: %v", err)
+		}
+		if err := v.variant(vr); err != nil {
+			return fmt.Errorf("variant: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown resource type %v", r.Which())
+	}
+	return nil
+}
+
+func (v *validator) file(f File) error {
+	if err := v.text("path", f.PathBytes); err != nil {
+		return err
+	}
+	switch f.Which() {
+	case File_Which_plain:
+		p := f.Plain()
+		content, err := p.Content()
+		if err != nil {
+			return fmt.Errorf("content: %v", err)
+		}
+		if len(content) > v.limits.MaxContentSize {
+			return fmt.Errorf("content size %d is over limit of %d", len(content), v.limits.MaxContentSize)
+		}
+		if err := v.text("content URL", p.ContentUrlBytes); err != nil {
+			return err
+		}
+		if err := v.text("content path", p.ContentPathBytes); err != nil {
+			return err
+		}
+		if p.HasVerify() {
+			c, err := p.Verify()
+			if err == nil {
+				err = v.command(c)
+			}
+			if err != nil {
+				return fmt.Errorf("verify: %v", err)
+			}
+		}
+		mode, err := p.Mode()
+		if err != nil {
+			return fmt.Errorf("mode: %v", err)
+		}
+		return v.mode(mode)
+	case File_Which_directory:
+		mode, err := f.Directory().Mode()
+		if err != nil {
+			return fmt.Errorf("mode: %v", err)
+		}
+		return v.mode(mode)
+	case File_Which_symlink:
+		return v.text("target", f.Symlink().TargetBytes)
+	case File_Which_absent:
+		return nil
+	default:
+		return fmt.Errorf("unknown file type %v", f.Which())
+	}
+}
+
+func (v *validator) mode(m File_Mode) error {
+	u, err := m.User()
+	if err != nil {
+		return fmt.Errorf("mode user: %v", err)
+	}
+	switch u.Which() {
+	case UserRef_Which_ID:
+	case UserRef_Which_name:
+		if err := v.text("mode user", u.NameBytes); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown user reference %v", u.Which())
+	}
+	g, err := m.Group()
+	if err != nil {
+		return fmt.Errorf("mode group: %v", err)
+	}
+	switch g.Which() {
+	case GroupRef_Which_ID:
+	case GroupRef_Which_name:
+		if err := v.text("mode group", g.NameBytes); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown group reference %v", g.Which())
+	}
+	return nil
+}
+
+func (v *validator) exec(e Exec) error {
+	cmd, err := e.Command()
+	if err != nil {
+		return fmt.Errorf("command: %v", err)
+	}
+	if err := v.command(cmd); err != nil {
+		return fmt.Errorf("command: %v", err)
+	}
+	cond := e.Condition()
+	switch cond.Which() {
+	case Exec_condition_Which_always:
+	case Exec_condition_Which_onlyIf:
+		c, err := cond.OnlyIf()
+		if err == nil {
+			err = v.command(c)
+		}
+		if err != nil {
+			return fmt.Errorf("onlyIf: %v", err)
+		}
+	case Exec_condition_Which_unless:
+		c, err := cond.Unless()
+		if err == nil {
+			err = v.command(c)
+		}
+		if err != nil {
+			return fmt.Errorf("unless: %v", err)
+		}
+	case Exec_condition_Which_fileAbsent:
+		if err := v.text("fileAbsent", cond.FileAbsentBytes); err != nil {
+			return err
+		}
+	case Exec_condition_Which_ifDepsChanged:
+		deps, err := cond.IfDepsChanged()
+		if err != nil {
+			return fmt.Errorf("ifDepsChanged: %v", err)
+		}
+		if err := v.listLen("ifDepsChanged", deps.Len()); err != nil {
+			return err
+		}
+	case Exec_condition_Which_healthy:
+		hc, err := cond.Healthy()
+		if err == nil {
+			err = v.healthCheck(hc)
+		}
+		if err != nil {
+			return fmt.Errorf("healthy: %v", err)
+		}
+	case Exec_condition_Which_until:
+		u, err := cond.Until()
+		if err == nil {
+			err = v.until(u)
+		}
+		if err != nil {
+			return fmt.Errorf("until: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown condition %v", cond.Which())
+	}
+	batch := e.Batch()
+	if err := v.text("batch key", batch.KeyBytes); err != nil {
+		return err
+	}
+	args, err := batch.Args()
+	if err != nil {
+		return fmt.Errorf("batch args: %v", err)
+	}
+	if err := v.textList("batch args", args); err != nil {
+		return err
+	}
+	if err := v.text("creates", e.CreatesBytes); err != nil {
+		return err
+	}
+	expect := e.Expect()
+	if err := v.text("expect output pattern", expect.OutputPatternBytes); err != nil {
+		return err
+	}
+	codes, err := expect.ExitCodes()
+	if err != nil {
+		return fmt.Errorf("expect exit codes: %v", err)
+	}
+	if err := v.listLen("expect exit codes", codes.Len()); err != nil {
+		return err
+	}
+	sup, err := e.Supervise()
+	if err != nil {
+		return fmt.Errorf("supervise: %v", err)
+	}
+	if sup.HasReadyCommand() {
+		c, err := sup.ReadyCommand()
+		if err == nil {
+			err = v.command(c)
+		}
+		if err != nil {
+			return fmt.Errorf("supervise ready command: %v", err)
+		}
+	}
+	return v.text("supervise ready address", sup.ReadyAddressBytes)
+}
+
+func (v *validator) command(c Exec_Command) error {
+	switch c.Which() {
+	case Exec_Command_Which_argv:
+		argv, err := c.Argv()
+		if err != nil {
+			return fmt.Errorf("argv: %v", err)
+		}
+		if err := v.textList("argv", argv); err != nil {
+			return err
+		}
+	case Exec_Command_Which_bash:
+		if err := v.text("bash", c.BashBytes); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown command type %v", c.Which())
+	}
+	env, err := c.Environment()
+	if err != nil {
+		return fmt.Errorf("environment: %v", err)
+	}
+	if err := v.environment(env); err != nil {
+		return err
+	}
+	if err := v.text("working directory", c.WorkingDirectoryBytes); err != nil {
+		return err
+	}
+	mode, err := c.WorkingDirectoryMode()
+	if err != nil {
+		return fmt.Errorf("working directory mode: %v", err)
+	}
+	return v.mode(mode)
+}
+
+func (v *validator) until(u Exec_Until) error {
+	switch u.Which() {
+	case Exec_Until_Which_command:
+		c, err := u.Command()
+		if err == nil {
+			err = v.command(c)
+		}
+		if err != nil {
+			return fmt.Errorf("command: %v", err)
+		}
+		return nil
+	case Exec_Until_Which_fileExists:
+		return v.text("file exists", u.FileExistsBytes)
+	default:
+		return fmt.Errorf("unknown probe %v", u.Which())
+	}
+}
+
+func (v *validator) healthCheck(hc HealthCheck) error {
+	switch hc.Which() {
+	case HealthCheck_Which_tcpAddress:
+		return v.text("tcp address", hc.TcpAddressBytes)
+	case HealthCheck_Which_httpUrl:
+		return v.text("http URL", hc.HttpUrlBytes)
+	default:
+		return fmt.Errorf("unknown health check type %v", hc.Which())
+	}
+}
+
+func (v *validator) registryKey(k RegistryKey) error {
+	if err := v.text("path", k.PathBytes); err != nil {
+		return err
+	}
+	switch k.Which() {
+	case RegistryKey_Which_present, RegistryKey_Which_absent:
+		return nil
+	default:
+		return fmt.Errorf("unknown registry key state %v", k.Which())
+	}
+}
+
+func (v *validator) registryValue(rv RegistryValue) error {
+	if err := v.text("key", rv.KeyBytes); err != nil {
+		return err
+	}
+	if err := v.text("name", rv.NameBytes); err != nil {
+		return err
+	}
+	switch rv.Which() {
+	case RegistryValue_Which_sz:
+		return v.text("sz", rv.SzBytes)
+	case RegistryValue_Which_expandSz:
+		return v.text("expand sz", rv.ExpandSzBytes)
+	case RegistryValue_Which_multiSz:
+		l, err := rv.MultiSz()
+		if err != nil {
+			return fmt.Errorf("multi sz: %v", err)
+		}
+		return v.textList("multi sz", l)
+	case RegistryValue_Which_binary:
+		data, err := rv.Binary()
+		if err != nil {
+			return fmt.Errorf("binary: %v", err)
+		}
+		if len(data) > v.limits.MaxContentSize {
+			return fmt.Errorf("binary size %d is over limit of %d", len(data), v.limits.MaxContentSize)
+		}
+		return nil
+	case RegistryValue_Which_dword, RegistryValue_Which_qword, RegistryValue_Which_absent:
+		return nil
+	default:
+		return fmt.Errorf("unknown registry value type %v", rv.Which())
+	}
+}
+
+func (v *validator) service(s Service) error {
+	if err := v.text("name", s.NameBytes); err != nil {
+		return err
+	}
+	if err := v.text("binary path", s.BinaryPathBytes); err != nil {
+		return err
+	}
+	return v.text("display name", s.DisplayNameBytes)
+}
+
+func (v *validator) launchdJob(l LaunchdJob) error {
+	if err := v.text("label", l.LabelBytes); err != nil {
+		return err
+	}
+	if err := v.text("plist path", l.PlistPathBytes); err != nil {
+		return err
+	}
+	if err := v.text("domain", l.DomainBytes); err != nil {
+		return err
+	}
+	switch l.Which() {
+	case LaunchdJob_Which_loaded, LaunchdJob_Which_unloaded:
+		return nil
+	default:
+		return fmt.Errorf("unknown launchd job state %v", l.Which())
+	}
+}
+
+func (v *validator) userDefault(d UserDefault) error {
+	if err := v.text("domain", d.DomainBytes); err != nil {
+		return err
+	}
+	if err := v.text("key", d.KeyBytes); err != nil {
+		return err
+	}
+	switch d.Which() {
+	case UserDefault_Which_text:
+		return v.text("text", d.TextBytes)
+	case UserDefault_Which_integer, UserDefault_Which_real, UserDefault_Which_boolean, UserDefault_Which_absent:
+		return nil
+	default:
+		return fmt.Errorf("unknown user default type %v", d.Which())
+	}
+}
+
+func (v *validator) packageRepo(pr PackageRepo) error {
+	if err := v.text("name", pr.NameBytes); err != nil {
+		return err
+	}
+	switch pr.Which() {
+	case PackageRepo_Which_apt:
+		a, err := pr.Apt()
+		if err != nil {
+			return fmt.Errorf("apt: %v", err)
+		}
+		if err := v.text("uri", a.UriBytes); err != nil {
+			return err
+		}
+		if err := v.text("suite", a.SuiteBytes); err != nil {
+			return err
+		}
+		comps, err := a.Components()
+		if err != nil {
+			return fmt.Errorf("components: %v", err)
+		}
+		if err := v.textList("components", comps); err != nil {
+			return err
+		}
+		archs, err := a.Architectures()
+		if err != nil {
+			return fmt.Errorf("architectures: %v", err)
+		}
+		if err := v.textList("architectures", archs); err != nil {
+			return err
+		}
+		key, err := a.SigningKey()
+		if err != nil {
+			return fmt.Errorf("signing key: %v", err)
+		}
+		if len(key) > v.limits.MaxContentSize {
+			return fmt.Errorf("signing key size %d is over limit of %d", len(key), v.limits.MaxContentSize)
+		}
+		return nil
+	case PackageRepo_Which_yum:
+		y, err := pr.Yum()
+		if err != nil {
+			return fmt.Errorf("yum: %v", err)
+		}
+		if err := v.text("description", y.DescriptionBytes); err != nil {
+			return err
+		}
+		if err := v.text("base URL", y.BaseUrlBytes); err != nil {
+			return err
+		}
+		key, err := y.GpgKey()
+		if err != nil {
+			return fmt.Errorf("GPG key: %v", err)
+		}
+		if len(key) > v.limits.MaxContentSize {
+			return fmt.Errorf("GPG key size %d is over limit of %d", len(key), v.limits.MaxContentSize)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown package repo type %v", pr.Which())
+	}
+}
+
+func (v *validator) alternative(a Alternative) error {
+	if err := v.text("name", a.NameBytes); err != nil {
+		return err
+	}
+	if err := v.text("link", a.LinkBytes); err != nil {
+		return err
+	}
+	return v.text("path", a.PathBytes)
+}
+
+func (v *validator) reboot(rb Reboot) error {
+	paths, err := rb.TriggerPaths()
+	if err != nil {
+		return fmt.Errorf("trigger paths: %v", err)
+	}
+	if err := v.textList("trigger paths", paths); err != nil {
+		return err
+	}
+	deps, err := rb.IfDepsChanged()
+	if err != nil {
+		return fmt.Errorf("ifDepsChanged: %v", err)
+	}
+	if err := v.listLen("ifDepsChanged", deps.Len()); err != nil {
+		return err
+	}
+	return v.text("message", rb.MessageBytes)
+}
+
+func (v *validator) assert(a Assert) error {
+	switch a.Which() {
+	case Assert_Which_fileExists:
+		if err := v.text("file exists", a.FileExistsBytes); err != nil {
+			return err
+		}
+	case Assert_Which_fileHash:
+		fh, err := a.FileHash()
+		if err != nil {
+			return fmt.Errorf("file hash: %v", err)
+		}
+		if err := v.text("file hash path", fh.PathBytes); err != nil {
+			return err
+		}
+		if err := v.text("file hash sha256", fh.Sha256Bytes); err != nil {
+			return err
+		}
+	case Assert_Which_command:
+		c, err := a.Command()
+		if err != nil {
+			return fmt.Errorf("command: %v", err)
+		}
+		if err := v.command(c); err != nil {
+			return fmt.Errorf("command: %v", err)
+		}
+	case Assert_Which_tcpAddress:
+		if err := v.text("tcp address", a.TcpAddressBytes); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown assertion %v", a.Which())
+	}
+	return v.text("message", a.MessageBytes)
+}
+
+func (v *validator) fileGroup(g FileGroup) error {
+	files, err := g.Files()
+	if err != nil {
+		return fmt.Errorf("files: %v", err)
+	}
+	for i, n := 0, files.Len(); i < n; i++ {
+		if err := v.file(files.At(i)); err != nil {
+			return fmt.Errorf("files[%d]: %v", i, err)
+		}
+	}
+	if g.HasValidate() {
+		c, err := g.Validate()
+		if err == nil {
+			err = v.command(c)
+		}
+		if err != nil {
+			return fmt.Errorf("validate: %v", err)
+		}
+	}
+	return nil
+}
+
+func (v *validator) variant(vr Variant) error {
+	cases, err := vr.Cases()
+	if err != nil {
+		return fmt.Errorf("cases: %v", err)
+	}
+	if err := v.listLen("cases", cases.Len()); err != nil {
+		return err
+	}
+	for i := 0; i < cases.Len(); i++ {
+		cs := cases.At(i)
+		when, err := cs.When()
+		if err != nil {
+			return fmt.Errorf("cases[%d]: when: %v", i, err)
+		}
+		if err := v.listLen(fmt.Sprintf("cases[%d]: when", i), when.Len()); err != nil {
+			return err
+		}
+		for j := 0; j < when.Len(); j++ {
+			sel := when.At(j)
+			if err := v.text(fmt.Sprintf("cases[%d]: when[%d]: variable", i, j), sel.VariableBytes); err != nil {
+				return err
+			}
+			values, err := sel.Values()
+			if err != nil {
+				return fmt.Errorf("cases[%d]: when[%d]: values: %v", i, j, err)
+			}
+			if err := v.textList(fmt.Sprintf("cases[%d]: when[%d]: values", i, j), values); err != nil {
+				return err
+			}
+		}
+		r, err := cs.Resource()
+		if err != nil {
+			return fmt.Errorf("cases[%d]: resource: %v", i, err)
+		}
+		if err := v.resource(r); err != nil {
+			return fmt.Errorf("cases[%d]: resource: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// environment checks a command's environment variables, including
+// any secret sources.
+func (v *validator) environment(env Exec_Command_EnvVar_List) error {
+	if err := v.listLen("environment", env.Len()); err != nil {
+		return err
+	}
+	for i := 0; i < env.Len(); i++ {
+		ev := env.At(i)
+		if err := v.text(fmt.Sprintf("environment[%d] name", i), ev.NameBytes); err != nil {
+			return err
+		}
+		if err := v.text(fmt.Sprintf("environment[%d] value", i), ev.ValueBytes); err != nil {
+			return err
+		}
+		if ev.HasSecret() {
+			if err := v.secret(fmt.Sprintf("environment[%d] secret", i), ev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *validator) secret(name string, ev Exec_Command_EnvVar) error {
+	if v, _ := ev.ValueBytes(); len(v) > 0 {
+		return fmt.Errorf("%s: value must be empty", name)
+	}
+	s, err := ev.Secret()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	switch s.Which() {
+	case Exec_Command_Secret_Which_systemdCredential:
+		return v.text(name+" systemd credential", s.SystemdCredentialBytes)
+	case Exec_Command_Secret_Which_keyring:
+		return v.text(name+" keyring", s.KeyringBytes)
+	case Exec_Command_Secret_Which_file:
+		return v.text(name+" file", s.FileBytes)
+	default:
+		return fmt.Errorf("%s: unknown type %v", name, s.Which())
+	}
+}
+
+// text checks a text field read by f.
+func (v *validator) text(name string, f func() ([]byte, error)) error {
+	b, err := f()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if len(b) > v.limits.MaxTextSize {
+		return fmt.Errorf("%s: size %d is over limit of %d", name, len(b), v.limits.MaxTextSize)
+	}
+	return nil
+}
+
+func (v *validator) textList(name string, l capnp.TextList) error {
+	if err := v.listLen(name, l.Len()); err != nil {
+		return err
+	}
+	for i := 0; i < l.Len(); i++ {
+		i := i
+		if err := v.text(fmt.Sprintf("%s[%d]", name, i), func() ([]byte, error) { return l.BytesAt(i) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *validator) listLen(name string, n int) error {
+	if n > v.limits.MaxListLen {
+		return fmt.Errorf("%s: length %d is over limit of %d", name, n, v.limits.MaxListLen)
+	}
+	return nil
+}
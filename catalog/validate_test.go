@@ -0,0 +1,156 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func TestValidateStructure(t *testing.T) {
+	c := newTestCatalog(t, 2)
+	if err := ValidateStructure(c, nil); err != nil {
+		t.Fatal("ValidateStructure:", err)
+	}
+	// Validation reads the whole catalog, but the budget it used is
+	// given back afterward.
+	limits := &Limits{MaxTraversal: 4096}
+	if err := ValidateStructure(c, limits); err != nil {
+		t.Fatal("ValidateStructure with small traversal limit:", err)
+	}
+	res, err := c.Resources()
+	if err != nil {
+		t.Fatal("Resources after ValidateStructure:", err)
+	}
+	if _, err := res.At(0).File(); err != nil {
+		t.Error("File after ValidateStructure:", err)
+	}
+}
+
+func TestValidateStructureLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		want   string
+	}{
+		{"resources", Limits{MaxResources: 1}, "3 resources is over limit of 1"},
+		{"text", Limits{MaxTextSize: 4}, "path: size"},
+		{"content", Limits{MaxContentSize: 2}, "content size 5 is over limit of 2"},
+		{"list", Limits{MaxListLen: 1}, "argv: length 2 is over limit of 1"},
+		{"traversal", Limits{MaxTraversal: 64}, "validate catalog"},
+	}
+	for _, test := range tests {
+		c := newTestCatalog(t, 2)
+		err := ValidateStructure(c, &test.limits)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: ValidateStructure(...) = %v; want error containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestValidateStructureUnknownUnion(t *testing.T) {
+	c := newTestCatalog(t, 1)
+	res, err := c.Resources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resource's union discriminant is at byte 8 of its data section.
+	res.At(0).Struct.SetUint16(8, 99)
+	err = ValidateStructure(c, nil)
+	if err == nil || !strings.Contains(err.Error(), "unknown resource type") {
+		t.Errorf("ValidateStructure(...) = %v; want unknown resource type error", err)
+	}
+}
+
+func TestValidateStructureBadPointer(t *testing.T) {
+	// A catalog whose resources list lies far outside of the segment.
+	seg := make([]byte, 16)
+	binary.LittleEndian.PutUint64(seg[0:], 1<<48)                 // root: struct, 0 data words, 1 pointer
+	binary.LittleEndian.PutUint64(seg[8:], 1|1000<<2|7<<32|1<<35) // list at +1000 words, composite, 1 word
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	binary.Write(buf, binary.LittleEndian, uint32(len(seg)/8))
+	buf.Write(seg)
+	msg, err := capnp.NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal("Decode:", err)
+	}
+	c, err := ReadRootCatalog(msg)
+	if err != nil {
+		t.Fatal("ReadRootCatalog:", err)
+	}
+	if err := ValidateStructure(c, nil); err == nil {
+		t.Error("ValidateStructure did not return an error")
+	}
+}
+
+// newTestCatalog returns a catalog with n exec resources that each depend
+// on a plain file resource.
+func newTestCatalog(t *testing.T, n int) Catalog {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRootCatalog(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.NewResources(int32(n) + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := res.At(0)
+	r.SetID(1)
+	f, err := r.NewFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetPath("/etc/motd"); err != nil {
+		t.Fatal(err)
+	}
+	f.SetPlain()
+	if err := f.Plain().SetContent([]byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		r := res.At(i)
+		r.SetID(uint64(i + 1))
+		deps, err := r.NewDependencies(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deps.Set(0, 1)
+		e, err := r.NewExec()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, err := e.NewCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		argv, err := cmd.NewArgv(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		argv.Set(0, "/bin/echo")
+		argv.Set(1, "hi")
+		e.Condition().SetAlways()
+	}
+	return c
+}
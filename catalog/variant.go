@@ -0,0 +1,218 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SelectVariants returns a catalog like c, but with each variant
+// resource replaced by the resource of its first case whose selectors
+// all match vars.  The replacement keeps the variant's ID, name,
+// dependencies, and other fields that aren't part of the resource's
+// type.  If c has no variants, then c is returned as-is; otherwise the
+// result is a copy in a new message, and c is not changed.  It returns
+// an error if no case of a variant matches or if the matching case is
+// itself a variant.
+func SelectVariants(c Catalog, vars map[string]string) (Catalog, error) {
+	res, err := c.Resources()
+	if err != nil {
+		return Catalog{}, fmt.Errorf("select variants: %v", err)
+	}
+	var idx []int
+	for i := 0; i < res.Len(); i++ {
+		if res.At(i).Which() == Resource_Which_variant {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) == 0 {
+		return c, nil
+	}
+	out, err := copyCatalog(c)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("select variants: %v", err)
+	}
+	outRes, err := out.Resources()
+	if err != nil {
+		return Catalog{}, fmt.Errorf("select variants: %v", err)
+	}
+	for _, i := range idx {
+		r := res.At(i)
+		sel, err := selectCase(r, vars)
+		if err != nil {
+			return Catalog{}, fmt.Errorf("select variants: %s: %v", describeResource(r), err)
+		}
+		if err := outRes.Set(i, sel); err != nil {
+			return Catalog{}, fmt.Errorf("select variants: %s: %v", describeResource(r), err)
+		}
+		if err := copyResourceHeader(outRes.At(i), r); err != nil {
+			return Catalog{}, fmt.Errorf("select variants: %s: %v", describeResource(r), err)
+		}
+	}
+	// Copy again to drop the unselected cases from the message.
+	out, err = copyCatalog(out)
+	if err != nil {
+		return Catalog{}, fmt.Errorf("select variants: %v", err)
+	}
+	return out, nil
+}
+
+// selectCase returns the resource of the first case of the variant
+// resource r that matches vars.
+func selectCase(r Resource, vars map[string]string) (Resource, error) {
+	v, err := r.Variant()
+	if err != nil {
+		return Resource{}, err
+	}
+	cases, err := v.Cases()
+	if err != nil {
+		return Resource{}, fmt.Errorf("cases: %v", err)
+	}
+	var names []string
+	for i := 0; i < cases.Len(); i++ {
+		when, err := cases.At(i).When()
+		if err != nil {
+			return Resource{}, fmt.Errorf("cases[%d]: %v", i, err)
+		}
+		ok := true
+		for j := 0; j < when.Len() && ok; j++ {
+			name, err := when.At(j).Variable()
+			if err != nil {
+				return Resource{}, fmt.Errorf("cases[%d]: when[%d]: %v", i, j, err)
+			}
+			names = appendUnique(names, name)
+			val, set := vars[name]
+			ok, err = selectorMatches(when.At(j), val, set)
+			if err != nil {
+				return Resource{}, fmt.Errorf("cases[%d]: when[%d]: %v", i, j, err)
+			}
+		}
+		if !ok {
+			continue
+		}
+		sel, err := cases.At(i).Resource()
+		if err != nil {
+			return Resource{}, fmt.Errorf("cases[%d]: %v", i, err)
+		}
+		if sel.Which() == Resource_Which_variant {
+			return Resource{}, fmt.Errorf("cases[%d]: variant can't contain a variant", i)
+		}
+		return sel, nil
+	}
+	if len(names) == 0 {
+		return Resource{}, fmt.Errorf("no cases")
+	}
+	desc := make([]string, len(names))
+	for i, name := range names {
+		if val, ok := vars[name]; ok {
+			desc[i] = fmt.Sprintf("%s=%q", name, val)
+		} else {
+			desc[i] = name + " unset"
+		}
+	}
+	return Resource{}, fmt.Errorf("no case matches %s", strings.Join(desc, ", "))
+}
+
+// selectorMatches reports whether s matches a variable's value.  set
+// is false if the variable is not set.
+func selectorMatches(s Variant_Selector, val string, set bool) (bool, error) {
+	if !set {
+		return false, nil
+	}
+	values, err := s.Values()
+	if err != nil {
+		return false, fmt.Errorf("values: %v", err)
+	}
+	if values.Len() == 0 {
+		return true, nil
+	}
+	for i := 0; i < values.Len(); i++ {
+		pattern, err := values.At(i)
+		if err != nil {
+			return false, fmt.Errorf("values[%d]: %v", i, err)
+		}
+		ok, err := path.Match(pattern, val)
+		if err != nil {
+			return false, fmt.Errorf("values[%d]: %q: %v", i, pattern, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, t := range list {
+		if t == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// copyResourceHeader sets the fields of dst that aren't part of its
+// type to those of src.
+func copyResourceHeader(dst, src Resource) error {
+	dst.SetID(src.ID())
+	dst.SetDisabled(src.Disabled())
+	texts := []struct {
+		get func() (string, error)
+		set func(string) error
+	}{
+		{src.Comment, dst.SetComment},
+		{src.Name, dst.SetName},
+		{src.Deprecated, dst.SetDeprecated},
+		{src.Owner, dst.SetOwner},
+		{src.DocUrl, dst.SetDocUrl},
+	}
+	for _, t := range texts {
+		s, err := t.get()
+		if err != nil {
+			return err
+		}
+		if err := t.set(s); err != nil {
+			return err
+		}
+	}
+	deps, err := src.Dependencies()
+	if err != nil {
+		return err
+	}
+	if err := dst.SetDependencies(deps); err != nil {
+		return err
+	}
+	replaces, err := src.Replaces()
+	if err != nil {
+		return err
+	}
+	if err := dst.SetReplaces(replaces); err != nil {
+		return err
+	}
+	tags, err := src.Tags()
+	if err != nil {
+		return err
+	}
+	if err := dst.SetTags(tags); err != nil {
+		return err
+	}
+	suppress, err := src.Suppress()
+	if err != nil {
+		return err
+	}
+	return dst.SetSuppress(suppress)
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catalog
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelectVariants(t *testing.T) {
+	c := newDepsCatalog(t, [][]uint64{
+		1: nil,
+		2: {1},
+	})
+	res, _ := c.Resources()
+	r := res.At(1)
+	if err := r.SetName("pkg"); err != nil {
+		t.Fatal(err)
+	}
+	v, err := r.NewVariant()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases, err := v.NewCases(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apt := setTestCase(t, cases.At(0), "facts.os_release.ID", "debian", "ubuntu")
+	setTestFile(t, apt, File_Which_plain, "/etc/apt/apt.conf")
+	apt.SetID(99)
+	yum := setTestCase(t, cases.At(1), "facts.os_release.ID", "rhel*")
+	setTestFile(t, yum, File_Which_plain, "/etc/yum.conf")
+	def := setTestCase(t, cases.At(2), "")
+	def.SetNoop()
+
+	tests := []struct {
+		id    string
+		which Resource_Which
+		path  string
+	}{
+		{"ubuntu", Resource_Which_file, "/etc/apt/apt.conf"},
+		{"rhel-server", Resource_Which_file, "/etc/yum.conf"},
+		{"arch", Resource_Which_noop, ""},
+	}
+	for _, test := range tests {
+		out, err := SelectVariants(c, map[string]string{"facts.os_release.ID": test.id})
+		if err != nil {
+			t.Errorf("SelectVariants(ID=%q): %v", test.id, err)
+			continue
+		}
+		outRes, _ := out.Resources()
+		if outRes.Len() != 2 {
+			t.Errorf("SelectVariants(ID=%q) has %d resources; want 2", test.id, outRes.Len())
+			continue
+		}
+		sel := outRes.At(1)
+		if sel.Which() != test.which {
+			t.Errorf("SelectVariants(ID=%q) resource type = %v; want %v", test.id, sel.Which(), test.which)
+			continue
+		}
+		if sel.ID() != 2 {
+			t.Errorf("SelectVariants(ID=%q) resource ID = %d; want 2", test.id, sel.ID())
+		}
+		if name, _ := sel.Name(); name != "pkg" {
+			t.Errorf("SelectVariants(ID=%q) resource name = %q; want \"pkg\"", test.id, name)
+		}
+		if deps, _ := sel.Dependencies(); deps.Len() != 1 || deps.At(0) != 1 {
+			t.Errorf("SelectVariants(ID=%q) resource dependencies have length %d; want [1]", test.id, deps.Len())
+		}
+		if test.which == Resource_Which_file {
+			f, _ := sel.File()
+			if path, _ := f.Path(); path != test.path {
+				t.Errorf("SelectVariants(ID=%q) path = %q; want %q", test.id, path, test.path)
+			}
+		}
+	}
+	if res.At(1).Which() != Resource_Which_variant {
+		t.Errorf("original resource 2 is %v after SelectVariants; want variant", res.At(1).Which())
+	}
+}
+
+func TestSelectVariants_NoMatch(t *testing.T) {
+	c := newDepsCatalog(t, [][]uint64{
+		1: nil,
+	})
+	res, _ := c.Resources()
+	v, err := res.At(0).NewVariant()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases, err := v.NewCases(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestCase(t, cases.At(0), "facts.os", "linux").SetNoop()
+
+	_, err = SelectVariants(c, map[string]string{"facts.os": "darwin"})
+	if err == nil || !strings.Contains(err.Error(), `facts.os="darwin"`) {
+		t.Errorf("SelectVariants(os=darwin) = %v; want no case matches error", err)
+	}
+	_, err = SelectVariants(c, nil)
+	if err == nil || !strings.Contains(err.Error(), "facts.os unset") {
+		t.Errorf("SelectVariants(nil) = %v; want no case matches error", err)
+	}
+}
+
+// setTestCase fills in cs with a selector for variable, unless it's
+// empty, and returns the case's new resource.
+func setTestCase(t *testing.T, cs Variant_Case, variable string, values ...string) Resource {
+	if variable != "" {
+		when, err := cs.NewWhen(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sel := when.At(0)
+		if err := sel.SetVariable(variable); err != nil {
+			t.Fatal(err)
+		}
+		l, err := sel.NewValues(int32(len(values)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range values {
+			if err := l.Set(i, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	r, err := cs.NewResource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/cloudinit/cloudinitlib"
+	"github.com/zombiezen/mcm/internal/catcrypt"
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// userDataWarnSize is the smallest user data limit among the common
+// clouds (EC2's).
+const userDataWarnSize = 16 << 10
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s [options] (-exec FILE | -exec_url URL) [CATALOG]\n", name)
+	flag.PrintDefaults()
+}
+
+func main() {
+	c := new(cloudinitlib.Config)
+	format := flag.String("format", "cloud-config", "output format: cloud-config (user data) or systemd (image build script that installs a first-boot unit)")
+	execPath := flag.String("exec", "", "path to the mcm-exec binary to embed")
+	flag.StringVar(&c.ExecURL, "exec_url", "", "URL the machine downloads mcm-exec from at boot instead of embedding it")
+	flag.StringVar(&c.ExecSHA256, "exec_sha256", "", "hex-encoded SHA-256 hash that the -exec_url download must match")
+	flag.Var((*argsFlag)(&c.ExecArgs), "exec_arg", "flag to pass to mcm-exec on the machine (repeatable)")
+	flag.StringVar(&c.Dir, "dir", cloudinitlib.DefaultDir, "directory on the machine to install the catalog and boot script to")
+	flag.StringVar(&c.ExecPath, "exec_path", cloudinitlib.DefaultExecPath, "path on the machine to install mcm-exec to")
+	outPath := flag.String("o", "", "file to write to instead of stdout")
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+	var write func(io.Writer, *cloudinitlib.Config) error
+	switch *format {
+	case "cloud-config":
+		write = cloudinitlib.CloudConfig
+	case "systemd":
+		write = cloudinitlib.FirstBootScript
+	default:
+		fmt.Fprintf(os.Stderr, "mcm-cloudinit: unknown -format %q\n", *format)
+		os.Exit(2)
+	}
+
+	if *execPath != "" {
+		var err error
+		c.Exec, err = ioutil.ReadFile(*execPath)
+		if err != nil {
+			die(err)
+		}
+	}
+	if arg := flag.Arg(0); download.IsURL(arg) {
+		c.CatalogURL = arg
+	} else {
+		var err error
+		if arg == "" || arg == "-" {
+			c.Catalog, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			c.Catalog, err = ioutil.ReadFile(arg)
+		}
+		if err != nil {
+			die(err)
+		}
+		if err := checkCatalog(c.Catalog); err != nil {
+			die(err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := write(buf, c); err != nil {
+		die(err)
+	}
+	if *format == "cloud-config" && buf.Len() > userDataWarnSize {
+		fmt.Fprintf(os.Stderr, "mcm-cloudinit: warning: user data is %d bytes, more than some clouds allow (%d); consider -exec_url or a catalog URL\n", buf.Len(), userDataWarnSize)
+	}
+	var err error
+	if *outPath == "" || *outPath == "-" {
+		_, err = os.Stdout.Write(buf.Bytes())
+	} else {
+		err = ioutil.WriteFile(*outPath, buf.Bytes(), 0600)
+	}
+	if err != nil {
+		die(err)
+	}
+}
+
+// checkCatalog verifies that data is a catalog.  Encrypted catalogs
+// can't be checked without the key, so they are accepted as-is.
+func checkCatalog(data []byte) error {
+	if catcrypt.IsEncrypted(data) {
+		return nil
+	}
+	msg, err := capnp.NewDecoder(bytes.NewReader(data)).Decode()
+	if err != nil {
+		return fmt.Errorf("read catalog: %v", err)
+	}
+	if _, err := catalog.ReadRootCatalog(msg); err != nil {
+		return fmt.Errorf("read catalog: %v", err)
+	}
+	return nil
+}
+
+// argsFlag is a flag.Value that collects each occurrence of a flag.
+type argsFlag []string
+
+func (f *argsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *argsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, "mcm-cloudinit:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,287 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloudinitlib provides the functionality of the mcm-cloudinit
+// tool: packaging a catalog and mcm-exec so that a new machine applies
+// the catalog on its first boot.
+package cloudinitlib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Default install locations on the target machine.
+const (
+	DefaultDir      = "/var/lib/mcm"
+	DefaultExecPath = "/usr/local/bin/mcm-exec"
+)
+
+// UnitName is the name of the systemd unit installed by FirstBootScript.
+const UnitName = "mcm-firstboot.service"
+
+// Names of files inside of Config.Dir.
+const (
+	catalogName = "catalog.bin"
+	scriptName  = "firstboot.sh"
+	doneName    = "firstboot.done"
+)
+
+// Config describes what to install on the target machine.
+type Config struct {
+	// Catalog is the serialized catalog to embed.  Exactly one of
+	// Catalog or CatalogURL must be set.
+	Catalog []byte
+
+	// CatalogURL is the location that mcm-exec downloads the catalog
+	// from at boot.
+	CatalogURL string
+
+	// Exec is the mcm-exec binary to embed.  Exactly one of Exec or
+	// ExecURL must be set.
+	Exec []byte
+
+	// ExecURL is the location that the mcm-exec binary is downloaded
+	// from at boot, using curl.  If ExecSHA256 is not empty, then it is
+	// the hex-encoded SHA-256 hash that the download must match.
+	ExecURL    string
+	ExecSHA256 string
+
+	// ExecArgs are flags passed to mcm-exec before the catalog.
+	ExecArgs []string
+
+	// Dir is the directory that the catalog and boot script are
+	// installed to.  If empty, then DefaultDir is used.
+	Dir string
+
+	// ExecPath is where mcm-exec is installed.  If empty, then
+	// DefaultExecPath is used.
+	ExecPath string
+}
+
+func (c *Config) validate() error {
+	if (c.Catalog == nil) == (c.CatalogURL == "") {
+		return errors.New("exactly one of catalog or catalog URL must be given")
+	}
+	if (c.Exec == nil) == (c.ExecURL == "") {
+		return errors.New("exactly one of mcm-exec binary or mcm-exec URL must be given")
+	}
+	if c.ExecSHA256 != "" && c.ExecURL == "" {
+		return errors.New("mcm-exec hash given without URL")
+	}
+	if c.ExecSHA256 != "" && !isHexSHA256(c.ExecSHA256) {
+		return fmt.Errorf("mcm-exec hash %q is not a hex-encoded SHA-256 hash", c.ExecSHA256)
+	}
+	for _, p := range []string{c.dir(), c.execPath()} {
+		if !path.IsAbs(p) {
+			return fmt.Errorf("%s is not an absolute path", p)
+		}
+	}
+	return nil
+}
+
+func isHexSHA256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f' || 'A' <= s[i] && s[i] <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Config) dir() string {
+	if c.Dir == "" {
+		return DefaultDir
+	}
+	return c.Dir
+}
+
+func (c *Config) execPath() string {
+	if c.ExecPath == "" {
+		return DefaultExecPath
+	}
+	return c.ExecPath
+}
+
+func (c *Config) catalogPath() string {
+	return path.Join(c.dir(), catalogName)
+}
+
+func (c *Config) scriptPath() string {
+	return path.Join(c.dir(), scriptName)
+}
+
+// bootScript returns the shell script that runs at first boot.  It
+// downloads mcm-exec if necessary, applies the catalog, and then marks
+// the machine as converged so that the systemd unit doesn't run again.
+func (c *Config) bootScript() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("#!/bin/sh\n# Generated by mcm-cloudinit.\nset -e\n")
+	execPath := c.execPath()
+	if c.ExecURL != "" {
+		fmt.Fprintf(buf, "curl -fsSL --retry 5 -o %s %s\n", shellQuote(execPath), shellQuote(c.ExecURL))
+		if c.ExecSHA256 != "" {
+			fmt.Fprintf(buf, "echo %s | sha256sum -c -\n", shellQuote(strings.ToLower(c.ExecSHA256)+"  "+execPath))
+		}
+		fmt.Fprintf(buf, "chmod 0755 %s\n", shellQuote(execPath))
+	}
+	args := []string{execPath}
+	args = append(args, c.ExecArgs...)
+	if c.CatalogURL != "" {
+		args = append(args, c.CatalogURL)
+	} else {
+		args = append(args, c.catalogPath())
+	}
+	for i, arg := range args {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(shellQuote(arg))
+	}
+	buf.WriteByte('\n')
+	fmt.Fprintf(buf, "touch %s\n", shellQuote(path.Join(c.dir(), doneName)))
+	return buf.Bytes()
+}
+
+// unit returns the systemd unit that runs the boot script.
+func (c *Config) unit() []byte {
+	return []byte(fmt.Sprintf(`# Generated by mcm-cloudinit.
+[Unit]
+Description=Apply mcm catalog on first boot
+Wants=network-online.target
+After=network-online.target
+ConditionPathExists=!%s
+
+[Service]
+Type=oneshot
+ExecStart=/bin/sh %s
+
+[Install]
+WantedBy=multi-user.target
+`, path.Join(c.dir(), doneName), c.scriptPath()))
+}
+
+// A file is a file to install on the target machine.
+type file struct {
+	path    string
+	mode    string
+	content []byte
+}
+
+func (c *Config) files() []file {
+	var files []file
+	if c.Exec != nil {
+		files = append(files, file{c.execPath(), "0755", c.Exec})
+	}
+	if c.Catalog != nil {
+		// The catalog may contain secrets.
+		files = append(files, file{c.catalogPath(), "0600", c.Catalog})
+	}
+	files = append(files, file{c.scriptPath(), "0700", c.bootScript()})
+	return files
+}
+
+// CloudConfig writes a cloud-config user-data document that installs
+// mcm-exec and the catalog and applies the catalog.  cloud-init runs
+// the commands once per instance.
+func CloudConfig(w io.Writer, c *Config) error {
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("cloud-config: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("#cloud-config\n# Generated by mcm-cloudinit.\nwrite_files:\n")
+	for _, f := range c.files() {
+		fmt.Fprintf(buf, "- path: %s\n  permissions: %s\n  owner: root:root\n  encoding: gz+b64\n  content: |\n", yamlQuote(f.path), yamlQuote(f.mode))
+		if err := writeEncoded(buf, "    ", f.content); err != nil {
+			return fmt.Errorf("cloud-config: %v", err)
+		}
+	}
+	fmt.Fprintf(buf, "runcmd:\n- [%s, %s]\n", yamlQuote("/bin/sh"), yamlQuote(c.scriptPath()))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// FirstBootScript writes a shell script that installs mcm-exec, the
+// catalog, and a systemd unit that applies the catalog on the next
+// boot.  It is meant to be run while building a machine image.
+func FirstBootScript(w io.Writer, c *Config) error {
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("first boot script: %v", err)
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("#!/bin/sh\n# Generated by mcm-cloudinit.  Run as root while building an image.\nset -e\n")
+	fmt.Fprintf(buf, "mkdir -p %s\n", shellQuote(c.dir()))
+	files := append(c.files(), file{path.Join("/etc/systemd/system", UnitName), "0644", c.unit()})
+	for i, f := range files {
+		marker := fmt.Sprintf("MCM_EOF_%d", i)
+		fmt.Fprintf(buf, "base64 -d <<'%s' | gunzip > %s\n", marker, shellQuote(f.path))
+		if err := writeEncoded(buf, "", f.content); err != nil {
+			return fmt.Errorf("first boot script: %v", err)
+		}
+		fmt.Fprintf(buf, "%s\nchmod %s %s\n", marker, f.mode, shellQuote(f.path))
+	}
+	fmt.Fprintf(buf, "rm -f %s\nsystemctl enable %s\n", shellQuote(path.Join(c.dir(), doneName)), UnitName)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeEncoded writes data gzipped and base64-encoded, in lines of 76
+// characters that start with indent.
+func writeEncoded(buf *bytes.Buffer, indent string, data []byte) error {
+	zbuf := new(bytes.Buffer)
+	zw, err := gzip.NewWriterLevel(zbuf, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	enc := base64.StdEncoding.EncodeToString(zbuf.Bytes())
+	for len(enc) > 0 {
+		n := 76
+		if n > len(enc) {
+			n = len(enc)
+		}
+		buf.WriteString(indent)
+		buf.WriteString(enc[:n])
+		buf.WriteByte('\n')
+		enc = enc[n:]
+	}
+	return nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:+,@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// yamlQuote returns s as a single-quoted YAML scalar.
+func yamlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudinitlib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCloudConfig(t *testing.T) {
+	c := &Config{
+		Catalog:  []byte("catalog bytes"),
+		Exec:     []byte("\x7fELF..."),
+		ExecArgs: []string{"-log-format", "json"},
+	}
+	buf := new(bytes.Buffer)
+	if err := CloudConfig(buf, c); err != nil {
+		t.Fatal("CloudConfig:", err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "#cloud-config\n") {
+		t.Errorf("CloudConfig output does not start with #cloud-config:\n%s", out)
+	}
+	files := parseWriteFiles(t, out)
+	if got := files[DefaultExecPath]; got != "\x7fELF..." {
+		t.Errorf("%s content = %q; want \"\\x7fELF...\"", DefaultExecPath, got)
+	}
+	if got := files["/var/lib/mcm/catalog.bin"]; got != "catalog bytes" {
+		t.Errorf("catalog content = %q; want \"catalog bytes\"", got)
+	}
+	script := files["/var/lib/mcm/firstboot.sh"]
+	if !strings.Contains(script, "/usr/local/bin/mcm-exec -log-format json /var/lib/mcm/catalog.bin\n") {
+		t.Errorf("boot script does not run mcm-exec on the catalog:\n%s", script)
+	}
+	if !strings.Contains(out, "runcmd:\n- ['/bin/sh', '/var/lib/mcm/firstboot.sh']\n") {
+		t.Errorf("CloudConfig output does not run the boot script:\n%s", out)
+	}
+}
+
+func TestFirstBootScript(t *testing.T) {
+	c := &Config{
+		CatalogURL: "s3://bucket/web.bin",
+		ExecURL:    "https://example.com/mcm-exec",
+		ExecSHA256: strings.Repeat("ab", 32),
+		Dir:        "/opt/mcm",
+	}
+	buf := new(bytes.Buffer)
+	if err := FirstBootScript(buf, c); err != nil {
+		t.Fatal("FirstBootScript:", err)
+	}
+	files := parseHeredocs(t, buf.String())
+	if len(files) != 2 {
+		t.Errorf("FirstBootScript installs %d files; want 2 (boot script and unit)", len(files))
+	}
+	script := files["/opt/mcm/firstboot.sh"]
+	for _, want := range []string{
+		"curl -fsSL --retry 5 -o /usr/local/bin/mcm-exec https://example.com/mcm-exec\n",
+		"sha256sum -c -\n",
+		"/usr/local/bin/mcm-exec s3://bucket/web.bin\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("boot script does not contain %q:\n%s", want, script)
+		}
+	}
+	unit := files["/etc/systemd/system/"+UnitName]
+	for _, want := range []string{"ConditionPathExists=!/opt/mcm/firstboot.done\n", "ExecStart=/bin/sh /opt/mcm/firstboot.sh\n"} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit does not contain %q:\n%s", want, unit)
+		}
+	}
+	if !strings.Contains(buf.String(), "systemctl enable "+UnitName+"\n") {
+		t.Error("FirstBootScript does not enable the unit")
+	}
+}
+
+func TestBootScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found:", err)
+	}
+	dir, err := ioutil.TempDir("", "cloudinitlib_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fakeExec := filepath.Join(dir, "mcm-exec")
+	argsPath := filepath.Join(dir, "args")
+	fake := "#!/bin/sh\nfor arg in \"$@\"; do echo \"$arg\"; done > " + shellQuote(argsPath) + "\n"
+	if err := ioutil.WriteFile(fakeExec, []byte(fake), 0700); err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		Catalog:  []byte("catalog"),
+		ExecURL:  "https://example.com/unused",
+		ExecArgs: []string{"-v", "it's quoted"},
+		Dir:      dir,
+		ExecPath: fakeExec,
+	}
+	script := c.bootScript()
+	// Skip the download, since the fake is already in place.
+	script = bytes.Replace(script, []byte("curl "), []byte(": "), 1)
+	cmd := exec.Command("sh", "-c", string(script))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("boot script: %v; output:\n%s", err, out)
+	}
+	args, err := ioutil.ReadFile(argsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-v\nit's quoted\n" + filepath.Join(dir, catalogName) + "\n"; string(args) != want {
+		t.Errorf("mcm-exec args = %q; want %q", args, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, doneName)); err != nil {
+		t.Error("boot script did not mark first boot as done:", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    Config
+	}{
+		{"no catalog", Config{Exec: []byte("x")}},
+		{"both catalogs", Config{Catalog: []byte("c"), CatalogURL: "https://example.com/c", Exec: []byte("x")}},
+		{"no exec", Config{Catalog: []byte("c")}},
+		{"hash without URL", Config{Catalog: []byte("c"), Exec: []byte("x"), ExecSHA256: strings.Repeat("0", 64)}},
+		{"bad hash", Config{Catalog: []byte("c"), ExecURL: "https://example.com/x", ExecSHA256: "1234"}},
+		{"relative dir", Config{Catalog: []byte("c"), Exec: []byte("x"), Dir: "mcm"}},
+	}
+	for _, test := range tests {
+		if err := CloudConfig(ioutil.Discard, &test.c); err == nil {
+			t.Errorf("%s: CloudConfig did not return an error", test.name)
+		}
+	}
+}
+
+// parseWriteFiles returns the decoded contents of the write_files
+// entries of a cloud-config document produced by CloudConfig.
+func parseWriteFiles(t *testing.T, doc string) map[string]string {
+	files := make(map[string]string)
+	var path string
+	var enc *bytes.Buffer
+	flush := func() {
+		if enc != nil {
+			files[path] = gunzipBase64(t, enc.String())
+			enc = nil
+		}
+	}
+	for _, line := range strings.Split(doc, "\n") {
+		switch {
+		case strings.HasPrefix(line, "- path: "):
+			flush()
+			path = strings.Trim(strings.TrimPrefix(line, "- path: "), "'")
+		case line == "  content: |":
+			enc = new(bytes.Buffer)
+		case enc != nil && strings.HasPrefix(line, "    "):
+			enc.WriteString(strings.TrimSpace(line))
+		default:
+			flush()
+		}
+	}
+	return files
+}
+
+// parseHeredocs returns the decoded contents of the files written by a
+// script produced by FirstBootScript.
+func parseHeredocs(t *testing.T, script string) map[string]string {
+	files := make(map[string]string)
+	lines := strings.Split(script, "\n")
+	for i := 0; i < len(lines); i++ {
+		const prefix = "base64 -d <<'"
+		if !strings.HasPrefix(lines[i], prefix) {
+			continue
+		}
+		marker := lines[i][len(prefix):strings.Index(lines[i], "' |")]
+		path := lines[i][strings.LastIndex(lines[i], "> ")+2:]
+		enc := new(bytes.Buffer)
+		for i++; i < len(lines) && lines[i] != marker; i++ {
+			enc.WriteString(lines[i])
+		}
+		files[path] = gunzipBase64(t, enc.String())
+	}
+	return files
+}
+
+func gunzipBase64(t *testing.T, s string) string {
+	z, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal("decode base64:", err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		t.Fatal("gunzip:", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("gunzip:", err)
+	}
+	return string(data)
+}
@@ -0,0 +1,213 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/depgraph"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// Fill colors of resources in a diff.
+const (
+	addedColor   = "palegreen"
+	removedColor = "lightpink"
+	changedColor = "lightgoldenrod1"
+)
+
+// Edge colors of dependencies in a diff.
+const (
+	addedEdgeColor   = "green4"
+	removedEdgeColor = "red3"
+)
+
+// printDiff prints a graph of the resources of both catalogs, with the
+// resources and dependencies that were added, removed, or changed
+// between old and new colored.  A resource in new that replaces one in
+// old is drawn in place of the old one.
+func printDiff(old, new catalog.Catalog) error {
+	oldRes, err := old.Resources()
+	if err != nil {
+		return fmt.Errorf("old catalog: %v", err)
+	}
+	newRes, err := new.Resources()
+	if err != nil {
+		return fmt.Errorf("new catalog: %v", err)
+	}
+	oldEdges, err := catalogEdges(oldRes)
+	if err != nil {
+		return fmt.Errorf("old catalog: %v", err)
+	}
+	newEdges, err := catalogEdges(newRes)
+	if err != nil {
+		return fmt.Errorf("new catalog: %v", err)
+	}
+
+	// Map the IDs of old resources to the IDs in the new catalog.
+	oldByID := make(map[uint64]catalog.Resource, oldRes.Len())
+	for i := 0; i < oldRes.Len(); i++ {
+		r := oldRes.At(i)
+		oldByID[r.ID()] = r
+	}
+	inNew := make(map[uint64]bool, newRes.Len())
+	for i := 0; i < newRes.Len(); i++ {
+		inNew[newRes.At(i).ID()] = true
+	}
+	renamed := make(map[uint64]uint64)
+	for i := 0; i < newRes.Len(); i++ {
+		r := newRes.At(i)
+		replaces, _ := r.Replaces()
+		for j := 0; j < replaces.Len(); j++ {
+			id := replaces.At(j)
+			if _, inOld := oldByID[id]; inOld && !inNew[id] {
+				renamed[id] = r.ID()
+			}
+		}
+	}
+	newID := func(id uint64) uint64 {
+		if n, ok := renamed[id]; ok {
+			return n
+		}
+		return id
+	}
+	matched := make(map[uint64]catalog.Resource, oldRes.Len())
+	for id, r := range oldByID {
+		matched[newID(id)] = r
+	}
+
+	fmt.Println("digraph catalog {")
+	for i := 0; i < newRes.Len(); i++ {
+		r := newRes.At(i)
+		printNode(r)
+		o, ok := matched[r.ID()]
+		if !ok {
+			fmt.Printf("  %d [style=filled, fillcolor=%s];\n", r.ID(), addedColor)
+			continue
+		}
+		same, err := sameResource(o, r)
+		if err != nil {
+			return fmt.Errorf("resource %d: %v", r.ID(), err)
+		}
+		if !same {
+			fmt.Printf("  %d [style=filled, fillcolor=%s];\n", r.ID(), changedColor)
+		}
+	}
+	for i := 0; i < oldRes.Len(); i++ {
+		r := oldRes.At(i)
+		if _, ok := renamed[r.ID()]; ok || inNew[r.ID()] {
+			continue
+		}
+		printNode(r)
+		fmt.Printf("  %d [style=filled, fillcolor=%s];\n", r.ID(), removedColor)
+	}
+	fmt.Println()
+
+	oldSet := make(map[edge]bool, len(oldEdges))
+	for _, e := range oldEdges {
+		e.from, e.to = newID(e.from), newID(e.to)
+		oldSet[e] = true
+	}
+	newSet := make(map[edge]bool, len(newEdges))
+	for _, e := range newEdges {
+		newSet[e] = true
+		if oldSet[e] {
+			printEdge(e, "")
+		} else {
+			printEdge(e, addedEdgeColor)
+		}
+	}
+	for _, e := range oldEdges {
+		e.from, e.to = newID(e.from), newID(e.to)
+		if !newSet[e] {
+			printEdge(e, removedEdgeColor)
+			newSet[e] = true // only draw the edge once
+		}
+	}
+	fmt.Println("}")
+	return nil
+}
+
+// An edge is a dependency in the graph.
+type edge struct {
+	from, to uint64
+	implicit bool
+}
+
+// catalogEdges returns the listed and implicit dependencies of the
+// resources.
+func catalogEdges(res catalog.Resource_List) ([]edge, error) {
+	g, err := depgraph.New(res)
+	if err != nil {
+		return nil, err
+	}
+	var edges []edge
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		deps, _ := r.Dependencies()
+		for j := 0; j < deps.Len(); j++ {
+			edges = append(edges, edge{from: r.ID(), to: deps.At(j)})
+		}
+		for _, d := range g.ImplicitDependencies(r.ID()) {
+			edges = append(edges, edge{from: r.ID(), to: d, implicit: true})
+		}
+	}
+	return edges, nil
+}
+
+func printEdge(e edge, color string) {
+	var attrs []string
+	if e.implicit {
+		attrs = append(attrs, "style=dashed")
+	}
+	if color != "" {
+		attrs = append(attrs, "color="+color)
+	}
+	if len(attrs) == 0 {
+		fmt.Printf("  %d -> %d;\n", e.from, e.to)
+		return
+	}
+	fmt.Printf("  %d -> %d [%s];\n", e.from, e.to, strings.Join(attrs, ", "))
+}
+
+// sameResource reports whether a and b have the same fields.
+func sameResource(a, b catalog.Resource) (bool, error) {
+	adata, err := resourceData(a)
+	if err != nil {
+		return false, err
+	}
+	bdata, err := resourceData(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(adata, bdata), nil
+}
+
+// resourceData returns r serialized as the root of its own message.
+// Copying the resource lays it out in the same way no matter how the
+// catalog it came from was laid out.
+func resourceData(r catalog.Resource) ([]byte, error) {
+	msg, _, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.SetRootPtr(r.Struct.ToPtr()); err != nil {
+		return nil, err
+	}
+	return msg.Marshal()
+}
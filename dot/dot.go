@@ -19,13 +19,16 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 
 	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/depgraph"
 	"github.com/zombiezen/mcm/internal/version"
 	"github.com/zombiezen/mcm/third_party/golang/capnproto"
 )
 
 func main() {
+	reduce := flag.Bool("reduce", false, "leave out duplicate dependencies and ones implied by other dependencies")
 	versionMode := flag.Bool("version", false, "display version info")
 	flag.Parse()
 	if *versionMode {
@@ -33,47 +36,106 @@ func main() {
 		return
 	}
 
-	var cat catalog.Catalog
+	var cats []catalog.Catalog
 	switch flag.NArg() {
 	case 0:
-		var err error
-		cat, err = readCatalog(os.Stdin)
+		cat, err := readCatalog(os.Stdin)
 		if err != nil {
 			die(err)
 		}
-	case 1:
-		// TODO(someday): read segments lazily
-		f, err := os.Open(flag.Arg(0))
-		if err != nil {
-			die(err)
-		}
-		cat, err = readCatalog(f)
-		if err != nil {
-			die(err)
-		}
-		if err = f.Close(); err != nil {
-			die(err)
+		cats = append(cats, cat)
+	case 1, 2:
+		for _, path := range flag.Args() {
+			f, err := catalog.OpenFile(path)
+			if err != nil {
+				die(err)
+			}
+			defer f.Close()
+			cats = append(cats, f.Catalog)
 		}
 	default:
 		flag.Usage()
 		os.Exit(2)
 	}
+	if *reduce {
+		for i := range cats {
+			var err error
+			cats[i], err = catalog.ReduceDependencies(cats[i])
+			if err != nil {
+				die(err)
+			}
+		}
+	}
 
-	fmt.Println("digraph catalog {")
+	var err error
+	if len(cats) == 2 {
+		err = printDiff(cats[0], cats[1])
+	} else {
+		err = printGraph(cats[0])
+	}
+	if err != nil {
+		die(err)
+	}
+}
+
+func printGraph(cat catalog.Catalog) error {
 	resources, _ := cat.Resources()
+	g, err := depgraph.New(resources)
+	if err != nil {
+		return err
+	}
+	fmt.Println("digraph catalog {")
 	for i := 0; i < resources.Len(); i++ {
 		r := resources.At(i)
 		id := r.ID()
-		if c, _ := r.Comment(); c != "" {
-			fmt.Printf("  %d [label=%q];\n", id, c)
-		}
+		printNode(r)
 		deps, _ := r.Dependencies()
 		for j := 0; j < deps.Len(); j++ {
 			fmt.Printf("  %d -> %d;\n", id, deps.At(j))
 		}
+		for _, d := range g.ImplicitDependencies(id) {
+			fmt.Printf("  %d -> %d [style=dashed];\n", id, d)
+		}
 		fmt.Println()
 	}
 	fmt.Println("}")
+	return nil
+}
+
+// printNode prints the attributes of r's node, if it has any.
+func printNode(r catalog.Resource) {
+	id := r.ID()
+	if label := resourceLabel(r); label != "" {
+		fmt.Printf("  %d [label=%q];\n", id, label)
+	}
+	if r.Which() == catalog.Resource_Which_barrier {
+		fmt.Printf("  %d [shape=box];\n", id)
+	}
+	if r.Disabled() {
+		fmt.Printf("  %d [color=gray, fontcolor=gray];\n", id)
+	}
+}
+
+// resourceLabel returns the label to draw r with, or the empty string
+// to draw r with its ID.  Exec resources with a creates path show the
+// path as a second line.
+func resourceLabel(r catalog.Resource) string {
+	label, _ := r.Name()
+	if label == "" {
+		label, _ = r.Comment()
+	}
+	if r.Which() != catalog.Resource_Which_exec {
+		return label
+	}
+	e, _ := r.Exec()
+	creates, _ := e.Creates()
+	if creates == "" {
+		return label
+	}
+	if label == "" {
+		label = strconv.FormatUint(r.ID(), 10)
+	}
+	return label + "\ncreates " + creates
 }
 
 func die(err error) {
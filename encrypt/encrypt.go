@@ -0,0 +1,107 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/zombiezen/mcm/internal/catcrypt"
+	"github.com/zombiezen/mcm/internal/version"
+)
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s -genkey\n", name)
+	fmt.Fprintf(os.Stderr, "       %s [-d] (-key FILE | -key_command CMD) [IN [OUT]]\n", name)
+	flag.PrintDefaults()
+}
+
+func main() {
+	genKey := flag.Bool("genkey", false, "print a new random key")
+	decrypt := flag.Bool("d", false, "decrypt instead of encrypt")
+	keyPath := flag.String("key", "", "path to base64-encoded key")
+	keyCommand := flag.String("key_command", "", "shell command that prints the base64-encoded key")
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if *genKey {
+		if flag.NArg() != 0 {
+			usage()
+			os.Exit(2)
+		}
+		key, err := catcrypt.GenerateKey()
+		if err != nil {
+			die(err)
+		}
+		fmt.Println(key)
+		return
+	}
+	if flag.NArg() > 2 {
+		usage()
+		os.Exit(2)
+	}
+	key, err := catcrypt.LoadKey(context.Background(), *keyPath, *keyCommand)
+	if err != nil {
+		die(err)
+	}
+	if key == nil {
+		usage()
+		os.Exit(2)
+	}
+
+	var in []byte
+	if flag.NArg() == 0 || flag.Arg(0) == "-" {
+		in, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		in, err = ioutil.ReadFile(flag.Arg(0))
+	}
+	if err != nil {
+		die(err)
+	}
+	var out []byte
+	if *decrypt {
+		out, err = catcrypt.Decrypt(key, in)
+	} else {
+		out, err = catcrypt.Encrypt(key, in)
+	}
+	if err != nil {
+		die(err)
+	}
+	if flag.NArg() < 2 || flag.Arg(1) == "-" {
+		_, err = os.Stdout.Write(out)
+	} else {
+		err = ioutil.WriteFile(flag.Arg(1), out, 0666)
+	}
+	if err != nil {
+		die(err)
+	}
+}
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, "mcm-encrypt:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+
+	"github.com/zombiezen/mcm/internal/audit"
+)
+
+// openAuditLog opens the audit log at path, recording the user that
+// runs mcm-exec and the host in each entry.  If mcm-exec was run with
+// sudo, the invoking user is recorded too.
+func openAuditLog(path string) (*audit.Log, error) {
+	l, err := audit.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if u, err := user.Current(); err == nil {
+		l.User = u.Username
+	} else {
+		l.User = fmt.Sprintf("uid=%d", os.Getuid())
+	}
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		l.User += " (sudo from " + sudoUser + ")"
+	}
+	l.Host, _ = os.Hostname()
+	return l, nil
+}
+
+// verifyAuditLog checks the hash chain of the audit log at path and
+// returns the number of entries.
+func verifyAuditLog(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("verify audit log: %v", err)
+	}
+	defer f.Close()
+	n, err := audit.Verify(f)
+	if err != nil {
+		return 0, fmt.Errorf("verify audit log %s: %v", path, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/internal/mounts"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// defaultDiskHeadroom is the default value of -disk_headroom_mb.
+const defaultDiskHeadroom = 100
+
+// diskUsage is the estimated growth of a mounted filesystem during a
+// run.
+type diskUsage struct {
+	mount *mounts.Mount
+	bytes int64
+	paths []string
+
+	// unknown is the number of downloads whose size the server did not
+	// report and files written from command output, which are not
+	// counted in bytes.
+	unknown int
+}
+
+// diskShortfall is a filesystem without enough free space for a run.
+type diskShortfall struct {
+	usage    *diskUsage
+	free     int64
+	headroom int64
+}
+
+func (s *diskShortfall) String() string {
+	u := s.usage
+	msg := fmt.Sprintf("%s needs %s for %d file(s) plus %s headroom, but has %s free",
+		u.mount.Point, formatBytes(u.bytes), len(u.paths), formatBytes(s.headroom), formatBytes(s.free))
+	if n := s.headroom + u.bytes - s.free; n > 0 {
+		msg += fmt.Sprintf(" (short by %s)", formatBytes(n))
+	}
+	if u.unknown > 0 {
+		msg += fmt.Sprintf(", not counting %d file(s) of unknown size", u.unknown)
+	}
+	return msg
+}
+
+// estimateDiskUsage estimates how many bytes the file resources of
+// cats will add to each mounted filesystem, in the order that the
+// filesystems are first seen.  A file's estimate is the size of its
+// new content minus the size of the file it replaces.  Downloads are
+// sized by asking the server.
+func estimateDiskUsage(ctx context.Context, sys system.System, d *download.Downloader, cats []catalog.Catalog) ([]*diskUsage, error) {
+	ms, err := mounts.Read()
+	if err != nil || len(ms) == 0 {
+		return nil, err
+	}
+	var found []*diskUsage
+	byMount := make(map[*mounts.Mount]*diskUsage)
+	for _, cat := range cats {
+		res, err := cat.Resources()
+		if err != nil {
+			return nil, err
+		}
+		for i, n := 0, res.Len(); i < n; i++ {
+			r := res.At(i)
+			if r.Which() != catalog.Resource_Which_file {
+				continue
+			}
+			f, err := r.File()
+			if err != nil {
+				return nil, err
+			}
+			path, err := f.Path()
+			if err != nil || !filepath.IsAbs(path) || f.Which() != catalog.File_Which_plain {
+				// Malformed paths are reported when the resource is
+				// applied.
+				continue
+			}
+			size, known, err := newContentSize(ctx, sys, d, f.Plain())
+			if err != nil {
+				return nil, fmt.Errorf("estimate size of %s: %v", path, err)
+			}
+			if size == 0 && known {
+				continue
+			}
+			m := mounts.Find(ms, path)
+			if m == nil {
+				continue
+			}
+			u := byMount[m]
+			if u == nil {
+				u = &diskUsage{mount: m}
+				byMount[m] = u
+				found = append(found, u)
+			}
+			u.paths = append(u.paths, path)
+			if !known {
+				u.unknown++
+				continue
+			}
+			if info, err := sys.Lstat(ctx, path); err == nil && info.Mode().IsRegular() {
+				size -= info.Size()
+			}
+			if size > 0 {
+				u.bytes += size
+			}
+		}
+	}
+	return found, nil
+}
+
+// newContentSize returns the size of a plain file's new content.  known
+// is false if the content is a download whose size the server did not
+// report or a command's output.
+func newContentSize(ctx context.Context, sys system.System, d *download.Downloader, f catalog.File_plain) (size int64, known bool, err error) {
+	switch {
+	case f.ContentFromOutput() != 0:
+		return 0, false, nil
+	case f.HasContent():
+		content, err := f.Content()
+		if err != nil {
+			return 0, false, err
+		}
+		return int64(len(content)), true, nil
+	case f.HasContentUrl():
+		u, err := f.ContentUrl()
+		if err != nil {
+			return 0, false, err
+		}
+		n, err := d.Size(ctx, u)
+		if err != nil || n < 0 {
+			// The download is reported when the resource is applied.
+			return 0, false, nil
+		}
+		return n, true, nil
+	case f.HasContentPath():
+		src, err := f.ContentPath()
+		if err != nil {
+			return 0, false, err
+		}
+		info, err := sys.Lstat(ctx, src)
+		if err != nil {
+			// A missing source is reported when the resource is applied.
+			return 0, true, nil
+		}
+		return info.Size(), true, nil
+	default:
+		return 0, true, nil
+	}
+}
+
+// findDiskShortfalls returns the filesystems in usage that have less
+// free space than their estimated growth plus headroom bytes.
+func findDiskShortfalls(ctx context.Context, sys system.System, usage []*diskUsage, headroom int64) ([]*diskShortfall, error) {
+	hi, ok := sys.(system.HostInspector)
+	if !ok || len(usage) == 0 {
+		return nil, nil
+	}
+	var short []*diskShortfall
+	for _, u := range usage {
+		free, err := hi.DiskFree(ctx, u.mount.Point)
+		if err != nil {
+			return nil, fmt.Errorf("check disk space: %v", err)
+		}
+		if free < u.bytes+headroom {
+			short = append(short, &diskShortfall{usage: u, free: free, headroom: headroom})
+		}
+	}
+	return short, nil
+}
+
+// diskSpaceError returns an error describing the filesystems that
+// don't have room for the run.
+func diskSpaceError(short []*diskShortfall) error {
+	lines := make([]string, len(short))
+	for i, s := range short {
+		lines[i] = s.String()
+	}
+	return fmt.Errorf("not enough disk space: %s", strings.Join(lines, "; "))
+}
+
+// formatBytes formats n with a binary unit, like "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		f /= unit
+		if f < unit && f > -unit || suffix == "TiB" {
+			return fmt.Sprintf("%.1f %s", f, suffix)
+		}
+	}
+	panic("unreachable")
+}
@@ -15,22 +15,44 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/zombiezen/mcm/catalog"
 	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/audit"
+	"github.com/zombiezen/mcm/internal/catcrypt"
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/internal/facts"
+	"github.com/zombiezen/mcm/internal/history"
+	"github.com/zombiezen/mcm/internal/oci"
+	"github.com/zombiezen/mcm/internal/plan"
+	"github.com/zombiezen/mcm/internal/policy"
+	"github.com/zombiezen/mcm/internal/state"
 	"github.com/zombiezen/mcm/internal/system"
+	"github.com/zombiezen/mcm/internal/system/replay"
+	"github.com/zombiezen/mcm/internal/system/systrace"
 	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/internal/window"
 	"github.com/zombiezen/mcm/third_party/golang/capnproto"
 )
 
@@ -39,29 +61,430 @@ func init() {
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "usage: %s [CATALOG]:\n", filepath.Base(os.Args[0]))
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s [options] [CATALOG...]\n", name)
+	fmt.Fprintf(os.Stderr, "       %s -plan FILE -plan_key KEYFILE plan|apply [CATALOG...]\n", name)
+	fmt.Fprintf(os.Stderr, "       %s -audit_log FILE audit verify\n", name)
+	fmt.Fprintf(os.Stderr, "       %s [options] replay BUNDLE\n", name)
+	fmt.Fprintf(os.Stderr, "       %s -update_url URL -update_key FILE self-update\n", name)
+	for _, line := range strings.Split(history.CommandUsage, "\n") {
+		fmt.Fprintf(os.Stderr, "       %s -history DIR %s\n", name, line)
+	}
 	flag.PrintDefaults()
 }
 
 func main() {
 	log := new(logger)
 	opts := &execlib.Options{
-		Log: log,
+		Log:        log,
+		Supervisor: new(execlib.Supervisor),
 	}
 	simulate := flag.Bool("n", false, "dry-run")
 	flag.BoolVar(&log.quiet, "q", false, "suppress info messages and failure output")
+	flag.Var(verbosityFlag{&log.verbosity, execlib.Verbose}, "v", "also log unchanged resources and the outcome of conditions")
+	flag.Var(verbosityFlag{&log.verbosity, execlib.VeryVerbose}, "vv", "like -v, and also log the output of commands")
 	logCommands := flag.Bool("s", false, "show commands run in the log")
 	flag.IntVar(&opts.ConcurrentJobs, "j", 1, "set the maximum number of resources to apply simultaneously")
+	maxMemory := flag.Int64("max_memory_mb", 0, "MiB of file content and command output that the resources applied at once may buffer before no more are started (0 for no limit)")
 	flag.StringVar(&opts.Bash, "bash", execlib.DefaultBashPath, "path to bash shell")
+	flag.IntVar(&opts.MaxOutput, "max_output", execlib.DefaultMaxOutput, "maximum number of bytes of output to keep from each command (negative for no limit)")
+	flag.BoolVar(&opts.Strict, "strict", false, "fail resources that have warnings, such as content drift, and refuse to apply conflicting resources even with -allow_conflicts")
+	flag.BoolVar(&opts.AllowConflicts, "allow_conflicts", false, "warn about file resources that manage the same path instead of refusing to apply")
+	flag.StringVar(&opts.RunID, "run_id", "", "identify the run with this ID in logs and reports instead of a random UUID")
+	flag.Int64Var(&opts.Seed, "seed", 0, "shuffle the order that ready resources start in with this seed (0 for catalog order)")
+	flag.BoolVar(&opts.CriticalPath, "critical_path", false, "apply resources on the longest dependency chain first (weighted by -state durations)")
+	flag.Var(tagLimitsFlag{&opts.TagLimits}, "limit", "TAG=N maximum number of resources tagged TAG to apply simultaneously (repeatable)")
+	flag.Var(varsFlag{&opts.Vars}, "var", "NAME=VALUE variable for exec commands with expand set (repeatable)")
+	gatherFacts := flag.Bool("facts", false, "gather the host's facts as facts.* variables for exec commands with expand set")
+	factsDir := flag.String("facts_dir", "", "directory of NAME.json files to add as custom facts (requires -facts)")
+	hist := new(history.Store)
+	flag.StringVar(&hist.Dir, "history", "", "directory to record run reports in")
+	flag.IntVar(&hist.Max, "keep", history.DefaultMax, "number of run reports to keep in the -history directory")
+	statePath := flag.String("state", "", "path to file to keep resource durations in between runs")
+	flag.BoolVar(&opts.FastHash, "fast_hash", false, "hash large files with xxHash instead of SHA-256 to detect changes between -state runs")
+	flag.Float64Var(&opts.SlowFactor, "slow", execlib.DefaultSlowFactor, "log resources that take this many times longer than their average (requires -state)")
+	logFormat := flag.String("log-format", "text", "format of log output: text or json (one object per line)")
+	var overlays overlaysFlag
+	inferDeps := flag.Bool("infer_deps", false, "make exec resources depend on the file resources that manage paths in their argv or working directory, and files on the directory resources above them")
+	flag.Var(&overlays, "overlay", "path to an overlay file of patches to apply to the catalogs' resources (repeatable, applied in order)")
+	decryptKeyPath := flag.String("decrypt_key", "", "path to base64-encoded key to decrypt an encrypted catalog with")
+	proxy := flag.String("proxy", "", "URL of the HTTP(S) proxy to download through (default from $HTTPS_PROXY/$HTTP_PROXY)")
+	credentialsPath := flag.String("credentials", "", "path to file of HOST basic USER:PASSWORD or HOST bearer TOKEN lines to authenticate fetches with")
+	var mirrors download.Mirrors
+	flag.Var(&mirrors, "mirror", "PREFIX=URL mirror to fetch from when the server for URLs beginning with PREFIX is unreachable (repeatable)")
+	decryptKeyCommand := flag.String("decrypt_key_command", "", "shell command that prints the base64-encoded key to decrypt an encrypted catalog with")
+	umask := flag.String("umask", "", "octal file creation mask to use for the run instead of the inherited one")
+	ociLayer := flag.String("oci_layer", "", "apply a file-only catalog to an OCI image layer written to this directory instead of the host")
+	cpuProfile := flag.String("cpuprofile", "", "write a CPU profile to this file")
+	memProfile := flag.String("memprofile", "", "write a heap profile to this file before exiting")
+	tracePath := flag.String("trace", "", "write an execution trace to this file")
+	recordPath := flag.String("record", "", "record every call the run makes to the system, with the catalogs, in a bundle at this path for the replay command")
+	syscallsPath := flag.String("syscalls", "", "write each call the run makes to the system, with its duration and error, to this file as JSON lines")
+	planPath := flag.String("plan", "", "plan file to write with the plan command or to check against with the apply command")
+	planKeyPath := flag.String("plan_key", "", "path to base64-encoded key to sign and verify -plan files with")
+	policyPath := flag.String("policy", "", "Rego policy file or directory that may refuse the run or veto resources before applying")
+	opaPath := flag.String("opa", "opa", "path to the Open Policy Agent executable used to evaluate -policy")
+	auditPath := flag.String("audit_log", "", "append a hash-chained record of every change made to the host to this file")
+	oncePath := flag.String("once", "", "apply only if this stamp file doesn't exist, and create it after a successful run")
+	onceUnit := flag.String("once_unit", "", "systemd unit name to disable, or unit file path to disable and remove, once the -once stamp is written")
+	interactive := flag.Bool("interactive", false, "show each change before applying it and ask whether to apply it on the terminal")
+	schedule := new(window.Schedule)
+	flag.Var(&schedule.Windows, "window", "\"[DAYS ]HH:MM-HH:MM\" maintenance window to limit applying to, like \"Mon-Fri 02:00-05:00\" (repeatable)")
+	flag.Var(&schedule.Blackouts, "blackout", "YYYY-MM-DD or YYYY-MM-DD..YYYY-MM-DD dates to not apply on, even during a -window (repeatable)")
+	windowTZ := flag.String("window_tz", "", "time zone of -window and -blackout, like America/New_York (default local)")
+	ignoreWindow := flag.Bool("ignore_window", false, "apply even outside -window or during a -blackout")
+	updateURL := flag.String("update_url", "", "URL of the signed release manifest to install a new mcm-exec from with the self-update command")
+	updateKeyPath := flag.String("update_key", "", "path to base64-encoded Ed25519 public key that -update_url and its binaries must be signed with")
+	remountRW := flag.Bool("remount_rw", false, "remount read-only filesystems that file resources are on read-write for the run, then read-only again")
+	lockPath := flag.String("lock", "", "hold an exclusive lock on this file for the run, waiting for any other run that holds it")
+	flag.BoolVar(&opts.LockFiles, "lock_files", false, "hold an advisory lock on each existing file while rewriting it, for other processes that lock the files they write")
+	diskHeadroom := flag.Int64("disk_headroom_mb", defaultDiskHeadroom, "MiB that each filesystem must have free beyond the estimated size of the files written to it, or negative to skip the disk space check")
+	flag.StringVar(&opts.CommandLogDir, "command_log_dir", "", "directory to write the output of each exec resource's command to, as ID.log")
+	flag.IntVar(&opts.CommandLogsKept, "command_logs_kept", 5, "number of earlier -command_log_dir logs to keep for each resource, as ID.log.1 through ID.log.N")
+	envMode := flag.String("env", "default", "base environment of catalog commands: default (LANG=C and TZ=UTC), inherit (mcm-exec's own minus -scrub_env variables, plus the defaults), or none")
+	scrubEnv := flag.String("scrub_env", strings.Join(execlib.DefaultScrubPatterns, ","), "comma-separated patterns of inherited variables to drop with -env=inherit")
+	flag.StringVar(&opts.ScratchDir, "scratch_dir", "", "create a private scratch directory for the run in this directory, passed to commands as $"+execlib.ScratchEnv+" and removed afterward")
 	versionMode := flag.Bool("version", false, "display version info")
 	flag.Parse()
 	if *versionMode {
 		version.Show()
 		return
 	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		log.json = true
+	default:
+		fmt.Fprintf(os.Stderr, "mcm-exec: unknown -log-format %q\n", *logFormat)
+		os.Exit(2)
+	}
+	if *umask != "" {
+		mask, err := strconv.ParseUint(*umask, 8, 32)
+		if err != nil || mask > 0777 {
+			fmt.Fprintf(os.Stderr, "mcm-exec: invalid -umask %q\n", *umask)
+			os.Exit(2)
+		}
+		m := os.FileMode(mask)
+		opts.Umask = &m
+	}
+	if *maxMemory < 0 {
+		fmt.Fprintln(os.Stderr, "mcm-exec: -max_memory_mb must not be negative")
+		os.Exit(2)
+	}
+	opts.MemoryLimit = *maxMemory << 20
+	opts.CredentialsDirectory = os.Getenv("CREDENTIALS_DIRECTORY")
+	switch *envMode {
+	case "default":
+		opts.Environment = execlib.DefaultEnvironment
+	case "inherit":
+		var patterns []string
+		if *scrubEnv != "" {
+			patterns = strings.Split(*scrubEnv, ",")
+		}
+		opts.Environment = append(execlib.ScrubEnvironment(os.Environ(), patterns), execlib.DefaultEnvironment...)
+	case "none":
+	default:
+		fmt.Fprintf(os.Stderr, "mcm-exec: unknown -env %q\n", *envMode)
+		os.Exit(2)
+	}
+	if *factsDir != "" && !*gatherFacts {
+		fmt.Fprintln(os.Stderr, "mcm-exec: -facts_dir requires -facts")
+		os.Exit(2)
+	}
+	if *gatherFacts {
+		f, err := facts.Gather(*factsDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mcm-exec: %v\n", err)
+			os.Exit(1)
+		}
+		fv, err := f.Vars()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mcm-exec: %v\n", err)
+			os.Exit(1)
+		}
+		if opts.Vars == nil {
+			opts.Vars = make(map[string]string, len(fv))
+		}
+		for k, v := range fv {
+			if _, set := opts.Vars[k]; !set {
+				opts.Vars[k] = v
+			}
+		}
+	}
+	if *ociLayer != "" && *simulate {
+		fmt.Fprintln(os.Stderr, "mcm-exec: can't use -oci_layer with -n")
+		os.Exit(2)
+	}
+	if *onceUnit != "" && *oncePath == "" {
+		fmt.Fprintln(os.Stderr, "mcm-exec: -once_unit requires -once")
+		os.Exit(2)
+	}
+	if *oncePath != "" && (*simulate || *ociLayer != "") {
+		fmt.Fprintln(os.Stderr, "mcm-exec: can't use -once with -n or -oci_layer")
+		os.Exit(2)
+	}
+	if *interactive && (*simulate || *ociLayer != "") {
+		fmt.Fprintln(os.Stderr, "mcm-exec: can't use -interactive with -n or -oci_layer")
+		os.Exit(2)
+	}
+	if *ociLayer != "" && *policyPath != "" {
+		fmt.Fprintln(os.Stderr, "mcm-exec: can't use -oci_layer with -policy")
+		os.Exit(2)
+	}
+	if *windowTZ != "" {
+		loc, err := time.LoadLocation(*windowTZ)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mcm-exec: -window_tz: %v\n", err)
+			os.Exit(2)
+		}
+		schedule.Location = loc
+	}
+	if opts.LockFiles && *ociLayer != "" {
+		fmt.Fprintln(os.Stderr, "mcm-exec: can't use -lock_files with -oci_layer")
+		os.Exit(2)
+	}
+	if *ociLayer != "" && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "mcm-exec: can't use -oci_layer with more than one catalog")
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	prof, err := startProfiler(*cpuProfile, *memProfile, *tracePath)
+	if err != nil {
+		log.Fatal(ctx, err)
+	}
+	log.atExit = func() {
+		if err := prof.stop(); err != nil {
+			log.Error(ctx, err)
+		}
+	}
+	defer log.atExit()
+	if flag.Arg(0) == "history" {
+		if hist.Dir == "" {
+			fmt.Fprintln(os.Stderr, "mcm-exec: history requires -history")
+			os.Exit(2)
+		}
+		err := history.Command(os.Stdout, hist, flag.Args()[1:])
+		if err == history.ErrUsage {
+			usage()
+			os.Exit(2)
+		}
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		return
+	}
+	if flag.Arg(0) == "audit" {
+		if *auditPath == "" {
+			fmt.Fprintln(os.Stderr, "mcm-exec: audit requires -audit_log")
+			os.Exit(2)
+		}
+		if flag.NArg() != 2 || flag.Arg(1) != "verify" {
+			usage()
+			os.Exit(2)
+		}
+		n, err := verifyAuditLog(*auditPath)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		fmt.Printf("%s: %d entries verified\n", *auditPath, n)
+		return
+	}
+	if flag.Arg(0) == "self-update" {
+		if *updateURL == "" || *updateKeyPath == "" {
+			fmt.Fprintln(os.Stderr, "mcm-exec: self-update requires -update_url and -update_key")
+			os.Exit(2)
+		}
+		if flag.NArg() != 1 {
+			usage()
+			os.Exit(2)
+		}
+		d, err := download.New(*proxy, *credentialsPath, mirrors)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		if err := selfUpdate(ctx, log, *updateURL, *updateKeyPath, d); err != nil {
+			log.Fatal(ctx, err)
+		}
+		return
+	}
+	if flag.Arg(0) == "replay" {
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		wrap := func(sys system.System) system.System {
+			if *logCommands {
+				return sysLogger{System: sys, log: log}
+			}
+			return sys
+		}
+		if err := replayBundle(ctx, log, flag.Arg(1), opts, wrap); err != nil {
+			log.Fatal(ctx, err)
+		}
+		return
+	}
+	args := flag.Args()
+	planMode := ""
+	if flag.Arg(0) == "plan" || flag.Arg(0) == "apply" {
+		planMode, args = flag.Arg(0), args[1:]
+		if *planPath == "" {
+			fmt.Fprintf(os.Stderr, "mcm-exec: %s requires -plan\n", planMode)
+			os.Exit(2)
+		}
+		if *simulate || *ociLayer != "" {
+			fmt.Fprintf(os.Stderr, "mcm-exec: can't use %s with -n or -oci_layer\n", planMode)
+			os.Exit(2)
+		}
+	}
+	if *lockPath != "" && !*simulate && *ociLayer == "" && planMode != "plan" {
+		// Take the lock before checking the -once stamp, so that a run
+		// waiting for the lock sees the stamp written by the one that
+		// held it.
+		l, err := lockRun(ctx, log, *lockPath)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		defer l.Unlock()
+	}
+	if *oncePath != "" && planMode != "plan" {
+		done, err := stampExists(*oncePath)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		if done {
+			log.Infof(ctx, "%s exists; catalogs already applied", *oncePath)
+			// Finish the cleanup in case the last run was interrupted.
+			if *onceUnit != "" {
+				if err := disableUnit(ctx, system.Local{}, *onceUnit); err != nil {
+					log.Fatal(ctx, err)
+				}
+			}
+			return
+		}
+	}
+	if !*ignoreWindow && !*simulate && *ociLayer == "" && planMode != "plan" {
+		if err := schedule.Check(time.Now()); err != nil {
+			log.Infof(ctx, "not applying: %v", err)
+			return
+		}
+	}
+	key, err := catcrypt.LoadKey(ctx, *decryptKeyPath, *decryptKeyCommand)
+	if err != nil {
+		log.Fatal(ctx, err)
+	}
+	opts.Downloader, err = download.New(*proxy, *credentialsPath, mirrors)
+	if err != nil {
+		log.Fatal(ctx, err)
+	}
+	var cats []catalog.Catalog
+	if len(args) == 0 {
+		cat, err := readCatalog(os.Stdin, key)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		cats = append(cats, cat)
+	}
+	for _, arg := range args {
+		var cat catalog.Catalog
+		if download.IsURL(arg) {
+			cat, err = fetchCatalog(ctx, opts.Downloader, arg, key)
+		} else {
+			// The file stays mapped until mcm-exec exits.
+			cat, err = openCatalog(arg, key)
+		}
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		cats = append(cats, cat)
+	}
+	for _, path := range overlays {
+		o, err := readOverlay(path)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		cats, err = catalog.ApplyOverlay(cats, o)
+		if err != nil {
+			log.Fatal(ctx, fmt.Errorf("%s: %v", path, err))
+		}
+	}
+	// Select variants before the resources are examined, so that plans
+	// and policies see the cases that will be applied.
+	for i := range cats {
+		cats[i], err = catalog.SelectVariants(cats[i], opts.Vars)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+	}
+	if *inferDeps {
+		for i := range cats {
+			var inferred []*catalog.InferredDependency
+			cats[i], inferred, err = catalog.InferDependencies(cats[i])
+			if err != nil {
+				log.Fatal(ctx, err)
+			}
+			for _, d := range inferred {
+				log.Infof(ctx, "inferred dependency: %v", d)
+			}
+		}
+	}
+	var planned *plan.Plan
+	switch {
+	case planMode == "plan":
+		planned, err = makePlan(ctx, log, cats, opts)
+	case planMode == "apply":
+		planned, err = checkPlan(ctx, log, *planPath, *planKeyPath, cats, opts)
+	case *policyPath != "":
+		planned, err = makePlan(ctx, &logger{quiet: true, json: log.json}, cats, opts)
+	}
+	if err != nil {
+		log.Fatal(ctx, err)
+	}
+	if *policyPath != "" {
+		pol := &policy.OPA{Path: *opaPath, Data: []string{*policyPath}}
+		if err := checkPolicy(ctx, pol, cats, planned, opts); err != nil {
+			log.Fatal(ctx, err)
+		}
+	}
+	if planMode == "plan" {
+		if err := writePlan(*planPath, *planKeyPath, planned); err != nil {
+			log.Fatal(ctx, err)
+		}
+		log.Infof(ctx, "wrote plan of %d changes to %s", len(planned.Changes), *planPath)
+		return
+	}
 	var sys system.System = system.Local{}
-	if *simulate {
-		sys = simulatedSystem{}
+	var layer *oci.Layer
+	switch {
+	case *ociLayer != "":
+		layer, err = oci.NewLayer(cats[0])
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		sys = layer
+	case *simulate:
+		sys = simulatedSystem{services: new(simulatedServices)}
+		opts.SkipHealthChecks = true
+	case *auditPath != "":
+		auditLog, err := openAuditLog(*auditPath)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		defer auditLog.Close()
+		sys = audit.System{System: sys, Log: auditLog}
+	}
+	var recorder *replay.Recorder
+	if *recordPath != "" {
+		recorder = replay.NewRecorder(sys)
+		sys = recorder
+	}
+	if *syscallsPath != "" {
+		f, err := os.Create(*syscallsPath)
+		if err != nil {
+			log.Fatal(ctx, err)
+		}
+		defer f.Close()
+		sys = systrace.System{System: sys, Tracer: systrace.NewLog(f)}
 	}
 	if *logCommands {
 		sys = sysLogger{
@@ -70,36 +493,201 @@ func main() {
 		}
 	}
 
-	ctx := context.Background()
-	var cat catalog.Catalog
-	switch flag.NArg() {
-	case 0:
+	if *interactive {
+		if planned == nil {
+			planned, err = makePlan(ctx, &logger{quiet: true, json: log.json}, cats, opts)
+			if err != nil {
+				log.Fatal(ctx, err)
+			}
+		}
+		tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+		if err != nil {
+			log.Fatal(ctx, fmt.Errorf("-interactive: %v", err))
+		}
+		defer tty.Close()
+		pr := newPrompter(ctx, sys, tty, planned)
+		veto := opts.Veto
+		opts.Veto = func(cat int, r catalog.Resource) string {
+			if veto != nil {
+				if reason := veto(cat, r); reason != "" {
+					return reason
+				}
+			}
+			return pr.veto(cat, r)
+		}
+	}
+
+	opts.Report = new(execlib.Report)
+	stateStore := &state.Store{Path: *statePath}
+	if *statePath != "" && !*simulate {
 		var err error
-		cat, err = readCatalog(os.Stdin)
+		opts.State, err = stateStore.Load()
+		if err != nil && opts.State != nil {
+			log.Infof(ctx, "warning: %v; starting over", err)
+		} else if err != nil {
+			log.Error(ctx, err)
+		}
+	}
+	var remounted []string
+	if *ociLayer == "" {
+		ros, err := findReadOnlyMounts(cats)
 		if err != nil {
 			log.Fatal(ctx, err)
 		}
-	case 1:
-		// TODO(someday): read segments lazily
-		f, err := os.Open(flag.Arg(0))
+		switch {
+		case len(ros) == 0:
+		case *simulate:
+			log.Infof(ctx, "warning: %v", readOnlyError(ros))
+		case !*remountRW:
+			log.Fatal(ctx, readOnlyError(ros))
+		default:
+			for _, ro := range ros {
+				if err := remount(ctx, sys, ro.mount.Point, "rw"); err != nil {
+					remountReadOnly(ctx, sys, log, remounted)
+					log.Fatal(ctx, err)
+				}
+				remounted = append(remounted, ro.mount.Point)
+			}
+		}
+		if *diskHeadroom >= 0 {
+			usage, err := estimateDiskUsage(ctx, sys, opts.Downloader, cats)
+			if err != nil {
+				remountReadOnly(ctx, sys, log, remounted)
+				log.Fatal(ctx, err)
+			}
+			short, err := findDiskShortfalls(ctx, sys, usage, *diskHeadroom<<20)
+			if err != nil {
+				remountReadOnly(ctx, sys, log, remounted)
+				log.Fatal(ctx, err)
+			}
+			switch {
+			case len(short) == 0:
+			case *simulate:
+				log.Infof(ctx, "warning: %v", diskSpaceError(short))
+			default:
+				remountReadOnly(ctx, sys, log, remounted)
+				log.Fatal(ctx, diskSpaceError(short))
+			}
+		}
+	}
+	err = execlib.ApplyAll(ctx, sys, cats, opts)
+	remountReadOnly(ctx, sys, log, remounted)
+	if recorder != nil {
+		if rerr := writeBundle(*recordPath, recorder, cats, opts.Vars); rerr != nil {
+			log.Error(ctx, rerr)
+		} else {
+			log.Infof(ctx, "recorded %d calls to %s", len(recorder.Calls()), *recordPath)
+		}
+	}
+	if opts.Report.Summary != nil {
+		log.Summary(ctx, opts.Report.Summary)
+		if hist.Dir != "" && !*simulate {
+			if _, herr := hist.Save(opts.Report); herr != nil {
+				log.Error(ctx, herr)
+			}
+		}
+	}
+	if opts.State != nil {
+		if serr := stateStore.Save(opts.State); serr != nil {
+			log.Error(ctx, serr)
+		}
+	}
+	if err != nil {
+		if opts.Report.Reboot != nil && !*simulate {
+			log.Infof(ctx, "warning: not rebooting because the run failed")
+		}
+		opts.Supervisor.Stop()
+		log.Fatal(ctx, err)
+	}
+	if layer != nil {
+		info, err := writeLayer(*ociLayer, layer)
 		if err != nil {
 			log.Fatal(ctx, err)
 		}
-		cat, err = readCatalog(f)
-		if err != nil {
+		log.Infof(ctx, "wrote layer %s to %s", info.Layer.Digest, *ociLayer)
+	}
+	if *oncePath != "" {
+		if err := writeStamp(*oncePath, cats); err != nil {
 			log.Fatal(ctx, err)
 		}
-		if err = f.Close(); err != nil {
-			log.Error(ctx, err)
+		if *onceUnit != "" {
+			if err := disableUnit(ctx, sys, *onceUnit); err != nil {
+				log.Fatal(ctx, err)
+			}
 		}
-	default:
-		usage()
-		os.Exit(2)
 	}
+	if req := opts.Report.Reboot; req != nil && !*simulate && layer == nil {
+		if err := execlib.ScheduleReboot(ctx, sys, req); err != nil {
+			log.Fatal(ctx, err)
+		}
+		log.Infof(ctx, "reboot scheduled in %v", req.Delay)
+	}
+	if n := opts.Supervisor.Len(); n > 0 && !*simulate {
+		log.Infof(ctx, "supervising %d processes; interrupt to stop", n)
+		superviseUntilSignal(ctx, opts.Supervisor)
+	}
+	if err := opts.Supervisor.Stop(); err != nil {
+		log.Error(ctx, err)
+	}
+}
 
-	if err := execlib.Apply(ctx, sys, cat, opts); err != nil {
-		log.Fatal(ctx, err)
+// superviseUntilSignal waits until all of the supervised processes
+// exit or the program is interrupted.
+func superviseUntilSignal(ctx context.Context, sup *execlib.Supervisor) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	sup.Wait(ctx)
+}
+
+// writeLayer writes layer.tar.gz and layer.json to dir.  layer.json
+// holds the layer's descriptor and the entries to append to the base
+// image's configuration.  Entries are timestamped with
+// $SOURCE_DATE_EPOCH if it is set, for reproducible builds.
+func writeLayer(dir string, layer *oci.Layer) (*oci.LayerInfo, error) {
+	created := time.Now().UTC().Truncate(time.Second)
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("write layer: invalid SOURCE_DATE_EPOCH %q", epoch)
+		}
+		created = time.Unix(sec, 0).UTC()
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("write layer: %v", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "layer.tar.gz"))
+	if err != nil {
+		return nil, fmt.Errorf("write layer: %v", err)
+	}
+	info, err := layer.Write(f, oci.History{
+		Created:   &created,
+		CreatedBy: "mcm-exec -oci_layer",
+	})
+	cerr := f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if cerr != nil {
+		return nil, fmt.Errorf("write layer: %v", cerr)
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("write layer: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "layer.json"), append(data, '\n'), 0666); err != nil {
+		return nil, fmt.Errorf("write layer: %v", err)
 	}
+	return info, nil
 }
 
 type sysLogger struct {
@@ -147,19 +735,229 @@ func (l sysLogger) CreateFile(ctx context.Context, path string, mode os.FileMode
 	return l.System.CreateFile(ctx, path, mode)
 }
 
+func (l sysLogger) LookPath(ctx context.Context, file string, pathList string) (string, error) {
+	path, err := l.System.LookPath(ctx, file, pathList)
+	if err == nil {
+		l.log.Infof(ctx, "resolved %s to %s", file, path)
+	}
+	return path, err
+}
+
+func (l sysLogger) Umask(mask os.FileMode) os.FileMode {
+	l.log.Infof(context.Background(), "umask %03o", uint32(mask&os.ModePerm))
+	u, ok := l.System.(system.Umasker)
+	if !ok {
+		return 0
+	}
+	return u.Umask(mask)
+}
+
 func (l sysLogger) Run(ctx context.Context, cmd *system.Cmd) (output []byte, err error) {
 	l.log.Infof(ctx, "exec %s", strings.Join(cmd.Args, " "))
 	return l.System.Run(ctx, cmd)
 }
 
-type simulatedSystem struct{}
+func (l sysLogger) Start(ctx context.Context, cmd *system.Cmd) (system.Process, error) {
+	l.log.Infof(ctx, "start %s", strings.Join(cmd.Args, " "))
+	st, ok := l.System.(system.Starter)
+	if !ok {
+		return nil, errors.New("system cannot start background processes")
+	}
+	return st.Start(ctx, cmd)
+}
+
+func (l sysLogger) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, ok := l.System.(system.Dialer)
+	if !ok {
+		return nil, errors.New("system cannot dial addresses")
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+func (l sysLogger) Lock(ctx context.Context, path string, mode os.FileMode) (system.FileLock, error) {
+	l.log.Infof(ctx, "lock %s", path)
+	lk, ok := l.System.(system.Locker)
+	if !ok {
+		return nil, errors.New("system cannot lock files")
+	}
+	return lk.Lock(ctx, path, mode)
+}
+
+func (l sysLogger) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	l.log.Infof(ctx, "clone %s to %s", src, dst)
+	c, ok := l.System.(system.Cloner)
+	if !ok {
+		return errors.New("system cannot clone files")
+	}
+	return c.CloneFile(ctx, src, dst, mode)
+}
+
+func (l sysLogger) Rename(ctx context.Context, oldpath, newpath string) error {
+	l.log.Infof(ctx, "rename %s to %s", oldpath, newpath)
+	r, ok := l.System.(system.Renamer)
+	if !ok {
+		return errors.New("system cannot rename files")
+	}
+	return r.Rename(ctx, oldpath, newpath)
+}
+
+func (l sysLogger) FileIdentity(info os.FileInfo) (dev, ino uint64, err error) {
+	fi, ok := l.System.(system.FileIdentifier)
+	if !ok {
+		return 0, 0, errors.New("system cannot identify files")
+	}
+	return fi.FileIdentity(info)
+}
+
+func (l sysLogger) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	dr, ok := l.System.(system.DirReader)
+	if !ok {
+		return nil, errors.New("system cannot list directories")
+	}
+	return dr.ReadDir(ctx, path)
+}
+
+func (l sysLogger) RegistryKeyExists(ctx context.Context, key string) (bool, error) {
+	r, ok := l.System.(system.Registry)
+	if !ok {
+		return false, errors.New("system has no registry")
+	}
+	return r.RegistryKeyExists(ctx, key)
+}
+
+func (l sysLogger) CreateRegistryKey(ctx context.Context, key string) error {
+	l.log.Infof(ctx, "create registry key %s", key)
+	r, ok := l.System.(system.Registry)
+	if !ok {
+		return errors.New("system has no registry")
+	}
+	return r.CreateRegistryKey(ctx, key)
+}
+
+func (l sysLogger) DeleteRegistryKey(ctx context.Context, key string) error {
+	l.log.Infof(ctx, "delete registry key %s", key)
+	r, ok := l.System.(system.Registry)
+	if !ok {
+		return errors.New("system has no registry")
+	}
+	return r.DeleteRegistryKey(ctx, key)
+}
+
+func (l sysLogger) RegistryValue(ctx context.Context, key, name string) (system.RegistryValue, error) {
+	r, ok := l.System.(system.Registry)
+	if !ok {
+		return system.RegistryValue{}, errors.New("system has no registry")
+	}
+	return r.RegistryValue(ctx, key, name)
+}
+
+func (l sysLogger) SetRegistryValue(ctx context.Context, key, name string, val system.RegistryValue) error {
+	l.log.Infof(ctx, "set registry value %s\\%s", key, name)
+	r, ok := l.System.(system.Registry)
+	if !ok {
+		return errors.New("system has no registry")
+	}
+	return r.SetRegistryValue(ctx, key, name, val)
+}
+
+func (l sysLogger) DeleteRegistryValue(ctx context.Context, key, name string) error {
+	l.log.Infof(ctx, "delete registry value %s\\%s", key, name)
+	r, ok := l.System.(system.Registry)
+	if !ok {
+		return errors.New("system has no registry")
+	}
+	return r.DeleteRegistryValue(ctx, key, name)
+}
+
+func (l sysLogger) QueryService(ctx context.Context, name string) (*system.ServiceStatus, error) {
+	sm, ok := l.System.(system.ServiceManager)
+	if !ok {
+		return nil, errors.New("system cannot manage services")
+	}
+	return sm.QueryService(ctx, name)
+}
+
+func (l sysLogger) CreateService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	l.log.Infof(ctx, "create service %s", name)
+	sm, ok := l.System.(system.ServiceManager)
+	if !ok {
+		return errors.New("system cannot manage services")
+	}
+	return sm.CreateService(ctx, name, config)
+}
+
+func (l sysLogger) ConfigureService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	l.log.Infof(ctx, "configure service %s", name)
+	sm, ok := l.System.(system.ServiceManager)
+	if !ok {
+		return errors.New("system cannot manage services")
+	}
+	return sm.ConfigureService(ctx, name, config)
+}
+
+func (l sysLogger) StartService(ctx context.Context, name string) error {
+	l.log.Infof(ctx, "start service %s", name)
+	sm, ok := l.System.(system.ServiceManager)
+	if !ok {
+		return errors.New("system cannot manage services")
+	}
+	return sm.StartService(ctx, name)
+}
+
+func (l sysLogger) StopService(ctx context.Context, name string) error {
+	l.log.Infof(ctx, "stop service %s", name)
+	sm, ok := l.System.(system.ServiceManager)
+	if !ok {
+		return errors.New("system cannot manage services")
+	}
+	return sm.StopService(ctx, name)
+}
+
+type simulatedSystem struct {
+	// services holds the simulated changes to services, so that waiting
+	// for a service to start or stop succeeds.
+	services *simulatedServices
+
+	// obs records the host state read during a run that makes a plan
+	// or checks one, if not nil.
+	obs *plan.Observer
+}
+
+func (s simulatedSystem) Lstat(ctx context.Context, path string) (os.FileInfo, error) {
+	info, err := system.Local{}.Lstat(ctx, path)
+	if err != nil {
+		s.obs.Observe("lstat %s: %v", path, err)
+		return nil, err
+	}
+	uid, gid, _ := system.Local{}.OwnerInfo(info)
+	if info.IsDir() {
+		// A directory's size and modification time change whenever
+		// any entry is added, so they say nothing about the resource.
+		s.obs.Observe("lstat %s: %v %d:%d", path, info.Mode(), uid, gid)
+	} else {
+		s.obs.Observe("lstat %s: %v %d:%d %d %d", path, info.Mode(), uid, gid, info.Size(), info.ModTime().UnixNano())
+	}
+	return info, nil
+}
 
-func (simulatedSystem) Lstat(ctx context.Context, path string) (os.FileInfo, error) {
-	return system.Local{}.Lstat(ctx, path)
+func (s simulatedSystem) Readlink(ctx context.Context, path string) (string, error) {
+	target, err := system.Local{}.Readlink(ctx, path)
+	s.obs.Observe("readlink %s: %q %v", path, target, err)
+	return target, err
 }
 
-func (simulatedSystem) Readlink(ctx context.Context, path string) (string, error) {
-	return system.Local{}.Readlink(ctx, path)
+func (s simulatedSystem) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	infos, err := system.Local{}.ReadDir(ctx, path)
+	if err != nil {
+		s.obs.Observe("readdir %s: %v", path, err)
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i := range infos {
+		names[i] = infos[i].Name()
+	}
+	s.obs.Observe("readdir %s: %q", path, names)
+	return infos, nil
 }
 
 func (simulatedSystem) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
@@ -184,12 +982,17 @@ func (simulatedSystem) CreateFile(ctx context.Context, path string, mode os.File
 	return discardWriter{}, nil
 }
 
-func (simulatedSystem) OpenFile(ctx context.Context, path string) (system.File, error) {
+func (s simulatedSystem) OpenFile(ctx context.Context, path string) (system.File, error) {
 	f, err := os.Open(path)
 	if err != nil {
+		s.obs.Observe("open %s: %v", path, err)
 		return nil, err
 	}
-	return &readOnlyFile{f: f}, nil
+	ro := &readOnlyFile{f: f}
+	if s.obs != nil {
+		ro.obs, ro.hash = s.obs, sha256.New()
+	}
+	return ro, nil
 }
 
 func (simulatedSystem) Chmod(ctx context.Context, path string, mode os.FileMode) error {
@@ -204,28 +1007,228 @@ func (simulatedSystem) OwnerInfo(mode os.FileInfo) (system.UID, system.GID, erro
 	return (system.Local{}).OwnerInfo(mode)
 }
 
-func (simulatedSystem) LookupUser(name string) (system.UID, error) {
-	return (system.Local{}).LookupUser(name)
+func (s simulatedSystem) LookupUser(name string) (system.UID, error) {
+	uid, err := (system.Local{}).LookupUser(name)
+	s.obs.Observe("user %s: %d %v", name, uid, err)
+	return uid, err
 }
 
-func (simulatedSystem) LookupGroup(name string) (system.GID, error) {
-	return (system.Local{}).LookupGroup(name)
+func (s simulatedSystem) LookupGroup(name string) (system.GID, error) {
+	gid, err := (system.Local{}).LookupGroup(name)
+	s.obs.Observe("group %s: %d %v", name, gid, err)
+	return gid, err
+}
+
+func (s simulatedSystem) LookPath(ctx context.Context, file string, pathList string) (string, error) {
+	path, err := system.Local{}.LookPath(ctx, file, pathList)
+	s.obs.Observe("lookpath %s %s: %s %v", file, pathList, path, err)
+	return path, err
 }
 
 func (simulatedSystem) Run(ctx context.Context, cmd *system.Cmd) (output []byte, err error) {
 	return nil, nil
 }
 
+func (simulatedSystem) Start(ctx context.Context, cmd *system.Cmd) (system.Process, error) {
+	return &simulatedProcess{done: make(chan struct{})}, nil
+}
+
+// Lock returns a lock that does nothing, since a dry run doesn't write
+// files.
+func (simulatedSystem) Lock(ctx context.Context, path string, mode os.FileMode) (system.FileLock, error) {
+	return simulatedLock{}, nil
+}
+
+type simulatedLock struct{}
+
+func (simulatedLock) Unlock() error { return nil }
+
+// CloneFile fails so that the applier falls back to writing the file,
+// which a dry run observes.
+func (simulatedSystem) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	return errors.New("dry run: not cloning files")
+}
+
+// Rename does nothing, since a dry run doesn't write the file being
+// renamed.
+func (simulatedSystem) Rename(ctx context.Context, oldpath, newpath string) error {
+	return nil
+}
+
+func (simulatedSystem) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// Pretend that every service is up.
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func localRegistry() (system.Registry, error) {
+	r, ok := interface{}(system.Local{}).(system.Registry)
+	if !ok {
+		return nil, errors.New("system has no registry")
+	}
+	return r, nil
+}
+
+func (s simulatedSystem) RegistryKeyExists(ctx context.Context, key string) (bool, error) {
+	r, err := localRegistry()
+	if err != nil {
+		return false, err
+	}
+	exists, err := r.RegistryKeyExists(ctx, key)
+	s.obs.Observe("registry key %s: %t %v", key, exists, err)
+	return exists, err
+}
+
+func (simulatedSystem) CreateRegistryKey(ctx context.Context, key string) error {
+	return nil
+}
+
+func (simulatedSystem) DeleteRegistryKey(ctx context.Context, key string) error {
+	return nil
+}
+
+func (s simulatedSystem) RegistryValue(ctx context.Context, key, name string) (system.RegistryValue, error) {
+	r, err := localRegistry()
+	if err != nil {
+		return system.RegistryValue{}, err
+	}
+	val, err := r.RegistryValue(ctx, key, name)
+	s.obs.Observe("registry value %s\\%s: %d %x %v", key, name, val.Type, val.Data, err)
+	return val, err
+}
+
+func (simulatedSystem) SetRegistryValue(ctx context.Context, key, name string, val system.RegistryValue) error {
+	return nil
+}
+
+func (simulatedSystem) DeleteRegistryValue(ctx context.Context, key, name string) error {
+	return nil
+}
+
+func (s simulatedSystem) QueryService(ctx context.Context, name string) (*system.ServiceStatus, error) {
+	status, err := s.services.query(ctx, name)
+	if err != nil {
+		s.obs.Observe("service %s: %v", name, err)
+	} else {
+		s.obs.Observe("service %s: %+v", name, *status)
+	}
+	return status, err
+}
+
+func (s simulatedSystem) CreateService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	s.services.set(name, &system.ServiceStatus{
+		ServiceConfig: *config,
+		State:         system.ServiceStopped,
+	})
+	return nil
+}
+
+func (s simulatedSystem) ConfigureService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	status, err := s.services.query(ctx, name)
+	if err != nil {
+		return err
+	}
+	if config.DisplayName != "" {
+		status.DisplayName = config.DisplayName
+	}
+	if config.BinaryPath != "" {
+		status.BinaryPath = config.BinaryPath
+	}
+	if config.StartType != 0 {
+		status.StartType = config.StartType
+	}
+	s.services.set(name, status)
+	return nil
+}
+
+func (s simulatedSystem) StartService(ctx context.Context, name string) error {
+	return s.services.setState(ctx, name, system.ServiceRunning)
+}
+
+func (s simulatedSystem) StopService(ctx context.Context, name string) error {
+	return s.services.setState(ctx, name, system.ServiceStopped)
+}
+
+// simulatedServices overlays simulated changes on the local services.
+type simulatedServices struct {
+	mu       sync.Mutex
+	services map[string]*system.ServiceStatus
+}
+
+func (ss *simulatedServices) query(ctx context.Context, name string) (*system.ServiceStatus, error) {
+	ss.mu.Lock()
+	status := ss.services[strings.ToLower(name)]
+	ss.mu.Unlock()
+	if status != nil {
+		s := *status
+		return &s, nil
+	}
+	sm, ok := interface{}(system.Local{}).(system.ServiceManager)
+	if !ok {
+		return nil, errors.New("system cannot manage services")
+	}
+	return sm.QueryService(ctx, name)
+}
+
+func (ss *simulatedServices) set(name string, status *system.ServiceStatus) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.services == nil {
+		ss.services = make(map[string]*system.ServiceStatus)
+	}
+	ss.services[strings.ToLower(name)] = status
+}
+
+func (ss *simulatedServices) setState(ctx context.Context, name string, state system.ServiceState) error {
+	status, err := ss.query(ctx, name)
+	if err != nil {
+		return err
+	}
+	status.State = state
+	ss.set(name, status)
+	return nil
+}
+
+// simulatedProcess runs until it is killed.
+type simulatedProcess struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func (p *simulatedProcess) Wait() error {
+	<-p.done
+	return nil
+}
+
+func (p *simulatedProcess) Kill() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+func (p *simulatedProcess) Output() []byte {
+	return nil
+}
+
 type readOnlyFile struct {
 	f     *os.File
 	wrote bool
+
+	// obs is given the hash of the bytes read when the file is closed,
+	// if not nil.
+	obs  *plan.Observer
+	hash hash.Hash
 }
 
 func (ro *readOnlyFile) Read(p []byte) (int, error) {
 	if ro.wrote {
 		return 0, errors.New("read after simulated write")
 	}
-	return ro.f.Read(p)
+	n, err := ro.f.Read(p)
+	if ro.hash != nil {
+		ro.hash.Write(p[:n])
+	}
+	return n, err
 }
 
 func (ro *readOnlyFile) Write(p []byte) (int, error) {
@@ -246,6 +1249,9 @@ func (ro *readOnlyFile) Truncate(size int64) error {
 }
 
 func (ro *readOnlyFile) Close() error {
+	if ro.obs != nil {
+		ro.obs.Observe("read %s: %x", ro.f.Name(), ro.hash.Sum(nil))
+	}
 	return ro.f.Close()
 }
 
@@ -260,8 +1266,33 @@ func (discardWriter) Close() error {
 }
 
 type logger struct {
-	quiet bool
-	mu    sync.Mutex
+	quiet     bool
+	verbosity execlib.Verbosity
+	json      bool
+	mu        sync.Mutex
+
+	// atExit is called by Fatal before exiting, if not nil.
+	atExit func()
+}
+
+func (l *logger) Debugf(ctx context.Context, v execlib.Verbosity, format string, args ...interface{}) {
+	if l.quiet || v > l.verbosity {
+		return
+	}
+	now := time.Now()
+	if l.json {
+		l.writeJSON(newJSONLogEntry(ctx, now, "debug", fmt.Sprintf(format, args...)))
+		return
+	}
+	var line bytes.Buffer
+	writeLogHead(&line, "DEBUG", now)
+	fmt.Fprintf(&line, format, args...)
+	if b := line.Bytes(); b[len(b)-1] != '\n' {
+		line.WriteByte('\n')
+	}
+	defer l.mu.Unlock()
+	l.mu.Lock()
+	os.Stderr.Write(line.Bytes())
 }
 
 func (l *logger) Infof(ctx context.Context, format string, args ...interface{}) {
@@ -269,8 +1300,16 @@ func (l *logger) Infof(ctx context.Context, format string, args ...interface{})
 		return
 	}
 	now := time.Now()
+	level, severity := "info", "INFO"
+	if ev := execlib.EventFromContext(ctx); ev != nil && ev.Kind == execlib.EventWarning {
+		level, severity = "warning", "WARN"
+	}
+	if l.json {
+		l.writeJSON(newJSONLogEntry(ctx, now, level, fmt.Sprintf(format, args...)))
+		return
+	}
 	var line bytes.Buffer
-	writeLogHead(&line, "INFO", now)
+	writeLogHead(&line, severity, now)
 	fmt.Fprintf(&line, format, args...)
 	if b := line.Bytes(); b[len(b)-1] != '\n' {
 		line.WriteByte('\n')
@@ -282,6 +1321,20 @@ func (l *logger) Infof(ctx context.Context, format string, args ...interface{})
 
 func (l *logger) Error(ctx context.Context, err error) {
 	now := time.Now()
+	if l.json {
+		ent := newJSONLogEntry(ctx, now, "error", err.Error())
+		if err, ok := err.(*execlib.Error); ok {
+			if ent.ResourceID == 0 {
+				ent.ResourceID, ent.Name, ent.Comment = err.ResourceID, err.ResourceName, err.ResourceComment
+			}
+			ent.Owner, ent.DocURL = err.ResourceOwner, err.ResourceDocURL
+			if !l.quiet {
+				ent.Output = string(err.Output)
+			}
+		}
+		l.writeJSON(ent)
+		return
+	}
 	var line bytes.Buffer
 	writeLogHead(&line, "ERROR", now)
 	line.WriteString(err.Error())
@@ -314,6 +1367,180 @@ func (l *logger) Error(ctx context.Context, err error) {
 	}
 }
 
+// Summary writes the run's summary line to stdout.  In JSON mode, the
+// summary is also logged as a "summary" event.  The summary is never
+// suppressed by -q.
+func (l *logger) Summary(ctx context.Context, sum *execlib.Summary) {
+	if l.json {
+		ent := newJSONLogEntry(ctx, time.Now(), "info", sum.String())
+		ent.Event = "summary"
+		ent.Summary = sum
+		l.writeJSON(ent)
+	}
+	defer l.mu.Unlock()
+	l.mu.Lock()
+	fmt.Println(sum)
+}
+
+// verbosityFlag is a boolean flag that raises the verbosity to at
+// least level.
+type verbosityFlag struct {
+	v     *execlib.Verbosity
+	level execlib.Verbosity
+}
+
+func (f verbosityFlag) String() string {
+	if f.v == nil {
+		return "false"
+	}
+	return strconv.FormatBool(*f.v >= f.level)
+}
+
+func (f verbosityFlag) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if b && *f.v < f.level {
+		*f.v = f.level
+	}
+	return nil
+}
+
+func (f verbosityFlag) IsBoolFlag() bool {
+	return true
+}
+
+// tagLimitsFlag is a repeatable TAG=N flag that fills in
+// execlib.Options.TagLimits.
+type tagLimitsFlag struct {
+	m *map[string]int
+}
+
+func (f tagLimitsFlag) String() string {
+	if f.m == nil {
+		return ""
+	}
+	tags := make([]string, 0, len(*f.m))
+	for tag := range *f.m {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for i, tag := range tags {
+		tags[i] = tag + "=" + strconv.Itoa((*f.m)[tag])
+	}
+	return strings.Join(tags, ",")
+}
+
+func (f tagLimitsFlag) Set(s string) error {
+	i := strings.LastIndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("limit %q is not in the form TAG=N", s)
+	}
+	n, err := strconv.Atoi(s[i+1:])
+	if err != nil || n < 1 {
+		return fmt.Errorf("limit %q is not a positive number", s[i+1:])
+	}
+	if *f.m == nil {
+		*f.m = make(map[string]int)
+	}
+	(*f.m)[s[:i]] = n
+	return nil
+}
+
+// varsFlag is a repeatable NAME=VALUE flag that fills in
+// execlib.Options.Vars.
+type varsFlag struct {
+	m *map[string]string
+}
+
+func (f varsFlag) String() string {
+	if f.m == nil {
+		return ""
+	}
+	names := make([]string, 0, len(*f.m))
+	for name := range *f.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + (*f.m)[name]
+	}
+	return strings.Join(names, ",")
+}
+
+func (f varsFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("variable %q is not in the form NAME=VALUE", s)
+	}
+	if *f.m == nil {
+		*f.m = make(map[string]string)
+	}
+	(*f.m)[s[:i]] = s[i+1:]
+	return nil
+}
+
+// overlaysFlag is a repeatable flag of overlay file paths.
+type overlaysFlag []string
+
+func (f *overlaysFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *overlaysFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// jsonLogEntry is a single line of -log-format=json output.
+type jsonLogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"msg"`
+
+	RunID      string                 `json:"run_id,omitempty"`
+	SpanID     string                 `json:"span_id,omitempty"`
+	Event      execlib.EventKind      `json:"event,omitempty"`
+	ResourceID uint64                 `json:"resource_id,omitempty"`
+	Name       string                 `json:"name,omitempty"`
+	Comment    string                 `json:"comment,omitempty"`
+	Owner      string                 `json:"owner,omitempty"`
+	DocURL     string                 `json:"doc_url,omitempty"`
+	Status     execlib.ResourceStatus `json:"status,omitempty"`
+	Duration   float64                `json:"duration_seconds,omitempty"`
+	Skipped    []uint64               `json:"skipped,omitempty"`
+	Output     string                 `json:"output,omitempty"`
+	Summary    *execlib.Summary       `json:"summary,omitempty"`
+}
+
+func newJSONLogEntry(ctx context.Context, now time.Time, level, msg string) *jsonLogEntry {
+	ent := &jsonLogEntry{Time: now, Level: level, Message: msg, RunID: execlib.RunIDFromContext(ctx)}
+	if ev := execlib.EventFromContext(ctx); ev != nil {
+		ent.SpanID = ev.SpanID
+		ent.Event = ev.Kind
+		ent.ResourceID = ev.ResourceID
+		ent.Name = ev.ResourceName
+		ent.Comment = ev.ResourceComment
+		ent.Status = ev.Status
+		ent.Duration = ev.Duration.Seconds()
+		ent.Skipped = ev.Skipped
+	}
+	return ent
+}
+
+func (l *logger) writeJSON(ent *jsonLogEntry) {
+	line, err := json.Marshal(ent)
+	if err != nil {
+		// Only possible with a bug in jsonLogEntry.
+		panic(err)
+	}
+	line = append(line, '\n')
+	defer l.mu.Unlock()
+	l.mu.Lock()
+	os.Stderr.Write(line)
+}
+
 func writeLogHead(buf *bytes.Buffer, severity string, now time.Time) {
 	buf.WriteString("mcm-exec: ")
 	buf.WriteString(now.Format("2006-01-02T15:04:05"))
@@ -322,11 +1549,29 @@ func writeLogHead(buf *bytes.Buffer, severity string, now time.Time) {
 
 func (l *logger) Fatal(ctx context.Context, err error) {
 	l.Error(ctx, err)
+	if l.atExit != nil {
+		l.atExit()
+	}
 	os.Exit(1)
 }
 
-func readCatalog(r io.Reader) (catalog.Catalog, error) {
-	msg, err := capnp.NewDecoder(r).Decode()
+// readCatalog reads a serialized catalog, decrypting it with key if it
+// is encrypted.
+func readCatalog(r io.Reader, key *catcrypt.Key) (catalog.Catalog, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	if catcrypt.IsEncrypted(data) {
+		if key == nil {
+			return catalog.Catalog{}, errors.New("read catalog: catalog is encrypted; use -decrypt_key or -decrypt_key_command")
+		}
+		data, err = catcrypt.Decrypt(key, data)
+		if err != nil {
+			return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+		}
+	}
+	msg, err := capnp.NewDecoder(bytes.NewReader(data)).Decode()
 	if err != nil {
 		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
 	}
@@ -336,3 +1581,50 @@ func readCatalog(r io.Reader) (catalog.Catalog, error) {
 	}
 	return c, nil
 }
+
+// readOverlay reads the overlay file at path.
+func readOverlay(path string) (catalog.Overlay, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return catalog.Overlay{}, fmt.Errorf("read overlay: %v", err)
+	}
+	msg, err := capnp.Unmarshal(data)
+	if err != nil {
+		return catalog.Overlay{}, fmt.Errorf("read overlay %s: %v", path, err)
+	}
+	o, err := catalog.ReadRootOverlay(msg)
+	if err != nil {
+		return catalog.Overlay{}, fmt.Errorf("read overlay %s: %v", path, err)
+	}
+	return o, nil
+}
+
+// openCatalog reads the catalog at path.  Unencrypted catalogs are
+// memory-mapped, so large catalogs aren't read into memory all at once.
+func openCatalog(path string, key *catcrypt.Key) (catalog.Catalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	// A short read means the file is smaller than the header.
+	if head, _ := r.Peek(64); catcrypt.IsEncrypted(head) {
+		return readCatalog(r, key)
+	}
+	cf, err := catalog.OpenFile(path)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	return cf.Catalog, nil
+}
+
+// fetchCatalog downloads and reads the catalog at url, which may be an
+// http, https, s3, or gs URL.
+func fetchCatalog(ctx context.Context, d *download.Downloader, url string, key *catcrypt.Key) (catalog.Catalog, error) {
+	data, err := d.Fetch(ctx, url)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("fetch %s: %v", url, err)
+	}
+	return readCatalog(bytes.NewReader(data), key)
+}
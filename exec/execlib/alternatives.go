@@ -0,0 +1,156 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// updateAlternativesPaths are the places that update-alternatives is
+// installed: /usr/bin on Debian and /usr/sbin on Red Hat.
+var updateAlternativesPaths = []string{
+	"/usr/bin/update-alternatives",
+	"/usr/sbin/update-alternatives",
+}
+
+func (j *job) alternative(ctx context.Context, a catalog.Alternative) (changed bool, err error) {
+	name, err := a.Name()
+	if err != nil {
+		return false, errorf("read name: %v", err)
+	}
+	if name == "" {
+		return false, errorf("alternatives name is empty")
+	}
+	path, err := a.Path()
+	if err != nil {
+		return false, errorf("read path: %v", err)
+	}
+	if path == "" {
+		return false, errorf("alternative path is empty")
+	}
+	tool, err := j.findUpdateAlternatives(ctx)
+	if err != nil {
+		return false, err
+	}
+	out, exists, err := j.probeProgram(ctx, tool, "--display", name)
+	if err != nil {
+		return false, err
+	}
+	var group alternativesGroup
+	if exists {
+		group = parseAlternatives(out, name)
+	}
+	priority, installed := group.priorities[path]
+
+	if a.Absent() {
+		if !installed {
+			return false, nil
+		}
+		if _, err := j.runProgram(ctx, tool, "--remove", name, path); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if !installed || priority != int64(a.Priority()) {
+		link, err := a.Link()
+		if err != nil {
+			return false, errorf("read link: %v", err)
+		}
+		if link == "" {
+			return false, errorf("alternative link is empty")
+		}
+		if _, err := j.runProgram(ctx, tool, "--install", link, name, path, strconv.FormatInt(int64(a.Priority()), 10)); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+	// Installing can change the automatic choice, so the group is not
+	// trusted to still point at the same path.
+	if a.Selected() && (changed || !group.manual || group.current != path) {
+		if _, err := j.runProgram(ctx, tool, "--set", name, path); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// findUpdateAlternatives returns the path of update-alternatives.
+func (j *job) findUpdateAlternatives(ctx context.Context) (string, error) {
+	for _, p := range updateAlternativesPaths {
+		ok, err := j.pathExists(ctx, p)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return p, nil
+		}
+	}
+	return "", errorf("update-alternatives not found in %s", strings.Join(updateAlternativesPaths, " or "))
+}
+
+// alternativesGroup is the state of an alternatives group.
+type alternativesGroup struct {
+	manual     bool
+	current    string
+	priorities map[string]int64
+}
+
+// parseAlternatives parses the output of update-alternatives --display,
+// which on Debian looks like:
+//
+//	editor - manual mode
+//	  link best version is /bin/nano
+//	  link currently points to /usr/bin/vim.basic
+//	  link editor is /usr/bin/editor
+//	/bin/nano - priority 40
+//	/usr/bin/vim.basic - priority 30
+//
+// Red Hat prints "status is manual." instead of "manual mode", may add
+// a family before an alternative's priority, and prints slave links
+// below each alternative, which are ignored.
+func parseAlternatives(out []byte, name string) alternativesGroup {
+	g := alternativesGroup{priorities: make(map[string]int64)}
+	const current = "link currently points to "
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, name+" - "):
+			status := line[len(name)+len(" - "):]
+			g.manual = strings.Contains(status, "manual")
+		case strings.HasPrefix(trimmed, current):
+			g.current = strings.TrimSpace(trimmed[len(current):])
+		case !strings.HasPrefix(line, " ") && strings.Contains(line, " - "):
+			i := strings.Index(line, " - ")
+			fields := strings.Fields(line[i+len(" - "):])
+			if len(fields) < 2 || fields[len(fields)-2] != "priority" {
+				continue
+			}
+			p, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+			if err == nil {
+				g.priorities[line[:i]] = p
+			}
+		}
+	}
+	return g
+}
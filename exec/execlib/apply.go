@@ -20,39 +20,133 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/internal/state"
 	"github.com/zombiezen/mcm/internal/system"
 )
 
 type job struct {
 	sys         system.System
 	log         Logger
+	now         func() time.Time
 	resource    catalog.Resource
 	depsChanged map[uint64]bool
 
-	bashPath string
+	bashPath   string
+	vars       map[string]string
+	umask      *os.FileMode
+	maxOutput  int
+	supervisor *Supervisor
+	downloader *download.Downloader
+	hashes     *hashCache
+	lockFiles  bool
+	skipHealth bool
+	credsDir   string
+	env        []string
+
+	// cmdLogDir is the directory to tee command output to, if any.  See
+	// Options.CommandLogDir.
+	cmdLogDir   string
+	cmdLogsKept int
+
+	// keepOutput is true if a file takes its content from the output of
+	// the resource's command.  output is the output, and ran is true
+	// once the command has run.
+	keepOutput bool
+	output     []byte
+	ran        bool
+
+	// sourceOutput is the output of the exec resource that a file takes
+	// its content from, and sourceRan is false if its command wasn't
+	// run.
+	sourceOutput []byte
+	sourceRan    bool
+
+	// batch is the list of other exec resources to apply with this
+	// one's command.  See runBatch.
+	batch []*job
+
+	// vetoed is the reason that Options.Veto gave for not applying the
+	// resource, if any.
+	vetoed string
+
+	// span is the resource's Event.SpanID.
+	span string
+
+	// warnings are the messages passed to warnf while applying the
+	// resource.
+	warnings []string
+
+	// conditions are the exec resource's evaluated conditions, in the
+	// order that they were checked.
+	conditions []*ConditionTrace
 }
 
 type jobResult struct {
-	id      uint64
-	changed bool
-	err     error
+	id         uint64
+	changed    bool
+	err        error
+	warnings   []string
+	conditions []*ConditionTrace
+	reboot     *RebootRequest
+
+	// output is the output of an exec resource's command, if ran and
+	// the command's output is kept for a file.
+	output []byte
+	ran    bool
+
+	// violated is true if err is a violated assertion rather than a
+	// failure to apply the resource.
+	violated bool
+
+	// disabled is true if the resource was not applied because the
+	// catalog disables it.
+	disabled bool
+
+	start    time.Time
+	duration time.Duration
+}
+
+// warnf records a warning about the resource: a problem that doesn't
+// stop the resource from being applied, but that Options.Strict turns
+// into a failure.
+func (j *job) warnf(format string, args ...interface{}) {
+	j.warnings = append(j.warnings, fmt.Sprintf(format, args...))
+}
+
+// ids returns the IDs of the resources applied by j.
+func (j *job) ids() []uint64 {
+	ids := make([]uint64, 0, 1+len(j.batch))
+	ids = append(ids, j.resource.ID())
+	for _, b := range j.batch {
+		ids = append(ids, b.resource.ID())
+	}
+	return ids
 }
 
 func (j *job) run(ctx context.Context) jobResult {
 	result := jobResult{id: j.resource.ID()}
+	if j.resource.Disabled() {
+		result.disabled = true
+		return result
+	}
+	if j.vetoed != "" {
+		result.err = errorWithResource(j.resource, errorf("vetoed: %s", j.vetoed))
+		return result
+	}
 	switch j.resource.Which() {
 	case catalog.Resource_Which_noop:
-		for _, c := range j.depsChanged {
-			if c {
-				result.changed = true
-				break
-			}
-		}
+		result.changed = j.anyDepsChanged()
+		return result
+	case catalog.Resource_Which_barrier:
 		return result
 	case catalog.Resource_Which_file:
 		f, err := j.resource.File()
@@ -67,6 +161,19 @@ func (j *job) run(ctx context.Context) jobResult {
 		}
 		result.changed = changed
 		return result
+	case catalog.Resource_Which_fileGroup:
+		g, err := j.resource.FileGroup()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		changed, err := j.fileGroup(ctx, g)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.changed = changed
+		return result
 	case catalog.Resource_Which_exec:
 		e, err := j.resource.Exec()
 		if err != nil {
@@ -79,6 +186,138 @@ func (j *job) run(ctx context.Context) jobResult {
 			return result
 		}
 		result.changed = changed
+		result.output, result.ran = j.output, j.ran
+		return result
+	case catalog.Resource_Which_healthCheck:
+		hc, err := j.resource.HealthCheck()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		unhealthy, err := j.healthCheck(ctx, hc)
+		if err == nil {
+			err = unhealthy
+		}
+		result.err = errorWithResource(j.resource, err)
+		return result
+	case catalog.Resource_Which_registryKey:
+		k, err := j.resource.RegistryKey()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		changed, err := j.registryKey(ctx, k)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.changed = changed
+		return result
+	case catalog.Resource_Which_registryValue:
+		v, err := j.resource.RegistryValue()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		changed, err := j.registryValue(ctx, v)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.changed = changed
+		return result
+	case catalog.Resource_Which_service:
+		s, err := j.resource.Service()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		changed, err := j.service(ctx, s)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.changed = changed
+		return result
+	case catalog.Resource_Which_launchdJob:
+		l, err := j.resource.LaunchdJob()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		changed, err := j.launchdJob(ctx, l)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.changed = changed
+		return result
+	case catalog.Resource_Which_userDefault:
+		d, err := j.resource.UserDefault()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		changed, err := j.userDefault(ctx, d)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.changed = changed
+		return result
+	case catalog.Resource_Which_packageRepo:
+		pr, err := j.resource.PackageRepo()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		changed, err := j.packageRepo(ctx, pr)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.changed = changed
+		return result
+	case catalog.Resource_Which_alternative:
+		a, err := j.resource.Alternative()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		changed, err := j.alternative(ctx, a)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.changed = changed
+		return result
+	case catalog.Resource_Which_reboot:
+		rb, err := j.resource.Reboot()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		req, err := j.rebootRequest(ctx, rb)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.changed = req != nil
+		result.reboot = req
+		return result
+	case catalog.Resource_Which_assert:
+		a, err := j.resource.Assert()
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		violation, err := j.assert(ctx, a)
+		if err != nil {
+			result.err = errorWithResource(j.resource, err)
+			return result
+		}
+		result.err = errorWithResource(j.resource, violation)
+		result.violated = violation != nil
 		return result
 	default:
 		result.err = errorWithResource(j.resource, errorf("unknown type %v", j.resource.Which()))
@@ -94,6 +333,22 @@ func (j *job) file(ctx context.Context, f catalog.File) (changed bool, err error
 	if path == "" {
 		return false, errors.New("file path is empty")
 	}
+	created := false
+	if f.CreateParents() && f.Which() != catalog.File_Which_absent {
+		created, err = j.mkdirAll(ctx, filepath.Dir(path))
+		if err != nil {
+			return false, errorf("create parents of %s: %v", path, err)
+		}
+		if created {
+			debugf(j.log, ctx, Verbose, "%s: created parents of %s", formatResource(j.resource), path)
+		}
+	}
+	changed, err = j.fileEntry(ctx, path, f)
+	return changed || created, err
+}
+
+// fileEntry applies f to the file at path.
+func (j *job) fileEntry(ctx context.Context, path string, f catalog.File) (changed bool, err error) {
 	switch f.Which() {
 	case catalog.File_Which_plain:
 		return j.plainFile(ctx, path, f.Plain())
@@ -116,28 +371,79 @@ func (j *job) file(ctx context.Context, f catalog.File) (changed bool, err error
 }
 
 func (j *job) plainFile(ctx context.Context, path string, f catalog.File_plain) (changed bool, err error) {
-	if !f.HasContent() {
+	if f.CreateOnly() {
+		if f.OnlyIfExists() {
+			return false, errorf("createOnly set with onlyIfExists")
+		}
+		if _, err := j.sys.Lstat(ctx, path); err == nil {
+			mode, _ := f.Mode()
+			return j.fileMode(ctx, path, mode)
+		} else if !os.IsNotExist(err) {
+			return false, errorf("determine state of %s: %v", path, err)
+		}
+	}
+	if f.OnlyIfExists() {
+		if _, err := j.sys.Lstat(ctx, path); os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, errorf("determine state of %s: %v", path, err)
+		}
+	}
+	if f.ContentFromOutput() != 0 && (f.HasContent() || f.HasContentUrl() || f.HasContentPath()) {
+		return false, errorf("contentFromOutput set with content, contentUrl, or contentPath")
+	}
+	if !f.HasContent() && !f.HasContentUrl() && !f.HasContentPath() && !j.sourceRan {
+		if f.ContentFromOutput() != 0 {
+			debugf(j.log, ctx, Verbose, "%s: command of resource %d was not run: leaving content", formatResource(j.resource), f.ContentFromOutput())
+		}
 		info, err := j.sys.Lstat(ctx, path)
 		if err != nil {
 			return false, err
 		}
 		if !info.Mode().IsRegular() {
 			// TODO(soon): what kind of node it?
-			return false, errorf("%s is not a regular file")
+			return false, errorf("%s is not a regular file", path)
 		}
 		mode, _ := f.Mode()
 		return j.fileModeWithInfo(ctx, path, info, mode)
 	}
 
-	content, err := f.Content()
+	content, err := j.plainContent(ctx, f)
 	if err != nil {
-		return false, errorf("read content from catalog: %v", err)
+		return false, err
+	}
+	if f.HasVerify() {
+		if err := j.verifyContent(ctx, path, f, content); err != nil {
+			return false, err
+		}
+	}
+	mode, _ := f.Mode()
+	var contentChanged, created bool
+	if f.CreateOnly() {
+		err = system.CreateNewFile(ctx, j.sys, path, content, createMode(mode.Bits(), 0666))
+		// Another process may have created the file since it was
+		// checked.  Its content wins.
+		created = err == nil
+		contentChanged = created
+		if os.IsExist(err) {
+			err = nil
+		}
+	} else {
+		var src string
+		if f.HasContentPath() {
+			// plainContent checked that the path is valid.
+			src, _ = f.ContentPath()
+		}
+		contentChanged, created, err = j.plainFileContent(ctx, path, content, src, createMode(mode.Bits(), 0666))
 	}
-	contentChanged, err := j.plainFileContent(ctx, path, content)
 	if err != nil {
 		return false, err
 	}
-	mode, _ := f.Mode()
+	if created {
+		if err := j.applyUmask(ctx, path, mode.Bits(), 0666); err != nil {
+			return false, err
+		}
+	}
 	modeChanged, err := j.fileMode(ctx, path, mode)
 	if err != nil {
 		return false, err
@@ -145,43 +451,213 @@ func (j *job) plainFile(ctx context.Context, path string, f catalog.File_plain)
 	return contentChanged || modeChanged, nil
 }
 
-func (j *job) plainFileContent(ctx context.Context, path string, content []byte) (changed bool, err error) {
-	w, err := j.sys.CreateFile(ctx, path, 0666) // rely on umask to restrict
+// plainContent returns the content that a plain file should have,
+// downloading it if the catalog gives a URL or reading it from the
+// system if the catalog gives a path.
+func (j *job) plainContent(ctx context.Context, f catalog.File_plain) ([]byte, error) {
+	if f.ContentFromOutput() != 0 {
+		return j.sourceOutput, nil
+	}
+	if f.HasContentPath() {
+		if f.HasContent() || f.HasContentUrl() {
+			return nil, errorf("contentPath set with content or contentUrl")
+		}
+		return j.copyContent(ctx, f)
+	}
+	if !f.HasContentUrl() {
+		content, err := f.Content()
+		if err != nil {
+			return nil, errorf("read content from catalog: %v", err)
+		}
+		return content, nil
+	}
+	if f.HasContent() {
+		return nil, errorf("both content and contentUrl set")
+	}
+	u, err := f.ContentUrl()
+	if err != nil {
+		return nil, errorf("read content URL from catalog: %v", err)
+	}
+	d := j.downloader
+	if d == nil {
+		d = defaultDownloader
+	}
+	content, err := d.Fetch(ctx, u)
+	if err != nil {
+		return nil, errorf("download %s: %v", u, err)
+	}
+	return content, nil
+}
+
+// copyContent reads the content of the file named by f's contentPath.
+func (j *job) copyContent(ctx context.Context, f catalog.File_plain) ([]byte, error) {
+	src, err := f.ContentPath()
+	if err != nil {
+		return nil, errorf("read content path from catalog: %v", err)
+	}
+	if !filepath.IsAbs(src) {
+		return nil, errorf("content path %s is not absolute", src)
+	}
+	content, err := system.ReadFile(ctx, j.sys, src)
+	if err != nil {
+		return nil, errorf("copy from %s: %v", src, err)
+	}
+	return content, nil
+}
+
+var defaultDownloader = new(download.Downloader)
+
+// plainFileContent ensures that the file at path has the given
+// content, creating it with mode if it does not exist.  If the job has
+// a hash cache and the content is large, then a file that hasn't
+// changed since its hash was recorded isn't read.  If src is not
+// empty, then it names a file with the content, and a large file is
+// written by cloning src where the filesystem supports it.
+func (j *job) plainFileContent(ctx context.Context, path string, content []byte, src string, mode os.FileMode) (changed, created bool, err error) {
+	clone := src != "" && len(content) >= minCloneSize
+	if clone {
+		if _, err := j.sys.Lstat(ctx, path); os.IsNotExist(err) && j.cloneFile(ctx, src, path, mode) {
+			return true, true, nil
+		}
+	}
+	w, err := j.sys.CreateFile(ctx, path, mode)
+	created = err == nil
 	if os.IsExist(err) {
+		var key *state.FileHash
+		var sum string
+		known, matches := false, false
+		if j.hashes != nil && len(content) >= minHashCacheSize {
+			key = j.hashes.stat(ctx, j.sys, path)
+			if key != nil {
+				sum = j.hashes.sum(content)
+				var cached string
+				cached, known = j.hashes.lookup(path, key)
+				if known && cached == sum {
+					return false, false, nil
+				}
+			}
+		}
+		if j.lockFiles {
+			unlock, err := j.lockFile(ctx, path, mode)
+			if err != nil {
+				return false, false, err
+			}
+			defer unlock()
+		}
 		f, err := j.sys.OpenFile(ctx, path)
 		if err != nil {
-			return false, err
+			return false, false, err
 		}
-		matches, err := hasContent(f, content)
-		if err != nil {
-			f.Close()
-			return false, err
+		if !known {
+			matches, err = hasContent(f, content)
+			if err != nil {
+				f.Close()
+				return false, false, err
+			}
 		}
 		if matches {
 			f.Close()
-			return false, nil
+			if key != nil {
+				j.hashes.record(path, key, sum)
+			}
+			return false, false, nil
+		}
+		if key != nil && j.hashes.previous(path) == sum {
+			j.warnf("drift corrected: %s was modified after it was last applied", path)
+		}
+		if clone && j.cloneFile(ctx, src, path, mode) {
+			f.Close()
+			return true, false, nil
 		}
 		if _, err = f.Seek(0, io.SeekStart); err != nil {
 			f.Close()
-			return false, err
+			return false, false, err
 		}
 		if err = f.Truncate(0); err != nil {
 			f.Close()
-			return false, err
+			return false, false, err
 		}
 		w = f
 	} else if err != nil {
-		return false, err
+		return false, false, err
 	}
 	_, err = w.Write(content)
 	cerr := w.Close()
 	if err != nil {
-		return false, err
+		return false, created, err
 	}
 	if cerr != nil {
-		return false, cerr
+		return false, created, cerr
 	}
-	return true, nil
+	return true, created, nil
+}
+
+// lockFile takes an advisory lock on the file at path, which is
+// created with mode if it does not exist.  The returned function
+// releases the lock.
+func (j *job) lockFile(ctx context.Context, path string, mode os.FileMode) (unlock func(), err error) {
+	l, ok := j.sys.(system.Locker)
+	if !ok {
+		return nil, errorf("lock %s: system cannot lock files", path)
+	}
+	lock, err := l.Lock(ctx, path, mode)
+	if err != nil {
+		return nil, errorf("lock %s: %v", path, err)
+	}
+	return func() {
+		if err := lock.Unlock(); err != nil {
+			j.warnf("unlock %s: %v", path, err)
+		}
+	}, nil
+}
+
+// minCloneSize is the smallest content for which a file is cloned from
+// its contentPath instead of written.  Smaller files are cheaper to
+// write than to share data with.
+const minCloneSize = 1 << 20
+
+// cloneFile tries to clone src to path, reporting whether it did.  If
+// the system can't clone the file, then the caller should write it.
+func (j *job) cloneFile(ctx context.Context, src, path string, mode os.FileMode) bool {
+	c, ok := j.sys.(system.Cloner)
+	if !ok {
+		return false
+	}
+	if err := c.CloneFile(ctx, src, path, mode); err != nil {
+		debugf(j.log, ctx, Verbose, "%s: clone %s: %v; copying instead", formatResource(j.resource), src, err)
+		return false
+	}
+	return true
+}
+
+// createMode returns the permission bits to create a file with.  If the
+// catalog specifies bits, then the file is created with them so that it
+// is never more accessible than intended, even briefly.  Otherwise, def
+// is restricted by the umask.
+func createMode(bits uint16, def os.FileMode) os.FileMode {
+	if bits == catalog.File_Mode_unset {
+		return def
+	}
+	return modeFromCatalog(bits) & os.ModePerm
+}
+
+// applyUmask sets the permissions of a newly created file with unset
+// bits to def minus the run's umask.  It is a no-op if the run does not
+// have a umask, in which case the inherited umask applies.  Catalog bits
+// are applied by fileMode regardless of any umask.
+func (j *job) applyUmask(ctx context.Context, path string, bits uint16, def os.FileMode) error {
+	if j.umask == nil || bits != catalog.File_Mode_unset {
+		return nil
+	}
+	info, err := j.sys.Lstat(ctx, path)
+	if err != nil {
+		return err
+	}
+	want := def &^ *j.umask
+	if info.Mode()&os.ModePerm == want {
+		return nil
+	}
+	return j.sys.Chmod(ctx, path, info.Mode()&^os.ModePerm|want)
 }
 
 func hasContent(r io.Reader, content []byte) (bool, error) {
@@ -224,9 +700,30 @@ func (er *errReader) Read(p []byte) (n int, _ error) {
 }
 
 func (j *job) directory(ctx context.Context, path string, d catalog.File_directory) (changed bool, err error) {
-	err = j.sys.Mkdir(ctx, path, 0777) // rely on umask to restrict
+	changed, err = j.makeDirectory(ctx, path, d)
+	if err != nil || d.MaxAgeMillis() == 0 {
+		return changed, err
+	}
+	if d.MaxAgeMillis() > uint64(math.MaxInt64/int64(time.Millisecond)) {
+		// Nothing can be that old.
+		return changed, nil
+	}
+	cutoff := j.now().Add(-time.Duration(d.MaxAgeMillis()) * time.Millisecond)
+	dr, ok := j.sys.(system.DirReader)
+	if !ok {
+		return changed, errorf("purge %s: system cannot list directories", path)
+	}
+	purged, _, err := j.purge(ctx, dr, path, cutoff)
+	return changed || purged, err
+}
+
+func (j *job) makeDirectory(ctx context.Context, path string, d catalog.File_directory) (changed bool, err error) {
+	mode, _ := d.Mode()
+	err = j.sys.Mkdir(ctx, path, createMode(mode.Bits(), 0777))
 	if err == nil {
-		mode, _ := d.Mode()
+		if err := j.applyUmask(ctx, path, mode.Bits(), 0777); err != nil {
+			return true, err
+		}
 		_, err = j.fileMode(ctx, path, mode)
 		return true, err
 	}
@@ -242,15 +739,53 @@ func (j *job) directory(ctx context.Context, path string, d catalog.File_directo
 		// TODO(soon): what kind of node it?
 		return false, errorf("%s is not a directory", path)
 	}
-	mode, _ := d.Mode()
 	return j.fileModeWithInfo(ctx, path, info, mode)
 }
 
+// purge removes the entries in dir that were last modified before
+// cutoff.  Subdirectories are purged first, then removed if they were
+// old and are left empty.  It returns whether it removed anything and
+// the number of entries left in dir.
+func (j *job) purge(ctx context.Context, dr system.DirReader, dir string, cutoff time.Time) (removed bool, left int, err error) {
+	infos, err := dr.ReadDir(ctx, dir)
+	if err != nil {
+		return false, 0, errorf("purge: %v", err)
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		old := info.ModTime().Before(cutoff)
+		if info.IsDir() {
+			r, n, err := j.purge(ctx, dr, path, cutoff)
+			removed = removed || r
+			if err != nil {
+				return removed, 0, err
+			}
+			old = old && n == 0
+		}
+		if !old {
+			left++
+			continue
+		}
+		if err := j.sys.Remove(ctx, path); err != nil {
+			return removed, 0, errorf("purge: %v", err)
+		}
+		debugf(j.log, ctx, Verbose, "%s: removed %s", formatResource(j.resource), path)
+		removed = true
+	}
+	return removed, left, nil
+}
+
 func (j *job) symlink(ctx context.Context, path string, l catalog.File_symlink) (changed bool, err error) {
 	target, err := l.Target()
 	if err != nil {
 		return false, errorf("read target from catalog: %v", err)
 	}
+	if l.Relative() && filepath.IsAbs(target) {
+		target, err = filepath.Rel(filepath.Dir(path), target)
+		if err != nil {
+			return false, errorf("relative target: %v", err)
+		}
+	}
 	err = j.sys.Symlink(ctx, target, path)
 	if err == nil {
 		return true, nil
@@ -342,7 +877,7 @@ func (j *job) fileModeOwner(ctx context.Context, path string, info os.FileInfo,
 		return false, nil
 	}
 	if oldUID, oldGID, err := j.sys.OwnerInfo(info); err != nil {
-		j.log.Infof(ctx, "%s: reading file owner: %v; assuming need to chown", formatResource(j.resource), err)
+		j.warnf("reading owner of %s: %v; assuming it needs chown", path, err)
 	} else if (uid == -1 || oldUID == uid) && (gid == -1 || oldGID == gid) {
 		return false, nil
 	}
@@ -413,9 +948,9 @@ func modeFromCatalog(cmode uint16) os.FileMode {
 }
 
 func (j *job) exec(ctx context.Context, e catalog.Exec) (changed bool, err error) {
-	proceed, err := j.evalExecCondition(ctx, e.Condition())
+	proceed, err := j.execCondition(ctx, e)
 	if err != nil {
-		return false, errorf("condition: %v", err)
+		return false, err
 	}
 	if !proceed {
 		return false, nil
@@ -424,13 +959,211 @@ func (j *job) exec(ctx context.Context, e catalog.Exec) (changed bool, err error
 	if err != nil {
 		return false, errorf("command: %v", err)
 	}
-	if err := j.runCommand(ctx, cmd); err != nil {
+	args, err := batchArgs(e, cmd)
+	if err != nil {
+		return false, err
+	}
+	if e.HasSupervise() {
+		if hasExpect(e) {
+			return false, errorf("expect checks cannot be used with supervise")
+		}
+		sup, err := e.Supervise()
+		if err != nil {
+			return false, errorf("supervise: %v", err)
+		}
+		if err := j.supervise(ctx, cmd, args, sup); err != nil {
+			return false, errorf("supervise: %v", err)
+		}
+		return true, nil
+	}
+	if hasExpect(e) {
+		if err := j.runExpectCommand(ctx, cmd, args, e.Expect()); err != nil {
+			return false, errorf("command: %v", err)
+		}
+		return true, nil
+	}
+	if err := j.runCommand(ctx, cmd, args); err != nil {
 		return false, errorf("command: %v", err)
 	}
 	return true, nil
 }
 
-func (j *job) evalExecCondition(ctx context.Context, cond catalog.Exec_condition) (proceed bool, err error) {
+// execCondition evaluates an exec resource's creates path and
+// condition, logs the outcome, and records it in j.conditions.
+func (j *job) execCondition(ctx context.Context, e catalog.Exec) (proceed bool, err error) {
+	if creates, _ := e.Creates(); creates != "" {
+		exists, err := j.pathExists(ctx, creates)
+		if err != nil {
+			return false, errorf("creates: %v", err)
+		}
+		t := &ConditionTrace{Condition: "creates", Run: !exists}
+		if exists {
+			t.Detail = creates + " exists"
+		} else {
+			t.Detail = creates + " does not exist"
+		}
+		j.conditions = append(j.conditions, t)
+		if exists {
+			debugf(j.log, ctx, Verbose, "%s: %s exists: not running command", formatResource(j.resource), creates)
+			return false, nil
+		}
+	}
+	cond := e.Condition()
+	t := &ConditionTrace{Condition: cond.Which().String()}
+	proceed, err = j.evalExecCondition(ctx, cond, t)
+	if err != nil {
+		return false, errorf("condition: %v", err)
+	}
+	if cond.Which() != catalog.Exec_condition_Which_always {
+		t.Run = proceed
+		j.conditions = append(j.conditions, t)
+		if t.Argv != nil {
+			debugf(j.log, ctx, Verbose, "%s: %v condition: %s", formatResource(j.resource), cond.Which(), t.describeProbe())
+		} else if t.Detail != "" {
+			debugf(j.log, ctx, Verbose, "%s: %v condition: %s", formatResource(j.resource), cond.Which(), t.Detail)
+		}
+		verdict := "not running command"
+		if proceed {
+			verdict = "running command"
+		}
+		debugf(j.log, ctx, Verbose, "%s: %v condition: %s", formatResource(j.resource), cond.Which(), verdict)
+	}
+	return proceed, nil
+}
+
+// batchArgs returns the arguments to append to an exec resource's
+// command.
+func batchArgs(e catalog.Exec, cmd catalog.Exec_Command) ([]string, error) {
+	list, err := e.Batch().Args()
+	if err != nil {
+		return nil, errorf("batch args: %v", err)
+	}
+	if list.Len() == 0 {
+		return nil, nil
+	}
+	if cmd.Which() != catalog.Exec_Command_Which_argv {
+		return nil, errorf("batch args require an argv command")
+	}
+	args := make([]string, list.Len())
+	for i := range args {
+		args[i], err = list.At(i)
+		if err != nil {
+			return nil, errorf("batch args[%d]: %v", i, err)
+		}
+	}
+	return args, nil
+}
+
+// batchKey returns the batch key of r or the empty string if r can't
+// be combined with other resources.
+func batchKey(r catalog.Resource) string {
+	if r.Which() != catalog.Resource_Which_exec {
+		return ""
+	}
+	e, err := r.Exec()
+	if err != nil {
+		return ""
+	}
+	if cmd, _ := e.Command(); cmd.Which() != catalog.Exec_Command_Which_argv || e.HasSupervise() || hasExpect(e) || hasSecrets(cmd) {
+		return ""
+	}
+	key, _ := e.Batch().Key()
+	return key
+}
+
+// sameBatchCommand reports whether two exec resources with the same
+// batch key can be applied with one command.
+func sameBatchCommand(r1, r2 catalog.Resource, vars map[string]string) bool {
+	e1, _ := r1.Exec()
+	e2, _ := r2.Exec()
+	c1, _ := e1.Command()
+	c2, _ := e2.Command()
+	if c1.CreateWorkingDirectory() != c2.CreateWorkingDirectory() || c1.LookPath() != c2.LookPath() {
+		return false
+	}
+	cmd1, err1 := buildCommand(c1, "", vars)
+	cmd2, err2 := buildCommand(c2, "", vars)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return cmd1.Dir == cmd2.Dir && stringsEqual(cmd1.Args, cmd2.Args) && stringsEqual(cmd1.Env, cmd2.Env) && schedEqual(cmd1.Sched, cmd2.Sched)
+}
+
+func schedEqual(a, b *system.Sched) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// runBatch applies j and the resources in j.batch.  The condition of
+// each resource is evaluated separately, then the command is run once
+// with the batch args of each resource whose condition was met.  The
+// first result is j's.
+func (j *job) runBatch(ctx context.Context) []jobResult {
+	all := append([]*job{j}, j.batch...)
+	results := make([]jobResult, len(all))
+	var args []string
+	var proceeding []int
+	for i, m := range all {
+		results[i].id = m.resource.ID()
+		e, err := m.resource.Exec()
+		if err != nil {
+			results[i].err = errorWithResource(m.resource, err)
+			continue
+		}
+		proceed, err := m.execCondition(ctx, e)
+		if err != nil {
+			results[i].err = errorWithResource(m.resource, err)
+			continue
+		}
+		if !proceed {
+			continue
+		}
+		cmd, err := e.Command()
+		if err != nil {
+			results[i].err = errorWithResource(m.resource, errorf("command: %v", err))
+			continue
+		}
+		margs, err := batchArgs(e, cmd)
+		if err != nil {
+			results[i].err = errorWithResource(m.resource, err)
+			continue
+		}
+		args = append(args, margs...)
+		proceeding = append(proceeding, i)
+	}
+	if len(proceeding) == 0 {
+		return results
+	}
+	e, _ := j.resource.Exec()
+	cmd, _ := e.Command()
+	err := j.runCommand(ctx, cmd, args)
+	if err != nil {
+		err = errorf("batch command: %v", err)
+	}
+	for _, i := range proceeding {
+		results[i].changed = err == nil
+		results[i].err = errorWithResource(all[i].resource, err)
+	}
+	return results
+}
+
+// evalExecCondition evaluates an exec resource's condition, filling in
+// t with the probe that was run or a description of the outcome.
+func (j *job) evalExecCondition(ctx context.Context, cond catalog.Exec_condition, t *ConditionTrace) (proceed bool, err error) {
 	switch cond.Which() {
 	case catalog.Exec_condition_Which_always:
 		return true, nil
@@ -439,27 +1172,29 @@ func (j *job) evalExecCondition(ctx context.Context, cond catalog.Exec_condition
 		if err != nil {
 			return false, err
 		}
-		return j.runCondition(ctx, c)
+		return j.runCondition(ctx, c, t)
 	case catalog.Exec_condition_Which_unless:
 		c, err := cond.Unless()
 		if err != nil {
 			return false, err
 		}
-		success, err := j.runCondition(ctx, c)
+		success, err := j.runCondition(ctx, c, t)
 		if err != nil {
 			return false, err
 		}
 		return !success, nil
 	case catalog.Exec_condition_Which_fileAbsent:
 		path, _ := cond.FileAbsent()
-		_, err := j.sys.Lstat(ctx, path)
+		exists, err := j.pathExists(ctx, path)
 		if err != nil {
-			if os.IsNotExist(err) {
-				return true, nil
-			}
 			return false, err
 		}
-		return false, nil
+		if exists {
+			t.Detail = path + " exists"
+		} else {
+			t.Detail = path + " does not exist"
+		}
+		return !exists, nil
 	case catalog.Exec_condition_Which_ifDepsChanged:
 		deps, err := cond.IfDepsChanged()
 		if err != nil {
@@ -477,43 +1212,242 @@ func (j *job) evalExecCondition(ctx context.Context, cond catalog.Exec_condition
 		}
 		for i := 0; i < n; i++ {
 			if j.depsChanged[deps.At(i)] {
+				t.Detail = fmt.Sprintf("dependency %d changed", deps.At(i))
 				return true, nil
 			}
 		}
+		t.Detail = "no listed dependency changed"
 		return false, nil
+	case catalog.Exec_condition_Which_healthy:
+		hc, err := cond.Healthy()
+		if err != nil {
+			return false, err
+		}
+		unhealthy, err := j.healthCheck(ctx, hc)
+		if err != nil {
+			return false, err
+		}
+		if unhealthy != nil {
+			t.Detail = unhealthy.Error()
+		} else {
+			t.Detail = "healthy"
+		}
+		return unhealthy == nil, nil
+	case catalog.Exec_condition_Which_until:
+		u, err := cond.Until()
+		if err != nil {
+			return false, err
+		}
+		if err := j.until(ctx, u, t); err != nil {
+			return false, err
+		}
+		return true, nil
 	default:
 		return false, errorf("unknown condition %v", cond.Which())
 	}
 }
 
-func (j *job) runCommand(ctx context.Context, c catalog.Exec_Command) error {
-	cmd, err := buildCommand(c, j.bashPath)
+// pathExists reports whether path exists, without following a
+// symlink at path.
+func (j *job) pathExists(ctx context.Context, path string) (bool, error) {
+	_, err := j.sys.Lstat(ctx, path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// runCommand runs c with extra arguments appended.
+func (j *job) runCommand(ctx context.Context, c catalog.Exec_Command, extra []string) error {
+	cmd, err := j.prepareCommand(ctx, c)
 	if err != nil {
 		return err
 	}
+	cmd.Args = append(cmd.Args, extra...)
 	out, err := j.sys.Run(ctx, cmd)
+	j.teeOutput(ctx, cmd, out, err)
 	if err != nil {
-		return errorWithOutput(out, err)
+		return errorWithOutput(out, j.maxOutput, err)
 	}
+	j.logOutput(ctx, out)
+	return j.keep(out)
+}
+
+// keep saves the output of the resource's command for the files that
+// take their content from it.
+func (j *job) keep(out []byte) error {
+	if !j.keepOutput {
+		return nil
+	}
+	if j.maxOutput > 0 && len(out) > j.maxOutput {
+		// The middle of the output was dropped.
+		return errorf("output is over the limit of %d bytes, so it can't be used as file content", j.maxOutput)
+	}
+	j.output, j.ran = out, true
 	return nil
 }
 
-func (j *job) runCondition(ctx context.Context, c catalog.Exec_Command) (success bool, err error) {
-	cmd, err := buildCommand(c, j.bashPath)
+// logOutput logs the output of a command that did not produce an error.
+func (j *job) logOutput(ctx context.Context, out []byte) {
+	if len(out) == 0 {
+		return
+	}
+	out = system.LimitOutput(out, j.maxOutput)
+	debugf(j.log, ctx, VeryVerbose, "%s: output:\n%s", formatResource(j.resource), out)
+}
+
+// runCondition runs a command whose exit status is a condition.  If t
+// is not nil, then the command and its outcome are recorded in it.
+func (j *job) runCondition(ctx context.Context, c catalog.Exec_Command, t *ConditionTrace) (success bool, err error) {
+	cmd, err := j.prepareCommand(ctx, c)
 	if err != nil {
 		return false, err
 	}
 	out, err := j.sys.Run(ctx, cmd)
+	if t != nil {
+		t.recordProbe(cmd, out, err)
+	}
 	if _, fail := err.(*exec.ExitError); fail {
+		j.logOutput(ctx, out)
 		return false, nil
 	}
 	if err != nil {
-		return false, errorWithOutput(out, err)
+		return false, errorWithOutput(out, j.maxOutput, err)
 	}
+	j.logOutput(ctx, out)
 	return true, nil
 }
 
-func buildCommand(cmd catalog.Exec_Command, bashPath string) (*system.Cmd, error) {
+// runProgram runs a program with the given arguments, where args[0]
+// is the program's path.  A non-zero exit status is an error.
+func (j *job) runProgram(ctx context.Context, args ...string) ([]byte, error) {
+	out, err := j.sys.Run(ctx, &system.Cmd{Path: args[0], Args: args, MaxOutput: j.maxOutput})
+	if err != nil {
+		return nil, errorWithOutput(out, j.maxOutput, errorf("%s: %v", strings.Join(args, " "), err))
+	}
+	j.logOutput(ctx, out)
+	return out, nil
+}
+
+// probeProgram runs a program like runProgram, but reports a non-zero
+// exit status as success = false instead of an error.
+func (j *job) probeProgram(ctx context.Context, args ...string) (out []byte, success bool, err error) {
+	out, err = j.sys.Run(ctx, &system.Cmd{Path: args[0], Args: args, MaxOutput: j.maxOutput})
+	if _, fail := err.(*exec.ExitError); fail {
+		j.logOutput(ctx, out)
+		return out, false, nil
+	}
+	if err != nil {
+		return nil, false, errorWithOutput(out, j.maxOutput, errorf("%s: %v", strings.Join(args, " "), err))
+	}
+	j.logOutput(ctx, out)
+	return out, true, nil
+}
+
+// prepareCommand converts a catalog command into a system command,
+// performing any steps needed before the command is run.
+func (j *job) prepareCommand(ctx context.Context, c catalog.Exec_Command) (*system.Cmd, error) {
+	cmd, err := buildCommand(c, j.bashPath, j.vars)
+	if err != nil {
+		return nil, err
+	}
+	cmd.MaxOutput = j.maxOutput
+	if err := j.resolveSecrets(ctx, c, cmd.Env); err != nil {
+		return nil, err
+	}
+	cmd.Env = mergeEnv(j.env, cmd.Env)
+	if c.Which() == catalog.Exec_Command_Which_argv && !filepath.IsAbs(cmd.Path) {
+		pathList, _ := lookupEnv(cmd.Env, "PATH")
+		cmd.Path, err = j.sys.LookPath(ctx, cmd.Path, pathList)
+		if err != nil {
+			return nil, errorf("look up %s: %v", cmd.Args[0], err)
+		}
+	}
+	if err := j.createWorkingDirectory(ctx, c, cmd.Dir); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// lookupEnv finds the value of a variable in a list of "key=value"
+// strings.
+func lookupEnv(env []string, key string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], key) && len(env[i]) > len(key) && env[i][len(key)] == '=' {
+			return env[i][len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+// createWorkingDirectory creates the command's working directory if the
+// command requests it.
+func (j *job) createWorkingDirectory(ctx context.Context, c catalog.Exec_Command, dir string) error {
+	if !c.CreateWorkingDirectory() {
+		return nil
+	}
+	created, err := j.mkdirAll(ctx, dir)
+	if err != nil {
+		return errorf("create working directory: %v", err)
+	}
+	if !created {
+		return nil
+	}
+	mode, _ := c.WorkingDirectoryMode()
+	if _, err := j.fileMode(ctx, dir, mode); err != nil {
+		return errorf("create working directory: %v", err)
+	}
+	return nil
+}
+
+// mkdirAll creates a directory along with any missing parents.  It
+// reports whether path itself was created.
+func (j *job) mkdirAll(ctx context.Context, path string) (created bool, err error) {
+	info, err := j.sys.Lstat(ctx, path)
+	if err == nil {
+		// Symlinks are assumed to point to directories: if not, then
+		// the command will fail to start.
+		if !info.IsDir() && info.Mode()&os.ModeType != os.ModeSymlink {
+			return false, errorf("%s is not a directory", path)
+		}
+		return false, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if _, err := j.mkdirAll(ctx, parent); err != nil {
+			return false, err
+		}
+	}
+	err = j.sys.Mkdir(ctx, path, 0777) // rely on umask to restrict
+	if os.IsExist(err) {
+		// Created concurrently by another resource.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := j.applyUmask(ctx, path, catalog.File_Mode_unset, 0777); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// isBareName reports whether name is a program name without any
+// directory components.
+func isBareName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/`+string(filepath.Separator))
+}
+
+// buildCommand converts a catalog command into a system command.  If
+// the command sets expand, then references in its arguments and
+// environment are replaced with vars.  Secret environment variables
+// are left empty: prepareCommand fills them in.
+func buildCommand(cmd catalog.Exec_Command, bashPath string, vars map[string]string) (*system.Cmd, error) {
 	var c *system.Cmd
 	switch cmd.Which() {
 	case catalog.Exec_Command_Which_argv:
@@ -528,8 +1462,13 @@ func buildCommand(cmd catalog.Exec_Command, bashPath string) (*system.Cmd, error
 			if err != nil {
 				return nil, errorf("argv[%d]: %v", i, err)
 			}
+			if cmd.Expand() {
+				if argv[i], err = expandVars(argv[i], vars); err != nil {
+					return nil, errorf("argv[%d]: %v", i, err)
+				}
+			}
 		}
-		if !filepath.IsAbs(argv[0]) {
+		if !filepath.IsAbs(argv[0]) && !(cmd.LookPath() && isBareName(argv[0])) {
 			return nil, errorf("argv[0] (%q) is not an absolute path", argv[0])
 		}
 		c = &system.Cmd{
@@ -561,6 +1500,17 @@ func buildCommand(cmd catalog.Exec_Command, bashPath string) (*system.Cmd, error
 			return nil, errorf("environment[%d] missing name", i)
 		}
 		v, _ := ei.ValueBytes()
+		if ei.HasSecret() {
+			if len(v) > 0 {
+				return nil, errorf("environment[%d] (%s) has both a value and a secret", i, k)
+			}
+		} else if cmd.Expand() {
+			ev, err := expandVars(string(v), vars)
+			if err != nil {
+				return nil, errorf("environment[%d] (%s): %v", i, k, err)
+			}
+			v = []byte(ev)
+		}
 		buf := make([]byte, 0, len(k)+len(v)+1)
 		buf = append(buf, k...)
 		buf = append(buf, '=')
@@ -575,5 +1525,46 @@ func buildCommand(cmd catalog.Exec_Command, bashPath string) (*system.Cmd, error
 		return nil, errorf("working directory %q is not absolute", c.Dir)
 	}
 
+	sched, err := commandSched(cmd)
+	if err != nil {
+		return nil, err
+	}
+	c.Sched = sched
 	return c, nil
 }
+
+// commandSched returns the scheduling settings of cmd, or nil if it
+// leaves them all inherited.
+func commandSched(cmd catalog.Exec_Command) (*system.Sched, error) {
+	s := &system.Sched{
+		Nice:        int(cmd.Nice()),
+		IOLevel:     int(cmd.IoLevel()),
+		OOMScoreAdj: int(cmd.OomScoreAdj()),
+	}
+	if s.Nice < -20 || s.Nice > 19 {
+		return nil, errorf("nice %d out of range [-20, 19]", s.Nice)
+	}
+	switch cmd.IoClass() {
+	case catalog.Exec_Command_IoClass_unset:
+		s.IOLevel = 0
+	case catalog.Exec_Command_IoClass_realtime:
+		s.IOClass = system.IOClassRealtime
+	case catalog.Exec_Command_IoClass_bestEffort:
+		s.IOClass = system.IOClassBestEffort
+	case catalog.Exec_Command_IoClass_idle:
+		s.IOClass = system.IOClassIdle
+		s.IOLevel = 0
+	default:
+		return nil, errorf("unknown I/O class %v", cmd.IoClass())
+	}
+	if s.IOLevel > 7 {
+		return nil, errorf("I/O level %d out of range [0, 7]", s.IOLevel)
+	}
+	if s.OOMScoreAdj < -1000 || s.OOMScoreAdj > 1000 {
+		return nil, errorf("oom score adjustment %d out of range [-1000, 1000]", s.OOMScoreAdj)
+	}
+	if *s == (system.Sched{}) {
+		return nil, nil
+	}
+	return s, nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// assertDialTimeout is how long an assertion waits for a TCP
+// connection.
+const assertDialTimeout = 10 * time.Second
+
+// assert checks an assertion without changing the system.  If the
+// assertion does not hold, then violation describes how.  err is only
+// returned if the assertion could not be checked.
+func (j *job) assert(ctx context.Context, a catalog.Assert) (violation error, err error) {
+	switch a.Which() {
+	case catalog.Assert_Which_fileExists:
+		path, err := a.FileExists()
+		if err != nil {
+			return nil, errorf("read path: %v", err)
+		}
+		if path == "" {
+			return nil, errorf("empty path")
+		}
+		exists, err := j.pathExists(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			violation = errorf("%s does not exist", path)
+		}
+	case catalog.Assert_Which_fileHash:
+		fh, err := a.FileHash()
+		if err != nil {
+			return nil, errorf("read file hash: %v", err)
+		}
+		violation, err = j.assertFileHash(ctx, fh)
+		if err != nil {
+			return nil, err
+		}
+	case catalog.Assert_Which_command:
+		c, err := a.Command()
+		if err != nil {
+			return nil, errorf("read command: %v", err)
+		}
+		cmd, err := j.prepareCommand(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		out, err := j.sys.Run(ctx, cmd)
+		if _, fail := err.(*exec.ExitError); fail {
+			violation = errorWithOutput(out, j.maxOutput, errorf("command: %v", err))
+		} else if err != nil {
+			return nil, errorWithOutput(out, j.maxOutput, err)
+		} else {
+			j.logOutput(ctx, out)
+		}
+	case catalog.Assert_Which_tcpAddress:
+		addr, err := a.TcpAddress()
+		if err != nil {
+			return nil, errorf("read address: %v", err)
+		}
+		if addr == "" {
+			return nil, errorf("empty TCP address")
+		}
+		d, ok := j.sys.(system.Dialer)
+		if !ok {
+			return nil, errorf("system cannot check network services")
+		}
+		dialCtx, cancel := context.WithTimeout(ctx, assertDialTimeout)
+		conn, err := d.DialContext(dialCtx, "tcp", addr)
+		cancel()
+		if err != nil {
+			violation = errorf("connect to %s: %v", addr, err)
+		} else {
+			conn.Close()
+		}
+	default:
+		return nil, errorf("unknown assertion %v", a.Which())
+	}
+	if violation == nil {
+		return nil, nil
+	}
+	msg, err := a.Message()
+	if err != nil {
+		return nil, errorf("read message: %v", err)
+	}
+	if msg != "" {
+		return errorf("assertion failed: %s: %v", msg, violation), nil
+	}
+	return errorf("assertion failed: %v", violation), nil
+}
+
+func (j *job) assertFileHash(ctx context.Context, fh catalog.Assert_FileHash) (violation error, err error) {
+	path, err := fh.Path()
+	if err != nil {
+		return nil, errorf("read path: %v", err)
+	}
+	if path == "" {
+		return nil, errorf("empty path")
+	}
+	want, err := fh.Sha256()
+	if err != nil {
+		return nil, errorf("read hash: %v", err)
+	}
+	if b, err := hex.DecodeString(want); err != nil || len(b) != sha256.Size {
+		return nil, errorf("sha256 %q is not a hex-encoded SHA-256 hash", want)
+	}
+	f, err := j.sys.OpenFile(ctx, path)
+	if os.IsNotExist(err) {
+		return errorf("%s does not exist", path), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, errorf("read %s: %v", path, err)
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(got, want) {
+		return errorf("%s has sha256 %s, want %s", path, got, strings.ToLower(want)), nil
+	}
+	return nil, nil
+}
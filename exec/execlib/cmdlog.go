@@ -0,0 +1,85 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// teeOutput writes the output of the resource's command to its log
+// file in the command log directory, if there is one.  runErr is the
+// error that running the command returned.  A log that can't be
+// written is a warning, since the command has already run.
+func (j *job) teeOutput(ctx context.Context, cmd *system.Cmd, out []byte, runErr error) {
+	if j.cmdLogDir == "" {
+		return
+	}
+	if err := j.writeCommandLog(ctx, cmd, out, runErr); err != nil {
+		j.warnf("command log: %v", err)
+	}
+}
+
+func (j *job) writeCommandLog(ctx context.Context, cmd *system.Cmd, out []byte, runErr error) error {
+	if _, err := j.mkdirAll(ctx, j.cmdLogDir); err != nil {
+		return err
+	}
+	path := filepath.Join(j.cmdLogDir, fmt.Sprintf("%d.log", j.resource.ID()))
+	if err := j.rotateCommandLogs(ctx, path); err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# %s %s\n", j.now().UTC().Format(time.RFC3339), formatResource(j.resource))
+	fmt.Fprintf(buf, "# %q\n", cmd.Args)
+	buf.Write(out)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	if runErr != nil {
+		fmt.Fprintf(buf, "# %v\n", runErr)
+	} else {
+		buf.WriteString("# exit status 0\n")
+	}
+	return system.WriteFile(ctx, j.sys, path, buf.Bytes(), 0600)
+}
+
+// rotateCommandLogs renames the log at path to path.1, path.1 to path.2,
+// and so on, dropping the logs past the number of logs kept.
+func (j *job) rotateCommandLogs(ctx context.Context, path string) error {
+	if j.cmdLogsKept <= 0 {
+		return nil
+	}
+	r, ok := j.sys.(system.Renamer)
+	if !ok {
+		return errorf("system cannot rename files")
+	}
+	for i := j.cmdLogsKept; i > 0; i-- {
+		src := path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", path, i-1)
+		}
+		err := r.Rename(ctx, src, fmt.Sprintf("%s.%d", path, i))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"path"
+	"strings"
+)
+
+// DefaultEnvironment is a base environment for commands that pins the
+// locale and time zone, so that the output of commands, like dates and
+// sorted lists, doesn't depend on the settings of whoever started the
+// applier.  See Options.Environment.
+var DefaultEnvironment = []string{"LANG=C", "TZ=UTC"}
+
+// DefaultScrubPatterns matches the variables that ScrubEnvironment
+// removes by default: the locale and time zone, which change the
+// output of many commands, and proxy settings, which change where
+// downloads go.
+var DefaultScrubPatterns = []string{
+	"LANG",
+	"LANGUAGE",
+	"LC_*",
+	"TZ",
+	"*_proxy",
+	"*_PROXY",
+}
+
+// ScrubEnvironment returns the "key=value" strings in env whose names
+// don't match any of patterns, which use path.Match syntax.  env is not
+// modified.
+func ScrubEnvironment(env []string, patterns []string) []string {
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		if !matchAny(patterns, name) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeEnv returns base followed by env, leaving out the variables in
+// base that env sets, so a command's own variables take precedence.
+func mergeEnv(base, env []string) []string {
+	if len(base) == 0 {
+		return env
+	}
+	merged := make([]string, 0, len(base)+len(env))
+	for _, kv := range base {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		if _, set := lookupEnv(env, name); !set {
+			merged = append(merged, kv)
+		}
+	}
+	return append(merged, env...)
+}
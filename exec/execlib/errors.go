@@ -18,13 +18,21 @@ import (
 	"fmt"
 
 	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
 )
 
 type Error struct {
 	ResourceID      uint64
+	ResourceName    string
 	ResourceComment string
 	Err             error
 	Output          []byte
+
+	// ResourceOwner and ResourceDocURL are the resource's owner and
+	// docUrl from the catalog, so that whoever sees the error knows who
+	// to contact and where the runbook is.
+	ResourceOwner  string
+	ResourceDocURL string
 }
 
 func newError(e error) *Error {
@@ -65,10 +73,24 @@ func (e *Error) Error() string {
 	if e.ResourceID == 0 {
 		return e.Err.Error()
 	}
-	if e.ResourceComment == "" {
-		return fmt.Sprintf("apply id=%d: %v", e.ResourceID, e.Err)
+	var msg string
+	switch {
+	case e.ResourceName != "":
+		msg = fmt.Sprintf("apply %s: %v", e.ResourceName, e.Err)
+	case e.ResourceComment == "":
+		msg = fmt.Sprintf("apply id=%d: %v", e.ResourceID, e.Err)
+	default:
+		msg = fmt.Sprintf("apply %s (id=%d): %v", e.ResourceComment, e.ResourceID, e.Err)
+	}
+	switch {
+	case e.ResourceOwner != "" && e.ResourceDocURL != "":
+		msg += fmt.Sprintf(" [owner: %s, docs: %s]", e.ResourceOwner, e.ResourceDocURL)
+	case e.ResourceOwner != "":
+		msg += fmt.Sprintf(" [owner: %s]", e.ResourceOwner)
+	case e.ResourceDocURL != "":
+		msg += fmt.Sprintf(" [docs: %s]", e.ResourceDocURL)
 	}
-	return fmt.Sprintf("apply %s (id=%d): %v", e.ResourceComment, e.ResourceID, e.Err)
+	return msg
 }
 
 func errorWithResource(r catalog.Resource, err error) error {
@@ -77,15 +99,20 @@ func errorWithResource(r catalog.Resource, err error) error {
 	}
 	e := newError(err)
 	e.ResourceID = r.ID()
+	e.ResourceName, _ = r.Name()
 	e.ResourceComment, _ = r.Comment()
+	e.ResourceOwner, _ = r.Owner()
+	e.ResourceDocURL, _ = r.DocUrl()
 	return e
 }
 
-func errorWithOutput(out []byte, err error) error {
+// errorWithOutput attaches a command's output to err.  The output is
+// limited to max bytes, since not every Runner honors Cmd.MaxOutput.
+func errorWithOutput(out []byte, max int, err error) error {
 	if err == nil {
 		return nil
 	}
 	e := newError(err)
-	e.Output = out
+	e.Output = system.LimitOutput(out, max)
 	return e
 }
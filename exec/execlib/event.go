@@ -0,0 +1,79 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// An Event describes what a log message passed to a Logger is about.
+// Loggers that produce structured output can retrieve it with
+// EventFromContext.
+type Event struct {
+	Kind            EventKind
+	ResourceID      uint64
+	ResourceName    string
+	ResourceComment string
+
+	// SpanID identifies the resource's application within the run
+	// (see RunIDFromContext).  It is also recorded in the resource's
+	// ResourceReport.
+	SpanID string
+
+	// Warning is the message for EventWarning.
+	Warning string
+
+	// Status is set for EventResult and EventError.  Duration is set
+	// for those and EventSlow.
+	Status   ResourceStatus
+	Duration time.Duration
+
+	// Skipped is the list of resources skipped because of the
+	// resource's failure for EventSkip.
+	Skipped []uint64
+}
+
+// EventKind is the type of an Event.
+type EventKind string
+
+// Event kinds.
+const (
+	EventStart   EventKind = "start"
+	EventResult  EventKind = "result"
+	EventSkip    EventKind = "skip"
+	EventSlow    EventKind = "slow"
+	EventError   EventKind = "error"
+	EventWarning EventKind = "warning"
+)
+
+type eventKey struct{}
+
+// EventFromContext returns the event attached to a context passed to a
+// Logger method.  It returns nil if the message is not about a
+// particular resource.
+func EventFromContext(ctx context.Context) *Event {
+	ev, _ := ctx.Value(eventKey{}).(*Event)
+	return ev
+}
+
+func withEvent(ctx context.Context, kind EventKind, r catalog.Resource, span string) (context.Context, *Event) {
+	ev := &Event{Kind: kind, ResourceID: r.ID(), SpanID: span}
+	ev.ResourceName, _ = r.Name()
+	ev.ResourceComment, _ = r.Comment()
+	return context.WithValue(ctx, eventKey{}, ev), ev
+}
@@ -18,28 +18,214 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/zombiezen/mcm/catalog"
 	"github.com/zombiezen/mcm/internal/depgraph"
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/internal/state"
 	"github.com/zombiezen/mcm/internal/system"
 )
 
 // Apply changes a system match the resources in a catalog.
 // Passing nil options is the same as passing the zero value.
+// The catalog's structure is validated, its variant resources are
+// selected using opts.Vars (see catalog.SelectVariants), its file
+// resources are checked for conflicts (see catalog.CheckConflicts), and
+// its preconditions are checked against sys before anything is applied.
 func Apply(ctx context.Context, sys system.System, c catalog.Catalog, opts *Options) error {
+	opts = opts.normalize()
+	if err := catalog.ValidateStructure(c, opts.Limits); err != nil {
+		return toError(err)
+	}
+	c, err := catalog.SelectVariants(c, opts.Vars)
+	if err != nil {
+		return toError(err)
+	}
+	c, err = catalog.ExpandDefaults(c)
+	if err != nil {
+		return toError(err)
+	}
+	if err := checkConflicts(ctx, opts, c); err != nil {
+		return err
+	}
+	if err := checkPreconditions(ctx, sys, c); err != nil {
+		return err
+	}
+	opts, cleanup, err := makeScratchDir(ctx, sys, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 	res, _ := c.Resources()
 	g, err := depgraph.New(res)
 	if err != nil {
 		return toError(err)
 	}
-	if err = apply(ctx, cacheUserLookups(sys), g, opts.normalize()); err != nil {
+	prov := catalogProvenance(c)
+	if prov != nil {
+		opts.Log.Infof(ctx, "catalog: %v", prov)
+	}
+	err = applyGraph(ctx, sys, g, opts)
+	if opts.Report != nil && prov != nil {
+		opts.Report.Provenance = []*Provenance{prov}
+	}
+	return err
+}
+
+// ApplyAll applies several catalogs in order as a single run, such as a
+// base catalog followed by role and host catalogs.  Every catalog is
+// checked before any are applied, and conflicts are checked across all
+// of the catalogs.  If a catalog does not apply cleanly, then the
+// catalogs after it are not applied and their resources are reported
+// as skipped.  The report covers the whole run, and each resource
+// report's Catalog is the index of its catalog in cats.  The
+// preconditions of every catalog must be met before any are applied.
+func ApplyAll(ctx context.Context, sys system.System, cats []catalog.Catalog, opts *Options) error {
+	opts = opts.normalize()
+	graphs := make([]*depgraph.Graph, len(cats))
+	// Don't replace the caller's catalogs with their expansions.
+	cats = append([]catalog.Catalog(nil), cats...)
+	for i, c := range cats {
+		if err := catalog.ValidateStructure(c, opts.Limits); err != nil {
+			return errorf("catalog %d: %v", i, err)
+		}
+		c, err := catalog.SelectVariants(c, opts.Vars)
+		if err != nil {
+			return errorf("catalog %d: %v", i, err)
+		}
+		c, err = catalog.ExpandDefaults(c)
+		if err != nil {
+			return errorf("catalog %d: %v", i, err)
+		}
+		cats[i] = c
+		res, _ := c.Resources()
+		graphs[i], err = depgraph.New(res)
+		if err != nil {
+			return errorf("catalog %d: %v", i, err)
+		}
+	}
+	if err := checkConflicts(ctx, opts, cats...); err != nil {
+		return err
+	}
+	if err := checkPreconditions(ctx, sys, cats...); err != nil {
+		return err
+	}
+	opts, cleanup, err := makeScratchDir(ctx, sys, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	provs := make([]*Provenance, len(cats))
+	hasProv := false
+	for i, c := range cats {
+		provs[i] = catalogProvenance(c)
+		if provs[i] != nil {
+			hasProv = true
+			opts.Log.Infof(ctx, "catalog %d: %v", i, provs[i])
+		}
+	}
+	if !hasProv {
+		provs = nil
+	}
+	report := opts.Report
+	if report != nil {
+		now := clock(sys)
+		*report = Report{Start: now(), RunID: opts.RunID, Seed: opts.Seed, Provenance: provs}
+		defer func() {
+			report.End = now()
+			report.Summary = report.Summarize()
+		}()
+	}
+	var firstErr error
+	for i, c := range cats {
+		if firstErr != nil {
+			if report != nil {
+				reportSkipped(report, i, c)
+			}
+			continue
+		}
+		catOpts := new(Options)
+		*catOpts = *opts
+		if veto := opts.Veto; veto != nil {
+			i := i
+			catOpts.Veto = func(_ int, r catalog.Resource) string { return veto(i, r) }
+		}
+		if report != nil {
+			catOpts.Report = new(Report)
+		}
+		firstErr = applyGraph(ctx, sys, graphs[i], catOpts)
+		if report != nil {
+			for _, rr := range catOpts.Report.Resources {
+				rr.Catalog = i
+				report.Resources = append(report.Resources, rr)
+			}
+			report.Pending = append(report.Pending, catOpts.Report.Pending...)
+			if req := catOpts.Report.Reboot; req != nil {
+				if report.Reboot == nil {
+					report.Reboot = new(RebootRequest)
+				}
+				report.Reboot.merge(req)
+			}
+		}
+		if firstErr != nil && len(cats) > 1 {
+			firstErr = errorf("catalog %d: %v", i, firstErr)
+		}
+	}
+	return firstErr
+}
+
+func applyGraph(ctx context.Context, sys system.System, g *depgraph.Graph, opts *Options) error {
+	if opts.Umask != nil {
+		if u, ok := sys.(system.Umasker); ok {
+			old := u.Umask(*opts.Umask)
+			defer u.Umask(old)
+		}
+	}
+	if err := apply(ctx, cacheUserLookups(sys), clock(sys), g, opts); err != nil {
+		return toError(err)
+	}
+	return nil
+}
+
+// checkConflicts returns an error if file resources in cats conflict,
+// or logs a warning if opts.AllowConflicts is set and opts.Strict is
+// not.
+func checkConflicts(ctx context.Context, opts *Options, cats ...catalog.Catalog) error {
+	err := catalog.CheckConflicts(cats...)
+	if err == nil {
+		return nil
+	}
+	if !opts.AllowConflicts || opts.Strict {
 		return toError(err)
 	}
+	opts.Log.Infof(ctx, "warning: %v", err)
 	return nil
 }
 
+// reportSkipped adds every resource in the catalog at index i to the
+// report as skipped.
+func reportSkipped(report *Report, i int, c catalog.Catalog) {
+	res, _ := c.Resources()
+	for j := 0; j < res.Len(); j++ {
+		r := res.At(j)
+		rr := &ResourceReport{
+			ID:      r.ID(),
+			Catalog: i,
+			Status:  StatusSkipped,
+			SpanID:  newSpanID(),
+		}
+		rr.Name, _ = r.Name()
+		rr.Comment, _ = r.Comment()
+		report.Resources = append(report.Resources, rr)
+	}
+}
+
 // Options is the set of optional parameters for Apply.  The zero value
 // is the default set of options.
 type Options struct {
@@ -53,15 +239,191 @@ type Options struct {
 	// ConcurrentJobs is the number of resources to apply simultaneously.
 	// If non-positive, then it assumes 1.
 	ConcurrentJobs int
+
+	// AllowConflicts logs conflicting file resources as a warning
+	// instead of refusing to apply the catalog.
+	AllowConflicts bool
+
+	// Report will be filled in with the outcome of each resource if
+	// non-nil.  Any previous contents are discarded.  If sys is a
+	// system.Clock, then times and durations are measured with it.
+	Report *Report
+
+	// State is used to track how long each resource takes to apply if
+	// non-nil.  A resource that takes more than SlowFactor times its
+	// average is logged.  If SlowFactor is non-positive, then it
+	// assumes DefaultSlowFactor.  The hashes of large files are also
+	// kept in State, so that files that haven't changed since the last
+	// run aren't read again to compare their content.
+	State      *state.State
+	SlowFactor float64
+
+	// FastHash hashes file content with xxHash instead of SHA-256 for
+	// the hashes kept in State.  xxHash is much faster, but it is not
+	// cryptographic, so it is only used to detect changes to files that
+	// mcm-exec manages; assertions and audit logs still use SHA-256.
+	FastHash bool
+
+	// Umask is the file creation mask to use for the run if non-nil.
+	// If sys is a system.Umasker, then the mask is set for the duration
+	// of Apply, so it also applies to commands that are run.  Files
+	// created without explicit permission bits are given the default
+	// permissions minus Umask, even if sys does not honor the mask.
+	// Permission bits from the catalog are applied exactly, regardless
+	// of any umask.  If Umask is nil, then the inherited mask is used.
+	Umask *os.FileMode
+
+	// Vars are the variables that exec commands with expand set can
+	// refer to as ${name}, such as the host's facts from
+	// facts.Facts.Vars.  They also select the cases of variant
+	// resources.
+	Vars map[string]string
+
+	// MaxOutput is the maximum number of bytes of output kept from each
+	// command.  Output beyond the limit is dropped from the middle, so
+	// the beginning and end are kept.  If zero, then Apply uses
+	// DefaultMaxOutput.  If negative, then output is not limited.
+	MaxOutput int
+
+	// CriticalPath changes the order in which ready resources are
+	// started.  Normally, ready resources start in catalog order.  If
+	// CriticalPath is true, then resources on the longest remaining
+	// chain of dependents start first.  Chains are measured with the
+	// average durations in State if available; resources without any
+	// history count as the mean of those with it.
+	CriticalPath bool
+
+	// Seed shuffles the order in which ready resources are started, to
+	// shake out missing dependencies.  If zero, then ties keep catalog
+	// order.  Otherwise, ties are broken by a hash of Seed and the
+	// resource ID, so the same seed always starts resources in the same
+	// order.  The seed is saved in the Report.
+	Seed int64
+
+	// TagLimits is the maximum number of resources with each tag to
+	// apply at once, such as 1 for a tag given to package manager
+	// resources that can't run concurrently.  Resources with tags that
+	// aren't in TagLimits are only limited by ConcurrentJobs.  Limits
+	// less than 1 are treated as 1.  A batch of exec resources counts
+	// as one resource.
+	TagLimits map[string]int
+
+	// MemoryLimit is the number of bytes that the resources being
+	// applied at once may use for file content and command output, if
+	// positive.  Each resource's use is estimated before it starts: the
+	// size of a file copied from a contentPath or replaced by a
+	// download, or MaxOutput for an exec command.  A resource isn't
+	// started while it would take the total past the limit, unless no
+	// other resources are running, so devices with little memory can
+	// use a high ConcurrentJobs without running out.
+	MemoryLimit int64
+
+	// Strict fails resources that have warnings, such as a file whose
+	// content drifted since the last run, instead of logging the
+	// warnings and applying them normally.  It also overrides
+	// AllowConflicts.  It is intended for validation runs in CI.
+	Strict bool
+
+	// RunID identifies the run in its Report and in the contexts passed
+	// to Log (see RunIDFromContext), so that logs gathered from many
+	// hosts can be traced back to a run.  If empty, then a random UUID
+	// is used.
+	RunID string
+
+	// Pauser pauses the run between resources if non-nil.  While it is
+	// paused, resources that have started finish, but no more are
+	// started.
+	Pauser *Pauser
+
+	// Supervisor keeps track of the processes started by supervised
+	// exec resources.  If nil, supervised exec resources fail.
+	Supervisor *Supervisor
+
+	// Downloader fetches the content of files that give a contentUrl.
+	// If nil, then a zero download.Downloader is used.
+	Downloader *download.Downloader
+
+	// SkipHealthChecks treats every health check as passing without
+	// dialing the service.  It is meant for dry runs, where the services
+	// that the checks wait for were never started.
+	SkipHealthChecks bool
+
+	// LockFiles takes an advisory lock on each existing plain file while
+	// its content is rewritten, so that cooperating processes that lock
+	// the file don't read or write it at the same time.  sys must be a
+	// system.Locker that supports locking, or the file resources fail.
+	LockFiles bool
+
+	// CredentialsDirectory is the directory that systemd put the
+	// applier's credentials in, from $CREDENTIALS_DIRECTORY.  Secret
+	// environment variables that name a systemd credential are read
+	// from it if the credential is there.  If empty, then systemd
+	// credentials are always decrypted with systemd-creds.
+	CredentialsDirectory string
+
+	// Environment is the base environment of every command that the
+	// catalog runs, as "key=value" strings.  A command's own variables
+	// replace base variables of the same name.  If empty, then commands
+	// only get the variables that the catalog gives them, since the
+	// applier's own environment is never passed on.  Callers that want
+	// commands to behave the same on every host should use
+	// DefaultEnvironment.
+	Environment []string
+
+	// ScratchDir is a directory in which each run creates a private
+	// scratch directory, if not empty, so that commands that need
+	// temporary space don't leave files behind in shared directories
+	// and can pass intermediate files to each other.  Every command
+	// gets the scratch directory's path in its environment as
+	// ScratchEnv.  The scratch directory is removed along with its
+	// contents once the run finishes, whether or not it succeeds.
+	// sys must be a system.DirReader.
+	ScratchDir string
+
+	// CommandLogDir is a directory to write the output of each exec
+	// resource's command to, if not empty, so that the output outlives
+	// Log.  The directory is created if it does not exist.  Each
+	// resource's log is named for its ID, like "42.log", and is
+	// replaced each time the command runs; a batch's output is logged
+	// under its first resource.  The log has the same limit as
+	// MaxOutput.  CommandLogsKept is the number of earlier logs to
+	// keep for each resource, as 42.log.1 (the newest) through
+	// 42.log.N, which requires sys to be a system.Renamer.
+	CommandLogDir   string
+	CommandLogsKept int
+
+	// Limits bounds the size of catalogs that Apply accepts.  If nil,
+	// then catalog.DefaultLimits is used.
+	Limits *catalog.Limits
+
+	// Veto is called before each resource is applied, if non-nil.  If
+	// it returns a non-empty reason, then the resource fails with that
+	// reason instead of being applied, and its dependents are skipped.
+	// cat is the index of the resource's catalog in a run of ApplyAll,
+	// and is always zero for Apply.
+	Veto func(cat int, r catalog.Resource) (reason string)
 }
 
+// DefaultMaxOutput is the default value of Options.MaxOutput.
+const DefaultMaxOutput = 1 << 20
+
+// DefaultSlowFactor is the default value of Options.SlowFactor.
+const DefaultSlowFactor = 3
+
+// Resources are only reported as slow once they have enough samples and
+// take a noticeable amount of time.
+const (
+	minSlowSamples  = 3
+	minSlowDuration = 100 * time.Millisecond
+)
+
 // normalize will return a Options struct that is equivalent to opts.
 // It will never return nil, and it may return opts.
 func (opts *Options) normalize() *Options {
 	if opts == nil {
-		return &Options{Log: nullLogger{}}
+		opts = new(Options)
 	}
-	if opts.Log != nil && opts.Bash != "" && opts.ConcurrentJobs >= 1 {
+	if opts.Log != nil && opts.Bash != "" && opts.ConcurrentJobs >= 1 && opts.SlowFactor > 0 && opts.MaxOutput != 0 && opts.RunID != "" {
 		return opts
 	}
 	newOpts := new(Options)
@@ -72,9 +434,18 @@ func (opts *Options) normalize() *Options {
 	if newOpts.Bash == "" {
 		newOpts.Bash = DefaultBashPath
 	}
+	if newOpts.SlowFactor <= 0 {
+		newOpts.SlowFactor = DefaultSlowFactor
+	}
 	if newOpts.ConcurrentJobs < 1 {
 		newOpts.ConcurrentJobs = 1
 	}
+	if newOpts.MaxOutput == 0 {
+		newOpts.MaxOutput = DefaultMaxOutput
+	}
+	if newOpts.RunID == "" {
+		newOpts.RunID = newRunID()
+	}
 	return newOpts
 }
 
@@ -88,6 +459,35 @@ type Logger interface {
 	Error(ctx context.Context, err error)
 }
 
+// Verbosity is the level of detail of a log message.  Higher levels
+// are more detailed.
+type Verbosity int
+
+// Verbosity levels above the messages sent to Logger.Infof.
+const (
+	// Verbose messages report resources that did not change and the
+	// outcome of exec conditions.
+	Verbose Verbosity = 1
+
+	// VeryVerbose messages include the output of commands that did not
+	// fail the resource, including conditions.
+	VeryVerbose Verbosity = 2
+)
+
+// A LeveledLogger is a Logger that can also receive messages more
+// detailed than Infof.  If Options.Log implements LeveledLogger, then
+// Apply sends such messages to Debugf; otherwise, they are dropped.
+type LeveledLogger interface {
+	Logger
+	Debugf(ctx context.Context, v Verbosity, format string, args ...interface{})
+}
+
+func debugf(log Logger, ctx context.Context, v Verbosity, format string, args ...interface{}) {
+	if ll, ok := log.(LeveledLogger); ok {
+		ll.Debugf(ctx, v, format, args...)
+	}
+}
+
 type nullLogger struct{}
 
 func (nullLogger) Infof(ctx context.Context, format string, args ...interface{}) {}
@@ -95,43 +495,125 @@ func (nullLogger) Error(ctx context.Context, err error)
 
 type applyState struct {
 	graph            *depgraph.Graph
+	now              func() time.Time
 	hasFailures      bool
 	changedResources map[uint64]bool
+	outputs          map[uint64][]byte
+	report           *Report
+	durations        *state.State
+	slowFactor       float64
+	hashes           *hashCache
+	spans            map[uint64]string
+	strict           bool
+}
+
+// spanID returns the span ID of the resource with the given ID,
+// assigning one if needed.
+func (state *applyState) spanID(id uint64) string {
+	span := state.spans[id]
+	if span == "" {
+		span = newSpanID()
+		state.spans[id] = span
+	}
+	return span
 }
 
-func apply(ctx context.Context, sys system.System, g *depgraph.Graph, opts *Options) error {
-	ch, results, done := startWorkers(ctx, opts.Log, opts.ConcurrentJobs)
+func apply(ctx context.Context, sys system.System, now func() time.Time, g *depgraph.Graph, opts *Options) error {
+	ctx = withRunID(ctx, opts.RunID)
+	ch, results, done := startWorkers(ctx, opts.Log, now, opts.ConcurrentJobs)
 	defer done()
 
 	state := &applyState{
 		graph:            g,
+		now:              now,
 		changedResources: make(map[uint64]bool),
+		outputs:          make(map[uint64][]byte),
+		report:           opts.Report,
+		durations:        opts.State,
+		slowFactor:       opts.SlowFactor,
+		spans:            make(map[uint64]string),
+		strict:           opts.Strict,
+	}
+	if opts.State != nil {
+		state.hashes = &hashCache{now: now, st: opts.State, fast: opts.FastHash}
+	}
+	if state.report != nil {
+		*state.report = Report{Start: now(), RunID: opts.RunID, Seed: opts.Seed}
+		defer func() {
+			state.report.End = now()
+			state.report.Pending = state.pendingIDs()
+			state.report.Summary = state.report.Summarize()
+		}()
+	}
+	var priority map[uint64]float64
+	if opts.CriticalPath {
+		priority = g.CriticalPath(durationWeight(opts.State))
 	}
 	working := make(workingSet, opts.ConcurrentJobs)
+	limiter := newTagLimiter(opts.TagLimits)
+	memory := newMemLimiter(opts.MemoryLimit, opts.MaxOutput)
+	finish := func(rs []jobResult) {
+		working.remove(rs[0].id)
+		limiter.release(g.Resource(rs[0].id))
+		memory.release(g.Resource(rs[0].id))
+		for _, r := range rs {
+			update(ctx, opts.Log, state, r)
+		}
+	}
 	var nextJob *job
+	paused := false
 	for !g.Done() {
+		if resumed := opts.Pauser.wait(); resumed != nil {
+			if !paused {
+				opts.Log.Infof(ctx, "paused; waiting to resume before starting more resources")
+				paused = true
+			}
+			select {
+			case <-resumed:
+			case rs := <-results:
+				finish(rs)
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if paused {
+			opts.Log.Infof(ctx, "resumed")
+			paused = false
+		}
 		if working.hasIdle() && nextJob == nil {
 			// Find next work, if any.
 			ready := g.Ready()
 			if len(ready) == 0 {
 				return errors.New("graph not done, but has nothing to do")
 			}
-			if id := working.next(ready); id != 0 {
+			allowed := func(id uint64) bool {
 				res := g.Resource(id)
-				nextJob = &job{
-					sys:         sys,
-					log:         opts.Log,
-					bashPath:    opts.Bash,
-					resource:    res,
-					depsChanged: mapChangedDeps(state.changedResources, res),
+				return limiter.allows(res) && memory.allows(ctx, sys, res)
+			}
+			if id := working.next(ready, priority, opts.Seed, allowed); id != 0 {
+				nextJob = state.newJob(sys, opts, id)
+				if key := batchKey(nextJob.resource); key != "" && nextJob.vetoed == "" && !nextJob.keepOutput && !nextJob.resource.Disabled() {
+					for _, other := range ready {
+						if other == id || working.contains(other) || g.IsOutputSource(other) {
+							continue
+						}
+						// A batch counts as one resource against its
+						// tags' limits, so its members must share tags.
+						res := g.Resource(other)
+						if batchKey(res) == key && !res.Disabled() && sameBatchCommand(nextJob.resource, res, opts.Vars) && sameTags(nextJob.resource, res) {
+							if b := state.newJob(sys, opts, other); b.vetoed == "" {
+								nextJob.batch = append(nextJob.batch, b)
+							}
+						}
+					}
 				}
 			}
 		}
 		if nextJob == nil {
 			select {
-			case r := <-results:
-				working.remove(r.id)
-				update(ctx, opts.Log, state, r)
+			case rs := <-results:
+				finish(rs)
 			case <-ctx.Done():
 				return ctx.Err()
 			}
@@ -139,11 +621,12 @@ func apply(ctx context.Context, sys system.System, g *depgraph.Graph, opts *Opti
 		}
 		select {
 		case ch <- nextJob:
-			working.add(nextJob.resource.ID())
+			working.add(nextJob.ids())
+			limiter.acquire(nextJob.resource)
+			memory.acquire(ctx, sys, nextJob.resource)
 			nextJob = nil
-		case r := <-results:
-			working.remove(r.id)
-			update(ctx, opts.Log, state, r)
+		case rs := <-results:
+			finish(rs)
 		case <-ctx.Done():
 			return ctx.Err()
 		}
@@ -155,10 +638,80 @@ func apply(ctx context.Context, sys system.System, g *depgraph.Graph, opts *Opti
 	return nil
 }
 
+func (state *applyState) newJob(sys system.System, opts *Options, id uint64) *job {
+	res := state.graph.Resource(id)
+	var vetoed string
+	if opts.Veto != nil {
+		vetoed = opts.Veto(0, res)
+	}
+	j := &job{
+		vetoed:      vetoed,
+		span:        state.spanID(id),
+		sys:         sys,
+		log:         opts.Log,
+		now:         state.now,
+		bashPath:    opts.Bash,
+		vars:        opts.Vars,
+		umask:       opts.Umask,
+		maxOutput:   opts.MaxOutput,
+		supervisor:  opts.Supervisor,
+		downloader:  opts.Downloader,
+		hashes:      state.hashes,
+		lockFiles:   opts.LockFiles,
+		skipHealth:  opts.SkipHealthChecks,
+		credsDir:    opts.CredentialsDirectory,
+		env:         opts.Environment,
+		cmdLogDir:   opts.CommandLogDir,
+		cmdLogsKept: opts.CommandLogsKept,
+		keepOutput:  state.graph.IsOutputSource(id),
+		resource:    res,
+		depsChanged: mapChangedDeps(state.changedResources, res),
+	}
+	if src := contentFromOutput(res); src != 0 {
+		j.sourceOutput, j.sourceRan = state.outputs[src]
+	}
+	if state.durations != nil && state.durations.Pending[id] != nil {
+		// Replay the change that the resource missed in an earlier run.
+		for dep := range j.depsChanged {
+			j.depsChanged[dep] = true
+		}
+	}
+	if msg, _ := res.Deprecated(); msg != "" && !res.Disabled() {
+		j.warnf("deprecated: %s", msg)
+	}
+	return j
+}
+
 func update(ctx context.Context, log Logger, state *applyState, r jobResult) {
+	res := state.graph.Resource(r.id)
+	for _, w := range r.warnings {
+		warnCtx, ev := withEvent(ctx, EventWarning, res, state.spanID(r.id))
+		ev.Warning = w
+		log.Infof(warnCtx, "warning: %s: %s", formatResource(res), w)
+	}
+	if state.strict && r.err == nil && len(r.warnings) > 0 {
+		r.changed = false
+		r.err = errorWithResource(res, errorf("warnings are errors in strict mode: %s", strings.Join(r.warnings, "; ")))
+	}
+	state.recordResult(r)
+	if r.disabled {
+		disabledCtx, ev := withEvent(ctx, EventResult, res, state.spanID(r.id))
+		ev.Status = StatusDisabled
+		log.Infof(disabledCtx, "%s: %s", ev.Status, formatResource(res))
+		// Leave the resource pending, so it catches up on changes to its
+		// dependencies once it is enabled again.
+		state.leavePending(ctx, log, res)
+		state.graph.Mark(r.id)
+		state.changedResources[r.id] = false
+		return
+	}
+	state.observeDuration(ctx, log, r)
 	if r.err != nil {
 		state.hasFailures = true
-		log.Error(ctx, r.err)
+		errCtx, ev := withEvent(ctx, EventError, res, state.spanID(r.id))
+		ev.Status, ev.Duration = StatusFailed, r.duration
+		log.Error(errCtx, r.err)
+		state.leavePending(ctx, log, res)
 		skipped := state.graph.MarkFailure(r.id)
 		if len(skipped) == 0 {
 			return
@@ -166,13 +719,179 @@ func update(ctx context.Context, log Logger, state *applyState, r jobResult) {
 		skipnames := make([]string, len(skipped))
 		for i := range skipnames {
 			skipnames[i] = formatResource(state.graph.Resource(skipped[i]))
+			state.recordSkip(skipped[i])
+			state.leavePending(ctx, log, state.graph.Resource(skipped[i]))
 		}
-		res := state.graph.Resource(r.id)
-		log.Infof(ctx, "skipping due to failure of %s: %s", formatResource(res), strings.Join(skipnames, ", "))
+		skipCtx, ev := withEvent(ctx, EventSkip, res, state.spanID(r.id))
+		ev.Skipped = skipped
+		log.Infof(skipCtx, "skipping due to failure of %s: %s", formatResource(res), strings.Join(skipnames, ", "))
 		return
 	}
+	if state.durations != nil {
+		if pc := state.durations.RemovePending(r.id); pc != nil {
+			log.Infof(ctx, "applied pending change: %s, pending since %s", formatResource(res), pc.Since.Format(time.RFC3339))
+		}
+	}
+	if r.reboot != nil {
+		log.Infof(ctx, "reboot requested: %s", strings.Join(r.reboot.Reasons, "; "))
+		state.requestReboot(r.reboot)
+	}
+	resultCtx, ev := withEvent(ctx, EventResult, res, state.spanID(r.id))
+	ev.Status, ev.Duration = StatusUnchanged, r.duration
+	if r.changed {
+		ev.Status = StatusChanged
+	}
+	if r.changed {
+		log.Infof(resultCtx, "%s: %s", ev.Status, formatResource(res))
+	} else {
+		debugf(log, resultCtx, Verbose, "%s: %s", ev.Status, formatResource(res))
+	}
 	state.graph.Mark(r.id)
 	state.changedResources[r.id] = r.changed
+	if r.ran {
+		state.outputs[r.id] = r.output
+	}
+}
+
+func (state *applyState) recordResult(r jobResult) {
+	if state.report == nil {
+		return
+	}
+	res := state.graph.Resource(r.id)
+	rr := &ResourceReport{
+		ID:       r.id,
+		Status:   StatusUnchanged,
+		Start:    r.start,
+		Duration: r.duration,
+		SpanID:   state.spanID(r.id),
+	}
+	rr.Name, _ = res.Name()
+	rr.Comment, _ = res.Comment()
+	rr.Replaces = resourceReplaces(res)
+	switch {
+	case r.disabled:
+		rr.Status = StatusDisabled
+	case r.err != nil:
+		rr.Status = StatusFailed
+		rr.Error = r.err.Error()
+		rr.Violated = r.violated
+		rr.Owner, _ = res.Owner()
+		rr.DocURL, _ = res.DocUrl()
+	case r.changed:
+		rr.Status = StatusChanged
+	}
+	rr.Warnings = r.warnings
+	rr.Conditions = r.conditions
+	state.report.Resources = append(state.report.Resources, rr)
+}
+
+// leavePending records res as pending if any of its dependencies
+// changed, so that the next run applies it as though they changed
+// again.  It does nothing without a State.
+func (state *applyState) leavePending(ctx context.Context, log Logger, res catalog.Resource) {
+	if state.durations == nil {
+		return
+	}
+	deps, _ := res.Dependencies()
+	for i := 0; i < deps.Len(); i++ {
+		if state.changedResources[deps.At(i)] {
+			if state.durations.Pending[res.ID()] == nil {
+				log.Infof(ctx, "pending: %s was triggered by a change but did not apply; it will be triggered again next run", formatResource(res))
+			}
+			state.durations.AddPending(res.ID(), state.now())
+			return
+		}
+	}
+}
+
+// pendingIDs returns the sorted IDs of the resources in the graph that
+// are pending once the run finishes.
+func (state *applyState) pendingIDs() []uint64 {
+	if state.durations == nil {
+		return nil
+	}
+	var ids []uint64
+	for id := range state.durations.Pending {
+		if state.graph.Resource(id).ID() == id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids
+}
+
+type uint64Slice []uint64
+
+func (a uint64Slice) Len() int           { return len(a) }
+func (a uint64Slice) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func (state *applyState) requestReboot(req *RebootRequest) {
+	if state.report == nil {
+		return
+	}
+	if state.report.Reboot == nil {
+		state.report.Reboot = new(RebootRequest)
+	}
+	state.report.Reboot.merge(req)
+}
+
+func (state *applyState) observeDuration(ctx context.Context, log Logger, r jobResult) {
+	if state.durations == nil {
+		return
+	}
+	prev := state.durations.ObserveDuration(r.id, r.duration)
+	if prev.Samples < minSlowSamples || r.duration < minSlowDuration {
+		return
+	}
+	if float64(r.duration) > state.slowFactor*float64(prev.Average) {
+		res := state.graph.Resource(r.id)
+		slowCtx, ev := withEvent(ctx, EventSlow, res, state.spanID(r.id))
+		ev.Duration = r.duration
+		log.Infof(slowCtx, "slow: %s took %v, %.1f times its average of %v", formatResource(res), r.duration, float64(r.duration)/float64(prev.Average), prev.Average)
+	}
+}
+
+func (state *applyState) recordSkip(id uint64) {
+	if state.report == nil {
+		return
+	}
+	rr := &ResourceReport{
+		ID:     id,
+		Status: StatusSkipped,
+		SpanID: state.spanID(id),
+	}
+	res := state.graph.Resource(id)
+	rr.Name, _ = res.Name()
+	rr.Comment, _ = res.Comment()
+	rr.Replaces = resourceReplaces(res)
+	state.report.Resources = append(state.report.Resources, rr)
+}
+
+// resourceReplaces returns the IDs in r's replaces field.
+func resourceReplaces(r catalog.Resource) []uint64 {
+	list, _ := r.Replaces()
+	if list.Len() == 0 {
+		return nil
+	}
+	ids := make([]uint64, list.Len())
+	for i := range ids {
+		ids[i] = list.At(i)
+	}
+	return ids
+}
+
+// contentFromOutput returns the ID of the exec resource whose output r
+// takes its content from, or zero if r is not such a file.
+func contentFromOutput(r catalog.Resource) uint64 {
+	if r.Which() != catalog.Resource_Which_file {
+		return 0
+	}
+	f, err := r.File()
+	if err != nil || f.Which() != catalog.File_Which_plain {
+		return 0
+	}
+	return f.Plain().ContentFromOutput()
 }
 
 func mapChangedDeps(all map[uint64]bool, r catalog.Resource) map[uint64]bool {
@@ -186,61 +905,138 @@ func mapChangedDeps(all map[uint64]bool, r catalog.Resource) map[uint64]bool {
 	return m
 }
 
-// workingSet is the list of resource IDs being processed at a point in time.
-type workingSet []uint64
+// workingSet is the list of resource IDs being processed by each
+// worker at a point in time.  A worker applying a batch has more than
+// one ID, the first of which is the job's resource.
+type workingSet [][]uint64
 
 // hasIdle reports whether there are idle workers.
 func (ws workingSet) hasIdle() bool {
-	return ws.find(0) != -1
+	for i := range ws {
+		if len(ws[i]) == 0 {
+			return true
+		}
+	}
+	return false
 }
 
-func (ws workingSet) add(id uint64) {
-	i := ws.find(0)
-	if i == -1 {
-		panic("workingSet.add on full set")
+func (ws workingSet) add(ids []uint64) {
+	for i := range ws {
+		if len(ws[i]) == 0 {
+			ws[i] = ids
+			return
+		}
 	}
-	ws[i] = id
+	panic("workingSet.add on full set")
 }
 
+// remove marks the worker processing the job for id as idle.
 func (ws workingSet) remove(id uint64) {
-	i := ws.find(id)
-	if i == -1 {
-		panic("workingSet.remove could not find ID")
+	for i := range ws {
+		if len(ws[i]) > 0 && ws[i][0] == id {
+			ws[i] = nil
+			return
+		}
 	}
-	ws[i] = 0
+	panic("workingSet.remove could not find ID")
 }
 
-// find returns the index of an ID in the set or -1 if not found.
-func (ws workingSet) find(id uint64) int {
+// contains reports whether an ID is being processed.
+func (ws workingSet) contains(id uint64) bool {
 	for i := range ws {
-		if ws[i] == id {
-			return i
+		for _, x := range ws[i] {
+			if x == id {
+				return true
+			}
 		}
 	}
-	return -1
+	return false
 }
 
-// next returns a resource ID that is in ready but not in ws or zero if ws is a superset of ready.
-func (ws workingSet) next(ready []uint64) uint64 {
+// next returns a resource ID that is in ready, not in ws, and allowed,
+// or zero if there is none.
+// If priority is not nil, then the resource with the highest priority
+// is returned, with ties broken by order in ready.
+func (ws workingSet) next(ready []uint64, priority map[uint64]float64, seed int64, allowed func(id uint64) bool) uint64 {
 	// While this is technically O(len(ws) * len(ready)),
 	// len(ws) is constant over the course of an Apply.
+	var best uint64
 	for _, id := range ready {
-		if ws.find(id) == -1 {
+		if ws.contains(id) || !allowed(id) {
+			continue
+		}
+		if priority == nil && seed == 0 {
 			return id
 		}
+		if best == 0 || startsBefore(id, best, priority, seed) {
+			best = id
+		}
 	}
-	return 0
+	return best
 }
 
-func startWorkers(ctx context.Context, log Logger, n int) (chan<- *job, <-chan jobResult, func()) {
+// startsBefore reports whether ready resource a should be started
+// before ready resource b.  Resources with a higher priority start
+// first.  Ties are broken by shuffleKey if seed is not zero, and
+// otherwise a does not start before b.
+func startsBefore(a, b uint64, priority map[uint64]float64, seed int64) bool {
+	if pa, pb := priority[a], priority[b]; pa != pb {
+		return pa > pb
+	}
+	if seed == 0 {
+		return false
+	}
+	return shuffleKey(seed, a) < shuffleKey(seed, b)
+}
+
+// shuffleKey returns a pseudo-random sort key for a resource ID.  It
+// depends only on its arguments, so that the order doesn't depend on
+// when resources become ready.
+func shuffleKey(seed int64, id uint64) uint64 {
+	// splitmix64 finalizer
+	z := (uint64(seed) ^ id) + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// durationWeight returns the weight of each resource for critical path
+// scheduling.
+func durationWeight(st *state.State) func(id uint64) float64 {
+	var total time.Duration
+	n := 0
+	if st != nil {
+		for _, ds := range st.Durations {
+			if ds.Samples > 0 {
+				total += ds.Average
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return func(uint64) float64 { return 1 }
+	}
+	mean := float64(total) / float64(n)
+	return func(id uint64) float64 {
+		if ds := st.Durations[id]; ds != nil && ds.Samples > 0 {
+			return float64(ds.Average)
+		}
+		return mean
+	}
+}
+
+// startWorkers starts n workers that apply jobs sent on the returned
+// channel.  Each job's results are sent together, with the result for
+// the job's resource first.
+func startWorkers(ctx context.Context, log Logger, now func() time.Time, n int) (chan<- *job, <-chan []jobResult, func()) {
 	ch := make(chan *job)
-	results := make(chan jobResult)
+	results := make(chan []jobResult)
 	workCtx, cancel := context.WithCancel(ctx)
 	var wg sync.WaitGroup
 	wg.Add(n)
 	for i := 0; i < n; i++ {
 		go func() {
-			worker(workCtx, log, results, ch)
+			worker(workCtx, log, now, results, ch)
 			wg.Done()
 		}()
 	}
@@ -250,17 +1046,32 @@ func startWorkers(ctx context.Context, log Logger, n int) (chan<- *job, <-chan j
 	}
 }
 
-func worker(ctx context.Context, log Logger, results chan<- jobResult, ch <-chan *job) {
+func worker(ctx context.Context, log Logger, now func() time.Time, results chan<- []jobResult, ch <-chan *job) {
 	for {
 		select {
 		case j, ok := <-ch:
 			if !ok {
 				return
 			}
-			log.Infof(ctx, "applying: %s", formatResource(j.resource))
-			r := j.run(ctx)
+			for _, jj := range append([]*job{j}, j.batch...) {
+				startCtx, _ := withEvent(ctx, EventStart, jj.resource, jj.span)
+				log.Infof(startCtx, "applying: %s", formatResource(jj.resource))
+			}
+			start := now()
+			var rs []jobResult
+			if len(j.batch) > 0 {
+				rs = j.runBatch(ctx)
+			} else {
+				rs = []jobResult{j.run(ctx)}
+			}
+			d := now().Sub(start)
+			for i, jj := range append([]*job{j}, j.batch...) {
+				rs[i].start, rs[i].duration = start, d
+				rs[i].warnings = jj.warnings
+				rs[i].conditions = jj.conditions
+			}
 			select {
-			case results <- r:
+			case results <- rs:
 			case <-ctx.Done():
 				return
 			}
@@ -275,6 +1086,15 @@ type cachedUserLookupSystem struct {
 	cache userLookupCache
 }
 
+// clock returns the time source for a run on sys: its Now method if it
+// is a system.Clock and the wall clock otherwise.
+func clock(sys system.System) func() time.Time {
+	if c, ok := sys.(system.Clock); ok {
+		return c.Now
+	}
+	return time.Now
+}
+
 func cacheUserLookups(sys system.System) system.System {
 	return &cachedUserLookupSystem{
 		System: sys,
@@ -282,6 +1102,150 @@ func cacheUserLookups(sys system.System) system.System {
 	}
 }
 
+func (s *cachedUserLookupSystem) Start(ctx context.Context, cmd *system.Cmd) (system.Process, error) {
+	st, ok := s.System.(system.Starter)
+	if !ok {
+		return nil, errors.New("system cannot start background processes")
+	}
+	return st.Start(ctx, cmd)
+}
+
+func (s *cachedUserLookupSystem) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, ok := s.System.(system.Dialer)
+	if !ok {
+		return nil, errors.New("system cannot dial addresses")
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+func (s *cachedUserLookupSystem) Lock(ctx context.Context, path string, mode os.FileMode) (system.FileLock, error) {
+	l, ok := s.System.(system.Locker)
+	if !ok {
+		return nil, errors.New("system cannot lock files")
+	}
+	return l.Lock(ctx, path, mode)
+}
+
+func (s *cachedUserLookupSystem) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	c, ok := s.System.(system.Cloner)
+	if !ok {
+		return errors.New("system cannot clone files")
+	}
+	return c.CloneFile(ctx, src, dst, mode)
+}
+
+func (s *cachedUserLookupSystem) Rename(ctx context.Context, oldpath, newpath string) error {
+	r, ok := s.System.(system.Renamer)
+	if !ok {
+		return errors.New("system cannot rename files")
+	}
+	return r.Rename(ctx, oldpath, newpath)
+}
+
+func (s *cachedUserLookupSystem) FileIdentity(info os.FileInfo) (dev, ino uint64, err error) {
+	fi, ok := s.System.(system.FileIdentifier)
+	if !ok {
+		return 0, 0, errors.New("system cannot identify files")
+	}
+	return fi.FileIdentity(info)
+}
+
+func (s *cachedUserLookupSystem) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	dr, ok := s.System.(system.DirReader)
+	if !ok {
+		return nil, errors.New("system cannot list directories")
+	}
+	return dr.ReadDir(ctx, path)
+}
+
+func (s *cachedUserLookupSystem) RegistryKeyExists(ctx context.Context, key string) (bool, error) {
+	r, ok := s.System.(system.Registry)
+	if !ok {
+		return false, errors.New("system has no registry")
+	}
+	return r.RegistryKeyExists(ctx, key)
+}
+
+func (s *cachedUserLookupSystem) CreateRegistryKey(ctx context.Context, key string) error {
+	r, ok := s.System.(system.Registry)
+	if !ok {
+		return errors.New("system has no registry")
+	}
+	return r.CreateRegistryKey(ctx, key)
+}
+
+func (s *cachedUserLookupSystem) DeleteRegistryKey(ctx context.Context, key string) error {
+	r, ok := s.System.(system.Registry)
+	if !ok {
+		return errors.New("system has no registry")
+	}
+	return r.DeleteRegistryKey(ctx, key)
+}
+
+func (s *cachedUserLookupSystem) RegistryValue(ctx context.Context, key, name string) (system.RegistryValue, error) {
+	r, ok := s.System.(system.Registry)
+	if !ok {
+		return system.RegistryValue{}, errors.New("system has no registry")
+	}
+	return r.RegistryValue(ctx, key, name)
+}
+
+func (s *cachedUserLookupSystem) SetRegistryValue(ctx context.Context, key, name string, val system.RegistryValue) error {
+	r, ok := s.System.(system.Registry)
+	if !ok {
+		return errors.New("system has no registry")
+	}
+	return r.SetRegistryValue(ctx, key, name, val)
+}
+
+func (s *cachedUserLookupSystem) DeleteRegistryValue(ctx context.Context, key, name string) error {
+	r, ok := s.System.(system.Registry)
+	if !ok {
+		return errors.New("system has no registry")
+	}
+	return r.DeleteRegistryValue(ctx, key, name)
+}
+
+func (s *cachedUserLookupSystem) QueryService(ctx context.Context, name string) (*system.ServiceStatus, error) {
+	sm, ok := s.System.(system.ServiceManager)
+	if !ok {
+		return nil, errors.New("system cannot manage services")
+	}
+	return sm.QueryService(ctx, name)
+}
+
+func (s *cachedUserLookupSystem) CreateService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sm, ok := s.System.(system.ServiceManager)
+	if !ok {
+		return errors.New("system cannot manage services")
+	}
+	return sm.CreateService(ctx, name, config)
+}
+
+func (s *cachedUserLookupSystem) ConfigureService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sm, ok := s.System.(system.ServiceManager)
+	if !ok {
+		return errors.New("system cannot manage services")
+	}
+	return sm.ConfigureService(ctx, name, config)
+}
+
+func (s *cachedUserLookupSystem) StartService(ctx context.Context, name string) error {
+	sm, ok := s.System.(system.ServiceManager)
+	if !ok {
+		return errors.New("system cannot manage services")
+	}
+	return sm.StartService(ctx, name)
+}
+
+func (s *cachedUserLookupSystem) StopService(ctx context.Context, name string) error {
+	sm, ok := s.System.(system.ServiceManager)
+	if !ok {
+		return errors.New("system cannot manage services")
+	}
+	return sm.StopService(ctx, name)
+}
+
 func (s *cachedUserLookupSystem) LookupUser(name string) (system.UID, error) {
 	return s.cache.LookupUser(name)
 }
@@ -342,6 +1306,9 @@ func (c *userLookupCache) LookupGroup(name string) (system.GID, error) {
 }
 
 func formatResource(r catalog.Resource) string {
+	if name, _ := r.Name(); name != "" {
+		return name
+	}
 	c, _ := r.Comment()
 	if c == "" {
 		return fmt.Sprintf("id=%d", r.ID())
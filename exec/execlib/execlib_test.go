@@ -17,15 +17,27 @@ package execlib_test
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/zombiezen/mcm/catalog"
 	. "github.com/zombiezen/mcm/exec/execlib"
 	"github.com/zombiezen/mcm/internal/applytests"
 	"github.com/zombiezen/mcm/internal/catpogs"
+	"github.com/zombiezen/mcm/internal/state"
 	"github.com/zombiezen/mcm/internal/system"
 	"github.com/zombiezen/mcm/internal/system/fakesystem"
 )
@@ -101,98 +113,4641 @@ func TestExecBash(t *testing.T) {
 	}
 }
 
+func TestReport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	falsePath := filepath.Join(fakesystem.Root, "false")
+	filePath := filepath.Join(fakesystem.Root, "foo.txt")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "file",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(filePath, []byte("Hello")),
+			},
+			{
+				ID:      2,
+				Comment: "fails",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{falsePath},
+					},
+				},
+			},
+			{
+				ID:      3,
+				Comment: "skipped",
+				Deps:    []uint64{2},
+				Which:   catalog.Resource_Which_noop,
+			},
+			{
+				ID:      4,
+				Comment: "unchanged",
+				Which:   catalog.Resource_Which_noop,
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	err = sys.Mkprogram(falsePath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		return 1
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+
+	report := new(Report)
+	log := &recordLogger{t: t}
+	err = Apply(ctx, sys, cat, &Options{
+		Log:    log,
+		Report: report,
+	})
+	if err == nil {
+		t.Error("Apply did not return an error")
+	}
+
+	if report.Start.IsZero() || report.End.Before(report.Start) {
+		t.Errorf("report = {Start: %v, End: %v}; want non-zero, ordered times", report.Start, report.End)
+	}
+	if len(report.Resources) != 4 {
+		t.Errorf("len(report.Resources) = %d; want 4", len(report.Resources))
+	}
+	tests := []struct {
+		id     uint64
+		status ResourceStatus
+	}{
+		{1, StatusChanged},
+		{2, StatusFailed},
+		{3, StatusSkipped},
+		{4, StatusUnchanged},
+	}
+	for _, test := range tests {
+		rr := report.Resource(test.id)
+		if rr == nil {
+			t.Errorf("report.Resource(%d) = nil", test.id)
+			continue
+		}
+		if rr.Status != test.status {
+			t.Errorf("report.Resource(%d).Status = %q; want %q", test.id, rr.Status, test.status)
+		}
+		if failed := rr.Status == StatusFailed; failed != (rr.Error != "") {
+			t.Errorf("report.Resource(%d).Error = %q", test.id, rr.Error)
+		}
+	}
+
+	if sum := report.Summary; sum == nil {
+		t.Error("report.Summary = nil")
+	} else {
+		if sum.Applied != 3 || sum.Changed != 1 || sum.Unchanged != 1 || sum.Failed != 1 || sum.Skipped != 1 {
+			t.Errorf("report.Summary = %+v; want applied 3, changed 1, unchanged 1, failed 1, skipped 1", sum)
+		}
+		const prefix = "applied 3, changed 1, unchanged 1, failed 1, skipped 1 in "
+		if s := sum.String(); !strings.HasPrefix(s, prefix) || !strings.HasSuffix(s, "s") {
+			t.Errorf("report.Summary.String() = %q; want %q followed by duration", s, prefix)
+		}
+	}
+
+	eventTests := []struct {
+		kind   EventKind
+		id     uint64
+		status ResourceStatus
+	}{
+		{EventStart, 1, ""},
+		{EventResult, 1, StatusChanged},
+		{EventStart, 2, ""},
+		{EventError, 2, StatusFailed},
+		{EventSkip, 2, ""},
+		{EventStart, 4, ""},
+		{EventResult, 4, StatusUnchanged},
+	}
+	for _, test := range eventTests {
+		var found *Event
+		for _, ev := range log.events {
+			if ev.Kind == test.kind && ev.ResourceID == test.id {
+				found = ev
+				break
+			}
+		}
+		if found == nil {
+			t.Errorf("no %s event logged for resource %d", test.kind, test.id)
+			continue
+		}
+		if found.Status != test.status {
+			t.Errorf("%s event for resource %d has status %q; want %q", test.kind, test.id, found.Status, test.status)
+		}
+		if test.kind == EventSkip && (len(found.Skipped) != 1 || found.Skipped[0] != 3) {
+			t.Errorf("skip event for resource %d has Skipped = %v; want [3]", test.id, found.Skipped)
+		}
+	}
+}
+
+func TestSlowResource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sleepPath := filepath.Join(fakesystem.Root, "sleep")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "sleepy",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{sleepPath},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	err = sys.Mkprogram(sleepPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		time.Sleep(150 * time.Millisecond)
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	st := &state.State{
+		Durations: map[uint64]*state.DurationStats{
+			42: {Average: time.Millisecond, Samples: 5},
+		},
+	}
+
+	log := &recordLogger{t: t}
+	err = Apply(ctx, sys, cat, &Options{
+		Log:   log,
+		State: st,
+	})
+	if err != nil {
+		t.Error("Apply:", err)
+	}
+	if !log.contains("slow: sleepy (id=42)") {
+		t.Error("slow resource not logged")
+	}
+	if ds := st.Durations[42]; ds.Samples != 6 || ds.Average <= time.Millisecond {
+		t.Errorf("after Apply, Durations[42] = %+v; want Samples = 6, Average > 1ms", ds)
+	}
+}
+
+func TestReportClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progPath := filepath.Join(fakesystem.Root, "prog")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "prog",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{progPath},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	start := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	sys := &fakesystem.System{Clock: fakesystem.NewClock(start)}
+	err = sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		sys.Clock.Advance(5 * time.Second)
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	report := new(Report)
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+		t.Error("Apply:", err)
+	}
+	if !report.Start.Equal(start) || !report.End.Equal(start.Add(5*time.Second)) {
+		t.Errorf("report = {Start: %v, End: %v}; want {Start: %v, End: %v}", report.Start, report.End, start, start.Add(5*time.Second))
+	}
+	if rr := report.Resource(1); rr == nil || !rr.Start.Equal(start) || rr.Duration != 5*time.Second {
+		t.Errorf("report.Resource(1) = %+v; want Start = %v, Duration = 5s", rr, start)
+	}
+	if inv := sys.Invocations(); len(inv) != 1 || inv[0].Path != progPath {
+		t.Errorf("invocations = %+v; want one run of %s", inv, progPath)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(fakesystem.Root, "foo.txt")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "file",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(path, []byte("Hello")),
+			},
+			{
+				ID:      2,
+				Comment: "noop",
+				Which:   catalog.Resource_Which_noop,
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	err = Apply(ctx, sys, cat, &Options{
+		Log:    testLogger{t: t},
+		Limits: &catalog.Limits{MaxResources: 1},
+	})
+	if err == nil {
+		t.Error("Apply did not return an error")
+	}
+	if _, err := sys.Lstat(ctx, path); !os.IsNotExist(err) {
+		t.Errorf("Lstat(%q) = _, %v; want not exist", path, err)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(fakesystem.Root, "foo.txt")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "file",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(path, []byte("Hello")),
+			},
+			{
+				ID:      2,
+				Comment: "other file",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(path, []byte("Goodbye")),
+				Deps:    []uint64{1},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}}); err == nil {
+		t.Error("Apply did not return an error")
+	}
+	if _, err := sys.Lstat(ctx, path); !os.IsNotExist(err) {
+		t.Errorf("Lstat(%q) = _, %v; want not exist", path, err)
+	}
+	err = Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, AllowConflicts: true})
+	if err != nil {
+		t.Error("Apply with AllowConflicts:", err)
+	}
+	if _, err := sys.Lstat(ctx, path); err != nil {
+		t.Errorf("Lstat(%q) after Apply with AllowConflicts: %v", path, err)
+	}
+}
+
+func TestApplyAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fooPath := filepath.Join(fakesystem.Root, "foo.txt")
+	barPath := filepath.Join(fakesystem.Root, "bar.txt")
+	progPath := filepath.Join(fakesystem.Root, "prog")
+	var cats []catalog.Catalog
+	for _, c := range []*catpogs.Catalog{
+		{Resources: []*catpogs.Resource{{
+			ID:      1,
+			Comment: "foo",
+			Which:   catalog.Resource_Which_file,
+			File:    catpogs.PlainFile(fooPath, []byte("Hello")),
+		}}},
+		{Resources: []*catpogs.Resource{{
+			ID:      1,
+			Comment: "prog",
+			Which:   catalog.Resource_Which_exec,
+			Exec: &catpogs.Exec{
+				Command: &catpogs.Command{
+					Which: catalog.Exec_Command_Which_argv,
+					Argv:  []string{progPath},
+				},
+			},
+		}}},
+		{Resources: []*catpogs.Resource{{
+			ID:      1,
+			Comment: "bar",
+			Which:   catalog.Resource_Which_file,
+			File:    catpogs.PlainFile(barPath, []byte("Hello")),
+		}}},
+	} {
+		cat, err := c.ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		cats = append(cats, cat)
+	}
+	sys := new(fakesystem.System)
+	err := sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		return 1
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	report := new(Report)
+	err = ApplyAll(ctx, sys, cats, &Options{Log: testLogger{t: t}, Report: report})
+	if err == nil {
+		t.Error("ApplyAll did not return an error")
+	}
+	if _, err := sys.Lstat(ctx, fooPath); err != nil {
+		t.Errorf("Lstat(%q): %v", fooPath, err)
+	}
+	if _, err := sys.Lstat(ctx, barPath); !os.IsNotExist(err) {
+		t.Errorf("Lstat(%q) = _, %v; want not exist", barPath, err)
+	}
+	want := []ResourceReport{
+		{ID: 1, Catalog: 0, Comment: "foo", Status: StatusChanged},
+		{ID: 1, Catalog: 1, Comment: "prog", Status: StatusFailed},
+		{ID: 1, Catalog: 2, Comment: "bar", Status: StatusSkipped},
+	}
+	if len(report.Resources) != len(want) {
+		t.Fatalf("len(report.Resources) = %d; want %d", len(report.Resources), len(want))
+	}
+	for i, rr := range report.Resources {
+		if rr.ID != want[i].ID || rr.Catalog != want[i].Catalog || rr.Comment != want[i].Comment || rr.Status != want[i].Status {
+			t.Errorf("report.Resources[%d] = %+v; want %+v", i, rr, want[i])
+		}
+	}
+	if s := report.Summary; s == nil || s.Applied != 2 || s.Changed != 1 || s.Failed != 1 || s.Skipped != 1 {
+		t.Errorf("report.Summary = %v; want applied 2, changed 1, failed 1, skipped 1", s)
+	}
+}
+
+func TestVeto(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fooPath := filepath.Join(fakesystem.Root, "foo.txt")
+	barPath := filepath.Join(fakesystem.Root, "bar.txt")
+	bazPath := filepath.Join(fakesystem.Root, "baz.txt")
+	var cats []catalog.Catalog
+	for _, c := range []*catpogs.Catalog{
+		{Resources: []*catpogs.Resource{{
+			ID:      1,
+			Comment: "foo",
+			Which:   catalog.Resource_Which_file,
+			File:    catpogs.PlainFile(fooPath, []byte("Hello")),
+		}}},
+		{Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "bar",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(barPath, []byte("Hello")),
+			},
+			{
+				ID:      2,
+				Comment: "baz",
+				Deps:    []uint64{1},
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(bazPath, []byte("Hello")),
+			},
+		}},
+	} {
+		cat, err := c.ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		cats = append(cats, cat)
+	}
+	sys := new(fakesystem.System)
+	report := new(Report)
+	err := ApplyAll(ctx, sys, cats, &Options{
+		Log:    testLogger{t: t},
+		Report: report,
+		Veto: func(cat int, r catalog.Resource) string {
+			if cat == 1 && r.ID() == 1 {
+				return "bar is forbidden"
+			}
+			return ""
+		},
+	})
+	if err == nil {
+		t.Error("ApplyAll did not return an error")
+	}
+	if _, err := sys.Lstat(ctx, fooPath); err != nil {
+		t.Errorf("Lstat(%q): %v", fooPath, err)
+	}
+	for _, path := range []string{barPath, bazPath} {
+		if _, err := sys.Lstat(ctx, path); !os.IsNotExist(err) {
+			t.Errorf("Lstat(%q) = _, %v; want not exist", path, err)
+		}
+	}
+	want := []ResourceReport{
+		{ID: 1, Catalog: 0, Comment: "foo", Status: StatusChanged},
+		{ID: 1, Catalog: 1, Comment: "bar", Status: StatusFailed},
+		{ID: 2, Catalog: 1, Comment: "baz", Status: StatusSkipped},
+	}
+	if len(report.Resources) != len(want) {
+		t.Fatalf("len(report.Resources) = %d; want %d", len(report.Resources), len(want))
+	}
+	for i, rr := range report.Resources {
+		if rr.ID != want[i].ID || rr.Catalog != want[i].Catalog || rr.Comment != want[i].Comment || rr.Status != want[i].Status {
+			t.Errorf("report.Resources[%d] = %+v; want %+v", i, rr, want[i])
+		}
+	}
+	if e := report.Resources[1].Error; !strings.Contains(e, "bar is forbidden") {
+		t.Errorf("report.Resources[1].Error = %q; want to contain %q", e, "bar is forbidden")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fooPath := filepath.Join(fakesystem.Root, "foo.txt")
+	barPath := filepath.Join(fakesystem.Root, "bar.txt")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:       1,
+				Comment:  "foo",
+				Disabled: true,
+				Which:    catalog.Resource_Which_file,
+				File:     catpogs.PlainFile(fooPath, []byte("Hello")),
+			},
+			{
+				ID:      2,
+				Comment: "bar",
+				Deps:    []uint64{1},
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(barPath, []byte("Hello")),
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	report := new(Report)
+	err = Apply(ctx, sys, cat, &Options{
+		Log:    testLogger{t: t},
+		Report: report,
+	})
+	if err != nil {
+		t.Error("Apply:", err)
+	}
+	if _, err := sys.Lstat(ctx, fooPath); !os.IsNotExist(err) {
+		t.Errorf("Lstat(%q) = _, %v; want not exist", fooPath, err)
+	}
+	if _, err := sys.Lstat(ctx, barPath); err != nil {
+		t.Errorf("Lstat(%q): %v", barPath, err)
+	}
+	if rr := report.Resource(1); rr == nil || rr.Status != StatusDisabled {
+		t.Errorf("report.Resource(1) = %+v; want status %q", rr, StatusDisabled)
+	}
+	if rr := report.Resource(2); rr == nil || rr.Status != StatusChanged {
+		t.Errorf("report.Resource(2) = %+v; want status %q", rr, StatusChanged)
+	}
+	if s := report.Summary; s.Applied != 1 || s.Disabled != 1 {
+		t.Errorf("summary applied = %d, disabled = %d; want 1, 1", s.Applied, s.Disabled)
+	}
+}
+
+func TestApplyAllChecksFirst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(fakesystem.Root, "foo.txt")
+	good, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "file",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(path, []byte("Hello")),
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	bad, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "noop",
+				Which:   catalog.Resource_Which_noop,
+				Deps:    []uint64{2},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	if err := ApplyAll(ctx, sys, []catalog.Catalog{good, bad}, &Options{Log: testLogger{t: t}}); err == nil {
+		t.Error("ApplyAll did not return an error")
+	}
+	if _, err := sys.Lstat(ctx, path); !os.IsNotExist(err) {
+		t.Errorf("Lstat(%q) = _, %v; want not exist", path, err)
+	}
+}
+
+func TestExecLookPathInherited(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progDir := filepath.SplitList(fakesystem.DefaultPath)[0]
+	progPath := filepath.Join(progDir, "xyzzy")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "exec",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which:    catalog.Exec_Command_Which_argv,
+						Argv:     []string{"xyzzy"},
+						LookPath: true,
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	if err := mkdirAll(ctx, sys, progDir); err != nil {
+		t.Fatal(err)
+	}
+	ran := false
+	err = sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		ran = true
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}}); err != nil {
+		t.Error("Apply:", err)
+	}
+	if !ran {
+		t.Errorf("%s not run", progPath)
+	}
+}
+
+func TestExecExpand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progDir := filepath.Join(fakesystem.Root, "opt", "app")
+	progPath := filepath.Join(progDir, "setup")
+	newCatalog := func(expand bool, arg string) catalog.Catalog {
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:      42,
+					Comment: "exec",
+					Which:   catalog.Resource_Which_exec,
+					Exec: &catpogs.Exec{
+						Command: &catpogs.Command{
+							Which:  catalog.Exec_Command_Which_argv,
+							Argv:   []string{"${dir}/setup", arg},
+							Env:    []catpogs.EnvVar{{Name: "HOST", Value: "${facts.hostname}.example.com"}},
+							Expand: expand,
+						},
+					},
+				},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		return cat
+	}
+	sys := new(fakesystem.System)
+	if err := mkdirAll(ctx, sys, progDir); err != nil {
+		t.Fatal(err)
+	}
+	var gotArgs, gotEnv []string
+	err := sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		gotArgs, gotEnv = pc.Args, pc.Env
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	vars := map[string]string{"dir": progDir, "facts.hostname": "web1"}
+	opts := &Options{Log: testLogger{t: t}, Vars: vars}
+	if err := Apply(ctx, sys, newCatalog(true, "$$HOME is $HOME"), opts); err != nil {
+		t.Error("Apply:", err)
+	}
+	if want := []string{progPath, "$HOME is $HOME"}; !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("args = %q; want %q", gotArgs, want)
+	}
+	if want := []string{"HOST=web1.example.com"}; !reflect.DeepEqual(gotEnv, want) {
+		t.Errorf("env = %q; want %q", gotEnv, want)
+	}
+
+	gotArgs = nil
+	if err := Apply(ctx, sys, newCatalog(true, "${nope}"), &Options{Log: testLogger{t: t}, Vars: vars}); err == nil {
+		t.Error("Apply with unknown variable did not return an error")
+	}
+	if err := Apply(ctx, sys, newCatalog(true, "${dir"), &Options{Log: testLogger{t: t}, Vars: vars}); err == nil {
+		t.Error("Apply with unterminated reference did not return an error")
+	}
+	if err := Apply(ctx, sys, newCatalog(false, "x"), &Options{Log: testLogger{t: t}, Vars: vars}); err == nil {
+		t.Error("Apply of unexpanded relative argv[0] did not return an error")
+	}
+	if gotArgs != nil {
+		t.Errorf("program ran with %q; want not run", gotArgs)
+	}
+}
+
+func TestExecEnvironment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progPath := filepath.Join(fakesystem.Root, "setup")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "exec",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{progPath},
+						Env:   []catpogs.EnvVar{{Name: "TZ", Value: "America/New_York"}},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	var gotEnv []string
+	err = sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		gotEnv = pc.Env
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	opts := &Options{Log: testLogger{t: t}, Environment: []string{"LANG=C", "TZ=UTC", "PATH=/bin"}}
+	if err := Apply(ctx, sys, cat, opts); err != nil {
+		t.Error("Apply:", err)
+	}
+	if want := []string{"LANG=C", "PATH=/bin", "TZ=America/New_York"}; !reflect.DeepEqual(gotEnv, want) {
+		t.Errorf("env = %q; want %q", gotEnv, want)
+	}
+}
+
+func TestScratchDir(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writePath := filepath.Join(fakesystem.Root, "write")
+	readPath := filepath.Join(fakesystem.Root, "read")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "write",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{writePath},
+					},
+				},
+			},
+			{
+				ID:      2,
+				Comment: "read",
+				Deps:    []uint64{1},
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{readPath},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	tmp := filepath.Join(fakesystem.Root, "tmp")
+	if err := sys.Mkdir(ctx, tmp, 0777); err != nil {
+		t.Fatal(err)
+	}
+	var scratch, got string
+	err = sys.Mkprogram(writePath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		scratch = envValue(pc.Env, ScratchEnv)
+		if err := sys.Mkdir(ctx, filepath.Join(scratch, "out"), 0777); err != nil {
+			fmt.Fprintln(pc.Output, err)
+			return 1
+		}
+		if err := system.WriteFile(ctx, sys, filepath.Join(scratch, "out", "data"), []byte("intermediate"), 0666); err != nil {
+			fmt.Fprintln(pc.Output, err)
+			return 1
+		}
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	err = sys.Mkprogram(readPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		dir := envValue(pc.Env, ScratchEnv)
+		data, err := system.ReadFile(ctx, sys, filepath.Join(dir, "out", "data"))
+		if err != nil {
+			fmt.Fprintln(pc.Output, err)
+			return 1
+		}
+		got = string(data)
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, ScratchDir: tmp}); err != nil {
+		t.Error("Apply:", err)
+	}
+	if filepath.Dir(scratch) != tmp {
+		t.Errorf("%s = %q; want a directory in %s", ScratchEnv, scratch, tmp)
+	}
+	if got != "intermediate" {
+		t.Errorf("read program got %q; want \"intermediate\"", got)
+	}
+	if _, err := sys.Lstat(ctx, scratch); !system.IsNotExist(err) {
+		t.Errorf("after Apply, lstat %s = %v; want not exist", scratch, err)
+	}
+	if _, err := sys.Lstat(ctx, tmp); err != nil {
+		t.Errorf("after Apply, lstat %s: %v", tmp, err)
+	}
+}
+
+// envValue returns the value of the variable named name in env, a list
+// of "key=value" strings.
+func envValue(env []string, name string) string {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return kv[len(name)+1:]
+		}
+	}
+	return ""
+}
+
+func TestScrubEnvironment(t *testing.T) {
+	env := []string{
+		"PATH=/usr/bin:/bin",
+		"LANG=de_DE.UTF-8",
+		"LC_ALL=de_DE.UTF-8",
+		"TZ=Europe/Berlin",
+		"https_proxy=http://proxy:3128",
+		"NO_PROXY=localhost",
+		"HOME=/root",
+	}
+	got := ScrubEnvironment(env, DefaultScrubPatterns)
+	if want := []string{"PATH=/usr/bin:/bin", "HOME=/root"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ScrubEnvironment(env, DefaultScrubPatterns) = %q; want %q", got, want)
+	}
+	got = ScrubEnvironment(env, nil)
+	if !reflect.DeepEqual(got, env) {
+		t.Errorf("ScrubEnvironment(env, nil) = %q; want %q", got, env)
+	}
+}
+
+func TestCommandLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progPath := filepath.Join(fakesystem.Root, "setup")
+	logDir := filepath.Join(fakesystem.Root, "var", "log", "mcm")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "exec",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{progPath},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	runs := 0
+	err = sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		runs++
+		fmt.Fprintf(pc.Output, "run %d\n", runs)
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	opts := &Options{Log: testLogger{t: t}, CommandLogDir: logDir, CommandLogsKept: 1}
+	for i := 0; i < 3; i++ {
+		if err := Apply(ctx, sys, cat, opts); err != nil {
+			t.Fatalf("Apply #%d: %v", i+1, err)
+		}
+	}
+	logPath := filepath.Join(logDir, "42.log")
+	for _, want := range []struct {
+		path string
+		out  string
+	}{
+		{logPath, "run 3\n"},
+		{logPath + ".1", "run 2\n"},
+	} {
+		got, err := system.ReadFile(ctx, sys, want.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Contains(got, []byte(want.out)) {
+			t.Errorf("%s = %q; want to contain %q", want.path, got, want.out)
+		}
+	}
+	if _, err := sys.Lstat(ctx, logPath+".2"); !os.IsNotExist(err) {
+		t.Errorf("Lstat(%q) = _, %v; want not exist", logPath+".2", err)
+	}
+}
+
+func TestExecSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progPath := filepath.Join(fakesystem.Root, "deploy")
+	secretPath := filepath.Join(fakesystem.Root, "token")
+	credsDir := filepath.Join(fakesystem.Root, "creds")
+	newCatalog := func(secret *catpogs.Secret) catalog.Catalog {
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:      42,
+					Comment: "exec",
+					Which:   catalog.Resource_Which_exec,
+					Exec: &catpogs.Exec{
+						Command: &catpogs.Command{
+							Which:  catalog.Exec_Command_Which_argv,
+							Argv:   []string{progPath},
+							Env:    []catpogs.EnvVar{{Name: "TOKEN", Secret: secret}},
+							Expand: true,
+						},
+					},
+				},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		return cat
+	}
+	sys := new(fakesystem.System)
+	if err := system.WriteFile(ctx, sys, secretPath, []byte("s3cr${et}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.Mkdir(ctx, credsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := system.WriteFile(ctx, sys, filepath.Join(credsDir, "db"), []byte("hunter2"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	var gotEnv []string
+	err := sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		gotEnv = pc.Env
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+
+	fileSecret := &catpogs.Secret{Which: catalog.Exec_Command_Secret_Which_file, File: secretPath}
+	if err := Apply(ctx, sys, newCatalog(fileSecret), &Options{Log: testLogger{t: t}}); err != nil {
+		t.Error("Apply with file secret:", err)
+	}
+	if want := []string{"TOKEN=s3cr${et}"}; !reflect.DeepEqual(gotEnv, want) {
+		t.Errorf("env = %q; want %q", gotEnv, want)
+	}
+
+	gotEnv = nil
+	credSecret := &catpogs.Secret{Which: catalog.Exec_Command_Secret_Which_systemdCredential, SystemdCredential: "db"}
+	opts := &Options{Log: testLogger{t: t}, CredentialsDirectory: credsDir}
+	if err := Apply(ctx, sys, newCatalog(credSecret), opts); err != nil {
+		t.Error("Apply with systemd credential:", err)
+	}
+	if want := []string{"TOKEN=hunter2"}; !reflect.DeepEqual(gotEnv, want) {
+		t.Errorf("env = %q; want %q", gotEnv, want)
+	}
+
+	gotEnv = nil
+	if err := sys.Chmod(ctx, secretPath, 0640); err != nil {
+		t.Fatal(err)
+	}
+	err = Apply(ctx, sys, newCatalog(fileSecret), &Options{Log: testLogger{t: t}})
+	if err == nil {
+		t.Error("Apply with group-readable secret file did not return an error")
+	} else if strings.Contains(err.Error(), "s3cr") {
+		t.Errorf("Apply error %q contains the secret", err)
+	}
+	if gotEnv != nil {
+		t.Errorf("program ran with env %q; want not run", gotEnv)
+	}
+}
+
+func TestExecSched(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	progPath := filepath.Join(fakesystem.Root, "backup")
+	newCatalog := func(cmd *catpogs.Command) catalog.Catalog {
+		cmd.Which = catalog.Exec_Command_Which_argv
+		cmd.Argv = []string{progPath}
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:      42,
+					Comment: "exec",
+					Which:   catalog.Resource_Which_exec,
+					Exec:    &catpogs.Exec{Command: cmd},
+				},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		return cat
+	}
+	sys := new(fakesystem.System)
+	ran := false
+	var got *system.Sched
+	err := sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		ran, got = true, pc.Sched
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+
+	if err := Apply(ctx, sys, newCatalog(&catpogs.Command{}), &Options{Log: testLogger{t: t}}); err != nil {
+		t.Error("Apply:", err)
+	}
+	if got != nil {
+		t.Errorf("sched without settings = %+v; want nil", got)
+	}
+
+	cmd := &catpogs.Command{
+		Nice:        10,
+		IOClass:     catalog.Exec_Command_IoClass_bestEffort,
+		IOLevel:     7,
+		OOMScoreAdj: 500,
+	}
+	if err := Apply(ctx, sys, newCatalog(cmd), &Options{Log: testLogger{t: t}}); err != nil {
+		t.Error("Apply:", err)
+	}
+	want := &system.Sched{Nice: 10, IOClass: system.IOClassBestEffort, IOLevel: 7, OOMScoreAdj: 500}
+	if got == nil || *got != *want {
+		t.Errorf("sched = %+v; want %+v", got, want)
+	}
+
+	cmd = &catpogs.Command{IOClass: catalog.Exec_Command_IoClass_idle, IOLevel: 3}
+	if err := Apply(ctx, sys, newCatalog(cmd), &Options{Log: testLogger{t: t}}); err != nil {
+		t.Error("Apply:", err)
+	}
+	want = &system.Sched{IOClass: system.IOClassIdle}
+	if got == nil || *got != *want {
+		t.Errorf("idle sched = %+v; want %+v", got, want)
+	}
+
+	for _, cmd := range []*catpogs.Command{{Nice: 20}, {IOClass: catalog.Exec_Command_IoClass_realtime, IOLevel: 8}, {OOMScoreAdj: -1001}} {
+		ran = false
+		if err := Apply(ctx, sys, newCatalog(cmd), &Options{Log: testLogger{t: t}}); err == nil {
+			t.Errorf("Apply with %+v did not return an error", cmd)
+		}
+		if ran {
+			t.Errorf("Apply with %+v ran the command", cmd)
+		}
+	}
+}
+
+func TestRunID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:    1,
+				Which: catalog.Resource_Which_file,
+				File:  catpogs.PlainFile(filepath.Join(fakesystem.Root, "foo.txt"), []byte("Hello")),
+			},
+			{
+				ID:    2,
+				Deps:  []uint64{1},
+				Which: catalog.Resource_Which_file,
+				File:  catpogs.PlainFile(filepath.Join(fakesystem.Root, "bar.txt"), []byte("World")),
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	log := &recordLogger{t: t}
+	report := new(Report)
+	err = Apply(ctx, new(fakesystem.System), cat, &Options{Log: log, RunID: "run-1", Report: report})
+	if err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if report.RunID != "run-1" {
+		t.Errorf("report.RunID = %q; want %q", report.RunID, "run-1")
+	}
+	spans := make(map[uint64]string)
+	for _, rr := range report.Resources {
+		if rr.SpanID == "" {
+			t.Errorf("report for resource %d has no span ID", rr.ID)
+		}
+		spans[rr.ID] = rr.SpanID
+	}
+	if spans[1] == spans[2] {
+		t.Errorf("resources 1 and 2 have the same span ID %q", spans[1])
+	}
+	if len(log.events) == 0 {
+		t.Fatal("no events logged")
+	}
+	for _, id := range log.runIDs {
+		if id != "run-1" {
+			t.Errorf("message logged with run ID %q; want %q", id, "run-1")
+		}
+	}
+	for _, ev := range log.events {
+		if ev.SpanID != spans[ev.ResourceID] {
+			t.Errorf("%s event for resource %d has span ID %q; want %q", ev.Kind, ev.ResourceID, ev.SpanID, spans[ev.ResourceID])
+		}
+	}
+
+	report2 := new(Report)
+	if err := Apply(ctx, new(fakesystem.System), cat, &Options{Log: testLogger{t: t}, Report: report2}); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if report2.RunID == "" || report2.RunID == report.RunID {
+		t.Errorf("generated run ID = %q; want a new, non-empty ID", report2.RunID)
+	}
+}
+
+func TestUmask(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defaultPath := filepath.Join(fakesystem.Root, "default.txt")
+	explicitPath := filepath.Join(fakesystem.Root, "explicit.txt")
+	dirPath := filepath.Join(fakesystem.Root, "dir")
+	explicit := catpogs.PlainFile(explicitPath, []byte("Hello"))
+	explicit.Plain.Mode = &catpogs.FileMode{Bits: 0664}
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "default",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(defaultPath, []byte("Hello")),
+			},
+			{
+				ID:      2,
+				Comment: "explicit",
+				Which:   catalog.Resource_Which_file,
+				File:    explicit,
+			},
+			{
+				ID:      3,
+				Comment: "dir",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.Directory(dirPath, nil),
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	sys.Umask(0077)
+	umask := os.FileMode(0022)
+	err = Apply(ctx, sys, cat, &Options{
+		Log:   testLogger{t: t},
+		Umask: &umask,
+	})
+	if err != nil {
+		t.Error("Apply:", err)
+	}
+	tests := []struct {
+		path string
+		mode os.FileMode
+	}{
+		{defaultPath, 0644},
+		{explicitPath, 0664},
+		{dirPath, os.ModeDir | 0755},
+	}
+	for _, test := range tests {
+		info, err := sys.Lstat(ctx, test.path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if info.Mode() != test.mode {
+			t.Errorf("mode of %s = %v; want %v", test.path, info.Mode(), test.mode)
+		}
+	}
+	if old := sys.Umask(0); old != 0077 {
+		t.Errorf("umask after Apply = %03o; want 077", old)
+	}
+}
+
+func TestMaxOutput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	noisyPath := filepath.Join(fakesystem.Root, "noisy")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "noisy",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{noisyPath},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	err = sys.Mkprogram(noisyPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		io.WriteString(pc.Output, "START")
+		pc.Output.Write(bytes.Repeat([]byte{'.'}, 10000))
+		io.WriteString(pc.Output, "END")
+		return 1
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	log := &recordLogger{t: t}
+	err = Apply(ctx, sys, cat, &Options{
+		Log:       log,
+		MaxOutput: 100,
+	})
+	if err == nil {
+		t.Error("Apply did not return an error")
+	}
+	if len(log.errs) != 1 {
+		t.Fatalf("logged %d errors; want 1", len(log.errs))
+	}
+	e, ok := log.errs[0].(*Error)
+	if !ok {
+		t.Fatalf("logged error = %#v; want *Error", log.errs[0])
+	}
+	out := string(e.Output)
+	if len(out) > 200 || !strings.HasPrefix(out, "START") || !strings.HasSuffix(out, "END") || !strings.Contains(out, "bytes omitted") {
+		t.Errorf("error output = %q; want truncated output with head and tail", out)
+	}
+}
+
+func TestVerboseMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echoPath := filepath.Join(fakesystem.Root, "echo")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "exec",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{echoPath, "main"},
+					},
+					Condition: catpogs.ExecCondition{
+						Which: catalog.Exec_condition_Which_onlyIf,
+						OnlyIf: &catpogs.Command{
+							Which: catalog.Exec_Command_Which_argv,
+							Argv:  []string{echoPath, "check"},
+						},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	err = sys.Mkprogram(echoPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		fmt.Fprintf(pc.Output, "said %s\n", pc.Args[1])
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	log := &recordLogger{t: t}
+	if err := Apply(ctx, sys, cat, &Options{Log: log}); err != nil {
+		t.Error("Apply:", err)
+	}
+	tests := []struct {
+		v      Verbosity
+		substr string
+	}{
+		{Verbose, "onlyIf condition: running command"},
+		{VeryVerbose, "said check"},
+		{VeryVerbose, "said main"},
+	}
+	for _, test := range tests {
+		found := false
+		for _, m := range log.debug {
+			if strings.Contains(m.msg, test.substr) {
+				found = true
+				if m.v != test.v {
+					t.Errorf("message %q logged at verbosity %d; want %d", m.msg, m.v, test.v)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("no debug message containing %q", test.substr)
+		}
+	}
+}
+
+func TestExecConditionTrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	checkPath := filepath.Join(fakesystem.Root, "check")
+	stampPath := filepath.Join(fakesystem.Root, "stamp")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "exec",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{checkPath, "main"},
+					},
+					Condition: catpogs.ExecCondition{
+						Which: catalog.Exec_condition_Which_unless,
+						Unless: &catpogs.Command{
+							Which: catalog.Exec_Command_Which_argv,
+							Argv:  []string{checkPath, "installed"},
+						},
+					},
+					Creates: stampPath,
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	err = sys.Mkprogram(checkPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		if pc.Args[1] == "installed" {
+			fmt.Fprintln(pc.Output, "not installed")
+			return 1
+		}
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	report := new(Report)
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	rr := report.Resource(42)
+	if rr == nil {
+		t.Fatal("resource 42 not in report")
+	}
+	if len(rr.Conditions) != 2 {
+		t.Fatalf("len(Conditions) = %d; want 2", len(rr.Conditions))
+	}
+	if c := rr.Conditions[0]; c.Condition != "creates" || !c.Run || c.Detail != stampPath+" does not exist" {
+		t.Errorf("Conditions[0] = %+v; want creates with run and detail %q", c, stampPath+" does not exist")
+	}
+	c := rr.Conditions[1]
+	if c.Condition != "unless" || !c.Run {
+		t.Errorf("Conditions[1] = %+v; want unless with run", c)
+	}
+	if want := []string{checkPath, "installed"}; !reflect.DeepEqual(c.Argv, want) {
+		t.Errorf("Conditions[1].Argv = %q; want %q", c.Argv, want)
+	}
+	if c.ExitCode == nil || *c.ExitCode == 0 {
+		t.Errorf("Conditions[1].ExitCode = %v; want non-zero", c.ExitCode)
+	}
+	if c.Output != "not installed\n" {
+		t.Errorf("Conditions[1].Output = %q; want %q", c.Output, "not installed\n")
+	}
+}
+
+func TestCriticalPath(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 1 is independent, and 3 depends on 2.
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_noop},
+			{ID: 2, Which: catalog.Resource_Which_noop},
+			{ID: 3, Deps: []uint64{2}, Which: catalog.Resource_Which_noop},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	tests := []struct {
+		name  string
+		opts  Options
+		first uint64
+	}{
+		{name: "catalog order", first: 1},
+		{name: "critical path", opts: Options{CriticalPath: true}, first: 2},
+		{
+			name: "weighted critical path",
+			opts: Options{
+				CriticalPath: true,
+				State: &state.State{Durations: map[uint64]*state.DurationStats{
+					1: {Average: 10 * time.Second, Samples: 1},
+					2: {Average: time.Millisecond, Samples: 1},
+					3: {Average: time.Millisecond, Samples: 1},
+				}},
+			},
+			first: 1,
+		},
+	}
+	for _, test := range tests {
+		opts := test.opts
+		opts.Log = &recordLogger{t: t}
+		opts.Report = new(Report)
+		if err := Apply(ctx, new(fakesystem.System), cat, &opts); err != nil {
+			t.Errorf("%s: Apply: %v", test.name, err)
+			continue
+		}
+		if len(opts.Report.Resources) != 3 {
+			t.Errorf("%s: report has %d resources; want 3", test.name, len(opts.Report.Resources))
+			continue
+		}
+		if id := opts.Report.Resources[0].ID; id != test.first {
+			t.Errorf("%s: first resource applied = %d; want %d", test.name, id, test.first)
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := new(catpogs.Catalog)
+	for i := uint64(1); i <= 20; i++ {
+		c.Resources = append(c.Resources, &catpogs.Resource{ID: i, Which: catalog.Resource_Which_noop})
+	}
+	cat, err := c.ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	order := func(seed int64) []uint64 {
+		report := new(Report)
+		opts := &Options{Log: testLogger{t: t}, Report: report, Seed: seed}
+		if err := Apply(ctx, new(fakesystem.System), cat, opts); err != nil {
+			t.Fatalf("Apply with seed %d: %v", seed, err)
+		}
+		if report.Seed != seed {
+			t.Errorf("report.Seed = %d; want %d", report.Seed, seed)
+		}
+		ids := make([]uint64, len(report.Resources))
+		for i, rr := range report.Resources {
+			ids[i] = rr.ID
+		}
+		return ids
+	}
+	catalogOrder := order(0)
+	for i, id := range catalogOrder {
+		if id != uint64(i+1) {
+			t.Fatalf("order with seed 0 = %v; want catalog order", catalogOrder)
+		}
+	}
+	first, again := order(42), order(42)
+	if !uint64sEqual(first, again) {
+		t.Errorf("order with seed 42 = %v, then %v; want same order", first, again)
+	}
+	if uint64sEqual(first, catalogOrder) {
+		t.Errorf("order with seed 42 = %v; want shuffled", first)
+	}
+}
+
+func TestTagLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sys := new(fakesystem.System)
+	var mu sync.Mutex
+	running := make(map[string]int)
+	peak := make(map[string]int)
+	for _, tag := range []string{"apt", "download", "other"} {
+		tag := tag
+		err := sys.Mkprogram(filepath.Join(fakesystem.Root, tag), func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+			mu.Lock()
+			running[tag]++
+			if running[tag] > peak[tag] {
+				peak[tag] = running[tag]
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running[tag]--
+			mu.Unlock()
+			return 0
+		})
+		if err != nil {
+			t.Fatal("Mkprogram:", err)
+		}
+	}
+	c := new(catpogs.Catalog)
+	id := uint64(1)
+	for _, tag := range []string{"apt", "download", "other"} {
+		for i := 0; i < 4; i++ {
+			res := &catpogs.Resource{
+				ID:    id,
+				Which: catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{filepath.Join(fakesystem.Root, tag)},
+					},
+				},
+			}
+			if tag != "other" {
+				res.Tags = []string{tag}
+			}
+			c.Resources = append(c.Resources, res)
+			id++
+		}
+	}
+	cat, err := c.ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	err = Apply(ctx, sys, cat, &Options{
+		Log:            testLogger{t: t},
+		ConcurrentJobs: 12,
+		TagLimits:      map[string]int{"apt": 1, "download": 2},
+	})
+	if err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if peak["apt"] != 1 {
+		t.Errorf("ran %d apt resources at once; want 1", peak["apt"])
+	}
+	if peak["download"] < 1 || peak["download"] > 2 {
+		t.Errorf("ran %d download resources at once; want 1 or 2", peak["download"])
+	}
+	if peak["other"] < 2 {
+		t.Errorf("ran %d untagged resources at once; want them in parallel", peak["other"])
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	tests := []struct {
+		limit    int64
+		wantPeak int
+	}{
+		{limit: 2500, wantPeak: 2},
+		{limit: 500, wantPeak: 1},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		sys := new(fakesystem.System)
+		var mu sync.Mutex
+		running, peak, runs := 0, 0, 0
+		progPath := filepath.Join(fakesystem.Root, "prog")
+		err := sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+			mu.Lock()
+			running++
+			runs++
+			if running > peak {
+				peak = running
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return 0
+		})
+		if err != nil {
+			cancel()
+			t.Fatal("Mkprogram:", err)
+		}
+		c := new(catpogs.Catalog)
+		for id := uint64(1); id <= 6; id++ {
+			c.Resources = append(c.Resources, &catpogs.Resource{
+				ID:    id,
+				Which: catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{progPath},
+					},
+				},
+			})
+		}
+		cat, err := c.ToCapnp()
+		if err != nil {
+			cancel()
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		err = Apply(ctx, sys, cat, &Options{
+			Log:            testLogger{t: t},
+			ConcurrentJobs: 6,
+			MaxOutput:      1000,
+			MemoryLimit:    test.limit,
+		})
+		cancel()
+		if err != nil {
+			t.Errorf("limit %d: Apply: %v", test.limit, err)
+			continue
+		}
+		if runs != 6 {
+			t.Errorf("limit %d: ran %d commands; want 6", test.limit, runs)
+		}
+		if peak != test.wantPeak {
+			t.Errorf("limit %d: ran %d commands at once; want %d", test.limit, peak, test.wantPeak)
+		}
+	}
+}
+
+func TestPause(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sys := new(fakesystem.System)
+	pauser := new(Pauser)
+	firstPath := filepath.Join(fakesystem.Root, "first")
+	secondPath := filepath.Join(fakesystem.Root, "second")
+	var mu sync.Mutex
+	var ran []string
+	err := sys.Mkprogram(firstPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		// Pausing while a resource runs lets that resource finish.
+		pauser.Pause()
+		mu.Lock()
+		ran = append(ran, "first")
+		mu.Unlock()
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	err = sys.Mkprogram(secondPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		mu.Lock()
+		ran = append(ran, "second")
+		mu.Unlock()
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:    1,
+				Which: catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{firstPath},
+					},
+				},
+			},
+			{
+				ID:    2,
+				Deps:  []uint64{1},
+				Which: catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{secondPath},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Pauser: pauser})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Apply returned %v while paused", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !pauser.Paused() {
+		t.Error("pauser.Paused() = false after Pause")
+	}
+	mu.Lock()
+	got := append([]string(nil), ran...)
+	mu.Unlock()
+	if want := []string{"first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %q while paused; want %q", got, want)
+	}
+
+	pauser.Resume()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Apply:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Apply did not finish after Resume")
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %q; want %q", ran, want)
+	}
+}
+
+func uint64sEqual(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	installPath := filepath.Join(fakesystem.Root, "install")
+	falsePath := filepath.Join(fakesystem.Root, "false")
+	pkg := func(id uint64, name string, unless bool) *catpogs.Resource {
+		e := &catpogs.Exec{
+			Command: &catpogs.Command{
+				Which: catalog.Exec_Command_Which_argv,
+				Argv:  []string{installPath, "-y"},
+			},
+		}
+		if unless {
+			e.Condition = catpogs.ExecCondition{
+				Which: catalog.Exec_condition_Which_unless,
+				Unless: &catpogs.Command{
+					Which: catalog.Exec_Command_Which_argv,
+					Argv:  []string{falsePath},
+				},
+			}
+		}
+		e.Batch.Key = "pkg"
+		e.Batch.Args = []string{name}
+		return &catpogs.Resource{ID: id, Which: catalog.Resource_Which_exec, Exec: e}
+	}
+	other := pkg(4, "other", false)
+	other.Exec.Command.Argv = []string{installPath, "-q"}
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			pkg(1, "a", false),
+			pkg(2, "b", true),
+			pkg(3, "c", false),
+			other,
+			pkg(5, "later", false),
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	// Make 5 depend on 1 so it can't join the first batch.
+	res, _ := cat.Resources()
+	deps, _ := res.At(4).NewDependencies(1)
+	deps.Set(0, 1)
+
+	sys := new(fakesystem.System)
+	var calls [][]string
+	err = sys.Mkprogram(installPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		calls = append(calls, pc.Args[1:])
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	if err := sys.Mkprogram(falsePath, func(ctx context.Context, pc *fakesystem.ProgramContext) int { return 1 }); err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	report := new(Report)
+	err = Apply(ctx, sys, cat, &Options{Log: &recordLogger{t: t}, Report: report})
+	if err != nil {
+		t.Error("Apply:", err)
+	}
+	want := [][]string{
+		{"-y", "a", "b", "c"},
+		{"-q", "other"},
+		{"-y", "later"},
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("install calls = %q; want %q", calls, want)
+	}
+	if report.Summary == nil || report.Summary.Changed != 5 {
+		t.Errorf("summary = %v; want 5 changed", report.Summary)
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	serverPath := filepath.Join(fakesystem.Root, "server")
+	crashPath := filepath.Join(fakesystem.Root, "crash")
+	newCatalog := func(t *testing.T, path string) catalog.Catalog {
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:      42,
+					Comment: "server",
+					Which:   catalog.Resource_Which_exec,
+					Exec: &catpogs.Exec{
+						Command: &catpogs.Command{
+							Which: catalog.Exec_Command_Which_argv,
+							Argv:  []string{path},
+						},
+						Supervise: &catpogs.Supervise{
+							ReadyAddress:       "localhost:8080",
+							ReadyTimeoutMillis: 5000,
+						},
+					},
+				},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		return cat
+	}
+	newSystem := func(t *testing.T, stopped chan<- struct{}) *fakesystem.System {
+		sys := new(fakesystem.System)
+		err := sys.Mkprogram(serverPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+			sys.OpenPort("tcp", "localhost:8080")
+			<-ctx.Done()
+			close(stopped)
+			return 0
+		})
+		if err != nil {
+			t.Fatal("Mkprogram:", err)
+		}
+		err = sys.Mkprogram(crashPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+			io.WriteString(pc.Output, "bad config")
+			return 1
+		})
+		if err != nil {
+			t.Fatal("Mkprogram:", err)
+		}
+		return sys
+	}
+
+	t.Run("Ready", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stopped := make(chan struct{})
+		sys := newSystem(t, stopped)
+		sup := new(Supervisor)
+		report := new(Report)
+		err := Apply(ctx, sys, newCatalog(t, serverPath), &Options{
+			Log:        &recordLogger{t: t},
+			Report:     report,
+			Supervisor: sup,
+		})
+		if err != nil {
+			t.Error("Apply:", err)
+		}
+		if report.Summary == nil || report.Summary.Changed != 1 {
+			t.Errorf("summary = %v; want 1 changed", report.Summary)
+		}
+		if n := sup.Len(); n != 1 {
+			t.Fatalf("sup.Len() = %d; want 1", n)
+		}
+		select {
+		case <-stopped:
+			t.Fatal("server stopped before sup.Stop")
+		default:
+		}
+		if err := sup.Stop(); err != nil {
+			t.Error("sup.Stop:", err)
+		}
+		select {
+		case <-stopped:
+		default:
+			t.Error("server still running after sup.Stop")
+		}
+	})
+	t.Run("ExitBeforeReady", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sys := newSystem(t, make(chan struct{}))
+		sup := new(Supervisor)
+		log := &recordLogger{t: t}
+		err := Apply(ctx, sys, newCatalog(t, crashPath), &Options{
+			Log:        log,
+			Supervisor: sup,
+		})
+		if err == nil {
+			t.Error("Apply did not return an error")
+		}
+		if n := sup.Len(); n != 0 {
+			t.Errorf("sup.Len() = %d; want 0", n)
+		}
+		if len(log.errs) != 1 {
+			t.Fatalf("logged %d errors; want 1", len(log.errs))
+		}
+		if e, ok := log.errs[0].(*Error); !ok || string(e.Output) != "bad config" {
+			t.Errorf("logged error = %#v; want *Error with output \"bad config\"", log.errs[0])
+		}
+	})
+	t.Run("NoSupervisor", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sys := newSystem(t, make(chan struct{}))
+		err := Apply(ctx, sys, newCatalog(t, serverPath), &Options{
+			Log: &recordLogger{t: t},
+		})
+		if err == nil {
+			t.Error("Apply did not return an error")
+		}
+	})
+}
+
+func TestHealthCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	touchPath := filepath.Join(fakesystem.Root, "touch")
+	canaryPath := filepath.Join(fakesystem.Root, "canary")
+	tests := []struct {
+		name    string
+		check   catpogs.HealthCheck
+		healthy bool
+	}{
+		{
+			name:    "open port",
+			check:   catpogs.HealthCheck{Which: catalog.HealthCheck_Which_tcpAddress, TCPAddress: "localhost:5432"},
+			healthy: true,
+		},
+		{
+			name:  "closed port",
+			check: catpogs.HealthCheck{Which: catalog.HealthCheck_Which_tcpAddress, TCPAddress: "localhost:5433"},
+		},
+		{
+			name:    "HTTP OK",
+			check:   catpogs.HealthCheck{Which: catalog.HealthCheck_Which_httpUrl, HTTPURL: srv.URL + "/healthz"},
+			healthy: true,
+		},
+		{
+			name:  "HTTP not found",
+			check: catpogs.HealthCheck{Which: catalog.HealthCheck_Which_httpUrl, HTTPURL: srv.URL + "/missing"},
+		},
+	}
+	for _, test := range tests {
+		hc := test.check
+		hc.TimeoutMillis = 300
+		hc.BackoffMillis = 10
+		newSystem := func() system.System {
+			sys := new(fakesystem.System)
+			sys.OpenPort("tcp", "localhost:5432")
+			err := sys.Mkprogram(touchPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+				if err := system.WriteFile(ctx, sys, canaryPath, nil, 0666); err != nil {
+					return 1
+				}
+				return 0
+			})
+			if err != nil {
+				t.Fatal("Mkprogram:", err)
+			}
+			return netSystem{sys, srv.Listener.Addr().String()}
+		}
+
+		// As a resource
+		ctx, cancel := context.WithCancel(context.Background())
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{ID: 1, Which: catalog.Resource_Which_healthCheck, HealthCheck: &hc},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		err = Apply(ctx, newSystem(), cat, &Options{Log: &recordLogger{t: t}})
+		if test.healthy && err != nil {
+			t.Errorf("%s: resource: Apply: %v", test.name, err)
+		} else if !test.healthy && err == nil {
+			t.Errorf("%s: resource: Apply did not return an error", test.name)
+		}
+
+		// As a condition
+		cat, err = (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:    1,
+					Which: catalog.Resource_Which_exec,
+					Exec: &catpogs.Exec{
+						Condition: catpogs.ExecCondition{
+							Which:   catalog.Exec_condition_Which_healthy,
+							Healthy: &hc,
+						},
+						Command: &catpogs.Command{
+							Which: catalog.Exec_Command_Which_argv,
+							Argv:  []string{touchPath},
+						},
+					},
+				},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		sys := newSystem()
+		if err := Apply(ctx, sys, cat, &Options{Log: &recordLogger{t: t}}); err != nil {
+			t.Errorf("%s: condition: Apply: %v", test.name, err)
+		}
+		_, err = sys.Lstat(ctx, canaryPath)
+		if ran := err == nil; ran != test.healthy {
+			t.Errorf("%s: condition: command ran = %t; want %t", test.name, ran, test.healthy)
+		}
+		cancel()
+	}
+}
+
+func TestSkipHealthChecks(t *testing.T) {
+	ctx := context.Background()
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:    1,
+				Which: catalog.Resource_Which_healthCheck,
+				HealthCheck: &catpogs.HealthCheck{
+					Which:         catalog.HealthCheck_Which_httpUrl,
+					HTTPURL:       "http://localhost:8080/healthz",
+					TimeoutMillis: 60000,
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	start := time.Now()
+	err = Apply(ctx, new(fakesystem.System), cat, &Options{Log: &recordLogger{t: t}, SkipHealthChecks: true})
+	if err != nil {
+		t.Errorf("Apply: %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Apply took %v; want health check skipped", d)
+	}
+}
+
+// netSystem is a System that dials a real address for a test HTTP
+// server and fakes all other addresses.
+type netSystem struct {
+	*fakesystem.System
+	httpAddr string
+}
+
+func (sys netSystem) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if address == sys.httpAddr {
+		return new(net.Dialer).DialContext(ctx, network, address)
+	}
+	return sys.System.DialContext(ctx, network, address)
+}
+
+func TestUntil(t *testing.T) {
+	probePath := filepath.Join(fakesystem.Root, "probe")
+	touchPath := filepath.Join(fakesystem.Root, "touch")
+	canaryPath := filepath.Join(fakesystem.Root, "canary")
+	readyPath := filepath.Join(fakesystem.Root, "ready")
+	tests := []struct {
+		name   string
+		until  catpogs.Until
+		passes bool
+	}{
+		{
+			name: "command passes",
+			until: catpogs.Until{
+				Which: catalog.Exec_Until_Which_command,
+				Command: &catpogs.Command{
+					Which: catalog.Exec_Command_Which_argv,
+					Argv:  []string{probePath},
+				},
+			},
+			passes: true,
+		},
+		{
+			name: "file appears",
+			until: catpogs.Until{
+				Which:      catalog.Exec_Until_Which_fileExists,
+				FileExists: readyPath,
+			},
+			passes: true,
+		},
+		{
+			name: "file never appears",
+			until: catpogs.Until{
+				Which:      catalog.Exec_Until_Which_fileExists,
+				FileExists: filepath.Join(fakesystem.Root, "never"),
+			},
+		},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		u := test.until
+		u.IntervalMillis = 5
+		u.TimeoutMillis = 300
+		sys := new(fakesystem.System)
+		probes := 0
+		err := sys.Mkprogram(probePath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+			// Pass on the third try.
+			if probes++; probes < 3 {
+				return 1
+			}
+			return 0
+		})
+		if err != nil {
+			t.Fatal("Mkprogram:", err)
+		}
+		err = sys.Mkprogram(touchPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+			if err := system.WriteFile(ctx, sys, canaryPath, nil, 0666); err != nil {
+				return 1
+			}
+			return 0
+		})
+		if err != nil {
+			t.Fatal("Mkprogram:", err)
+		}
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			system.WriteFile(ctx, sys, readyPath, nil, 0666)
+		}()
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:    1,
+					Which: catalog.Resource_Which_exec,
+					Exec: &catpogs.Exec{
+						Condition: catpogs.ExecCondition{
+							Which: catalog.Exec_condition_Which_until,
+							Until: &u,
+						},
+						Command: &catpogs.Command{
+							Which: catalog.Exec_Command_Which_argv,
+							Argv:  []string{touchPath},
+						},
+					},
+				},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		err = Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}})
+		_, statErr := sys.Lstat(ctx, canaryPath)
+		if test.passes {
+			if err != nil {
+				t.Errorf("%s: Apply: %v", test.name, err)
+			}
+			if statErr != nil {
+				t.Errorf("%s: command not run after probe passed: %v", test.name, statErr)
+			}
+		} else {
+			if err == nil {
+				t.Errorf("%s: Apply did not return an error", test.name)
+			}
+			if !os.IsNotExist(statErr) {
+				t.Errorf("%s: command run even though probe did not pass", test.name)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestExpect(t *testing.T) {
+	checkPath := filepath.Join(fakesystem.Root, "check")
+	tests := []struct {
+		name      string
+		output    string
+		exit      int
+		pattern   string
+		exitCodes []uint32
+		passes    bool
+	}{
+		{
+			name:    "output matches",
+			output:  "status: ok\n",
+			pattern: `(?m)^status: ok$`,
+			passes:  true,
+		},
+		{
+			name:    "output does not match",
+			output:  "status: degraded\n",
+			pattern: `(?m)^status: ok$`,
+		},
+		{
+			name:    "output matches but command fails",
+			output:  "status: ok\n",
+			exit:    1,
+			pattern: `status: ok`,
+		},
+		{
+			name:      "exit code in list",
+			exitCodes: []uint32{0, 2},
+			passes:    true,
+		},
+		{
+			name:      "exit code not in list",
+			exitCodes: []uint32{3},
+		},
+		{
+			name:    "invalid pattern",
+			pattern: `(`,
+		},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		sys := new(fakesystem.System)
+		err := sys.Mkprogram(checkPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+			io.WriteString(pc.Output, test.output)
+			return test.exit
+		})
+		if err != nil {
+			t.Fatal("Mkprogram:", err)
+		}
+		e := &catpogs.Exec{
+			Command: &catpogs.Command{
+				Which: catalog.Exec_Command_Which_argv,
+				Argv:  []string{checkPath},
+			},
+			Condition: catpogs.ExecCondition{Which: catalog.Exec_condition_Which_always},
+		}
+		e.Expect.OutputPattern = test.pattern
+		e.Expect.ExitCodes = test.exitCodes
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:    1,
+					Which: catalog.Resource_Which_exec,
+					Exec:  e,
+				},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		err = Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}})
+		if test.passes && err != nil {
+			t.Errorf("%s: Apply: %v", test.name, err)
+		}
+		if !test.passes && err == nil {
+			t.Errorf("%s: Apply did not return an error", test.name)
+		}
+	}
+}
+
+func TestResourceNames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	failPath := filepath.Join(fakesystem.Root, "fail")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				Name:    "setup",
+				Comment: "run setup",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{failPath},
+					},
+				},
+			},
+			{
+				Name:     "after",
+				DepNames: []string{"setup"},
+				Which:    catalog.Resource_Which_noop,
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	err = sys.Mkprogram(failPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		return 1
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	log := &recordLogger{t: t}
+	report := new(Report)
+	err = Apply(ctx, sys, cat, &Options{Log: log, Report: report})
+	if err == nil {
+		t.Error("Apply did not return an error")
+	}
+	if !log.contains("applying: setup") {
+		t.Error("no \"applying: setup\" message logged")
+	}
+	if len(log.errs) != 1 {
+		t.Fatalf("logged %d errors; want 1", len(log.errs))
+	}
+	if msg := log.errs[0].Error(); !strings.HasPrefix(msg, "apply setup: ") {
+		t.Errorf("logged error = %q; want it to start with \"apply setup: \"", msg)
+	}
+	for _, rr := range report.Resources {
+		if rr.Name == "" {
+			t.Errorf("report for id=%d has no name", rr.ID)
+		}
+	}
+}
+
+func TestResourceOwner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	failPath := filepath.Join(fakesystem.Root, "fail")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				Name:   "migrate",
+				Owner:  "db-oncall",
+				DocURL: "https://wiki.example.com/runbooks/migrate",
+				Which:  catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{failPath},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	err = sys.Mkprogram(failPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		return 1
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	log := &recordLogger{t: t}
+	report := new(Report)
+	if err := Apply(ctx, sys, cat, &Options{Log: log, Report: report}); err == nil {
+		t.Error("Apply did not return an error")
+	}
+	if len(log.errs) != 1 {
+		t.Fatalf("logged %d errors; want 1", len(log.errs))
+	}
+	const want = "[owner: db-oncall, docs: https://wiki.example.com/runbooks/migrate]"
+	if msg := log.errs[0].Error(); !strings.Contains(msg, want) {
+		t.Errorf("logged error = %q; want it to contain %q", msg, want)
+	}
+	if len(report.Resources) != 1 {
+		t.Fatalf("report has %d resources; want 1", len(report.Resources))
+	}
+	if rr := report.Resources[0]; rr.Owner != "db-oncall" || rr.DocURL != "https://wiki.example.com/runbooks/migrate" {
+		t.Errorf("report owner, doc URL = %q, %q; want \"db-oncall\", \"https://wiki.example.com/runbooks/migrate\"", rr.Owner, rr.DocURL)
+	}
+}
+
+func mkdirAll(ctx context.Context, sys *fakesystem.System, path string) error {
+	if parent := filepath.Dir(path); parent != path {
+		if err := mkdirAll(ctx, sys, parent); err != nil {
+			return err
+		}
+	}
+	if err := sys.Mkdir(ctx, path, 0777); err != nil && !system.IsExist(err) {
+		return fmt.Errorf("mkdir %s: %v", path, err)
+	}
+	return nil
+}
+
 type fixtureFactory struct {
 	concurrentJobs int
 }
 
-type fixture struct {
-	sys            *fakesystem.System
-	log            applytests.Logger
-	info           *applytests.SystemInfo
-	concurrentJobs int
+type fixture struct {
+	sys            *fakesystem.System
+	log            applytests.Logger
+	info           *applytests.SystemInfo
+	concurrentJobs int
+}
+
+func (ff *fixtureFactory) newFixture(ctx context.Context, log applytests.Logger, name string) (applytests.Fixture, error) {
+	sys := new(fakesystem.System)
+	binPath := filepath.Join(fakesystem.Root, "mybin")
+	info := &applytests.SystemInfo{
+		Root:      filepath.Join(fakesystem.Root, "subdir"),
+		TruePath:  filepath.Join(binPath, "true"),
+		FalsePath: filepath.Join(binPath, "false"),
+		TouchPath: filepath.Join(binPath, "touch"),
+	}
+	if err := sys.Mkdir(ctx, binPath, 0755); err != nil {
+		return nil, err
+	}
+	if err := sys.Mkdir(ctx, info.Root, 0755); err != nil {
+		return nil, err
+	}
+	err := sys.Mkprogram(info.TruePath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sys.Mkprogram(info.FalsePath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		return 1
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = sys.Mkprogram(info.TouchPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		if len(pc.Args) != 2 {
+			fmt.Fprintln(pc.Output, "usage: touch FILE")
+			return 1
+		}
+		w, err := sys.CreateFile(ctx, pc.Args[1], 0666)
+		if err != nil {
+			fmt.Fprintln(pc.Output, "touch:", err)
+			return 1
+		}
+		if err := w.Close(); err != nil {
+			fmt.Fprintln(pc.Output, "touch:", err)
+			return 1
+		}
+		return 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fixture{
+		sys:            sys,
+		log:            log,
+		info:           info,
+		concurrentJobs: ff.concurrentJobs,
+	}, nil
+}
+
+func (f *fixture) Apply(ctx context.Context, c catalog.Catalog) error {
+	return Apply(ctx, f.sys, c, &Options{
+		Log:            testLogger{t: f.log},
+		ConcurrentJobs: f.concurrentJobs,
+	})
+}
+
+func (f *fixture) System() system.System {
+	return f.sys
+}
+
+func (f *fixture) SystemInfo() *applytests.SystemInfo {
+	return f.info
+}
+
+func (f *fixture) Close() error {
+	return nil
+}
+
+type testLogger struct {
+	t applytests.Logger
+}
+
+func (tl testLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	tl.t.Logf("applier info: "+format, args...)
+}
+
+func (tl testLogger) Error(ctx context.Context, err error) {
+	tl.t.Logf("applier error: %v", err)
+}
+
+// recordLogger is a testLogger that also saves its info messages.
+type recordLogger struct {
+	t applytests.Logger
+
+	mu     sync.Mutex
+	msgs   []string
+	debug  []debugMessage
+	errs   []error
+	events []*Event
+	runIDs []string
+}
+
+type debugMessage struct {
+	v   Verbosity
+	msg string
+}
+
+func (rl *recordLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	rl.t.Logf("applier info: %s", msg)
+	rl.mu.Lock()
+	rl.msgs = append(rl.msgs, msg)
+	rl.runIDs = append(rl.runIDs, RunIDFromContext(ctx))
+	if ev := EventFromContext(ctx); ev != nil {
+		rl.events = append(rl.events, ev)
+	}
+	rl.mu.Unlock()
+}
+
+func (rl *recordLogger) Debugf(ctx context.Context, v Verbosity, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	rl.t.Logf("applier debug(%d): %s", v, msg)
+	rl.mu.Lock()
+	rl.debug = append(rl.debug, debugMessage{v, msg})
+	rl.runIDs = append(rl.runIDs, RunIDFromContext(ctx))
+	if ev := EventFromContext(ctx); ev != nil {
+		rl.events = append(rl.events, ev)
+	}
+	rl.mu.Unlock()
+}
+
+func (rl *recordLogger) Error(ctx context.Context, err error) {
+	rl.t.Logf("applier error: %v", err)
+	rl.mu.Lock()
+	rl.errs = append(rl.errs, err)
+	rl.runIDs = append(rl.runIDs, RunIDFromContext(ctx))
+	if ev := EventFromContext(ctx); ev != nil {
+		rl.events = append(rl.events, ev)
+	}
+	rl.mu.Unlock()
+}
+
+func (rl *recordLogger) contains(substr string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, msg := range rl.msgs {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestContentURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/motd" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("Hello from the server!\n"))
+	}))
+	defer srv.Close()
+
+	motdPath := filepath.Join(fakesystem.Root, "etc", "motd")
+	fileCatalog := func(f *catpogs.File) catalog.Catalog {
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{ID: 1, Which: catalog.Resource_Which_file, File: f},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		return cat
+	}
+	ctx := context.Background()
+	sys := new(fakesystem.System)
+	if err := sys.Mkdir(ctx, filepath.Dir(motdPath), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	f := catpogs.PlainFile(motdPath, nil)
+	f.Plain.ContentURL = srv.URL + "/motd"
+	cat := fileCatalog(f)
+	for _, wantStatus := range []ResourceStatus{StatusChanged, StatusUnchanged} {
+		report := new(Report)
+		if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+			t.Errorf("Apply: %v", err)
+		}
+		if len(report.Resources) != 1 || report.Resources[0].Status != wantStatus {
+			t.Errorf("report.Resources = %+v; want one %s resource", report.Resources, wantStatus)
+		}
+	}
+	if got, err := system.ReadFile(ctx, sys, motdPath); err != nil {
+		t.Error(err)
+	} else if string(got) != "Hello from the server!\n" {
+		t.Errorf("%s content = %q; want \"Hello from the server!\\n\"", motdPath, got)
+	}
+
+	f = catpogs.PlainFile(motdPath, nil)
+	f.Plain.ContentURL = srv.URL + "/missing"
+	if err := Apply(ctx, sys, fileCatalog(f), &Options{Log: testLogger{t: t}}); err == nil {
+		t.Error("Apply with missing content URL did not return an error")
+	}
+
+	f = catpogs.PlainFile(motdPath, []byte("inline\n"))
+	f.Plain.ContentURL = srv.URL + "/motd"
+	if err := Apply(ctx, sys, fileCatalog(f), &Options{Log: testLogger{t: t}}); err == nil {
+		t.Error("Apply with both content and contentUrl did not return an error")
+	}
+}
+
+func TestDriftWarning(t *testing.T) {
+	ctx := context.Background()
+	bigPath := filepath.Join(fakesystem.Root, "big")
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<17)
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_file, File: catpogs.PlainFile(bigPath, content)},
+			{ID: 2, Deps: []uint64{1}, Which: catalog.Resource_Which_noop},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	st := new(state.State)
+	apply := func(strict bool) (*Report, *recordLogger, error) {
+		report := new(Report)
+		log := &recordLogger{t: t}
+		err := Apply(ctx, sys, cat, &Options{Log: log, Report: report, State: st, Strict: strict})
+		return report, log, err
+	}
+	drift := func() {
+		junk := append([]byte(nil), content...)
+		junk[0] = 'X'
+		if err := system.WriteFile(ctx, sys, bigPath, junk, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := apply(false); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if report, _, err := apply(false); err != nil {
+		t.Fatal("Apply:", err)
+	} else if rr := report.Resource(1); rr == nil || len(rr.Warnings) != 0 {
+		t.Errorf("converged run report = %+v; want no warnings", rr)
+	}
+
+	drift()
+	report, log, err := apply(false)
+	if err != nil {
+		t.Error("Apply after drift:", err)
+	}
+	if rr := report.Resource(1); rr == nil || rr.Status != StatusChanged || len(rr.Warnings) != 1 {
+		t.Errorf("report after drift = %+v; want changed with 1 warning", rr)
+	}
+	if report.Summary.Warned != 1 {
+		t.Errorf("report.Summary.Warned = %d; want 1", report.Summary.Warned)
+	}
+	nwarn := 0
+	for _, ev := range log.events {
+		if ev.Kind == EventWarning {
+			nwarn++
+			if ev.ResourceID != 1 || ev.Warning == "" {
+				t.Errorf("warning event = %+v; want for resource 1 with a message", ev)
+			}
+		}
+	}
+	if nwarn != 1 {
+		t.Errorf("logged %d warning events; want 1", nwarn)
+	}
+
+	// Converge again so the hash is recorded, then drift under -strict.
+	if _, _, err := apply(false); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	drift()
+	report, _, err = apply(true)
+	if err == nil {
+		t.Error("strict Apply after drift did not return an error")
+	}
+	if rr := report.Resource(1); rr == nil || rr.Status != StatusFailed {
+		t.Errorf("strict report for resource 1 = %+v; want failed", rr)
+	}
+	if rr := report.Resource(2); rr == nil || rr.Status != StatusSkipped {
+		t.Errorf("strict report for resource 2 = %+v; want skipped", rr)
+	}
+}
+
+func TestCreateOnly(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(fakesystem.Root, "secret")
+	file := catpogs.PlainFile(path, []byte("generated\n"))
+	file.Plain.CreateOnly = true
+	file.Plain.Mode = &catpogs.FileMode{Bits: 0600}
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_file, File: file},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+
+	sys := new(fakesystem.System)
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}}); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if got, err := system.ReadFile(ctx, sys, path); err != nil {
+		t.Error(err)
+	} else if string(got) != "generated\n" {
+		t.Errorf("created file content = %q; want \"generated\\n\"", got)
+	}
+
+	sys = new(fakesystem.System)
+	if err := system.WriteFile(ctx, sys, path, []byte("existing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}}); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if got, err := system.ReadFile(ctx, sys, path); err != nil {
+		t.Error(err)
+	} else if string(got) != "existing\n" {
+		t.Errorf("existing file content = %q after Apply; want \"existing\\n\"", got)
+	}
+	if info, err := sys.Lstat(ctx, path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("existing file mode = %v after Apply; want 0600", info.Mode())
+	}
+}
+
+func TestCloneContentPath(t *testing.T) {
+	ctx := context.Background()
+	src := filepath.Join(fakesystem.Root, "artifact.orig")
+	dst := filepath.Join(fakesystem.Root, "artifact")
+	// Large enough to be cloned rather than copied.
+	content := bytes.Repeat([]byte("x"), 1<<20)
+	file := catpogs.PlainFile(dst, nil)
+	file.Plain.ContentPath = src
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_file, File: file},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	tests := []struct {
+		name     string
+		existing []byte
+		clones   int
+	}{
+		{name: "New", clones: 1},
+		{name: "Different", existing: []byte("old\n"), clones: 1},
+		{name: "Same", existing: content, clones: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sys := &cloneCountingSystem{System: new(fakesystem.System)}
+			if err := system.WriteFile(ctx, sys, src, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.existing != nil {
+				if err := system.WriteFile(ctx, sys, dst, test.existing, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}}); err != nil {
+				t.Fatal("Apply:", err)
+			}
+			if got, err := system.ReadFile(ctx, sys, dst); err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(got, content) {
+				t.Errorf("%s has %d bytes of content after Apply; want a copy of %s", dst, len(got), src)
+			}
+			if sys.clones != test.clones {
+				t.Errorf("CloneFile called %d times; want %d", sys.clones, test.clones)
+			}
+		})
+	}
+}
+
+// cloneCountingSystem counts the calls to CloneFile.
+type cloneCountingSystem struct {
+	*fakesystem.System
+	clones int
+}
+
+func (sys *cloneCountingSystem) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	sys.clones++
+	return sys.System.CloneFile(ctx, src, dst, mode)
+}
+
+func TestLockFiles(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(fakesystem.Root, "config")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_file, File: catpogs.PlainFile(path, []byte("new\n"))},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	if err := system.WriteFile(ctx, sys, path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := sys.Lock(ctx, path, 0644)
+	if err != nil {
+		t.Fatal("Lock:", err)
+	}
+
+	// Another process holds the lock, so the file is not rewritten.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	err = Apply(timeoutCtx, sys, cat, &Options{Log: testLogger{t: t}, LockFiles: true})
+	cancel()
+	if err == nil {
+		t.Error("Apply while file locked did not return an error")
+	}
+	if got, err := system.ReadFile(ctx, sys, path); err != nil {
+		t.Error(err)
+	} else if string(got) != "old\n" {
+		t.Errorf("content = %q after Apply while locked; want \"old\\n\"", got)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal("Unlock:", err)
+	}
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, LockFiles: true}); err != nil {
+		t.Error("Apply after unlock:", err)
+	}
+	if got, err := system.ReadFile(ctx, sys, path); err != nil {
+		t.Error(err)
+	} else if string(got) != "new\n" {
+		t.Errorf("content = %q after Apply; want \"new\\n\"", got)
+	}
+}
+
+func TestDeprecated(t *testing.T) {
+	ctx := context.Background()
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Deprecated: "use resource 2", Which: catalog.Resource_Which_noop},
+			{ID: 2, Replaces: []uint64{1}, Which: catalog.Resource_Which_noop},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	report := new(Report)
+	err = Apply(ctx, new(fakesystem.System), cat, &Options{Log: &recordLogger{t: t}, Report: report})
+	if err != nil {
+		t.Error("Apply:", err)
+	}
+	if rr := report.Resource(1); rr == nil || rr.Status != StatusUnchanged || len(rr.Warnings) != 1 || rr.Warnings[0] != "deprecated: use resource 2" {
+		t.Errorf("report for resource 1 = %+v; want unchanged with a deprecation warning", rr)
+	}
+	if rr := report.Resource(2); rr == nil || len(rr.Warnings) != 0 || len(rr.Replaces) != 1 || rr.Replaces[0] != 1 {
+		t.Errorf("report for resource 2 = %+v; want no warnings and Replaces = [1]", rr)
+	}
+
+	report = new(Report)
+	err = Apply(ctx, new(fakesystem.System), cat, &Options{Log: &recordLogger{t: t}, Report: report, Strict: true})
+	if err == nil {
+		t.Error("strict Apply did not return an error")
+	}
+	if rr := report.Resource(1); rr == nil || rr.Status != StatusFailed {
+		t.Errorf("strict report for resource 1 = %+v; want failed", rr)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	ctx := context.Background()
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_noop},
+		},
+		Metadata: &catpogs.Metadata{
+			Generator:    "mcm-luacat",
+			SourceRepo:   "https://example.com/config.git",
+			SourceCommit: "abc123",
+			BuildTime:    1496318400,
+			Author:       "alice",
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	report := new(Report)
+	log := &recordLogger{t: t}
+	if err := Apply(ctx, new(fakesystem.System), cat, &Options{Log: log, Report: report}); err != nil {
+		t.Error("Apply:", err)
+	}
+	const want = "mcm-luacat from https://example.com/config.git at abc123, built 2017-06-01T12:00:00Z by alice"
+	if len(report.Provenance) != 1 || report.Provenance[0].String() != want {
+		t.Errorf("report.Provenance = %v; want [%s]", report.Provenance, want)
+	}
+	found := false
+	for _, msg := range log.msgs {
+		if msg == "catalog: "+want {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("log = %q; want to contain %q", log.msgs, "catalog: "+want)
+	}
+
+	plain, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_noop},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	report = new(Report)
+	if err := ApplyAll(ctx, new(fakesystem.System), []catalog.Catalog{plain, cat}, &Options{Log: &recordLogger{t: t}, Report: report}); err != nil {
+		t.Error("ApplyAll:", err)
+	}
+	if len(report.Provenance) != 2 || report.Provenance[0] != nil || report.Provenance[1].String() != want {
+		t.Errorf("ApplyAll report.Provenance = %v; want [<nil> %s]", report.Provenance, want)
+	}
+}
+
+func TestHashCache(t *testing.T) {
+	ctx := context.Background()
+	bigPath := filepath.Join(fakesystem.Root, "big")
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<17)
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_file, File: catpogs.PlainFile(bigPath, content)},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := &openCountingSystem{System: new(fakesystem.System)}
+	st := new(state.State)
+	apply := func(wantStatus ResourceStatus) {
+		report := new(Report)
+		if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report, State: st}); err != nil {
+			t.Errorf("Apply: %v", err)
+		}
+		if len(report.Resources) != 1 || report.Resources[0].Status != wantStatus {
+			t.Errorf("report.Resources = %+v; want one %s resource", report.Resources, wantStatus)
+		}
+	}
+
+	apply(StatusChanged)
+	apply(StatusUnchanged)
+	if len(st.Hashes) != 1 || st.Hashes[bigPath] == nil {
+		t.Fatalf("after converged run, st.Hashes = %v; want an entry for %s", st.Hashes, bigPath)
+	}
+	sys.opens = 0
+	apply(StatusUnchanged)
+	if sys.opens != 0 {
+		t.Errorf("converged run with cached hash opened files %d times; want 0", sys.opens)
+	}
+
+	// Changing the file changes its modification time, so the cached
+	// hash is no longer trusted.
+	junk := append([]byte(nil), content...)
+	junk[0] = 'X'
+	if err := system.WriteFile(ctx, sys, bigPath, junk, 0666); err != nil {
+		t.Fatal(err)
+	}
+	apply(StatusChanged)
+	if got, err := system.ReadFile(ctx, sys, bigPath); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(got, content) {
+		t.Errorf("%s content not restored", bigPath)
+	}
+}
+
+func TestHashCacheFastHash(t *testing.T) {
+	ctx := context.Background()
+	bigPath := filepath.Join(fakesystem.Root, "big")
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1<<17)
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_file, File: catpogs.PlainFile(bigPath, content)},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := &openCountingSystem{System: new(fakesystem.System)}
+	st := new(state.State)
+	apply := func(fast bool) {
+		if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, State: st, FastHash: fast}); err != nil {
+			t.Errorf("Apply: %v", err)
+		}
+	}
+
+	apply(true)
+	apply(true)
+	if h := st.Hashes[bigPath]; h == nil || h.XXH64 == "" || h.SHA256 != "" {
+		t.Fatalf("after converged fast hash run, st.Hashes[%q] = %+v; want only an xxHash", bigPath, h)
+	}
+	sys.opens = 0
+	apply(true)
+	if sys.opens != 0 {
+		t.Errorf("converged run with cached xxHash opened files %d times; want 0", sys.opens)
+	}
+
+	// A SHA-256 run can't use the xxHash, so it reads the file again.
+	apply(false)
+	if sys.opens == 0 {
+		t.Error("SHA-256 run after fast hash run did not read the file")
+	}
+	if h := st.Hashes[bigPath]; h == nil || h.SHA256 != fmt.Sprintf("%x", sha256.Sum256(content)) {
+		t.Errorf("after SHA-256 run, st.Hashes[%q] = %+v; want SHA-256 of content", bigPath, h)
+	}
+}
+
+func TestDirectoryMaxAge(t *testing.T) {
+	ctx := context.Background()
+	const day = 24 * time.Hour
+	dir := filepath.Join(fakesystem.Root, "tmp")
+	f := catpogs.Directory(dir, nil)
+	f.Directory.MaxAgeMillis = uint64(7 * day / time.Millisecond)
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_file, File: f},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	clock := fakesystem.NewClock(time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC))
+	sys := &fakesystem.System{Clock: clock}
+	mkdir := func(path string) {
+		if err := sys.Mkdir(ctx, path, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(path string) {
+		if err := system.WriteFile(ctx, sys, path, []byte("hi"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outside := filepath.Join(fakesystem.Root, "outside")
+	mkdir(dir)
+	mkdir(outside)
+	write(filepath.Join(outside, "old.txt"))
+	write(filepath.Join(dir, "old.txt"))
+	mkdir(filepath.Join(dir, "olddir"))
+	write(filepath.Join(dir, "olddir", "old.txt"))
+	mkdir(filepath.Join(dir, "mixed"))
+	write(filepath.Join(dir, "mixed", "old.txt"))
+	if err := sys.Symlink(ctx, outside, filepath.Join(dir, "oldlink")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * day)
+	write(filepath.Join(dir, "new.txt"))
+	write(filepath.Join(dir, "mixed", "new.txt"))
+	clock.Advance(day)
+
+	apply := func(wantStatus ResourceStatus) {
+		report := new(Report)
+		if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+			t.Errorf("Apply: %v", err)
+		}
+		if len(report.Resources) != 1 || report.Resources[0].Status != wantStatus {
+			t.Errorf("report.Resources = %+v; want one %s resource", report.Resources, wantStatus)
+		}
+	}
+	apply(StatusChanged)
+	tests := []struct {
+		path   string
+		exists bool
+	}{
+		{"old.txt", false},
+		{"olddir", false},
+		{"oldlink", false},
+		{"mixed/old.txt", false},
+		{"new.txt", true},
+		{"mixed", true},
+		{"mixed/new.txt", true},
+		{"../outside/old.txt", true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, filepath.FromSlash(test.path))
+		_, err := sys.Lstat(ctx, path)
+		if exists := err == nil; exists != test.exists {
+			t.Errorf("after purge, exists(%s) = %t; want %t", path, exists, test.exists)
+		}
+	}
+	apply(StatusUnchanged)
+}
+
+// openCountingSystem is a fake system that counts calls to OpenFile.
+type openCountingSystem struct {
+	*fakesystem.System
+
+	mu    sync.Mutex
+	opens int
+}
+
+func (sys *openCountingSystem) OpenFile(ctx context.Context, path string) (system.File, error) {
+	sys.mu.Lock()
+	sys.opens++
+	sys.mu.Unlock()
+	return sys.System.OpenFile(ctx, path)
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	const key = `HKLM\SOFTWARE\Example`
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:    1,
+				Which: catalog.Resource_Which_registryValue,
+				RegistryValue: &catpogs.RegistryValue{
+					Key:   key,
+					Name:  "Greeting",
+					Which: catalog.RegistryValue_Which_sz,
+					Sz:    "Hello",
+				},
+			},
+			{
+				ID:    2,
+				Which: catalog.Resource_Which_registryValue,
+				RegistryValue: &catpogs.RegistryValue{
+					Key:   key,
+					Name:  "Count",
+					Which: catalog.RegistryValue_Which_dword,
+					Dword: 42,
+				},
+			},
+			{
+				ID:    3,
+				Which: catalog.Resource_Which_registryValue,
+				RegistryValue: &catpogs.RegistryValue{
+					Key:   key,
+					Name:  "Old",
+					Which: catalog.RegistryValue_Which_absent,
+				},
+			},
+			{
+				ID:    4,
+				Which: catalog.Resource_Which_registryKey,
+				RegistryKey: &catpogs.RegistryKey{
+					Path:  `HKLM\SOFTWARE\Obsolete`,
+					Which: catalog.RegistryKey_Which_absent,
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	if err := sys.CreateRegistryKey(ctx, `HKLM\SOFTWARE\Obsolete\Sub`); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.CreateRegistryKey(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.SetRegistryValue(ctx, key, "Old", system.DWORDValue(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.SetRegistryValue(ctx, key, "Count", system.StringValue(system.RegSZ, "42")); err != nil {
+		t.Fatal(err)
+	}
+
+	report := new(Report)
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+		t.Fatal("first Apply:", err)
+	}
+	for _, id := range []uint64{1, 2, 3, 4} {
+		if rr := report.Resource(id); rr == nil || rr.Status != StatusChanged {
+			t.Errorf("first run: resource %d report = %+v; want changed", id, rr)
+		}
+	}
+	if v, err := sys.RegistryValue(ctx, key, "Greeting"); err != nil {
+		t.Error(err)
+	} else if want := system.StringValue(system.RegSZ, "Hello"); !v.Equal(want) {
+		t.Errorf("Greeting = %+v; want %+v", v, want)
+	}
+	if v, err := sys.RegistryValue(ctx, key, "Count"); err != nil {
+		t.Error(err)
+	} else if want := system.DWORDValue(42); !v.Equal(want) {
+		t.Errorf("Count = %+v; want %+v", v, want)
+	}
+	if _, err := sys.RegistryValue(ctx, key, "Old"); !os.IsNotExist(err) {
+		t.Errorf("RegistryValue(Old) error = %v; want not exist", err)
+	}
+	if exists, err := sys.RegistryKeyExists(ctx, `HKLM\SOFTWARE\Obsolete\Sub`); err != nil || exists {
+		t.Errorf("RegistryKeyExists(Obsolete\\Sub) = %t, %v; want false, <nil>", exists, err)
+	}
+
+	report = new(Report)
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+		t.Fatal("second Apply:", err)
+	}
+	for _, id := range []uint64{1, 2, 3, 4} {
+		if rr := report.Resource(id); rr == nil || rr.Status != StatusUnchanged {
+			t.Errorf("second run: resource %d report = %+v; want unchanged", id, rr)
+		}
+	}
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		existing *system.ServiceConfig
+		svc      catpogs.Service
+		want     system.ServiceStatus
+		fail     bool
+	}{
+		{
+			name: "create and start",
+			svc: catpogs.Service{
+				Name:       "example",
+				BinaryPath: `C:\example.exe`,
+				StartType:  catalog.Service_StartType_automatic,
+				State:      catalog.Service_State_running,
+			},
+			want: system.ServiceStatus{
+				ServiceConfig: system.ServiceConfig{
+					DisplayName: "example",
+					BinaryPath:  `C:\example.exe`,
+					StartType:   system.ServiceAutoStart,
+				},
+				State: system.ServiceRunning,
+			},
+		},
+		{
+			name: "reconfigure",
+			existing: &system.ServiceConfig{
+				DisplayName: "Old Name",
+				BinaryPath:  `C:\old.exe`,
+				StartType:   system.ServiceAutoStart,
+			},
+			svc: catpogs.Service{
+				Name:        "example",
+				DisplayName: "Example",
+				StartType:   catalog.Service_StartType_disabled,
+				State:       catalog.Service_State_stopped,
+			},
+			want: system.ServiceStatus{
+				ServiceConfig: system.ServiceConfig{
+					DisplayName: "Example",
+					BinaryPath:  `C:\old.exe`,
+					StartType:   system.ServiceDisabled,
+				},
+				State: system.ServiceStopped,
+			},
+		},
+		{
+			name: "missing without binary path",
+			svc: catpogs.Service{
+				Name:  "example",
+				State: catalog.Service_State_running,
+			},
+			fail: true,
+		},
+	}
+	for _, test := range tests {
+		svc := test.svc
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{ID: 1, Which: catalog.Resource_Which_service, Service: &svc},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatalf("%s: catpogs.Catalog.ToCapnp(): %v", test.name, err)
+		}
+		sys := new(fakesystem.System)
+		if test.existing != nil {
+			if err := sys.CreateService(ctx, svc.Name, test.existing); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		err = Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}})
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: Apply did not return an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: first Apply: %v", test.name, err)
+			continue
+		}
+		if status, err := sys.QueryService(ctx, svc.Name); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if *status != test.want {
+			t.Errorf("%s: status = %+v; want %+v", test.name, *status, test.want)
+		}
+
+		report := new(Report)
+		if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+			t.Errorf("%s: second Apply: %v", test.name, err)
+		} else if rr := report.Resource(1); rr == nil || rr.Status != StatusUnchanged {
+			t.Errorf("%s: second run report = %+v; want unchanged", test.name, rr)
+		}
+	}
+}
+
+func TestLaunchdJob(t *testing.T) {
+	const launchctlPath = "/bin/launchctl"
+	const label = "com.example.agent"
+	plistPath := filepath.Join(fakesystem.Root, "Library", "LaunchDaemons", label+".plist")
+	tests := []struct {
+		name         string
+		job          catpogs.LaunchdJob
+		loaded       bool
+		disabled     string
+		plistChanged bool
+
+		wantLoaded   bool
+		wantDisabled string
+		wantChanged  bool
+	}{
+		{
+			name:        "load",
+			job:         catpogs.LaunchdJob{Which: catalog.LaunchdJob_Which_loaded},
+			wantLoaded:  true,
+			wantChanged: true,
+		},
+		{
+			name:       "already loaded",
+			job:        catpogs.LaunchdJob{Which: catalog.LaunchdJob_Which_loaded},
+			loaded:     true,
+			wantLoaded: true,
+		},
+		{
+			name:        "unload",
+			job:         catpogs.LaunchdJob{Which: catalog.LaunchdJob_Which_unloaded},
+			loaded:      true,
+			wantChanged: true,
+		},
+		{
+			name:         "enable and load",
+			job:          catpogs.LaunchdJob{Which: catalog.LaunchdJob_Which_loaded, Enabled: catalog.LaunchdJob_Enabled_enabled},
+			disabled:     "disabled",
+			wantLoaded:   true,
+			wantDisabled: "enabled",
+			wantChanged:  true,
+		},
+		{
+			name:         "already disabled",
+			job:          catpogs.LaunchdJob{Which: catalog.LaunchdJob_Which_unloaded, Enabled: catalog.LaunchdJob_Enabled_disabled},
+			disabled:     "disabled",
+			wantDisabled: "disabled",
+		},
+		{
+			name:         "reload",
+			job:          catpogs.LaunchdJob{Which: catalog.LaunchdJob_Which_loaded, ReloadIfDepsChanged: true},
+			loaded:       true,
+			plistChanged: true,
+			wantLoaded:   true,
+			wantChanged:  true,
+		},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		sys := new(fakesystem.System)
+		if err := mkdirAll(ctx, sys, filepath.Dir(plistPath)); err != nil {
+			t.Fatal(err)
+		}
+		if !test.plistChanged {
+			if err := system.WriteFile(ctx, sys, plistPath, []byte("<plist/>"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		loaded, disabled := test.loaded, test.disabled
+		var bootstraps int
+		err := mkdirAll(ctx, sys, filepath.Dir(launchctlPath))
+		if err == nil {
+			err = sys.Mkprogram(launchctlPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+				switch {
+				case len(pc.Args) == 3 && pc.Args[1] == "print" && pc.Args[2] == "system/"+label:
+					if !loaded {
+						return 113
+					}
+				case len(pc.Args) == 3 && pc.Args[1] == "print-disabled" && pc.Args[2] == "system":
+					fmt.Fprintln(pc.Output, "disabled services = {")
+					if disabled != "" {
+						fmt.Fprintf(pc.Output, "\t%q => %s\n", label, disabled)
+					}
+					fmt.Fprintln(pc.Output, "}")
+				case len(pc.Args) == 4 && pc.Args[1] == "bootstrap" && pc.Args[2] == "system" && pc.Args[3] == plistPath:
+					if loaded || disabled == "disabled" {
+						return 1
+					}
+					loaded = true
+					bootstraps++
+				case len(pc.Args) == 3 && pc.Args[1] == "bootout" && pc.Args[2] == "system/"+label:
+					if !loaded {
+						return 1
+					}
+					loaded = false
+				case len(pc.Args) == 3 && pc.Args[1] == "enable" && pc.Args[2] == "system/"+label:
+					disabled = "enabled"
+				case len(pc.Args) == 3 && pc.Args[1] == "disable" && pc.Args[2] == "system/"+label:
+					disabled = "disabled"
+				default:
+					fmt.Fprintf(pc.Output, "unexpected arguments %q\n", pc.Args)
+					return 64
+				}
+				return 0
+			})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		job := test.job
+		job.Label = label
+		job.PlistPath = plistPath
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{ID: 1, Which: catalog.Resource_Which_file, File: catpogs.PlainFile(plistPath, []byte("<plist/>"))},
+				{ID: 2, Deps: []uint64{1}, Which: catalog.Resource_Which_launchdJob, LaunchdJob: &job},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatalf("%s: catpogs.Catalog.ToCapnp(): %v", test.name, err)
+		}
+		report := new(Report)
+		if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+			t.Errorf("%s: Apply: %v", test.name, err)
+			continue
+		}
+		if loaded != test.wantLoaded {
+			t.Errorf("%s: loaded = %t; want %t", test.name, loaded, test.wantLoaded)
+		}
+		if disabled != test.wantDisabled && test.wantDisabled != "" {
+			t.Errorf("%s: disabled = %q; want %q", test.name, disabled, test.wantDisabled)
+		}
+		if test.plistChanged && bootstraps != 1 {
+			t.Errorf("%s: bootstrapped %d times; want 1", test.name, bootstraps)
+		}
+		wantStatus := StatusUnchanged
+		if test.wantChanged {
+			wantStatus = StatusChanged
+		}
+		if rr := report.Resource(2); rr == nil || rr.Status != wantStatus {
+			t.Errorf("%s: report = %+v; want %s", test.name, rr, wantStatus)
+		}
+	}
+}
+
+func TestPackageRepo(t *testing.T) {
+	ctx := context.Background()
+	sys := new(fakesystem.System)
+	var updates [][]string
+	for _, prog := range []string{"/usr/bin/apt-get", "/usr/bin/yum"} {
+		if err := mkdirAll(ctx, sys, filepath.Dir(prog)); err != nil {
+			t.Fatal(err)
+		}
+		err := sys.Mkprogram(prog, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+			updates = append(updates, pc.Args)
+			return 0
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----\nxyz\n-----END PGP PUBLIC KEY BLOCK-----\n")
+	repos := func(absent bool) catalog.Catalog {
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{ID: 1, Which: catalog.Resource_Which_packageRepo, PackageRepo: &catpogs.PackageRepo{
+					Name:   "docker",
+					Absent: absent,
+					Which:  catalog.PackageRepo_Which_apt,
+					Apt: &catpogs.AptRepo{
+						URI:           "https://download.docker.com/linux/debian",
+						Suite:         "bookworm",
+						Components:    []string{"stable"},
+						Architectures: []string{"amd64"},
+						SigningKey:    key,
+					},
+				}},
+				{ID: 2, Which: catalog.Resource_Which_packageRepo, PackageRepo: &catpogs.PackageRepo{
+					Name:   "epel",
+					Absent: absent,
+					Which:  catalog.PackageRepo_Which_yum,
+					Yum: &catpogs.YumRepo{
+						Description: "Extra Packages",
+						BaseURL:     "https://example.com/epel/$releasever/$basearch",
+						GPGKey:      key,
+					},
+				}},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		return cat
+	}
+	apply := func(cat catalog.Catalog) *Report {
+		report := new(Report)
+		if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+			t.Fatal("Apply:", err)
+		}
+		return report
+	}
+
+	report := apply(repos(false))
+	for _, id := range []uint64{1, 2} {
+		if rr := report.Resource(id); rr == nil || rr.Status != StatusChanged {
+			t.Errorf("first run: resource %d = %+v; want changed", id, rr)
+		}
+	}
+	files := []struct {
+		path string
+		want string
+	}{
+		{"/etc/apt/sources.list.d/docker.list", "deb [arch=amd64 signed-by=/etc/apt/keyrings/docker.asc] https://download.docker.com/linux/debian bookworm stable\n"},
+		{"/etc/apt/keyrings/docker.asc", string(key)},
+		{"/etc/yum.repos.d/epel.repo", "[epel]\nname=Extra Packages\nbaseurl=https://example.com/epel/$releasever/$basearch\nenabled=1\ngpgcheck=1\ngpgkey=file:///etc/pki/rpm-gpg/RPM-GPG-KEY-epel\n"},
+		{"/etc/pki/rpm-gpg/RPM-GPG-KEY-epel", string(key)},
+	}
+	for _, f := range files {
+		if got, err := system.ReadFile(ctx, sys, f.path); err != nil {
+			t.Error(err)
+		} else if string(got) != f.want {
+			t.Errorf("%s = %q; want %q", f.path, got, f.want)
+		}
+	}
+	if len(updates) != 2 {
+		t.Errorf("first run refreshed %q; want apt-get update and yum makecache", updates)
+	}
+	for _, args := range updates {
+		if len(args) < 2 || args[1] != "update" && args[1] != "makecache" {
+			t.Errorf("refresh command = %q; want update or makecache", args)
+		}
+	}
+
+	updates = nil
+	report = apply(repos(false))
+	for _, id := range []uint64{1, 2} {
+		if rr := report.Resource(id); rr == nil || rr.Status != StatusUnchanged {
+			t.Errorf("second run: resource %d = %+v; want unchanged", id, rr)
+		}
+	}
+	if len(updates) != 0 {
+		t.Errorf("second run refreshed %q; want no refreshes", updates)
+	}
+
+	report = apply(repos(true))
+	for _, id := range []uint64{1, 2} {
+		if rr := report.Resource(id); rr == nil || rr.Status != StatusChanged {
+			t.Errorf("absent run: resource %d = %+v; want changed", id, rr)
+		}
+	}
+	for _, f := range files {
+		if _, err := sys.Lstat(ctx, f.path); !os.IsNotExist(err) {
+			t.Errorf("after absent run, Lstat(%q) = %v; want not exist", f.path, err)
+		}
+	}
+}
+
+func TestAlternative(t *testing.T) {
+	const tool = "/usr/bin/update-alternatives"
+	tests := []struct {
+		name     string
+		alt      catpogs.Alternative
+		existing map[string]int64
+		manual   string
+		redHat   bool // print --display output in Red Hat's format
+
+		want        map[string]int64
+		wantManual  string
+		wantCalls   int
+		wantChanged bool
+	}{
+		{
+			name:        "install",
+			alt:         catpogs.Alternative{Priority: 30},
+			existing:    map[string]int64{"/bin/nano": 40},
+			want:        map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+			wantCalls:   1,
+			wantChanged: true,
+		},
+		{
+			name:     "already installed",
+			alt:      catpogs.Alternative{Priority: 30},
+			existing: map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+			want:     map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+		},
+		{
+			name:        "priority differs",
+			alt:         catpogs.Alternative{Priority: 50},
+			existing:    map[string]int64{"/usr/bin/vim.basic": 30},
+			want:        map[string]int64{"/usr/bin/vim.basic": 50},
+			wantCalls:   1,
+			wantChanged: true,
+		},
+		{
+			name:        "select",
+			alt:         catpogs.Alternative{Priority: 30, Selected: true},
+			existing:    map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+			want:        map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+			wantManual:  "/usr/bin/vim.basic",
+			wantCalls:   1,
+			wantChanged: true,
+		},
+		{
+			name:       "already selected",
+			alt:        catpogs.Alternative{Priority: 30, Selected: true},
+			existing:   map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+			manual:     "/usr/bin/vim.basic",
+			want:       map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+			wantManual: "/usr/bin/vim.basic",
+		},
+		{
+			name:       "already selected on Red Hat",
+			alt:        catpogs.Alternative{Priority: 30, Selected: true},
+			existing:   map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+			manual:     "/usr/bin/vim.basic",
+			redHat:     true,
+			want:       map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+			wantManual: "/usr/bin/vim.basic",
+		},
+		{
+			name:        "remove",
+			alt:         catpogs.Alternative{Absent: true},
+			existing:    map[string]int64{"/bin/nano": 40, "/usr/bin/vim.basic": 30},
+			want:        map[string]int64{"/bin/nano": 40},
+			wantCalls:   1,
+			wantChanged: true,
+		},
+		{
+			name: "already absent",
+			alt:  catpogs.Alternative{Absent: true},
+		},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		sys := new(fakesystem.System)
+		alts := make(map[string]int64)
+		for k, v := range test.existing {
+			alts[k] = v
+		}
+		manual := test.manual
+		calls := 0
+		err := mkdirAll(ctx, sys, filepath.Dir(tool))
+		if err == nil {
+			err = sys.Mkprogram(tool, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+				args := pc.Args[1:]
+				switch {
+				case len(args) == 2 && args[0] == "--display" && args[1] == "editor":
+					if len(alts) == 0 {
+						return 2
+					}
+					best := ""
+					for p, pri := range alts {
+						if best == "" || pri > alts[best] {
+							best = p
+						}
+					}
+					mode, curr := "auto", best
+					if manual != "" {
+						mode, curr = "manual", manual
+					}
+					if test.redHat {
+						fmt.Fprintf(pc.Output, "editor - status is %s.\n link currently points to %s\n", mode, curr)
+						for p, pri := range alts {
+							fmt.Fprintf(pc.Output, "%s - family editor priority %d\n slave editor.1.gz: /usr/share/man/man1/editor.1.gz\n", p, pri)
+						}
+						fmt.Fprintf(pc.Output, "Current `best' version is %s.\n", best)
+						break
+					}
+					fmt.Fprintf(pc.Output, "editor - %s mode\n  link best version is %s\n  link currently points to %s\n  link editor is /usr/bin/editor\n", mode, best, curr)
+					for p, pri := range alts {
+						fmt.Fprintf(pc.Output, "%s - priority %d\n", p, pri)
+					}
+				case len(args) == 5 && args[0] == "--install" && args[1] == "/usr/bin/editor" && args[2] == "editor":
+					pri, err := strconv.ParseInt(args[4], 10, 64)
+					if err != nil {
+						return 2
+					}
+					alts[args[3]] = pri
+					calls++
+				case len(args) == 3 && args[0] == "--set" && args[1] == "editor":
+					manual = args[2]
+					calls++
+				case len(args) == 3 && args[0] == "--remove" && args[1] == "editor":
+					delete(alts, args[2])
+					if manual == args[2] {
+						manual = ""
+					}
+					calls++
+				default:
+					fmt.Fprintf(pc.Output, "unexpected arguments %q\n", pc.Args)
+					return 64
+				}
+				return 0
+			})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		alt := test.alt
+		alt.Name = "editor"
+		alt.Link = "/usr/bin/editor"
+		alt.Path = "/usr/bin/vim.basic"
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{ID: 1, Which: catalog.Resource_Which_alternative, Alternative: &alt},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatalf("%s: catpogs.Catalog.ToCapnp(): %v", test.name, err)
+		}
+		report := new(Report)
+		if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+			t.Errorf("%s: Apply: %v", test.name, err)
+			continue
+		}
+		if len(alts) != len(test.want) {
+			t.Errorf("%s: alternatives = %v; want %v", test.name, alts, test.want)
+		} else {
+			for p, pri := range test.want {
+				if alts[p] != pri {
+					t.Errorf("%s: alternatives = %v; want %v", test.name, alts, test.want)
+					break
+				}
+			}
+		}
+		if manual != test.wantManual {
+			t.Errorf("%s: manual selection = %q; want %q", test.name, manual, test.wantManual)
+		}
+		if calls != test.wantCalls {
+			t.Errorf("%s: ran %d changing commands; want %d", test.name, calls, test.wantCalls)
+		}
+		wantStatus := StatusUnchanged
+		if test.wantChanged {
+			wantStatus = StatusChanged
+		}
+		if rr := report.Resource(1); rr == nil || rr.Status != wantStatus {
+			t.Errorf("%s: report = %+v; want status %v", test.name, rr, wantStatus)
+		}
+	}
 }
 
-func (ff *fixtureFactory) newFixture(ctx context.Context, log applytests.Logger, name string) (applytests.Fixture, error) {
-	sys := new(fakesystem.System)
-	binPath := filepath.Join(fakesystem.Root, "mybin")
-	info := &applytests.SystemInfo{
-		Root:      filepath.Join(fakesystem.Root, "subdir"),
-		TruePath:  filepath.Join(binPath, "true"),
-		FalsePath: filepath.Join(binPath, "false"),
-		TouchPath: filepath.Join(binPath, "touch"),
+func TestReboot(t *testing.T) {
+	ctx := context.Background()
+	sys := new(fakesystem.System)
+	const flagPath = "/var/run/reboot-required"
+	const confPath = "/etc/kernel.conf"
+	if err := mkdirAll(ctx, sys, filepath.Dir(flagPath)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mkdirAll(ctx, sys, filepath.Dir(confPath)); err != nil {
+		t.Fatal(err)
+	}
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_file, File: catpogs.PlainFile(confPath, []byte("quiet\n"))},
+			{ID: 2, Which: catalog.Resource_Which_reboot, Reboot: &catpogs.Reboot{
+				TriggerPaths: []string{flagPath},
+				DelaySeconds: 300,
+			}},
+			{ID: 3, Deps: []uint64{1}, Which: catalog.Resource_Which_reboot, Reboot: &catpogs.Reboot{
+				IfDepsChanged: []uint64{1},
+				DelaySeconds:  90,
+				Message:       "kernel settings changed",
+			}},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+
+	report := new(Report)
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if rr := report.Resource(2); rr == nil || rr.Status != StatusUnchanged {
+		t.Errorf("resource 2 without trigger file = %+v; want unchanged", rr)
+	}
+	if rr := report.Resource(3); rr == nil || rr.Status != StatusChanged {
+		t.Errorf("resource 3 after dependency changed = %+v; want changed", rr)
+	}
+	req := report.Reboot
+	if req == nil || len(req.Resources) != 1 || req.Resources[0] != 3 || req.Delay != 90*time.Second || req.Message != "kernel settings changed" {
+		t.Fatalf("first run reboot = %+v; want requested by 3 after 90s", req)
+	}
+
+	if err := system.WriteFile(ctx, sys, flagPath, nil, 0644); err != nil {
+		t.Fatal(err)
 	}
-	if err := sys.Mkdir(ctx, binPath, 0755); err != nil {
-		return nil, err
+	report = new(Report)
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+		t.Fatal("Apply:", err)
 	}
-	if err := sys.Mkdir(ctx, info.Root, 0755); err != nil {
-		return nil, err
+	req = report.Reboot
+	if req == nil || len(req.Resources) != 1 || req.Resources[0] != 2 || req.Delay != 300*time.Second {
+		t.Fatalf("second run reboot = %+v; want requested by 2 after 300s", req)
 	}
-	err := sys.Mkprogram(info.TruePath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+	if len(req.Reasons) != 1 || !strings.Contains(req.Reasons[0], flagPath) {
+		t.Errorf("second run reboot reasons = %q; want to mention %s", req.Reasons, flagPath)
+	}
+
+	var shutdownArgs []string
+	if err := mkdirAll(ctx, sys, "/sbin"); err != nil {
+		t.Fatal(err)
+	}
+	err = sys.Mkprogram("/sbin/shutdown", func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		shutdownArgs = pc.Args
 		return 0
 	})
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	err = sys.Mkprogram(info.FalsePath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+	if err := ScheduleReboot(ctx, sys, req); err != nil {
+		t.Fatal("ScheduleReboot:", err)
+	}
+	if len(shutdownArgs) < 3 || shutdownArgs[1] != "-r" || shutdownArgs[2] != "+5" {
+		t.Errorf("shutdown args = %q; want -r +5", shutdownArgs)
+	}
+}
+
+func TestAssert(t *testing.T) {
+	ctx := context.Background()
+	sys := new(fakesystem.System)
+	const confPath = "/etc/app.conf"
+	const confHash = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	const checkPath = "/usr/bin/check-app"
+	for _, dir := range []string{filepath.Dir(confPath), filepath.Dir(checkPath)} {
+		if err := mkdirAll(ctx, sys, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := system.WriteFile(ctx, sys, confPath, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := sys.Mkprogram(checkPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		if len(pc.Args) > 1 && pc.Args[1] == "ok" {
+			return 0
+		}
 		return 1
 	})
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-	err = sys.Mkprogram(info.TouchPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
-		if len(pc.Args) != 2 {
-			fmt.Fprintln(pc.Output, "usage: touch FILE")
-			return 1
+	sys.OpenPort("tcp", "localhost:8080")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_assert, Assert: &catpogs.Assert{
+				Which:      catalog.Assert_Which_fileExists,
+				FileExists: confPath,
+			}},
+			{ID: 2, Which: catalog.Resource_Which_assert, Assert: &catpogs.Assert{
+				Which:    catalog.Assert_Which_fileHash,
+				FileHash: &catpogs.AssertFileHash{Path: confPath, SHA256: confHash},
+			}},
+			{ID: 3, Which: catalog.Resource_Which_assert, Assert: &catpogs.Assert{
+				Which: catalog.Assert_Which_command,
+				Command: &catpogs.Command{
+					Which: catalog.Exec_Command_Which_argv,
+					Argv:  []string{checkPath, "ok"},
+				},
+			}},
+			{ID: 4, Which: catalog.Resource_Which_assert, Assert: &catpogs.Assert{
+				Which:      catalog.Assert_Which_tcpAddress,
+				TCPAddress: "localhost:8080",
+			}},
+			{ID: 5, Which: catalog.Resource_Which_assert, Assert: &catpogs.Assert{
+				Which:      catalog.Assert_Which_tcpAddress,
+				TCPAddress: "localhost:8081",
+				Message:    "app must listen on 8081",
+			}},
+			{ID: 6, Which: catalog.Resource_Which_assert, Assert: &catpogs.Assert{
+				Which: catalog.Assert_Which_command,
+				Command: &catpogs.Command{
+					Which: catalog.Exec_Command_Which_argv,
+					Argv:  []string{checkPath, "fail"},
+				},
+			}},
+			{ID: 7, Which: catalog.Resource_Which_assert, Assert: &catpogs.Assert{
+				Which:    catalog.Assert_Which_fileHash,
+				FileHash: &catpogs.AssertFileHash{Path: confPath, SHA256: "not a hash"},
+			}},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+
+	report := new(Report)
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err == nil {
+		t.Error("Apply did not return an error")
+	}
+	for id := uint64(1); id <= 4; id++ {
+		if rr := report.Resource(id); rr == nil || rr.Status != StatusUnchanged {
+			t.Errorf("resource %d = %+v; want unchanged", id, rr)
 		}
-		w, err := sys.CreateFile(ctx, pc.Args[1], 0666)
+	}
+	if rr := report.Resource(5); rr == nil || rr.Status != StatusFailed || !rr.Violated || !strings.Contains(rr.Error, "app must listen on 8081") {
+		t.Errorf("resource 5 = %+v; want violated with message", rr)
+	}
+	if rr := report.Resource(6); rr == nil || rr.Status != StatusFailed || !rr.Violated {
+		t.Errorf("resource 6 = %+v; want violated", rr)
+	}
+	if rr := report.Resource(7); rr == nil || rr.Status != StatusFailed || rr.Violated {
+		t.Errorf("resource 7 = %+v; want failed without violation", rr)
+	}
+	if sum := report.Summarize(); sum.Failed != 3 || sum.Violated != 2 {
+		t.Errorf("summary = %+v; want 3 failed, 2 violated", sum)
+	}
+	if data, err := system.ReadFile(ctx, sys, confPath); err != nil {
+		t.Error(err)
+	} else if string(data) != "hello\n" {
+		t.Errorf("%s = %q after Apply; want unchanged", confPath, data)
+	}
+}
+
+func TestPreconditions(t *testing.T) {
+	ctx := context.Background()
+	const confPath = "/etc/app.conf"
+	newSystem := func() *fakesystem.System {
+		sys := &fakesystem.System{FreeSpace: 1 << 30, Kernel: "4.9.0-3-amd64"}
+		if err := mkdirAll(ctx, sys, "/etc"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mkdirAll(ctx, sys, "/usr/bin"); err != nil {
+			t.Fatal(err)
+		}
+		err := sys.Mkprogram("/usr/bin/git", func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+			return 0
+		})
 		if err != nil {
-			fmt.Fprintln(pc.Output, "touch:", err)
-			return 1
+			t.Fatal(err)
 		}
-		if err := w.Close(); err != nil {
-			fmt.Fprintln(pc.Output, "touch:", err)
-			return 1
+		return sys
+	}
+	precondition := func(which catalog.Precondition_Which) *catpogs.Precondition {
+		return &catpogs.Precondition{Which: which}
+	}
+	disk := func(path string, bytes uint64) *catpogs.Precondition {
+		p := precondition(catalog.Precondition_Which_minDiskFree)
+		p.MinDiskFree.Path = path
+		p.MinDiskFree.Bytes = bytes
+		return p
+	}
+	binary := func(name string) *catpogs.Precondition {
+		p := precondition(catalog.Precondition_Which_binary)
+		p.Binary = name
+		return p
+	}
+	kernel := func(v string) *catpogs.Precondition {
+		p := precondition(catalog.Precondition_Which_minKernelVersion)
+		p.MinKernelVersion = v
+		return p
+	}
+	privileged := func(priv bool) *catpogs.Precondition {
+		p := precondition(catalog.Precondition_Which_privileged)
+		p.Privileged = priv
+		return p
+	}
+	tests := []struct {
+		name  string
+		pre   []*catpogs.Precondition
+		unmet []string
+	}{
+		{
+			name: "all met",
+			pre:  []*catpogs.Precondition{disk("/etc", 1<<20), binary("git"), binary("/usr/bin/git"), kernel("4.9"), privileged(true)},
+		},
+		{
+			name:  "not enough disk",
+			pre:   []*catpogs.Precondition{disk("/etc", 2<<30)},
+			unmet: []string{"/etc has 1073741824 bytes free"},
+		},
+		{
+			name:  "missing binaries",
+			pre:   []*catpogs.Precondition{binary("apt-get"), binary("/usr/bin/git"), binary("/usr/sbin/nginx")},
+			unmet: []string{"apt-get is not installed", "/usr/sbin/nginx is not installed"},
+		},
+		{
+			name:  "old kernel",
+			pre:   []*catpogs.Precondition{kernel("4.10")},
+			unmet: []string{"kernel 4.9.0-3-amd64 is older than 4.10"},
+		},
+		{
+			name:  "all violations listed",
+			pre:   []*catpogs.Precondition{kernel("5"), privileged(false), disk("/etc", 2<<30)},
+			unmet: []string{"older than 5", "must not run as the superuser", "/etc has"},
+		},
+	}
+	for _, test := range tests {
+		sys := newSystem()
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{ID: 1, Which: catalog.Resource_Which_file, File: catpogs.PlainFile(confPath, []byte("hello\n"))},
+			},
+			Preconditions: test.pre,
+		}).ToCapnp()
+		if err != nil {
+			t.Fatal("catpogs.Catalog.ToCapnp():", err)
+		}
+		err = Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}})
+		if len(test.unmet) == 0 {
+			if err != nil {
+				t.Errorf("%s: Apply: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: Apply did not return an error", test.name)
+			continue
+		}
+		for _, want := range test.unmet {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: Apply error = %v; want to mention %q", test.name, err, want)
+			}
+		}
+		if _, err := sys.Lstat(ctx, confPath); !os.IsNotExist(err) {
+			t.Errorf("%s: %s was created despite unmet preconditions", test.name, confPath)
+		}
+	}
+}
+
+func TestPendingChange(t *testing.T) {
+	ctx := context.Background()
+	sys := new(fakesystem.System)
+	const confPath = "/etc/app.conf"
+	const restartPath = "/usr/bin/restart-app"
+	for _, dir := range []string{filepath.Dir(confPath), filepath.Dir(restartPath)} {
+		if err := mkdirAll(ctx, sys, dir); err != nil {
+			t.Fatal(err)
 		}
+	}
+	restarts := 0
+	err := sys.Mkprogram(restartPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		restarts++
 		return 0
 	})
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
+	}
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_file, File: catpogs.PlainFile(confPath, []byte("port = 80\n"))},
+			{ID: 2, Deps: []uint64{1}, Which: catalog.Resource_Which_exec, Exec: &catpogs.Exec{
+				Command: &catpogs.Command{
+					Which: catalog.Exec_Command_Which_argv,
+					Argv:  []string{restartPath},
+				},
+				Condition: catpogs.ExecCondition{
+					Which:         catalog.Exec_condition_Which_ifDepsChanged,
+					IfDepsChanged: []uint64{1},
+				},
+			}},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	st := new(state.State)
+	apply := func(veto func(int, catalog.Resource) string) *Report {
+		report := new(Report)
+		Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report, State: st, Veto: veto})
+		return report
 	}
-	return &fixture{
-		sys:            sys,
-		log:            log,
-		info:           info,
-		concurrentJobs: ff.concurrentJobs,
-	}, nil
-}
 
-func (f *fixture) Apply(ctx context.Context, c catalog.Catalog) error {
-	return Apply(ctx, f.sys, c, &Options{
-		Log:            testLogger{t: f.log},
-		ConcurrentJobs: f.concurrentJobs,
+	// The restart is vetoed, so it is left pending.
+	report := apply(func(_ int, r catalog.Resource) string {
+		if r.ID() == 2 {
+			return "not now"
+		}
+		return ""
 	})
+	if restarts != 0 {
+		t.Errorf("vetoed run restarted %d times; want 0", restarts)
+	}
+	if len(report.Pending) != 1 || report.Pending[0] != 2 {
+		t.Errorf("vetoed run report.Pending = %v; want [2]", report.Pending)
+	}
+	if st.Pending[2] == nil {
+		t.Error("vetoed run did not record resource 2 as pending in the state")
+	}
+
+	// The file is up to date, but the pending restart is replayed.
+	report = apply(nil)
+	if restarts != 1 {
+		t.Errorf("replay run restarted %d times; want 1", restarts)
+	}
+	if rr := report.Resource(2); rr == nil || rr.Status != StatusChanged {
+		t.Errorf("replay run resource 2 = %+v; want changed", rr)
+	}
+	if len(report.Pending) != 0 || len(st.Pending) != 0 {
+		t.Errorf("after replay, report.Pending = %v and state pending = %v; want empty", report.Pending, st.Pending)
+	}
+
+	report = apply(nil)
+	if restarts != 1 {
+		t.Errorf("converged run restarted %d times in total; want 1", restarts)
+	}
 }
 
-func (f *fixture) System() system.System {
-	return f.sys
+func TestUserDefault(t *testing.T) {
+	const defaultsPath = "/usr/bin/defaults"
+	type value struct {
+		typ, val string
+	}
+	tests := []struct {
+		name     string
+		def      catpogs.UserDefault
+		existing *value
+
+		want        *value
+		wantChanged bool
+	}{
+		{
+			name:        "write missing",
+			def:         catpogs.UserDefault{Which: catalog.UserDefault_Which_boolean, Boolean: true},
+			want:        &value{"boolean", "1"},
+			wantChanged: true,
+		},
+		{
+			name:     "same integer",
+			def:      catpogs.UserDefault{Which: catalog.UserDefault_Which_integer, Integer: 48},
+			existing: &value{"integer", "48"},
+			want:     &value{"integer", "48"},
+		},
+		{
+			name:        "different type",
+			def:         catpogs.UserDefault{Which: catalog.UserDefault_Which_text, Text: "48"},
+			existing:    &value{"integer", "48"},
+			want:        &value{"string", "48"},
+			wantChanged: true,
+		},
+		{
+			name:        "different real",
+			def:         catpogs.UserDefault{Which: catalog.UserDefault_Which_real, Real: 0.5},
+			existing:    &value{"float", "0.25"},
+			want:        &value{"float", "0.5"},
+			wantChanged: true,
+		},
+		{
+			name:        "delete",
+			def:         catpogs.UserDefault{Which: catalog.UserDefault_Which_absent},
+			existing:    &value{"string", "hi"},
+			wantChanged: true,
+		},
+		{
+			name: "already absent",
+			def:  catpogs.UserDefault{Which: catalog.UserDefault_Which_absent},
+		},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		sys := new(fakesystem.System)
+		curr := test.existing
+		err := mkdirAll(ctx, sys, filepath.Dir(defaultsPath))
+		if err == nil {
+			err = sys.Mkprogram(defaultsPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+				args := pc.Args[1:]
+				if len(args) < 3 || args[1] != "com.apple.dock" || args[2] != "tilesize" {
+					fmt.Fprintf(pc.Output, "unexpected arguments %q\n", pc.Args)
+					return 64
+				}
+				switch {
+				case args[0] == "read-type" && len(args) == 3:
+					if curr == nil {
+						return 1
+					}
+					fmt.Fprintf(pc.Output, "Type is %s\n", curr.typ)
+				case args[0] == "read" && len(args) == 3:
+					if curr == nil {
+						return 1
+					}
+					fmt.Fprintln(pc.Output, curr.val)
+				case args[0] == "delete" && len(args) == 3:
+					if curr == nil {
+						return 1
+					}
+					curr = nil
+				case args[0] == "write" && len(args) == 5:
+					types := map[string]string{"-string": "string", "-int": "integer", "-float": "float", "-bool": "boolean"}
+					v := &value{types[args[3]], args[4]}
+					if v.typ == "boolean" {
+						v.val = map[string]string{"true": "1", "false": "0"}[args[4]]
+					}
+					curr = v
+				default:
+					fmt.Fprintf(pc.Output, "unexpected arguments %q\n", pc.Args)
+					return 64
+				}
+				return 0
+			})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		def := test.def
+		def.Domain = "com.apple.dock"
+		def.Key = "tilesize"
+		cat, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{ID: 1, Which: catalog.Resource_Which_userDefault, UserDefault: &def},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatalf("%s: catpogs.Catalog.ToCapnp(): %v", test.name, err)
+		}
+		report := new(Report)
+		if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}, Report: report}); err != nil {
+			t.Errorf("%s: Apply: %v", test.name, err)
+			continue
+		}
+		if (curr == nil) != (test.want == nil) || curr != nil && *curr != *test.want {
+			t.Errorf("%s: value = %+v; want %+v", test.name, curr, test.want)
+		}
+		wantStatus := StatusUnchanged
+		if test.wantChanged {
+			wantStatus = StatusChanged
+		}
+		if rr := report.Resource(1); rr == nil || rr.Status != wantStatus {
+			t.Errorf("%s: report = %+v; want %s", test.name, rr, wantStatus)
+		}
+	}
 }
 
-func (f *fixture) SystemInfo() *applytests.SystemInfo {
-	return f.info
+func TestFileVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+		want    string
+	}{
+		{name: "Valid", content: "valid\n", want: "valid\n"},
+		{name: "Invalid", content: "invalid\n", wantErr: true, want: "old\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			path := filepath.Join(fakesystem.Root, "foo.conf")
+			checkPath := filepath.Join(fakesystem.Root, "check")
+			file := catpogs.PlainFile(path, []byte(test.content))
+			file.Plain.Verify = &catpogs.Command{
+				Which: catalog.Exec_Command_Which_argv,
+				Argv:  []string{checkPath, "-f"},
+			}
+			cat, err := (&catpogs.Catalog{
+				Resources: []*catpogs.Resource{
+					{
+						ID:      1,
+						Comment: "config",
+						Which:   catalog.Resource_Which_file,
+						File:    file,
+					},
+				},
+			}).ToCapnp()
+			if err != nil {
+				t.Fatal("catpogs.Catalog.ToCapnp():", err)
+			}
+			sys := new(fakesystem.System)
+			if err := system.WriteFile(ctx, sys, path, []byte("old\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var checked string
+			err = sys.Mkprogram(checkPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+				checked = pc.Args[len(pc.Args)-1]
+				content, err := system.ReadFile(ctx, sys, checked)
+				if err != nil {
+					fmt.Fprintln(pc.Output, err)
+					return 1
+				}
+				if !bytes.HasPrefix(content, []byte("valid")) {
+					fmt.Fprintln(pc.Output, "syntax error")
+					return 1
+				}
+				return 0
+			})
+			if err != nil {
+				t.Fatal("Mkprogram:", err)
+			}
+
+			err = Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}})
+			if test.wantErr && err == nil {
+				t.Error("Apply did not return an error")
+			} else if !test.wantErr && err != nil {
+				t.Error("Apply:", err)
+			}
+			if got, err := system.ReadFile(ctx, sys, path); err != nil {
+				t.Error(err)
+			} else if string(got) != test.want {
+				t.Errorf("content = %q; want %q", got, test.want)
+			}
+			if checked == "" || checked == path {
+				t.Errorf("verify command checked %q; want a temporary file", checked)
+			} else if _, err := sys.Lstat(ctx, checked); !os.IsNotExist(err) {
+				t.Errorf("Lstat(%q) = _, %v; want not exist", checked, err)
+			}
+		})
+	}
 }
 
-func (f *fixture) Close() error {
-	return nil
+func TestFileGroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		contentB string
+		wantErr  bool
+		wantA    string
+		wantB    string // empty if b should not exist
+	}{
+		{name: "Valid", contentB: "valid b\n", wantA: "valid a\n", wantB: "valid b\n"},
+		{name: "Invalid", contentB: "invalid b\n", wantErr: true, wantA: "old a\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			pathA := filepath.Join(fakesystem.Root, "a.conf")
+			pathB := filepath.Join(fakesystem.Root, "b.conf")
+			checkPath := filepath.Join(fakesystem.Root, "check")
+			cat, err := (&catpogs.Catalog{
+				Resources: []*catpogs.Resource{
+					{
+						ID:      1,
+						Comment: "config",
+						Which:   catalog.Resource_Which_fileGroup,
+						FileGroup: &catpogs.FileGroup{
+							Files: []*catpogs.File{
+								catpogs.PlainFile(pathA, []byte("valid a\n")),
+								catpogs.PlainFile(pathB, []byte(test.contentB)),
+							},
+							Validate: &catpogs.Command{
+								Which: catalog.Exec_Command_Which_argv,
+								Argv:  []string{checkPath},
+							},
+						},
+					},
+				},
+			}).ToCapnp()
+			if err != nil {
+				t.Fatal("catpogs.Catalog.ToCapnp():", err)
+			}
+			sys := new(fakesystem.System)
+			if err := system.WriteFile(ctx, sys, pathA, []byte("old a\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var checked []string
+			err = sys.Mkprogram(checkPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+				checked = pc.Args[1:]
+				for _, path := range checked {
+					content, err := system.ReadFile(ctx, sys, path)
+					if err != nil {
+						fmt.Fprintln(pc.Output, err)
+						return 1
+					}
+					if !bytes.HasPrefix(content, []byte("valid")) {
+						fmt.Fprintf(pc.Output, "%s: syntax error\n", path)
+						return 1
+					}
+				}
+				return 0
+			})
+			if err != nil {
+				t.Fatal("Mkprogram:", err)
+			}
+
+			err = Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}})
+			if test.wantErr && err == nil {
+				t.Error("Apply did not return an error")
+			} else if !test.wantErr && err != nil {
+				t.Error("Apply:", err)
+			}
+			if got, err := system.ReadFile(ctx, sys, pathA); err != nil {
+				t.Error(err)
+			} else if string(got) != test.wantA {
+				t.Errorf("%s content = %q; want %q", pathA, got, test.wantA)
+			}
+			if test.wantB == "" {
+				if _, err := sys.Lstat(ctx, pathB); !os.IsNotExist(err) {
+					t.Errorf("Lstat(%q) = _, %v; want not exist", pathB, err)
+				}
+			} else if got, err := system.ReadFile(ctx, sys, pathB); err != nil {
+				t.Error(err)
+			} else if string(got) != test.wantB {
+				t.Errorf("%s content = %q; want %q", pathB, got, test.wantB)
+			}
+			if len(checked) != 2 {
+				t.Fatalf("validate command checked %q; want 2 staged files", checked)
+			}
+			for _, path := range checked {
+				if path == pathA || path == pathB {
+					t.Errorf("validate command checked %q; want a staged file", path)
+				} else if _, err := sys.Lstat(ctx, path); !os.IsNotExist(err) {
+					t.Errorf("Lstat(%q) = _, %v; want not exist", path, err)
+				}
+			}
+		})
+	}
 }
 
-type testLogger struct {
-	t applytests.Logger
+func TestFileGroupRestore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pathA := filepath.Join(fakesystem.Root, "a.conf")
+	pathB := filepath.Join(fakesystem.Root, "b.conf")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "config",
+				Which:   catalog.Resource_Which_fileGroup,
+				FileGroup: &catpogs.FileGroup{
+					Files: []*catpogs.File{
+						catpogs.PlainFile(pathA, []byte("new a\n")),
+						catpogs.PlainFile(pathB, []byte("new b\n")),
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := &renameFailSystem{System: new(fakesystem.System), failPath: pathB}
+	if err := system.WriteFile(ctx, sys, pathA, []byte("old a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := system.WriteFile(ctx, sys, pathB, []byte("old b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}}); err == nil {
+		t.Error("Apply did not return an error")
+	}
+	if got, err := system.ReadFile(ctx, sys, pathA); err != nil {
+		t.Error(err)
+	} else if string(got) != "old a\n" {
+		t.Errorf("%s content = %q; want \"old a\\n\"", pathA, got)
+	}
+	if got, err := system.ReadFile(ctx, sys, pathB); err != nil {
+		t.Error(err)
+	} else if string(got) != "old b\n" {
+		t.Errorf("%s content = %q; want \"old b\\n\"", pathB, got)
+	}
+	if info, err := sys.Lstat(ctx, pathA); err != nil {
+		t.Error(err)
+	} else if info.Mode()&os.ModePerm != 0644 {
+		t.Errorf("%s mode = %v; want 0644", pathA, info.Mode()&os.ModePerm)
+	}
+	infos, err := sys.ReadDir(ctx, fakesystem.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if name := info.Name(); name != "a.conf" && name != "b.conf" {
+			t.Errorf("%s left in %s", name, fakesystem.Root)
+		}
+	}
 }
 
-func (tl testLogger) Infof(ctx context.Context, format string, args ...interface{}) {
-	tl.t.Logf("applier info: "+format, args...)
+// renameFailSystem fails renames onto failPath.
+type renameFailSystem struct {
+	*fakesystem.System
+	failPath string
 }
 
-func (tl testLogger) Error(ctx context.Context, err error) {
-	tl.t.Logf("applier error: %v", err)
+func (sys *renameFailSystem) Rename(ctx context.Context, oldpath, newpath string) error {
+	if newpath == sys.failPath {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("injected failure")}
+	}
+	return sys.System.Rename(ctx, oldpath, newpath)
+}
+
+func TestFileCreateParents(t *testing.T) {
+	tests := []struct {
+		name          string
+		createParents bool
+		wantErr       bool
+	}{
+		{name: "Set", createParents: true},
+		{name: "Unset", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			dir := filepath.Join(fakesystem.Root, "opt", "app")
+			path := filepath.Join(dir, "app.conf")
+			f := catpogs.PlainFile(path, []byte("Hello"))
+			f.CreateParents = test.createParents
+			cat, err := (&catpogs.Catalog{
+				Resources: []*catpogs.Resource{
+					{
+						ID:      42,
+						Comment: "file",
+						Which:   catalog.Resource_Which_file,
+						File:    f,
+					},
+				},
+			}).ToCapnp()
+			if err != nil {
+				t.Fatal("catpogs.Catalog.ToCapnp():", err)
+			}
+			sys := new(fakesystem.System)
+
+			err = Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}})
+			if test.wantErr {
+				if err == nil {
+					t.Error("Apply did not return an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal("Apply:", err)
+			}
+			if info, err := sys.Lstat(ctx, dir); err != nil {
+				t.Error(err)
+			} else if !info.IsDir() {
+				t.Errorf("%s is not a directory", dir)
+			}
+			if content, err := system.ReadFile(ctx, sys, path); err != nil {
+				t.Error(err)
+			} else if string(content) != "Hello" {
+				t.Errorf("%s content = %q; want \"Hello\"", path, content)
+			}
+		})
+	}
+}
+
+func TestVariant(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(fakesystem.Root, "pkg.conf")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "package config",
+				Which:   catalog.Resource_Which_variant,
+				Variant: &catpogs.Variant{
+					Cases: []*catpogs.VariantCase{
+						{
+							When: []*catpogs.VariantSelector{
+								{Variable: "facts.os_release.ID", Values: []string{"fedora", "rhel"}},
+							},
+							Resource: &catpogs.Resource{
+								Which: catalog.Resource_Which_file,
+								File:  catpogs.PlainFile(path, []byte("yum")),
+							},
+						},
+						{
+							When: []*catpogs.VariantSelector{
+								{Variable: "facts.os_release.ID", Values: []string{"debian", "ubuntu"}},
+							},
+							Resource: &catpogs.Resource{
+								Which: catalog.Resource_Which_file,
+								File:  catpogs.PlainFile(path, []byte("apt")),
+							},
+						},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+
+	err = Apply(ctx, sys, cat, &Options{
+		Log:  testLogger{t: t},
+		Vars: map[string]string{"facts.os_release.ID": "arch"},
+	})
+	if err == nil {
+		t.Error("Apply with no matching case did not return an error")
+	}
+	if _, err := sys.Lstat(ctx, path); !system.IsNotExist(err) {
+		t.Errorf("after failed Apply, lstat %s = %v; want not exist", path, err)
+	}
+
+	err = Apply(ctx, sys, cat, &Options{
+		Log:  testLogger{t: t},
+		Vars: map[string]string{"facts.os_release.ID": "debian"},
+	})
+	if err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if content, err := system.ReadFile(ctx, sys, path); err != nil {
+		t.Error(err)
+	} else if string(content) != "apt" {
+		t.Errorf("%s content = %q; want \"apt\"", path, content)
+	}
+}
+
+func TestContentFromOutput(t *testing.T) {
+	ctx := context.Background()
+	progPath := filepath.Join(fakesystem.Root, "gen")
+	stampPath := filepath.Join(fakesystem.Root, "stamp")
+	dst := filepath.Join(fakesystem.Root, "generated.conf")
+	file := catpogs.PlainFile(dst, nil)
+	file.Plain.ContentFromOutput = 2
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			// The file is listed first, without a dependency, to check
+			// that it waits for its source.
+			{ID: 1, Which: catalog.Resource_Which_file, File: file},
+			{
+				ID:    2,
+				Which: catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{progPath},
+					},
+					Condition: catpogs.ExecCondition{Which: catalog.Exec_condition_Which_always},
+					Creates:   stampPath,
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(fakesystem.System)
+	err = sys.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		io.WriteString(pc.Output, "generated\n")
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}}); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if got, err := system.ReadFile(ctx, sys, dst); err != nil {
+		t.Error(err)
+	} else if string(got) != "generated\n" {
+		t.Errorf("%s content = %q; want %q", dst, got, "generated\n")
+	}
+
+	// Once the command no longer runs, the file is left alone.
+	if err := system.WriteFile(ctx, sys, stampPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := system.WriteFile(ctx, sys, dst, []byte("edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(ctx, sys, cat, &Options{Log: testLogger{t: t}}); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	if got, err := system.ReadFile(ctx, sys, dst); err != nil {
+		t.Error(err)
+	} else if string(got) != "edited\n" {
+		t.Errorf("%s content = %q after Apply without running command; want %q", dst, got, "edited\n")
+	}
 }
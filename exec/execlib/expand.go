@@ -0,0 +1,62 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bytes"
+	"strings"
+)
+
+// expandVars replaces ${name} references in s with values from vars.
+// "$$" is replaced with a single "$", and a "$" followed by any other
+// character is left as is, so that shell syntax like $HOME passes
+// through untouched.
+func expandVars(s string, vars map[string]string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	buf := new(bytes.Buffer)
+	for {
+		i := strings.IndexByte(s, '$')
+		if i == -1 || i == len(s)-1 {
+			buf.WriteString(s)
+			return buf.String(), nil
+		}
+		buf.WriteString(s[:i])
+		switch s[i+1] {
+		case '$':
+			buf.WriteByte('$')
+			s = s[i+2:]
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end == -1 {
+				return "", errorf("unterminated ${ in %q", s[i:])
+			}
+			name := s[i+2 : i+2+end]
+			if name == "" {
+				return "", errorf("empty variable name in %q", s)
+			}
+			v, ok := vars[name]
+			if !ok {
+				return "", errorf("unknown variable %q", name)
+			}
+			buf.WriteString(v)
+			s = s[i+2+end+1:]
+		default:
+			buf.WriteByte('$')
+			s = s[i+1:]
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// hasExpect reports whether an exec resource checks its command's
+// result.
+func hasExpect(e catalog.Exec) bool {
+	expect := e.Expect()
+	pattern, _ := expect.OutputPattern()
+	return pattern != "" || expect.HasExitCodes()
+}
+
+// runExpectCommand runs c with extra arguments appended, like
+// runCommand, then checks its exit code and output against the
+// resource's expect group.
+func (j *job) runExpectCommand(ctx context.Context, c catalog.Exec_Command, extra []string, expect catalog.Exec_expect) error {
+	pattern, err := expect.OutputPattern()
+	if err != nil {
+		return errorf("read expected output pattern: %v", err)
+	}
+	var re *regexp.Regexp
+	if pattern != "" {
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			return errorf("expected output pattern: %v", err)
+		}
+	}
+	list, err := expect.ExitCodes()
+	if err != nil {
+		return errorf("read expected exit codes: %v", err)
+	}
+	codes := make([]int, list.Len())
+	for i := range codes {
+		codes[i] = int(list.At(i))
+	}
+	if len(codes) == 0 {
+		codes = []int{0}
+	}
+
+	cmd, err := j.prepareCommand(ctx, c)
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, extra...)
+	out, err := j.sys.Run(ctx, cmd)
+	j.teeOutput(ctx, cmd, out, err)
+	code := 0
+	got := "exit status 0"
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// exitCode is -1 if the process was killed by a signal or its
+		// status is unknown, which never matches.
+		code = exitCode(exitErr)
+		got = "unknown exit status"
+		if exitErr.ProcessState != nil {
+			got = exitErr.Error()
+		}
+	} else if err != nil {
+		return errorWithOutput(out, j.maxOutput, err)
+	}
+	if !containsInt(codes, code) {
+		return errorWithOutput(out, j.maxOutput, errorf("%s; expected exit status %s", got, formatExitCodes(codes)))
+	}
+	if re != nil && !re.Match(out) {
+		return errorWithOutput(out, j.maxOutput, errorf("output does not match %q", pattern))
+	}
+	j.logOutput(ctx, out)
+	return j.keep(out)
+}
+
+// exitCode returns the exit code of the process that caused err, or -1
+// if it was killed by a signal or its status is unknown.
+func exitCode(err *exec.ExitError) int {
+	if err.ProcessState == nil {
+		return -1
+	}
+	ws, ok := err.Sys().(interface {
+		ExitStatus() int
+	})
+	if !ok {
+		return -1
+	}
+	return ws.ExitStatus()
+}
+
+func containsInt(list []int, x int) bool {
+	for _, y := range list {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
+
+// formatExitCodes returns a list of exit codes as "0", "0 or 1", or
+// "0, 1, or 2".
+func formatExitCodes(codes []int) string {
+	s := make([]string, len(codes))
+	for i, c := range codes {
+		s[i] = fmt.Sprint(c)
+	}
+	switch len(s) {
+	case 1:
+		return s[0]
+	case 2:
+		return s[0] + " or " + s[1]
+	default:
+		return strings.Join(s[:len(s)-1], ", ") + ", or " + s[len(s)-1]
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// A groupFile is a file in a file group resource.
+type groupFile struct {
+	path    string
+	mode    catalog.File_Mode
+	content []byte
+
+	// createParents is true if missing directories above path are
+	// created when the file is staged.
+	createParents bool
+
+	// info is the state of the existing file, or nil if it does not
+	// exist.  old is the existing file's content.
+	info os.FileInfo
+	old  []byte
+
+	// changed is true if the file's content differs from content.
+	changed bool
+
+	// staged is the path of the file's staged copy, or empty if the
+	// copy was never created or has been renamed into place.
+	staged string
+
+	// backup is the path of a copy of the existing file that is
+	// renamed back into place if the group can't be installed, or
+	// empty if there is none.
+	backup string
+
+	// installed is true once the staged copy has been renamed into
+	// place.
+	installed bool
+}
+
+// fileGroup applies a file group resource.  If any of the files'
+// content has changed, then all of the files are staged next to their
+// targets and checked with the group's validate command before the
+// changed ones are renamed into place.
+func (j *job) fileGroup(ctx context.Context, g catalog.FileGroup) (changed bool, err error) {
+	list, err := g.Files()
+	if err != nil {
+		return false, errorf("read files from catalog: %v", err)
+	}
+	files := make([]*groupFile, list.Len())
+	contentChanged := false
+	for i := range files {
+		files[i], err = j.readGroupFile(ctx, list.At(i))
+		if err != nil {
+			return false, err
+		}
+		contentChanged = contentChanged || files[i].changed
+	}
+	if contentChanged {
+		if err := j.installGroup(ctx, g, files); err != nil {
+			return false, err
+		}
+	}
+	for _, gf := range files {
+		modeChanged, err := j.fileMode(ctx, gf.path, gf.mode)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || modeChanged
+	}
+	return contentChanged || changed, nil
+}
+
+// readGroupFile computes the content of a file in a file group and
+// compares it with the file on the system.
+func (j *job) readGroupFile(ctx context.Context, f catalog.File) (*groupFile, error) {
+	path, err := f.Path()
+	if err != nil {
+		return nil, errorf("read file path from catalog: %v", err)
+	}
+	if path == "" {
+		return nil, errorf("file path is empty")
+	}
+	if f.Which() != catalog.File_Which_plain {
+		return nil, errorf("%s: file groups only support plain files, not %v", path, f.Which())
+	}
+	p := f.Plain()
+	switch {
+	case !p.HasContent() && !p.HasContentUrl() && !p.HasContentPath():
+		return nil, errorf("%s: file group files need content, contentUrl, or contentPath", path)
+	case p.ContentFromOutput() != 0 || p.OnlyIfExists() || p.CreateOnly() || p.HasVerify():
+		return nil, errorf("%s: file group files can't set contentFromOutput, onlyIfExists, createOnly, or verify", path)
+	}
+	content, err := j.plainContent(ctx, p)
+	if err != nil {
+		return nil, errorf("%s: %v", path, err)
+	}
+	mode, _ := p.Mode()
+	gf := &groupFile{path: path, mode: mode, content: content, createParents: f.CreateParents()}
+	gf.info, err = j.sys.Lstat(ctx, path)
+	if os.IsNotExist(err) {
+		gf.info = nil
+		gf.changed = true
+		return gf, nil
+	}
+	if err != nil {
+		return nil, errorf("determine state of %s: %v", path, err)
+	}
+	if !gf.info.Mode().IsRegular() {
+		return nil, errorf("%s is not a regular file", path)
+	}
+	gf.old, err = system.ReadFile(ctx, j.sys, path)
+	if err != nil {
+		return nil, err
+	}
+	gf.changed = !bytes.Equal(gf.old, content)
+	return gf, nil
+}
+
+// installGroup stages every file in the group, runs the validate
+// command, and then renames the staged copies of the changed files
+// into place.  The changed files are backed up first, so that if a
+// rename fails, the files already installed are put back.  Staged
+// copies that are not renamed and backups are removed.
+func (j *job) installGroup(ctx context.Context, g catalog.FileGroup, files []*groupFile) error {
+	renamer, ok := j.sys.(system.Renamer)
+	if !ok {
+		return errorf("system cannot rename files")
+	}
+	defer func() {
+		for _, gf := range files {
+			if gf.staged != "" {
+				if err := j.sys.Remove(ctx, gf.staged); err != nil {
+					j.warnf("remove staged file: %v", err)
+				}
+			}
+			if gf.backup != "" {
+				if err := j.sys.Remove(ctx, gf.backup); err != nil {
+					j.warnf("remove backup file: %v", err)
+				}
+			}
+		}
+	}()
+	for _, gf := range files {
+		if err := j.stageGroupFile(ctx, gf); err != nil {
+			return errorf("stage %s: %v", gf.path, err)
+		}
+	}
+	if g.HasValidate() {
+		if err := j.validateGroup(ctx, g, files); err != nil {
+			return err
+		}
+	}
+	for _, gf := range files {
+		if !gf.changed || gf.info == nil {
+			continue
+		}
+		if err := j.backupGroupFile(ctx, gf); err != nil {
+			return errorf("back up %s: %v", gf.path, err)
+		}
+	}
+	for _, gf := range files {
+		if !gf.changed {
+			continue
+		}
+		debugf(j.log, ctx, Verbose, "%s: installing %s", formatResource(j.resource), gf.path)
+		if err := renamer.Rename(ctx, gf.staged, gf.path); err != nil {
+			j.restoreGroup(ctx, renamer, files)
+			return errorf("install %s: %v", gf.path, err)
+		}
+		gf.staged = ""
+		gf.installed = true
+	}
+	return nil
+}
+
+// backupGroupFile copies the existing file's content, permissions, and
+// owner to a file in the same directory, so that it can be renamed
+// back over the file.
+func (j *job) backupGroupFile(ctx context.Context, gf *groupFile) error {
+	tmp := filepath.Join(filepath.Dir(gf.path), "."+filepath.Base(gf.path)+".mcm-backup")
+	perm := gf.info.Mode() & os.ModePerm
+	if err := j.createTempFile(ctx, tmp, gf.old, perm); err != nil {
+		return err
+	}
+	gf.backup = tmp
+	// The umask may have removed bits from the existing mode.
+	if err := j.sys.Chmod(ctx, tmp, perm); err != nil {
+		return err
+	}
+	if uid, gid, err := j.sys.OwnerInfo(gf.info); err != nil {
+		j.warnf("reading owner of %s: %v; backup keeps the applier's owner", gf.path, err)
+	} else if err := j.sys.Chown(ctx, tmp, uid, gid); err != nil {
+		return err
+	}
+	return nil
+}
+
+// restoreGroup puts back the files of a group that were installed
+// before a later file failed to install: files that existed are
+// replaced by their backups and new files are removed.
+func (j *job) restoreGroup(ctx context.Context, renamer system.Renamer, files []*groupFile) {
+	for _, gf := range files {
+		if !gf.installed {
+			continue
+		}
+		debugf(j.log, ctx, Verbose, "%s: restoring %s", formatResource(j.resource), gf.path)
+		if gf.backup == "" {
+			if err := j.sys.Remove(ctx, gf.path); err != nil {
+				j.warnf("restore %s: %v", gf.path, err)
+			}
+			continue
+		}
+		if err := renamer.Rename(ctx, gf.backup, gf.path); err != nil {
+			j.warnf("restore %s: %v", gf.path, err)
+			continue
+		}
+		gf.backup = ""
+	}
+}
+
+// stageGroupFile writes the file's content to a staging file in the
+// same directory, so that it can be renamed over the file.  The staged
+// copy gets the existing file's permissions and owner, then the
+// catalog's mode.
+func (j *job) stageGroupFile(ctx context.Context, gf *groupFile) error {
+	// Dot files are skipped by the include directives of most
+	// programs, so a staged file isn't picked up before it is renamed.
+	tmp := filepath.Join(filepath.Dir(gf.path), "."+filepath.Base(gf.path)+".mcm-stage")
+	if gf.info == nil && gf.createParents {
+		if _, err := j.mkdirAll(ctx, filepath.Dir(gf.path)); err != nil {
+			return errorf("create parents: %v", err)
+		}
+	}
+	bits := gf.mode.Bits()
+	def := os.FileMode(0666)
+	if gf.info != nil {
+		def = gf.info.Mode() & os.ModePerm
+	}
+	if err := j.createTempFile(ctx, tmp, gf.content, createMode(bits, def)); err != nil {
+		return err
+	}
+	gf.staged = tmp
+	if gf.info == nil {
+		if err := j.applyUmask(ctx, tmp, bits, def); err != nil {
+			return err
+		}
+	} else {
+		if bits == catalog.File_Mode_unset {
+			// The umask may have removed bits from the existing mode.
+			if err := j.sys.Chmod(ctx, tmp, def); err != nil {
+				return err
+			}
+		}
+		if uid, gid, err := j.sys.OwnerInfo(gf.info); err != nil {
+			j.warnf("reading owner of %s: %v; staged file keeps the applier's owner", gf.path, err)
+		} else if err := j.sys.Chown(ctx, tmp, uid, gid); err != nil {
+			return err
+		}
+	}
+	_, err := j.fileMode(ctx, tmp, gf.mode)
+	return err
+}
+
+// validateGroup runs the group's validate command on the staged files.
+func (j *job) validateGroup(ctx context.Context, g catalog.FileGroup, files []*groupFile) error {
+	c, err := g.Validate()
+	if err != nil {
+		return errorf("read validate command from catalog: %v", err)
+	}
+	cmd, err := j.prepareCommand(ctx, c)
+	if err != nil {
+		return errorf("validate: %v", err)
+	}
+	staged := make([]string, len(files))
+	for i, gf := range files {
+		staged[i] = gf.staged
+	}
+	if c.Which() == catalog.Exec_Command_Which_argv {
+		cmd.Args = append(cmd.Args, staged...)
+	}
+	cmd.Env = append(cmd.Env, "MCM_STAGED_FILES="+strings.Join(staged, "\n"))
+	debugf(j.log, ctx, Verbose, "%s: validating %d staged files", formatResource(j.resource), len(staged))
+	out, err := j.sys.Run(ctx, cmd)
+	if err != nil {
+		return errorWithOutput(out, j.maxOutput, errorf("validate: %v", err))
+	}
+	j.logOutput(ctx, out)
+	return nil
+}
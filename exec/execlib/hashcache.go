@@ -0,0 +1,136 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/state"
+	"github.com/zombiezen/mcm/internal/system"
+	"github.com/zombiezen/mcm/internal/xxhash"
+)
+
+// minHashCacheSize is the smallest content for which a file's hash is
+// cached.  Smaller files are cheap enough to compare directly.
+const minHashCacheSize = 1 << 20
+
+// racyWindow is how recently a file may have been modified for its hash
+// to not be cached.  A file could be written again within the
+// granularity of its modification time without the time changing, so
+// the hash of a file that was just modified can't be trusted later.
+const racyWindow = 2 * time.Second
+
+// A hashCache remembers the content hashes of files in a state, so that
+// a large file that hasn't changed since the last run doesn't need to
+// be read to compare it.  It is safe to use from multiple goroutines.
+type hashCache struct {
+	now func() time.Time
+
+	// fast is whether content is hashed with xxHash instead of
+	// SHA-256.  Hashes recorded with the other function are ignored.
+	fast bool
+
+	mu sync.Mutex
+	st *state.State
+}
+
+// stat returns the key for the file at path, without a hash.  It
+// returns nil if the file is not a regular file or can't be examined.
+func (c *hashCache) stat(ctx context.Context, sys system.System, path string) *state.FileHash {
+	info, err := sys.Lstat(ctx, path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	key := &state.FileHash{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if fi, ok := sys.(system.FileIdentifier); ok {
+		// Systems without inodes are keyed by size and time alone.
+		key.Device, key.Inode, _ = fi.FileIdentity(info)
+	}
+	return key
+}
+
+// lookup returns the hash recorded for the file at path if it matches
+// key.
+func (c *hashCache) lookup(path string, key *state.FileHash) (sum string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.st.Hashes[path]
+	if h == nil || !h.Matches(key) {
+		return "", false
+	}
+	sum = c.recorded(h)
+	return sum, sum != ""
+}
+
+// previous returns the hash recorded for the file at path, even if the
+// file has changed since, or the empty string if none was recorded.
+func (c *hashCache) previous(path string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h := c.st.Hashes[path]
+	if h == nil {
+		return ""
+	}
+	return c.recorded(h)
+}
+
+// recorded returns the hash in h that the cache uses.
+func (c *hashCache) recorded(h *state.FileHash) string {
+	if c.fast {
+		return h.XXH64
+	}
+	return h.SHA256
+}
+
+// sum returns the hash of content that the cache uses.
+func (c *hashCache) sum(content []byte) string {
+	if c.fast {
+		return fmt.Sprintf("%016x", xxhash.Sum64(content))
+	}
+	return sha256Hex(content)
+}
+
+// record saves sum as the hash of the file at path, unless the file
+// was modified too recently to trust key.
+func (c *hashCache) record(path string, key *state.FileHash, sum string) {
+	if !key.ModTime.Before(c.now().Add(-racyWindow)) {
+		return
+	}
+	h := *key
+	if c.fast {
+		h.XXH64 = sum
+	} else {
+		h.SHA256 = sum
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.st.Hashes == nil {
+		c.st.Hashes = make(map[string]*state.FileHash)
+	}
+	c.st.Hashes[path] = &h
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// DefaultHealthTimeout is how long a health check is retried if the
+// catalog does not give a timeout.
+const DefaultHealthTimeout = 30 * time.Second
+
+// Health check backoff bounds.
+const (
+	defaultHealthBackoff = 100 * time.Millisecond
+	maxHealthBackoff     = 5 * time.Second
+)
+
+// healthCheck runs a health check until it passes or times out.  If
+// the check did not pass, then unhealthy describes the last failure.
+// err is only returned for a malformed check.
+func (j *job) healthCheck(ctx context.Context, hc catalog.HealthCheck) (unhealthy error, err error) {
+	d, ok := j.sys.(system.Dialer)
+	if !ok {
+		return nil, errorf("system cannot check network services")
+	}
+	var check func(ctx context.Context) error
+	switch hc.Which() {
+	case catalog.HealthCheck_Which_tcpAddress:
+		addr, err := hc.TcpAddress()
+		if err != nil {
+			return nil, errorf("read address: %v", err)
+		}
+		if addr == "" {
+			return nil, errorf("empty TCP address")
+		}
+		check = func(ctx context.Context) error {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	case catalog.HealthCheck_Which_httpUrl:
+		rawurl, err := hc.HttpUrl()
+		if err != nil {
+			return nil, errorf("read URL: %v", err)
+		}
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, errorf("parse URL: %v", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, errorf("URL %s is not HTTP or HTTPS", rawurl)
+		}
+		client := &http.Client{
+			Transport: &http.Transport{DialContext: d.DialContext},
+		}
+		defer client.Transport.(*http.Transport).CloseIdleConnections()
+		check = func(ctx context.Context) error {
+			return checkHTTP(ctx, client, u)
+		}
+	default:
+		return nil, errorf("unknown health check %v", hc.Which())
+	}
+	if j.skipHealth {
+		debugf(j.log, ctx, Verbose, "%s: skipping health check", formatResource(j.resource))
+		return nil, nil
+	}
+
+	timeout := DefaultHealthTimeout
+	if ms := hc.TimeoutMillis(); ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	backoff := defaultHealthBackoff
+	if ms := hc.BackoffMillis(); ms > 0 {
+		backoff = time.Duration(ms) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		err := check(ctx)
+		if err == nil {
+			return nil, nil
+		}
+		debugf(j.log, ctx, Verbose, "%s: not healthy yet: %v", formatResource(j.resource), err)
+		select {
+		case <-ctx.Done():
+			return errorf("not healthy after %v: %v", timeout, err), nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxHealthBackoff {
+			backoff = maxHealthBackoff
+		}
+	}
+}
+
+func checkHTTP(ctx context.Context, client *http.Client, u *url.URL) error {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errorf("GET %s: %s", u, resp.Status)
+	}
+	return nil
+}
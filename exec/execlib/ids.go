@@ -0,0 +1,61 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// newRunID returns a random (version 4) UUID to identify a run.
+func newRunID() string {
+	var u [16]byte
+	randomBytes(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// newSpanID returns a random 16-digit hex string to identify a
+// resource within a run.
+func newSpanID() string {
+	var b [8]byte
+	randomBytes(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func randomBytes(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the OS can't provide randomness, in
+		// which case nothing else would work either.
+		panic(fmt.Sprintf("execlib: generate ID: %v", err))
+	}
+}
+
+type runIDKey struct{}
+
+// RunIDFromContext returns the Options.RunID of the run that a message
+// passed to a Logger is from.  It returns the empty string if the
+// message is not from a run.
+func RunIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(runIDKey{}).(string)
+	return id
+}
+
+func withRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, id)
+}
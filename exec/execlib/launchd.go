@@ -0,0 +1,144 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// Paths of the macOS tools used to apply launchd and user defaults
+// resources.
+const (
+	launchctlPath = "/bin/launchctl"
+	defaultsPath  = "/usr/bin/defaults"
+)
+
+func (j *job) launchdJob(ctx context.Context, l catalog.LaunchdJob) (changed bool, err error) {
+	label, err := l.Label()
+	if err != nil {
+		return false, errorf("read label: %v", err)
+	}
+	if label == "" {
+		return false, errorf("launchd job label is empty")
+	}
+	plist, err := l.PlistPath()
+	if err != nil {
+		return false, errorf("read plist path: %v", err)
+	}
+	domain, err := l.Domain()
+	if err != nil {
+		return false, errorf("read domain: %v", err)
+	}
+	if domain == "" {
+		domain = "system"
+	}
+	target := domain + "/" + label
+
+	// Enable before loading, since launchctl refuses to load a
+	// disabled job.
+	if en := l.Enabled(); en != catalog.LaunchdJob_Enabled_unchanged {
+		out, err := j.runProgram(ctx, launchctlPath, "print-disabled", domain)
+		if err != nil {
+			return false, err
+		}
+		disabled, found := parseLaunchdDisabled(out, label)
+		switch {
+		case en == catalog.LaunchdJob_Enabled_enabled && (disabled || !found):
+			if _, err := j.runProgram(ctx, launchctlPath, "enable", target); err != nil {
+				return false, err
+			}
+			changed = true
+		case en == catalog.LaunchdJob_Enabled_disabled && (!disabled || !found):
+			if _, err := j.runProgram(ctx, launchctlPath, "disable", target); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+
+	_, loaded, err := j.probeProgram(ctx, launchctlPath, "print", target)
+	if err != nil {
+		return changed, err
+	}
+	switch l.Which() {
+	case catalog.LaunchdJob_Which_loaded:
+		if loaded && !(l.ReloadIfDepsChanged() && j.anyDepsChanged()) {
+			return changed, nil
+		}
+		if plist == "" {
+			return changed, errorf("launchd job %s has no plist path to load", label)
+		}
+		if loaded {
+			if _, err := j.runProgram(ctx, launchctlPath, "bootout", target); err != nil {
+				return changed, err
+			}
+			changed = true
+		}
+		if _, err := j.runProgram(ctx, launchctlPath, "bootstrap", domain, plist); err != nil {
+			return changed, err
+		}
+		return true, nil
+	case catalog.LaunchdJob_Which_unloaded:
+		if !loaded {
+			return changed, nil
+		}
+		if _, err := j.runProgram(ctx, launchctlPath, "bootout", target); err != nil {
+			return changed, err
+		}
+		return true, nil
+	default:
+		return changed, errorf("unknown launchd job state %v", l.Which())
+	}
+}
+
+// parseLaunchdDisabled finds a job in the output of launchctl
+// print-disabled, which has lines like:
+//
+//	"com.example.agent" => disabled
+//
+// Older versions of launchctl print true and false instead.
+func parseLaunchdDisabled(out []byte, label string) (disabled, found bool) {
+	prefix := `"` + label + `" =>`
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		switch strings.TrimSpace(line[len(prefix):]) {
+		case "disabled", "true":
+			return true, true
+		case "enabled", "false":
+			return false, true
+		}
+	}
+	return false, false
+}
+
+// anyDepsChanged reports whether any of the resource's dependencies
+// changed during the run.
+func (j *job) anyDepsChanged() bool {
+	for _, c := range j.depsChanged {
+		if c {
+			return true
+		}
+	}
+	return false
+}
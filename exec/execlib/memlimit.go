@@ -0,0 +1,124 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// A memLimiter bounds the memory that running resources are estimated
+// to use for file content and command output.  A nil memLimiter allows
+// everything.  It is only used by the scheduling goroutine, so it is
+// not safe to use from multiple goroutines.
+type memLimiter struct {
+	limit     int64
+	maxOutput int
+	used      int64
+	estimates map[uint64]int64
+}
+
+// newMemLimiter returns a limiter for the given number of bytes, or nil
+// if limit is not positive.
+func newMemLimiter(limit int64, maxOutput int) *memLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &memLimiter{
+		limit:     limit,
+		maxOutput: maxOutput,
+		estimates: make(map[uint64]int64),
+	}
+}
+
+// allows reports whether starting res would stay within the limit.  A
+// resource is always allowed when no others are counted, so that a
+// resource larger than the limit still applies, alone.
+func (l *memLimiter) allows(ctx context.Context, sys system.System, res catalog.Resource) bool {
+	if l == nil || l.used == 0 {
+		return true
+	}
+	return l.used+l.estimate(ctx, sys, res) <= l.limit
+}
+
+// acquire counts res as running.
+func (l *memLimiter) acquire(ctx context.Context, sys system.System, res catalog.Resource) {
+	if l == nil {
+		return
+	}
+	l.used += l.estimate(ctx, sys, res)
+}
+
+// release counts res as no longer running.
+func (l *memLimiter) release(res catalog.Resource) {
+	if l == nil {
+		return
+	}
+	l.used -= l.estimates[res.ID()]
+}
+
+// estimate returns the number of bytes that res is expected to buffer,
+// computing it the first time res is seen.
+func (l *memLimiter) estimate(ctx context.Context, sys system.System, res catalog.Resource) int64 {
+	n, ok := l.estimates[res.ID()]
+	if !ok {
+		n = estimateMemory(ctx, sys, res, l.maxOutput)
+		l.estimates[res.ID()] = n
+	}
+	return n
+}
+
+// estimateMemory returns the number of bytes that applying res is
+// expected to buffer: the content of a plain file that is copied from
+// contentPath or downloaded from contentUrl, or the output kept from
+// an exec command.  Content in the catalog is already in memory, so it
+// isn't counted.  A download is estimated by the size of the file it
+// replaces, since its own size isn't known until it is fetched.
+func estimateMemory(ctx context.Context, sys system.System, res catalog.Resource, maxOutput int) int64 {
+	switch res.Which() {
+	case catalog.Resource_Which_file:
+		f, err := res.File()
+		if err != nil || f.Which() != catalog.File_Which_plain {
+			return 0
+		}
+		p := f.Plain()
+		var path string
+		switch {
+		case p.HasContentPath():
+			path, _ = p.ContentPath()
+		case p.HasContentUrl():
+			path, _ = f.Path()
+		default:
+			return 0
+		}
+		if path == "" {
+			return 0
+		}
+		info, err := sys.Lstat(ctx, path)
+		if err != nil || !info.Mode().IsRegular() {
+			return 0
+		}
+		return info.Size()
+	case catalog.Resource_Which_exec:
+		if maxOutput < 0 {
+			return 0
+		}
+		return int64(maxOutput)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import "sync"
+
+// A Pauser holds off starting resources in a run while it is paused.
+// Resources that are being applied when the Pauser is paused finish
+// normally, and the run continues once the Pauser is resumed.  The zero
+// value is a resumed Pauser.  Its methods are safe to call from
+// multiple goroutines.
+type Pauser struct {
+	mu      sync.Mutex
+	resumed chan struct{} // non-nil while paused
+}
+
+// Pause stops runs using p from starting any more resources.
+func (p *Pauser) Pause() {
+	p.mu.Lock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+	p.mu.Unlock()
+}
+
+// Resume lets runs using p continue.
+func (p *Pauser) Resume() {
+	p.mu.Lock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+	p.mu.Unlock()
+}
+
+// Paused reports whether p is paused.
+func (p *Pauser) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed != nil
+}
+
+// wait returns a channel that is closed when p is resumed, or nil if p
+// is nil or not paused.
+func (p *Pauser) wait() <-chan struct{} {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed
+}
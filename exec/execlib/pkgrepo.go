@@ -0,0 +1,262 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// Paths of the files and tools used to apply package repo resources.
+const (
+	aptSourcesDir  = "/etc/apt/sources.list.d"
+	aptKeyringsDir = "/etc/apt/keyrings"
+	aptGetPath     = "/usr/bin/apt-get"
+	yumReposDir    = "/etc/yum.repos.d"
+	rpmKeysDir     = "/etc/pki/rpm-gpg"
+	yumPath        = "/usr/bin/yum"
+)
+
+// A repoFile is a file written for a package repo resource.
+type repoFile struct {
+	path    string
+	content []byte
+}
+
+func (j *job) packageRepo(ctx context.Context, pr catalog.PackageRepo) (changed bool, err error) {
+	name, err := pr.Name()
+	if err != nil {
+		return false, errorf("read name: %v", err)
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return false, errorf("package repo name %q is invalid", name)
+	}
+	var files []repoFile
+	var refresh []string
+	switch pr.Which() {
+	case catalog.PackageRepo_Which_apt:
+		listPath := filepath.Join(aptSourcesDir, name+".list")
+		if pr.Absent() {
+			return j.removeRepoFiles(ctx, listPath, aptKeyPath(name, true), aptKeyPath(name, false))
+		}
+		a, err := pr.Apt()
+		if err != nil {
+			return false, errorf("read apt: %v", err)
+		}
+		files, err = aptRepoFiles(name, listPath, a)
+		if err != nil {
+			return false, err
+		}
+		refresh = []string{
+			aptGetPath, "update",
+			"-o", "Dir::Etc::sourcelist=" + listPath,
+			"-o", "Dir::Etc::sourceparts=-",
+			"-o", "APT::Get::List-Cleanup=0",
+		}
+	case catalog.PackageRepo_Which_yum:
+		repoPath := filepath.Join(yumReposDir, name+".repo")
+		if pr.Absent() {
+			return j.removeRepoFiles(ctx, repoPath, yumKeyPath(name))
+		}
+		y, err := pr.Yum()
+		if err != nil {
+			return false, errorf("read yum: %v", err)
+		}
+		files, err = yumRepoFiles(name, repoPath, y)
+		if err != nil {
+			return false, err
+		}
+		if !y.Disabled() {
+			refresh = []string{yumPath, "makecache", "--disablerepo=*", "--enablerepo=" + name}
+		}
+	default:
+		return false, errorf("unknown package repo type %v", pr.Which())
+	}
+
+	for _, f := range files {
+		created, err := j.mkdirAll(ctx, filepath.Dir(f.path))
+		if err != nil {
+			return changed, err
+		}
+		fchanged, fcreated, err := j.plainFileContent(ctx, f.path, f.content, "", 0644)
+		if err != nil {
+			return changed, err
+		}
+		if fcreated {
+			if err := j.applyUmask(ctx, f.path, catalog.File_Mode_unset, 0644); err != nil {
+				return true, err
+			}
+		}
+		changed = changed || created || fchanged
+	}
+	if !changed || refresh == nil {
+		return changed, nil
+	}
+	if _, err := j.runProgram(ctx, refresh...); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// removeRepoFiles removes the files of an absent package repo.
+func (j *job) removeRepoFiles(ctx context.Context, paths ...string) (changed bool, err error) {
+	for _, path := range paths {
+		err := j.sys.Remove(ctx, path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// aptKeyPath returns the path of an apt repo's signing key.  apt
+// accepts ASCII-armored keys only with a .asc extension.
+func aptKeyPath(name string, armored bool) string {
+	if armored {
+		return filepath.Join(aptKeyringsDir, name+".asc")
+	}
+	return filepath.Join(aptKeyringsDir, name+".gpg")
+}
+
+func yumKeyPath(name string) string {
+	return filepath.Join(rpmKeysDir, "RPM-GPG-KEY-"+name)
+}
+
+// aptRepoFiles returns the sources.list.d entry for an apt repo and its
+// signing key, if any.
+func aptRepoFiles(name, listPath string, a catalog.PackageRepo_Apt) ([]repoFile, error) {
+	uri, err := a.Uri()
+	if err != nil {
+		return nil, errorf("read uri: %v", err)
+	}
+	if uri == "" {
+		return nil, errorf("apt repo uri is empty")
+	}
+	suite, err := a.Suite()
+	if err != nil {
+		return nil, errorf("read suite: %v", err)
+	}
+	if suite == "" {
+		return nil, errorf("apt repo suite is empty")
+	}
+	comps, err := readTextList(a.Components())
+	if err != nil {
+		return nil, errorf("read components: %v", err)
+	}
+	archs, err := readTextList(a.Architectures())
+	if err != nil {
+		return nil, errorf("read architectures: %v", err)
+	}
+	key, err := a.SigningKey()
+	if err != nil {
+		return nil, errorf("read signing key: %v", err)
+	}
+
+	// The key is written before the source, so that the source never
+	// names a missing key.
+	var files []repoFile
+	var opts []string
+	if len(archs) > 0 {
+		opts = append(opts, "arch="+strings.Join(archs, ","))
+	}
+	if len(key) > 0 {
+		keyPath := aptKeyPath(name, bytes.HasPrefix(bytes.TrimSpace(key), []byte("-----BEGIN")))
+		opts = append(opts, "signed-by="+keyPath)
+		files = append(files, repoFile{path: keyPath, content: key})
+	}
+	line := uri + " " + suite
+	if len(comps) > 0 {
+		line += " " + strings.Join(comps, " ")
+	}
+	if len(opts) > 0 {
+		line = "[" + strings.Join(opts, " ") + "] " + line
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "deb %s\n", line)
+	if a.Source() {
+		fmt.Fprintf(buf, "deb-src %s\n", line)
+	}
+	files = append(files, repoFile{path: listPath, content: buf.Bytes()})
+	return files, nil
+}
+
+// yumRepoFiles returns the yum.repos.d file for a yum repo and its GPG
+// key, if any.
+func yumRepoFiles(name, repoPath string, y catalog.PackageRepo_Yum) ([]repoFile, error) {
+	baseURL, err := y.BaseUrl()
+	if err != nil {
+		return nil, errorf("read base URL: %v", err)
+	}
+	if baseURL == "" {
+		return nil, errorf("yum repo base URL is empty")
+	}
+	desc, err := y.Description()
+	if err != nil {
+		return nil, errorf("read description: %v", err)
+	}
+	if desc == "" {
+		desc = name
+	}
+	key, err := y.GpgKey()
+	if err != nil {
+		return nil, errorf("read GPG key: %v", err)
+	}
+	if strings.ContainsAny(desc+baseURL, "\n") {
+		return nil, errorf("yum repo description and base URL must be a single line")
+	}
+
+	var files []repoFile
+	enabled := 1
+	if y.Disabled() {
+		enabled = 0
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "[%s]\nname=%s\nbaseurl=%s\nenabled=%d\n", name, desc, baseURL, enabled)
+	if len(key) > 0 {
+		keyPath := yumKeyPath(name)
+		files = append(files, repoFile{path: keyPath, content: key})
+		fmt.Fprintf(buf, "gpgcheck=1\ngpgkey=file://%s\n", keyPath)
+	} else {
+		buf.WriteString("gpgcheck=0\n")
+	}
+	files = append(files, repoFile{path: repoPath, content: buf.Bytes()})
+	return files, nil
+}
+
+// readTextList copies the strings in a text list.
+func readTextList(l capnp.TextList, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	s := make([]string, l.Len())
+	for i := range s {
+		s[i], err = l.At(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
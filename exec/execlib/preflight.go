@@ -0,0 +1,202 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// checkPreconditions checks the preconditions of every catalog before
+// any resource is applied.  The error lists every precondition that is
+// not met, not just the first.
+func checkPreconditions(ctx context.Context, sys system.System, cats ...catalog.Catalog) error {
+	var unmet []string
+	for i, c := range cats {
+		pre, err := c.Preconditions()
+		if err != nil {
+			return errorf("read preconditions: %v", err)
+		}
+		for j := 0; j < pre.Len(); j++ {
+			msg, err := checkPrecondition(ctx, sys, pre.At(j))
+			if err != nil {
+				msg = err.Error()
+			}
+			if msg == "" {
+				continue
+			}
+			if len(cats) > 1 {
+				msg = fmt.Sprintf("catalog %d: %s", i, msg)
+			}
+			unmet = append(unmet, msg)
+		}
+	}
+	if len(unmet) == 0 {
+		return nil
+	}
+	return errorf("preconditions not met: %s", strings.Join(unmet, "; "))
+}
+
+// checkPrecondition returns a description of how the host does not
+// meet p, or the empty string if it does.  err is returned if p could
+// not be checked.
+func checkPrecondition(ctx context.Context, sys system.System, p catalog.Precondition) (unmet string, err error) {
+	switch p.Which() {
+	case catalog.Precondition_Which_minDiskFree:
+		path, err := p.MinDiskFree().Path()
+		if err != nil {
+			return "", errorf("read path: %v", err)
+		}
+		want := p.MinDiskFree().Bytes()
+		hi, ok := sys.(system.HostInspector)
+		if !ok {
+			return "", errorf("%s: system cannot check disk space", path)
+		}
+		free, err := hi.DiskFree(ctx, path)
+		if err != nil {
+			return "", errorf("check disk space: %v", err)
+		}
+		if free < 0 || uint64(free) < want {
+			return fmt.Sprintf("%s has %d bytes free, need %d", path, free, want), nil
+		}
+		return "", nil
+	case catalog.Precondition_Which_binary:
+		name, err := p.Binary()
+		if err != nil {
+			return "", errorf("read binary: %v", err)
+		}
+		if name == "" {
+			return "", errorf("empty binary")
+		}
+		found, err := findBinary(ctx, sys, name)
+		if err != nil {
+			return "", errorf("find %s: %v", name, err)
+		}
+		if !found {
+			return fmt.Sprintf("%s is not installed", name), nil
+		}
+		return "", nil
+	case catalog.Precondition_Which_minKernelVersion:
+		want, err := p.MinKernelVersion()
+		if err != nil {
+			return "", errorf("read kernel version: %v", err)
+		}
+		if len(versionNumbers(want)) == 0 {
+			return "", errorf("min kernel version %q does not start with a number", want)
+		}
+		hi, ok := sys.(system.HostInspector)
+		if !ok {
+			return "", errorf("system cannot check kernel version")
+		}
+		got, err := hi.KernelVersion(ctx)
+		if err != nil {
+			return "", errorf("check kernel version: %v", err)
+		}
+		if compareVersions(got, want) < 0 {
+			return fmt.Sprintf("kernel %s is older than %s", got, want), nil
+		}
+		return "", nil
+	case catalog.Precondition_Which_privileged:
+		hi, ok := sys.(system.HostInspector)
+		if !ok {
+			return "", errorf("system cannot check privileges")
+		}
+		priv, err := hi.Privileged(ctx)
+		if err != nil {
+			return "", errorf("check privileges: %v", err)
+		}
+		switch {
+		case p.Privileged() && !priv:
+			return "must run as the superuser", nil
+		case !p.Privileged() && priv:
+			return "must not run as the superuser", nil
+		}
+		return "", nil
+	default:
+		return "", errorf("unknown precondition %v", p.Which())
+	}
+}
+
+// findBinary reports whether name is an executable path or a program in
+// the system's default search path.
+func findBinary(ctx context.Context, sys system.System, name string) (bool, error) {
+	if !filepath.IsAbs(name) {
+		_, err := sys.LookPath(ctx, name, "")
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	info, err := sys.Lstat(ctx, name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.Mode().IsRegular() && info.Mode()&0111 != 0, nil
+}
+
+// compareVersions compares the leading dot-separated numbers of two
+// versions, returning -1, 0, or 1 if a is lower than, the same as, or
+// higher than b.  Missing numbers count as zero, so "4.9" is the same
+// as "4.9.0-3-amd64".
+func compareVersions(a, b string) int {
+	an, bn := versionNumbers(a), versionNumbers(b)
+	for i := 0; i < len(an) || i < len(bn); i++ {
+		var x, y int
+		if i < len(an) {
+			x = an[i]
+		}
+		if i < len(bn) {
+			y = bn[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionNumbers returns the leading dot-separated numbers of v, so
+// "4.9.0-3-amd64" is [4 9 0].
+func versionNumbers(v string) []int {
+	var nums []int
+	for _, part := range strings.Split(v, ".") {
+		end := 0
+		for end < len(part) && '0' <= part[end] && part[end] <= '9' {
+			end++
+		}
+		n, err := strconv.Atoi(part[:end])
+		if err != nil {
+			break
+		}
+		nums = append(nums, n)
+		if end < len(part) {
+			break
+		}
+	}
+	return nums
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// Provenance is a catalog's metadata: where it came from.  Reports can
+// be serialized with encoding/json.
+type Provenance struct {
+	Generator        string    `json:"generator,omitempty"`
+	GeneratorVersion string    `json:"generator_version,omitempty"`
+	SourceRepo       string    `json:"source_repo,omitempty"`
+	SourceCommit     string    `json:"source_commit,omitempty"`
+	BuildTime        time.Time `json:"build_time,omitempty"`
+	Author           string    `json:"author,omitempty"`
+}
+
+// catalogProvenance returns the metadata of c, or nil if c has none.
+func catalogProvenance(c catalog.Catalog) *Provenance {
+	if !c.HasMetadata() {
+		return nil
+	}
+	md, err := c.Metadata()
+	if err != nil {
+		return nil
+	}
+	p := new(Provenance)
+	p.Generator, _ = md.Generator()
+	p.GeneratorVersion, _ = md.GeneratorVersion()
+	p.SourceRepo, _ = md.SourceRepo()
+	p.SourceCommit, _ = md.SourceCommit()
+	if t := md.BuildTime(); t != 0 {
+		p.BuildTime = time.Unix(t, 0).UTC()
+	}
+	p.Author, _ = md.Author()
+	if *p == (Provenance{}) {
+		return nil
+	}
+	return p
+}
+
+// String describes the provenance in a single line, such as
+// "mcm-luacat 1.2 from https://example.com/config.git at abc123, built
+// 2017-06-01T12:00:00Z by alice".
+func (p *Provenance) String() string {
+	if p == nil {
+		return "unknown provenance"
+	}
+	var buf bytes.Buffer
+	add := func(format string, args ...interface{}) {
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, format, args...)
+	}
+	if p.Generator != "" {
+		add("%s", p.Generator)
+	}
+	if p.GeneratorVersion != "" {
+		add("%s", p.GeneratorVersion)
+	}
+	if p.SourceRepo != "" {
+		add("from %s", p.SourceRepo)
+	}
+	if p.SourceCommit != "" {
+		add("at %s", p.SourceCommit)
+	}
+	if !p.BuildTime.IsZero() || p.Author != "" {
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+		add("built")
+		if !p.BuildTime.IsZero() {
+			add("%s", p.BuildTime.Format(time.RFC3339))
+		}
+		if p.Author != "" {
+			add("by %s", p.Author)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// A RebootRequest is a request from the run's reboot resources to
+// reboot the host once the run finishes.
+type RebootRequest struct {
+	// Resources are the IDs of the reboot resources that requested
+	// the reboot.
+	Resources []uint64 `json:"resources"`
+
+	// Reasons say why each resource requested the reboot.
+	Reasons []string `json:"reasons"`
+
+	// Delay is how long to wait before rebooting: the longest delay of
+	// the requests.
+	Delay time.Duration `json:"delay,omitempty"`
+
+	// Message is shown to logged-in users.  It is the first non-empty
+	// message of the requests.
+	Message string `json:"message,omitempty"`
+}
+
+// merge adds the resources and reasons of other to req.
+func (req *RebootRequest) merge(other *RebootRequest) {
+	req.Resources = append(req.Resources, other.Resources...)
+	req.Reasons = append(req.Reasons, other.Reasons...)
+	if other.Delay > req.Delay {
+		req.Delay = other.Delay
+	}
+	if req.Message == "" {
+		req.Message = other.Message
+	}
+}
+
+// rebootRequest returns a request if any of rb's triggers fire, or nil
+// if none do.
+func (j *job) rebootRequest(ctx context.Context, rb catalog.Reboot) (*RebootRequest, error) {
+	paths, err := readTextList(rb.TriggerPaths())
+	if err != nil {
+		return nil, errorf("read trigger paths: %v", err)
+	}
+	deps, err := rb.IfDepsChanged()
+	if err != nil {
+		return nil, errorf("read ifDepsChanged: %v", err)
+	}
+	if len(paths) == 0 && deps.Len() == 0 {
+		return nil, errorf("reboot has no trigger paths or ifDepsChanged")
+	}
+	for i := 0; i < deps.Len(); i++ {
+		if _, ok := j.depsChanged[deps.At(i)]; !ok {
+			return nil, errorf("depends on ID %d, which is not in resource's direct dependencies", deps.At(i))
+		}
+	}
+
+	var reason string
+	for _, p := range paths {
+		exists, err := j.pathExists(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			reason = p + " exists"
+			break
+		}
+	}
+	if reason == "" {
+		for i := 0; i < deps.Len(); i++ {
+			if j.depsChanged[deps.At(i)] {
+				reason = "dependencies changed"
+				break
+			}
+		}
+	}
+	if reason == "" {
+		return nil, nil
+	}
+	msg, err := rb.Message()
+	if err != nil {
+		return nil, errorf("read message: %v", err)
+	}
+	return &RebootRequest{
+		Resources: []uint64{j.resource.ID()},
+		Reasons:   []string{formatResource(j.resource) + ": " + reason},
+		Delay:     time.Duration(rb.DelaySeconds()) * time.Second,
+		Message:   msg,
+	}, nil
+}
+
+// ScheduleReboot asks the operating system to reboot the host after
+// the request's delay, using shutdown(8) or shutdown.exe.  It returns
+// once the reboot is scheduled.
+func ScheduleReboot(ctx context.Context, sys system.System, req *RebootRequest) error {
+	msg := req.Message
+	if msg == "" {
+		msg = "mcm: reboot requested by " + strings.Join(req.Reasons, "; ")
+	}
+	var args []string
+	if runtime.GOOS == "windows" {
+		secs := int64((req.Delay + time.Second - 1) / time.Second)
+		args = []string{`C:\Windows\System32\shutdown.exe`, "/r", "/t", strconv.FormatInt(secs, 10), "/c", msg}
+	} else {
+		when := "now"
+		if req.Delay > 0 {
+			when = "+" + strconv.FormatInt(int64((req.Delay+time.Minute-1)/time.Minute), 10)
+		}
+		args = []string{"/sbin/shutdown", "-r", when, msg}
+	}
+	out, err := sys.Run(ctx, &system.Cmd{Path: args[0], Args: args})
+	if err != nil {
+		return errorWithOutput(out, 0, errorf("schedule reboot: %v", err))
+	}
+	return nil
+}
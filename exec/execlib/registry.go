@@ -0,0 +1,168 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"os"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+func (j *job) registry() (system.Registry, error) {
+	r, ok := j.sys.(system.Registry)
+	if !ok {
+		return nil, errorf("system has no registry")
+	}
+	return r, nil
+}
+
+func (j *job) registryKey(ctx context.Context, k catalog.RegistryKey) (changed bool, err error) {
+	r, err := j.registry()
+	if err != nil {
+		return false, err
+	}
+	path, err := k.Path()
+	if err != nil {
+		return false, errorf("read key path: %v", err)
+	}
+	if path == "" {
+		return false, errorf("registry key path is empty")
+	}
+	exists, err := r.RegistryKeyExists(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	switch k.Which() {
+	case catalog.RegistryKey_Which_present:
+		if exists {
+			return false, nil
+		}
+		if err := r.CreateRegistryKey(ctx, path); err != nil {
+			return false, err
+		}
+		return true, nil
+	case catalog.RegistryKey_Which_absent:
+		if !exists {
+			return false, nil
+		}
+		if err := r.DeleteRegistryKey(ctx, path); err != nil {
+			return false, err
+		}
+		return true, nil
+	default:
+		return false, errorf("unsupported registry key state %v", k.Which())
+	}
+}
+
+func (j *job) registryValue(ctx context.Context, v catalog.RegistryValue) (changed bool, err error) {
+	r, err := j.registry()
+	if err != nil {
+		return false, err
+	}
+	key, err := v.Key()
+	if err != nil {
+		return false, errorf("read key path: %v", err)
+	}
+	if key == "" {
+		return false, errorf("registry key path is empty")
+	}
+	name, err := v.Name()
+	if err != nil {
+		return false, errorf("read value name: %v", err)
+	}
+	if v.Which() == catalog.RegistryValue_Which_absent {
+		if _, err := r.RegistryValue(ctx, key, name); os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if err := r.DeleteRegistryValue(ctx, key, name); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	want, err := registryValueData(v)
+	if err != nil {
+		return false, err
+	}
+	curr, err := r.RegistryValue(ctx, key, name)
+	if err == nil && curr.Equal(want) {
+		return false, nil
+	}
+	if os.IsNotExist(err) {
+		exists, err := r.RegistryKeyExists(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			if err := r.CreateRegistryKey(ctx, key); err != nil {
+				return false, err
+			}
+		}
+	} else if err != nil {
+		return false, err
+	}
+	if err := r.SetRegistryValue(ctx, key, name, want); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// registryValueData converts the data of a present registry value to
+// its system representation.
+func registryValueData(v catalog.RegistryValue) (system.RegistryValue, error) {
+	switch v.Which() {
+	case catalog.RegistryValue_Which_sz:
+		s, err := v.Sz()
+		if err != nil {
+			return system.RegistryValue{}, errorf("read string: %v", err)
+		}
+		return system.StringValue(system.RegSZ, s), nil
+	case catalog.RegistryValue_Which_expandSz:
+		s, err := v.ExpandSz()
+		if err != nil {
+			return system.RegistryValue{}, errorf("read string: %v", err)
+		}
+		return system.StringValue(system.RegExpandSZ, s), nil
+	case catalog.RegistryValue_Which_multiSz:
+		list, err := v.MultiSz()
+		if err != nil {
+			return system.RegistryValue{}, errorf("read strings: %v", err)
+		}
+		strs := make([]string, list.Len())
+		for i := range strs {
+			strs[i], err = list.At(i)
+			if err != nil {
+				return system.RegistryValue{}, errorf("read strings[%d]: %v", i, err)
+			}
+		}
+		return system.MultiStringValue(strs), nil
+	case catalog.RegistryValue_Which_dword:
+		return system.DWORDValue(v.Dword()), nil
+	case catalog.RegistryValue_Which_qword:
+		return system.QWORDValue(v.Qword()), nil
+	case catalog.RegistryValue_Which_binary:
+		data, err := v.Binary()
+		if err != nil {
+			return system.RegistryValue{}, errorf("read data: %v", err)
+		}
+		return system.RegistryValue{Type: system.RegBinary, Data: data}, nil
+	default:
+		return system.RegistryValue{}, errorf("unsupported registry value type %v", v.Which())
+	}
+}
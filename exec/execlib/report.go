@@ -0,0 +1,249 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// A Report describes the outcome of an Apply.  Reports can be
+// serialized with encoding/json.
+type Report struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Resources has an entry for each resource that was applied or
+	// skipped, in the order that they finished.
+	Resources []*ResourceReport `json:"resources"`
+
+	// RunID is the Options.RunID that identifies the run.
+	RunID string `json:"run_id,omitempty"`
+
+	// Seed is the Options.Seed that the run was scheduled with.
+	Seed int64 `json:"seed,omitempty"`
+
+	// Pending is the list of IDs of resources that still have a
+	// pending change once the run finishes: resources that were
+	// triggered by a change in a dependency, in this run or an earlier
+	// one, but didn't apply.  It is only filled in when the run has a
+	// State.  See state.PendingChange.
+	Pending []uint64 `json:"pending,omitempty"`
+
+	// Reboot is the reboot requested by the run's reboot resources, or
+	// nil if none did.  Apply and ApplyAll don't reboot the host: the
+	// caller schedules the reboot with ScheduleReboot once it is done
+	// with the report.
+	Reboot *RebootRequest `json:"reboot,omitempty"`
+
+	// Provenance has the metadata of each catalog in the run, indexed
+	// like ResourceReport.Catalog.  An entry is nil if its catalog has
+	// no metadata, and the list is empty if none do.
+	Provenance []*Provenance `json:"provenance,omitempty"`
+
+	// Summary is filled in by Apply once the run finishes.
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// ResourceReport describes the outcome of a single resource.
+type ResourceReport struct {
+	ID      uint64         `json:"id"`
+	Name    string         `json:"name,omitempty"`
+	Comment string         `json:"comment,omitempty"`
+	Status  ResourceStatus `json:"status"`
+
+	// Catalog is the index of the resource's catalog in a run of
+	// ApplyAll.  It is always zero for Apply.
+	Catalog int `json:"catalog,omitempty"`
+
+	// Start and Duration are zero for skipped resources.
+	Start    time.Time     `json:"start,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Error is the failure message for a failed resource.
+	Error string `json:"error,omitempty"`
+
+	// Owner and DocURL are the failed resource's owner and docUrl from
+	// the catalog.
+	Owner  string `json:"owner,omitempty"`
+	DocURL string `json:"doc_url,omitempty"`
+
+	// Violated is true if the resource is an assertion that did not
+	// hold.  Its status is failed, but the system may be as the catalog
+	// describes it, so it is counted separately in the summary.
+	Violated bool `json:"violated,omitempty"`
+
+	// Warnings are the problems found while applying the resource that
+	// did not fail it.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// SpanID is the Event.SpanID given to log messages about the
+	// resource.
+	SpanID string `json:"span_id,omitempty"`
+
+	// Replaces is the list of IDs of resources that the resource
+	// replaces, as given in the catalog, so that comparisons between
+	// runs can match a renamed resource to its old ID.
+	Replaces []uint64 `json:"replaces,omitempty"`
+
+	// Conditions explains whether an exec resource's command ran: its
+	// creates path and condition, in the order that they were checked.
+	// An always condition is left out.
+	Conditions []*ConditionTrace `json:"conditions,omitempty"`
+}
+
+// A ConditionTrace describes how one of an exec resource's conditions
+// was evaluated.
+type ConditionTrace struct {
+	// Condition is what was checked: "creates" or the catalog's name for
+	// the condition, like "onlyIf" or "ifDepsChanged".
+	Condition string `json:"condition"`
+
+	// Argv, ExitCode, and Output describe the command run by an onlyIf,
+	// unless, or until condition: the last probe for until.  ExitCode
+	// is -1 if the command was killed by a signal or its status is
+	// unknown, and nil if it could not be started.  Output is the command's combined output, with
+	// its middle dropped if it is over 1 KiB.
+	Argv     []string `json:"argv,omitempty"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+	Output   string   `json:"output,omitempty"`
+
+	// Detail describes the outcome of a condition that doesn't run a
+	// command, like "/etc/foo exists" or "dependency 4 changed".
+	Detail string `json:"detail,omitempty"`
+
+	// Run is true if the condition let the command run.
+	Run bool `json:"run"`
+}
+
+// maxTraceOutput is the number of bytes of a condition command's
+// output kept in its ConditionTrace.
+const maxTraceOutput = 1024
+
+// recordProbe records a condition command and its outcome.
+func (t *ConditionTrace) recordProbe(cmd *system.Cmd, out []byte, err error) {
+	t.Argv = cmd.Args
+	t.Output = string(system.LimitOutput(out, maxTraceOutput))
+	t.ExitCode = nil
+	switch err := err.(type) {
+	case nil:
+		code := 0
+		t.ExitCode = &code
+	case *exec.ExitError:
+		code := exitCode(err)
+		t.ExitCode = &code
+	}
+}
+
+// describeProbe formats the condition command and its exit status for
+// a log message.
+func (t *ConditionTrace) describeProbe() string {
+	if t.ExitCode == nil {
+		return fmt.Sprintf("%q did not run", t.Argv)
+	}
+	return fmt.Sprintf("%q exited with status %d", t.Argv, *t.ExitCode)
+}
+
+// ResourceStatus is the result of applying a resource.
+type ResourceStatus string
+
+// Resource statuses.
+const (
+	StatusUnchanged ResourceStatus = "unchanged"
+	StatusChanged   ResourceStatus = "changed"
+	StatusFailed    ResourceStatus = "failed"
+	StatusSkipped   ResourceStatus = "skipped"
+	StatusDisabled  ResourceStatus = "disabled"
+)
+
+// Resource returns the report for the resource with the given ID or
+// nil if the resource is not in the report.  If the report covers
+// several catalogs, then the first matching resource is returned.
+func (r *Report) Resource(id uint64) *ResourceReport {
+	for _, rr := range r.Resources {
+		if rr.ID == id {
+			return rr
+		}
+	}
+	return nil
+}
+
+// Summarize counts the outcomes of the resources in the report.
+func (r *Report) Summarize() *Summary {
+	s := &Summary{Duration: r.End.Sub(r.Start)}
+	for _, rr := range r.Resources {
+		switch rr.Status {
+		case StatusChanged:
+			s.Changed++
+		case StatusUnchanged:
+			s.Unchanged++
+		case StatusFailed:
+			s.Failed++
+		case StatusSkipped:
+			s.Skipped++
+		case StatusDisabled:
+			s.Disabled++
+		}
+		if rr.Violated {
+			s.Violated++
+		}
+		if len(rr.Warnings) > 0 {
+			s.Warned++
+		}
+	}
+	s.Applied = s.Changed + s.Unchanged + s.Failed
+	return s
+}
+
+// A Summary is the number of resources with each outcome in a run.
+type Summary struct {
+	// Applied is the number of resources that were attempted: the sum
+	// of Changed, Unchanged, and Failed.
+	Applied   int `json:"applied"`
+	Changed   int `json:"changed"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"`
+
+	// Disabled is the number of resources that were not applied
+	// because the catalog disables them.  It is not included in String.
+	Disabled int `json:"disabled,omitempty"`
+
+	// Warned is the number of resources with warnings, which may have
+	// any outcome.  It is not included in String.
+	Warned int `json:"warned,omitempty"`
+
+	// Violated is the number of failed resources that are assertions
+	// that did not hold, rather than resources that could not be
+	// applied.  It is not included in String.
+	Violated int `json:"violated,omitempty"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+// String formats the summary as
+//
+//	applied N, changed M, unchanged K, failed F, skipped S in D
+//
+// where D is the run's duration in seconds with millisecond precision
+// followed by "s".  This format is stable and is intended to be parsed
+// by other programs.
+func (s *Summary) String() string {
+	return fmt.Sprintf("applied %d, changed %d, unchanged %d, failed %d, skipped %d in %.3fs",
+		s.Applied, s.Changed, s.Unchanged, s.Failed, s.Skipped, s.Duration.Seconds())
+}
@@ -0,0 +1,80 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// ScratchEnv is the name of the environment variable that gives
+// commands the path of the run's scratch directory.  See
+// Options.ScratchDir.
+const ScratchEnv = "MCM_SCRATCH_DIR"
+
+// makeScratchDir creates the run's scratch directory inside
+// opts.ScratchDir, if it is set.  It returns options whose base
+// environment names the directory and a function that removes the
+// directory along with everything in it.
+func makeScratchDir(ctx context.Context, sys system.System, opts *Options) (*Options, func(), error) {
+	if opts.ScratchDir == "" {
+		return opts, func() {}, nil
+	}
+	dr, ok := sys.(system.DirReader)
+	if !ok {
+		return nil, nil, errorf("scratch directory: system cannot list directories")
+	}
+	dir := filepath.Join(opts.ScratchDir, "mcm-"+newRunID())
+	if err := sys.Mkdir(ctx, dir, 0700); err != nil {
+		return nil, nil, errorf("scratch directory: %v", err)
+	}
+	debugf(opts.Log, ctx, Verbose, "scratch directory: %s", dir)
+	newOpts := new(Options)
+	*newOpts = *opts
+	newOpts.Environment = mergeEnv(opts.Environment, []string{ScratchEnv + "=" + dir})
+	cleanup := func() {
+		if err := removeAll(ctx, sys, dr, dir); err != nil {
+			opts.Log.Infof(ctx, "warning: remove scratch directory: %v", err)
+		}
+	}
+	return newOpts, cleanup, nil
+}
+
+// removeAll removes the directory at path and everything in it.  It is
+// not an error for the directory not to exist, such as if a command
+// removed it.
+func removeAll(ctx context.Context, fs system.FS, dr system.DirReader, path string) error {
+	infos, err := dr.ReadDir(ctx, path)
+	if system.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		p := filepath.Join(path, info.Name())
+		if info.IsDir() {
+			err = removeAll(ctx, fs, dr, p)
+		} else {
+			err = fs.Remove(ctx, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fs.Remove(ctx, path)
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// secretPath is the list of directories searched for the programs that
+// read secrets.  The command's own PATH isn't used, since the programs
+// run with the applier's privileges.
+const secretPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// encryptedCredsDir is where systemd-creds looks for encrypted
+// credentials by default.
+const encryptedCredsDir = "/etc/credstore.encrypted"
+
+// hasSecrets reports whether any of the command's environment variables
+// are read from the host's credential store.
+func hasSecrets(c catalog.Exec_Command) bool {
+	env, _ := c.Environment()
+	for i := 0; i < env.Len(); i++ {
+		if env.At(i).HasSecret() {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecrets fills in the secret environment variables of env,
+// which must have been built from c by buildCommand.  Errors never
+// include a secret or the output of the programs that read it.
+func (j *job) resolveSecrets(ctx context.Context, c catalog.Exec_Command, env []string) error {
+	list, _ := c.Environment()
+	for i := 0; i < list.Len(); i++ {
+		ev := list.At(i)
+		if !ev.HasSecret() {
+			continue
+		}
+		name, _ := ev.Name()
+		s, err := ev.Secret()
+		if err != nil {
+			return errorf("environment[%d] (%s): read secret: %v", i, name, err)
+		}
+		val, err := j.readSecret(ctx, s)
+		if err != nil {
+			return errorf("environment[%d] (%s): %v", i, name, err)
+		}
+		env[i] = name + "=" + string(bytes.TrimSuffix(val, []byte("\n")))
+	}
+	return nil
+}
+
+// readSecret reads a secret from the host.
+func (j *job) readSecret(ctx context.Context, s catalog.Exec_Command_Secret) ([]byte, error) {
+	switch s.Which() {
+	case catalog.Exec_Command_Secret_Which_systemdCredential:
+		name, _ := s.SystemdCredential()
+		if name == "" || strings.ContainsRune(name, '/') {
+			return nil, errorf("systemd credential %q is not a valid name", name)
+		}
+		if j.credsDir != "" {
+			val, err := system.ReadFile(ctx, j.sys, filepath.Join(j.credsDir, name))
+			if err == nil {
+				return val, nil
+			}
+			if !os.IsNotExist(err) {
+				return nil, errorf("read systemd credential %s: %v", name, err)
+			}
+		}
+		return j.secretProgram(ctx, "systemd credential "+name, "systemd-creds", "decrypt", "--name="+name, filepath.Join(encryptedCredsDir, name), "-")
+	case catalog.Exec_Command_Secret_Which_keyring:
+		desc, _ := s.Keyring()
+		if desc == "" {
+			return nil, errorf("keyring secret has an empty description")
+		}
+		return j.secretProgram(ctx, "key "+desc, "keyctl", "pipe", "%user:"+desc)
+	case catalog.Exec_Command_Secret_Which_file:
+		path, _ := s.File()
+		if !filepath.IsAbs(path) {
+			return nil, errorf("secret file %q is not an absolute path", path)
+		}
+		info, err := j.sys.Lstat(ctx, path)
+		if err != nil {
+			return nil, errorf("read secret: %v", err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, errorf("secret file %s is not a regular file", path)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return nil, errorf("secret file %s has mode %v; it must not be accessible to group or others", path, info.Mode().Perm())
+		}
+		val, err := system.ReadFile(ctx, j.sys, path)
+		if err != nil {
+			return nil, errorf("read secret: %v", err)
+		}
+		return val, nil
+	default:
+		return nil, errorf("unsupported secret type %v", s.Which())
+	}
+}
+
+// secretProgram runs a program that writes a secret to its output.
+// Its output is not logged or kept on failure.
+func (j *job) secretProgram(ctx context.Context, what string, name string, args ...string) ([]byte, error) {
+	path, err := j.sys.LookPath(ctx, name, secretPath)
+	if err != nil {
+		return nil, errorf("read %s: look up %s: %v", what, name, err)
+	}
+	out, err := j.sys.Run(ctx, &system.Cmd{
+		Path: path,
+		Args: append([]string{path}, args...),
+		Dir:  system.LocalRoot,
+	})
+	if err != nil {
+		return nil, errorf("read %s: %s: %v", what, name, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// DefaultServiceTimeout is how long to wait for a service to start or
+// stop if the catalog does not give a timeout.
+const DefaultServiceTimeout = 30 * time.Second
+
+// serviceInterval is the time between queries while waiting for a
+// service to start or stop.
+const serviceInterval = 250 * time.Millisecond
+
+func (j *job) service(ctx context.Context, s catalog.Service) (changed bool, err error) {
+	sm, ok := j.sys.(system.ServiceManager)
+	if !ok {
+		return false, errorf("system cannot manage services")
+	}
+	name, err := s.Name()
+	if err != nil {
+		return false, errorf("read service name: %v", err)
+	}
+	if name == "" {
+		return false, errorf("service name is empty")
+	}
+	want := new(system.ServiceConfig)
+	if want.BinaryPath, err = s.BinaryPath(); err != nil {
+		return false, errorf("read binary path: %v", err)
+	}
+	if want.DisplayName, err = s.DisplayName(); err != nil {
+		return false, errorf("read display name: %v", err)
+	}
+	switch s.StartType() {
+	case catalog.Service_StartType_unchanged:
+	case catalog.Service_StartType_automatic:
+		want.StartType = system.ServiceAutoStart
+	case catalog.Service_StartType_manual:
+		want.StartType = system.ServiceDemandStart
+	case catalog.Service_StartType_disabled:
+		want.StartType = system.ServiceDisabled
+	default:
+		return false, errorf("unknown start type %v", s.StartType())
+	}
+
+	status, err := sm.QueryService(ctx, name)
+	if os.IsNotExist(err) {
+		if want.BinaryPath == "" {
+			return false, errorf("service %s does not exist and no binary path given", name)
+		}
+		if err := sm.CreateService(ctx, name, want); err != nil {
+			return false, err
+		}
+		changed = true
+		status = &system.ServiceStatus{ServiceConfig: *want, State: system.ServiceStopped}
+	} else if err != nil {
+		return false, err
+	} else {
+		update := new(system.ServiceConfig)
+		if want.BinaryPath != "" && want.BinaryPath != status.BinaryPath {
+			update.BinaryPath = want.BinaryPath
+		}
+		if want.DisplayName != "" && want.DisplayName != status.DisplayName {
+			update.DisplayName = want.DisplayName
+		}
+		if want.StartType != 0 && want.StartType != status.StartType {
+			update.StartType = want.StartType
+		}
+		if *update != (system.ServiceConfig{}) {
+			if err := sm.ConfigureService(ctx, name, update); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+
+	var state, pending system.ServiceState
+	var transition func(context.Context, string) error
+	switch s.State() {
+	case catalog.Service_State_unchanged:
+		return changed, nil
+	case catalog.Service_State_running:
+		state, pending, transition = system.ServiceRunning, system.ServiceStartPending, sm.StartService
+	case catalog.Service_State_stopped:
+		state, pending, transition = system.ServiceStopped, system.ServiceStopPending, sm.StopService
+	default:
+		return changed, errorf("unknown service state %v", s.State())
+	}
+	if status.State == state {
+		return changed, nil
+	}
+	if status.State != pending {
+		if err := transition(ctx, name); err != nil {
+			return changed, err
+		}
+	}
+	timeout := DefaultServiceTimeout
+	if ms := s.TimeoutMillis(); ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	return true, j.waitService(ctx, sm, name, state, timeout)
+}
+
+// waitService queries a service until it is in the given state,
+// returning an error if it does not reach the state before the timeout.
+func (j *job) waitService(ctx context.Context, sm system.ServiceManager, name string, state system.ServiceState, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		status, err := sm.QueryService(ctx, name)
+		if err != nil {
+			return err
+		}
+		if status.State == state {
+			return nil
+		}
+		debugf(j.log, ctx, Verbose, "%s: service %s is %v", formatResource(j.resource), name, status.State)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return errorf("service %s is %v after %v; want %v", name, status.State, timeout, state)
+		case <-time.After(serviceInterval):
+		}
+	}
+}
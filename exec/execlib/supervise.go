@@ -0,0 +1,184 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// DefaultReadyTimeout is how long Apply waits for a supervised process
+// to become ready if the catalog does not give a timeout.
+const DefaultReadyTimeout = 30 * time.Second
+
+// readyPollInterval is the time between readiness checks.
+const readyPollInterval = 100 * time.Millisecond
+
+// A Supervisor keeps track of the processes started by supervised exec
+// resources so that they can be stopped once they are no longer
+// needed.  The zero value has no processes.  Its methods are safe to
+// call from multiple goroutines.
+type Supervisor struct {
+	mu    sync.Mutex
+	procs []system.Process
+}
+
+func (s *Supervisor) add(p system.Process) {
+	s.mu.Lock()
+	s.procs = append(s.procs, p)
+	s.mu.Unlock()
+}
+
+// Len returns the number of processes that have been started.
+func (s *Supervisor) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.procs)
+}
+
+// Wait waits for all of the processes to exit.  It returns ctx.Err()
+// if ctx is done first.
+func (s *Supervisor) Wait(ctx context.Context) error {
+	s.mu.Lock()
+	procs := append([]system.Process(nil), s.procs...)
+	s.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		for _, p := range procs {
+			p.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop kills all of the processes and waits for them to exit.  It
+// returns the first error encountered while killing them.
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	procs := s.procs
+	s.procs = nil
+	s.mu.Unlock()
+	var firstErr error
+	for _, p := range procs {
+		if err := p.Kill(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, p := range procs {
+		p.Wait()
+	}
+	return firstErr
+}
+
+// supervise starts a supervised command, waits for it to become ready,
+// and hands it to the job's supervisor.
+func (j *job) supervise(ctx context.Context, c catalog.Exec_Command, args []string, sup catalog.Exec_Supervise) error {
+	if j.supervisor == nil {
+		return errorf("supervised command requires a supervisor")
+	}
+	starter, ok := j.sys.(system.Starter)
+	if !ok {
+		return errorf("system cannot start background processes")
+	}
+	cmd, err := j.prepareCommand(ctx, c)
+	if err != nil {
+		return err
+	}
+	cmd.Args = append(cmd.Args, args...)
+	p, err := starter.Start(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	if err := j.waitReady(ctx, p, sup); err != nil {
+		p.Kill()
+		p.Wait()
+		return errorWithOutput(p.Output(), j.maxOutput, err)
+	}
+	j.supervisor.add(p)
+	return nil
+}
+
+// waitReady polls the readiness checks of a supervised process until
+// they all succeed.
+func (j *job) waitReady(ctx context.Context, p system.Process, sup catalog.Exec_Supervise) error {
+	timeout := DefaultReadyTimeout
+	if ms := sup.ReadyTimeoutMillis(); ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- p.Wait()
+	}()
+	for {
+		ready, err := j.checkReady(ctx, sup)
+		if err != nil {
+			return err
+		}
+		if ready {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("exit status 0")
+			}
+			return errorf("exited before becoming ready: %v", err)
+		case <-ctx.Done():
+			return errorf("not ready after %v", timeout)
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+func (j *job) checkReady(ctx context.Context, sup catalog.Exec_Supervise) (bool, error) {
+	if addr, _ := sup.ReadyAddress(); addr != "" {
+		d, ok := j.sys.(system.Dialer)
+		if !ok {
+			return false, errorf("system cannot check addresses")
+		}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return false, nil
+		}
+		conn.Close()
+	}
+	if sup.HasReadyCommand() {
+		c, err := sup.ReadyCommand()
+		if err != nil {
+			return false, errorf("ready command: %v", err)
+		}
+		ok, err := j.runCondition(ctx, c, nil)
+		if err != nil {
+			return false, errorf("ready command: %v", err)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// A tagLimiter counts the running resources with each limited tag.  A
+// nil tagLimiter allows everything.  It is only used by the scheduling
+// goroutine, so it is not safe to use from multiple goroutines.
+type tagLimiter struct {
+	limits  map[string]int
+	running map[string]int
+}
+
+// newTagLimiter returns a limiter for the given limits, or nil if there
+// are none.
+func newTagLimiter(limits map[string]int) *tagLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	return &tagLimiter{
+		limits:  limits,
+		running: make(map[string]int),
+	}
+}
+
+// allows reports whether starting res would stay within the limits of
+// its tags.
+func (l *tagLimiter) allows(res catalog.Resource) bool {
+	if l == nil {
+		return true
+	}
+	for _, tag := range resourceTags(res) {
+		n, ok := l.limits[tag]
+		if !ok {
+			continue
+		}
+		if n < 1 {
+			n = 1
+		}
+		if l.running[tag] >= n {
+			return false
+		}
+	}
+	return true
+}
+
+// acquire counts res as running.
+func (l *tagLimiter) acquire(res catalog.Resource) {
+	if l == nil {
+		return
+	}
+	for _, tag := range resourceTags(res) {
+		if _, ok := l.limits[tag]; ok {
+			l.running[tag]++
+		}
+	}
+}
+
+// release counts res as no longer running.
+func (l *tagLimiter) release(res catalog.Resource) {
+	if l == nil {
+		return
+	}
+	for _, tag := range resourceTags(res) {
+		if _, ok := l.limits[tag]; ok {
+			l.running[tag]--
+		}
+	}
+}
+
+// resourceTags returns the distinct tags of res.
+func resourceTags(res catalog.Resource) []string {
+	list, _ := res.Tags()
+	var tags []string
+outer:
+	for i := 0; i < list.Len(); i++ {
+		tag, _ := list.At(i)
+		for _, t := range tags {
+			if t == tag {
+				continue outer
+			}
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// sameTags reports whether two resources have the same tags, in any
+// order.
+func sameTags(r1, r2 catalog.Resource) bool {
+	t1, t2 := resourceTags(r1), resourceTags(r2)
+	if len(t1) != len(t2) {
+		return false
+	}
+outer:
+	for _, a := range t1 {
+		for _, b := range t2 {
+			if a == b {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
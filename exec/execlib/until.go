@@ -0,0 +1,94 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// DefaultUntilTimeout is how long an until condition's probe is retried
+// if the catalog does not give a timeout.
+const DefaultUntilTimeout = 5 * time.Minute
+
+// defaultUntilInterval is the time between probes if the catalog does
+// not give an interval.
+const defaultUntilInterval = 1 * time.Second
+
+// until checks the probe of an until condition every interval until it
+// passes, returning an error if it does not pass before the timeout.
+// The last command probe is recorded in t.
+func (j *job) until(ctx context.Context, u catalog.Exec_Until, t *ConditionTrace) error {
+	var probe func(ctx context.Context) (bool, error)
+	switch u.Which() {
+	case catalog.Exec_Until_Which_command:
+		c, err := u.Command()
+		if err != nil {
+			return errorf("read command: %v", err)
+		}
+		probe = func(ctx context.Context) (bool, error) {
+			return j.runCondition(ctx, c, t)
+		}
+	case catalog.Exec_Until_Which_fileExists:
+		path, err := u.FileExists()
+		if err != nil {
+			return errorf("read path: %v", err)
+		}
+		if path == "" {
+			return errorf("file exists path is empty")
+		}
+		// The trace is only kept if the probe passes.
+		t.Detail = path + " exists"
+		probe = func(ctx context.Context) (bool, error) {
+			_, err := j.sys.Lstat(ctx, path)
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return err == nil, err
+		}
+	default:
+		return errorf("unknown probe %v", u.Which())
+	}
+
+	timeout := DefaultUntilTimeout
+	if ms := u.TimeoutMillis(); ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+	interval := defaultUntilInterval
+	if ms := u.IntervalMillis(); ms > 0 {
+		interval = time.Duration(ms) * time.Millisecond
+	}
+	deadline := time.After(timeout)
+	for {
+		ok, err := probe(ctx)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		debugf(j.log, ctx, Verbose, "%s: %v probe has not passed yet", formatResource(j.resource), u.Which())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return errorf("%v probe did not pass after %v", u.Which(), timeout)
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+func (j *job) userDefault(ctx context.Context, d catalog.UserDefault) (changed bool, err error) {
+	domain, err := d.Domain()
+	if err != nil {
+		return false, errorf("read domain: %v", err)
+	}
+	if domain == "" {
+		return false, errorf("defaults domain is empty")
+	}
+	key, err := d.Key()
+	if err != nil {
+		return false, errorf("read key: %v", err)
+	}
+	if key == "" {
+		return false, errorf("defaults key is empty")
+	}
+	defaults := []string{defaultsPath}
+	if d.CurrentHost() {
+		defaults = append(defaults, "-currentHost")
+	}
+	cmd := func(args ...string) []string {
+		return append(append([]string(nil), defaults...), args...)
+	}
+
+	typeOut, exists, err := j.probeProgram(ctx, cmd("read-type", domain, key)...)
+	if err != nil {
+		return false, err
+	}
+	if d.Which() == catalog.UserDefault_Which_absent {
+		if !exists {
+			return false, nil
+		}
+		if _, err := j.runProgram(ctx, cmd("delete", domain, key)...); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	var typ string
+	var write []string
+	var matches func(string) bool
+	switch d.Which() {
+	case catalog.UserDefault_Which_text:
+		s, err := d.Text()
+		if err != nil {
+			return false, errorf("read text: %v", err)
+		}
+		typ, write = "string", []string{"-string", s}
+		matches = func(v string) bool { return v == s }
+	case catalog.UserDefault_Which_integer:
+		n := d.Integer()
+		typ, write = "integer", []string{"-int", strconv.FormatInt(n, 10)}
+		matches = func(v string) bool {
+			m, err := strconv.ParseInt(v, 10, 64)
+			return err == nil && m == n
+		}
+	case catalog.UserDefault_Which_real:
+		f := d.Real()
+		typ, write = "float", []string{"-float", strconv.FormatFloat(f, 'g', -1, 64)}
+		matches = func(v string) bool {
+			g, err := strconv.ParseFloat(v, 64)
+			return err == nil && g == f
+		}
+	case catalog.UserDefault_Which_boolean:
+		b := d.Boolean()
+		typ, write = "boolean", []string{"-bool", strconv.FormatBool(b)}
+		want := "0"
+		if b {
+			want = "1"
+		}
+		matches = func(v string) bool { return v == want }
+	default:
+		return false, errorf("unknown defaults value type %v", d.Which())
+	}
+	if exists && strings.TrimSpace(strings.TrimPrefix(string(typeOut), "Type is ")) == typ {
+		out, err := j.runProgram(ctx, cmd("read", domain, key)...)
+		if err != nil {
+			return false, err
+		}
+		if matches(string(bytes.TrimSuffix(out, []byte("\n")))) {
+			return false, nil
+		}
+	}
+	if _, err := j.runProgram(ctx, cmd(append([]string{"write", domain, key}, write...)...)...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
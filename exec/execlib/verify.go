@@ -0,0 +1,77 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package execlib
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// verifyContent runs the plain file's verify command on content before
+// it is written to path.  The command is not run if path already has
+// the content.
+func (j *job) verifyContent(ctx context.Context, path string, f catalog.File_plain, content []byte) error {
+	if old, err := system.ReadFile(ctx, j.sys, path); err == nil && bytes.Equal(old, content) {
+		return nil
+	}
+	c, err := f.Verify()
+	if err != nil {
+		return errorf("read verify command from catalog: %v", err)
+	}
+	cmd, err := j.prepareCommand(ctx, c)
+	if err != nil {
+		return errorf("verify: %v", err)
+	}
+	// Dot files are skipped by the include directives of programs like
+	// sudo, so the temporary file isn't picked up before it is removed.
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".mcm-verify")
+	if err := j.createTempFile(ctx, tmp, content, 0600); err != nil {
+		return errorf("verify: %v", err)
+	}
+	defer func() {
+		if err := j.sys.Remove(ctx, tmp); err != nil {
+			j.warnf("remove verify file: %v", err)
+		}
+	}()
+	if c.Which() == catalog.Exec_Command_Which_argv {
+		cmd.Args = append(cmd.Args, tmp)
+	}
+	cmd.Env = append(cmd.Env, "MCM_VERIFY_PATH="+tmp)
+	debugf(j.log, ctx, Verbose, "%s: verifying new content of %s", formatResource(j.resource), path)
+	out, err := j.sys.Run(ctx, cmd)
+	if err != nil {
+		return errorWithOutput(out, j.maxOutput, errorf("verify %s: %v", path, err))
+	}
+	j.logOutput(ctx, out)
+	return nil
+}
+
+// createTempFile writes content to a new file at tmp with the given
+// mode.  A file left at tmp by an interrupted run is replaced.
+func (j *job) createTempFile(ctx context.Context, tmp string, content []byte, mode os.FileMode) error {
+	err := system.CreateNewFile(ctx, j.sys, tmp, content, mode)
+	if !os.IsExist(err) {
+		return err
+	}
+	if err := j.sys.Remove(ctx, tmp); err != nil {
+		return err
+	}
+	return system.CreateNewFile(ctx, j.sys, tmp, content, mode)
+}
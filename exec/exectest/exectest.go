@@ -0,0 +1,185 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package exectest provides helpers for testing catalogs without
+// touching a real machine.  Catalog generators can apply their output
+// to an in-memory System and check the resulting files and report.
+package exectest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/system/fakesystem"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// Root is the root directory of a System.
+const Root = fakesystem.Root
+
+// System is an in-memory filesystem and command runner.  The zero
+// value is an empty filesystem with no commands.  It is safe to use
+// from multiple goroutines.
+type System struct {
+	fakesystem.System
+}
+
+// WriteFile creates a file with the given content, creating any
+// missing parent directories.
+func (sys *System) WriteFile(path string, content []byte, mode os.FileMode) error {
+	ctx := context.Background()
+	if err := sys.MkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	w, err := sys.CreateFile(ctx, path, mode)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	cerr := w.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// ReadFile returns the content of a file.
+func (sys *System) ReadFile(path string) ([]byte, error) {
+	f, err := sys.OpenFile(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := new(bytes.Buffer)
+	_, err = io.Copy(buf, f)
+	return buf.Bytes(), err
+}
+
+// MkdirAll creates a directory along with any missing parents.
+func (sys *System) MkdirAll(path string) error {
+	ctx := context.Background()
+	if info, err := sys.Lstat(ctx, path); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if err := sys.MkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := sys.Mkdir(ctx, path, 0777); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// A Result is the scripted outcome of running a command.
+type Result struct {
+	// Output is written to the command's combined output.
+	Output string
+
+	// Exit is the command's exit code.
+	Exit int
+}
+
+// Command creates an executable at path, along with any missing parent
+// directories, that returns the given results in order each time it is
+// run.  Once the results are used up, the last one is repeated.  With
+// no results, the command succeeds without output.
+func (sys *System) Command(path string, results ...Result) error {
+	if err := sys.MkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	return sys.Mkprogram(path, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		if len(results) == 0 {
+			return 0
+		}
+		mu.Lock()
+		r := results[n]
+		if n < len(results)-1 {
+			n++
+		}
+		mu.Unlock()
+		io.WriteString(pc.Output, r.Output)
+		return r.Exit
+	})
+}
+
+// ReadCatalog decodes a serialized catalog, such as the output of a
+// catalog generator.
+func ReadCatalog(r io.Reader) (catalog.Catalog, error) {
+	msg, err := capnp.NewDecoder(r).Decode()
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	c, err := catalog.ReadRootCatalog(msg)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	return c, nil
+}
+
+// Apply applies c to sys and returns the run's report.  If opts.Log is
+// nil, then messages are logged to t.  The report is returned even if
+// the catalog failed to apply, so that tests can check which resources
+// failed.
+func Apply(t testing.TB, sys *System, c catalog.Catalog, opts *execlib.Options) (*execlib.Report, error) {
+	var o execlib.Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.Log == nil {
+		o.Log = testLogger{t}
+	}
+	o.Report = new(execlib.Report)
+	err := execlib.Apply(context.Background(), sys, c, &o)
+	return o.Report, err
+}
+
+// MustApply applies c to sys with the default options and returns the
+// run's report.  It fails the test immediately if any resource fails.
+func MustApply(t testing.TB, sys *System, c catalog.Catalog) *execlib.Report {
+	r, err := Apply(t, sys, c, nil)
+	if err != nil {
+		t.Fatal("apply catalog:", err)
+	}
+	return r
+}
+
+type testLogger struct {
+	t testing.TB
+}
+
+func (tl testLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	tl.t.Logf("apply: "+format, args...)
+}
+
+func (tl testLogger) Error(ctx context.Context, err error) {
+	tl.t.Logf("apply error: %v", err)
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exectest
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/catpogs"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func TestApply(t *testing.T) {
+	motdPath := filepath.Join(Root, "etc", "motd")
+	checkPath := filepath.Join(Root, "bin", "check")
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:    1,
+				Name:  "motd",
+				Which: catalog.Resource_Which_file,
+				File:  catpogs.PlainFile(motdPath, []byte("Hello")),
+			},
+			{
+				ID:      2,
+				Comment: "check",
+				Deps:    []uint64{1},
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{checkPath},
+					},
+				},
+			},
+			{
+				ID:      3,
+				Comment: "after check",
+				Deps:    []uint64{2},
+				Which:   catalog.Resource_Which_noop,
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	sys := new(System)
+	if err := sys.WriteFile(motdPath, []byte("Goodbye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.Command(checkPath, Result{Output: "bad\n", Exit: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Apply(t, sys, cat, nil)
+	if err == nil {
+		t.Error("Apply did not return an error")
+	}
+	CheckReport(t, r, filepath.Join("testdata", "report.golden"))
+	if got, err := sys.ReadFile(motdPath); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(got, []byte("Hello")) {
+		t.Errorf("%s = %q; want \"Hello\"", motdPath, got)
+	}
+}
+
+func TestCommandResults(t *testing.T) {
+	path := filepath.Join(Root, "bin", "flaky")
+	sys := new(System)
+	if err := sys.Command(path, Result{Exit: 1}, Result{Output: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      1,
+				Comment: "flaky",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{path},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	want := []execlib.ResourceStatus{execlib.StatusFailed, execlib.StatusChanged, execlib.StatusChanged}
+	for i, status := range want {
+		r, _ := Apply(t, sys, cat, nil)
+		if got := r.Resource(1); got == nil || got.Status != status {
+			t.Errorf("run %d: report = %+v; want status %s", i+1, got, status)
+		}
+	}
+}
+
+func TestReadCatalog(t *testing.T) {
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{ID: 1, Which: catalog.Resource_Which_noop},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := capnp.NewEncoder(buf).Encode(cat.Segment().Message()); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ReadCatalog(buf)
+	if err != nil {
+		t.Fatal("ReadCatalog:", err)
+	}
+	r := MustApply(t, new(System), c)
+	if got := FormatReport(r); got != "1: unchanged\napplied 1, changed 0, unchanged 1, failed 0, skipped 0\n" {
+		t.Errorf("FormatReport = %q", got)
+	}
+}
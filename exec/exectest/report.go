@@ -0,0 +1,91 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exectest
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+)
+
+var update = flag.Bool("exectest.update", false, "rewrite golden report files instead of comparing against them")
+
+// FormatReport formats a report as text that only depends on the
+// outcome of each resource and not on timing, suitable for comparing
+// against a golden file.  There is one line per resource, in ID order:
+//
+//	ID [LABEL]: STATUS[: ERROR]
+//
+// where LABEL is the resource's name, or its comment if it has no name.
+// The report's summary follows, without the duration.
+func FormatReport(r *execlib.Report) string {
+	res := make([]*execlib.ResourceReport, len(r.Resources))
+	copy(res, r.Resources)
+	sort.Sort(byID(res))
+	buf := new(bytes.Buffer)
+	for _, rr := range res {
+		label := rr.Name
+		if label == "" {
+			label = rr.Comment
+		}
+		fmt.Fprintf(buf, "%d", rr.ID)
+		if label != "" {
+			fmt.Fprintf(buf, " %s", label)
+		}
+		fmt.Fprintf(buf, ": %s", rr.Status)
+		if rr.Error != "" {
+			fmt.Fprintf(buf, ": %s", strings.Replace(rr.Error, "\n", " ", -1))
+		}
+		buf.WriteByte('\n')
+	}
+	if s := r.Summary; s != nil {
+		fmt.Fprintf(buf, "applied %d, changed %d, unchanged %d, failed %d, skipped %d\n",
+			s.Applied, s.Changed, s.Unchanged, s.Failed, s.Skipped)
+	}
+	return buf.String()
+}
+
+// CheckReport fails the test if FormatReport(r) differs from the
+// content of the golden file at path.  Running the test with
+// -exectest.update writes the report to the golden file instead.
+func CheckReport(t testing.TB, r *execlib.Report, path string) {
+	got := FormatReport(r)
+	if *update {
+		if err := ioutil.WriteFile(path, []byte(got), 0666); err != nil {
+			t.Error("update golden report:", err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("read golden report: %v (run with -exectest.update to create it)", err)
+		return
+	}
+	if got != string(want) {
+		t.Errorf("report does not match %s (run with -exectest.update to accept):\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+type byID []*execlib.ResourceReport
+
+func (a byID) Len() int           { return len(a) }
+func (a byID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+func (a byID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
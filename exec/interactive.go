@@ -0,0 +1,281 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/plan"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// maxDiffLines is the number of changed lines shown for a file before
+// the rest are elided.
+const maxDiffLines = 40
+
+// A prompter asks whether to apply each change in a plan.  Its veto
+// method is used as execlib.Options.Veto.
+type prompter struct {
+	ctx     context.Context
+	sys     system.System
+	in      *bufio.Reader
+	out     io.Writer
+	changes map[changeKey]bool
+
+	all  bool
+	quit bool
+}
+
+// changeKey identifies a resource in a run of several catalogs.
+type changeKey struct {
+	cat int
+	id  uint64
+}
+
+func newPrompter(ctx context.Context, sys system.System, tty io.ReadWriter, p *plan.Plan) *prompter {
+	pr := &prompter{
+		ctx:     ctx,
+		sys:     sys,
+		in:      bufio.NewReader(tty),
+		out:     tty,
+		changes: make(map[changeKey]bool, len(p.Changes)),
+	}
+	for _, c := range p.Changes {
+		pr.changes[changeKey{c.Catalog, c.ID}] = true
+	}
+	return pr
+}
+
+// veto asks whether to apply r if the plan says that it changes.
+// Resources that the plan doesn't change are applied without asking.
+func (pr *prompter) veto(cat int, r catalog.Resource) string {
+	switch {
+	case pr.quit:
+		return "quit at prompt"
+	case pr.all || !pr.changes[changeKey{cat, r.ID()}]:
+		return ""
+	}
+	fmt.Fprintf(pr.out, "\n%s\n", describeResource(r))
+	if desc, err := describeChange(pr.ctx, pr.sys, r); err != nil {
+		fmt.Fprintf(pr.out, "  (%v)\n", err)
+	} else {
+		io.WriteString(pr.out, desc)
+	}
+	for {
+		io.WriteString(pr.out, "Apply this change? [y,n,a,q,?] ")
+		line, err := pr.in.ReadString('\n')
+		if err != nil && line == "" {
+			// Treat a closed terminal like quitting.
+			io.WriteString(pr.out, "\n")
+			pr.quit = true
+			return "quit at prompt"
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return ""
+		case "n", "no":
+			return "declined at prompt"
+		case "a", "all":
+			pr.all = true
+			return ""
+		case "q", "quit":
+			pr.quit = true
+			return "quit at prompt"
+		default:
+			io.WriteString(pr.out, "y - apply this change\n"+
+				"n - skip this change\n"+
+				"a - apply this change and all later ones\n"+
+				"q - skip this change and all later ones\n")
+		}
+	}
+}
+
+// describeResource returns a one-line description of r for the prompt.
+func describeResource(r catalog.Resource) string {
+	desc := fmt.Sprintf("id=%d", r.ID())
+	if name, _ := r.Name(); name != "" {
+		desc = name
+	} else if c, _ := r.Comment(); c != "" {
+		desc = fmt.Sprintf("%s (id=%d)", c, r.ID())
+	}
+	return fmt.Sprintf("%s: %v", desc, r.Which())
+}
+
+// describeChange returns the indented lines to show for the change that
+// applying r makes: a diff for plain files with inline content, the
+// command for exec resources, and the path for other file resources.
+func describeChange(ctx context.Context, sys system.System, r catalog.Resource) (string, error) {
+	buf := new(bytes.Buffer)
+	switch r.Which() {
+	case catalog.Resource_Which_file:
+		f, err := r.File()
+		if err != nil {
+			return "", err
+		}
+		path, err := f.Path()
+		if err != nil {
+			return "", err
+		}
+		switch f.Which() {
+		case catalog.File_Which_plain:
+			if url, _ := f.Plain().ContentUrl(); url != "" {
+				fmt.Fprintf(buf, "  write %s from %s\n", path, url)
+				break
+			}
+			if src, _ := f.Plain().ContentPath(); src != "" {
+				fmt.Fprintf(buf, "  copy %s to %s\n", src, path)
+				break
+			}
+			if id := f.Plain().ContentFromOutput(); id != 0 {
+				fmt.Fprintf(buf, "  write %s from the output of resource %d\n", path, id)
+				break
+			}
+			if !f.Plain().HasContent() {
+				fmt.Fprintf(buf, "  set mode of %s\n", path)
+				break
+			}
+			content, err := f.Plain().Content()
+			if err != nil {
+				return "", err
+			}
+			old, err := system.ReadFile(ctx, sys, path)
+			if system.IsNotExist(err) {
+				fmt.Fprintf(buf, "  create %s\n", path)
+			} else if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(buf, "  --- %s\n  +++ %s\n", path, path)
+			writeDiff(buf, old, content)
+		case catalog.File_Which_directory:
+			fmt.Fprintf(buf, "  directory %s\n", path)
+		case catalog.File_Which_symlink:
+			target, err := f.Symlink().Target()
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(buf, "  symlink %s -> %s\n", path, target)
+		case catalog.File_Which_absent:
+			fmt.Fprintf(buf, "  remove %s\n", path)
+		}
+	case catalog.Resource_Which_exec:
+		e, err := r.Exec()
+		if err != nil {
+			return "", err
+		}
+		c, err := e.Command()
+		if err != nil {
+			return "", err
+		}
+		switch c.Which() {
+		case catalog.Exec_Command_Which_argv:
+			argv, err := c.Argv()
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString("  run")
+			for i := 0; i < argv.Len(); i++ {
+				arg, _ := argv.At(i)
+				buf.WriteString(" " + strconv.Quote(arg))
+			}
+			buf.WriteString("\n")
+		case catalog.Exec_Command_Which_bash:
+			script, err := c.Bash()
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString("  run bash:\n")
+			for _, line := range strings.Split(strings.TrimRight(script, "\n"), "\n") {
+				fmt.Fprintf(buf, "    %s\n", line)
+			}
+		}
+	}
+	return buf.String(), nil
+}
+
+// writeDiff writes the lines removed from old and added in new to w,
+// prefixed with "-" and "+".  Binary content is only summarized.
+func writeDiff(w io.Writer, old, new []byte) {
+	if bytes.IndexByte(old, 0) != -1 || bytes.IndexByte(new, 0) != -1 {
+		fmt.Fprintf(w, "  binary content differs (%d bytes -> %d bytes)\n", len(old), len(new))
+		return
+	}
+	a, b := splitLines(old), splitLines(new)
+	// Trim the common prefix and suffix before the quadratic step.
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	if len(a)*len(b) > 1<<20 {
+		fmt.Fprintf(w, "  %d lines replaced with %d lines\n", len(a), len(b))
+		return
+	}
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	n := 0
+	line := func(prefix, s string) {
+		if n < maxDiffLines {
+			fmt.Fprintf(w, "  %s%s\n", prefix, s)
+		}
+		n++
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			line("-", a[i])
+			i++
+		default:
+			line("+", b[j])
+			j++
+		}
+	}
+	if n > maxDiffLines {
+		fmt.Fprintf(w, "  ... %d more changed lines\n", n-maxDiffLines)
+	}
+}
+
+func splitLines(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
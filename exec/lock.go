@@ -0,0 +1,46 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// lockRun takes the -lock lock at path, so that only one run applies
+// catalogs to the host at a time.  If another run holds the lock, then
+// lockRun logs that it is waiting for it.
+func lockRun(ctx context.Context, log *logger, path string) (system.FileLock, error) {
+	var sys system.Local
+	// Local.Lock tries once before checking the context.
+	tryCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	l, err := sys.Lock(tryCtx, path, 0644)
+	if err == nil {
+		return l, nil
+	}
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != context.Canceled || ctx.Err() != nil {
+		return nil, fmt.Errorf("-lock: %v", err)
+	}
+	log.Infof(ctx, "waiting for another run to release %s", path)
+	l, err = sys.Lock(ctx, path, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("-lock: %v", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,34 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build mcm_minimal mcm_noprofile
+
+package main
+
+import "errors"
+
+// A profiler does nothing, since the build does not support profiling.
+type profiler struct{}
+
+// startProfiler returns an error if any profile is requested.
+func startProfiler(cpuPath, memPath, tracePath string) (*profiler, error) {
+	if cpuPath != "" || memPath != "" || tracePath != "" {
+		return nil, errors.New("profiling not supported (built with mcm_noprofile)")
+	}
+	return new(profiler), nil
+}
+
+func (p *profiler) stop() error {
+	return nil
+}
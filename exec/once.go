@@ -0,0 +1,136 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/plan"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// onceStamp is the content of the -once completion stamp.
+type onceStamp struct {
+	Finished time.Time `json:"finished"`
+
+	// Catalogs has the digest of each applied catalog (see
+	// plan.CatalogDigest).
+	Catalogs []string `json:"catalogs"`
+}
+
+// stampExists reports whether the -once stamp at path was written by
+// an earlier run.
+func stampExists(path string) (bool, error) {
+	_, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("-once: %v", err)
+	}
+	return true, nil
+}
+
+// writeStamp records that cats were applied in the -once stamp at path.
+// The stamp is renamed into place, so an interrupted write leaves no
+// stamp and the next run applies the catalogs again.
+func writeStamp(path string, cats []catalog.Catalog) error {
+	stamp := &onceStamp{Finished: time.Now().UTC()}
+	for _, cat := range cats {
+		d, err := plan.CatalogDigest(cat)
+		if err != nil {
+			return fmt.Errorf("write stamp %s: %v", path, err)
+		}
+		stamp.Catalogs = append(stamp.Catalogs, d)
+	}
+	data, err := json.Marshal(stamp)
+	if err != nil {
+		return fmt.Errorf("write stamp %s: %v", path, err)
+	}
+	data = append(data, '\n')
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("write stamp %s: %v", path, err)
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("write stamp %s: %v", path, err)
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write stamp %s: %v", path, err)
+	}
+	return nil
+}
+
+// disableUnit stops the systemd unit that started mcm-exec from running
+// again.  unit is either a unit name, which is disabled, or the path of
+// a unit file, which is disabled and then removed.  Calling disableUnit
+// again after it succeeded or was interrupted is safe.
+func disableUnit(ctx context.Context, sys system.System, unit string) error {
+	if !filepath.IsAbs(unit) {
+		return systemctl(ctx, sys, "disable", unit)
+	}
+	if _, err := os.Lstat(unit); os.IsNotExist(err) {
+		// Removed by an earlier run, which may not have reloaded.
+		return systemctl(ctx, sys, "daemon-reload")
+	}
+	if err := systemctl(ctx, sys, "disable", filepath.Base(unit)); err != nil {
+		return err
+	}
+	if err := os.Remove(unit); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove unit: %v", err)
+	}
+	return systemctl(ctx, sys, "daemon-reload")
+}
+
+// systemctl runs systemctl(1) with args.
+func systemctl(ctx context.Context, sys system.System, args ...string) error {
+	path, err := sys.LookPath(ctx, "systemctl", "")
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v", args[0], err)
+	}
+	out, err := sys.Run(ctx, &system.Cmd{
+		Path: path,
+		Args: append([]string{path}, args...),
+		Dir:  system.LocalRoot,
+	})
+	if err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			return fmt.Errorf("systemctl %s: %v: %s", args[0], err, out)
+		}
+		return fmt.Errorf("systemctl %s: %v", args[0], err)
+	}
+	return nil
+}
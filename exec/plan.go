@@ -0,0 +1,142 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/catcrypt"
+	"github.com/zombiezen/mcm/internal/plan"
+	"github.com/zombiezen/mcm/internal/policy"
+)
+
+// makePlan simulates applying the catalogs and returns the resulting
+// plan.  The simulated run uses its own report, supervisor, and
+// logger, so it does not disturb a real run that uses opts afterward.
+func makePlan(ctx context.Context, log execlib.Logger, cats []catalog.Catalog, opts *execlib.Options) (*plan.Plan, error) {
+	p := &plan.Plan{Created: time.Now().UTC()}
+	p.Host, _ = os.Hostname()
+	for _, cat := range cats {
+		d, err := plan.CatalogDigest(cat)
+		if err != nil {
+			return nil, err
+		}
+		p.Catalogs = append(p.Catalogs, d)
+	}
+	obs := new(plan.Observer)
+	sys := simulatedSystem{services: new(simulatedServices), obs: obs}
+	simOpts := *opts
+	simOpts.Log = log
+	simOpts.Report = new(execlib.Report)
+	simOpts.State = nil
+	simOpts.Supervisor = new(execlib.Supervisor)
+	simOpts.SkipHealthChecks = true
+	err := execlib.ApplyAll(ctx, sys, cats, &simOpts)
+	simOpts.Supervisor.Stop()
+	if err != nil {
+		return nil, fmt.Errorf("plan: %v", err)
+	}
+	p.Observed = obs.Sum()
+	p.Changes = plan.Changes(simOpts.Report)
+	return p, nil
+}
+
+// writePlan writes a plan file to path.
+func writePlan(path string, keyPath string, p *plan.Plan) error {
+	key, err := readPlanKey(keyPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("write plan: %v", err)
+	}
+	err = plan.Write(f, key, p)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	if cerr != nil {
+		return fmt.Errorf("write plan: %v", cerr)
+	}
+	return nil
+}
+
+// readPlan reads the plan file at path.
+func readPlan(path string, keyPath string) (*plan.Plan, error) {
+	key, err := readPlanKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read plan: %v", err)
+	}
+	defer f.Close()
+	return plan.Read(f, key)
+}
+
+// checkPlan returns an error if applying the catalogs now would not make
+// the changes recorded in the plan file at path.  Otherwise, it returns
+// the plan of the changes that applying would make now.
+func checkPlan(ctx context.Context, log *logger, path string, keyPath string, cats []catalog.Catalog, opts *execlib.Options) (*plan.Plan, error) {
+	want, err := readPlan(path, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	got, err := makePlan(ctx, &logger{quiet: true, json: log.json}, cats, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := want.Check(got); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return got, nil
+}
+
+// checkPolicy evaluates pol against the catalogs and the plan p.  It
+// returns an error if the policy refuses the run, and otherwise sets
+// opts.Veto to fail the resources that the policy denies.
+func checkPolicy(ctx context.Context, pol policy.Policy, cats []catalog.Catalog, p *plan.Plan, opts *execlib.Options) error {
+	in, err := policy.NewInput(cats, p)
+	if err != nil {
+		return fmt.Errorf("policy: %v", err)
+	}
+	in.UID = os.Getuid()
+	d, err := pol.Evaluate(ctx, in)
+	if err != nil {
+		return fmt.Errorf("policy: %v", err)
+	}
+	if err := d.Err(); err != nil {
+		return err
+	}
+	if len(d.DenyResources) > 0 {
+		opts.Veto = d.Veto()
+	}
+	return nil
+}
+
+func readPlanKey(path string) (*catcrypt.Key, error) {
+	if path == "" {
+		return nil, errors.New("plan files require -plan_key")
+	}
+	return catcrypt.ReadKeyFile(path)
+}
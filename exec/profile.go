@@ -0,0 +1,113 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !mcm_minimal,!mcm_noprofile
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+
+	"github.com/zombiezen/mcm/internal/features"
+)
+
+func init() {
+	features.Register("profile")
+}
+
+// A profiler writes the profiles requested on the command line.
+type profiler struct {
+	cpu     *os.File
+	trace   *os.File
+	memPath string
+	once    sync.Once
+}
+
+// startProfiler starts CPU profiling and execution tracing for the
+// paths that are not empty.  The heap profile is written to memPath
+// when the profiler is stopped.
+func startProfiler(cpuPath, memPath, tracePath string) (*profiler, error) {
+	p := &profiler{memPath: memPath}
+	if cpuPath != "" {
+		f, err := os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("cpu profile: %v", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("cpu profile: %v", err)
+		}
+		p.cpu = f
+	}
+	if tracePath != "" {
+		f, err := os.Create(tracePath)
+		if err != nil {
+			p.stop()
+			return nil, fmt.Errorf("trace: %v", err)
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			p.stop()
+			return nil, fmt.Errorf("trace: %v", err)
+		}
+		p.trace = f
+	}
+	return p, nil
+}
+
+// stop finishes the profiles.  Only the first call has any effect, so
+// it is safe to call both on exit and on a fatal error.
+func (p *profiler) stop() error {
+	var firstErr error
+	p.once.Do(func() {
+		if p.cpu != nil {
+			pprof.StopCPUProfile()
+			if err := p.cpu.Close(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("cpu profile: %v", err)
+			}
+		}
+		if p.trace != nil {
+			trace.Stop()
+			if err := p.trace.Close(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("trace: %v", err)
+			}
+		}
+		if p.memPath != "" {
+			if err := writeHeapProfile(p.memPath); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("memory profile: %v", err)
+			}
+		}
+	})
+	return firstErr
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// Collect garbage so the profile shows what is still in use.
+	runtime.GC()
+	err = pprof.WriteHeapProfile(f)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
@@ -0,0 +1,128 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/mounts"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// readOnlyMount is a read-only mount that file resources write to.
+type readOnlyMount struct {
+	mount *mounts.Mount
+	paths []string
+}
+
+func (ro *readOnlyMount) String() string {
+	s := fmt.Sprintf("%s is on the read-only %s filesystem %s mounted at %s", ro.paths[0], ro.mount.FSType, ro.mount.Source, ro.mount.Point)
+	if n := len(ro.paths) - 1; n == 1 {
+		s += " (as is 1 other path)"
+	} else if n > 1 {
+		s += fmt.Sprintf(" (as are %d other paths)", n)
+	}
+	return s
+}
+
+// findReadOnlyMounts returns the read-only mounts that the file
+// resources of cats are on, in the order that they are first seen.
+func findReadOnlyMounts(cats []catalog.Catalog) ([]*readOnlyMount, error) {
+	ms, err := mounts.Read()
+	if err != nil || len(ms) == 0 {
+		return nil, err
+	}
+	var found []*readOnlyMount
+	byMount := make(map[*mounts.Mount]*readOnlyMount)
+	for _, cat := range cats {
+		res, err := cat.Resources()
+		if err != nil {
+			return nil, err
+		}
+		for i, n := 0, res.Len(); i < n; i++ {
+			r := res.At(i)
+			if r.Which() != catalog.Resource_Which_file {
+				continue
+			}
+			f, err := r.File()
+			if err != nil {
+				return nil, err
+			}
+			path, err := f.Path()
+			if err != nil || !filepath.IsAbs(path) {
+				// Reported when the resource is applied.
+				continue
+			}
+			m := mounts.Find(ms, path)
+			if m == nil || !m.ReadOnly {
+				continue
+			}
+			ro := byMount[m]
+			if ro == nil {
+				ro = &readOnlyMount{mount: m}
+				byMount[m] = ro
+				found = append(found, ro)
+			}
+			ro.paths = append(ro.paths, path)
+		}
+	}
+	return found, nil
+}
+
+// readOnlyError returns an error describing the read-only mounts that
+// prevent the run.
+func readOnlyError(ros []*readOnlyMount) error {
+	lines := make([]string, len(ros))
+	for i, ro := range ros {
+		lines[i] = ro.String()
+	}
+	return fmt.Errorf("%s; remount read-write or run with -remount_rw", strings.Join(lines, "; "))
+}
+
+// remount changes a mount point to read-write ("rw") or read-only
+// ("ro") with mount(8).
+func remount(ctx context.Context, sys system.System, point string, mode string) error {
+	path, err := sys.LookPath(ctx, "mount", "")
+	if err != nil {
+		return fmt.Errorf("remount %s %s: %v", point, mode, err)
+	}
+	out, err := sys.Run(ctx, &system.Cmd{
+		Path: path,
+		Args: []string{path, "-o", "remount," + mode, point},
+		Dir:  system.LocalRoot,
+	})
+	if err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			return fmt.Errorf("remount %s %s: %v: %s", point, mode, err, out)
+		}
+		return fmt.Errorf("remount %s %s: %v", point, mode, err)
+	}
+	return nil
+}
+
+// remountReadOnly changes the points back to read-only after a run,
+// logging any failures.
+func remountReadOnly(ctx context.Context, sys system.System, log *logger, points []string) {
+	for _, point := range points {
+		if err := remount(ctx, sys, point, "ro"); err != nil {
+			log.Error(ctx, err)
+		}
+	}
+}
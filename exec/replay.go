@@ -0,0 +1,121 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/system"
+	"github.com/zombiezen/mcm/internal/system/replay"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// writeBundle saves the calls recorded during a run in a bundle at
+// path, along with the run's catalogs and variables.
+func writeBundle(path string, rec *replay.Recorder, cats []catalog.Catalog, vars map[string]string) error {
+	b := &replay.Bundle{
+		Time:  time.Now().UTC(),
+		Args:  os.Args,
+		Vars:  vars,
+		Calls: rec.Calls(),
+	}
+	for _, cat := range cats {
+		data, err := cat.Segment().Message().Marshal()
+		if err != nil {
+			return fmt.Errorf("write bundle %s: %v", path, err)
+		}
+		b.Catalogs = append(b.Catalogs, data)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("write bundle %s: %v", path, err)
+	}
+	err = b.Write(f)
+	cerr := f.Close()
+	if err != nil {
+		return fmt.Errorf("write bundle %s: %v", path, err)
+	}
+	if cerr != nil {
+		return fmt.Errorf("write bundle %s: %v", path, cerr)
+	}
+	return nil
+}
+
+// readBundle reads the bundle at path and its catalogs.
+func readBundle(path string) (*replay.Bundle, []catalog.Catalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read bundle %s: %v", path, err)
+	}
+	defer f.Close()
+	b, err := replay.ReadBundle(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cats := make([]catalog.Catalog, 0, len(b.Catalogs))
+	for i, data := range b.Catalogs {
+		msg, err := capnp.NewDecoder(bytes.NewReader(data)).Decode()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read bundle %s: catalog %d: %v", path, i, err)
+		}
+		cat, err := catalog.ReadRootCatalog(msg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read bundle %s: catalog %d: %v", path, i, err)
+		}
+		cats = append(cats, cat)
+	}
+	return b, cats, nil
+}
+
+// replayBundle applies the catalogs in the bundle at path against its
+// recorded calls.  wrap is applied to the replaying system, so that
+// -s can log its commands.
+func replayBundle(ctx context.Context, log *logger, path string, opts *execlib.Options, wrap func(system.System) system.System) error {
+	b, cats, err := readBundle(path)
+	if err != nil {
+		return err
+	}
+	log.Infof(ctx, "replaying %d calls recorded at %v", len(b.Calls), b.Time.Format(time.RFC3339))
+	if len(b.Vars) > 0 {
+		vars := make(map[string]string, len(b.Vars)+len(opts.Vars))
+		for k, v := range b.Vars {
+			vars[k] = v
+		}
+		// Variables given on the command line take precedence.
+		for k, v := range opts.Vars {
+			vars[k] = v
+		}
+		opts.Vars = vars
+	}
+	rsys := replay.NewSystem(b.Calls)
+	opts.Report = new(execlib.Report)
+	err = execlib.ApplyAll(ctx, wrap(rsys), cats, opts)
+	if opts.Report.Summary != nil {
+		log.Summary(ctx, opts.Report.Summary)
+	}
+	if misses := rsys.Misses(); len(misses) > 0 {
+		log.Infof(ctx, "warning: replay diverged from the recording: %d calls were not recorded", len(misses))
+		for _, m := range misses {
+			log.Infof(ctx, "not recorded: %s", m)
+		}
+	}
+	return err
+}
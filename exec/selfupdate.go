@@ -0,0 +1,69 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/internal/selfupdate"
+	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/third_party/golang/crypto/ed25519"
+)
+
+// selfUpdate replaces the mcm-exec executable with the release in the
+// manifest at manifestURL, if it is a different version.
+func selfUpdate(ctx context.Context, log *logger, manifestURL, keyPath string, d *download.Downloader) error {
+	key, err := readUpdateKey(keyPath)
+	if err != nil {
+		return err
+	}
+	u := &selfupdate.Updater{
+		URL:        manifestURL,
+		PublicKey:  key,
+		Program:    "mcm-exec",
+		Version:    version.Label,
+		Downloader: d,
+	}
+	rel, err := u.Update(ctx)
+	if err != nil {
+		return err
+	}
+	if rel == nil {
+		log.Infof(ctx, "mcm-exec %s is current", version.Label)
+		return nil
+	}
+	log.Infof(ctx, "updated mcm-exec to %s", rel.Version)
+	return nil
+}
+
+func readUpdateKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read update key: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("read update key %s: %v", path, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("read update key %s: wrong size %d", path, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
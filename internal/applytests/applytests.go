@@ -70,13 +70,21 @@ func Run(t *testing.T, ff FixtureFunc) {
 	t.Run("FileMode", func(t *testing.T) { fileModeTest(t, ff) })
 	t.Run("Noop", func(t *testing.T) { noopTest(t, ff) })
 	t.Run("NoContentFile", func(t *testing.T) { noContentFileTest(t, ff) })
+	t.Run("OnlyIfExistsFile", func(t *testing.T) { onlyIfExistsFileTest(t, ff) })
+	t.Run("CopyFile", func(t *testing.T) { copyFileTest(t, ff) })
 	t.Run("Link", func(t *testing.T) { linkTest(t, ff) })
 	t.Run("Relink", func(t *testing.T) { relinkTest(t, ff) })
+	t.Run("RelativeLink", func(t *testing.T) { relativeLinkTest(t, ff) })
 	t.Run("SkipFail", func(t *testing.T) { skipFailTest(t, ff) })
+	t.Run("Barrier", func(t *testing.T) { barrierTest(t, ff) })
 	t.Run("Exec", func(t *testing.T) { execTest(t, ff) })
 	t.Run("ExecOnlyIf", func(t *testing.T) { execOnlyIfTest(t, ff) })
 	t.Run("ExecUnless", func(t *testing.T) { execUnlessTest(t, ff) })
+	t.Run("ExecCreates", func(t *testing.T) { execCreatesTest(t, ff) })
 	t.Run("ExecIfDepsChanged", func(t *testing.T) { execIfDepsChangedTest(t, ff) })
+	t.Run("ExecCreateWorkingDirectory", func(t *testing.T) { execCreateWorkingDirectoryTest(t, ff) })
+	t.Run("ExecLookPath", func(t *testing.T) { execLookPathTest(t, ff) })
+	t.Run("ExecBatchArgs", func(t *testing.T) { execBatchArgsTest(t, ff) })
 }
 
 func startTest(t *testing.T, ff FixtureFunc, name string) (ctx context.Context, f Fixture, done func()) {
@@ -448,6 +456,140 @@ func noContentFileTest(t *testing.T, ff FixtureFunc) {
 	})
 }
 
+func onlyIfExistsFileTest(t *testing.T, ff FixtureFunc) {
+	const fileContent = "Hello!\n"
+	onlyIfExistsCatalog := func(fpath string) (catalog.Catalog, error) {
+		file := catpogs.PlainFile(fpath, []byte(fileContent))
+		file.Plain.OnlyIfExists = true
+		return (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:      42,
+					Comment: "file",
+					Which:   catalog.Resource_Which_file,
+					File:    file,
+				},
+			},
+		}).ToCapnp()
+	}
+	t.Run("Exists", func(t *testing.T) {
+		ctx, f, done := startTest(t, ff, "onlyIfExistsExists")
+		defer done()
+		fpath := filepath.Join(f.SystemInfo().Root, "foo.txt")
+		if err := system.WriteFile(ctx, f.System(), fpath, []byte("data\n"), 0666); err != nil {
+			t.Fatal("WriteFile:", err)
+		}
+		c, err := onlyIfExistsCatalog(fpath)
+		if err != nil {
+			t.Fatalf("build catalog: %v", err)
+		}
+		err = f.Apply(ctx, c)
+		if err != nil {
+			t.Errorf("run catalog: %v", err)
+		}
+		gotContent, err := system.ReadFile(ctx, f.System(), fpath)
+		if err != nil {
+			t.Errorf("read %s: %v", fpath, err)
+		}
+		if !bytes.Equal(gotContent, []byte(fileContent)) {
+			t.Errorf("content of %s = %q; want %q", fpath, gotContent, fileContent)
+		}
+	})
+	t.Run("NotExists", func(t *testing.T) {
+		ctx, f, done := startTest(t, ff, "onlyIfExistsNotExists")
+		defer done()
+		fpath := filepath.Join(f.SystemInfo().Root, "foo.txt")
+		c, err := onlyIfExistsCatalog(fpath)
+		if err != nil {
+			t.Fatalf("build catalog: %v", err)
+		}
+		err = f.Apply(ctx, c)
+		if err != nil {
+			t.Errorf("run catalog: %v", err)
+		}
+		if exists, err := fileExists(ctx, f.System(), fpath); err != nil {
+			t.Error("fileExists:", err)
+		} else if exists {
+			t.Errorf("file %q exists; applier should not have created", fpath)
+		}
+	})
+}
+
+func copyFileTest(t *testing.T, ff FixtureFunc) {
+	const fileContent = "Hello!\n"
+	copyCatalog := func(src, dst string) (catalog.Catalog, error) {
+		file := catpogs.PlainFile(dst, nil)
+		file.Plain.ContentPath = src
+		return (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:      42,
+					Comment: "file",
+					Which:   catalog.Resource_Which_file,
+					File:    file,
+				},
+			},
+		}).ToCapnp()
+	}
+	for _, existing := range []string{"", "data\n", fileContent} {
+		name := "New"
+		switch existing {
+		case fileContent:
+			name = "Same"
+		case "data\n":
+			name = "Different"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx, f, done := startTest(t, ff, "copyFile"+name)
+			defer done()
+			root := f.SystemInfo().Root
+			src := filepath.Join(root, "example.txt")
+			dst := filepath.Join(root, "foo.txt")
+			if err := system.WriteFile(ctx, f.System(), src, []byte(fileContent), 0666); err != nil {
+				t.Fatal("WriteFile:", err)
+			}
+			if existing != "" {
+				if err := system.WriteFile(ctx, f.System(), dst, []byte(existing), 0666); err != nil {
+					t.Fatal("WriteFile:", err)
+				}
+			}
+			c, err := copyCatalog(src, dst)
+			if err != nil {
+				t.Fatalf("build catalog: %v", err)
+			}
+			err = f.Apply(ctx, c)
+			if err != nil {
+				t.Errorf("run catalog: %v", err)
+			}
+			gotContent, err := system.ReadFile(ctx, f.System(), dst)
+			if err != nil {
+				t.Errorf("read %s: %v", dst, err)
+			}
+			if !bytes.Equal(gotContent, []byte(fileContent)) {
+				t.Errorf("content of %s = %q; want %q", dst, gotContent, fileContent)
+			}
+		})
+	}
+	t.Run("MissingSource", func(t *testing.T) {
+		ctx, f, done := startTest(t, ff, "copyFileMissingSource")
+		defer done()
+		root := f.SystemInfo().Root
+		dst := filepath.Join(root, "foo.txt")
+		c, err := copyCatalog(filepath.Join(root, "example.txt"), dst)
+		if err != nil {
+			t.Fatalf("build catalog: %v", err)
+		}
+		if err := f.Apply(ctx, c); err == nil {
+			t.Error("run catalog did not return an error")
+		}
+		if exists, err := fileExists(ctx, f.System(), dst); err != nil {
+			t.Error("fileExists:", err)
+		} else if exists {
+			t.Errorf("file %q exists; applier should not have created", dst)
+		}
+	})
+}
+
 func linkTest(t *testing.T, ff FixtureFunc) {
 	ctx, f, done := startTest(t, ff, "link")
 	defer done()
@@ -547,6 +689,54 @@ func relinkTest(t *testing.T, ff FixtureFunc) {
 	}
 }
 
+func relativeLinkTest(t *testing.T, ff FixtureFunc) {
+	ctx, f, done := startTest(t, ff, "relativeLink")
+	defer done()
+	root := f.SystemInfo().Root
+	fpath := filepath.Join(root, "foo")
+	dpath := filepath.Join(root, "dir")
+	lpath := filepath.Join(dpath, "link")
+	link := catpogs.SymlinkFile(fpath, lpath)
+	link.Symlink.Relative = true
+	c, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "link",
+				Which:   catalog.Resource_Which_file,
+				File:    link,
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatalf("build catalog: %v", err)
+	}
+	sys := f.System()
+	if err := system.WriteFile(ctx, sys, fpath, []byte("Hello"), 0666); err != nil {
+		t.Fatal("WriteFile:", err)
+	}
+	if err := sys.Mkdir(ctx, dpath, 0777); err != nil {
+		t.Fatal("Mkdir:", err)
+	}
+	// An existing link to the absolute path is retargeted.
+	if err := sys.Symlink(ctx, fpath, lpath); err != nil {
+		t.Fatalf("os.Symlink %s -> %s: %v", lpath, fpath, err)
+	}
+	err = f.Apply(ctx, c)
+	if err != nil {
+		t.Errorf("run catalog: %v", err)
+	}
+
+	want := filepath.Join("..", "foo")
+	if target, err := sys.Readlink(ctx, lpath); err == nil {
+		if target != want {
+			t.Errorf("Readlink(%q) = %q; want %q", lpath, target, want)
+		}
+	} else {
+		t.Errorf("Readlink(%q): %v", lpath, err)
+	}
+}
+
 func skipFailTest(t *testing.T, ff FixtureFunc) {
 	ctx, f, done := startTest(t, ff, "skipFail")
 	defer done()
@@ -610,6 +800,62 @@ func skipFailTest(t *testing.T, ff FixtureFunc) {
 	}
 }
 
+func barrierTest(t *testing.T, ff FixtureFunc) {
+	ctx, f, done := startTest(t, ff, "barrier")
+	defer done()
+	root := f.SystemInfo().Root
+	f1path := filepath.Join(root, "foo")
+	f2path := filepath.Join(root, "bar")
+	canaryPath := filepath.Join(root, "canary")
+	c, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      101,
+				Comment: "file 1",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(f1path, []byte("foo")),
+			},
+			{
+				ID:      200,
+				Comment: "canary file - before the barrier",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(canaryPath, []byte("tweet!")),
+			},
+			{
+				ID:      300,
+				Comment: "barrier",
+				Which:   catalog.Resource_Which_barrier,
+			},
+			{
+				ID:      102,
+				Comment: "file 2 - not dependent on file 1",
+				Which:   catalog.Resource_Which_file,
+				File:    catpogs.PlainFile(f2path, []byte("bar")),
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatalf("build catalog: %v", err)
+	}
+	// Create a directory to cause file 1 to fail.
+	sys := f.System()
+	if err := sys.Mkdir(ctx, f1path, 0777); err != nil {
+		t.Fatal("mkdir:", err)
+	}
+	err = f.Apply(ctx, c)
+	t.Logf("run catalog: %v", err)
+	if err == nil {
+		t.Error("run catalog did not return an error")
+	}
+
+	if exists, err := fileExists(ctx, sys, f2path); exists || err != nil {
+		t.Errorf("fileExists(%q) = %t, %v; false, nil", f2path, exists, err)
+	}
+	if exists, err := fileExists(ctx, sys, canaryPath); !exists || err != nil {
+		t.Errorf("fileExists(%q) = %t, %v; true, nil", canaryPath, exists, err)
+	}
+}
+
 func execTest(t *testing.T, ff FixtureFunc) {
 	ctx, f, done := startTest(t, ff, "exec")
 	defer done()
@@ -754,6 +1000,69 @@ func execUnlessTest(t *testing.T, ff FixtureFunc) {
 	})
 }
 
+func execCreatesTest(t *testing.T, ff FixtureFunc) {
+	run := func(t *testing.T, name string, exists bool, cond bool, want bool) {
+		ctx, f, done := startTest(t, ff, name)
+		defer done()
+		info := f.SystemInfo()
+		fpath := filepath.Join(info.Root, "canary")
+		cpath := filepath.Join(info.Root, "created")
+		if exists {
+			if err := system.WriteFile(ctx, f.System(), cpath, nil, 0666); err != nil {
+				t.Fatal("WriteFile:", err)
+			}
+		}
+		condExe := info.FalsePath
+		if cond {
+			condExe = info.TruePath
+		}
+		c, err := (&catpogs.Catalog{
+			Resources: []*catpogs.Resource{
+				{
+					ID:      42,
+					Comment: "touch canary",
+					Which:   catalog.Resource_Which_exec,
+					Exec: &catpogs.Exec{
+						Command: &catpogs.Command{
+							Which: catalog.Exec_Command_Which_argv,
+							Argv:  []string{info.TouchPath, fpath},
+						},
+						Condition: catpogs.ExecCondition{
+							Which: catalog.Exec_condition_Which_onlyIf,
+							OnlyIf: &catpogs.Command{
+								Which: catalog.Exec_Command_Which_argv,
+								Argv:  []string{condExe},
+							},
+						},
+						Creates: cpath,
+					},
+				},
+			},
+		}).ToCapnp()
+		if err != nil {
+			t.Fatalf("build catalog: %v", err)
+		}
+		err = f.Apply(ctx, c)
+		if err != nil {
+			t.Errorf("run catalog: %v", err)
+		}
+		if exists, err := fileExists(ctx, f.System(), fpath); err != nil {
+			t.Error("fileExists:", err)
+		} else if exists != want {
+			t.Errorf("existence of %q = %t; want %t", fpath, exists, want)
+		}
+	}
+	t.Run("Absent", func(t *testing.T) {
+		run(t, "execCreatesAbsent", false, true, true)
+	})
+	t.Run("Exists", func(t *testing.T) {
+		run(t, "execCreatesExists", true, true, false)
+	})
+	t.Run("AbsentConditionFalse", func(t *testing.T) {
+		run(t, "execCreatesAbsentConditionFalse", false, false, false)
+	})
+}
+
 func execIfDepsChangedTest(t *testing.T, ff FixtureFunc) {
 	const fileName = "config"
 	const fileContent = "Hello"
@@ -836,6 +1145,124 @@ func execIfDepsChangedTest(t *testing.T, ff FixtureFunc) {
 	})
 }
 
+func execCreateWorkingDirectoryTest(t *testing.T, ff FixtureFunc) {
+	ctx, f, done := startTest(t, ff, "execCreateWorkingDirectory")
+	defer done()
+	info := f.SystemInfo()
+	fpath := filepath.Join(info.Root, "canary")
+	wd := filepath.Join(info.Root, "work", "dir")
+	c, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "exec",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which:     catalog.Exec_Command_Which_argv,
+						Argv:      []string{info.TouchPath, fpath},
+						Dir:       wd,
+						CreateDir: true,
+						DirMode:   &catpogs.FileMode{Bits: 0750},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatalf("build catalog: %v", err)
+	}
+	err = f.Apply(ctx, c)
+	if err != nil {
+		t.Errorf("run catalog: %v", err)
+	}
+	if exists, err := fileExists(ctx, f.System(), fpath); err != nil {
+		t.Error("fileExists:", err)
+	} else if !exists {
+		t.Errorf("file %q not created", fpath)
+	}
+	if st, err := f.System().Lstat(ctx, wd); err != nil {
+		t.Error("lstat working directory:", err)
+	} else if !st.IsDir() {
+		t.Errorf("%s is not a directory", wd)
+	} else if perm := st.Mode() & os.ModePerm; perm != 0750 {
+		t.Errorf("%s mode = %v; want %v", wd, perm, os.FileMode(0750))
+	}
+}
+
+func execLookPathTest(t *testing.T, ff FixtureFunc) {
+	ctx, f, done := startTest(t, ff, "execLookPath")
+	defer done()
+	info := f.SystemInfo()
+	fpath := filepath.Join(info.Root, "canary")
+	c, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "exec",
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which:    catalog.Exec_Command_Which_argv,
+						Argv:     []string{filepath.Base(info.TouchPath), fpath},
+						Env:      []catpogs.EnvVar{{Name: "PATH", Value: filepath.Dir(info.TouchPath)}},
+						LookPath: true,
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatalf("build catalog: %v", err)
+	}
+	err = f.Apply(ctx, c)
+	if err != nil {
+		t.Errorf("run catalog: %v", err)
+	}
+	if exists, err := fileExists(ctx, f.System(), fpath); err != nil {
+		t.Error("fileExists:", err)
+	} else if !exists {
+		t.Errorf("file %q not created", fpath)
+	}
+}
+
+func execBatchArgsTest(t *testing.T, ff FixtureFunc) {
+	ctx, f, done := startTest(t, ff, "execBatchArgs")
+	defer done()
+	info := f.SystemInfo()
+	fpath := filepath.Join(info.Root, "canary")
+	e := &catpogs.Exec{
+		Command: &catpogs.Command{
+			Which: catalog.Exec_Command_Which_argv,
+			Argv:  []string{info.TouchPath},
+		},
+	}
+	e.Batch.Key = "touch"
+	e.Batch.Args = []string{fpath}
+	c, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:      42,
+				Comment: "exec",
+				Which:   catalog.Resource_Which_exec,
+				Exec:    e,
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatalf("build catalog: %v", err)
+	}
+	err = f.Apply(ctx, c)
+	if err != nil {
+		t.Errorf("run catalog: %v", err)
+	}
+	if exists, err := fileExists(ctx, f.System(), fpath); err != nil {
+		t.Error("fileExists:", err)
+	} else if !exists {
+		t.Errorf("file %q not created", fpath)
+	}
+}
+
 func fileExists(ctx context.Context, fs system.FS, path string) (bool, error) {
 	_, err := fs.Lstat(ctx, path)
 	if system.IsNotExist(err) {
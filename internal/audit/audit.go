@@ -0,0 +1,206 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit keeps an append-only log of the changes made to a
+// system.  Each line of the log is a JSON object holding an entry and
+// the SHA-256 of the entry's bytes.  Every entry includes the hash of
+// the entry before it, so editing, removing, or reordering entries
+// breaks the chain and is caught by Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// An Entry records a single change.
+type Entry struct {
+	// Seq is the entry's position in the log, starting at 1.
+	Seq int64 `json:"seq"`
+
+	// Prev is the hash of the previous entry, or empty for the first.
+	Prev string `json:"prev,omitempty"`
+
+	Time time.Time `json:"time"`
+	User string    `json:"user,omitempty"`
+	Host string    `json:"host,omitempty"`
+
+	// Op names the change, like "write" or "exec".
+	Op string `json:"op"`
+
+	// Path is the file, registry value, or service that was changed.
+	Path string `json:"path,omitempty"`
+
+	// OldHash and NewHash are the hex-encoded SHA-256 of the content
+	// before and after the change.  OldHash is empty for new content
+	// and NewHash is empty for removed content.
+	OldHash string `json:"old_hash,omitempty"`
+	NewHash string `json:"new_hash,omitempty"`
+
+	// Old and New describe other attributes that were changed, like a
+	// file's mode or owner.
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+
+	// Argv, Dir, and ExitStatus describe a command that was run.
+	// ExitStatus is nil if the command could not be started.
+	Argv       []string `json:"argv,omitempty"`
+	Dir        string   `json:"dir,omitempty"`
+	ExitStatus *int     `json:"exit_status,omitempty"`
+
+	// Error is set if the change failed.
+	Error string `json:"error,omitempty"`
+}
+
+type line struct {
+	Entry json.RawMessage `json:"entry"`
+	Hash  string          `json:"hash"`
+}
+
+// A Log appends entries to an audit log file.  It is safe to use from
+// multiple goroutines.
+type Log struct {
+	// User and Host are recorded in entries that do not set them.
+	User string
+	Host string
+
+	mu   sync.Mutex
+	f    *os.File
+	seq  int64
+	prev string
+
+	// now is time.Now in production.
+	now func() time.Time
+}
+
+// Open opens the audit log at path for appending, creating it if it
+// does not exist.  It returns an error if the existing entries fail
+// verification, since appending to a broken chain would hide the
+// tampering.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %v", err)
+	}
+	seq, last, err := verify(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open audit log %s: %v", path, err)
+	}
+	return &Log{f: f, seq: seq, prev: last, now: time.Now}, nil
+}
+
+// Record appends an entry to the log, filling in its Seq, Prev, and
+// any unset Time, User, or Host.  The entry is synced to disk before
+// Record returns.
+func (l *Log) Record(e *Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = l.now().UTC()
+	}
+	if e.User == "" {
+		e.User = l.User
+	}
+	if e.Host == "" {
+		e.Host = l.Host
+	}
+	e.Seq, e.Prev = l.seq+1, l.prev
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	h := hashEntry(data)
+	out, err := json.Marshal(line{Entry: data, Hash: h})
+	if err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	if _, err := l.f.Write(append(out, '\n')); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+	l.seq, l.prev = e.Seq, h
+	return nil
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("close audit log: %v", err)
+	}
+	return nil
+}
+
+// Verify reads an audit log and checks that each entry's hash matches
+// its content and that the entries form an unbroken chain.  It returns
+// the number of entries in the log.
+func Verify(r io.Reader) (n int64, err error) {
+	n, _, err = verify(r)
+	return n, err
+}
+
+// verify is Verify that also returns the hash of the last entry.
+func verify(r io.Reader) (seq int64, last string, err error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxLine)
+	for s.Scan() {
+		seq++
+		var ln line
+		if err := json.Unmarshal(s.Bytes(), &ln); err != nil {
+			return 0, "", fmt.Errorf("line %d: %v", seq, err)
+		}
+		// Hash the entry as Record wrote it, in case the line was
+		// reformatted.
+		compact := new(bytes.Buffer)
+		if err := json.Compact(compact, ln.Entry); err != nil {
+			return 0, "", fmt.Errorf("line %d: %v", seq, err)
+		}
+		if hashEntry(compact.Bytes()) != ln.Hash {
+			return 0, "", fmt.Errorf("line %d: entry does not match its hash", seq)
+		}
+		var e Entry
+		if err := json.Unmarshal(ln.Entry, &e); err != nil {
+			return 0, "", fmt.Errorf("line %d: %v", seq, err)
+		}
+		if e.Seq != seq {
+			return 0, "", fmt.Errorf("line %d: entry has sequence number %d", seq, e.Seq)
+		}
+		if e.Prev != last {
+			return 0, "", fmt.Errorf("line %d: previous hash does not match line %d", seq, seq-1)
+		}
+		last = ln.Hash
+	}
+	if err := s.Err(); err != nil {
+		return 0, "", err
+	}
+	return seq, last, nil
+}
+
+// maxLine is the longest line that Verify accepts.
+const maxLine = 16 << 20
+
+func hashEntry(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,195 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zombiezen/mcm/internal/system"
+	"github.com/zombiezen/mcm/internal/system/fakesystem"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mcm-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	l.User = "alice"
+	for _, op := range []string{"mkdir", "write"} {
+		if err := l.Record(&Entry{Op: op, Path: "/foo"}); err != nil {
+			t.Fatal("Record:", err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	// Reopening continues the chain.
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal("Open existing:", err)
+	}
+	if err := l.Record(&Entry{Op: "remove", Path: "/foo"}); err != nil {
+		t.Fatal("Record:", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal("Close:", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Verify(bytes.NewReader(data)); err != nil || n != 3 {
+		t.Errorf("Verify = %d, %v; want 3, <nil>", n, err)
+	}
+	entries := readEntries(t, data)
+	if len(entries) != 3 {
+		t.Fatalf("log has %d entries; want 3", len(entries))
+	}
+	if entries[0].User != "alice" || entries[0].Time.IsZero() || entries[0].Prev != "" {
+		t.Errorf("entries[0] = %+v; want user alice, a time, and no previous hash", entries[0])
+	}
+	if entries[2].Seq != 3 || entries[2].Prev == "" {
+		t.Errorf("entries[2] = %+v; want seq 3 with a previous hash", entries[2])
+	}
+
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Edited", bytes.Replace(data, []byte(`"op":"write"`), []byte(`"op":"chmod"`), 1)},
+		{"Removed", bytes.Join([][]byte{lines[0], lines[2]}, nil)},
+		{"Reordered", bytes.Join([][]byte{lines[1], lines[0], lines[2]}, nil)},
+	}
+	for _, test := range tests {
+		if _, err := Verify(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("%s: Verify succeeded", test.name)
+		}
+		if err := ioutil.WriteFile(path, test.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if l, err := Open(path); err == nil {
+			l.Close()
+			t.Errorf("%s: Open succeeded", test.name)
+		}
+	}
+}
+
+func TestSystem(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "mcm-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "audit.log")
+	l, err := Open(logPath)
+	if err != nil {
+		t.Fatal("Open:", err)
+	}
+	defer l.Close()
+
+	fake := new(fakesystem.System)
+	progPath := filepath.Join(fakesystem.Root, "prog")
+	err = fake.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		return 3
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	sys := System{System: fake, Log: l}
+	fooPath := filepath.Join(fakesystem.Root, "foo")
+	if err := system.WriteFile(ctx, sys, fooPath, []byte("Hello"), 0644); err != nil {
+		t.Fatal("WriteFile:", err)
+	}
+	if err := system.WriteFile(ctx, sys, fooPath, []byte("Goodbye"), 0644); err != nil {
+		t.Fatal("WriteFile:", err)
+	}
+	if _, err := system.ReadFile(ctx, sys, fooPath); err != nil {
+		t.Fatal("ReadFile:", err)
+	}
+	if err := sys.Chmod(ctx, fooPath, 0600); err != nil {
+		t.Fatal("Chmod:", err)
+	}
+	if err := sys.Remove(ctx, fooPath); err != nil {
+		t.Fatal("Remove:", err)
+	}
+	if _, err := sys.Run(ctx, &system.Cmd{Path: progPath, Args: []string{progPath, "x"}}); err == nil {
+		t.Error("Run did not return an error")
+	}
+
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := readEntries(t, data)
+	const (
+		helloHash   = "185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969"
+		goodbyeHash = "c015ad6ddaf8bb50689d2d7cbf1539dff6dd84473582a08ed1d15d841f4254f4"
+	)
+	want := []Entry{
+		{Op: "create", Path: fooPath, NewHash: helloHash, New: "0644"},
+		{Op: "write", Path: fooPath, OldHash: helloHash, NewHash: goodbyeHash},
+		{Op: "chmod", Path: fooPath, Old: "0644", New: "0600"},
+		{Op: "remove", Path: fooPath, OldHash: goodbyeHash},
+		{Op: "exec", Argv: []string{progPath, "x"}},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("log has %d entries; want %d:\n%s", len(entries), len(want), data)
+	}
+	for i, e := range entries {
+		w := want[i]
+		if e.Op != w.Op || e.Path != w.Path || e.OldHash != w.OldHash || e.NewHash != w.NewHash || e.Old != w.Old || e.New != w.New || strings.Join(e.Argv, " ") != strings.Join(w.Argv, " ") {
+			t.Errorf("entries[%d] = %+v; want %+v", i, e, w)
+		}
+	}
+	if last := entries[len(entries)-1]; last.ExitStatus == nil || last.Error == "" {
+		t.Errorf("exec entry = %+v; want exit status and error", last)
+	}
+}
+
+func readEntries(t *testing.T, data []byte) []*Entry {
+	var entries []*Entry
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		var ln line
+		if err := json.Unmarshal(s.Bytes(), &ln); err != nil {
+			t.Fatal(err)
+		}
+		e := new(Entry)
+		if err := json.Unmarshal(ln.Entry, e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
@@ -0,0 +1,465 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// System is a system.System that records every change made through it
+// in Log.  Reads are passed through unrecorded.  If a change succeeds
+// but can't be recorded, then the change returns the recording error.
+// The optional system interfaces are forwarded to the underlying
+// system, returning an error if it does not implement them.
+type System struct {
+	system.System
+	Log *Log
+}
+
+// record records e, filling in Error from err.  It returns err, or the
+// recording error if err is nil.
+func (s System) record(e *Entry, err error) error {
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if rerr := s.Log.Record(e); rerr != nil && err == nil {
+		return rerr
+	}
+	return err
+}
+
+// hashFile returns the hex-encoded SHA-256 of a file's content, or empty
+// if path is not a regular file.
+func (s System) hashFile(ctx context.Context, path string) string {
+	info, err := s.System.Lstat(ctx, path)
+	if err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	f, err := s.System.OpenFile(ctx, path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s System) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	err := s.System.Mkdir(ctx, path, mode)
+	return s.record(&Entry{Op: "mkdir", Path: path, New: formatMode(mode)}, err)
+}
+
+func (s System) Remove(ctx context.Context, path string) error {
+	e := &Entry{Op: "remove", Path: path, OldHash: s.hashFile(ctx, path)}
+	return s.record(e, s.System.Remove(ctx, path))
+}
+
+func (s System) Symlink(ctx context.Context, oldname, newname string) error {
+	err := s.System.Symlink(ctx, oldname, newname)
+	return s.record(&Entry{Op: "symlink", Path: newname, New: oldname}, err)
+}
+
+func (s System) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	e := &Entry{Op: "chmod", Path: path, New: formatMode(mode)}
+	if info, err := s.System.Lstat(ctx, path); err == nil {
+		e.Old = formatMode(info.Mode())
+	}
+	return s.record(e, s.System.Chmod(ctx, path, mode))
+}
+
+func (s System) Chown(ctx context.Context, path string, uid system.UID, gid system.GID) error {
+	e := &Entry{Op: "chown", Path: path, New: fmt.Sprintf("%d:%d", uid, gid)}
+	if info, err := s.System.Lstat(ctx, path); err == nil {
+		if oldUID, oldGID, err := s.System.OwnerInfo(info); err == nil {
+			e.Old = fmt.Sprintf("%d:%d", oldUID, oldGID)
+		}
+	}
+	return s.record(e, s.System.Chown(ctx, path, uid, gid))
+}
+
+func (s System) CreateFile(ctx context.Context, path string, mode os.FileMode) (system.FileWriter, error) {
+	w, err := s.System.CreateFile(ctx, path, mode)
+	if err != nil {
+		if !os.IsExist(err) {
+			s.record(&Entry{Op: "create", Path: path, New: formatMode(mode)}, err)
+		}
+		return nil, err
+	}
+	return &createdFile{w: w, sys: s, path: path, mode: mode, hash: sha256.New()}, nil
+}
+
+// createdFile records a CreateFile once it is closed.
+type createdFile struct {
+	w    system.FileWriter
+	sys  System
+	path string
+	mode os.FileMode
+	hash hash.Hash
+}
+
+func (f *createdFile) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.hash.Write(p[:n])
+	return n, err
+}
+
+func (f *createdFile) Close() error {
+	err := f.w.Close()
+	e := &Entry{
+		Op:      "create",
+		Path:    f.path,
+		NewHash: hex.EncodeToString(f.hash.Sum(nil)),
+		New:     formatMode(f.mode),
+	}
+	return f.sys.record(e, err)
+}
+
+func (s System) OpenFile(ctx context.Context, path string) (system.File, error) {
+	f, err := s.System.OpenFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &openedFile{File: f, ctx: ctx, sys: s, path: path}, nil
+}
+
+// openedFile records a write to an existing file once it is closed.
+// The old content is hashed just before the first change.
+type openedFile struct {
+	system.File
+	ctx      context.Context
+	sys      System
+	path     string
+	modified bool
+	oldHash  string
+}
+
+func (f *openedFile) beforeChange() {
+	if !f.modified {
+		f.modified = true
+		f.oldHash = f.sys.hashFile(f.ctx, f.path)
+	}
+}
+
+func (f *openedFile) Write(p []byte) (int, error) {
+	f.beforeChange()
+	return f.File.Write(p)
+}
+
+func (f *openedFile) Truncate(size int64) error {
+	f.beforeChange()
+	return f.File.Truncate(size)
+}
+
+func (f *openedFile) Close() error {
+	err := f.File.Close()
+	if !f.modified {
+		return err
+	}
+	e := &Entry{
+		Op:      "write",
+		Path:    f.path,
+		OldHash: f.oldHash,
+		NewHash: f.sys.hashFile(f.ctx, f.path),
+	}
+	return f.sys.record(e, err)
+}
+
+func (s System) Run(ctx context.Context, cmd *system.Cmd) (output []byte, err error) {
+	output, err = s.System.Run(ctx, cmd)
+	e := &Entry{Op: "exec", Argv: cmd.Args, Dir: cmd.Dir, ExitStatus: exitStatus(err)}
+	if rerr := s.record(e, err); err == nil {
+		err = rerr
+	}
+	return output, err
+}
+
+// exitStatus returns the exit status of a command that returned err
+// from Run, or nil if the command didn't run to completion.
+func exitStatus(err error) *int {
+	var code int
+	switch err := err.(type) {
+	case nil:
+	case *exec.ExitError:
+		if err.ProcessState == nil {
+			code = 1
+			break
+		}
+		ws, ok := err.Sys().(interface {
+			ExitStatus() int
+		})
+		if !ok {
+			return nil
+		}
+		code = ws.ExitStatus()
+	default:
+		return nil
+	}
+	return &code
+}
+
+func (s System) Start(ctx context.Context, cmd *system.Cmd) (system.Process, error) {
+	st, ok := s.System.(system.Starter)
+	if !ok {
+		return nil, errors.New("system cannot start background processes")
+	}
+	p, err := st.Start(ctx, cmd)
+	if rerr := s.record(&Entry{Op: "start", Argv: cmd.Args, Dir: cmd.Dir}, err); err == nil && rerr != nil {
+		p.Kill()
+		return nil, rerr
+	}
+	return p, err
+}
+
+func (s System) Umask(mask os.FileMode) os.FileMode {
+	u, ok := s.System.(system.Umasker)
+	if !ok {
+		return 0
+	}
+	return u.Umask(mask)
+}
+
+func (s System) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, ok := s.System.(system.Dialer)
+	if !ok {
+		return nil, errors.New("system cannot dial addresses")
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// Lock is not recorded, since the lock is released by the end of the
+// run.
+func (s System) Lock(ctx context.Context, path string, mode os.FileMode) (system.FileLock, error) {
+	l, ok := s.System.(system.Locker)
+	if !ok {
+		return nil, errors.New("system cannot lock files")
+	}
+	return l.Lock(ctx, path, mode)
+}
+
+// CloneFile records a successful clone as a write of dst.  A failed
+// clone is not recorded, since the applier writes the file instead.
+func (s System) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	c, ok := s.System.(system.Cloner)
+	if !ok {
+		return errors.New("system cannot clone files")
+	}
+	oldHash := s.hashFile(ctx, dst)
+	if err := c.CloneFile(ctx, src, dst, mode); err != nil {
+		return err
+	}
+	e := &Entry{Op: "write", Path: dst, OldHash: oldHash, NewHash: s.hashFile(ctx, dst)}
+	return s.record(e, nil)
+}
+
+// Rename records a successful rename as a write of newpath, since the
+// file at oldpath is a staging copy that the applier created.
+func (s System) Rename(ctx context.Context, oldpath, newpath string) error {
+	r, ok := s.System.(system.Renamer)
+	if !ok {
+		return errors.New("system cannot rename files")
+	}
+	oldHash := s.hashFile(ctx, newpath)
+	if err := r.Rename(ctx, oldpath, newpath); err != nil {
+		return err
+	}
+	e := &Entry{Op: "write", Path: newpath, OldHash: oldHash, NewHash: s.hashFile(ctx, newpath)}
+	return s.record(e, nil)
+}
+
+func (s System) FileIdentity(info os.FileInfo) (dev, ino uint64, err error) {
+	fi, ok := s.System.(system.FileIdentifier)
+	if !ok {
+		return 0, 0, errors.New("system cannot identify files")
+	}
+	return fi.FileIdentity(info)
+}
+
+func (s System) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	dr, ok := s.System.(system.DirReader)
+	if !ok {
+		return nil, errors.New("system cannot list directories")
+	}
+	return dr.ReadDir(ctx, path)
+}
+
+func (s System) registry() (system.Registry, error) {
+	r, ok := s.System.(system.Registry)
+	if !ok {
+		return nil, errors.New("system has no registry")
+	}
+	return r, nil
+}
+
+func (s System) RegistryKeyExists(ctx context.Context, key string) (bool, error) {
+	r, err := s.registry()
+	if err != nil {
+		return false, err
+	}
+	return r.RegistryKeyExists(ctx, key)
+}
+
+func (s System) CreateRegistryKey(ctx context.Context, key string) error {
+	r, err := s.registry()
+	if err != nil {
+		return err
+	}
+	return s.record(&Entry{Op: "create registry key", Path: key}, r.CreateRegistryKey(ctx, key))
+}
+
+func (s System) DeleteRegistryKey(ctx context.Context, key string) error {
+	r, err := s.registry()
+	if err != nil {
+		return err
+	}
+	return s.record(&Entry{Op: "delete registry key", Path: key}, r.DeleteRegistryKey(ctx, key))
+}
+
+func (s System) RegistryValue(ctx context.Context, key, name string) (system.RegistryValue, error) {
+	r, err := s.registry()
+	if err != nil {
+		return system.RegistryValue{}, err
+	}
+	return r.RegistryValue(ctx, key, name)
+}
+
+func (s System) SetRegistryValue(ctx context.Context, key, name string, val system.RegistryValue) error {
+	r, err := s.registry()
+	if err != nil {
+		return err
+	}
+	e := &Entry{Op: "set registry value", Path: key + `\` + name, NewHash: hashRegistryValue(val)}
+	if old, err := r.RegistryValue(ctx, key, name); err == nil {
+		e.OldHash = hashRegistryValue(old)
+	}
+	return s.record(e, r.SetRegistryValue(ctx, key, name, val))
+}
+
+func (s System) DeleteRegistryValue(ctx context.Context, key, name string) error {
+	r, err := s.registry()
+	if err != nil {
+		return err
+	}
+	e := &Entry{Op: "delete registry value", Path: key + `\` + name}
+	if old, err := r.RegistryValue(ctx, key, name); err == nil {
+		e.OldHash = hashRegistryValue(old)
+	}
+	return s.record(e, r.DeleteRegistryValue(ctx, key, name))
+}
+
+// hashRegistryValue returns the hex-encoded SHA-256 of a registry
+// value's type and data.
+func hashRegistryValue(val system.RegistryValue) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:", val.Type)
+	h.Write(val.Data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s System) services() (system.ServiceManager, error) {
+	sm, ok := s.System.(system.ServiceManager)
+	if !ok {
+		return nil, errors.New("system cannot manage services")
+	}
+	return sm, nil
+}
+
+func (s System) QueryService(ctx context.Context, name string) (*system.ServiceStatus, error) {
+	sm, err := s.services()
+	if err != nil {
+		return nil, err
+	}
+	return sm.QueryService(ctx, name)
+}
+
+func (s System) CreateService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sm, err := s.services()
+	if err != nil {
+		return err
+	}
+	e := &Entry{Op: "create service", Path: name, New: formatServiceConfig(config)}
+	return s.record(e, sm.CreateService(ctx, name, config))
+}
+
+func (s System) ConfigureService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sm, err := s.services()
+	if err != nil {
+		return err
+	}
+	e := &Entry{Op: "configure service", Path: name, New: formatServiceConfig(config)}
+	if old, err := sm.QueryService(ctx, name); err == nil {
+		e.Old = formatServiceConfig(&old.ServiceConfig)
+	}
+	return s.record(e, sm.ConfigureService(ctx, name, config))
+}
+
+func (s System) StartService(ctx context.Context, name string) error {
+	sm, err := s.services()
+	if err != nil {
+		return err
+	}
+	return s.record(&Entry{Op: "start service", Path: name}, sm.StartService(ctx, name))
+}
+
+func (s System) StopService(ctx context.Context, name string) error {
+	sm, err := s.services()
+	if err != nil {
+		return err
+	}
+	return s.record(&Entry{Op: "stop service", Path: name}, sm.StopService(ctx, name))
+}
+
+func formatServiceConfig(config *system.ServiceConfig) string {
+	return fmt.Sprintf("binary=%q display=%q start=%v", config.BinaryPath, config.DisplayName, config.StartType)
+}
+
+// formatMode formats the permission bits of mode in octal, using the
+// Unix values for the setuid, setgid, and sticky bits.
+func formatMode(mode os.FileMode) string {
+	m := uint32(mode & os.ModePerm)
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	return fmt.Sprintf("%04o", m)
+}
+
+var (
+	_ system.Starter        = System{}
+	_ system.Umasker        = System{}
+	_ system.Dialer         = System{}
+	_ system.FileIdentifier = System{}
+	_ system.Renamer        = System{}
+	_ system.Registry       = System{}
+	_ system.ServiceManager = System{}
+)
@@ -0,0 +1,172 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package catcrypt encrypts serialized catalogs so that they can be
+// stored and transferred through untrusted places.
+//
+// An encrypted catalog is the 8-byte header "mcmenc1\n", followed by a
+// 12-byte random nonce, followed by the catalog sealed with AES-256-GCM.
+// The header is authenticated as additional data.
+package catcrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// KeySize is the length of a key in bytes.
+const KeySize = 32
+
+// A Key is an AES-256 key.
+type Key [KeySize]byte
+
+const header = "mcmenc1\n"
+
+// IsEncrypted reports whether data is an encrypted catalog.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(header))
+}
+
+// Encrypt seals a serialized catalog with key.
+func Encrypt(key *Key, catalog []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(header)+aead.NonceSize(), len(header)+aead.NonceSize()+len(catalog)+aead.Overhead())
+	copy(out, header)
+	nonce := out[len(header):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("encrypt catalog: %v", err)
+	}
+	return aead.Seal(out, nonce, catalog, []byte(header)), nil
+}
+
+// Decrypt opens an encrypted catalog with key.
+func Decrypt(key *Key, data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, errors.New("decrypt catalog: not encrypted")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(header):]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("decrypt catalog: truncated")
+	}
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	catalog, err := aead.Open(nil, nonce, sealed, []byte(header))
+	if err != nil {
+		return nil, errors.New("decrypt catalog: wrong key or corrupted data")
+	}
+	return catalog, nil
+}
+
+func newAEAD(key *Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateKey returns a new random key.
+func GenerateKey() (*Key, error) {
+	key := new(Key)
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, fmt.Errorf("generate key: %v", err)
+	}
+	return key, nil
+}
+
+// String returns the key encoded in base64, the format read by ParseKey.
+func (key *Key) String() string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// ParseKey decodes a base64-encoded key.  Surrounding whitespace is
+// ignored.
+func ParseKey(data []byte) (*Key, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("parse key: %v", err)
+	}
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("parse key: wrong size %d", len(raw))
+	}
+	key := new(Key)
+	copy(key[:], raw)
+	return key, nil
+}
+
+// ReadKeyFile reads a base64-encoded key from a file.
+func ReadKeyFile(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %v", err)
+	}
+	key, err := ParseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("read key %s: %v", path, err)
+	}
+	return key, nil
+}
+
+// KeyFromCommand runs a shell command and parses its standard output
+// as a base64-encoded key.  This allows the key to be obtained from a
+// key management service's command-line client.
+func KeyFromCommand(ctx context.Context, command string) (*Key, error) {
+	c := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	stderr := new(bytes.Buffer)
+	c.Stderr = stderr
+	out, err := c.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("key command: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("key command: %v", err)
+	}
+	key, err := ParseKey(out)
+	if err != nil {
+		return nil, fmt.Errorf("key command: %v", err)
+	}
+	return key, nil
+}
+
+// LoadKey obtains a key from a file or a command, whichever is
+// non-empty.  It returns nil if both are empty, and an error if both
+// are given.
+func LoadKey(ctx context.Context, path, command string) (*Key, error) {
+	switch {
+	case path != "" && command != "":
+		return nil, errors.New("both key file and key command given")
+	case path != "":
+		return ReadKeyFile(path)
+	case command != "":
+		return KeyFromCommand(ctx, command)
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catcrypt
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := []byte("not really a catalog")
+	enc, err := Encrypt(key, catalog)
+	if err != nil {
+		t.Fatal("Encrypt:", err)
+	}
+	if !IsEncrypted(enc) {
+		t.Error("IsEncrypted(Encrypt(...)) = false")
+	}
+	if IsEncrypted(catalog) {
+		t.Error("IsEncrypted(plaintext) = true")
+	}
+	if bytes.Contains(enc, catalog) {
+		t.Error("encrypted catalog contains plaintext")
+	}
+	dec, err := Decrypt(key, enc)
+	if err != nil {
+		t.Fatal("Decrypt:", err)
+	}
+	if !bytes.Equal(dec, catalog) {
+		t.Errorf("Decrypt(Encrypt(%q)) = %q", catalog, dec)
+	}
+
+	otherKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(otherKey, enc); err == nil {
+		t.Error("Decrypt with wrong key succeeded")
+	}
+	enc[len(enc)-1] ^= 1
+	if _, err := Decrypt(key, enc); err == nil {
+		t.Error("Decrypt of corrupted data succeeded")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseKey([]byte(" " + key.String() + "\n"))
+	if err != nil {
+		t.Fatal("ParseKey:", err)
+	}
+	if *parsed != *key {
+		t.Errorf("ParseKey(%q) = %v", key.String(), parsed)
+	}
+	if _, err := ParseKey([]byte("c2hvcnQ=")); err == nil {
+		t.Error("ParseKey of short key succeeded")
+	}
+}
+
+func TestKeyFromCommand(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadKey(context.Background(), "", "echo "+key.String())
+	if err != nil {
+		t.Fatal("LoadKey:", err)
+	}
+	if *got != *key {
+		t.Errorf("LoadKey = %v; want %v", got, key)
+	}
+	if _, err := LoadKey(context.Background(), "", "exit 1"); err == nil {
+		t.Error("LoadKey with failing command succeeded")
+	}
+	if got, err := LoadKey(context.Background(), "", ""); got != nil || err != nil {
+		t.Errorf("LoadKey(\"\", \"\") = %v, %v; want <nil>, <nil>", got, err)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package catid derives stable resource IDs from names.
+//
+// The ID of a name in a namespace is the first 8 bytes of
+//
+//	SHA-1("mcm-luacat ID: " + namespace + "\x00" + name)
+//
+// interpreted as a little-endian integer, with the lowest bit set so
+// that the ID is never zero.  In the default (empty) namespace, the NUL
+// separator is omitted, so the ID of a name is the same as mcm.hash in
+// mcm-luacat.
+package catid
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const prefix = "mcm-luacat ID: "
+
+// Hash returns the ID for a name in the default namespace.
+func Hash(name string) uint64 {
+	return NamespacedHash("", name)
+}
+
+// NamespacedHash returns the ID for a name in a namespace.
+func NamespacedHash(namespace, name string) uint64 {
+	h := sha1.New()
+	h.Write([]byte(prefix))
+	if namespace != "" {
+		h.Write([]byte(namespace))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(name))
+	sum := h.Sum(nil)
+	return binary.LittleEndian.Uint64(sum) | 1
+}
+
+// A Name identifies a resource within a namespace.
+type Name struct {
+	Namespace string
+	Name      string
+}
+
+// String returns the name in the form "namespace/name", or just the
+// name if it is in the default namespace.
+func (n Name) String() string {
+	if n.Namespace == "" {
+		return n.Name
+	}
+	return n.Namespace + "/" + n.Name
+}
+
+// ID returns the hash of the name.
+func (n Name) ID() uint64 {
+	return NamespacedHash(n.Namespace, n.Name)
+}
+
+// An Assigner hands out IDs for names, detecting when two different
+// names hash to the same ID.  The zero value is an empty Assigner.
+type Assigner struct {
+	names map[uint64]Name
+}
+
+// ID returns the ID for a name in a namespace.  Asking for the same
+// name more than once returns the same ID.  It returns an error if the
+// name is invalid or collides with a different name given earlier.
+func (a *Assigner) ID(namespace, name string) (uint64, error) {
+	n := Name{Namespace: namespace, Name: name}
+	if strings.IndexByte(namespace, 0) != -1 || strings.IndexByte(name, 0) != -1 {
+		return 0, fmt.Errorf("resource name %q contains a NUL byte", n.String())
+	}
+	id := n.ID()
+	if prev, ok := a.names[id]; ok {
+		if prev != n {
+			return 0, &CollisionError{ID: id, Names: [2]Name{prev, n}}
+		}
+		return id, nil
+	}
+	if a.names == nil {
+		a.names = make(map[uint64]Name)
+	}
+	a.names[id] = n
+	return id, nil
+}
+
+// Lookup returns the name that was assigned id.
+func (a *Assigner) Lookup(id uint64) (Name, bool) {
+	n, ok := a.names[id]
+	return n, ok
+}
+
+// CollisionError is returned by Assigner.ID when two names hash to the
+// same ID.
+type CollisionError struct {
+	ID    uint64
+	Names [2]Name
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("ID collision: %q and %q both hash to %d", e.Names[0].String(), e.Names[1].String(), e.ID)
+}
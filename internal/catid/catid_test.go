@@ -0,0 +1,77 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package catid
+
+import (
+	"testing"
+)
+
+func TestHash(t *testing.T) {
+	// These must match the luacat test suite.
+	tests := []struct {
+		namespace, name string
+		id              uint64
+	}{
+		{"", "hello", 0x20e102f0f9e2b11d},
+		{"", "xyzzy!", 0xd96f419065c49db1},
+		{"", "apt-get update", 0x3d784cfc26097123},
+		{"web", "nginx", 0x159ea4a5f1db866b},
+	}
+	for _, test := range tests {
+		if id := NamespacedHash(test.namespace, test.name); id != test.id {
+			t.Errorf("NamespacedHash(%q, %q) = %#x; want %#x", test.namespace, test.name, id, test.id)
+		}
+	}
+	if Hash("hello") != NamespacedHash("", "hello") {
+		t.Error("Hash(\"hello\") != NamespacedHash(\"\", \"hello\")")
+	}
+	if NamespacedHash("web", "hello") == Hash("hello") {
+		t.Error("NamespacedHash(\"web\", \"hello\") == Hash(\"hello\")")
+	}
+}
+
+func TestAssigner(t *testing.T) {
+	var a Assigner
+	id1, err := a.ID("web", "nginx")
+	if err != nil {
+		t.Fatal("a.ID(\"web\", \"nginx\"):", err)
+	}
+	id2, err := a.ID("web", "nginx")
+	if err != nil {
+		t.Fatal("second a.ID(\"web\", \"nginx\"):", err)
+	}
+	if id1 != id2 {
+		t.Errorf("a.ID(\"web\", \"nginx\") = %#x, then %#x", id1, id2)
+	}
+	if n, ok := a.Lookup(id1); !ok || n != (Name{"web", "nginx"}) {
+		t.Errorf("a.Lookup(%#x) = %v, %t; want web/nginx, true", id1, n, ok)
+	}
+	if _, err := a.ID("", "nul\x00name"); err == nil {
+		t.Error("a.ID(\"\", \"nul\\x00name\") succeeded; want error")
+	}
+}
+
+func TestAssignerCollision(t *testing.T) {
+	// Collisions can't be found by hand, so force one.
+	a := Assigner{names: map[uint64]Name{Hash("foo"): {Name: "bar"}}}
+	_, err := a.ID("", "foo")
+	cerr, ok := err.(*CollisionError)
+	if !ok {
+		t.Fatalf("a.ID(\"\", \"foo\") error = %v; want *CollisionError", err)
+	}
+	if cerr.ID != Hash("foo") || cerr.Names != [2]Name{{Name: "bar"}, {Name: "foo"}} {
+		t.Errorf("collision = %+v", cerr)
+	}
+}
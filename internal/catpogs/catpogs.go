@@ -17,16 +17,54 @@
 package catpogs
 
 import (
+	"fmt"
+
 	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catid"
 	"github.com/zombiezen/mcm/third_party/golang/capnproto"
 	"github.com/zombiezen/mcm/third_party/golang/capnproto/pogs"
 )
 
 type Catalog struct {
-	Resources []*Resource
+	Resources     []*Resource
+	Metadata      *Metadata
+	Preconditions []*Precondition
+	Defaults      *Defaults
+}
+
+type Defaults struct {
+	FileMode      *FileMode
+	DirectoryMode *FileMode
+	Env           []EnvVar `capnp:"environment"`
+}
+
+type Metadata struct {
+	Generator        string
+	GeneratorVersion string
+	SourceRepo       string
+	SourceCommit     string
+	BuildTime        int64
+	Author           string
+}
+
+type Precondition struct {
+	Which       catalog.Precondition_Which
+	MinDiskFree struct {
+		Path  string
+		Bytes uint64
+	}
+	Binary           string
+	MinKernelVersion string
+	Privileged       bool
 }
 
+// ToCapnp builds a Cap'n Proto catalog from c, resolving resource
+// names first (see Resolve).
 func (c *Catalog) ToCapnp() (catalog.Catalog, error) {
+	c, err := c.Resolve()
+	if err != nil {
+		return catalog.Catalog{}, err
+	}
 	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
 	if err != nil {
 		return catalog.Catalog{}, err
@@ -39,14 +77,84 @@ func (c *Catalog) ToCapnp() (catalog.Catalog, error) {
 	return root, err
 }
 
+// Resolve returns a copy of c where resources with a name but no ID
+// are assigned the name's catid.Hash and names in DepNames are
+// appended to Deps.  It returns an error if a name is used twice or a
+// dependency names a resource not in the catalog.
+func (c *Catalog) Resolve() (*Catalog, error) {
+	ids := make(map[string]uint64)
+	var a catid.Assigner
+	out := &Catalog{Resources: make([]*Resource, len(c.Resources)), Metadata: c.Metadata, Preconditions: c.Preconditions}
+	for i, r := range c.Resources {
+		rr := new(Resource)
+		*rr = *r
+		out.Resources[i] = rr
+		if r.Name == "" {
+			continue
+		}
+		if _, dup := ids[r.Name]; dup {
+			return nil, fmt.Errorf("resource name %q used more than once", r.Name)
+		}
+		if rr.ID == 0 {
+			id, err := a.ID("", r.Name)
+			if err != nil {
+				return nil, err
+			}
+			rr.ID = id
+		}
+		ids[r.Name] = rr.ID
+	}
+	for _, r := range out.Resources {
+		if len(r.DepNames) == 0 {
+			continue
+		}
+		deps := make([]uint64, len(r.Deps), len(r.Deps)+len(r.DepNames))
+		copy(deps, r.Deps)
+		for _, name := range r.DepNames {
+			id, ok := ids[name]
+			if !ok {
+				return nil, fmt.Errorf("resource id=%d depends on unknown name %q", r.ID, name)
+			}
+			deps = append(deps, id)
+		}
+		r.Deps, r.DepNames = deps, nil
+	}
+	return out, nil
+}
+
 type Resource struct {
 	ID      uint64 `capnp:"id"`
+	Name    string
 	Comment string
 	Deps    []uint64 `capnp:"dependencies"`
+	Tags    []string
+
+	Deprecated string
+	Replaces   []uint64
+	Suppress   []string
+	Owner      string
+	DocURL     string `capnp:"docUrl"`
+	Disabled   bool
 
-	Which catalog.Resource_Which
-	File  *File
-	Exec  *Exec
+	// DepNames are the names of additional dependencies, resolved to
+	// IDs by Catalog.Resolve.
+	DepNames []string `capnp:"-"`
+
+	Which         catalog.Resource_Which
+	File          *File
+	Exec          *Exec
+	HealthCheck   *HealthCheck
+	RegistryKey   *RegistryKey
+	RegistryValue *RegistryValue
+	Service       *Service
+	LaunchdJob    *LaunchdJob
+	UserDefault   *UserDefault
+	PackageRepo   *PackageRepo
+	Alternative   *Alternative
+	Reboot        *Reboot
+	Assert        *Assert
+	FileGroup     *FileGroup
+	Variant       *Variant
 }
 
 type File struct {
@@ -54,15 +162,24 @@ type File struct {
 
 	Which catalog.File_Which
 	Plain struct {
-		Content []byte
-		Mode    *FileMode
+		Content           []byte
+		ContentURL        string `capnp:"contentUrl"`
+		ContentPath       string
+		ContentFromOutput uint64
+		Mode              *FileMode
+		OnlyIfExists      bool
+		CreateOnly        bool
+		Verify            *Command
 	}
 	Directory struct {
-		Mode *FileMode
+		Mode         *FileMode
+		MaxAgeMillis uint64
 	}
 	Symlink struct {
-		Target string
+		Target   string
+		Relative bool
 	}
+	CreateParents bool
 }
 
 func PlainFile(path string, content []byte) *File {
@@ -138,6 +255,22 @@ func GroupNameRef(name string) *GroupRef {
 type Exec struct {
 	Command   *Command
 	Condition ExecCondition
+	Batch     struct {
+		Key  string
+		Args []string
+	}
+	Supervise *Supervise
+	Creates   string
+	Expect    struct {
+		OutputPattern string
+		ExitCodes     []uint32
+	}
+}
+
+type Supervise struct {
+	ReadyCommand       *Command
+	ReadyAddress       string
+	ReadyTimeoutMillis uint32
 }
 
 type ExecCondition struct {
@@ -146,6 +279,146 @@ type ExecCondition struct {
 	Unless        *Command
 	FileAbsent    string
 	IfDepsChanged []uint64
+	Healthy       *HealthCheck
+	Until         *Until
+}
+
+type Until struct {
+	Which          catalog.Exec_Until_Which
+	Command        *Command
+	FileExists     string
+	IntervalMillis uint32
+	TimeoutMillis  uint32
+}
+
+type HealthCheck struct {
+	Which         catalog.HealthCheck_Which
+	TCPAddress    string `capnp:"tcpAddress"`
+	HTTPURL       string `capnp:"httpUrl"`
+	TimeoutMillis uint32
+	BackoffMillis uint32
+}
+
+type RegistryKey struct {
+	Path  string
+	Which catalog.RegistryKey_Which
+}
+
+type RegistryValue struct {
+	Key  string
+	Name string
+
+	Which    catalog.RegistryValue_Which
+	Sz       string
+	ExpandSz string
+	MultiSz  []string
+	Dword    uint32
+	Qword    uint64
+	Binary   []byte
+}
+
+type Service struct {
+	Name          string
+	BinaryPath    string
+	DisplayName   string
+	StartType     catalog.Service_StartType
+	State         catalog.Service_State
+	TimeoutMillis uint32
+}
+
+type LaunchdJob struct {
+	Label               string
+	PlistPath           string
+	Domain              string
+	Which               catalog.LaunchdJob_Which
+	Enabled             catalog.LaunchdJob_Enabled
+	ReloadIfDepsChanged bool
+}
+
+type UserDefault struct {
+	Domain      string
+	Key         string
+	CurrentHost bool
+
+	Which   catalog.UserDefault_Which
+	Text    string
+	Integer int64
+	Real    float64
+	Boolean bool
+}
+
+type PackageRepo struct {
+	Name   string
+	Absent bool
+
+	Which catalog.PackageRepo_Which
+	Apt   *AptRepo
+	Yum   *YumRepo
+}
+
+type AptRepo struct {
+	URI           string `capnp:"uri"`
+	Suite         string
+	Components    []string
+	Architectures []string
+	Source        bool
+	SigningKey    []byte
+}
+
+type YumRepo struct {
+	Description string
+	BaseURL     string `capnp:"baseUrl"`
+	Disabled    bool
+	GPGKey      []byte `capnp:"gpgKey"`
+}
+
+type Alternative struct {
+	Name     string
+	Link     string
+	Path     string
+	Priority int32
+	Selected bool
+	Absent   bool
+}
+
+type Reboot struct {
+	TriggerPaths  []string
+	IfDepsChanged []uint64
+	DelaySeconds  uint32
+	Message       string
+}
+
+type FileGroup struct {
+	Files    []*File
+	Validate *Command
+}
+
+type Variant struct {
+	Cases []*VariantCase
+}
+
+type VariantCase struct {
+	When     []*VariantSelector
+	Resource *Resource
+}
+
+type VariantSelector struct {
+	Variable string
+	Values   []string
+}
+
+type Assert struct {
+	Which      catalog.Assert_Which
+	FileExists string
+	FileHash   *AssertFileHash
+	Command    *Command
+	TCPAddress string `capnp:"tcpAddress"`
+	Message    string
+}
+
+type AssertFileHash struct {
+	Path   string
+	SHA256 string `capnp:"sha256"`
 }
 
 type Command struct {
@@ -153,10 +426,27 @@ type Command struct {
 	Argv  []string
 	Bash  string
 
-	Env []EnvVar `capnp:"environment"`
-	Dir string   `capnp:"workingDirectory"`
+	Env       []EnvVar  `capnp:"environment"`
+	Dir       string    `capnp:"workingDirectory"`
+	CreateDir bool      `capnp:"createWorkingDirectory"`
+	DirMode   *FileMode `capnp:"workingDirectoryMode"`
+	LookPath  bool
+	Expand    bool
+
+	Nice        int8
+	IOClass     catalog.Exec_Command_IoClass `capnp:"ioClass"`
+	IOLevel     uint8                        `capnp:"ioLevel"`
+	OOMScoreAdj int16                        `capnp:"oomScoreAdj"`
 }
 
 type EnvVar struct {
 	Name, Value string
+	Secret      *Secret
+}
+
+type Secret struct {
+	Which             catalog.Exec_Command_Secret_Which
+	SystemdCredential string
+	Keyring           string
+	File              string
 }
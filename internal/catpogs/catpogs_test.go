@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catid"
 )
 
 func TestNoContentFile(t *testing.T) {
@@ -56,3 +57,44 @@ func TestNoContentFile(t *testing.T) {
 		t.Fatal("resources[0].file.content is not null")
 	}
 }
+
+func TestResolve(t *testing.T) {
+	c, err := (&Catalog{
+		Resources: []*Resource{
+			{Name: "first", Which: catalog.Resource_Which_noop},
+			{ID: 42, Name: "second", Which: catalog.Resource_Which_noop},
+			{ID: 7, Deps: []uint64{42}, DepNames: []string{"first"}, Which: catalog.Resource_Which_noop},
+		},
+	}).Resolve()
+	if err != nil {
+		t.Fatal("Resolve:", err)
+	}
+	if id := c.Resources[0].ID; id != catid.Hash("first") {
+		t.Errorf("resources[0].ID = %#x; want catid.Hash(\"first\") = %#x", id, catid.Hash("first"))
+	}
+	if id := c.Resources[1].ID; id != 42 {
+		t.Errorf("resources[1].ID = %d; want 42", id)
+	}
+	deps := c.Resources[2].Deps
+	if len(deps) != 2 || deps[0] != 42 || deps[1] != catid.Hash("first") {
+		t.Errorf("resources[2].Deps = %v; want [42 %d]", deps, catid.Hash("first"))
+	}
+
+	_, err = (&Catalog{
+		Resources: []*Resource{
+			{ID: 1, DepNames: []string{"missing"}, Which: catalog.Resource_Which_noop},
+		},
+	}).Resolve()
+	if err == nil {
+		t.Error("Resolve with unknown dependency name succeeded")
+	}
+	_, err = (&Catalog{
+		Resources: []*Resource{
+			{Name: "dup", Which: catalog.Resource_Which_noop},
+			{ID: 2, Name: "dup", Which: catalog.Resource_Which_noop},
+		},
+	}).Resolve()
+	if err == nil {
+		t.Error("Resolve with duplicate names succeeded")
+	}
+}
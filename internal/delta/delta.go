@@ -0,0 +1,223 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package delta computes and applies binary deltas between two versions
+// of a file, so that a client that has the old version only needs to
+// download what changed.
+//
+// A delta is the magic string "MCMDELTA", the SHA-256 of the old and
+// new versions, the new version's length as a uvarint, and then a
+// sequence of operations that build the new version:
+//
+//	'c' OFFSET LENGTH   copy LENGTH bytes of the old version at OFFSET
+//	'i' LENGTH DATA     insert LENGTH bytes of DATA
+//
+// OFFSET and LENGTH are uvarints.  Matches are found by indexing the
+// old version in fixed-size blocks and scanning the new version with a
+// rolling hash, as in rsync, so content that moves is still copied.
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encoding is the name of the delta format in the A-IM and IM headers
+// of HTTP delta encoding (RFC 3229).
+const Encoding = "mcm-delta"
+
+const magic = "MCMDELTA"
+
+const (
+	opCopy   = 'c'
+	opInsert = 'i'
+)
+
+// blockSize is the length of the old version's indexed blocks.  Changes
+// that are closer together than this are sent as one insert.
+const blockSize = 32
+
+// hashBase is the multiplier of the rolling hash.
+const hashBase = 16777619
+
+// Diff returns a delta that transforms old into new.
+func Diff(old, new []byte) []byte {
+	oldSum, newSum := sha256.Sum256(old), sha256.Sum256(new)
+	var d encoder
+	d.buf.WriteString(magic)
+	d.buf.Write(oldSum[:])
+	d.buf.Write(newSum[:])
+	d.uvarint(uint64(len(new)))
+
+	index := indexBlocks(old)
+	var pow uint32 = 1
+	for i := 1; i < blockSize; i++ {
+		pow *= hashBase
+	}
+	lit := 0 // start of the pending insert
+	i := 0
+	var h uint32
+	if len(new) >= blockSize {
+		h = hashBlock(new[:blockSize])
+	}
+	for i+blockSize <= len(new) {
+		off, ok := index[h]
+		if ok && bytes.Equal(old[off:off+blockSize], new[i:i+blockSize]) {
+			// Extend the match backward into the pending insert and
+			// then forward as far as it goes.
+			start := i
+			for start > lit && off > 0 && old[off-1] == new[start-1] {
+				start--
+				off--
+			}
+			n := i - start + blockSize
+			for off+n < len(old) && start+n < len(new) && old[off+n] == new[start+n] {
+				n++
+			}
+			d.insert(new[lit:start])
+			d.copy(off, n)
+			i = start + n
+			lit = i
+			if i+blockSize <= len(new) {
+				h = hashBlock(new[i : i+blockSize])
+			}
+			continue
+		}
+		if i+blockSize < len(new) {
+			h = (h-uint32(new[i])*pow)*hashBase + uint32(new[i+blockSize])
+		}
+		i++
+	}
+	d.insert(new[lit:])
+	return d.buf.Bytes()
+}
+
+// indexBlocks maps the rolling hash of each aligned block of old to the
+// block's offset.  If blocks collide, then the first is kept.
+func indexBlocks(old []byte) map[uint32]int {
+	index := make(map[uint32]int, len(old)/blockSize)
+	for off := 0; off+blockSize <= len(old); off += blockSize {
+		h := hashBlock(old[off : off+blockSize])
+		if _, dup := index[h]; !dup {
+			index[h] = off
+		}
+	}
+	return index
+}
+
+func hashBlock(b []byte) uint32 {
+	var h uint32
+	for _, c := range b {
+		h = h*hashBase + uint32(c)
+	}
+	return h
+}
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uvarint(x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	e.buf.Write(b[:n])
+}
+
+func (e *encoder) copy(off, n int) {
+	e.buf.WriteByte(opCopy)
+	e.uvarint(uint64(off))
+	e.uvarint(uint64(n))
+}
+
+func (e *encoder) insert(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	e.buf.WriteByte(opInsert)
+	e.uvarint(uint64(len(data)))
+	e.buf.Write(data)
+}
+
+// Patch applies a delta from Diff to old and returns the new version.
+// It returns an error if the delta was not made from old or if the
+// result does not match the delta's checksum.
+func Patch(old, delta []byte) ([]byte, error) {
+	if !bytes.HasPrefix(delta, []byte(magic)) {
+		return nil, errors.New("delta: not a delta")
+	}
+	r := bytes.NewReader(delta[len(magic):])
+	var oldSum, newSum [sha256.Size]byte
+	if _, err := io.ReadFull(r, oldSum[:]); err != nil {
+		return nil, errors.New("delta: truncated header")
+	}
+	if _, err := io.ReadFull(r, newSum[:]); err != nil {
+		return nil, errors.New("delta: truncated header")
+	}
+	if sha256.Sum256(old) != oldSum {
+		return nil, errors.New("delta: made from a different version")
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errors.New("delta: truncated header")
+	}
+	// Don't trust the size for more memory than the inputs could
+	// plausibly need.
+	capacity := size
+	if max := uint64(len(old) + len(delta)); capacity > max {
+		capacity = max
+	}
+	out := make([]byte, 0, int(capacity))
+	for uint64(len(out)) < size {
+		op, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("delta: truncated")
+		}
+		switch op {
+		case opCopy:
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil {
+				return nil, errors.New("delta: truncated")
+			}
+			if off > uint64(len(old)) || n > uint64(len(old))-off || n > size-uint64(len(out)) {
+				return nil, fmt.Errorf("delta: copy of %d bytes at %d out of range", n, off)
+			}
+			out = append(out, old[off:off+n]...)
+		case opInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, errors.New("delta: truncated")
+			}
+			if n > uint64(r.Len()) || n > size-uint64(len(out)) {
+				return nil, fmt.Errorf("delta: insert of %d bytes out of range", n)
+			}
+			start := len(out)
+			out = append(out, make([]byte, int(n))...)
+			r.Read(out[start:])
+		default:
+			return nil, fmt.Errorf("delta: unknown operation %q", op)
+		}
+	}
+	if r.Len() > 0 {
+		return nil, errors.New("delta: trailing data")
+	}
+	if sha256.Sum256(out) != newSum {
+		return nil, errors.New("delta: result does not match checksum")
+	}
+	return out, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	base := random(4096)
+	edited := append([]byte(nil), base...)
+	copy(edited[1000:], "hello, world")
+	tests := []struct {
+		name     string
+		old, new []byte
+	}{
+		{"Empty", nil, nil},
+		{"FromEmpty", nil, []byte("hello")},
+		{"ToEmpty", base, nil},
+		{"Same", base, base},
+		{"Short", []byte("abc"), []byte("abd")},
+		{"Edit", base, edited},
+		{"Append", base, append(append([]byte(nil), base...), "more"...)},
+		{"Prepend", base, append([]byte("more"), base...)},
+		{"Move", base, append(append([]byte(nil), base[2048:]...), base[:2048]...)},
+		{"Repeat", base[:100], bytes.Repeat(base[:100], 10)},
+		{"Unrelated", base, random(4096)},
+	}
+	for _, test := range tests {
+		d := Diff(test.old, test.new)
+		got, err := Patch(test.old, d)
+		if err != nil {
+			t.Errorf("%s: Patch(old, Diff(old, new)): %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(got, test.new) {
+			t.Errorf("%s: Patch(old, Diff(old, new)) = %d bytes; want %d bytes", test.name, len(got), len(test.new))
+		}
+	}
+}
+
+func TestDiffSize(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	old := make([]byte, 1<<16)
+	rng.Read(old)
+	new := append([]byte(nil), old...)
+	copy(new[30000:], "hello, world")
+	new = append(new[:50000], append([]byte("inserted"), new[50000:]...)...)
+	d := Diff(old, new)
+	if len(d) > 512 {
+		t.Errorf("len(Diff(old, new)) = %d; want <= 512 for two small edits", len(d))
+	}
+}
+
+func TestPatchErrors(t *testing.T) {
+	old := bytes.Repeat([]byte("0123456789"), 100)
+	new := append([]byte("start"), old...)
+	d := Diff(old, new)
+	if _, err := Patch(append([]byte("x"), old...), d); err == nil {
+		t.Error("Patch with a different old version did not return an error")
+	}
+	if _, err := Patch(old, d[:len(d)-1]); err == nil {
+		t.Error("Patch with a truncated delta did not return an error")
+	}
+	if _, err := Patch(old, append(d[:len(d):len(d)], 0)); err == nil {
+		t.Error("Patch with trailing data did not return an error")
+	}
+	if _, err := Patch(old, new); err == nil {
+		t.Error("Patch with a non-delta did not return an error")
+	}
+	corrupt := append([]byte(nil), d...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if _, err := Patch(old, corrupt); err == nil {
+		t.Error("Patch with a corrupted delta did not return an error")
+	}
+}
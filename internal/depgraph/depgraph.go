@@ -20,13 +20,16 @@ import (
 	"fmt"
 
 	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
 )
 
 // A Graph schedules work for a DAG of resources.
 type Graph struct {
-	res   catalog.Resource_List
-	deps  map[uint64][]uint64
-	index map[uint64]int
+	res      catalog.Resource_List
+	deps     map[uint64][]uint64
+	index    map[uint64]int
+	implicit map[uint64][]uint64
+	sources  map[uint64]bool
 
 	// Mutable state
 	ready  []uint64
@@ -34,17 +37,29 @@ type Graph struct {
 }
 
 // New builds a graph from a list of dependencies or returns an error
-// if the dependency information contains inconsistencies.
+// if the dependency information contains inconsistencies.  Barrier
+// resources add dependencies between the resources before and after
+// them in the list, and a file that takes its content from an exec
+// resource's output depends on the exec resource.
 func New(res catalog.Resource_List) (*Graph, error) {
 	n := res.Len()
 	g := &Graph{
-		res:    res,
-		deps:   make(map[uint64][]uint64, n),
-		index:  make(map[uint64]int, n),
-		queued: make(map[uint64]int, n),
+		res:      res,
+		deps:     make(map[uint64][]uint64, n),
+		index:    make(map[uint64]int, n),
+		implicit: make(map[uint64][]uint64),
+		sources:  make(map[uint64]bool),
+		queued:   make(map[uint64]int, n),
 	}
+	// rank orders the phases that barriers divide the list into.  Each
+	// barrier is ranked between the phase before it and the one after.
+	rank := make(map[uint64]int, n)
+	var barrier uint64
+	var phase []uint64
+	nbarriers := 0
 	for i := 0; i < n; i++ {
-		id := res.At(i).ID()
+		r := res.At(i)
+		id := r.ID()
 		if id == 0 {
 			return nil, errors.New("build dependency graph: encountered resource with ID=0")
 		}
@@ -52,18 +67,44 @@ func New(res catalog.Resource_List) (*Graph, error) {
 		if _, ok := g.deps[id]; !ok {
 			g.deps[id] = nil
 		}
-		deps, err := res.At(i).Dependencies()
+		deps, err := r.Dependencies()
 		if err != nil {
 			return nil, fmt.Errorf("build dependency graph: reading dependency list of resource ID=%d: %v", id, err)
 		}
-		if ndeps := deps.Len(); ndeps == 0 {
-			g.ready = append(g.ready, id)
+		var implicit []uint64
+		if r.Which() == catalog.Resource_Which_barrier {
+			implicit = phase
+			if len(implicit) == 0 && barrier != 0 {
+				implicit = []uint64{barrier}
+			}
+			rank[id] = 2*nbarriers + 1
+			barrier, phase = id, nil
+			nbarriers++
 		} else {
-			g.queued[id] = deps.Len()
-			for j := 0; j < ndeps; j++ {
-				d := deps.At(j)
-				g.deps[d] = append(g.deps[d], id)
+			if barrier != 0 {
+				implicit = []uint64{barrier}
 			}
+			rank[id] = 2 * nbarriers
+			phase = append(phase, id)
+		}
+		if src := outputSource(r); src != 0 && !contains(deps, src) {
+			implicit = append(implicit[:len(implicit):len(implicit)], src)
+		}
+		if len(implicit) > 0 {
+			g.implicit[id] = implicit
+		}
+		ndeps := deps.Len()
+		if ndeps+len(implicit) == 0 {
+			g.ready = append(g.ready, id)
+			continue
+		}
+		g.queued[id] = ndeps + len(implicit)
+		for j := 0; j < ndeps; j++ {
+			d := deps.At(j)
+			g.deps[d] = append(g.deps[d], id)
+		}
+		for _, d := range implicit {
+			g.deps[d] = append(g.deps[d], id)
 		}
 	}
 	for id, out := range g.deps {
@@ -71,10 +112,69 @@ func New(res catalog.Resource_List) (*Graph, error) {
 			return nil, fmt.Errorf("build dependency graph: unknown dependency ID %d requested by resource %d", id, out[0])
 		}
 	}
+	for i := 0; i < n; i++ {
+		r := res.At(i)
+		deps, _ := r.Dependencies()
+		for j := 0; j < deps.Len(); j++ {
+			if d := deps.At(j); rank[d] > rank[r.ID()] {
+				return nil, fmt.Errorf("build dependency graph: resource %d depends on resource %d across a barrier", r.ID(), d)
+			}
+		}
+		src := outputSource(r)
+		if src == 0 {
+			continue
+		}
+		if rank[src] > rank[r.ID()] {
+			return nil, fmt.Errorf("build dependency graph: resource %d takes its content from resource %d across a barrier", r.ID(), src)
+		}
+		s := g.Resource(src)
+		if s.Which() != catalog.Resource_Which_exec {
+			return nil, fmt.Errorf("build dependency graph: resource %d takes its content from resource %d, which is not an exec resource", r.ID(), src)
+		}
+		if e, _ := s.Exec(); e.HasSupervise() {
+			return nil, fmt.Errorf("build dependency graph: resource %d takes its content from resource %d, which is supervised", r.ID(), src)
+		}
+		g.sources[src] = true
+	}
 	// TODO(soon): loop detection
 	return g, nil
 }
 
+// ImplicitDependencies returns the resources that a resource depends on
+// because of barriers or its content source, in addition to its listed
+// dependencies.
+func (g *Graph) ImplicitDependencies(id uint64) []uint64 {
+	return g.implicit[id]
+}
+
+// IsOutputSource reports whether a file in the graph takes its content
+// from the output of the resource with the given ID.
+func (g *Graph) IsOutputSource(id uint64) bool {
+	return g.sources[id]
+}
+
+// outputSource returns the ID of the exec resource whose output r's
+// content comes from, or zero if r is not such a file.
+func outputSource(r catalog.Resource) uint64 {
+	if r.Which() != catalog.Resource_Which_file {
+		return 0
+	}
+	f, err := r.File()
+	if err != nil || f.Which() != catalog.File_Which_plain {
+		return 0
+	}
+	return f.Plain().ContentFromOutput()
+}
+
+func contains(list capnp.UInt64List, id uint64) bool {
+	for i := 0; i < list.Len(); i++ {
+		if list.At(i) == id {
+			return true
+		}
+	}
+	return false
+}
+
 // Ready returns a list of resources that have not been marked and have
 // no unmarked dependencies.  This slice is only valid until the next
 // mark call.
@@ -148,6 +248,41 @@ func (g *Graph) MarkFailure(id uint64) []uint64 {
 	return aborted
 }
 
+// CriticalPath returns the length of the longest chain of dependents
+// starting at each resource, including the resource itself, where each
+// resource's length is given by weight.  Scheduling resources with the
+// longest chains first shortens the total time to apply the graph when
+// resources are applied in parallel.
+func (g *Graph) CriticalPath(weight func(id uint64) float64) map[uint64]float64 {
+	length := make(map[uint64]float64, len(g.index))
+	visiting := make(map[uint64]bool)
+	var visit func(id uint64) float64
+	visit = func(id uint64) float64 {
+		if l, ok := length[id]; ok {
+			return l
+		}
+		if visiting[id] {
+			// Resources in a cycle can never be applied, so the length
+			// does not matter.
+			return 0
+		}
+		visiting[id] = true
+		var longest float64
+		for _, dep := range g.deps[id] {
+			if l := visit(dep); l > longest {
+				longest = l
+			}
+		}
+		delete(visiting, id)
+		length[id] = weight(id) + longest
+		return length[id]
+	}
+	for id := range g.index {
+		visit(id)
+	}
+	return length
+}
+
 func (g *Graph) pop(id uint64) bool {
 	i := -1
 	for ii, r := range g.ready {
@@ -29,9 +29,27 @@ func TestDepgraph(t *testing.T) {
 		fail    bool
 		skipped []uint64
 	}
+	type DummyFile struct {
+		Which catalog.File_Which
+		Plain struct {
+			ContentFromOutput uint64
+		}
+	}
+	type DummyExec struct{}
 	type DummyResource struct {
-		ID   uint64   `capnp:"id"`
-		Deps []uint64 `capnp:"dependencies"`
+		ID    uint64   `capnp:"id"`
+		Deps  []uint64 `capnp:"dependencies"`
+		Which catalog.Resource_Which
+		File  *DummyFile
+		Exec  *DummyExec
+	}
+	const barrier = catalog.Resource_Which_barrier
+	const exec = catalog.Resource_Which_exec
+	const file = catalog.Resource_Which_file
+	outputOf := func(id uint64) *DummyFile {
+		f := &DummyFile{Which: catalog.File_Which_plain}
+		f.Plain.ContentFromOutput = id
+		return f
 	}
 
 	tests := []struct {
@@ -237,6 +255,140 @@ func TestDepgraph(t *testing.T) {
 			},
 			failNew: true,
 		},
+		{
+			name: "barrier waits for everything before it",
+			resources: []DummyResource{
+				{ID: 10},
+				{ID: 20},
+				{ID: 30, Which: barrier},
+				{ID: 40},
+				{ID: 50},
+			},
+			marks: []Mark{
+				{id: 10},
+			},
+			ready: []uint64{20},
+		},
+		{
+			name: "barrier releases everything after it",
+			resources: []DummyResource{
+				{ID: 10},
+				{ID: 20},
+				{ID: 30, Which: barrier},
+				{ID: 40},
+				{ID: 50, Deps: []uint64{40}},
+			},
+			marks: []Mark{
+				{id: 10},
+				{id: 20},
+				{id: 30},
+			},
+			ready: []uint64{40},
+		},
+		{
+			name: "failure before barrier skips everything after it",
+			resources: []DummyResource{
+				{ID: 10},
+				{ID: 20},
+				{ID: 30, Which: barrier},
+				{ID: 40},
+				{ID: 50, Which: barrier},
+				{ID: 60},
+			},
+			marks: []Mark{
+				{id: 10, fail: true, skipped: []uint64{30, 40, 50, 60}},
+			},
+			ready: []uint64{20},
+		},
+		{
+			name: "consecutive barriers",
+			resources: []DummyResource{
+				{ID: 10},
+				{ID: 20, Which: barrier},
+				{ID: 30, Which: barrier},
+				{ID: 40},
+			},
+			marks: []Mark{
+				{id: 10},
+				{id: 20},
+			},
+			ready: []uint64{30},
+		},
+		{
+			name: "dependency on later phase",
+			resources: []DummyResource{
+				{ID: 10, Deps: []uint64{30}},
+				{ID: 20, Which: barrier},
+				{ID: 30},
+			},
+			failNew: true,
+		},
+		{
+			name: "dependency on own barrier",
+			resources: []DummyResource{
+				{ID: 10, Deps: []uint64{20}},
+				{ID: 20, Which: barrier},
+			},
+			failNew: true,
+		},
+		{
+			name: "dependency on earlier phase",
+			resources: []DummyResource{
+				{ID: 10},
+				{ID: 20, Which: barrier},
+				{ID: 30, Deps: []uint64{10}},
+			},
+			marks: []Mark{
+				{id: 10},
+				{id: 20},
+			},
+			ready: []uint64{30},
+		},
+		{
+			name: "file waits for its content source",
+			resources: []DummyResource{
+				{ID: 10, Which: file, File: outputOf(20)},
+				{ID: 20, Which: exec, Exec: &DummyExec{}},
+			},
+			ready: []uint64{20},
+		},
+		{
+			name: "content source finishes",
+			resources: []DummyResource{
+				{ID: 10, Which: file, File: outputOf(20), Deps: []uint64{20}},
+				{ID: 20, Which: exec, Exec: &DummyExec{}},
+			},
+			marks: []Mark{
+				{id: 20},
+			},
+			ready: []uint64{10},
+		},
+		{
+			name: "content source fails",
+			resources: []DummyResource{
+				{ID: 10, Which: file, File: outputOf(20)},
+				{ID: 20, Which: exec, Exec: &DummyExec{}},
+			},
+			marks: []Mark{
+				{id: 20, fail: true, skipped: []uint64{10}},
+			},
+			done: true,
+		},
+		{
+			name: "content source is not an exec resource",
+			resources: []DummyResource{
+				{ID: 10, Which: file, File: outputOf(20)},
+				{ID: 20},
+			},
+			failNew: true,
+		},
+		{
+			name: "unknown content source",
+			resources: []DummyResource{
+				{ID: 10, Which: file, File: outputOf(20)},
+			},
+			failNew: true,
+		},
 		{
 			name: "ABC cycle",
 			skip: true,
@@ -320,6 +472,69 @@ func TestDepgraph(t *testing.T) {
 	}
 }
 
+func TestCriticalPath(t *testing.T) {
+	type DummyResource struct {
+		ID   uint64   `capnp:"id"`
+		Deps []uint64 `capnp:"dependencies"`
+	}
+	// 1 and 2 are independent.  3 and 4 depend on 2, and 5 depends on 3.
+	resources := []DummyResource{
+		{ID: 1},
+		{ID: 2},
+		{ID: 3, Deps: []uint64{2}},
+		{ID: 4, Deps: []uint64{2}},
+		{ID: 5, Deps: []uint64{3}},
+	}
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		t.Fatal("NewMessage:", err)
+	}
+	res, err := catalog.NewResource_List(seg, int32(len(resources)))
+	if err != nil {
+		t.Fatal("NewResource_List:", err)
+	}
+	for i := range resources {
+		if err := pogs.Insert(catalog.Resource_TypeID, res.At(i).Struct, &resources[i]); err != nil {
+			t.Fatalf("pogs.Insert(resources[%d]): %v", i, err)
+		}
+	}
+	g, err := New(res)
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+
+	weights := map[uint64]float64{1: 10, 2: 1, 3: 1, 4: 20, 5: 1}
+	tests := []struct {
+		name   string
+		weight func(uint64) float64
+		want   map[uint64]float64
+	}{
+		{
+			name:   "unit",
+			weight: func(uint64) float64 { return 1 },
+			want:   map[uint64]float64{1: 1, 2: 3, 3: 2, 4: 1, 5: 1},
+		},
+		{
+			name:   "weighted",
+			weight: func(id uint64) float64 { return weights[id] },
+			want:   map[uint64]float64{1: 10, 2: 21, 3: 2, 4: 20, 5: 1},
+		},
+	}
+	for _, test := range tests {
+		got := g.CriticalPath(test.weight)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: CriticalPath = %v; want %v", test.name, got, test.want)
+			continue
+		}
+		for id, l := range test.want {
+			if got[id] != l {
+				t.Errorf("%s: CriticalPath = %v; want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
 func idSetsEqual(a, b []uint64) bool {
 	a, _ = sortSet(a)
 	b, _ = sortSet(b)
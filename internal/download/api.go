@@ -0,0 +1,156 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !mcm_minimal,!mcm_nocloud
+
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxAPIResponse bounds the size of a cloud API response.
+const maxAPIResponse = 16 << 20
+
+// AWSQuery sends a request to an AWS query API, like EC2's, signed with
+// the machine's AWS credentials and returns the response body.  params
+// should include the Action and Version.  Requests go to
+// $AWS_ENDPOINT_URL_<SERVICE> or $AWS_ENDPOINT_URL if set.
+func (d *Downloader) AWSQuery(ctx context.Context, service, region string, params url.Values) ([]byte, error) {
+	creds, err := d.cachedCredentials(ctx, &d.awsCreds, d.findAWSCredentials)
+	if err != nil {
+		return nil, err
+	}
+	if creds.anonymous() {
+		return nil, errors.New("no AWS credentials found")
+	}
+	endpoint := d.env("AWS_ENDPOINT_URL_" + strings.ToUpper(service))
+	if endpoint == "" {
+		endpoint = d.env("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://" + service + "." + region + ".amazonaws.com"
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(endpoint, "/")+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.URL.RawQuery = awsCanonicalQuery(params)
+	signAWS(req, creds, region, service, time.Now())
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAPIResponse))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", service, params.Get("Action"), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: server returned %s%s", service, params.Get("Action"), resp.Status, awsErrorMessage(body))
+	}
+	return body, nil
+}
+
+// awsCanonicalQuery encodes params sorted by name, escaped as AWS
+// signatures require.
+func awsCanonicalQuery(params url.Values) string {
+	var pairs []string
+	for k, vs := range params {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes every byte except the unreserved
+// characters.
+func awsEscape(s string) string {
+	return strings.Replace(escapePath(s), "/", "%2F", -1)
+}
+
+// awsErrorMessage returns ": CODE: MESSAGE" from an AWS XML error
+// response, or the empty string if body is not one.
+func awsErrorMessage(body []byte) string {
+	var resp struct {
+		Errors []struct {
+			Code    string
+			Message string
+		} `xml:"Errors>Error"`
+	}
+	if err := xml.Unmarshal(body, &resp); err != nil || len(resp.Errors) == 0 {
+		return ""
+	}
+	return ": " + resp.Errors[0].Code + ": " + resp.Errors[0].Message
+}
+
+// GoogleAPI sends a GET request to a Google Cloud API, like Compute
+// Engine's, with the machine's Google credentials and returns the
+// response body.
+func (d *Downloader) GoogleAPI(ctx context.Context, u string) ([]byte, error) {
+	creds, err := d.cachedCredentials(ctx, &d.computeCreds, d.findComputeCredentials)
+	if err != nil {
+		return nil, err
+	}
+	if creds.anonymous() {
+		return nil, errors.New("no Google credentials found")
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+creds.accessToken)
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAPIResponse))
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %v", u, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: server returned %s%s", u, resp.Status, googleErrorMessage(body))
+	}
+	return body, nil
+}
+
+// googleErrorMessage returns ": MESSAGE" from a Google API JSON error
+// response, or the empty string if body is not one.
+func googleErrorMessage(body []byte) string {
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error.Message == "" {
+		return ""
+	}
+	return ": " + resp.Error.Message
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !mcm_minimal,!mcm_nocloud
+
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAWSQuery(t *testing.T) {
+	var gotQuery, gotAuth string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("Action") == "Fail" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<Response><Errors><Error><Code>InvalidAction</Code><Message>no such action</Message></Error></Errors></Response>`))
+			return
+		}
+		gotQuery = r.URL.RawQuery
+		gotAuth = r.Header.Get("Authorization")
+		w.Write([]byte("<DescribeInstancesResponse/>"))
+	}))
+	defer hs.Close()
+
+	d := &Downloader{getenv: mapEnv{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "sekrit",
+		"AWS_ENDPOINT_URL_EC2":  hs.URL,
+	}.get}
+	params := url.Values{
+		"Action":           {"DescribeInstances"},
+		"Version":          {"2016-11-15"},
+		"Filter.1.Name":    {"tag:role"},
+		"Filter.1.Value.1": {"web server"},
+	}
+	data, err := d.AWSQuery(context.Background(), "ec2", "us-west-2", params)
+	if err != nil {
+		t.Fatal("AWSQuery:", err)
+	}
+	if string(data) != "<DescribeInstancesResponse/>" {
+		t.Errorf("AWSQuery = %q; want \"<DescribeInstancesResponse/>\"", data)
+	}
+	const wantQuery = "Action=DescribeInstances&Filter.1.Name=tag%3Arole&Filter.1.Value.1=web%20server&Version=2016-11-15"
+	if gotQuery != wantQuery {
+		t.Errorf("query = %q; want %q", gotQuery, wantQuery)
+	}
+	if !strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(gotAuth, "/us-west-2/ec2/aws4_request") {
+		t.Errorf("Authorization = %q; want signature by AKIDEXAMPLE for ec2 in us-west-2", gotAuth)
+	}
+
+	_, err = d.AWSQuery(context.Background(), "ec2", "us-west-2", url.Values{"Action": {"Fail"}})
+	if err == nil || !strings.Contains(err.Error(), "InvalidAction: no such action") {
+		t.Errorf("AWSQuery(Fail) error = %v; want to contain \"InvalidAction: no such action\"", err)
+	}
+}
+
+func TestAWSQueryNoCredentials(t *testing.T) {
+	d := &Downloader{getenv: mapEnv{"AWS_EC2_METADATA_DISABLED": "true"}.get}
+	if _, err := d.AWSQuery(context.Background(), "ec2", "us-west-2", url.Values{"Action": {"DescribeInstances"}}); err == nil {
+		t.Error("AWSQuery without credentials did not return an error")
+	}
+}
+
+func TestGoogleAPI(t *testing.T) {
+	var gotAuth string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case serviceAccountToken:
+			w.Write([]byte(`{"access_token":"ya29.metadata","expires_in":3599,"token_type":"Bearer"}`))
+		case "/compute/v1/projects/my-project/aggregated/instances":
+			gotAuth = r.Header.Get("Authorization")
+			w.Write([]byte(`{"items":{}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"message":"The resource was not found"}}`))
+		}
+	}))
+	defer hs.Close()
+	u, err := url.Parse(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Downloader{getenv: mapEnv{"GCE_METADATA_HOST": u.Host}.get}
+	data, err := d.GoogleAPI(context.Background(), hs.URL+"/compute/v1/projects/my-project/aggregated/instances")
+	if err != nil {
+		t.Fatal("GoogleAPI:", err)
+	}
+	if string(data) != `{"items":{}}` {
+		t.Errorf("GoogleAPI = %q; want `{\"items\":{}}`", data)
+	}
+	if gotAuth != "Bearer ya29.metadata" {
+		t.Errorf("Authorization = %q; want \"Bearer ya29.metadata\"", gotAuth)
+	}
+
+	_, err = d.GoogleAPI(context.Background(), hs.URL+"/compute/v1/projects/other/aggregated/instances")
+	if err == nil || !strings.Contains(err.Error(), "The resource was not found") {
+		t.Errorf("GoogleAPI(other) error = %v; want to contain \"The resource was not found\"", err)
+	}
+}
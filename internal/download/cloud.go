@@ -0,0 +1,158 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !mcm_minimal,!mcm_nocloud
+
+package download
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/features"
+)
+
+func init() {
+	features.Register("cloud")
+}
+
+// Object storage is accessed with the ambient credentials of the
+// machine, found in the same places that the providers' own tools look.
+// If no credentials are found, then requests are sent anonymously,
+// which works for public buckets.
+
+const (
+	// metadataTimeout bounds requests to instance metadata services,
+	// which are unreachable when not running on the provider's VMs.
+	metadataTimeout = 2 * time.Second
+
+	// credentialSlack is how long before expiring that credentials are
+	// refreshed.
+	credentialSlack = 5 * time.Minute
+
+	// anonymousRetry is how long to wait before looking for credentials
+	// again after none were found.
+	anonymousRetry = 5 * time.Minute
+)
+
+// cloudCredentials are credentials for an object storage service.  The
+// zero value means to send requests anonymously.
+type cloudCredentials struct {
+	// AWS access key.
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+
+	// OAuth2 access token for GCS.
+	accessToken string
+
+	// expires is the time at which the credentials stop working or
+	// zero if they don't expire.
+	expires time.Time
+}
+
+func (c *cloudCredentials) anonymous() bool {
+	return c.accessKeyID == "" && c.accessToken == ""
+}
+
+func (c *cloudCredentials) fresh(now time.Time) bool {
+	return c != nil && (c.expires.IsZero() || now.Add(credentialSlack).Before(c.expires))
+}
+
+// cachedCredentials returns *slot if it is still fresh and otherwise
+// replaces it with the result of find.  find returns nil if no
+// credentials could be found.
+func (d *Downloader) cachedCredentials(ctx context.Context, slot **cloudCredentials, find func(context.Context) (*cloudCredentials, error)) (*cloudCredentials, error) {
+	d.cloudMu.Lock()
+	defer d.cloudMu.Unlock()
+	now := time.Now()
+	if (*slot).fresh(now) {
+		return *slot, nil
+	}
+	c, err := find(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		c = &cloudCredentials{expires: now.Add(anonymousRetry)}
+	}
+	*slot = c
+	return c, nil
+}
+
+// metadataClient talks to instance metadata services.  These are
+// link-local, so requests never go through a proxy.
+var metadataClient = &http.Client{
+	Transport: &http.Transport{},
+	Timeout:   metadataTimeout,
+}
+
+// metadataRequest sends a request to an instance metadata service and
+// returns the response body.
+func metadataRequest(ctx context.Context, method, url string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: server returned %s", method, url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// escapePath percent-encodes an object name for use in a URL path,
+// leaving slashes and the characters that never need escaping intact.
+// This matches the canonical form required by AWS signatures.
+func escapePath(s string) string {
+	const hex = "0123456789ABCDEF"
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/':
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&0xf])
+		}
+	}
+	return buf.String()
+}
+
+// splitBucket splits the part of an object storage URL after the
+// scheme into a bucket and an object name.
+func splitBucket(u, scheme string) (bucket, object string, err error) {
+	rest := strings.TrimPrefix(u, scheme)
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", &requestError{fmt.Errorf("invalid URL %q: want %sBUCKET/OBJECT", u, scheme)}
+	}
+	return rest[:i], rest[i+1:], nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Credentials maps host names to the credential to present to them.  A
+// key may include a port, in which case it only matches URLs with that
+// port.
+type Credentials map[string]Credential
+
+// A Credential is either a username and password for basic
+// authentication or a bearer token.
+type Credential struct {
+	Username string
+	Password string
+	Token    string
+}
+
+func (c Credential) apply(req *http.Request) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+		return
+	}
+	req.SetBasicAuth(c.Username, c.Password)
+}
+
+// find returns the credential for u's host, preferring an entry that
+// includes the port.
+func (creds Credentials) find(u *url.URL) (Credential, bool) {
+	if c, ok := creds[u.Host]; ok {
+		return c, true
+	}
+	c, ok := creds[hostname(u)]
+	return c, ok
+}
+
+// hostname returns u's host without any port.
+func hostname(u *url.URL) string {
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		// No port.
+		return strings.TrimSuffix(strings.TrimPrefix(u.Host, "["), "]")
+	}
+	return host
+}
+
+// ParseCredentials parses a credentials file.  Each line of the file is
+// one of:
+//
+//	HOST basic USERNAME:PASSWORD
+//	HOST bearer TOKEN
+//
+// Blank lines and lines starting with '#' are ignored.
+func ParseCredentials(data []byte) (Credentials, error) {
+	creds := make(Credentials)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("parse credentials: line %d: want HOST TYPE VALUE", lineno)
+		}
+		host := fields[0]
+		if _, dup := creds[host]; dup {
+			return nil, fmt.Errorf("parse credentials: line %d: duplicate host %s", lineno, host)
+		}
+		switch fields[1] {
+		case "basic":
+			i := strings.IndexByte(fields[2], ':')
+			if i == -1 {
+				return nil, fmt.Errorf("parse credentials: line %d: basic credential must be USERNAME:PASSWORD", lineno)
+			}
+			creds[host] = Credential{Username: fields[2][:i], Password: fields[2][i+1:]}
+		case "bearer":
+			creds[host] = Credential{Token: fields[2]}
+		default:
+			return nil, fmt.Errorf("parse credentials: line %d: unknown type %q", lineno, fields[1])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("parse credentials: %v", err)
+	}
+	return creds, nil
+}
+
+// ReadCredentialsFile reads a credentials file in the format accepted by
+// ParseCredentials.
+func ReadCredentialsFile(path string) (Credentials, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials: %v", err)
+	}
+	creds, err := ParseCredentials(data)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials %s: %v", path, err)
+	}
+	return creds, nil
+}
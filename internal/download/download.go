@@ -0,0 +1,463 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package download fetches files over HTTP(S) and from object storage
+// (s3:// and gs:// URLs).  All of the network fetches of the mcm tools
+// go through a Downloader, so that proxies, credentials, and mirrors
+// are configured in one place.  The same credentials are used for the
+// cloud provider APIs that list hosts.
+package download
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Downloader makes HTTP requests on behalf of the mcm tools.  The
+// zero value uses the proxy named by the environment and has no
+// credentials or mirrors.  A Downloader must not be modified after its
+// first use, but its methods are safe to call from multiple goroutines.
+type Downloader struct {
+	// Proxy is the URL of the HTTP(S) proxy to send requests through.
+	// If nil, then the proxy is chosen by the HTTP_PROXY, HTTPS_PROXY,
+	// and NO_PROXY environment variables.
+	Proxy *url.URL
+
+	// Credentials supplies the Authorization header for requests to
+	// the hosts it lists.
+	Credentials Credentials
+
+	// Mirrors lists alternate locations to try, in order, when the
+	// server for a URL cannot be reached.
+	Mirrors Mirrors
+
+	// Transport sends the requests.  If nil, then a copy of
+	// http.DefaultTransport that uses Proxy is created.
+	Transport http.RoundTripper
+
+	// getenv looks up environment variables.  If nil, then os.Getenv
+	// is used.  Tests replace it to control ambient credentials.
+	getenv func(string) string
+
+	once   sync.Once
+	client *http.Client
+
+	// cloudMu protects the cached cloud credentials.
+	cloudMu      sync.Mutex
+	awsCreds     *cloudCredentials
+	gcsCreds     *cloudCredentials
+	computeCreds *cloudCredentials
+}
+
+// A Mirror serves the same files as the URLs starting with Prefix.  A
+// URL is rewritten for the mirror by replacing Prefix with URL.
+type Mirror struct {
+	Prefix string
+	URL    string
+}
+
+// ParseMirror parses a mirror in the form "PREFIX=URL".
+func ParseMirror(s string) (Mirror, error) {
+	i := strings.IndexByte(s, '=')
+	if i == -1 {
+		return Mirror{}, fmt.Errorf("parse mirror %q: missing '='", s)
+	}
+	m := Mirror{Prefix: s[:i], URL: s[i+1:]}
+	if !IsURL(m.Prefix) || !IsURL(m.URL) {
+		return Mirror{}, fmt.Errorf("parse mirror %q: prefix and mirror must be http, https, s3, or gs URLs", s)
+	}
+	return m, nil
+}
+
+// Mirrors is a list of mirrors.  It implements flag.Value so that
+// mirrors can be given as repeated "PREFIX=URL" flags.
+type Mirrors []Mirror
+
+// String returns the mirrors as comma-separated "PREFIX=URL" pairs.
+func (ms *Mirrors) String() string {
+	if ms == nil {
+		return ""
+	}
+	parts := make([]string, len(*ms))
+	for i, m := range *ms {
+		parts[i] = m.Prefix + "=" + m.URL
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses a mirror and appends it to the list.
+func (ms *Mirrors) Set(s string) error {
+	m, err := ParseMirror(s)
+	if err != nil {
+		return err
+	}
+	*ms = append(*ms, m)
+	return nil
+}
+
+// Schemes of object storage URLs.
+const (
+	s3Scheme  = "s3://"
+	gcsScheme = "gs://"
+)
+
+// IsURL reports whether s is a URL that a Downloader can fetch (http,
+// https, s3, or gs), as opposed to a local path.
+func IsURL(s string) bool {
+	for _, prefix := range []string{"http://", "https://", s3Scheme, gcsScheme} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnreachableError is returned when neither the server for a URL nor
+// any of its mirrors could be reached or all of them returned a server
+// error.  Such failures are likely transient.
+type UnreachableError struct {
+	URL string
+	Err error
+}
+
+func (e *UnreachableError) Error() string {
+	return e.Err.Error()
+}
+
+// Get sends a GET request for rawurl with the given extra headers.  If
+// the server cannot be reached or it returns a 5xx status, then each
+// matching mirror is tried in turn.  Any other response is returned,
+// regardless of its status; the caller must close its body.  If no
+// server gave such a response, then Get returns an *UnreachableError.
+func (d *Downloader) Get(ctx context.Context, rawurl string, header http.Header) (*http.Response, error) {
+	var msgs []string
+	for i, u := range d.candidates(rawurl) {
+		resp, err := d.do(ctx, u, header)
+		if rerr, ok := err.(*requestError); ok {
+			return nil, rerr.err
+		}
+		if err == nil && resp.StatusCode < 500 {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("server returned %s", resp.Status)
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if i == 0 {
+			msgs = append(msgs, err.Error())
+		} else {
+			msgs = append(msgs, fmt.Sprintf("mirror %s: %v", u, err))
+		}
+	}
+	return nil, &UnreachableError{URL: rawurl, Err: errors.New(strings.Join(msgs, "; "))}
+}
+
+// do sends a single GET request for u.
+func (d *Downloader) do(ctx context.Context, u string, header http.Header) (*http.Response, error) {
+	switch {
+	case strings.HasPrefix(u, s3Scheme):
+		return d.doS3(ctx, u, header)
+	case strings.HasPrefix(u, gcsScheme):
+		return d.doGCS(ctx, u, header)
+	}
+	req, err := newRequest(ctx, u, header)
+	if err != nil {
+		return nil, err
+	}
+	if req.Header.Get("Authorization") == "" {
+		if c, ok := d.Credentials.find(req.URL); ok {
+			c.apply(req)
+		}
+	}
+	return d.httpClient().Do(req)
+}
+
+// newRequest returns a GET request for u with the given extra headers.
+// Errors are wrapped in *requestError.
+func newRequest(ctx context.Context, u string, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, &requestError{err}
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+// requestError is returned by do for failures that trying a mirror
+// would not fix, like a malformed URL or unusable credentials.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+// Fetch downloads the file at rawurl into memory.  It returns an error
+// unless the server responds with 200 OK.
+func (d *Downloader) Fetch(ctx context.Context, rawurl string) ([]byte, error) {
+	resp, err := d.Get(ctx, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &UnreachableError{URL: rawurl, Err: err}
+	}
+	return data, nil
+}
+
+// Size returns the size of the file at rawurl without downloading it,
+// by requesting only its first byte.  It returns -1 if the server does
+// not report the size.
+func (d *Downloader) Size(ctx context.Context, rawurl string) (int64, error) {
+	resp, err := d.Get(ctx, rawurl, http.Header{"Range": {"bytes=0-0"}})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range is "bytes 0-0/SIZE", or "bytes 0-0/*" if the
+		// size is unknown.
+		cr := resp.Header.Get("Content-Range")
+		i := strings.LastIndexByte(cr, '/')
+		if i == -1 {
+			return -1, nil
+		}
+		n, err := strconv.ParseInt(cr[i+1:], 10, 64)
+		if err != nil {
+			return -1, nil
+		}
+		return n, nil
+	case http.StatusOK:
+		// The server ignored the range.
+		return resp.ContentLength, nil
+	default:
+		return 0, fmt.Errorf("server returned %s", resp.Status)
+	}
+}
+
+// Put uploads body to the HTTP(S) URL rawurl with a PUT request, using
+// the same proxy and credentials as Get.  Mirrors are not tried.  It
+// returns an error unless the server responds with a 2xx status.
+func (d *Downloader) Put(ctx context.Context, rawurl string, contentType string, body []byte) error {
+	return d.upload(ctx, http.MethodPut, rawurl, contentType, body)
+}
+
+// Post is like Put, but sends a POST request.
+func (d *Downloader) Post(ctx context.Context, rawurl string, contentType string, body []byte) error {
+	return d.upload(ctx, http.MethodPost, rawurl, contentType, body)
+}
+
+func (d *Downloader) upload(ctx context.Context, method string, rawurl string, contentType string, body []byte) error {
+	op := strings.ToLower(method)
+	if !strings.HasPrefix(rawurl, "http://") && !strings.HasPrefix(rawurl, "https://") {
+		return fmt.Errorf("%s %s: only http and https URLs are supported", op, rawurl)
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", op, rawurl, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	if c, ok := d.Credentials.find(req.URL); ok {
+		c.apply(req)
+	}
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", op, rawurl, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: server returned %s", op, rawurl, resp.Status)
+	}
+	return nil
+}
+
+// PartialSuffix is appended to the destination path of DownloadFile to
+// name the file that holds an incomplete download.
+const PartialSuffix = ".part"
+
+// DownloadFile downloads the file at rawurl to path.  The data is first
+// written to path+PartialSuffix, which is renamed to path once the
+// download completes.  If a partial file is left over from an
+// interrupted download, then DownloadFile asks the server for only the
+// remaining bytes.  The file at rawurl is assumed not to have changed
+// in the meantime.
+func (d *Downloader) DownloadFile(ctx context.Context, rawurl, path string) error {
+	f, err := os.OpenFile(path+PartialSuffix, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("download %s: %v", rawurl, err)
+	}
+	err = d.downloadTo(ctx, f, rawurl)
+	cerr := f.Close()
+	if err != nil {
+		return fmt.Errorf("download %s: %v", rawurl, err)
+	}
+	if cerr != nil {
+		return fmt.Errorf("download %s: %v", rawurl, cerr)
+	}
+	if err := os.Rename(path+PartialSuffix, path); err != nil {
+		return fmt.Errorf("download %s: %v", rawurl, err)
+	}
+	return nil
+}
+
+func (d *Downloader) downloadTo(ctx context.Context, f *os.File, rawurl string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+	resp, err := d.get(ctx, rawurl, offset)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable || (resp.StatusCode == http.StatusPartialContent && !rangeStartsAt(resp, offset)) {
+		// The partial file does not match the server's file.  Start over.
+		resp.Body.Close()
+		offset = 0
+		resp, err = d.get(ctx, rawurl, offset)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+	case http.StatusPartialContent:
+		if !rangeStartsAt(resp, offset) {
+			return fmt.Errorf("server returned mismatched range %q", resp.Header.Get("Content-Range"))
+		}
+	default:
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		// Keep what was written so that the next attempt can resume.
+		return &UnreachableError{URL: rawurl, Err: err}
+	}
+	return nil
+}
+
+// get requests rawurl starting at the given byte offset.
+func (d *Downloader) get(ctx context.Context, rawurl string, offset int64) (*http.Response, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {"bytes=" + strconv.FormatInt(offset, 10) + "-"}}
+	}
+	return d.Get(ctx, rawurl, header)
+}
+
+// rangeStartsAt reports whether a 206 response's Content-Range begins
+// at offset.
+func rangeStartsAt(resp *http.Response, offset int64) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(offset, 10)+"-")
+}
+
+// candidates returns rawurl followed by its mirrored locations.
+func (d *Downloader) candidates(rawurl string) []string {
+	c := []string{rawurl}
+	for _, m := range d.Mirrors {
+		if strings.HasPrefix(rawurl, m.Prefix) {
+			c = append(c, m.URL+rawurl[len(m.Prefix):])
+		}
+	}
+	return c
+}
+
+func (d *Downloader) env(key string) string {
+	if d.getenv == nil {
+		return os.Getenv(key)
+	}
+	return d.getenv(key)
+}
+
+func (d *Downloader) httpClient() *http.Client {
+	d.once.Do(func() {
+		rt := d.Transport
+		if rt == nil {
+			// Same settings as http.DefaultTransport.
+			t := &http.Transport{
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: 1 * time.Second,
+			}
+			if d.Proxy != nil {
+				t.Proxy = http.ProxyURL(d.Proxy)
+			} else {
+				t.Proxy = http.ProxyFromEnvironment
+			}
+			rt = t
+		}
+		d.client = &http.Client{Transport: rt}
+	})
+	return d.client
+}
+
+// New returns a Downloader configured from the values of the tools'
+// -proxy, -credentials, and -mirror flags.  Empty strings leave the
+// corresponding setting at its default.
+func New(proxy, credentialsPath string, mirrors Mirrors) (*Downloader, error) {
+	d := &Downloader{Mirrors: mirrors}
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q: must be an http or https URL", proxy)
+		}
+		d.Proxy = u
+	}
+	if credentialsPath != "" {
+		var err error
+		d.Credentials, err = ReadCredentialsFile(credentialsPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
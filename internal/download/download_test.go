@@ -0,0 +1,342 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package download
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFetch(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hello" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("Hello, World!\n"))
+	}))
+	defer hs.Close()
+
+	ctx := context.Background()
+	d := new(Downloader)
+	data, err := d.Fetch(ctx, hs.URL+"/hello")
+	if err != nil {
+		t.Fatal("Fetch /hello:", err)
+	}
+	if string(data) != "Hello, World!\n" {
+		t.Errorf("Fetch /hello = %q; want \"Hello, World!\\n\"", data)
+	}
+	_, err = d.Fetch(ctx, hs.URL+"/missing")
+	if err == nil {
+		t.Error("Fetch /missing did not return an error")
+	} else if _, unreachable := err.(*UnreachableError); unreachable {
+		t.Errorf("Fetch /missing = %v; want not an *UnreachableError", err)
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	var mirrorPath string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorPath = r.URL.Path
+		w.Write([]byte("mirrored"))
+	}))
+	defer mirror.Close()
+
+	ctx := context.Background()
+	d := &Downloader{
+		Mirrors: Mirrors{
+			{Prefix: "http://unrelated.example.com/", URL: "http://unrelated.example.com/"},
+			{Prefix: primary.URL + "/dist/", URL: mirror.URL + "/pub/mcm/"},
+		},
+	}
+	data, err := d.Fetch(ctx, primary.URL+"/dist/catalog.bin")
+	if err != nil {
+		t.Fatal("Fetch:", err)
+	}
+	if string(data) != "mirrored" {
+		t.Errorf("Fetch = %q; want \"mirrored\"", data)
+	}
+	if mirrorPath != "/pub/mcm/catalog.bin" {
+		t.Errorf("mirror requested %q; want \"/pub/mcm/catalog.bin\"", mirrorPath)
+	}
+
+	mirror.Close()
+	_, err = d.Fetch(ctx, primary.URL+"/dist/catalog.bin")
+	if _, unreachable := err.(*UnreachableError); !unreachable {
+		t.Errorf("Fetch with mirror down = %v; want *UnreachableError", err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	var gotURL string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURL = r.URL.String()
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Downloader{Proxy: proxyURL}
+	data, err := d.Fetch(context.Background(), "http://catalog.example.com/catalog.bin")
+	if err != nil {
+		t.Fatal("Fetch:", err)
+	}
+	if string(data) != "proxied" {
+		t.Errorf("Fetch = %q; want \"proxied\"", data)
+	}
+	if gotURL != "http://catalog.example.com/catalog.bin" {
+		t.Errorf("proxy received request for %q; want \"http://catalog.example.com/catalog.bin\"", gotURL)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	var auth string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer hs.Close()
+	u, err := url.Parse(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		creds Credentials
+		want  string
+	}{
+		{nil, ""},
+		{Credentials{"other.example.com": {Token: "xyzzy"}}, ""},
+		{Credentials{hostname(u): {Token: "xyzzy"}}, "Bearer xyzzy"},
+		{Credentials{hostname(u): {Username: "alice", Password: "sekrit"}}, "Basic YWxpY2U6c2Vrcml0"},
+		{Credentials{hostname(u): {Token: "nope"}, u.Host: {Token: "xyzzy"}}, "Bearer xyzzy"},
+	}
+	for _, test := range tests {
+		auth = ""
+		d := &Downloader{Credentials: test.creds}
+		if _, err := d.Fetch(context.Background(), hs.URL); err != nil {
+			t.Errorf("with %v: Fetch: %v", test.creds, err)
+			continue
+		}
+		if auth != test.want {
+			t.Errorf("with %v: Authorization = %q; want %q", test.creds, auth, test.want)
+		}
+	}
+}
+
+func TestPut(t *testing.T) {
+	var method, contentType, auth string
+	var body []byte
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			http.Error(w, "go away", http.StatusForbidden)
+			return
+		}
+		method = r.Method
+		contentType = r.Header.Get("Content-Type")
+		auth = r.Header.Get("Authorization")
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hs.Close()
+	u, err := url.Parse(hs.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Downloader{Credentials: Credentials{u.Host: {Token: "xyzzy"}}}
+	if err := d.Put(context.Background(), hs.URL+"/facts/web1", "application/json", []byte(`{"os":"linux"}`)); err != nil {
+		t.Fatal("Put:", err)
+	}
+	if method != http.MethodPut {
+		t.Errorf("method = %q; want PUT", method)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Content-Type = %q; want \"application/json\"", contentType)
+	}
+	if auth != "Bearer xyzzy" {
+		t.Errorf("Authorization = %q; want \"Bearer xyzzy\"", auth)
+	}
+	if string(body) != `{"os":"linux"}` {
+		t.Errorf("body = %q; want `{\"os\":\"linux\"}`", body)
+	}
+	if err := d.Put(context.Background(), hs.URL+"/forbidden", "application/json", nil); err == nil {
+		t.Error("Put to /forbidden did not return an error")
+	}
+	if err := d.Put(context.Background(), "s3://bucket/facts", "application/json", nil); err == nil {
+		t.Error("Put to s3:// URL did not return an error")
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	creds, err := ParseCredentials([]byte("# Catalog servers\n\nexample.com basic alice:se:krit\n  localhost:8080 bearer xyzzy\n"))
+	if err != nil {
+		t.Fatal("ParseCredentials:", err)
+	}
+	want := Credentials{
+		"example.com":    {Username: "alice", Password: "se:krit"},
+		"localhost:8080": {Token: "xyzzy"},
+	}
+	if len(creds) != len(want) {
+		t.Errorf("ParseCredentials returned %d entries; want %d", len(creds), len(want))
+	}
+	for host, c := range want {
+		if creds[host] != c {
+			t.Errorf("ParseCredentials()[%q] = %+v; want %+v", host, creds[host], c)
+		}
+	}
+
+	bad := []string{
+		"example.com",
+		"example.com basic alice",
+		"example.com digest alice:sekrit",
+		"example.com bearer a\nexample.com bearer b",
+	}
+	for _, data := range bad {
+		if _, err := ParseCredentials([]byte(data)); err == nil {
+			t.Errorf("ParseCredentials(%q) did not return an error", data)
+		}
+	}
+}
+
+func TestParseMirror(t *testing.T) {
+	m, err := ParseMirror("https://example.com/dist/=http://mirror.local/mcm/")
+	if err != nil {
+		t.Fatal("ParseMirror:", err)
+	}
+	if want := (Mirror{Prefix: "https://example.com/dist/", URL: "http://mirror.local/mcm/"}); m != want {
+		t.Errorf("ParseMirror = %+v; want %+v", m, want)
+	}
+	for _, s := range []string{"https://example.com/", "/dist/=http://mirror.local/", "https://example.com/=ftp://mirror.local/"} {
+		if _, err := ParseMirror(s); err == nil {
+			t.Errorf("ParseMirror(%q) did not return an error", s)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ranged":
+			http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+		case "/whole":
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer hs.Close()
+
+	ctx := context.Background()
+	d := new(Downloader)
+	for _, path := range []string{"/ranged", "/whole"} {
+		n, err := d.Size(ctx, hs.URL+path)
+		if err != nil {
+			t.Errorf("Size %s: %v", path, err)
+		} else if n != int64(len(content)) {
+			t.Errorf("Size %s = %d; want %d", path, n, len(content))
+		}
+	}
+	if _, err := d.Size(ctx, hs.URL+"/missing"); err == nil {
+		t.Error("Size /missing did not return an error")
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	var ranges []string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "download_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name      string
+		partial   []byte
+		wantRange string
+	}{
+		{"fresh", nil, ""},
+		{"resume", content[:300], "bytes=300-"},
+		{"overlong", append(append([]byte(nil), content...), "extra"...), "bytes=1005-"},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		path := filepath.Join(dir, test.name)
+		if test.partial != nil {
+			if err := ioutil.WriteFile(path+PartialSuffix, test.partial, 0666); err != nil {
+				t.Error(err)
+				continue
+			}
+		}
+		ranges = nil
+		if err := new(Downloader).DownloadFile(ctx, hs.URL, path); err != nil {
+			t.Errorf("%s: DownloadFile: %v", test.name, err)
+			continue
+		}
+		if got, err := ioutil.ReadFile(path); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !bytes.Equal(got, content) {
+			t.Errorf("%s: downloaded %d bytes that differ from content; want %d bytes", test.name, len(got), len(content))
+		}
+		if len(ranges) == 0 || ranges[0] != test.wantRange {
+			t.Errorf("%s: requested ranges %q; want first to be %q", test.name, ranges, test.wantRange)
+		}
+		if _, err := os.Stat(path + PartialSuffix); !os.IsNotExist(err) {
+			t.Errorf("%s: partial file still exists after download (err=%v)", test.name, err)
+		}
+	}
+}
+
+func TestIsURL(t *testing.T) {
+	tests := []struct {
+		s    string
+		want bool
+	}{
+		{"http://example.com/catalog.bin", true},
+		{"https://example.com/catalog.bin", true},
+		{"s3://bucket/catalog.bin", true},
+		{"gs://bucket/catalog.bin", true},
+		{"catalog.bin", false},
+		{"/srv/http://catalog.bin", false},
+	}
+	for _, test := range tests {
+		if got := IsURL(test.s); got != test.want {
+			t.Errorf("IsURL(%q) = %t; want %t", test.s, got, test.want)
+		}
+	}
+}
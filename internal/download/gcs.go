@@ -0,0 +1,263 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !mcm_minimal,!mcm_nocloud
+
+package download
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	gcsEndpoint         = "https://storage.googleapis.com"
+	gcsReadOnlyScope    = "https://www.googleapis.com/auth/devstorage.read_only"
+	computeReadOnly     = "https://www.googleapis.com/auth/compute.readonly"
+	googleTokenURL      = "https://oauth2.googleapis.com/token"
+	defaultGCEMetadata  = "metadata.google.internal"
+	jwtBearerGrantType  = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	serviceAccountToken = "/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// doGCS fetches a gs://BUCKET/OBJECT URL.  If $STORAGE_EMULATOR_HOST is
+// set, then requests go to the emulator without credentials.
+func (d *Downloader) doGCS(ctx context.Context, u string, header http.Header) (*http.Response, error) {
+	bucket, object, err := splitBucket(u, gcsScheme)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := gcsEndpoint
+	creds := new(cloudCredentials)
+	if host := d.env("STORAGE_EMULATOR_HOST"); host != "" {
+		endpoint = strings.TrimSuffix(host, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	} else {
+		creds, err = d.cachedCredentials(ctx, &d.gcsCreds, d.findGCSCredentials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req, err := newRequest(ctx, endpoint+"/"+bucket+"/"+escapePath(object), header)
+	if err != nil {
+		return nil, err
+	}
+	if !creds.anonymous() {
+		req.Header.Set("Authorization", "Bearer "+creds.accessToken)
+	}
+	return d.httpClient().Do(req)
+}
+
+// findGCSCredentials looks for Google credentials with read-only
+// storage access.
+func (d *Downloader) findGCSCredentials(ctx context.Context) (*cloudCredentials, error) {
+	return d.findGoogleCredentials(ctx, gcsReadOnlyScope)
+}
+
+// findComputeCredentials looks for Google credentials with read-only
+// Compute Engine access.
+func (d *Downloader) findComputeCredentials(ctx context.Context) (*cloudCredentials, error) {
+	return d.findGoogleCredentials(ctx, computeReadOnly)
+}
+
+// findGoogleCredentials looks for Google application default
+// credentials: the file named by $GOOGLE_APPLICATION_CREDENTIALS, then
+// the file written by "gcloud auth application-default login", then the
+// GCE metadata server.  Tokens for service account keys are limited to
+// scope; the others have the scopes that they were granted.
+func (d *Downloader) findGoogleCredentials(ctx context.Context, scope string) (*cloudCredentials, error) {
+	path := d.env("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if home := d.env("HOME"); home != "" {
+			p := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(p); err == nil {
+				path = p
+			}
+		}
+	}
+	if path != "" {
+		return d.googleFileCredentials(ctx, path, scope)
+	}
+	// Not being on GCE is the common reason for this failing, in which
+	// case the request is sent anonymously.
+	creds, _ := d.gceCredentials(ctx)
+	return creds, nil
+}
+
+// googleCredentialsFile is the JSON format of a service account key or
+// of gcloud's application default credentials.
+type googleCredentialsFile struct {
+	Type string `json:"type"`
+
+	// Service account fields.
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	// Authorized user fields.
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// googleFileCredentials exchanges the credentials in a service account
+// key or authorized user file for an access token.  Problems with the
+// file are returned as *requestError; failing to reach the token
+// endpoint is not.
+func (d *Downloader) googleFileCredentials(ctx context.Context, path, scope string) (*cloudCredentials, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &requestError{fmt.Errorf("read Google credentials: %v", err)}
+	}
+	var f googleCredentialsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, &requestError{fmt.Errorf("read Google credentials %s: %v", path, err)}
+	}
+	tokenURL := googleTokenURL
+	form := make(url.Values)
+	switch f.Type {
+	case "service_account":
+		if f.TokenURI != "" {
+			tokenURL = f.TokenURI
+		}
+		assertion, err := serviceAccountJWT(&f, tokenURL, scope, time.Now())
+		if err != nil {
+			return nil, &requestError{fmt.Errorf("read Google credentials %s: %v", path, err)}
+		}
+		form.Set("grant_type", jwtBearerGrantType)
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", f.ClientID)
+		form.Set("client_secret", f.ClientSecret)
+		form.Set("refresh_token", f.RefreshToken)
+	default:
+		return nil, &requestError{fmt.Errorf("read Google credentials %s: unsupported type %q", path, f.Type)}
+	}
+	req, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, &requestError{fmt.Errorf("Google token: %v", err)}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := d.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Google token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("Google token: %v", err)
+	}
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("Google token: server returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &requestError{fmt.Errorf("Google token: server returned %s", resp.Status)}
+	}
+	creds, err := parseGoogleToken(body)
+	if err != nil {
+		return nil, &requestError{err}
+	}
+	return creds, nil
+}
+
+// serviceAccountJWT returns a signed assertion requesting scope for a
+// service account.
+func serviceAccountJWT(f *googleCredentialsFile, audience, scope string, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(f.PrivateKey))
+	if block == nil {
+		return "", errors.New("private key is not PEM-encoded")
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if key, ok = k.(*rsa.PrivateKey); !ok {
+			return "", errors.New("private key is not an RSA key")
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", fmt.Errorf("parse private key: %v", err)
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   f.ClientEmail,
+		"scope": scope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signing := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	h := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", fmt.Errorf("sign assertion: %v", err)
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// gceCredentials obtains an access token for the instance's default
+// service account from the GCE metadata server.
+func (d *Downloader) gceCredentials(ctx context.Context) (*cloudCredentials, error) {
+	host := d.env("GCE_METADATA_HOST")
+	if host == "" {
+		host = defaultGCEMetadata
+	}
+	body, err := metadataRequest(ctx, http.MethodGet, "http://"+host+serviceAccountToken, http.Header{
+		"Metadata-Flavor": {"Google"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseGoogleToken(body)
+}
+
+// parseGoogleToken parses an OAuth2 token response.
+func parseGoogleToken(body []byte) (*cloudCredentials, error) {
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, fmt.Errorf("Google token: %v", err)
+	}
+	if tok.AccessToken == "" {
+		return nil, errors.New("Google token: response missing access_token")
+	}
+	creds := &cloudCredentials{accessToken: tok.AccessToken}
+	if tok.ExpiresIn > 0 {
+		creds.expires = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	return creds, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build mcm_minimal mcm_nocloud
+
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// errNoCloud is returned for object storage requests in builds without
+// cloud support.
+var errNoCloud = errors.New("s3:// and gs:// URLs not supported (built with mcm_nocloud)")
+
+// cloudCredentials is empty, since there are no credentials to find.
+type cloudCredentials struct{}
+
+func (d *Downloader) doS3(ctx context.Context, u string, header http.Header) (*http.Response, error) {
+	return nil, errNoCloud
+}
+
+func (d *Downloader) doGCS(ctx context.Context, u string, header http.Header) (*http.Response, error) {
+	return nil, errNoCloud
+}
+
+// AWSQuery returns an error, since the build does not support cloud
+// APIs.
+func (d *Downloader) AWSQuery(ctx context.Context, service, region string, params url.Values) ([]byte, error) {
+	return nil, errors.New("AWS APIs not supported (built with mcm_nocloud)")
+}
+
+// GoogleAPI returns an error, since the build does not support cloud
+// APIs.
+func (d *Downloader) GoogleAPI(ctx context.Context, u string) ([]byte, error) {
+	return nil, errors.New("Google Cloud APIs not supported (built with mcm_nocloud)")
+}
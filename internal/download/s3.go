@@ -0,0 +1,293 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !mcm_minimal,!mcm_nocloud
+
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region      = "us-east-1"
+	defaultEC2Metadata   = "http://169.254.169.254"
+	ec2MetadataTokenTTL  = "21600"
+	emptyPayloadSHA256   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	awsSigningAlgorithm  = "AWS4-HMAC-SHA256"
+	awsAmzDateFormat     = "20060102T150405Z"
+	s3BucketRegionHeader = "X-Amz-Bucket-Region"
+)
+
+// doS3 fetches an s3://BUCKET/KEY URL.  If the bucket turns out to be in
+// a different region than the one configured, then the request is
+// retried in the bucket's region.
+func (d *Downloader) doS3(ctx context.Context, u string, header http.Header) (*http.Response, error) {
+	bucket, key, err := splitBucket(u, s3Scheme)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := d.cachedCredentials(ctx, &d.awsCreds, d.findAWSCredentials)
+	if err != nil {
+		return nil, err
+	}
+	region := d.env("AWS_REGION")
+	if region == "" {
+		region = d.env("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = defaultS3Region
+	}
+	resp, err := d.s3Request(ctx, bucket, key, region, creds, header)
+	if err != nil {
+		return nil, err
+	}
+	if r := resp.Header.Get(s3BucketRegionHeader); r != "" && r != region && (resp.StatusCode == http.StatusMovedPermanently || resp.StatusCode == http.StatusBadRequest) {
+		resp.Body.Close()
+		return d.s3Request(ctx, bucket, key, r, creds, header)
+	}
+	return resp, nil
+}
+
+func (d *Downloader) s3Request(ctx context.Context, bucket, key, region string, creds *cloudCredentials, header http.Header) (*http.Response, error) {
+	var u string
+	endpoint := d.env("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = d.env("AWS_ENDPOINT_URL")
+	}
+	switch {
+	case endpoint != "":
+		u = strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/" + escapePath(key)
+	case strings.Contains(bucket, "."):
+		// Virtual-hosted names with dots don't match the certificate.
+		u = "https://s3." + region + ".amazonaws.com/" + bucket + "/" + escapePath(key)
+	default:
+		u = "https://" + bucket + ".s3." + region + ".amazonaws.com/" + escapePath(key)
+	}
+	req, err := newRequest(ctx, u, header)
+	if err != nil {
+		return nil, err
+	}
+	if !creds.anonymous() {
+		signS3(req, creds, region, time.Now())
+	}
+	return d.httpClient().Do(req)
+}
+
+// signS3 adds an AWS Signature Version 4 Authorization header to a GET
+// request without a body.
+func signS3(req *http.Request, creds *cloudCredentials, region string, now time.Time) {
+	signAWS(req, creds, region, "s3", now)
+}
+
+// signAWS adds an AWS Signature Version 4 Authorization header for
+// service to a GET request without a body.  The request's query string
+// must already be in canonical form.
+func signAWS(req *http.Request, creds *cloudCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsAmzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadSHA256)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	// Canonical headers must be sorted by name.
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	canonHeaders := "host:" + host + "\n"
+	signed := []string{"host"}
+	for _, name := range []string{"range", "x-amz-content-sha256", "x-amz-date", "x-amz-security-token"} {
+		v := req.Header.Get(name)
+		if v == "" {
+			continue
+		}
+		canonHeaders += name + ":" + strings.TrimSpace(v) + "\n"
+		signed = append(signed, name)
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders,
+		signedHeaders,
+		emptyPayloadSHA256,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonHash := sha256.Sum256([]byte(canonRequest))
+	stringToSign := awsSigningAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", awsSigningAlgorithm, creds.accessKeyID, scope, signedHeaders, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// findAWSCredentials looks for AWS credentials in the environment, then
+// the shared credentials file, then the EC2 instance metadata service.
+func (d *Downloader) findAWSCredentials(ctx context.Context) (*cloudCredentials, error) {
+	if id := d.env("AWS_ACCESS_KEY_ID"); id != "" {
+		return &cloudCredentials{
+			accessKeyID:     id,
+			secretAccessKey: d.env("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    d.env("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if creds, err := d.awsSharedCredentials(); creds != nil || err != nil {
+		return creds, err
+	}
+	if strings.EqualFold(d.env("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil, nil
+	}
+	// Not being on EC2 is the common reason for this failing, in which
+	// case the request is sent anonymously.
+	creds, _ := d.ec2Credentials(ctx)
+	return creds, nil
+}
+
+// awsSharedCredentials reads the profile named by $AWS_PROFILE (or the
+// default profile) from the shared credentials file.  It returns nil if
+// the file or profile does not exist, unless the profile was named
+// explicitly.
+func (d *Downloader) awsSharedCredentials() (*cloudCredentials, error) {
+	path := d.env("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home := d.env("HOME")
+		if home == "" {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := d.env("AWS_PROFILE")
+	explicit := profile != ""
+	if !explicit {
+		profile = "default"
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &requestError{fmt.Errorf("read AWS credentials: %v", err)}
+	}
+	section := parseINISection(data, profile)
+	if section["aws_access_key_id"] == "" {
+		if explicit {
+			return nil, &requestError{fmt.Errorf("read AWS credentials %s: no access key for profile %q", path, profile)}
+		}
+		return nil, nil
+	}
+	return &cloudCredentials{
+		accessKeyID:     section["aws_access_key_id"],
+		secretAccessKey: section["aws_secret_access_key"],
+		sessionToken:    section["aws_session_token"],
+	}, nil
+}
+
+// parseINISection returns the keys and values in the named section of
+// an INI file.
+func parseINISection(data []byte, name string) map[string]string {
+	m := make(map[string]string)
+	in := false
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			in = strings.TrimSpace(line[1:len(line)-1]) == name
+			continue
+		}
+		if !in {
+			continue
+		}
+		if i := strings.IndexByte(line, '='); i != -1 {
+			m[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+		}
+	}
+	return m
+}
+
+// ec2Credentials obtains the credentials of the instance's IAM role
+// from the EC2 instance metadata service (IMDSv2).
+func (d *Downloader) ec2Credentials(ctx context.Context) (*cloudCredentials, error) {
+	endpoint := d.env("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = defaultEC2Metadata
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	token, err := metadataRequest(ctx, http.MethodPut, endpoint+"/latest/api/token", http.Header{
+		"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {ec2MetadataTokenTTL},
+	})
+	if err != nil {
+		return nil, err
+	}
+	tokenHeader := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	const credsPath = "/latest/meta-data/iam/security-credentials/"
+	roles, err := metadataRequest(ctx, http.MethodGet, endpoint+credsPath, tokenHeader)
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(string(roles))
+	if i := strings.IndexByte(role, '\n'); i != -1 {
+		role = role[:i]
+	}
+	if role == "" {
+		return nil, nil
+	}
+	data, err := metadataRequest(ctx, http.MethodGet, endpoint+credsPath+role, tokenHeader)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("EC2 role credentials: %v", err)
+	}
+	return &cloudCredentials{
+		accessKeyID:     resp.AccessKeyID,
+		secretAccessKey: resp.SecretAccessKey,
+		sessionToken:    resp.Token,
+		expires:         resp.Expiration,
+	}, nil
+}
@@ -0,0 +1,203 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package facts gathers information about a host for server-side
+// catalog generation.
+package facts
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Facts describes a host.
+type Facts struct {
+	Hostname string `json:"hostname"`
+
+	// OS and Arch are the values of runtime.GOOS and runtime.GOARCH.
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+
+	CPUs int `json:"cpus"`
+
+	// Addrs lists the IP addresses of the host's interfaces, except for
+	// loopback and link-local addresses.
+	Addrs []string `json:"addrs,omitempty"`
+
+	// OSRelease holds the variables in /etc/os-release, like ID and
+	// VERSION_ID, on systems that have it.
+	OSRelease map[string]string `json:"os_release,omitempty"`
+
+	// Custom holds the contents of each NAME.json file in the custom
+	// facts directory, keyed by NAME.
+	Custom map[string]json.RawMessage `json:"custom,omitempty"`
+}
+
+// Gather collects the facts of the local host.  customDir is a
+// directory of NAME.json files to add as custom facts, or empty for
+// none.  A missing customDir is not an error.
+func Gather(customDir string) (*Facts, error) {
+	return gather("/etc/os-release", customDir)
+}
+
+func gather(osReleasePath, customDir string) (*Facts, error) {
+	f := &Facts{
+		OS:   runtime.GOOS,
+		Arch: runtime.GOARCH,
+		CPUs: runtime.NumCPU(),
+	}
+	var err error
+	if f.Hostname, err = os.Hostname(); err != nil {
+		return nil, fmt.Errorf("gather facts: %v", err)
+	}
+	if f.Addrs, err = interfaceAddrs(); err != nil {
+		return nil, fmt.Errorf("gather facts: %v", err)
+	}
+	if data, err := ioutil.ReadFile(osReleasePath); err == nil {
+		f.OSRelease = parseOSRelease(data)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("gather facts: %v", err)
+	}
+	if customDir != "" {
+		if f.Custom, err = readCustom(customDir); err != nil {
+			return nil, fmt.Errorf("gather facts: %v", err)
+		}
+	}
+	return f, nil
+}
+
+func interfaceAddrs() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		list = append(list, ipnet.IP.String())
+	}
+	return list, nil
+}
+
+// parseOSRelease parses the shell-style variable assignments of an
+// os-release file.
+func parseOSRelease(data []byte) map[string]string {
+	m := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			continue
+		}
+		k, v := line[:i], line[i+1:]
+		switch {
+		case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+			if u, err := strconv.Unquote(v); err == nil {
+				v = u
+			} else {
+				v = v[1 : len(v)-1]
+			}
+		case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+			v = v[1 : len(v)-1]
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// readCustom reads the NAME.json files in dir.
+func readCustom(dir string) (map[string]json.RawMessage, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+	m := make(map[string]json.RawMessage, len(names))
+	for _, path := range names {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var raw json.RawMessage
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("custom fact %s: not valid JSON", path)
+		}
+		m[strings.TrimSuffix(filepath.Base(path), ".json")] = json.RawMessage(bytes.TrimSpace(data))
+	}
+	return m, nil
+}
+
+// VarPrefix is the prefix of the variable names that Vars returns.
+const VarPrefix = "facts."
+
+// Vars flattens the facts into variables for exec commands, named by
+// their JSON keys joined with dots and prefixed with VarPrefix, like
+// "facts.hostname", "facts.os_release.ID", or "facts.custom.rack".
+// Array elements are named by their index, like "facts.addrs.0".
+// Strings are used as is, numbers and booleans are formatted as JSON,
+// and nulls are omitted.
+func (f *Facts) Vars() (map[string]string, error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return nil, fmt.Errorf("facts variables: %v", err)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, fmt.Errorf("facts variables: %v", err)
+	}
+	vars := make(map[string]string)
+	flatten(vars, strings.TrimSuffix(VarPrefix, "."), v)
+	return vars, nil
+}
+
+func flatten(vars map[string]string, name string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, elem := range v {
+			flatten(vars, name+"."+k, elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			flatten(vars, name+"."+strconv.Itoa(i), elem)
+		}
+	case string:
+		vars[name] = v
+	case json.Number:
+		vars[name] = v.String()
+	case bool:
+		vars[name] = strconv.FormatBool(v)
+	}
+}
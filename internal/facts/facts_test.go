@@ -0,0 +1,119 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package facts
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestGather(t *testing.T) {
+	dir, err := ioutil.TempDir("", "facts_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	osRelease := filepath.Join(dir, "os-release")
+	err = ioutil.WriteFile(osRelease, []byte("# comment\nNAME=\"Debian GNU/Linux\"\nID=debian\nVERSION_ID='9'\n\nPRETTY_NAME=\"Debian \\\"stretch\\\"\"\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	customDir := filepath.Join(dir, "facts.d")
+	if err := os.Mkdir(customDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(customDir, "rack.json"), []byte("\"r12\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(customDir, "notes.txt"), []byte("ignored"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := gather(osRelease, customDir)
+	if err != nil {
+		t.Fatal("gather:", err)
+	}
+	host, _ := os.Hostname()
+	if f.Hostname != host || f.OS != runtime.GOOS || f.Arch != runtime.GOARCH || f.CPUs != runtime.NumCPU() {
+		t.Errorf("facts = %+v; want hostname %q, os %q, arch %q, cpus %d", f, host, runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+	}
+	wantRelease := map[string]string{
+		"NAME":        "Debian GNU/Linux",
+		"ID":          "debian",
+		"VERSION_ID":  "9",
+		"PRETTY_NAME": `Debian "stretch"`,
+	}
+	if !reflect.DeepEqual(f.OSRelease, wantRelease) {
+		t.Errorf("OSRelease = %q; want %q", f.OSRelease, wantRelease)
+	}
+	wantCustom := map[string]json.RawMessage{"rack": json.RawMessage(`"r12"`)}
+	if !reflect.DeepEqual(f.Custom, wantCustom) {
+		t.Errorf("Custom = %s; want %s", f.Custom, wantCustom)
+	}
+
+	f, err = gather(filepath.Join(dir, "nope"), filepath.Join(dir, "nope.d"))
+	if err != nil {
+		t.Fatal("gather without os-release or custom facts:", err)
+	}
+	if f.OSRelease != nil || f.Custom != nil {
+		t.Errorf("facts = %+v; want no OSRelease or Custom", f)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(customDir, "bad.json"), []byte("{"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gather(osRelease, customDir); err == nil {
+		t.Error("gather with invalid custom fact did not return an error")
+	}
+}
+
+func TestVars(t *testing.T) {
+	f := &Facts{
+		Hostname:  "web1",
+		OS:        "linux",
+		Arch:      "amd64",
+		CPUs:      4,
+		Addrs:     []string{"10.0.0.2", "10.0.1.2"},
+		OSRelease: map[string]string{"ID": "debian"},
+		Custom: map[string]json.RawMessage{
+			"rack": json.RawMessage(`"r12"`),
+			"db":   json.RawMessage(`{"primary": true, "port": 5432, "replicas": null}`),
+		},
+	}
+	got, err := f.Vars()
+	if err != nil {
+		t.Fatal("Vars:", err)
+	}
+	want := map[string]string{
+		"facts.hostname":          "web1",
+		"facts.os":                "linux",
+		"facts.arch":              "amd64",
+		"facts.cpus":              "4",
+		"facts.addrs.0":           "10.0.0.2",
+		"facts.addrs.1":           "10.0.1.2",
+		"facts.os_release.ID":     "debian",
+		"facts.custom.rack":       "r12",
+		"facts.custom.db.primary": "true",
+		"facts.custom.db.port":    "5432",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Vars() = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package features records the optional subsystems that a binary was
+// built with.  Subsystems that can be left out with build tags, like
+// mcm_nocloud, register themselves from an init function, so that a
+// minimal build can report what it is able to do.
+package features
+
+import (
+	"sort"
+	"sync"
+)
+
+var (
+	mu    sync.Mutex
+	names []string
+)
+
+// Register records that the named feature is compiled in.  It is
+// intended to be called from init functions.
+func Register(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, n := range names {
+		if n == name {
+			return
+		}
+	}
+	names = append(names, name)
+}
+
+// List returns the names of the compiled-in features, sorted.
+func List() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	list := append([]string(nil), names...)
+	sort.Strings(list)
+	return list
+}
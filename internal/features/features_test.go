@@ -0,0 +1,31 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package features
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	defer func(old []string) { names = old }(names)
+	names = nil
+	Register("http")
+	Register("cloud")
+	Register("http")
+	if got, want := List(), []string{"cloud", "http"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package history
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+)
+
+// CommandUsage describes the arguments accepted by Command.
+const CommandUsage = `history list
+history show [ID]
+history diff ID1 [ID2]`
+
+// ErrUsage is returned by Command when its arguments are invalid.
+var ErrUsage = errors.New("usage: " + CommandUsage)
+
+// Command runs a history subcommand, writing its output to w.  args
+// does not include the "history" keyword.
+//
+// "list" prints a summary of each run.  "show" prints the outcome of
+// each resource in a run, defaulting to the latest run.  "diff" prints
+// the resources whose status differs between two runs, defaulting to
+// comparing against the latest run.
+func Command(w io.Writer, s *Store, args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return ErrUsage
+		}
+		return list(w, s)
+	case "show":
+		if len(args) > 2 {
+			return ErrUsage
+		}
+		id, err := argOrLatest(s, args[1:])
+		if err != nil {
+			return err
+		}
+		r, err := s.Load(id)
+		if err != nil {
+			return err
+		}
+		return show(w, id, r)
+	case "diff":
+		if len(args) != 2 && len(args) != 3 {
+			return ErrUsage
+		}
+		old, err := s.Load(args[1])
+		if err != nil {
+			return err
+		}
+		newID, err := argOrLatest(s, args[2:])
+		if err != nil {
+			return err
+		}
+		new, err := s.Load(newID)
+		if err != nil {
+			return err
+		}
+		return diff(w, Diff(old, new))
+	default:
+		return ErrUsage
+	}
+}
+
+func argOrLatest(s *Store, args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	return s.Latest()
+}
+
+func list(w io.Writer, s *Store) error {
+	ids, err := s.List()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTART\tDURATION\tCHANGED\tFAILED\tSKIPPED")
+	for _, id := range ids {
+		r, err := s.Load(id)
+		if err != nil {
+			return err
+		}
+		sum := r.Summarize()
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%d\t%d\t%d\n",
+			id,
+			r.Start.Local().Format(time.RFC3339),
+			sum.Duration,
+			sum.Changed,
+			sum.Failed,
+			sum.Skipped)
+	}
+	return tw.Flush()
+}
+
+func show(w io.Writer, id string, r *execlib.Report) error {
+	fmt.Fprintf(w, "run %s\nstart: %s\nend:   %s\n", id, r.Start.Local().Format(time.RFC3339), r.End.Local().Format(time.RFC3339))
+	if r.Seed != 0 {
+		fmt.Fprintf(w, "seed:  %d\n", r.Seed)
+	}
+	for i, p := range r.Provenance {
+		if p == nil {
+			continue
+		}
+		if len(r.Provenance) == 1 {
+			fmt.Fprintf(w, "catalog: %v\n", p)
+		} else {
+			fmt.Fprintf(w, "catalog %d: %v\n", i, p)
+		}
+	}
+	if len(r.Pending) > 0 {
+		ids := make([]string, len(r.Pending))
+		for i, id := range r.Pending {
+			ids[i] = strconv.FormatUint(id, 10)
+		}
+		fmt.Fprintf(w, "pending: %s\n", strings.Join(ids, ", "))
+	}
+	fmt.Fprintf(w, "%v\n\n", r.Summarize())
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tID\tCOMMENT\tDURATION\tERROR")
+	for _, rr := range r.Resources {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\n", rr.Status, formatID(rr.Catalog, rr.ID), rr.Comment, rr.Duration, rr.Error)
+	}
+	return tw.Flush()
+}
+
+func diff(w io.Writer, changes []Change) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCOMMENT\tOLD\tNEW")
+	for _, c := range changes {
+		id := formatID(c.Catalog, c.ID)
+		if c.OldID != 0 {
+			id += fmt.Sprintf(" (was %d)", c.OldID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", id, c.Comment, statusOrAbsent(c.OldStatus), statusOrAbsent(c.NewStatus))
+	}
+	return tw.Flush()
+}
+
+// formatID formats a resource ID, prefixed with the index of its catalog
+// for all but the first catalog of a run.
+func formatID(catalog int, id uint64) string {
+	if catalog == 0 {
+		return strconv.FormatUint(id, 10)
+	}
+	return fmt.Sprintf("%d:%d", catalog, id)
+}
+
+func statusOrAbsent(s execlib.ResourceStatus) string {
+	if s == "" {
+		return "-"
+	}
+	return string(s)
+}
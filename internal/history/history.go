@@ -0,0 +1,250 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package history stores the reports of past runs on the local disk.
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+)
+
+// DefaultMax is the number of runs kept by a Store with a non-positive Max.
+const DefaultMax = 50
+
+const fileExt = ".json"
+
+// idFormat is the time layout used for run IDs.  IDs sort in
+// chronological order.
+const idFormat = "20060102T150405.000000000Z"
+
+// A Store is a directory of run reports, one JSON file per run.
+type Store struct {
+	Dir string
+
+	// Max is the number of runs to keep.  When a run is saved, the
+	// oldest runs beyond Max are deleted.
+	Max int
+}
+
+// Save adds a report to the store and returns its ID.
+func (s *Store) Save(r *execlib.Report) (id string, err error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", fmt.Errorf("save run: %v", err)
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return "", fmt.Errorf("save run: %v", err)
+	}
+	start := r.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	id = start.UTC().Format(idFormat)
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(s.path(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			// Two runs started within the same nanosecond; unlikely, but
+			// don't clobber.
+			id = fmt.Sprintf("%s-%d", start.UTC().Format(idFormat), i)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("save run: %v", err)
+		}
+		_, err = f.Write(data)
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return "", fmt.Errorf("save run %s: %v", id, err)
+		}
+		break
+	}
+	if err := s.prune(); err != nil {
+		return id, fmt.Errorf("save run %s: %v", id, err)
+	}
+	return id, nil
+}
+
+func (s *Store) prune() error {
+	ids, err := s.List()
+	if err != nil {
+		return err
+	}
+	max := s.Max
+	if max <= 0 {
+		max = DefaultMax
+	}
+	for len(ids) > max {
+		if err := os.Remove(s.path(ids[0])); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("prune: %v", err)
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// List returns the IDs of the stored runs, oldest first.  An empty or
+// missing directory has no runs.
+func (s *Store) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list runs: %v", err)
+	}
+	var ids []string
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, fileExt))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Latest returns the ID of the most recent run.
+func (s *Store) Latest() (string, error) {
+	ids, err := s.List()
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", errors.New("no runs in history")
+	}
+	return ids[len(ids)-1], nil
+}
+
+// Load reads the report of the run with the given ID.
+func (s *Store) Load(id string) (*execlib.Report, error) {
+	if id == "" || strings.ContainsRune(id, filepath.Separator) {
+		return nil, fmt.Errorf("load run %q: invalid ID", id)
+	}
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("load run %s: not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load run %s: %v", id, err)
+	}
+	r := new(execlib.Report)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("load run %s: %v", id, err)
+	}
+	return r, nil
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.Dir, id+fileExt)
+}
+
+// A Change is a resource whose outcome differs between two runs.
+// A status is empty if the resource does not appear in that run.
+type Change struct {
+	ID        uint64
+	Catalog   int
+	Comment   string
+	OldStatus execlib.ResourceStatus
+	NewStatus execlib.ResourceStatus
+
+	// OldID is the resource's ID in the old run if the resource
+	// replaced it in the new run, or zero otherwise.
+	OldID uint64
+}
+
+// changeKey identifies a resource across runs.
+type changeKey struct {
+	catalog int
+	id      uint64
+}
+
+// Diff compares two runs, returning the resources whose status differs
+// between them sorted by catalog, then ID.  A resource in the new run
+// that replaces a resource in the old run, and doesn't appear in the old
+// run under its own ID, is compared to the resource it replaces.
+func Diff(old, new *execlib.Report) []Change {
+	byID := make(map[changeKey]*Change)
+	for _, rr := range old.Resources {
+		byID[changeKey{rr.Catalog, rr.ID}] = &Change{ID: rr.ID, Catalog: rr.Catalog, Comment: rr.Comment, OldStatus: rr.Status}
+	}
+	inNew := make(map[changeKey]bool, len(new.Resources))
+	for _, rr := range new.Resources {
+		inNew[changeKey{rr.Catalog, rr.ID}] = true
+	}
+	for _, rr := range new.Resources {
+		k := changeKey{rr.Catalog, rr.ID}
+		c := byID[k]
+		if c == nil {
+			c = renamed(byID, inNew, rr)
+		}
+		if c == nil {
+			c = &Change{ID: rr.ID, Catalog: rr.Catalog}
+		}
+		byID[k] = c
+		c.Comment = rr.Comment
+		c.NewStatus = rr.Status
+	}
+	var changes []Change
+	for _, c := range byID {
+		if c.OldStatus != c.NewStatus {
+			changes = append(changes, *c)
+		}
+	}
+	sort.Sort(byCatalogID(changes))
+	return changes
+}
+
+type byCatalogID []Change
+
+func (a byCatalogID) Len() int      { return len(a) }
+func (a byCatalogID) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+
+func (a byCatalogID) Less(i, j int) bool {
+	if a[i].Catalog != a[j].Catalog {
+		return a[i].Catalog < a[j].Catalog
+	}
+	return a[i].ID < a[j].ID
+}
+
+// renamed finds the old run's change for a resource that rr replaces,
+// moving it to rr's ID.  It returns nil if rr doesn't replace a resource
+// that is only in the old run.
+func renamed(byID map[changeKey]*Change, inNew map[changeKey]bool, rr *execlib.ResourceReport) *Change {
+	for _, id := range rr.Replaces {
+		k := changeKey{rr.Catalog, id}
+		c := byID[k]
+		if c == nil || inNew[k] {
+			continue
+		}
+		delete(byID, k)
+		c.OldID, c.ID = id, rr.ID
+		return c
+	}
+	return nil
+}
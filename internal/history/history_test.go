@@ -0,0 +1,211 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package history
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Store{Dir: dir, Max: 2}
+	base := time.Date(2017, time.March, 1, 0, 0, 0, 0, time.UTC)
+	var ids []string
+	for i := 0; i < 3; i++ {
+		start := base.Add(time.Duration(i) * time.Minute)
+		id, err := s.Save(&execlib.Report{
+			Start: start,
+			End:   start.Add(time.Second),
+			Resources: []*execlib.ResourceReport{
+				{ID: uint64(i), Status: execlib.StatusChanged},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Save #%d: %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+
+	got, err := s.List()
+	if err != nil {
+		t.Fatal("List:", err)
+	}
+	if len(got) != 2 || got[0] != ids[1] || got[1] != ids[2] {
+		t.Errorf("List() = %q; want %q", got, ids[1:])
+	}
+	latest, err := s.Latest()
+	if err != nil {
+		t.Fatal("Latest:", err)
+	}
+	if latest != ids[2] {
+		t.Errorf("Latest() = %q; want %q", latest, ids[2])
+	}
+	r, err := s.Load(ids[2])
+	if err != nil {
+		t.Fatal("Load:", err)
+	}
+	if !r.Start.Equal(base.Add(2*time.Minute)) || len(r.Resources) != 1 || r.Resources[0].ID != 2 {
+		t.Errorf("Load(%q) = %+v; want run #2", ids[2], r)
+	}
+	if _, err := s.Load(ids[0]); err == nil {
+		t.Errorf("Load(%q) succeeded after pruning", ids[0])
+	}
+}
+
+func TestStoreEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Store{Dir: dir + "/missing"}
+	ids, err := s.List()
+	if err != nil || len(ids) != 0 {
+		t.Errorf("List() = %q, %v; want [], <nil>", ids, err)
+	}
+	if _, err := s.Latest(); err == nil {
+		t.Error("Latest succeeded on empty store")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := &execlib.Report{
+		Resources: []*execlib.ResourceReport{
+			{ID: 1, Status: execlib.StatusUnchanged},
+			{ID: 2, Status: execlib.StatusChanged},
+			{ID: 3, Status: execlib.StatusFailed},
+			{ID: 4, Status: execlib.StatusChanged},
+		},
+	}
+	new := &execlib.Report{
+		Resources: []*execlib.ResourceReport{
+			{ID: 1, Comment: "one", Status: execlib.StatusChanged},
+			{ID: 2, Status: execlib.StatusChanged},
+			{ID: 3, Status: execlib.StatusUnchanged},
+			{ID: 5, Status: execlib.StatusSkipped},
+			{ID: 1, Catalog: 1, Status: execlib.StatusFailed},
+		},
+	}
+	got := Diff(old, new)
+	want := []Change{
+		{ID: 1, Comment: "one", OldStatus: execlib.StatusUnchanged, NewStatus: execlib.StatusChanged},
+		{ID: 3, OldStatus: execlib.StatusFailed, NewStatus: execlib.StatusUnchanged},
+		{ID: 4, OldStatus: execlib.StatusChanged},
+		{ID: 5, NewStatus: execlib.StatusSkipped},
+		{ID: 1, Catalog: 1, NewStatus: execlib.StatusFailed},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Diff = %+v; want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Diff[%d] = %+v; want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDiffReplaces(t *testing.T) {
+	old := &execlib.Report{
+		Resources: []*execlib.ResourceReport{
+			{ID: 1, Status: execlib.StatusUnchanged},
+			{ID: 2, Status: execlib.StatusUnchanged},
+			{ID: 3, Status: execlib.StatusChanged},
+		},
+	}
+	new := &execlib.Report{
+		Resources: []*execlib.ResourceReport{
+			{ID: 1, Status: execlib.StatusUnchanged},
+			{ID: 20, Replaces: []uint64{2}, Status: execlib.StatusUnchanged},
+			{ID: 30, Replaces: []uint64{3}, Status: execlib.StatusFailed},
+			{ID: 10, Replaces: []uint64{1}, Status: execlib.StatusChanged},
+		},
+	}
+	got := Diff(old, new)
+	want := []Change{
+		{ID: 10, NewStatus: execlib.StatusChanged},
+		{ID: 30, OldID: 3, OldStatus: execlib.StatusChanged, NewStatus: execlib.StatusFailed},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Diff = %+v; want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Diff[%d] = %+v; want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Store{Dir: dir}
+	start := time.Date(2017, time.March, 1, 0, 0, 0, 0, time.UTC)
+	oldID, err := s.Save(&execlib.Report{
+		Start:     start,
+		End:       start.Add(time.Second),
+		Resources: []*execlib.ResourceReport{{ID: 42, Comment: "foo", Status: execlib.StatusChanged}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Save(&execlib.Report{
+		Start:      start.Add(time.Hour),
+		End:        start.Add(time.Hour + time.Second),
+		Resources:  []*execlib.ResourceReport{{ID: 42, Comment: "foo", Status: execlib.StatusUnchanged}},
+		Provenance: []*execlib.Provenance{{Generator: "mcm-luacat", SourceCommit: "abc123"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"list"}, []string{oldID}},
+		{[]string{"show"}, []string{"unchanged", "foo", "applied 1, changed 0, unchanged 1, failed 0, skipped 0 in 1.000s", "catalog: mcm-luacat at abc123"}},
+		{[]string{"show", oldID}, []string{"changed", "foo"}},
+		{[]string{"diff", oldID}, []string{"42", "changed", "unchanged"}},
+	}
+	for _, test := range tests {
+		out := new(bytes.Buffer)
+		if err := Command(out, s, test.args); err != nil {
+			t.Errorf("Command(%q): %v", test.args, err)
+			continue
+		}
+		for _, w := range test.want {
+			if !strings.Contains(out.String(), w) {
+				t.Errorf("Command(%q) output = %q; want to contain %q", test.args, out, w)
+			}
+		}
+	}
+	if err := Command(new(bytes.Buffer), s, []string{"bogus"}); err != ErrUsage {
+		t.Errorf("Command([bogus]) = %v; want ErrUsage", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+type fakeAWS struct {
+	pages  []string
+	params []url.Values
+}
+
+func (f *fakeAWS) AWSQuery(ctx context.Context, service, region string, params url.Values) ([]byte, error) {
+	if service != "ec2" || region != "us-west-2" {
+		return nil, errors.New("wrong service or region")
+	}
+	p := make(url.Values)
+	for k, v := range params {
+		p[k] = v
+	}
+	f.params = append(f.params, p)
+	page := f.pages[0]
+	f.pages = f.pages[1:]
+	return []byte(page), nil
+}
+
+func TestEC2(t *testing.T) {
+	client := &fakeAWS{pages: []string{
+		`<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+			<reservationSet><item><instancesSet>
+				<item>
+					<instanceId>i-0001</instanceId>
+					<privateIpAddress>10.0.0.1</privateIpAddress>
+					<ipAddress>203.0.113.1</ipAddress>
+					<tagSet>
+						<item><key>role</key><value>web</value></item>
+						<item><key>env</key><value>prod</value></item>
+					</tagSet>
+				</item>
+				<item>
+					<instanceId>i-0002</instanceId>
+					<privateIpAddress>10.0.0.2</privateIpAddress>
+					<tagSet><item><key>env</key><value>prod</value></item></tagSet>
+				</item>
+			</instancesSet></item></reservationSet>
+			<nextToken>page2</nextToken>
+		</DescribeInstancesResponse>`,
+		`<DescribeInstancesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+			<reservationSet><item><instancesSet>
+				<item>
+					<instanceId>i-0003</instanceId>
+					<privateIpAddress>10.0.0.3</privateIpAddress>
+					<ipAddress>203.0.113.3</ipAddress>
+					<tagSet><item><key>role</key><value>db</value></item></tagSet>
+				</item>
+			</instancesSet></item></reservationSet>
+		</DescribeInstancesResponse>`,
+	}}
+	e := &EC2{
+		Client:    client,
+		Region:    "us-west-2",
+		Tags:      map[string]string{"team": "infra"},
+		GroupKeys: []string{"role", "env"},
+	}
+	hosts, err := e.Hosts(context.Background())
+	if err != nil {
+		t.Fatal("Hosts:", err)
+	}
+	want := []*Host{
+		{Name: "i-0001", Addr: "10.0.0.1", Groups: []string{"web", "prod"}},
+		{Name: "i-0002", Addr: "10.0.0.2", Groups: []string{"prod"}},
+		{Name: "i-0003", Addr: "10.0.0.3", Groups: []string{"db"}},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Hosts = %+v; want %+v", hosts, want)
+	}
+	if len(client.params) != 2 {
+		t.Fatalf("sent %d requests; want 2", len(client.params))
+	}
+	p := client.params[0]
+	if p.Get("Action") != "DescribeInstances" || p.Get("Filter.1.Value.1") != "running" || p.Get("Filter.2.Name") != "tag:team" || p.Get("Filter.2.Value.1") != "infra" {
+		t.Errorf("first request params = %v; want DescribeInstances of running instances tagged team=infra", p)
+	}
+	if got := client.params[1].Get("NextToken"); got != "page2" {
+		t.Errorf("second request NextToken = %q; want \"page2\"", got)
+	}
+}
+
+func TestEC2PublicAddr(t *testing.T) {
+	client := &fakeAWS{pages: []string{`<DescribeInstancesResponse><reservationSet><item><instancesSet>
+		<item><instanceId>i-0001</instanceId><privateIpAddress>10.0.0.1</privateIpAddress><ipAddress>203.0.113.1</ipAddress></item>
+		<item><instanceId>i-0002</instanceId><privateIpAddress>10.0.0.2</privateIpAddress></item>
+	</instancesSet></item></reservationSet></DescribeInstancesResponse>`}}
+	e := &EC2{Client: client, Region: "us-west-2", PublicAddr: true}
+	hosts, err := e.Hosts(context.Background())
+	if err != nil {
+		t.Fatal("Hosts:", err)
+	}
+	want := []*Host{{Name: "i-0001", Addr: "203.0.113.1"}}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Hosts = %+v; want %+v", hosts, want)
+	}
+}
+
+type fakeGoogle map[string]string
+
+func (f fakeGoogle) GoogleAPI(ctx context.Context, u string) ([]byte, error) {
+	page, ok := f[u]
+	if !ok {
+		return nil, errors.New("not found: " + u)
+	}
+	return []byte(page), nil
+}
+
+func TestGCE(t *testing.T) {
+	const base = DefaultGCEEndpoint + "/projects/my-project"
+	client := fakeGoogle{
+		base + "/aggregated/instances": `{
+			"items": {
+				"zones/us-central1-b": {"instances": [
+					{"name": "db1", "status": "RUNNING", "labels": {"role": "db", "team": "infra"},
+					 "networkInterfaces": [{"networkIP": "10.128.0.3"}]}
+				]},
+				"zones/us-central1-a": {"instances": [
+					{"name": "web1", "status": "RUNNING", "labels": {"role": "web", "team": "infra"},
+					 "networkInterfaces": [{"networkIP": "10.128.0.1", "accessConfigs": [{"natIP": "203.0.113.1"}]}]},
+					{"name": "web2", "status": "TERMINATED", "labels": {"role": "web", "team": "infra"},
+					 "networkInterfaces": [{"networkIP": "10.128.0.2"}]}
+				]},
+				"zones/europe-west1-b": {"warning": {"code": "NO_RESULTS_ON_PAGE"}}
+			},
+			"nextPageToken": "page 2"
+		}`,
+		base + "/aggregated/instances?pageToken=page+2": `{
+			"items": {
+				"zones/us-central1-a": {"instances": [
+					{"name": "other", "status": "RUNNING", "labels": {"role": "web", "team": "apps"},
+					 "networkInterfaces": [{"networkIP": "10.128.0.9"}]}
+				]}
+			}
+		}`,
+		base + "/zones/us-central1-a/instances": `{
+			"items": [
+				{"name": "web1", "status": "RUNNING", "labels": {"role": "web"},
+				 "networkInterfaces": [{"networkIP": "10.128.0.1", "accessConfigs": [{"natIP": "203.0.113.1"}]}]},
+				{"name": "web3", "status": "RUNNING", "labels": {"role": "web"},
+				 "networkInterfaces": [{"networkIP": "10.128.0.4", "accessConfigs": [{}]}]}
+			]
+		}`,
+	}
+	g := &GCE{
+		Client:    client,
+		Project:   "my-project",
+		Labels:    map[string]string{"team": "infra"},
+		GroupKeys: []string{"role"},
+	}
+	hosts, err := g.Hosts(context.Background())
+	if err != nil {
+		t.Fatal("Hosts:", err)
+	}
+	want := []*Host{
+		{Name: "web1", Addr: "10.128.0.1", Groups: []string{"web"}},
+		{Name: "db1", Addr: "10.128.0.3", Groups: []string{"db"}},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Hosts = %+v; want %+v", hosts, want)
+	}
+
+	g = &GCE{Client: client, Project: "my-project", Zone: "us-central1-a", PublicAddr: true}
+	hosts, err = g.Hosts(context.Background())
+	if err != nil {
+		t.Fatal("Hosts (zone):", err)
+	}
+	want = []*Host{{Name: "web1", Addr: "203.0.113.1"}}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Hosts (zone) = %+v; want %+v", hosts, want)
+	}
+}
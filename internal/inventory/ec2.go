@@ -0,0 +1,115 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// An AWSClient sends requests to AWS query APIs.  *download.Downloader
+// implements AWSClient.
+type AWSClient interface {
+	AWSQuery(ctx context.Context, service, region string, params url.Values) ([]byte, error)
+}
+
+// EC2 is an Inventory of the running EC2 instances in a region.  Hosts
+// are named by their instance IDs.
+type EC2 struct {
+	Client AWSClient
+	Region string
+
+	// Tags limits the instances to those with the given tag values.
+	Tags map[string]string
+
+	// GroupKeys are the tags whose values become a host's groups.
+	GroupKeys []string
+
+	// PublicAddr connects to instances' public IP addresses instead of
+	// their private ones.
+	PublicAddr bool
+}
+
+// ec2APIVersion is the version of the EC2 API that requests use.
+const ec2APIVersion = "2016-11-15"
+
+// Hosts lists the instances by calling DescribeInstances.  Instances
+// without an address of the requested kind are left out.
+func (e *EC2) Hosts(ctx context.Context) ([]*Host, error) {
+	params := url.Values{
+		"Action":           {"DescribeInstances"},
+		"Version":          {ec2APIVersion},
+		"Filter.1.Name":    {"instance-state-name"},
+		"Filter.1.Value.1": {"running"},
+	}
+	keys := make([]string, 0, len(e.Tags))
+	for k := range e.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		n := strconv.Itoa(i + 2)
+		params.Set("Filter."+n+".Name", "tag:"+k)
+		params.Set("Filter."+n+".Value.1", e.Tags[k])
+	}
+	var hosts []*Host
+	for {
+		data, err := e.Client.AWSQuery(ctx, "ec2", e.Region, params)
+		if err != nil {
+			return nil, fmt.Errorf("list EC2 instances: %v", err)
+		}
+		var resp ec2DescribeInstances
+		if err := xml.Unmarshal(data, &resp); err != nil {
+			return nil, fmt.Errorf("list EC2 instances: %v", err)
+		}
+		for _, inst := range resp.Instances {
+			addr := inst.PrivateIP
+			if e.PublicAddr {
+				addr = inst.PublicIP
+			}
+			if addr == "" {
+				continue
+			}
+			tags := make(map[string]string, len(inst.Tags))
+			for _, t := range inst.Tags {
+				tags[t.Key] = t.Value
+			}
+			hosts = append(hosts, hostFromKeys(inst.ID, addr, tags, e.GroupKeys))
+		}
+		if resp.NextToken == "" {
+			return hosts, nil
+		}
+		params.Set("NextToken", resp.NextToken)
+	}
+}
+
+// ec2DescribeInstances is the part of a DescribeInstances response
+// that EC2 reads.
+type ec2DescribeInstances struct {
+	Instances []struct {
+		ID        string `xml:"instanceId"`
+		PrivateIP string `xml:"privateIpAddress"`
+		PublicIP  string `xml:"ipAddress"`
+		Tags      []struct {
+			Key   string `xml:"key"`
+			Value string `xml:"value"`
+		} `xml:"tagSet>item"`
+	} `xml:"reservationSet>item>instancesSet>item"`
+	NextToken string `xml:"nextToken"`
+}
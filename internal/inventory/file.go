@@ -0,0 +1,264 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ParseHostFile parses a JSON or YAML host file, which lists hosts with
+// the same fields as Host:
+//
+//	hosts:
+//	- name: web1.example.com
+//	  groups: [web, canary]
+//	  user: deploy
+//	- name: db1.example.com
+//	  port: 2222
+//	  groups:
+//	  - db
+//
+// or, equivalently in JSON:
+//
+//	{"hosts": [{"name": "web1.example.com", "groups": ["web", "canary"], ...}]}
+//
+// Only the subset of YAML needed for this structure is supported:
+// block mappings and sequences, flow sequences of scalars, plain and
+// quoted scalars, and comments.
+func ParseHostFile(r io.Reader) (HostList, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read host file: %v", err)
+	}
+	var hosts HostList
+	if t := bytes.TrimSpace(data); len(t) > 0 && t[0] == '{' {
+		var f struct {
+			Hosts HostList `json:"hosts"`
+		}
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("parse host file: %v", err)
+		}
+		hosts = f.Hosts
+	} else if hosts, err = parseYAMLHosts(data); err != nil {
+		return nil, fmt.Errorf("parse host file: %v", err)
+	}
+	seen := make(map[string]bool, len(hosts))
+	for i, h := range hosts {
+		if h == nil || h.Name == "" {
+			return nil, fmt.Errorf("parse host file: hosts[%d] has no name", i)
+		}
+		if seen[h.Name] {
+			return nil, fmt.Errorf("parse host file: host %s listed more than once", h.Name)
+		}
+		seen[h.Name] = true
+	}
+	return hosts, nil
+}
+
+// yamlLine is a non-blank, non-comment line of a YAML file.
+type yamlLine struct {
+	n      int
+	indent int
+	text   string
+}
+
+func parseYAMLHosts(data []byte) (HostList, error) {
+	var lines []yamlLine
+	for i, l := range strings.Split(string(data), "\n") {
+		text := strings.TrimRight(l, " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in indentation", i+1)
+		}
+		lines = append(lines, yamlLine{n: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	if lines[0].indent != 0 || lines[0].text != "hosts:" {
+		return nil, fmt.Errorf("line %d: expected \"hosts:\"", lines[0].n)
+	}
+	lines = lines[1:]
+	var hosts HostList
+	itemIndent := -1
+	var h *Host
+	keyIndent := 0
+	var listKey string
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l.text, "- ") && (itemIndent == -1 || l.indent == itemIndent):
+			itemIndent = l.indent
+			h = new(Host)
+			hosts = append(hosts, h)
+			// The item's first key sets the indentation of the rest.
+			entry := strings.TrimLeft(l.text[2:], " ")
+			keyIndent = l.indent + len(l.text) - len(entry)
+			key, value, err := splitYAMLKey(entry)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.n, err)
+			}
+			if listKey, err = setYAMLKey(h, key, value); err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.n, err)
+			}
+		case h == nil:
+			return nil, fmt.Errorf("line %d: expected a \"- \" list item", l.n)
+		case strings.HasPrefix(l.text, "- ") && listKey != "" && l.indent >= keyIndent:
+			v, err := parseYAMLScalar(strings.TrimLeft(l.text[2:], " "))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.n, err)
+			}
+			h.addGroup(v)
+		case l.indent == keyIndent:
+			key, value, err := splitYAMLKey(l.text)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.n, err)
+			}
+			if listKey, err = setYAMLKey(h, key, value); err != nil {
+				return nil, fmt.Errorf("line %d: %v", l.n, err)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.n)
+		}
+	}
+	return hosts, nil
+}
+
+// splitYAMLKey splits a "key: value" mapping entry.
+func splitYAMLKey(s string) (key, value string, err error) {
+	i := strings.Index(s, ":")
+	if i <= 0 || (i+1 < len(s) && s[i+1] != ' ') {
+		return "", "", fmt.Errorf("expected \"key: value\", found %q", s)
+	}
+	value = strings.TrimSpace(s[i+1:])
+	if strings.HasPrefix(value, "#") {
+		value = ""
+	}
+	return s[:i], value, nil
+}
+
+// setYAMLKey sets a field of h from a mapping entry.  If the entry
+// starts a block sequence, then setYAMLKey returns the key.
+func setYAMLKey(h *Host, key, value string) (listKey string, err error) {
+	if key == "groups" {
+		if value == "" {
+			return key, nil
+		}
+		groups, err := parseYAMLFlowSeq(value)
+		if err != nil {
+			return "", err
+		}
+		for _, g := range groups {
+			h.addGroup(g)
+		}
+		return "", nil
+	}
+	v, err := parseYAMLScalar(value)
+	if err != nil {
+		return "", err
+	}
+	if key == "name" {
+		if h.Name != "" {
+			return "", errors.New("name given more than once")
+		}
+		h.Name = v
+		return "", nil
+	}
+	return "", h.setValue(key, v)
+}
+
+// parseYAMLScalar parses a plain, single-quoted, or double-quoted
+// scalar, removing any trailing comment.
+func parseYAMLScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "'"):
+		end := -1
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '\'' {
+				i++
+				continue
+			}
+			end = i
+			break
+		}
+		if end == -1 || !isYAMLEnd(s[end+1:]) {
+			return "", fmt.Errorf("malformed quoted string %s", s)
+		}
+		return strings.Replace(s[1:end], "''", "'", -1), nil
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] == '"' {
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil || !isYAMLEnd(s[i+1:]) {
+					return "", fmt.Errorf("malformed quoted string %s", s)
+				}
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("malformed quoted string %s", s)
+	case strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{"):
+		return "", fmt.Errorf("unexpected collection %s", s)
+	}
+	if i := strings.Index(s, " #"); i != -1 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// isYAMLEnd reports whether s is empty or a comment.
+func isYAMLEnd(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || strings.HasPrefix(s, "#")
+}
+
+// parseYAMLFlowSeq parses a flow sequence of scalars, like "[a, 'b']".
+func parseYAMLFlowSeq(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") {
+		return nil, fmt.Errorf("expected a list, found %q", s)
+	}
+	end := strings.LastIndex(s, "]")
+	if end == -1 || !isYAMLEnd(s[end+1:]) {
+		return nil, fmt.Errorf("malformed list %s", s)
+	}
+	inner := strings.TrimSpace(s[1:end])
+	if inner == "" {
+		return nil, nil
+	}
+	var list []string
+	for _, item := range strings.Split(inner, ",") {
+		v, err := parseYAMLScalar(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseHostFile(t *testing.T) {
+	want := HostList{
+		{Name: "web1.example.com", Groups: []string{"web", "canary"}, User: "deploy"},
+		{Name: "db1.example.com", Groups: []string{"db", "backup"}, Port: 2222, Exec: "/usr/local/bin/mcm-exec"},
+		{Name: "it's", Addr: "10.0.0.3", Identity: "/etc/mcm/key #1"},
+	}
+	tests := []struct {
+		name string
+		text string
+	}{
+		{
+			name: "YAML",
+			text: `# Hosts to push to.
+hosts:
+- name: web1.example.com
+  groups: [web, "canary"]
+  user: deploy  # for ssh
+- name: db1.example.com
+  port: 2222
+  groups:
+  - db
+  - 'backup'
+  exec: /usr/local/bin/mcm-exec
+
+- name: 'it''s'
+  addr: "10.0.0.3"
+  identity: "/etc/mcm/key #1"
+`,
+		},
+		{
+			name: "IndentedYAML",
+			text: `hosts:
+  -   name: web1.example.com
+      groups: [web, canary]
+      user: deploy
+  - name: db1.example.com
+    port: 2222
+    groups:
+      - db
+      - backup
+    exec: /usr/local/bin/mcm-exec
+  - name: it's
+    addr: 10.0.0.3
+    identity: '/etc/mcm/key #1'
+`,
+		},
+		{
+			name: "JSON",
+			text: `{"hosts": [
+	{"name": "web1.example.com", "groups": ["web", "canary"], "user": "deploy"},
+	{"name": "db1.example.com", "groups": ["db", "backup"], "port": 2222, "exec": "/usr/local/bin/mcm-exec"},
+	{"name": "it's", "addr": "10.0.0.3", "identity": "/etc/mcm/key #1"}
+]}`,
+		},
+	}
+	for _, test := range tests {
+		hosts, err := ParseHostFile(strings.NewReader(test.text))
+		if err != nil {
+			t.Errorf("%s: ParseHostFile: %v", test.name, err)
+			continue
+		}
+		if len(hosts) != len(want) {
+			t.Errorf("%s: len(hosts) = %d; want %d", test.name, len(hosts), len(want))
+			continue
+		}
+		for i := range want {
+			if !reflect.DeepEqual(hosts[i], want[i]) {
+				t.Errorf("%s: hosts[%d] = %+v; want %+v", test.name, i, hosts[i], want[i])
+			}
+		}
+	}
+}
+
+func TestParseHostFileErrors(t *testing.T) {
+	tests := []string{
+		"servers:\n- name: foo\n",
+		"hosts:\n- user: deploy\n",
+		"hosts:\n- name: foo\n- name: foo\n",
+		"hosts:\n- name: foo\n    user: deploy\n",
+		"hosts:\n- name: foo\n  color: blue\n",
+		"hosts:\n- name: foo\n  port: http\n",
+		"hosts:\n- name: foo\n  user: 'deploy\n",
+		"hosts:\n- name: foo\n  groups: web\n",
+		"hosts:\n- name: foo\n  name: bar\n",
+		"hosts:\nname: foo\n",
+		`{"hosts": [{"name": ""}]}`,
+		`{"hosts": [{"name": "foo", "port": "22"}]}`,
+	}
+	for _, text := range tests {
+		if _, err := ParseHostFile(strings.NewReader(text)); err == nil {
+			t.Errorf("ParseHostFile(%q) did not return an error", text)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// A GoogleClient sends requests to Google Cloud APIs.
+// *download.Downloader implements GoogleClient.
+type GoogleClient interface {
+	GoogleAPI(ctx context.Context, u string) ([]byte, error)
+}
+
+// GCE is an Inventory of the running Compute Engine instances in a
+// project.  Hosts are named by their instance names.
+type GCE struct {
+	Client  GoogleClient
+	Project string
+
+	// Zone limits the instances to a single zone.  If empty, then
+	// instances in every zone are listed.
+	Zone string
+
+	// Labels limits the instances to those with the given label values.
+	Labels map[string]string
+
+	// GroupKeys are the labels whose values become a host's groups.
+	GroupKeys []string
+
+	// PublicAddr connects to instances' external IP addresses instead
+	// of their internal ones.
+	PublicAddr bool
+
+	// Endpoint is the base URL of the Compute Engine API.  If empty,
+	// then DefaultGCEEndpoint is used.
+	Endpoint string
+}
+
+// DefaultGCEEndpoint is the default value of GCE.Endpoint.
+const DefaultGCEEndpoint = "https://compute.googleapis.com/compute/v1"
+
+// Hosts lists the instances.  Instances without an address of the
+// requested kind are left out.
+func (g *GCE) Hosts(ctx context.Context) ([]*Host, error) {
+	endpoint := g.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultGCEEndpoint
+	}
+	base := strings.TrimSuffix(endpoint, "/") + "/projects/" + escapeSegment(g.Project)
+	if g.Zone != "" {
+		base += "/zones/" + escapeSegment(g.Zone) + "/instances"
+	} else {
+		base += "/aggregated/instances"
+	}
+	var hosts []*Host
+	pageToken := ""
+	for {
+		u := base
+		if pageToken != "" {
+			u += "?pageToken=" + url.QueryEscape(pageToken)
+		}
+		data, err := g.Client.GoogleAPI(ctx, u)
+		if err != nil {
+			return nil, fmt.Errorf("list GCE instances: %v", err)
+		}
+		var resp gceInstanceList
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return nil, fmt.Errorf("list GCE instances: %v", err)
+		}
+		instances := resp.Items.instances
+		// Aggregated lists are keyed by zone.  Sort them so that the
+		// host order is stable.
+		zones := make([]string, 0, len(resp.Items.zones))
+		for z := range resp.Items.zones {
+			zones = append(zones, z)
+		}
+		sort.Strings(zones)
+		for _, z := range zones {
+			instances = append(instances, resp.Items.zones[z].Instances...)
+		}
+		for _, inst := range instances {
+			if inst.Status != "RUNNING" || !matches(inst.Labels, g.Labels) {
+				continue
+			}
+			var addr string
+			if len(inst.NetworkInterfaces) > 0 {
+				ni := inst.NetworkInterfaces[0]
+				if !g.PublicAddr {
+					addr = ni.NetworkIP
+				} else if len(ni.AccessConfigs) > 0 {
+					addr = ni.AccessConfigs[0].NatIP
+				}
+			}
+			if addr == "" {
+				continue
+			}
+			hosts = append(hosts, hostFromKeys(inst.Name, addr, inst.Labels, g.GroupKeys))
+		}
+		if resp.NextPageToken == "" {
+			return hosts, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// escapeSegment escapes s for use as one segment of a URL path.
+func escapeSegment(s string) string {
+	return strings.Replace((&url.URL{Path: s}).EscapedPath(), "/", "%2F", -1)
+}
+
+// gceInstanceList is the part of an instances list or aggregated list
+// response that GCE reads.
+type gceInstanceList struct {
+	Items         gceItems `json:"items"`
+	NextPageToken string   `json:"nextPageToken"`
+}
+
+type gceInstance struct {
+	Name              string            `json:"name"`
+	Status            string            `json:"status"`
+	Labels            map[string]string `json:"labels"`
+	NetworkInterfaces []struct {
+		NetworkIP     string `json:"networkIP"`
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+	} `json:"networkInterfaces"`
+}
+
+// gceItems is the items field of either a zone's list, which is an
+// array of instances, or an aggregated list, which is an object keyed
+// by zone.
+type gceItems struct {
+	instances []gceInstance
+	zones     map[string]struct {
+		Instances []gceInstance `json:"instances"`
+	}
+}
+
+func (items *gceItems) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, &items.instances)
+	}
+	return json.Unmarshal(data, &items.zones)
+}
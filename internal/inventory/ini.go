@@ -0,0 +1,118 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ParseINI parses an INI-style inventory file.  Each non-blank line that
+// doesn't start with "#" is either a "[GROUP]" header or a host name
+// followed by KEY=VALUE settings:
+//
+//	[web]
+//	web1.example.com user=deploy identity=/etc/mcm/deploy_key
+//	web2.example.com addr=10.0.0.2 port=2222
+//
+//	[db]
+//	db1.example.com user=root exec=/usr/local/bin/mcm-exec
+//
+// A host may be listed in several groups.  Settings from each line are
+// merged, and a setting may not be given two different values.  Hosts
+// before the first header are in no group.
+func ParseINI(r io.Reader) (HostList, error) {
+	var hosts HostList
+	byName := make(map[string]*Host)
+	group := ""
+	s := bufio.NewScanner(r)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) == 2 {
+				return nil, fmt.Errorf("inventory line %d: malformed group header %q", lineno, line)
+			}
+			group = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		fields := strings.Fields(line)
+		h := byName[fields[0]]
+		if h == nil {
+			h = &Host{Name: fields[0]}
+			byName[h.Name] = h
+			hosts = append(hosts, h)
+		}
+		h.addGroup(group)
+		for _, f := range fields[1:] {
+			if err := h.set(f); err != nil {
+				return nil, fmt.Errorf("inventory line %d: %s: %v", lineno, h.Name, err)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("read inventory: %v", err)
+	}
+	return hosts, nil
+}
+
+// set applies a KEY=VALUE setting to h.
+func (h *Host) set(setting string) error {
+	i := strings.IndexByte(setting, '=')
+	if i <= 0 {
+		return fmt.Errorf("setting %q is not in the form KEY=VALUE", setting)
+	}
+	return h.setValue(setting[:i], setting[i+1:])
+}
+
+// setValue sets the field of h named by key, returning an error if it
+// was already set to a different value.
+func (h *Host) setValue(key, value string) error {
+	var dst *string
+	switch key {
+	case "addr":
+		dst = &h.Addr
+	case "user":
+		dst = &h.User
+	case "identity":
+		dst = &h.Identity
+	case "exec":
+		dst = &h.Exec
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %q", value)
+		}
+		if h.Port != 0 && h.Port != port {
+			return fmt.Errorf("port given as both %d and %d", h.Port, port)
+		}
+		h.Port = port
+		return nil
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	if *dst != "" && *dst != value {
+		return fmt.Errorf("%s given as both %q and %q", key, *dst, value)
+	}
+	*dst = value
+	return nil
+}
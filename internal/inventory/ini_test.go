@@ -0,0 +1,99 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseINI(t *testing.T) {
+	const text = `# Hosts
+bastion.example.com
+
+[web]
+web1.example.com user=deploy identity=/etc/mcm/key
+web2.example.com addr=10.0.0.2 port=2222
+
+[db]
+db1.example.com exec=/usr/local/bin/mcm-exec
+[ canary ]
+web2.example.com user=deploy
+`
+	hosts, err := ParseINI(strings.NewReader(text))
+	if err != nil {
+		t.Fatal("ParseINI:", err)
+	}
+	want := []*Host{
+		{Name: "bastion.example.com"},
+		{Name: "web1.example.com", Groups: []string{"web"}, User: "deploy", Identity: "/etc/mcm/key"},
+		{Name: "web2.example.com", Groups: []string{"web", "canary"}, Addr: "10.0.0.2", Port: 2222, User: "deploy"},
+		{Name: "db1.example.com", Groups: []string{"db"}, Exec: "/usr/local/bin/mcm-exec"},
+	}
+	if len(hosts) != len(want) {
+		t.Fatalf("len(hosts) = %d; want %d", len(hosts), len(want))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(hosts[i], want[i]) {
+			t.Errorf("hosts[%d] = %+v; want %+v", i, hosts[i], want[i])
+		}
+	}
+
+	tests := []struct {
+		groups []string
+		want   []string
+	}{
+		{nil, []string{"bastion.example.com", "web1.example.com", "web2.example.com", "db1.example.com"}},
+		{[]string{"web"}, []string{"web1.example.com", "web2.example.com"}},
+		{[]string{"canary", "db"}, []string{"web2.example.com", "db1.example.com"}},
+		{[]string{"bastion.example.com"}, []string{"bastion.example.com"}},
+	}
+	for _, test := range tests {
+		sel, err := Select(hosts, test.groups)
+		if err != nil {
+			t.Errorf("Select(hosts, %q): %v", test.groups, err)
+			continue
+		}
+		var names []string
+		for _, h := range sel {
+			names = append(names, h.Name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("Select(hosts, %q) = %q; want %q", test.groups, names, test.want)
+		}
+	}
+	if _, err := Select(hosts, []string{"nope"}); err == nil {
+		t.Error("Select(hosts, [\"nope\"]) did not return an error")
+	}
+}
+
+func TestParseINIErrors(t *testing.T) {
+	tests := []string{
+		"[web\nfoo\n",
+		"[]\n",
+		"foo bar\n",
+		"foo color=blue\n",
+		"foo port=http\n",
+		"foo port=70000\n",
+		"foo user=a\n[web]\nfoo user=b\n",
+		"foo port=22\nfoo port=23\n",
+	}
+	for _, text := range tests {
+		if _, err := ParseINI(strings.NewReader(text)); err == nil {
+			t.Errorf("ParseINI(%q) did not return an error", text)
+		}
+	}
+}
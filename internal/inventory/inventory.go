@@ -0,0 +1,203 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package inventory lists the hosts that catalogs are applied to, from
+// files or from cloud provider APIs, along with the groups that decide
+// which catalog each host gets.
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/internal/download"
+)
+
+// A Host is a machine to apply catalogs to.
+type Host struct {
+	// Name identifies the host in reports.  It is also the address to
+	// connect to unless Addr is set.
+	Name string `json:"name"`
+
+	// Groups are the groups that the host is in, in the order they
+	// were listed by the inventory.
+	Groups []string `json:"groups,omitempty"`
+
+	Addr     string `json:"addr,omitempty"`
+	User     string `json:"user,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Identity string `json:"identity,omitempty"`
+
+	// Exec is the path of mcm-exec on the host.  If empty, then the
+	// runner's default is used.
+	Exec string `json:"exec,omitempty"`
+}
+
+// InGroup reports whether h is a member of group.
+func (h *Host) InGroup(group string) bool {
+	for _, g := range h.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// addGroup adds group to h's groups if it isn't already there.
+func (h *Host) addGroup(group string) {
+	if group != "" && !h.InGroup(group) {
+		h.Groups = append(h.Groups, group)
+	}
+}
+
+// An Inventory is a source of hosts.
+type Inventory interface {
+	Hosts(ctx context.Context) ([]*Host, error)
+}
+
+// HostList is a fixed Inventory.
+type HostList []*Host
+
+// Hosts returns l.
+func (l HostList) Hosts(ctx context.Context) ([]*Host, error) {
+	return l, nil
+}
+
+// Select returns the hosts that are in any of the groups, or all of the
+// hosts if groups is empty.  Host names are also accepted as groups.
+func Select(hosts []*Host, groups []string) ([]*Host, error) {
+	if len(groups) == 0 {
+		return hosts, nil
+	}
+	var sel []*Host
+	for _, h := range hosts {
+		for _, g := range groups {
+			if h.Name == g || h.InGroup(g) {
+				sel = append(sel, h)
+				break
+			}
+		}
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("no hosts in %s", strings.Join(groups, ", "))
+	}
+	return sel, nil
+}
+
+// Options is the set of optional parameters for Open.  They apply to
+// cloud inventories only.
+type Options struct {
+	// Filters limits the hosts to those whose tags (EC2) or labels
+	// (GCE) have the given values.
+	Filters map[string]string
+
+	// GroupKeys are the tags or labels whose values become the groups
+	// of a host.
+	GroupKeys []string
+
+	// PublicAddr connects to hosts' public IP addresses instead of
+	// their private ones.
+	PublicAddr bool
+
+	// Downloader sends the cloud API requests.  If nil, then the zero
+	// Downloader is used.
+	Downloader *download.Downloader
+}
+
+// Open returns the inventory described by spec, which is one of:
+//
+//	ec2:REGION            running EC2 instances in REGION
+//	gce:PROJECT[/ZONE]    running Compute Engine instances
+//	FILE.json, FILE.yaml  a host file (see ParseHostFile)
+//	FILE                  an INI-style inventory (see ParseINI)
+//
+// Files are read when Open is called.
+func Open(spec string, opts *Options) (Inventory, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	d := opts.Downloader
+	if d == nil {
+		d = new(download.Downloader)
+	}
+	switch {
+	case strings.HasPrefix(spec, "ec2:"):
+		region := strings.TrimPrefix(spec, "ec2:")
+		if region == "" {
+			return nil, fmt.Errorf("inventory %q: missing region", spec)
+		}
+		return &EC2{
+			Client:     d,
+			Region:     region,
+			Tags:       opts.Filters,
+			GroupKeys:  opts.GroupKeys,
+			PublicAddr: opts.PublicAddr,
+		}, nil
+	case strings.HasPrefix(spec, "gce:"):
+		project, zone := strings.TrimPrefix(spec, "gce:"), ""
+		if i := strings.IndexByte(project, '/'); i != -1 {
+			project, zone = project[:i], project[i+1:]
+		}
+		if project == "" {
+			return nil, fmt.Errorf("inventory %q: missing project", spec)
+		}
+		return &GCE{
+			Client:     d,
+			Project:    project,
+			Zone:       zone,
+			Labels:     opts.Filters,
+			GroupKeys:  opts.GroupKeys,
+			PublicAddr: opts.PublicAddr,
+		}, nil
+	}
+	f, err := os.Open(spec)
+	if err != nil {
+		return nil, fmt.Errorf("read inventory: %v", err)
+	}
+	defer f.Close()
+	var hosts HostList
+	switch filepath.Ext(spec) {
+	case ".json", ".yaml", ".yml":
+		hosts, err = ParseHostFile(f)
+	default:
+		hosts, err = ParseINI(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", spec, err)
+	}
+	return hosts, nil
+}
+
+// hostFromKeys returns a host with the groups named by the values of
+// keys in m.
+func hostFromKeys(name, addr string, m map[string]string, keys []string) *Host {
+	h := &Host{Name: name, Addr: addr}
+	for _, k := range keys {
+		h.addGroup(m[k])
+	}
+	return h
+}
+
+// matches reports whether m has every key and value in filters.
+func matches(m map[string]string, filters map[string]string) bool {
+	for k, v := range filters {
+		if got, ok := m[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inventory
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	iniPath := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(iniPath, []byte("[web]\nweb1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	yamlPath := filepath.Join(dir, "hosts.yaml")
+	if err := ioutil.WriteFile(yamlPath, []byte("hosts:\n- name: db1\n  groups: [db]\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path, name, group string
+	}{
+		{iniPath, "web1", "web"},
+		{yamlPath, "db1", "db"},
+	} {
+		inv, err := Open(test.path, nil)
+		if err != nil {
+			t.Errorf("Open(%q): %v", test.path, err)
+			continue
+		}
+		hosts, err := inv.Hosts(context.Background())
+		if err != nil {
+			t.Errorf("Open(%q).Hosts: %v", test.path, err)
+			continue
+		}
+		if len(hosts) != 1 || hosts[0].Name != test.name || !hosts[0].InGroup(test.group) {
+			t.Errorf("Open(%q).Hosts = %+v; want %s in group %s", test.path, hosts, test.name, test.group)
+		}
+	}
+
+	opts := &Options{GroupKeys: []string{"role"}, PublicAddr: true}
+	inv, err := Open("ec2:eu-west-1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := inv.(*EC2); !ok || e.Region != "eu-west-1" || !e.PublicAddr || len(e.GroupKeys) != 1 {
+		t.Errorf("Open(\"ec2:eu-west-1\") = %#v; want *EC2 in eu-west-1 with options", inv)
+	}
+	inv, err = Open("gce:my-project/us-central1-a", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, ok := inv.(*GCE); !ok || g.Project != "my-project" || g.Zone != "us-central1-a" || !g.PublicAddr {
+		t.Errorf("Open(\"gce:my-project/us-central1-a\") = %#v; want *GCE for my-project in us-central1-a with options", inv)
+	}
+	for _, spec := range []string{"ec2:", "gce:", "gce:/us-central1-a", filepath.Join(dir, "nope")} {
+		if _, err := Open(spec, nil); err == nil {
+			t.Errorf("Open(%q) did not return an error", spec)
+		}
+	}
+}
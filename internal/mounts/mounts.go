@@ -0,0 +1,156 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mounts reads the table of mounted filesystems, so that writes
+// to read-only mounts can be caught before a run starts.
+package mounts
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A Mount is a mounted filesystem.
+type Mount struct {
+	// Point is the directory that the filesystem is mounted at.
+	Point string
+
+	// FSType and Source are the filesystem type, like "ext4", and the
+	// device or other source that was mounted, like "/dev/sda1".
+	FSType string
+	Source string
+
+	// ReadOnly is true if either the mount or the filesystem is
+	// read-only.
+	ReadOnly bool
+}
+
+// MountInfoPath is the Linux file that Read parses.
+const MountInfoPath = "/proc/self/mountinfo"
+
+// Read returns the mounts of the current process.  It returns nil and
+// no error on systems without MountInfoPath.
+func Read() ([]Mount, error) {
+	data, err := ioutil.ReadFile(MountInfoPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read mounts: %v", err)
+	}
+	return Parse(data)
+}
+
+// Parse parses the contents of a Linux mountinfo file, as described in
+// proc(5).  Mounts are returned in the file's order, so a mount that
+// covers an earlier mount at the same point comes after it.
+func Parse(data []byte) ([]Mount, error) {
+	var ms []Mount
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// Optional fields end with a lone "-".
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 6 || sep == -1 || len(fields) < sep+4 {
+			return nil, fmt.Errorf("parse mounts: line %d: malformed", n)
+		}
+		ms = append(ms, Mount{
+			Point:    unescape(fields[4]),
+			FSType:   fields[sep+1],
+			Source:   unescape(fields[sep+2]),
+			ReadOnly: hasOption(fields[5], "ro") || hasOption(fields[sep+3], "ro"),
+		})
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("parse mounts: %v", err)
+	}
+	return ms, nil
+}
+
+// unescape replaces the octal escapes that the kernel uses for spaces
+// and other special characters in paths, like "\040".
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				buf.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+func hasOption(opts string, name string) bool {
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns the mount that path is on, or nil if no mount contains
+// path.  path must be absolute.  Symlinks are not followed, so a path
+// under a symlink to another filesystem is reported as being on the
+// filesystem of the link.
+func Find(ms []Mount, path string) *Mount {
+	path = filepath.Clean(path)
+	var found *Mount
+	for i := range ms {
+		m := &ms[i]
+		if !contains(m.Point, path) {
+			continue
+		}
+		if found == nil || len(m.Point) >= len(found.Point) {
+			found = m
+		}
+	}
+	return found
+}
+
+// contains reports whether path is dir or inside of it.
+func contains(dir, path string) bool {
+	switch {
+	case dir == path:
+		return true
+	case !strings.HasPrefix(path, dir):
+		return false
+	case strings.HasSuffix(dir, string(filepath.Separator)):
+		return true
+	default:
+		return path[len(dir)] == filepath.Separator
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mounts
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+23 22 0:5 / /proc rw,nosuid,nodev,noexec,relatime shared:2 - proc proc rw
+24 22 8:2 / /usr ro,relatime shared:3 - ext4 /dev/sda2 rw
+25 22 7:0 / /opt/my\040app rw,relatime - squashfs /dev/loop0 ro
+26 22 8:3 / /var rw,relatime - ext4 /dev/sda3 rw
+27 26 0:30 / /var rw,relatime - tmpfs tmpfs ro
+`
+
+func TestParse(t *testing.T) {
+	ms, err := Parse([]byte(testMountInfo))
+	if err != nil {
+		t.Fatal("Parse:", err)
+	}
+	want := []Mount{
+		{Point: "/", FSType: "ext4", Source: "/dev/sda1"},
+		{Point: "/proc", FSType: "proc", Source: "proc"},
+		{Point: "/usr", FSType: "ext4", Source: "/dev/sda2", ReadOnly: true},
+		{Point: "/opt/my app", FSType: "squashfs", Source: "/dev/loop0", ReadOnly: true},
+		{Point: "/var", FSType: "ext4", Source: "/dev/sda3"},
+		{Point: "/var", FSType: "tmpfs", Source: "tmpfs", ReadOnly: true},
+	}
+	if !reflect.DeepEqual(ms, want) {
+		t.Errorf("Parse(...) = %+v; want %+v", ms, want)
+	}
+
+	if _, err := Parse([]byte("22 1 8:1 / / rw\n")); err == nil {
+		t.Error("Parse of line without separator did not return an error")
+	}
+}
+
+func TestFind(t *testing.T) {
+	ms, err := Parse([]byte(testMountInfo))
+	if err != nil {
+		t.Fatal("Parse:", err)
+	}
+	tests := []struct {
+		path   string
+		source string
+	}{
+		{"/", "/dev/sda1"},
+		{"/etc/motd", "/dev/sda1"},
+		{"/usr", "/dev/sda2"},
+		{"/usr/bin/env", "/dev/sda2"},
+		{"/usrlocal/x", "/dev/sda1"},
+		{"/usr/../etc/x", "/dev/sda1"},
+		{"/opt/my app/bin", "/dev/loop0"},
+		{"/var/log/syslog", "tmpfs"},
+	}
+	for _, test := range tests {
+		m := Find(ms, test.path)
+		if m == nil {
+			t.Errorf("Find(ms, %q) = nil; want mount of %s", test.path, test.source)
+			continue
+		}
+		if m.Source != test.source {
+			t.Errorf("Find(ms, %q) = mount of %s at %s; want mount of %s", test.path, m.Source, m.Point, test.source)
+		}
+	}
+	if m := Find(nil, "/etc"); m != nil {
+		t.Errorf("Find(nil, \"/etc\") = %+v; want nil", m)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"fmt"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// NewLayer returns an empty layer to apply c to.  Only file, no-op, and
+// barrier resources can be applied to a layer, so an error is returned if c has
+// any other kind of resource.  The paths of absent file resources are
+// recorded as whiteouts, since they can't be removed from the base
+// image any other way.
+func NewLayer(c catalog.Catalog) (*Layer, error) {
+	res, err := c.Resources()
+	if err != nil {
+		return nil, fmt.Errorf("read catalog resources: %v", err)
+	}
+	l := new(Layer)
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		switch r.Which() {
+		case catalog.Resource_Which_noop, catalog.Resource_Which_barrier:
+		case catalog.Resource_Which_file:
+			f, err := r.File()
+			if err != nil {
+				return nil, fmt.Errorf("%s: read file: %v", formatResource(r), err)
+			}
+			if f.Which() != catalog.File_Which_absent {
+				continue
+			}
+			path, err := f.Path()
+			if err != nil {
+				return nil, fmt.Errorf("%s: read file path: %v", formatResource(r), err)
+			}
+			if err := l.Whiteout(path); err != nil {
+				return nil, fmt.Errorf("%s: %v", formatResource(r), err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: %v resources can't be applied to an image layer", formatResource(r), r.Which())
+		}
+	}
+	return l, nil
+}
+
+func formatResource(r catalog.Resource) string {
+	if name, _ := r.Name(); name != "" {
+		return name
+	}
+	c, _ := r.Comment()
+	if c == "" {
+		return fmt.Sprintf("id=%d", r.ID())
+	}
+	return fmt.Sprintf("%s (id=%d)", c, r.ID())
+}
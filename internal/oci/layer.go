@@ -0,0 +1,455 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package oci builds OCI image layers from catalogs.  A Layer is a
+// system.System that records the changes made to it instead of
+// modifying the host, so applying a catalog to it produces the
+// contents of a layer to append to a base image.
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	slashpath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// A Layer is an in-memory filesystem holding the entries of an image
+// layer.  Paths are slash-separated and absolute, as inside an image.
+//
+// The base image's contents are not known, so every path starts out
+// missing.  Parent directories are created implicitly as needed; they
+// are left out of the written layer so that the base image's
+// directories and their permissions are kept.  A directory resource
+// for the path makes it explicit.
+//
+// New files and directories have their permissions masked by the
+// layer's umask, which starts out as 022.  Commands can't be run, and
+// user and group names can't be resolved, since they would need the
+// base image.  Its methods are safe to call from multiple goroutines.
+type Layer struct {
+	mu        sync.Mutex
+	entries   map[string]*entry
+	whiteouts map[string]bool
+	umask     os.FileMode
+}
+
+type entry struct {
+	mode     os.FileMode
+	uid      system.UID
+	gid      system.GID
+	content  []byte
+	link     string
+	implicit bool
+}
+
+var (
+	_ system.System  = new(Layer)
+	_ system.Umasker = new(Layer)
+)
+
+// defaultUmask is the umask of a new layer.
+const defaultUmask os.FileMode = 0022
+
+// errNoBase is returned for operations that need the base image.
+var errNoBase = errors.New("not available while building an image layer")
+
+func (l *Layer) init() {
+	if l.entries == nil {
+		l.entries = make(map[string]*entry)
+		l.whiteouts = make(map[string]bool)
+		l.umask = defaultUmask
+	}
+}
+
+// Umask sets the layer's file creation mask and returns the previous
+// one.
+func (l *Layer) Umask(mask os.FileMode) os.FileMode {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	old := l.umask
+	l.umask = mask & os.ModePerm
+	return old
+}
+
+// Whiteout marks path as deleted from the base image.
+func (l *Layer) Whiteout(path string) error {
+	path, err := cleanPath(path)
+	if err != nil {
+		return &os.PathError{Op: "whiteout", Path: path, Err: err}
+	}
+	if path == "/" {
+		return &os.PathError{Op: "whiteout", Path: path, Err: errors.New("can't remove root")}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	l.whiteouts[path] = true
+	return nil
+}
+
+// lookup returns the entry at path or nil if it does not exist.
+// Implicit directories are treated as existing only as parents.
+func (l *Layer) lookup(path string) *entry {
+	if path == "/" {
+		return &entry{mode: os.ModeDir | 0755}
+	}
+	ent := l.entries[path]
+	if ent == nil || ent.implicit {
+		return nil
+	}
+	return ent
+}
+
+// mkparents creates the missing parent directories of path.
+func (l *Layer) mkparents(path string) error {
+	dir := slashpath.Dir(path)
+	if dir == "/" {
+		return nil
+	}
+	if ent := l.entries[dir]; ent != nil {
+		if !ent.mode.IsDir() {
+			return errors.New("parent is not a directory")
+		}
+		return nil
+	}
+	if err := l.mkparents(dir); err != nil {
+		return err
+	}
+	l.entries[dir] = &entry{mode: os.ModeDir | 0755, implicit: true}
+	return nil
+}
+
+// create adds a new entry at path, failing if one exists.
+func (l *Layer) create(path string, ent *entry) error {
+	if path == "/" || l.lookup(path) != nil {
+		return os.ErrExist
+	}
+	if old := l.entries[path]; old != nil {
+		// An implicit directory becomes explicit.
+		if !ent.mode.IsDir() {
+			return os.ErrExist
+		}
+		old.mode, old.implicit = ent.mode, false
+		return nil
+	}
+	if err := l.mkparents(path); err != nil {
+		return err
+	}
+	delete(l.whiteouts, path)
+	l.entries[path] = ent
+	return nil
+}
+
+func (l *Layer) Lstat(ctx context.Context, path string) (os.FileInfo, error) {
+	path, err := cleanPath(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	ent := l.lookup(path)
+	if ent == nil {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+	}
+	return ent.stat(path), nil
+}
+
+func (l *Layer) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	path, err := cleanPath(path)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	if err := l.create(path, &entry{mode: os.ModeDir | mode&os.ModePerm&^l.umask}); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (l *Layer) Remove(ctx context.Context, path string) error {
+	path, err := cleanPath(path)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	if l.lookup(path) == nil || path == "/" {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	prefix := path + "/"
+	for p := range l.entries {
+		if strings.HasPrefix(p, prefix) {
+			return &os.PathError{Op: "remove", Path: path, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(l.entries, path)
+	return nil
+}
+
+func (l *Layer) Symlink(ctx context.Context, oldname, newname string) error {
+	path, err := cleanPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	if err := l.create(path, &entry{mode: os.ModeSymlink | 0777, link: oldname}); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (l *Layer) Readlink(ctx context.Context, path string) (string, error) {
+	path, err := cleanPath(path)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: err}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	ent := l.lookup(path)
+	if ent == nil {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: os.ErrNotExist}
+	}
+	if ent.mode&os.ModeType != os.ModeSymlink {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: errors.New("not a symlink")}
+	}
+	return ent.link, nil
+}
+
+func (l *Layer) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return l.modify("chmod", path, func(ent *entry) {
+		ent.mode = ent.mode&os.ModeType | mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	})
+}
+
+func (l *Layer) Chown(ctx context.Context, path string, uid system.UID, gid system.GID) error {
+	return l.modify("chown", path, func(ent *entry) {
+		if uid != -1 {
+			ent.uid = uid
+		}
+		if gid != -1 {
+			ent.gid = gid
+		}
+	})
+}
+
+func (l *Layer) modify(op string, path string, f func(*entry)) error {
+	path, err := cleanPath(path)
+	if err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	ent := l.lookup(path)
+	if ent == nil || path == "/" {
+		return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	}
+	f(ent)
+	return nil
+}
+
+func (l *Layer) OwnerInfo(info os.FileInfo) (system.UID, system.GID, error) {
+	st, ok := info.Sys().(*stat)
+	if !ok {
+		return -1, -1, errors.New("file info not from an image layer")
+	}
+	return st.uid, st.gid, nil
+}
+
+func (l *Layer) CreateFile(ctx context.Context, path string, mode os.FileMode) (system.FileWriter, error) {
+	path, err := cleanPath(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: path, Err: err}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	ent := &entry{mode: mode & os.ModePerm &^ l.umask}
+	if err := l.create(path, ent); err != nil {
+		return nil, &os.PathError{Op: "create", Path: path, Err: err}
+	}
+	return &openFile{l: l, ent: ent}, nil
+}
+
+func (l *Layer) OpenFile(ctx context.Context, path string) (system.File, error) {
+	path, err := cleanPath(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	ent := l.lookup(path)
+	if ent == nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	if !ent.mode.IsRegular() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: errors.New("not a regular file")}
+	}
+	return &openFile{l: l, ent: ent}, nil
+}
+
+func (l *Layer) LookupUser(name string) (system.UID, error) {
+	return -1, fmt.Errorf("look up user %q: %v; use a numeric ID", name, errNoBase)
+}
+
+func (l *Layer) LookupGroup(name string) (system.GID, error) {
+	return -1, fmt.Errorf("look up group %q: %v; use a numeric ID", name, errNoBase)
+}
+
+func (l *Layer) Run(ctx context.Context, cmd *system.Cmd) (output []byte, err error) {
+	return nil, fmt.Errorf("run %s: commands are %v", cmd.Path, errNoBase)
+}
+
+func (l *Layer) LookPath(ctx context.Context, file string, pathList string) (string, error) {
+	return "", &os.PathError{Op: "look path", Path: file, Err: os.ErrNotExist}
+}
+
+// paths returns the paths of the explicit entries and the whiteouts in
+// sorted order.
+func (l *Layer) paths() (entries, whiteouts []string) {
+	for p, ent := range l.entries {
+		if !ent.implicit {
+			entries = append(entries, p)
+		}
+	}
+	for p := range l.whiteouts {
+		whiteouts = append(whiteouts, p)
+	}
+	sort.Strings(entries)
+	sort.Strings(whiteouts)
+	return entries, whiteouts
+}
+
+func cleanPath(path string) (string, error) {
+	if !slashpath.IsAbs(path) {
+		return path, errors.New("path is not absolute")
+	}
+	return slashpath.Clean(path), nil
+}
+
+// openFile is a handle to a regular file's content.  Its methods take
+// the layer's lock, so they are safe to use while other goroutines
+// access the layer.
+type openFile struct {
+	l   *Layer
+	ent *entry
+	pos int64
+}
+
+func (f *openFile) Read(p []byte) (int, error) {
+	f.l.mu.Lock()
+	defer f.l.mu.Unlock()
+	if f.pos >= int64(len(f.ent.content)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.ent.content[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *openFile) Write(p []byte) (int, error) {
+	f.l.mu.Lock()
+	defer f.l.mu.Unlock()
+	end := f.pos + int64(len(p))
+	if end > int64(len(f.ent.content)) {
+		content := make([]byte, end)
+		copy(content, f.ent.content)
+		f.ent.content = content
+	}
+	copy(f.ent.content[f.pos:], p)
+	f.pos = end
+	return len(p), nil
+}
+
+func (f *openFile) Seek(offset int64, whence int) (int64, error) {
+	f.l.mu.Lock()
+	defer f.l.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.ent.content))
+	default:
+		return f.pos, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return f.pos, errors.New("seek: negative position")
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *openFile) Truncate(size int64) error {
+	f.l.mu.Lock()
+	defer f.l.mu.Unlock()
+	if size < 0 {
+		return errors.New("truncate: negative size")
+	}
+	if size <= int64(len(f.ent.content)) {
+		f.ent.content = f.ent.content[:size]
+		return nil
+	}
+	content := make([]byte, size)
+	copy(content, f.ent.content)
+	f.ent.content = content
+	return nil
+}
+
+func (f *openFile) Close() error {
+	return nil
+}
+
+type stat struct {
+	name string
+	size int64
+	mode os.FileMode
+	uid  system.UID
+	gid  system.GID
+}
+
+func (ent *entry) stat(path string) *stat {
+	return &stat{
+		name: slashpath.Base(path),
+		size: int64(len(ent.content)),
+		mode: ent.mode,
+		uid:  ent.uid,
+		gid:  ent.gid,
+	}
+}
+
+func (s *stat) Name() string       { return s.name }
+func (s *stat) Size() int64        { return s.size }
+func (s *stat) Mode() os.FileMode  { return s.mode }
+func (s *stat) ModTime() time.Time { return time.Time{} }
+func (s *stat) IsDir() bool        { return s.mode.IsDir() }
+func (s *stat) Sys() interface{}   { return s }
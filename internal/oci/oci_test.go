@@ -0,0 +1,244 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/catpogs"
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+func TestApply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	motd := catpogs.PlainFile("/etc/motd", []byte("Hello"))
+	motd.Plain.Mode = &catpogs.FileMode{Bits: 0640, Group: catpogs.GroupIDRef(4)}
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:    1,
+				Which: catalog.Resource_Which_file,
+				File:  motd,
+			},
+			{
+				ID:    2,
+				Which: catalog.Resource_Which_file,
+				File:  catpogs.Directory("/opt/app", &catpogs.FileMode{Bits: 0750, User: catpogs.UserIDRef(1000)}),
+			},
+			{
+				ID:    3,
+				Which: catalog.Resource_Which_file,
+				File:  catpogs.SymlinkFile("/etc/motd", "/opt/app/motd"),
+				Deps:  []uint64{2},
+			},
+			{
+				ID:    4,
+				Which: catalog.Resource_Which_file,
+				File:  &catpogs.File{Path: "/etc/issue", Which: catalog.File_Which_absent},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	layer, err := NewLayer(cat)
+	if err != nil {
+		t.Fatal("NewLayer:", err)
+	}
+	if err := execlib.Apply(ctx, layer, cat, nil); err != nil {
+		t.Fatal("Apply:", err)
+	}
+	created := time.Date(2017, time.June, 1, 0, 0, 0, 0, time.UTC)
+	buf := new(bytes.Buffer)
+	info, err := layer.Write(buf, History{Created: &created, CreatedBy: "mcm-exec"})
+	if err != nil {
+		t.Fatal("Write:", err)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	if want := "sha256:" + hex.EncodeToString(sum[:]); info.Layer.Digest != want {
+		t.Errorf("layer digest = %q; want %q", info.Layer.Digest, want)
+	}
+	if info.Layer.Size != int64(buf.Len()) {
+		t.Errorf("layer size = %d; want %d", info.Layer.Size, buf.Len())
+	}
+	if info.Layer.MediaType != LayerMediaType {
+		t.Errorf("layer media type = %q; want %q", info.Layer.MediaType, LayerMediaType)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum = sha256.Sum256(raw)
+	if want := "sha256:" + hex.EncodeToString(sum[:]); len(info.Config.RootFS.DiffIDs) != 1 || info.Config.RootFS.DiffIDs[0] != want {
+		t.Errorf("diff IDs = %q; want [%q]", info.Config.RootFS.DiffIDs, want)
+	}
+	if len(info.Config.History) != 1 || info.Config.History[0].CreatedBy != "mcm-exec" {
+		t.Errorf("history = %+v; want created by mcm-exec", info.Config.History)
+	}
+
+	type entry struct {
+		typ      byte
+		mode     int64
+		uid, gid int
+		content  string
+		link     string
+	}
+	want := []string{"etc/.wh.issue", "etc/motd", "opt/app/", "opt/app/motd"}
+	wantEntries := map[string]entry{
+		"etc/.wh.issue": {typ: tar.TypeReg},
+		"etc/motd":      {typ: tar.TypeReg, mode: 0640, gid: 4, content: "Hello"},
+		"opt/app/":      {typ: tar.TypeDir, mode: 0750, uid: 1000},
+		"opt/app/motd":  {typ: tar.TypeSymlink, mode: 0777, link: "/etc/motd"},
+	}
+	tr := tar.NewReader(bytes.NewReader(raw))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := entry{
+			typ:     hdr.Typeflag,
+			mode:    hdr.Mode,
+			uid:     hdr.Uid,
+			gid:     hdr.Gid,
+			content: string(content),
+			link:    hdr.Linkname,
+		}
+		if w, ok := wantEntries[hdr.Name]; ok && got != w {
+			t.Errorf("entry %s = %+v; want %+v", hdr.Name, got, w)
+		}
+		if !hdr.ModTime.Equal(created) {
+			t.Errorf("entry %s modified at %v; want %v", hdr.Name, hdr.ModTime, created)
+		}
+	}
+	if !equalStrings(names, want) {
+		t.Errorf("entries = %q; want %q", names, want)
+	}
+}
+
+func TestWriteDeterministic(t *testing.T) {
+	ctx := context.Background()
+	var blobs [2][]byte
+	for i := range blobs {
+		layer := new(Layer)
+		for _, p := range []string{"/b", "/a", "/c"} {
+			if err := system.WriteFile(ctx, layer, p, []byte(p), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf := new(bytes.Buffer)
+		if _, err := layer.Write(buf, History{}); err != nil {
+			t.Fatal("Write:", err)
+		}
+		blobs[i] = buf.Bytes()
+	}
+	if !bytes.Equal(blobs[0], blobs[1]) {
+		t.Error("writing the same layer twice produced different archives")
+	}
+}
+
+func TestImplicitDirectories(t *testing.T) {
+	ctx := context.Background()
+	layer := new(Layer)
+	if err := system.WriteFile(ctx, layer, "/tmp/foo/bar", []byte("Hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := layer.Lstat(ctx, "/tmp"); !os.IsNotExist(err) {
+		t.Errorf("Lstat(/tmp) error = %v; want not exist", err)
+	}
+	if err := layer.Mkdir(ctx, "/tmp", 0777|os.ModeSticky); err != nil {
+		t.Fatal("Mkdir(/tmp):", err)
+	}
+	if err := layer.Chmod(ctx, "/tmp", 0777|os.ModeSticky); err != nil {
+		t.Fatal("Chmod(/tmp):", err)
+	}
+	if err := layer.Mkdir(ctx, "/tmp", 0777); !os.IsExist(err) {
+		t.Errorf("second Mkdir(/tmp) error = %v; want exists", err)
+	}
+	entries, _ := layer.paths()
+	if want := []string{"/tmp", "/tmp/foo/bar"}; !equalStrings(entries, want) {
+		t.Errorf("entries = %q; want %q", entries, want)
+	}
+	info, err := layer.Lstat(ctx, "/tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := os.ModeDir | os.ModeSticky | 0777; info.Mode() != want {
+		t.Errorf("mode of /tmp = %v; want %v", info.Mode(), want)
+	}
+}
+
+func TestNewLayerRejectsExec(t *testing.T) {
+	cat, err := (&catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:    1,
+				Which: catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{"/bin/true"},
+					},
+				},
+			},
+		},
+	}).ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	if _, err := NewLayer(cat); err == nil {
+		t.Error("NewLayer did not return an error for an exec resource")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	slashpath "path"
+	"strings"
+	"time"
+)
+
+// LayerMediaType is the media type of the layers written by Write.
+const LayerMediaType = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+// whiteoutPrefix marks a layer entry as deleting the name after it.
+const whiteoutPrefix = ".wh."
+
+// A Descriptor identifies a blob, as in an image manifest.
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Config holds the fields to append to a base image's configuration
+// to add a layer.
+type Config struct {
+	RootFS  RootFS    `json:"rootfs"`
+	History []History `json:"history"`
+}
+
+// RootFS lists the digests of a layer's uncompressed tar archive.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History describes how a layer was created.
+type History struct {
+	Created   *time.Time `json:"created,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+}
+
+// LayerInfo describes a written layer: a descriptor for a manifest's
+// list of layers and the additions to the image configuration.
+type LayerInfo struct {
+	Layer  Descriptor `json:"layer"`
+	Config Config     `json:"config"`
+}
+
+// Write writes the layer to w as a gzip-compressed tar archive.  Entries
+// are sorted and stamped with h.Created (or the Unix epoch if it is
+// nil), so the same layer always produces the same bytes.
+func (l *Layer) Write(w io.Writer, h History) (*LayerInfo, error) {
+	modTime := time.Unix(0, 0)
+	if h.Created != nil {
+		modTime = *h.Created
+	}
+	blobHash := sha256.New()
+	blob := &countWriter{w: io.MultiWriter(w, blobHash)}
+	zw := gzip.NewWriter(blob)
+	diffHash := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(zw, diffHash))
+
+	l.mu.Lock()
+	err := l.writeEntries(tw, modTime)
+	l.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("write layer: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("write layer: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("write layer: %v", err)
+	}
+	if blob.err != nil {
+		return nil, fmt.Errorf("write layer: %v", blob.err)
+	}
+	return &LayerInfo{
+		Layer: Descriptor{
+			MediaType: LayerMediaType,
+			Digest:    digest(blobHash),
+			Size:      blob.n,
+		},
+		Config: Config{
+			RootFS: RootFS{
+				Type:    "layers",
+				DiffIDs: []string{digest(diffHash)},
+			},
+			History: []History{h},
+		},
+	}, nil
+}
+
+// writeEntries writes the whiteouts followed by the layer's entries.
+// The caller must hold l.mu.
+func (l *Layer) writeEntries(tw *tar.Writer, modTime time.Time) error {
+	entries, whiteouts := l.paths()
+	for _, p := range whiteouts {
+		dir, name := slashpath.Split(p)
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     tarName(dir + whiteoutPrefix + name),
+			ModTime:  modTime,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range entries {
+		ent := l.entries[p]
+		hdr := &tar.Header{
+			Name:    tarName(p),
+			Mode:    tarMode(ent.mode),
+			Uid:     int(ent.uid),
+			Gid:     int(ent.gid),
+			ModTime: modTime,
+		}
+		switch ent.mode & os.ModeType {
+		case 0:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(ent.content))
+		case os.ModeDir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case os.ModeSymlink:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = ent.link
+		default:
+			return fmt.Errorf("%s: unsupported file type %v", p, ent.mode&os.ModeType)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(ent.content); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tarName converts an absolute path into a name relative to the root
+// of the layer.
+func tarName(path string) string {
+	return strings.TrimPrefix(path, "/")
+}
+
+// tarMode converts a file mode into the mode bits of a tar header.
+func tarMode(mode os.FileMode) int64 {
+	m := int64(mode & os.ModePerm)
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+func digest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// countWriter counts the bytes written to w and records the first
+// error.
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plan reads and writes plan files, which record the changes
+// that applying a set of catalogs would make to a host, so that the
+// changes can be reviewed before they are applied.
+//
+// A plan file is a JSON object with a "plan" field holding the plan and
+// an "hmac" field holding the base64-encoded HMAC-SHA256 of the plan's
+// compact JSON encoding, keyed with a catcrypt key.
+package plan
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/catcrypt"
+)
+
+// A Plan is the outcome of a simulated run.
+type Plan struct {
+	Created time.Time `json:"created"`
+	Host    string    `json:"host,omitempty"`
+
+	// Catalogs has the SHA-256 of each catalog, as returned by
+	// CatalogDigest, in the order they are applied.
+	Catalogs []string `json:"catalogs"`
+
+	// Observed is the Sum of the Observer that recorded the host state
+	// read during the simulated run.
+	Observed string `json:"observed"`
+
+	// Changes lists the resources that the run would change, in the
+	// order that they finished.
+	Changes []*Change `json:"changes"`
+}
+
+// A Change names a resource that a run would change.
+type Change struct {
+	Catalog int    `json:"catalog,omitempty"`
+	ID      uint64 `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
+func (c *Change) String() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if c.Comment != "" {
+		return fmt.Sprintf("%s (id=%d)", c.Comment, c.ID)
+	}
+	return fmt.Sprintf("id=%d", c.ID)
+}
+
+// Changes returns the resources that changed in a run.
+func Changes(r *execlib.Report) []*Change {
+	var changes []*Change
+	for _, rr := range r.Resources {
+		if rr.Status != execlib.StatusChanged {
+			continue
+		}
+		changes = append(changes, &Change{
+			Catalog: rr.Catalog,
+			ID:      rr.ID,
+			Name:    rr.Name,
+			Comment: rr.Comment,
+		})
+	}
+	return changes
+}
+
+// CatalogDigest returns the hex-encoded SHA-256 of a catalog's
+// serialized message.
+func CatalogDigest(c catalog.Catalog) (string, error) {
+	data, err := c.Segment().Message().Marshal()
+	if err != nil {
+		return "", fmt.Errorf("catalog digest: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Check reports why applying now, as described by the plan q, would
+// not do what the reviewed plan p said it would.
+func (p *Plan) Check(q *Plan) error {
+	if len(p.Catalogs) != len(q.Catalogs) {
+		return fmt.Errorf("plan has %d catalogs, but %d were given", len(p.Catalogs), len(q.Catalogs))
+	}
+	for i := range p.Catalogs {
+		if p.Catalogs[i] != q.Catalogs[i] {
+			return fmt.Errorf("catalog %d is not the one that was planned", i)
+		}
+	}
+	planned := make(map[Change]bool, len(p.Changes))
+	for _, c := range p.Changes {
+		planned[changeKey(c)] = true
+	}
+	for _, c := range q.Changes {
+		if !planned[changeKey(c)] {
+			return fmt.Errorf("host changed since planning: %v would now change", c)
+		}
+		delete(planned, changeKey(c))
+	}
+	for _, c := range p.Changes {
+		if planned[changeKey(c)] {
+			return fmt.Errorf("host changed since planning: %v would no longer change", c)
+		}
+	}
+	if p.Observed != q.Observed {
+		return errors.New("host changed since planning")
+	}
+	return nil
+}
+
+func changeKey(c *Change) Change {
+	return Change{Catalog: c.Catalog, ID: c.ID}
+}
+
+type signedPlan struct {
+	Plan json.RawMessage `json:"plan"`
+	HMAC string          `json:"hmac"`
+}
+
+// Write writes p to w, signed with key.
+func Write(w io.Writer, key *catcrypt.Key, p *Plan) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("write plan: %v", err)
+	}
+	out, err := json.MarshalIndent(signedPlan{
+		Plan: data,
+		HMAC: base64.StdEncoding.EncodeToString(sign(key, data)),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("write plan: %v", err)
+	}
+	if _, err := w.Write(append(out, '\n')); err != nil {
+		return fmt.Errorf("write plan: %v", err)
+	}
+	return nil
+}
+
+// Read reads a plan from r, returning an error if it was not signed
+// with key.
+func Read(r io.Reader, key *catcrypt.Key) (*Plan, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read plan: %v", err)
+	}
+	var sp signedPlan
+	if err := json.Unmarshal(data, &sp); err != nil {
+		return nil, fmt.Errorf("read plan: %v", err)
+	}
+	// The plan is indented along with the rest of the file, so the
+	// signature covers its compact form.
+	compact := new(bytes.Buffer)
+	if err := json.Compact(compact, sp.Plan); err != nil {
+		return nil, fmt.Errorf("read plan: %v", err)
+	}
+	mac, err := base64.StdEncoding.DecodeString(sp.HMAC)
+	if err != nil || !hmac.Equal(mac, sign(key, compact.Bytes())) {
+		return nil, errors.New("read plan: signature does not match; plan was altered or signed with a different key")
+	}
+	p := new(Plan)
+	if err := json.Unmarshal(sp.Plan, p); err != nil {
+		return nil, fmt.Errorf("read plan: %v", err)
+	}
+	return p, nil
+}
+
+func sign(key *catcrypt.Key, data []byte) []byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// An Observer records the host state read during a simulated run.
+// Since resources may be applied in any order, the observations form a
+// set.  A nil Observer ignores observations.  It is safe to use from
+// multiple goroutines.
+type Observer struct {
+	mu  sync.Mutex
+	set map[string]struct{}
+}
+
+// Observe records an observation, formatted as for fmt.Sprintf.
+func (o *Observer) Observe(format string, args ...interface{}) {
+	if o == nil {
+		return
+	}
+	s := fmt.Sprintf(format, args...)
+	o.mu.Lock()
+	if o.set == nil {
+		o.set = make(map[string]struct{})
+	}
+	o.set[s] = struct{}{}
+	o.mu.Unlock()
+}
+
+// Sum returns the hex-encoded SHA-256 of the sorted observations.
+func (o *Observer) Sum() string {
+	o.mu.Lock()
+	list := make([]string, 0, len(o.set))
+	for s := range o.set {
+		list = append(list, s)
+	}
+	o.mu.Unlock()
+	sort.Strings(list)
+	buf := new(bytes.Buffer)
+	for _, s := range list {
+		buf.WriteString(s)
+		buf.WriteByte('\n')
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
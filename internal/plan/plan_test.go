@@ -0,0 +1,188 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/catcrypt"
+)
+
+func TestReadWrite(t *testing.T) {
+	key, err := catcrypt.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Plan{
+		Created:  time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC),
+		Host:     "example",
+		Catalogs: []string{"abc"},
+		Observed: "def",
+		Changes:  []*Change{{ID: 42, Name: "foo"}},
+	}
+	buf := new(bytes.Buffer)
+	if err := Write(buf, key, p); err != nil {
+		t.Fatal("Write:", err)
+	}
+	data := buf.Bytes()
+
+	got, err := Read(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatal("Read:", err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("Read = %+v; want %+v", got, p)
+	}
+
+	otherKey, err := catcrypt.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(bytes.NewReader(data), otherKey); err == nil {
+		t.Error("Read with other key succeeded")
+	}
+	altered := bytes.Replace(data, []byte("42"), []byte("43"), 1)
+	if _, err := Read(bytes.NewReader(altered), key); err == nil {
+		t.Error("Read of altered plan succeeded")
+	}
+}
+
+func TestChanges(t *testing.T) {
+	r := &execlib.Report{
+		Resources: []*execlib.ResourceReport{
+			{ID: 1, Status: execlib.StatusUnchanged},
+			{ID: 2, Name: "foo", Status: execlib.StatusChanged},
+			{ID: 3, Status: execlib.StatusFailed},
+			{ID: 4, Catalog: 1, Comment: "bar", Status: execlib.StatusChanged},
+		},
+	}
+	got := Changes(r)
+	want := []*Change{
+		{ID: 2, Name: "foo"},
+		{ID: 4, Catalog: 1, Comment: "bar"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Changes = %+v; want %+v", got, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	base := func() *Plan {
+		return &Plan{
+			Catalogs: []string{"abc", "def"},
+			Observed: "123",
+			Changes:  []*Change{{ID: 1}, {Catalog: 1, ID: 2}},
+		}
+	}
+	tests := []struct {
+		name    string
+		modify  func(q *Plan)
+		errText string
+	}{
+		{name: "Same", modify: func(q *Plan) {}},
+		{
+			name: "Reordered",
+			modify: func(q *Plan) {
+				q.Changes[0], q.Changes[1] = q.Changes[1], q.Changes[0]
+			},
+		},
+		{
+			name: "NamesIgnored",
+			modify: func(q *Plan) {
+				q.Changes[0].Name = "renamed"
+			},
+		},
+		{
+			name: "FewerCatalogs",
+			modify: func(q *Plan) {
+				q.Catalogs = q.Catalogs[:1]
+			},
+			errText: "catalogs",
+		},
+		{
+			name: "DifferentCatalog",
+			modify: func(q *Plan) {
+				q.Catalogs[1] = "xyz"
+			},
+			errText: "catalog 1",
+		},
+		{
+			name: "NewChange",
+			modify: func(q *Plan) {
+				q.Changes = append(q.Changes, &Change{ID: 3})
+			},
+			errText: "would now change",
+		},
+		{
+			name: "NoLongerChanges",
+			modify: func(q *Plan) {
+				q.Changes = q.Changes[:1]
+			},
+			errText: "would no longer change",
+		},
+		{
+			name: "SameIDOtherCatalog",
+			modify: func(q *Plan) {
+				q.Changes[1].Catalog = 0
+			},
+			errText: "would now change",
+		},
+		{
+			name: "Observed",
+			modify: func(q *Plan) {
+				q.Observed = "456"
+			},
+			errText: "host changed",
+		},
+	}
+	for _, test := range tests {
+		q := base()
+		test.modify(q)
+		err := base().Check(q)
+		switch {
+		case test.errText == "" && err != nil:
+			t.Errorf("%s: Check = %v; want <nil>", test.name, err)
+		case test.errText != "" && err == nil:
+			t.Errorf("%s: Check = <nil>; want error containing %q", test.name, test.errText)
+		case test.errText != "" && !strings.Contains(err.Error(), test.errText):
+			t.Errorf("%s: Check = %v; want error containing %q", test.name, err, test.errText)
+		}
+	}
+}
+
+func TestObserver(t *testing.T) {
+	o1 := new(Observer)
+	o1.Observe("lstat %s", "/foo")
+	o1.Observe("lstat %s", "/bar")
+	o1.Observe("lstat %s", "/foo")
+	o2 := new(Observer)
+	o2.Observe("lstat /bar")
+	o2.Observe("lstat /foo")
+	if s1, s2 := o1.Sum(), o2.Sum(); s1 != s2 {
+		t.Errorf("Sum differs for same observations: %s vs. %s", s1, s2)
+	}
+	o2.Observe("lstat /baz")
+	if s1, s2 := o1.Sum(), o2.Sum(); s1 == s2 {
+		t.Errorf("Sum = %s for different observations", s1)
+	}
+
+	var nilObs *Observer
+	nilObs.Observe("ignored")
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// DefaultOPAQuery is the Rego query that OPA evaluates if none is given.
+// Policies define rules in the mcm package, such as:
+//
+//	package mcm
+//
+//	deny[msg] {
+//		input.resources[_].type == "launchdJob"
+//		msg := "launchd jobs are not allowed"
+//	}
+//
+//	deny_resources[{"catalog": r.catalog, "id": r.id, "reason": "world-writable"}] {
+//		r := input.resources[_]
+//		bits.and(r.file.mode, 2) != 0
+//	}
+const DefaultOPAQuery = "data.mcm"
+
+// OPA is a Policy written in Rego and evaluated by the Open Policy
+// Agent's opa command.  The query's value is decoded as a Decision, so
+// it should have "deny" and "deny_resources" fields.  An undefined
+// query allows the run.
+type OPA struct {
+	// Path is the path of the opa executable.  If empty, then opa is
+	// searched for in PATH.
+	Path string
+
+	// Data is the list of Rego files, data files, or directories to
+	// load, as given to opa eval --data.
+	Data []string
+
+	// Query is the Rego query to evaluate.  If empty, then
+	// DefaultOPAQuery is used.
+	Query string
+}
+
+// Evaluate runs opa eval with in as the input document.
+func (o *OPA) Evaluate(ctx context.Context, in *Input) (*Decision, error) {
+	input, err := json.Marshal(in)
+	if err != nil {
+		return nil, fmt.Errorf("opa: %v", err)
+	}
+	path := o.Path
+	if path == "" {
+		path = "opa"
+	}
+	query := o.Query
+	if query == "" {
+		query = DefaultOPAQuery
+	}
+	args := []string{"eval", "--format=json", "--stdin-input"}
+	for _, d := range o.Data {
+		args = append(args, "--data", d)
+	}
+	args = append(args, query)
+	c := exec.CommandContext(ctx, path, args...)
+	c.Stdin = bytes.NewReader(input)
+	stderr := new(bytes.Buffer)
+	c.Stderr = stderr
+	out, err := c.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("opa: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("opa: %v", err)
+	}
+	return parseOPAOutput(out)
+}
+
+// parseOPAOutput decodes the first expression value of opa eval's JSON
+// output as a Decision.
+func parseOPAOutput(out []byte) (*Decision, error) {
+	var result struct {
+		Result []struct {
+			Expressions []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"expressions"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("opa: parse output: %v", err)
+	}
+	d := new(Decision)
+	if len(result.Result) == 0 || len(result.Result[0].Expressions) == 0 {
+		return d, nil
+	}
+	if err := json.Unmarshal(result.Result[0].Expressions[0].Value, d); err != nil {
+		return nil, fmt.Errorf("opa: parse decision: %v", err)
+	}
+	return d, nil
+}
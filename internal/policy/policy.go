@@ -0,0 +1,349 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy checks catalogs against centrally managed rules before
+// they are applied.  A policy is given a JSON-friendly description of
+// the catalogs' resources and the plan of changes, and may refuse the
+// whole run or veto individual resources.
+package policy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/plan"
+)
+
+// A Policy decides whether a run may proceed.
+type Policy interface {
+	Evaluate(ctx context.Context, in *Input) (*Decision, error)
+}
+
+// Input is what a policy decides on.
+type Input struct {
+	Host string `json:"host,omitempty"`
+
+	// UID is the user ID that the run applies as, or -1 if the
+	// operating system does not have user IDs.
+	UID int `json:"uid"`
+
+	Resources []*Resource `json:"resources"`
+}
+
+// A Resource describes a catalog resource.  Only the fields that
+// policies commonly check are included.
+type Resource struct {
+	Catalog int      `json:"catalog"`
+	ID      uint64   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Comment string   `json:"comment,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Deps    []uint64 `json:"deps,omitempty"`
+
+	// Type is the resource's type as named in the catalog schema, like
+	// "file" or "exec".
+	Type string `json:"type"`
+
+	// Changes is true if the plan says the resource would change the
+	// host.
+	Changes bool `json:"changes"`
+
+	File *File `json:"file,omitempty"`
+	Exec *Exec `json:"exec,omitempty"`
+}
+
+// File describes a file resource.
+type File struct {
+	Path string `json:"path"`
+
+	// Type is "plain", "directory", "symlink", or "absent".
+	Type string `json:"type"`
+
+	// Mode is the permission bits, using the Unix values for the
+	// setuid (04000), setgid (02000), and sticky (01000) bits.  It is
+	// nil if the catalog leaves the mode unchanged.
+	Mode *int `json:"mode,omitempty"`
+
+	User  *Owner `json:"user,omitempty"`
+	Group *Owner `json:"group,omitempty"`
+
+	ContentURL  string `json:"content_url,omitempty"`
+	ContentPath string `json:"content_path,omitempty"`
+	Target      string `json:"target,omitempty"`
+}
+
+// An Owner is a user or group given by ID or by name.
+type Owner struct {
+	ID   *int   `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Exec describes an exec resource's command.
+type Exec struct {
+	Argv      []string `json:"argv,omitempty"`
+	Bash      string   `json:"bash,omitempty"`
+	Dir       string   `json:"dir,omitempty"`
+	Supervise bool     `json:"supervise,omitempty"`
+}
+
+// A Decision is a policy's verdict on a run.
+type Decision struct {
+	// Deny lists reasons to refuse the whole run.
+	Deny []string `json:"deny,omitempty"`
+
+	// DenyResources lists resources that must not be applied.  Other
+	// resources are applied as usual, except for the dependents of
+	// denied resources.
+	DenyResources []*Denial `json:"deny_resources,omitempty"`
+}
+
+// A Denial vetoes a single resource.
+type Denial struct {
+	Catalog int    `json:"catalog"`
+	ID      uint64 `json:"id"`
+	Reason  string `json:"reason"`
+}
+
+// Err returns an error listing the reasons that d refuses the run, or
+// nil if it doesn't.
+func (d *Decision) Err() error {
+	if len(d.Deny) == 0 {
+		return nil
+	}
+	return fmt.Errorf("policy denied run: %s", strings.Join(d.Deny, "; "))
+}
+
+// Veto returns a function suitable for execlib.Options.Veto that fails
+// the resources in d.DenyResources.
+func (d *Decision) Veto() func(cat int, r catalog.Resource) string {
+	reasons := make(map[resourceKey]string, len(d.DenyResources))
+	for _, den := range d.DenyResources {
+		k := resourceKey{den.Catalog, den.ID}
+		reason := den.Reason
+		if reason == "" {
+			reason = "denied by policy"
+		}
+		if prev := reasons[k]; prev != "" {
+			reason = prev + "; " + reason
+		}
+		reasons[k] = reason
+	}
+	return func(cat int, r catalog.Resource) string {
+		return reasons[resourceKey{cat, r.ID()}]
+	}
+}
+
+// resourceKey identifies a resource in a run of several catalogs.
+type resourceKey struct {
+	cat int
+	id  uint64
+}
+
+// NewInput describes the catalogs for a policy.  p may be nil if no
+// plan was made, in which case no resource is marked as changing.
+func NewInput(cats []catalog.Catalog, p *plan.Plan) (*Input, error) {
+	in := new(Input)
+	changes := make(map[resourceKey]bool)
+	if p != nil {
+		in.Host = p.Host
+		for _, c := range p.Changes {
+			changes[resourceKey{c.Catalog, c.ID}] = true
+		}
+	}
+	for i, c := range cats {
+		c, err := catalog.ExpandDefaults(c)
+		if err != nil {
+			return nil, fmt.Errorf("catalog %d: %v", i, err)
+		}
+		res, err := c.Resources()
+		if err != nil {
+			return nil, fmt.Errorf("catalog %d: read resources: %v", i, err)
+		}
+		for j := 0; j < res.Len(); j++ {
+			r, err := newResource(res.At(j))
+			if err != nil {
+				return nil, fmt.Errorf("catalog %d: resource[%d]: %v", i, j, err)
+			}
+			r.Catalog = i
+			r.Changes = changes[resourceKey{i, r.ID}]
+			in.Resources = append(in.Resources, r)
+		}
+	}
+	return in, nil
+}
+
+func newResource(res catalog.Resource) (*Resource, error) {
+	r := &Resource{
+		ID:   res.ID(),
+		Type: res.Which().String(),
+	}
+	var err error
+	if r.Name, err = res.Name(); err != nil {
+		return nil, fmt.Errorf("read name: %v", err)
+	}
+	if r.Comment, err = res.Comment(); err != nil {
+		return nil, fmt.Errorf("read comment: %v", err)
+	}
+	tags, err := res.Tags()
+	if err != nil {
+		return nil, fmt.Errorf("read tags: %v", err)
+	}
+	for i := 0; i < tags.Len(); i++ {
+		tag, err := tags.At(i)
+		if err != nil {
+			return nil, fmt.Errorf("read tags: %v", err)
+		}
+		r.Tags = append(r.Tags, tag)
+	}
+	deps, err := res.Dependencies()
+	if err != nil {
+		return nil, fmt.Errorf("read dependencies: %v", err)
+	}
+	for i := 0; i < deps.Len(); i++ {
+		r.Deps = append(r.Deps, deps.At(i))
+	}
+	switch res.Which() {
+	case catalog.Resource_Which_file:
+		f, err := res.File()
+		if err != nil {
+			return nil, fmt.Errorf("read file: %v", err)
+		}
+		if r.File, err = newFile(f); err != nil {
+			return nil, err
+		}
+	case catalog.Resource_Which_exec:
+		e, err := res.Exec()
+		if err != nil {
+			return nil, fmt.Errorf("read exec: %v", err)
+		}
+		if r.Exec, err = newExec(e); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func newFile(f catalog.File) (*File, error) {
+	path, err := f.Path()
+	if err != nil {
+		return nil, fmt.Errorf("read path: %v", err)
+	}
+	pf := &File{Path: path, Type: f.Which().String()}
+	var mode catalog.File_Mode
+	switch f.Which() {
+	case catalog.File_Which_plain:
+		if mode, err = f.Plain().Mode(); err != nil {
+			return nil, fmt.Errorf("read mode: %v", err)
+		}
+		if pf.ContentURL, err = f.Plain().ContentUrl(); err != nil {
+			return nil, fmt.Errorf("read content URL: %v", err)
+		}
+		if pf.ContentPath, err = f.Plain().ContentPath(); err != nil {
+			return nil, fmt.Errorf("read content path: %v", err)
+		}
+	case catalog.File_Which_directory:
+		if mode, err = f.Directory().Mode(); err != nil {
+			return nil, fmt.Errorf("read mode: %v", err)
+		}
+	case catalog.File_Which_symlink:
+		if pf.Target, err = f.Symlink().Target(); err != nil {
+			return nil, fmt.Errorf("read target: %v", err)
+		}
+		return pf, nil
+	default:
+		return pf, nil
+	}
+	if bits := mode.Bits(); bits != catalog.File_Mode_unset {
+		m := unixMode(bits)
+		pf.Mode = &m
+	}
+	if mode.HasUser() {
+		u, err := mode.User()
+		if err != nil {
+			return nil, fmt.Errorf("read user: %v", err)
+		}
+		if u.Which() == catalog.UserRef_Which_name {
+			name, err := u.Name()
+			if err != nil {
+				return nil, fmt.Errorf("read user: %v", err)
+			}
+			pf.User = &Owner{Name: name}
+		} else if id := int(u.ID()); id != -1 {
+			pf.User = &Owner{ID: &id}
+		}
+	}
+	if mode.HasGroup() {
+		g, err := mode.Group()
+		if err != nil {
+			return nil, fmt.Errorf("read group: %v", err)
+		}
+		if g.Which() == catalog.GroupRef_Which_name {
+			name, err := g.Name()
+			if err != nil {
+				return nil, fmt.Errorf("read group: %v", err)
+			}
+			pf.Group = &Owner{Name: name}
+		} else if id := int(g.ID()); id != -1 {
+			pf.Group = &Owner{ID: &id}
+		}
+	}
+	return pf, nil
+}
+
+// unixMode converts catalog mode bits to their Unix values.
+func unixMode(bits uint16) int {
+	m := int(bits & catalog.File_Mode_permMask)
+	if bits&catalog.File_Mode_sticky != 0 {
+		m |= 01000
+	}
+	if bits&catalog.File_Mode_setgid != 0 {
+		m |= 02000
+	}
+	if bits&catalog.File_Mode_setuid != 0 {
+		m |= 04000
+	}
+	return m
+}
+
+func newExec(e catalog.Exec) (*Exec, error) {
+	c, err := e.Command()
+	if err != nil {
+		return nil, fmt.Errorf("read command: %v", err)
+	}
+	pe := &Exec{Supervise: e.HasSupervise()}
+	if pe.Dir, err = c.WorkingDirectory(); err != nil {
+		return nil, fmt.Errorf("read working directory: %v", err)
+	}
+	switch c.Which() {
+	case catalog.Exec_Command_Which_argv:
+		argv, err := c.Argv()
+		if err != nil {
+			return nil, fmt.Errorf("read argv: %v", err)
+		}
+		for i := 0; i < argv.Len(); i++ {
+			arg, err := argv.At(i)
+			if err != nil {
+				return nil, fmt.Errorf("read argv[%d]: %v", i, err)
+			}
+			pe.Argv = append(pe.Argv, arg)
+		}
+	case catalog.Exec_Command_Which_bash:
+		if pe.Bash, err = c.Bash(); err != nil {
+			return nil, fmt.Errorf("read bash: %v", err)
+		}
+	}
+	return pe, nil
+}
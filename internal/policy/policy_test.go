@@ -0,0 +1,232 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catpogs"
+	"github.com/zombiezen/mcm/internal/plan"
+)
+
+func TestNewInput(t *testing.T) {
+	f := catpogs.PlainFile("/etc/foo", []byte("foo"))
+	f.Plain.Mode = &catpogs.FileMode{
+		Bits: 0755 | catpogs.ModeSetuid,
+		User: catpogs.UserNameRef("root"),
+	}
+	c, err := (&catpogs.Catalog{Resources: []*catpogs.Resource{
+		{
+			ID:    1,
+			Name:  "foo",
+			Which: catalog.Resource_Which_file,
+			File:  f,
+		},
+		{
+			ID:    2,
+			Deps:  []uint64{1},
+			Tags:  []string{"apt"},
+			Which: catalog.Resource_Which_exec,
+			Exec: &catpogs.Exec{
+				Command: &catpogs.Command{
+					Which: catalog.Exec_Command_Which_argv,
+					Argv:  []string{"/bin/true", "x"},
+					Dir:   "/opt",
+				},
+			},
+		},
+		{
+			ID:    3,
+			Which: catalog.Resource_Which_file,
+			File:  catpogs.Directory("/srv", &catpogs.FileMode{Bits: catpogs.ModeUnset, Group: catpogs.GroupIDRef(0)}),
+		},
+	}}).ToCapnp()
+	if err != nil {
+		t.Fatal("ToCapnp:", err)
+	}
+	p := &plan.Plan{Host: "example", Changes: []*plan.Change{{ID: 2}}}
+	in, err := NewInput([]catalog.Catalog{c}, p)
+	if err != nil {
+		t.Fatal("NewInput:", err)
+	}
+	mode := 04755
+	root := 0
+	want := &Input{
+		Host: "example",
+		Resources: []*Resource{
+			{
+				ID:   1,
+				Name: "foo",
+				Type: "file",
+				File: &File{
+					Path: "/etc/foo",
+					Type: "plain",
+					Mode: &mode,
+					User: &Owner{Name: "root"},
+				},
+			},
+			{
+				ID:      2,
+				Deps:    []uint64{1},
+				Tags:    []string{"apt"},
+				Type:    "exec",
+				Changes: true,
+				Exec: &Exec{
+					Argv: []string{"/bin/true", "x"},
+					Dir:  "/opt",
+				},
+			},
+			{
+				ID:   3,
+				Type: "file",
+				File: &File{
+					Path:  "/srv",
+					Type:  "directory",
+					Group: &Owner{ID: &root},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(in, want) {
+		t.Errorf("NewInput = %s; want %s", dump(in), dump(want))
+	}
+}
+
+func dump(in *Input) string {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func TestDecisionVeto(t *testing.T) {
+	d := &Decision{DenyResources: []*Denial{
+		{Catalog: 0, ID: 1, Reason: "world-writable"},
+		{Catalog: 1, ID: 2},
+		{Catalog: 0, ID: 1, Reason: "setuid"},
+	}}
+	c, err := (&catpogs.Catalog{Resources: []*catpogs.Resource{
+		{ID: 1, Which: catalog.Resource_Which_noop},
+		{ID: 2, Which: catalog.Resource_Which_noop},
+	}}).ToCapnp()
+	if err != nil {
+		t.Fatal("ToCapnp:", err)
+	}
+	res, _ := c.Resources()
+	veto := d.Veto()
+	tests := []struct {
+		cat  int
+		r    catalog.Resource
+		want string
+	}{
+		{0, res.At(0), "world-writable; setuid"},
+		{0, res.At(1), ""},
+		{1, res.At(0), ""},
+		{1, res.At(1), "denied by policy"},
+	}
+	for _, test := range tests {
+		if got := veto(test.cat, test.r); got != test.want {
+			t.Errorf("veto(%d, id=%d) = %q; want %q", test.cat, test.r.ID(), got, test.want)
+		}
+	}
+	if err := d.Err(); err != nil {
+		t.Errorf("Err() = %v; want <nil>", err)
+	}
+	d.Deny = []string{"no launchd jobs"}
+	if err := d.Err(); err == nil || !strings.Contains(err.Error(), "no launchd jobs") {
+		t.Errorf("Err() = %v; want to contain %q", err, "no launchd jobs")
+	}
+}
+
+func TestParseOPAOutput(t *testing.T) {
+	tests := []struct {
+		out  string
+		want *Decision
+	}{
+		{out: `{}`, want: &Decision{}},
+		{out: `{"result": [{"expressions": [{"value": {}}]}]}`, want: &Decision{}},
+		{
+			out: `{"result": [{"expressions": [{"value": {"deny": ["no"], "deny_resources": [{"catalog": 1, "id": 42, "reason": "bad"}], "other": true}}]}]}`,
+			want: &Decision{
+				Deny:          []string{"no"},
+				DenyResources: []*Denial{{Catalog: 1, ID: 42, Reason: "bad"}},
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := parseOPAOutput([]byte(test.out))
+		if err != nil {
+			t.Errorf("parseOPAOutput(%q): %v", test.out, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseOPAOutput(%q) = %+v; want %+v", test.out, got, test.want)
+		}
+	}
+	if _, err := parseOPAOutput([]byte("not json")); err == nil {
+		t.Error("parseOPAOutput(\"not json\") did not return an error")
+	}
+}
+
+func TestOPAEvaluate(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh:", err)
+	}
+	dir, err := ioutil.TempDir("", "mcm-policy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The fake opa records its arguments and input and denies the run.
+	opa := filepath.Join(dir, "opa")
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" > " + filepath.Join(dir, "args") + "\n" +
+		"cat > " + filepath.Join(dir, "input") + "\n" +
+		"echo '{\"result\": [{\"expressions\": [{\"value\": {\"deny\": [\"nope\"]}}]}]}'\n"
+	if err := ioutil.WriteFile(opa, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	o := &OPA{Path: opa, Data: []string{"policy.rego"}}
+	d, err := o.Evaluate(context.Background(), &Input{Host: "example"})
+	if err != nil {
+		t.Fatal("Evaluate:", err)
+	}
+	if !reflect.DeepEqual(d.Deny, []string{"nope"}) {
+		t.Errorf("Deny = %q; want [\"nope\"]", d.Deny)
+	}
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(args)), "eval --format=json --stdin-input --data policy.rego data.mcm"; got != want {
+		t.Errorf("opa args = %q; want %q", got, want)
+	}
+	input, err := ioutil.ReadFile(filepath.Join(dir, "input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(input), `"host":"example"`) {
+		t.Errorf("opa input = %s; want to contain host", input)
+	}
+}
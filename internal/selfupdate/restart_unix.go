@@ -0,0 +1,34 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package selfupdate
+
+import (
+	"os"
+	"syscall"
+)
+
+// rename moves the new binary at src over the executable at dst.
+func rename(src, dst string) error {
+	return os.Rename(src, dst)
+}
+
+// Restart replaces the running process with a new run of the
+// executable at path, with the same arguments and environment.  It only
+// returns if the new process could not be started.
+func Restart(path string) error {
+	return syscall.Exec(path, os.Args, os.Environ())
+}
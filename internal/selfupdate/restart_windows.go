@@ -0,0 +1,44 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build windows
+
+package selfupdate
+
+import (
+	"errors"
+	"os"
+)
+
+// rename moves the new binary at src over the executable at dst.  A
+// running executable can't be replaced on Windows, but it can be
+// renamed, so the old binary is moved aside to dst + ".old" first.
+func rename(src, dst string) error {
+	old := dst + ".old"
+	os.Remove(old)
+	if err := os.Rename(dst, old); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		os.Rename(old, dst)
+		return err
+	}
+	return nil
+}
+
+// Restart is not supported on Windows: the process should exit and let
+// the service manager start it again.
+func Restart(path string) error {
+	return errors.New("restart is not supported on Windows")
+}
@@ -0,0 +1,256 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selfupdate replaces the running executable with a signed
+// release.
+//
+// Releases are described by a JSON manifest (see Manifest) that is
+// signed the same way as catalogs: the base64-encoded Ed25519
+// signature of the manifest's bytes is at the manifest's URL with
+// SignatureSuffix appended.  Each binary that the manifest lists is
+// signed the same way with the same key.
+package selfupdate
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/third_party/golang/crypto/ed25519"
+)
+
+// SignatureSuffix is appended to the URL of a manifest or binary to
+// obtain the location of its signature.
+const SignatureSuffix = ".sig"
+
+// Platform is the "GOOS/GOARCH" key of the running binary's builds in
+// a manifest.
+const Platform = runtime.GOOS + "/" + runtime.GOARCH
+
+// A Manifest describes a release.
+type Manifest struct {
+	// Version is the release's version label.
+	Version string `json:"version"`
+
+	// Binaries maps a program name, like "mcm-agent", to the URLs of
+	// its builds, keyed by "GOOS/GOARCH".  Relative URLs are resolved
+	// against the manifest's URL.
+	Binaries map[string]map[string]string `json:"binaries"`
+}
+
+// A Release is a build of a program that an Updater can install.
+type Release struct {
+	Version string
+	URL     string
+}
+
+// An Updater checks for and installs new releases of a program.
+type Updater struct {
+	// URL is the location of the release manifest.
+	URL string
+
+	// PublicKey is the Ed25519 key that the manifest and binaries must
+	// be signed with.  It is required.
+	PublicKey ed25519.PublicKey
+
+	// Program is the name of the program in the manifest.
+	Program string
+
+	// Version is the version of the running binary.  A release is only
+	// installed if its version is different, so a manifest can also
+	// roll a fleet back.
+	Version string
+
+	// Path is the executable to replace.  If empty, then the running
+	// executable is replaced.
+	Path string
+
+	// Downloader makes the HTTP requests.  If nil, then a zero
+	// download.Downloader is used.
+	Downloader *download.Downloader
+}
+
+// Check downloads the manifest and returns the release of the
+// program for this platform, or nil if the manifest's version is the
+// running one.
+func (u *Updater) Check(ctx context.Context) (*Release, error) {
+	if len(u.PublicKey) == 0 {
+		return nil, errors.New("check for update: no public key")
+	}
+	data, err := u.fetchSigned(ctx, u.URL)
+	if err != nil {
+		return nil, fmt.Errorf("check for update: %v", err)
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("check for update: %s: %v", u.URL, err)
+	}
+	if m.Version == "" {
+		return nil, fmt.Errorf("check for update: %s: no version", u.URL)
+	}
+	if m.Version == u.Version {
+		return nil, nil
+	}
+	ref := m.Binaries[u.Program][Platform]
+	if ref == "" {
+		return nil, fmt.Errorf("check for update: %s: no %s build of %s %s", u.URL, Platform, u.Program, m.Version)
+	}
+	base, err := url.Parse(u.URL)
+	if err != nil {
+		return nil, fmt.Errorf("check for update: %v", err)
+	}
+	ru, err := base.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("check for update: %s: %v", u.URL, err)
+	}
+	return &Release{Version: m.Version, URL: ru.String()}, nil
+}
+
+// Update installs the release that Check returns, if any.  It returns
+// the installed release, or nil if the running version is current.
+// The running process is not affected until it is restarted (see
+// Restart).
+func (u *Updater) Update(ctx context.Context) (*Release, error) {
+	rel, err := u.Check(ctx)
+	if rel == nil || err != nil {
+		return nil, err
+	}
+	if err := u.Install(ctx, rel); err != nil {
+		return nil, err
+	}
+	return rel, nil
+}
+
+// Install downloads the release's binary, checks its signature, and
+// replaces the executable with it.  The executable is replaced by
+// renaming over it, so it is either the old binary or the new one,
+// never a partial write.
+func (u *Updater) Install(ctx context.Context, rel *Release) error {
+	if len(u.PublicKey) == 0 {
+		return fmt.Errorf("install %s: no public key", rel.Version)
+	}
+	path, err := u.path()
+	if err != nil {
+		return fmt.Errorf("install %s: %v", rel.Version, err)
+	}
+	data, err := u.fetchSigned(ctx, rel.URL)
+	if err != nil {
+		return fmt.Errorf("install %s: %v", rel.Version, err)
+	}
+	if err := replaceFile(path, data); err != nil {
+		return fmt.Errorf("install %s: %v", rel.Version, err)
+	}
+	return nil
+}
+
+func (u *Updater) path() (string, error) {
+	if u.Path != "" {
+		return u.Path, nil
+	}
+	path, err := Executable()
+	if err != nil {
+		return "", err
+	}
+	// Replace the binary that a symlink points to, not the symlink.
+	return filepath.EvalSymlinks(path)
+}
+
+// Executable returns the absolute path of the running program's binary.
+func Executable() (string, error) {
+	if runtime.GOOS == "linux" {
+		path, err := os.Readlink("/proc/self/exe")
+		if err != nil {
+			return "", err
+		}
+		// The kernel marks a binary that has since been replaced, such
+		// as by Install.
+		return strings.TrimSuffix(path, " (deleted)"), nil
+	}
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
+
+// fetchSigned downloads rawurl and checks it against the signature at
+// rawurl + SignatureSuffix.
+func (u *Updater) fetchSigned(ctx context.Context, rawurl string) ([]byte, error) {
+	data, err := u.downloader().Fetch(ctx, rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", rawurl, err)
+	}
+	encSig, err := u.downloader().Fetch(ctx, rawurl+SignatureSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s signature: %v", rawurl, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encSig)))
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s signature: %v", rawurl, err)
+	}
+	if !ed25519.Verify(u.PublicKey, data, sig) {
+		return nil, fmt.Errorf("%s: signature does not match", rawurl)
+	}
+	return data, nil
+}
+
+func (u *Updater) downloader() *download.Downloader {
+	if u.Downloader == nil {
+		return defaultDownloader
+	}
+	return u.Downloader
+}
+
+var defaultDownloader = new(download.Downloader)
+
+// replaceFile writes data to a temporary file in the same directory as
+// path with path's permissions, then renames it into place.
+func replaceFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err == nil {
+		err = rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
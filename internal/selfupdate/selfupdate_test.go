@@ -0,0 +1,169 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selfupdate
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zombiezen/mcm/third_party/golang/crypto/ed25519"
+)
+
+// releaseServer serves files and their signatures.
+type releaseServer struct {
+	key   ed25519.PrivateKey
+	files map[string][]byte
+}
+
+func (rs *releaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if data, ok := rs.files[r.URL.Path]; ok {
+		w.Write(data)
+		return
+	}
+	if data, ok := rs.files[strings.TrimSuffix(r.URL.Path, SignatureSuffix)]; ok && strings.HasSuffix(r.URL.Path, SignatureSuffix) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString(ed25519.Sign(rs.key, data)) + "\n"))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func TestUpdate(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &releaseServer{
+		key: priv,
+		files: map[string][]byte{
+			"/release.json":  []byte(`{"version": "1.1", "binaries": {"mcm-agent": {"` + Platform + `": "bin/mcm-agent"}}}`),
+			"/bin/mcm-agent": []byte("new binary"),
+		},
+	}
+	hs := httptest.NewServer(rs)
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "selfupdate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mcm-agent")
+	if err := ioutil.WriteFile(path, []byte("old binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	u := &Updater{
+		URL:       hs.URL + "/release.json",
+		PublicKey: pub,
+		Program:   "mcm-agent",
+		Version:   "1.0",
+		Path:      path,
+	}
+	rel, err := u.Update(ctx)
+	if err != nil {
+		t.Fatal("Update:", err)
+	}
+	if rel == nil || rel.Version != "1.1" || rel.URL != hs.URL+"/bin/mcm-agent" {
+		t.Errorf("Update() = %+v; want version 1.1 from %s/bin/mcm-agent", rel, hs.URL)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil {
+		t.Error(err)
+	} else if string(data) != "new binary" {
+		t.Errorf("executable = %q after Update; want \"new binary\"", data)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0755 {
+		t.Errorf("executable mode = %v after Update; want 0755", info.Mode())
+	}
+
+	u.Version = "1.1"
+	if rel, err := u.Update(ctx); rel != nil || err != nil {
+		t.Errorf("Update() at current version = %+v, %v; want <nil>, <nil>", rel, err)
+	}
+}
+
+func TestUpdateBadSignature(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &releaseServer{
+		key: otherKey,
+		files: map[string][]byte{
+			"/release.json":  []byte(`{"version": "1.1", "binaries": {"mcm-agent": {"` + Platform + `": "bin/mcm-agent"}}}`),
+			"/bin/mcm-agent": []byte("new binary"),
+		},
+	}
+	hs := httptest.NewServer(rs)
+	defer hs.Close()
+	dir, err := ioutil.TempDir("", "selfupdate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mcm-agent")
+	if err := ioutil.WriteFile(path, []byte("old binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &Updater{
+		URL:       hs.URL + "/release.json",
+		PublicKey: pub,
+		Program:   "mcm-agent",
+		Version:   "1.0",
+		Path:      path,
+	}
+	if _, err := u.Update(context.Background()); err == nil {
+		t.Error("Update with wrong key did not return an error")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil {
+		t.Error(err)
+	} else if string(data) != "old binary" {
+		t.Errorf("executable = %q after failed Update; want \"old binary\"", data)
+	}
+}
+
+func TestExecutable(t *testing.T) {
+	path, err := Executable()
+	if err != nil {
+		t.Fatal("Executable:", err)
+	}
+	if !filepath.IsAbs(path) {
+		t.Errorf("Executable() = %q; want an absolute path", path)
+	}
+	got, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.Stat(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(got, want) {
+		t.Errorf("Executable() = %q; want %q", path, os.Args[0])
+	}
+}
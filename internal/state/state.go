@@ -0,0 +1,176 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package state provides information that persists on a host between
+// runs.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A Store is a JSON file holding a State.
+type Store struct {
+	Path string
+}
+
+// Load reads the state from the file.  A missing file is an empty state.
+// If the file can't be parsed, then Load returns an empty state along
+// with the error, so that saving the state replaces the corrupt file.
+func (s *Store) Load() (*State, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return new(State), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load state: %v", err)
+	}
+	st := new(State)
+	if err := json.Unmarshal(data, st); err != nil {
+		return new(State), fmt.Errorf("load state %s: %v", s.Path, err)
+	}
+	return st, nil
+}
+
+// Save replaces the file's contents with st.  The file is never left
+// partially written.
+func (s *Store) Save(st *State) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("save state: %v", err)
+	}
+	dir := filepath.Dir(s.Path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("save state: %v", err)
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(s.Path))
+	if err != nil {
+		return fmt.Errorf("save state: %v", err)
+	}
+	_, err = tmp.Write(data)
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.Path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("save state %s: %v", s.Path, err)
+	}
+	return nil
+}
+
+// State is the information kept between runs.  The zero value is an
+// empty state.  A State is not safe to use from multiple goroutines.
+type State struct {
+	// Durations has the apply time statistics of each resource by ID.
+	Durations map[uint64]*DurationStats `json:"durations,omitempty"`
+
+	// Hashes has the content hashes of large managed files by path.
+	Hashes map[string]*FileHash `json:"hashes,omitempty"`
+
+	// Pending has the resources by ID that were triggered by a change
+	// in a dependency, but did not apply.
+	Pending map[uint64]*PendingChange `json:"pending,omitempty"`
+}
+
+// PendingChange records that a resource was triggered by a change in
+// one of its dependencies, such as a service restart after its
+// configuration changed, but failed, was skipped, or was vetoed.  The
+// next run treats the resource's dependencies as changed, so that the
+// change isn't lost once the dependencies are up to date.
+type PendingChange struct {
+	// Since is when the resource was first left pending.
+	Since time.Time `json:"since"`
+}
+
+// AddPending records the resource as pending.  A resource that is
+// already pending keeps its original time.
+func (st *State) AddPending(id uint64, now time.Time) {
+	if st.Pending == nil {
+		st.Pending = make(map[uint64]*PendingChange)
+	}
+	if st.Pending[id] == nil {
+		st.Pending[id] = &PendingChange{Since: now}
+	}
+}
+
+// RemovePending clears the resource's pending change, returning the
+// change that was removed or nil if the resource was not pending.
+func (st *State) RemovePending(id uint64) *PendingChange {
+	pc := st.Pending[id]
+	delete(st.Pending, id)
+	return pc
+}
+
+// DurationStats is a rolling average of a resource's apply time.
+type DurationStats struct {
+	Average time.Duration `json:"average"`
+
+	// Samples is the number of observations in Average, up to
+	// durationWindow.
+	Samples int `json:"samples"`
+}
+
+// durationWindow is the number of samples the rolling average
+// approximates.
+const durationWindow = 10
+
+// ObserveDuration adds a sample to the resource's average apply time.
+// It returns the statistics from before the sample was added.
+func (st *State) ObserveDuration(id uint64, d time.Duration) DurationStats {
+	if st.Durations == nil {
+		st.Durations = make(map[uint64]*DurationStats)
+	}
+	ds := st.Durations[id]
+	if ds == nil {
+		ds = new(DurationStats)
+		st.Durations[id] = ds
+	}
+	prev := *ds
+	if ds.Samples < durationWindow {
+		ds.Samples++
+	}
+	ds.Average += (d - ds.Average) / time.Duration(ds.Samples)
+	return prev
+}
+
+// FileHash is the hash of a file's content at the time the file had
+// the given size, modification time, and identity.  If any of them
+// differ, then the file may have changed and the hash is stale.
+type FileHash struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Device  uint64    `json:"dev,omitempty"`
+	Inode   uint64    `json:"ino,omitempty"`
+
+	// SHA256 is the hex-encoded SHA-256 hash of the content.  XXH64 is
+	// the hex-encoded xxHash of the content, recorded instead of SHA256
+	// by runs that use the fast hash.
+	SHA256 string `json:"sha256,omitempty"`
+	XXH64  string `json:"xxh64,omitempty"`
+}
+
+// Matches reports whether h was recorded for a file with the same
+// size, modification time, and identity as k.  The hash is ignored.
+func (h *FileHash) Matches(k *FileHash) bool {
+	return h.Size == k.Size && h.ModTime.Equal(k.ModTime) && h.Device == k.Device && h.Inode == k.Inode
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Store{Path: filepath.Join(dir, "sub", "state.json")}
+
+	st, err := s.Load()
+	if err != nil {
+		t.Fatal("Load on missing file:", err)
+	}
+	if len(st.Durations) != 0 {
+		t.Errorf("Load on missing file = %+v; want empty", st)
+	}
+	st.ObserveDuration(42, time.Second)
+	if err := s.Save(st); err != nil {
+		t.Fatal("Save:", err)
+	}
+	st, err = s.Load()
+	if err != nil {
+		t.Fatal("Load:", err)
+	}
+	if ds := st.Durations[42]; ds == nil || ds.Average != time.Second || ds.Samples != 1 {
+		t.Errorf("Durations[42] = %+v; want {Average: 1s, Samples: 1}", ds)
+	}
+}
+
+func TestStoreCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &Store{Path: filepath.Join(dir, "state.json")}
+	if err := ioutil.WriteFile(s.Path, []byte("{\"durations\":"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := s.Load()
+	if err == nil {
+		t.Error("Load on corrupt file did not return an error")
+	}
+	if st == nil {
+		t.Fatal("Load on corrupt file returned a nil state")
+	}
+	st.ObserveDuration(42, time.Second)
+	if err := s.Save(st); err != nil {
+		t.Fatal("Save:", err)
+	}
+	if _, err := s.Load(); err != nil {
+		t.Error("Load after Save:", err)
+	}
+}
+
+func TestObserveDuration(t *testing.T) {
+	st := new(State)
+	if prev := st.ObserveDuration(1, 2*time.Second); prev.Samples != 0 {
+		t.Errorf("first ObserveDuration = %+v; want zero", prev)
+	}
+	if prev := st.ObserveDuration(1, 4*time.Second); prev.Average != 2*time.Second || prev.Samples != 1 {
+		t.Errorf("second ObserveDuration = %+v; want {Average: 2s, Samples: 1}", prev)
+	}
+	if ds := st.Durations[1]; ds.Average != 3*time.Second || ds.Samples != 2 {
+		t.Errorf("after two samples, Durations[1] = %+v; want {Average: 3s, Samples: 2}", ds)
+	}
+	for i := 0; i < 100; i++ {
+		st.ObserveDuration(1, time.Second)
+	}
+	if ds := st.Durations[1]; ds.Samples != durationWindow || ds.Average > 1001*time.Millisecond {
+		t.Errorf("after many samples, Durations[1] = %+v; want {Average: ~1s, Samples: %d}", ds, durationWindow)
+	}
+}
+
+func TestPending(t *testing.T) {
+	st := new(State)
+	t1 := time.Date(2017, time.March, 1, 0, 0, 0, 0, time.UTC)
+	st.AddPending(1, t1)
+	st.AddPending(1, t1.Add(time.Hour))
+	if pc := st.Pending[1]; pc == nil || !pc.Since.Equal(t1) {
+		t.Errorf("after adding twice, Pending[1] = %+v; want since %v", pc, t1)
+	}
+	if pc := st.RemovePending(1); pc == nil || !pc.Since.Equal(t1) {
+		t.Errorf("RemovePending(1) = %+v; want since %v", pc, t1)
+	}
+	if pc := st.RemovePending(1); pc != nil {
+		t.Errorf("second RemovePending(1) = %+v; want nil", pc)
+	}
+}
+
+func TestFileHashMatches(t *testing.T) {
+	mtime := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	h := &FileHash{Size: 10, ModTime: mtime, Device: 1, Inode: 2, SHA256: "abc"}
+	tests := []struct {
+		key  FileHash
+		want bool
+	}{
+		{FileHash{Size: 10, ModTime: mtime, Device: 1, Inode: 2}, true},
+		{FileHash{Size: 10, ModTime: mtime.Local(), Device: 1, Inode: 2}, true},
+		{FileHash{Size: 11, ModTime: mtime, Device: 1, Inode: 2}, false},
+		{FileHash{Size: 10, ModTime: mtime.Add(time.Nanosecond), Device: 1, Inode: 2}, false},
+		{FileHash{Size: 10, ModTime: mtime, Device: 1, Inode: 3}, false},
+		{FileHash{Size: 10, ModTime: mtime, Device: 4, Inode: 2}, false},
+	}
+	for _, test := range tests {
+		if got := h.Matches(&test.key); got != test.want {
+			t.Errorf("h.Matches(%+v) = %t; want %t", test.key, got, test.want)
+		}
+	}
+}
@@ -22,9 +22,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -45,9 +48,92 @@ var epoch = time.Date(2016, time.November, 24, 0, 0, 0, 0, time.UTC)
 // It uses path/filepath for path manipulation.  It is safe to use from
 // multiple goroutines.  The zero value is an empty filesystem.
 type System struct {
-	mu   sync.Mutex
-	fs   map[string]*entry
-	time time.Time
+	// Clock is the source of the system's time if non-nil.  Otherwise,
+	// Now returns the wall clock time and file modification times start
+	// at a fixed time and step forward by a second with each operation.
+	// Clock must not be changed once the system is in use.
+	Clock *Clock
+
+	// FreeSpace is the number of bytes that DiskFree reports for every
+	// filesystem.
+	FreeSpace int64
+
+	// Kernel is the release that KernelVersion returns.  If empty, then
+	// KernelVersion returns an error.
+	Kernel string
+
+	// Unprivileged makes Privileged report that the applier is not the
+	// superuser.
+	Unprivileged bool
+
+	mu          sync.Mutex
+	fs          map[string]*entry
+	time        time.Time
+	umask       os.FileMode
+	ports       map[string]bool
+	invocations []*Invocation
+	registry    map[string]map[string]system.RegistryValue
+	services    map[string]*system.ServiceStatus
+	locks       map[string]chan struct{}
+}
+
+// A Clock is a deterministic time source that only moves when
+// advanced.  It is safe to use from multiple goroutines.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a clock that starts at t.
+func NewClock(t time.Time) *Clock {
+	return &Clock{now: t}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// Now returns the time on Clock, or the wall clock time if Clock is nil.
+func (sys *System) Now() time.Time {
+	if sys.Clock == nil {
+		return time.Now()
+	}
+	return sys.Clock.Now()
+}
+
+// An Invocation is a record of a program run on a System.
+type Invocation struct {
+	Path  string
+	Args  []string
+	Env   []string
+	Dir   string
+	Stdin []byte
+
+	// Background is true if the program was run with Start.
+	Background bool
+
+	// Time is the value of the system's Now when the program started.
+	Time time.Time
+}
+
+// Invocations returns the programs that have been run on the system, in
+// the order they were started.
+func (sys *System) Invocations() []*Invocation {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	inv := make([]*Invocation, len(sys.invocations))
+	copy(inv, sys.invocations)
+	return inv
 }
 
 // Program is a function to call when an executable file is run.
@@ -57,6 +143,7 @@ type ProgramContext struct {
 	Args   []string
 	Env    []string
 	Dir    string
+	Sched  *system.Sched
 	Input  io.Reader
 	Output io.Writer
 }
@@ -79,7 +166,7 @@ func (sys *System) init() {
 	sys.fs = make(map[string]*entry)
 	sys.fs["/"] = &entry{
 		mode:    os.ModeDir | 0777,
-		modTime: sys.time,
+		modTime: sys.modTime(),
 	}
 }
 
@@ -87,6 +174,15 @@ func (sys *System) stepTime() {
 	sys.time = sys.time.Add(1 * time.Second)
 }
 
+// modTime returns the modification time to give to changed entries.
+// The caller must hold sys.mu.
+func (sys *System) modTime() time.Time {
+	if sys.Clock != nil {
+		return sys.Clock.Now()
+	}
+	return sys.time
+}
+
 func (sys *System) resolve(path string) string {
 	parts := pathParts(path)
 	if len(parts) == 0 {
@@ -166,7 +262,7 @@ func (sys *System) mkentry(path string, mode os.FileMode) (*entry, error) {
 	}
 	ent := &entry{
 		mode:    mode,
-		modTime: sys.time,
+		modTime: sys.modTime(),
 		uid:     DefaultUID,
 		gid:     DefaultGID,
 	}
@@ -185,16 +281,115 @@ func (sys *System) CreateFile(ctx context.Context, path string, mode os.FileMode
 	defer sys.stepTime()
 	sys.mu.Lock()
 	sys.init()
-	ent, err := sys.mkentry(path, mode&os.ModePerm)
+	ent, err := sys.mkentry(path, mode&os.ModePerm&^sys.umask)
 	if err != nil {
 		return nil, wrap(err)
 	}
 	return &openFile{
-		mu:  &sys.mu,
-		ent: ent,
+		sys:     sys,
+		ent:     ent,
+		written: true,
 	}, nil
 }
 
+// Lock takes a lock on the file that is only seen by other calls to
+// Lock on the same System.  The file is created if it does not exist.
+func (sys *System) Lock(ctx context.Context, path string, mode os.FileMode) (system.FileLock, error) {
+	wrap := pathErrorFunc("lock", path)
+	path, err := cleanPath(path)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	for {
+		sys.mu.Lock()
+		sys.init()
+		path = sys.resolve(path)
+		if sys.fs[path] == nil {
+			if _, err := sys.mkentry(path, mode&os.ModePerm&^sys.umask); err != nil {
+				sys.mu.Unlock()
+				return nil, wrap(err)
+			}
+			sys.stepTime()
+		}
+		held := sys.locks[path]
+		if held == nil {
+			if sys.locks == nil {
+				sys.locks = make(map[string]chan struct{})
+			}
+			sys.locks[path] = make(chan struct{})
+			sys.mu.Unlock()
+			return &fileLock{sys: sys, path: path}, nil
+		}
+		sys.mu.Unlock()
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return nil, wrap(ctx.Err())
+		}
+	}
+}
+
+type fileLock struct {
+	sys  *System
+	path string
+	once sync.Once
+}
+
+func (l *fileLock) Unlock() error {
+	unlocked := false
+	l.once.Do(func() {
+		l.sys.mu.Lock()
+		close(l.sys.locks[l.path])
+		delete(l.sys.locks, l.path)
+		l.sys.mu.Unlock()
+		unlocked = true
+	})
+	if !unlocked {
+		return errors.New("fake OS: unlock of unlocked file")
+	}
+	return nil
+}
+
+// CloneFile copies the content of src to dst, since the fake filesystem
+// has no data blocks to share.
+func (sys *System) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	wrap := func(err error) error {
+		return &os.LinkError{Op: "clone", Old: src, New: dst, Err: err}
+	}
+	src, err := cleanPath(src)
+	if err != nil {
+		return wrap(err)
+	}
+	dst, err = cleanPath(dst)
+	if err != nil {
+		return wrap(err)
+	}
+
+	defer sys.mu.Unlock()
+	defer sys.stepTime()
+	sys.mu.Lock()
+	sys.init()
+	in := sys.fs[sys.resolve(src)]
+	if in == nil {
+		return wrap(os.ErrNotExist)
+	}
+	if !in.mode.IsRegular() {
+		return wrap(errors.New("fake OS: not a file"))
+	}
+	out := sys.fs[sys.resolve(dst)]
+	if out == nil {
+		out, err = sys.mkentry(dst, mode&os.ModePerm&^sys.umask)
+		if err != nil {
+			return wrap(err)
+		}
+	} else if !out.mode.IsRegular() {
+		return wrap(errors.New("fake OS: not a file"))
+	}
+	out.content = append([]byte(nil), in.content...)
+	out.modTime = sys.modTime()
+	return nil
+}
+
 func (sys *System) OpenFile(ctx context.Context, path string) (system.File, error) {
 	wrap := pathErrorFunc("open", path)
 	path, err := cleanPath(path)
@@ -213,9 +408,8 @@ func (sys *System) OpenFile(ctx context.Context, path string) (system.File, erro
 	if !ent.mode.IsRegular() {
 		return nil, wrap(errors.New("fake OS: not a file"))
 	}
-	ent.modTime = sys.time
 	return &openFile{
-		mu:   &sys.mu,
+		sys:  sys,
 		ent:  ent,
 		data: append([]byte(nil), ent.content...),
 	}, nil
@@ -232,13 +426,23 @@ func (sys *System) Mkdir(ctx context.Context, path string, mode os.FileMode) err
 	defer sys.stepTime()
 	sys.mu.Lock()
 	sys.init()
-	_, err = sys.mkentry(path, os.ModeDir|mode&os.ModePerm)
+	_, err = sys.mkentry(path, os.ModeDir|mode&os.ModePerm&^sys.umask)
 	if err != nil {
 		return wrap(err)
 	}
 	return nil
 }
 
+// Umask sets the mask applied to the mode of subsequently created files
+// and directories.  The initial mask is zero.
+func (sys *System) Umask(mask os.FileMode) os.FileMode {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	old := sys.umask
+	sys.umask = mask & os.ModePerm
+	return old
+}
+
 func (sys *System) Symlink(ctx context.Context, oldname, newname string) error {
 	wrap := linkErrorFunc("symlink", oldname, newname)
 	newname, err := cleanPath(newname)
@@ -298,7 +502,7 @@ func (sys *System) Chmod(ctx context.Context, path string, mode os.FileMode) err
 		return wrap(os.ErrNotExist)
 	}
 	ent.mode = (ent.mode &^ mask) | (mode & mask)
-	ent.modTime = sys.time
+	ent.modTime = sys.modTime()
 	return nil
 }
 
@@ -324,7 +528,7 @@ func (sys *System) Chown(ctx context.Context, path string, uid system.UID, gid s
 		ent.gid = gid
 	}
 	if uid != -1 && gid != -1 {
-		ent.modTime = sys.time
+		ent.modTime = sys.modTime()
 	}
 	return nil
 }
@@ -337,6 +541,42 @@ func (sys *System) OwnerInfo(info os.FileInfo) (system.UID, system.GID, error) {
 	return s.uid, s.gid, nil
 }
 
+func (sys *System) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	wrap := pathErrorFunc("readdir", path)
+	path, err := cleanPath(path)
+	if err != nil {
+		return nil, wrap(err)
+	}
+
+	defer sys.mu.Unlock()
+	defer sys.stepTime()
+	sys.mu.Lock()
+	sys.init()
+	path = sys.resolve(path)
+	ent := sys.fs[path]
+	if ent == nil {
+		return nil, wrap(os.ErrNotExist)
+	}
+	if !ent.mode.IsDir() {
+		return nil, wrap(errors.New("fake OS: not a directory"))
+	}
+	names := sys.readdir(path)
+	sort.Strings(names)
+	infos := make([]os.FileInfo, len(names))
+	for i, name := range names {
+		child := sys.fs[filepath.Join(path, name)]
+		infos[i] = &stat{
+			name:    name,
+			mode:    child.mode,
+			modTime: child.modTime,
+			size:    len(child.content),
+			uid:     child.uid,
+			gid:     child.gid,
+		}
+	}
+	return infos, nil
+}
+
 func (sys *System) readdir(path string) []string {
 	var names []string
 	for p := range sys.fs {
@@ -383,6 +623,51 @@ func (sys *System) Remove(ctx context.Context, path string) error {
 	return nil
 }
 
+// Rename moves the entry at oldpath to newpath, replacing any entry
+// at newpath that isn't a directory.  Directories can't be renamed.
+func (sys *System) Rename(ctx context.Context, oldpath, newpath string) error {
+	wrap := linkErrorFunc("rename", oldpath, newpath)
+	oldpath, err := cleanPath(oldpath)
+	if err != nil {
+		return wrap(err)
+	}
+	newpath, err = cleanPath(newpath)
+	if err != nil {
+		return wrap(err)
+	}
+
+	defer sys.mu.Unlock()
+	defer sys.stepTime()
+	sys.mu.Lock()
+	sys.init()
+	var paths [2]string
+	for i, path := range []string{oldpath, newpath} {
+		dir, name := filepath.Split(path)
+		dir = sys.resolve(dir)
+		par := sys.fs[dir]
+		if par == nil || !par.mode.IsDir() {
+			return wrap(os.ErrNotExist)
+		}
+		if par.mode&0222 == 0 {
+			return wrap(os.ErrPermission)
+		}
+		paths[i] = filepath.Join(dir, name)
+	}
+	ent := sys.fs[paths[0]]
+	if ent == nil {
+		return wrap(os.ErrNotExist)
+	}
+	if ent.mode.IsDir() {
+		return wrap(errors.New("fake OS: renaming directories not supported"))
+	}
+	if old := sys.fs[paths[1]]; old != nil && old.mode.IsDir() {
+		return wrap(errors.New("fake OS: is a directory"))
+	}
+	delete(sys.fs, paths[0])
+	sys.fs[paths[1]] = ent
+	return nil
+}
+
 // Mkprogram creates a filesystem entry that calls a program when run.
 func (sys *System) Mkprogram(path string, prog Program) error {
 	wrap := pathErrorFunc("mkprogram", path)
@@ -427,7 +712,127 @@ func (sys *System) LookupGroup(name string) (system.GID, error) {
 	}
 }
 
+// Run calls the program and waits for it to return.  The invocation is
+// recorded, including all of cmd.Stdin, which is read before the
+// program is called.
 func (sys *System) Run(ctx context.Context, cmd *system.Cmd) (output []byte, err error) {
+	program, err := sys.program(cmd)
+	if err != nil {
+		return nil, err
+	}
+	in, err := sys.record(cmd, false)
+	if err != nil {
+		return nil, err
+	}
+	out := &system.OutputBuffer{Max: cmd.MaxOutput}
+	exit := program(ctx, &ProgramContext{
+		Args:   cmd.Args,
+		Env:    cmd.Env,
+		Dir:    cmd.Dir,
+		Sched:  cmd.Sched,
+		Input:  in,
+		Output: out,
+	})
+	if exit != 0 {
+		return out.Bytes(), new(exec.ExitError)
+	}
+	return out.Bytes(), nil
+}
+
+// Start calls the program in a new goroutine.  The program is passed a
+// context that is canceled when the process is killed.  The invocation
+// is recorded as for Run.
+func (sys *System) Start(ctx context.Context, cmd *system.Cmd) (system.Process, error) {
+	program, err := sys.program(cmd)
+	if err != nil {
+		return nil, err
+	}
+	in, err := sys.record(cmd, true)
+	if err != nil {
+		return nil, err
+	}
+	pctx, cancel := context.WithCancel(context.Background())
+	p := &process{
+		cancel: cancel,
+		done:   make(chan struct{}),
+		out:    system.OutputBuffer{Max: cmd.MaxOutput},
+	}
+	go func() {
+		exit := program(pctx, &ProgramContext{
+			Args:   cmd.Args,
+			Env:    cmd.Env,
+			Dir:    cmd.Dir,
+			Sched:  cmd.Sched,
+			Input:  in,
+			Output: p,
+		})
+		if exit != 0 {
+			p.err = new(exec.ExitError)
+		}
+		close(p.done)
+	}()
+	return p, nil
+}
+
+type process struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+
+	mu  sync.Mutex
+	out system.OutputBuffer
+}
+
+func (p *process) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.out.Write(b)
+}
+
+func (p *process) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *process) Kill() error {
+	p.cancel()
+	return nil
+}
+
+func (p *process) Output() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]byte(nil), p.out.Bytes()...)
+}
+
+// record adds cmd to the system's invocations and returns a reader of
+// its standard input.
+func (sys *System) record(cmd *system.Cmd, background bool) (io.Reader, error) {
+	var stdin []byte
+	if cmd.Stdin != nil {
+		var err error
+		stdin, err = ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return nil, &os.PathError{Op: "exec", Path: cmd.Path, Err: fmt.Errorf("read stdin: %v", err)}
+		}
+	}
+	inv := &Invocation{
+		Path:       cmd.Path,
+		Args:       append([]string(nil), cmd.Args...),
+		Env:        append([]string(nil), cmd.Env...),
+		Dir:        cmd.Dir,
+		Stdin:      stdin,
+		Background: background,
+		Time:       sys.Now(),
+	}
+	sys.mu.Lock()
+	sys.invocations = append(sys.invocations, inv)
+	sys.mu.Unlock()
+	return bytes.NewReader(stdin), nil
+}
+
+// program finds the program that cmd runs.
+func (sys *System) program(cmd *system.Cmd) (Program, error) {
 	wrap := pathErrorFunc("exec", cmd.Path)
 	path, err := cleanPath(cmd.Path)
 	if err != nil {
@@ -458,27 +863,94 @@ func (sys *System) Run(ctx context.Context, cmd *system.Cmd) (output []byte, err
 	if program == nil {
 		return nil, wrap(errors.New("fake system: not a program"))
 	}
-	in := cmd.Stdin
-	if in == nil {
-		in = bytes.NewReader(nil)
+	return program, nil
+}
+
+// OpenPort makes DialContext succeed for the given network and address
+// until ClosePort is called.
+func (sys *System) OpenPort(network, address string) {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	if sys.ports == nil {
+		sys.ports = make(map[string]bool)
 	}
-	out := new(bytes.Buffer)
-	exit := program(ctx, &ProgramContext{
-		Args:   cmd.Args,
-		Env:    cmd.Env,
-		Dir:    cmd.Dir,
-		Input:  in,
-		Output: out,
-	})
-	if exit != 0 {
-		return out.Bytes(), new(exec.ExitError)
+	sys.ports[network+" "+address] = true
+}
+
+// ClosePort undoes a call to OpenPort.
+func (sys *System) ClosePort(network, address string) {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	delete(sys.ports, network+" "+address)
+}
+
+// DialContext returns a connection whose peer has already hung up if
+// the address was opened with OpenPort.  Otherwise, it returns a
+// connection refused error.
+func (sys *System) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	sys.mu.Lock()
+	open := sys.ports[network+" "+address]
+	sys.mu.Unlock()
+	if !open {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("fake system: connection refused")}
 	}
-	return out.Bytes(), nil
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+// DiskFree returns sys.FreeSpace if path exists.
+func (sys *System) DiskFree(ctx context.Context, path string) (int64, error) {
+	if _, err := sys.Lstat(ctx, path); err != nil {
+		return 0, err
+	}
+	return sys.FreeSpace, nil
+}
+
+// KernelVersion returns sys.Kernel.
+func (sys *System) KernelVersion(ctx context.Context) (string, error) {
+	if sys.Kernel == "" {
+		return "", errors.New("fake OS: no kernel version")
+	}
+	return sys.Kernel, nil
+}
+
+// Privileged reports whether sys.Unprivileged is false.
+func (sys *System) Privileged(ctx context.Context) (bool, error) {
+	return !sys.Unprivileged, nil
+}
+
+// DefaultPath is the search path LookPath uses for an empty pathList.
+var DefaultPath = filepath.Join(Root, "usr", "bin") + string(filepath.ListSeparator) + filepath.Join(Root, "bin")
+
+// LookPath searches for a program named file in pathList.
+func (sys *System) LookPath(ctx context.Context, file string, pathList string) (string, error) {
+	if pathList == "" {
+		pathList = DefaultPath
+	}
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	sys.init()
+	for _, dir := range filepath.SplitList(pathList) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		path := filepath.Join(dir, file)
+		ent := sys.fs[sys.resolve(path)]
+		if ent != nil && ent.mode.IsRegular() && ent.mode&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", &os.PathError{Op: "lookpath", Path: file, Err: os.ErrNotExist}
 }
 
 var (
-	_ system.FS     = (*System)(nil)
-	_ system.Runner = (*System)(nil)
+	_ system.FS            = (*System)(nil)
+	_ system.Runner        = (*System)(nil)
+	_ system.HostInspector = (*System)(nil)
+	_ system.Locker        = (*System)(nil)
+	_ system.Cloner        = (*System)(nil)
+	_ system.Renamer       = (*System)(nil)
 )
 
 func cleanPath(path string) (string, error) {
@@ -535,11 +1007,12 @@ func linkErrorFunc(op string, oldname, newname string) func(error) error {
 }
 
 type openFile struct {
-	data   []byte
-	pos    int
-	closed bool
+	data    []byte
+	pos     int
+	closed  bool
+	written bool
 
-	mu  *sync.Mutex // pointer to System.mu
+	sys *System
 	ent *entry
 }
 
@@ -549,7 +1022,7 @@ func (f *openFile) Read(p []byte) (n int, err error) {
 	}
 	n = copy(p, f.data[f.pos:])
 	f.pos += n
-	if n >= len(f.data) {
+	if f.pos >= len(f.data) {
 		err = io.EOF
 	}
 	return
@@ -560,6 +1033,7 @@ func (f *openFile) Write(p []byte) (n int, err error) {
 		return 0, errClosed
 	}
 	n = len(p)
+	f.written = true
 	if f.pos < len(f.data) {
 		nn := copy(f.data[f.pos:], p)
 		p = p[nn:]
@@ -600,6 +1074,7 @@ func (f *openFile) Truncate(size int64) error {
 		return errClosed
 	}
 	f.data = f.data[:size]
+	f.written = true
 	return nil
 }
 
@@ -607,11 +1082,16 @@ func (f *openFile) Close() error {
 	if f.closed {
 		return errClosed
 	}
-	defer f.mu.Unlock()
-	f.mu.Lock()
+	f.closed = true
+	if !f.written {
+		return nil
+	}
+	defer f.sys.mu.Unlock()
+	defer f.sys.stepTime()
+	f.sys.mu.Lock()
 	f.ent.content = f.data
 	f.ent.program = nil
-	f.closed = true
+	f.ent.modTime = f.sys.modTime()
 	return nil
 }
 
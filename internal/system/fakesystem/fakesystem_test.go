@@ -25,6 +25,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/zombiezen/mcm/internal/system"
 )
@@ -173,6 +174,47 @@ func TestMkdir(t *testing.T) {
 	})
 }
 
+func TestUmask(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sys := new(System)
+	if old := sys.Umask(0027); old != 0 {
+		t.Errorf("initial umask = %#04o; want 0", uint32(old))
+	}
+	fpath := filepath.Join(Root, "foo")
+	w, err := sys.CreateFile(ctx, fpath, 0666)
+	if err != nil {
+		t.Fatalf("sys.CreateFile(ctx, %q, 0666): %v", fpath, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error("Close:", err)
+	}
+	dirpath := filepath.Join(Root, "bar")
+	if err := sys.Mkdir(ctx, dirpath, 0777); err != nil {
+		t.Fatalf("sys.Mkdir(ctx, %q, 0777): %v", dirpath, err)
+	}
+	tests := []struct {
+		path string
+		perm os.FileMode
+	}{
+		{fpath, 0640},
+		{dirpath, 0750},
+	}
+	for _, test := range tests {
+		info, err := sys.Lstat(ctx, test.path)
+		if err != nil {
+			t.Errorf("sys.Lstat(ctx, %q) = _, %v; want nil", test.path, err)
+			continue
+		}
+		if perm := info.Mode() & os.ModePerm; perm != test.perm {
+			t.Errorf("sys.Lstat(ctx, %q).Mode()&os.ModePerm = %#04o; want %#04o", test.path, uint32(perm), uint32(test.perm))
+		}
+	}
+	if old := sys.Umask(0); old != 0027 {
+		t.Errorf("sys.Umask(0) = %#04o; want 0027", uint32(old))
+	}
+}
+
 func TestRemove(t *testing.T) {
 	emptyDirPath := filepath.Join(Root, "emptydir")
 	filePath := filepath.Join(Root, "file")
@@ -245,6 +287,56 @@ func TestRemove(t *testing.T) {
 	}
 }
 
+func TestReadDir(t *testing.T) {
+	ctx := context.Background()
+	dirPath := filepath.Join(Root, "dir")
+	linkPath := filepath.Join(Root, "link")
+	sys := new(System)
+	if err := mkdir(ctx, t, sys, dirPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := mkfile(ctx, t, sys, filepath.Join(dirPath, "b"), []byte("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mkdir(ctx, t, sys, filepath.Join(dirPath, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mkfile(ctx, t, sys, filepath.Join(dirPath, "a", "c"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := mklink(ctx, t, sys, dirPath, linkPath); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{dirPath, linkPath} {
+		infos, err := sys.ReadDir(ctx, path)
+		if err != nil {
+			t.Errorf("sys.ReadDir(ctx, %q): %v", path, err)
+			continue
+		}
+		if len(infos) != 2 || infos[0].Name() != "a" || infos[1].Name() != "b" {
+			var names []string
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			t.Errorf("sys.ReadDir(ctx, %q) names = %q; want [\"a\" \"b\"]", path, names)
+			continue
+		}
+		if !infos[0].IsDir() {
+			t.Errorf("sys.ReadDir(ctx, %q)[0].IsDir() = false; want true", path)
+		}
+		if infos[1].Size() != 5 {
+			t.Errorf("sys.ReadDir(ctx, %q)[1].Size() = %d; want 5", path, infos[1].Size())
+		}
+	}
+	if _, err := sys.ReadDir(ctx, filepath.Join(Root, "nonexistent")); !system.IsNotExist(err) {
+		t.Errorf("sys.ReadDir(ctx, nonexistent) = _, %v; want not exist", err)
+	}
+	if _, err := sys.ReadDir(ctx, filepath.Join(dirPath, "b")); err == nil {
+		t.Error("sys.ReadDir(ctx, file) = _, nil; want error")
+	}
+}
+
 func TestSymlink(t *testing.T) {
 	dpath := filepath.Join(Root, "dir")
 	fpath := filepath.Join(dpath, "foo.txt")
@@ -588,6 +680,304 @@ func TestRun(t *testing.T) {
 	})
 }
 
+func TestStart(t *testing.T) {
+	ctx := context.Background()
+	sys := new(System)
+	path := filepath.Join(Root, "server")
+	err := sys.Mkprogram(path, func(ctx context.Context, pc *ProgramContext) int {
+		io.WriteString(pc.Output, "listening")
+		sys.OpenPort("tcp", "localhost:80")
+		<-ctx.Done()
+		sys.ClosePort("tcp", "localhost:80")
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	p, err := sys.Start(ctx, &system.Cmd{Path: path, Args: []string{path}})
+	if err != nil {
+		t.Fatal("Start:", err)
+	}
+	for i := 0; ; i++ {
+		conn, err := sys.DialContext(ctx, "tcp", "localhost:80")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i >= 1000 {
+			t.Fatal("port never opened:", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Kill(); err != nil {
+		t.Error("Kill:", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Error("Wait:", err)
+	}
+	if out := string(p.Output()); out != "listening" {
+		t.Errorf("Output() = %q; want \"listening\"", out)
+	}
+	if _, err := sys.DialContext(ctx, "tcp", "localhost:80"); err == nil {
+		t.Error("DialContext succeeded after port closed")
+	}
+}
+
+func TestInvocations(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	sys := &System{Clock: NewClock(start)}
+	path := filepath.Join(Root, "prog")
+	err := sys.Mkprogram(path, func(ctx context.Context, pc *ProgramContext) int {
+		sys.Clock.Advance(time.Minute)
+		io.Copy(pc.Output, pc.Input)
+		return 0
+	})
+	if err != nil {
+		t.Fatal("Mkprogram:", err)
+	}
+	out, err := sys.Run(ctx, &system.Cmd{
+		Path:  path,
+		Args:  []string{path, "first"},
+		Env:   []string{"FOO=bar"},
+		Dir:   Root,
+		Stdin: strings.NewReader("input"),
+	})
+	if err != nil {
+		t.Fatal("Run:", err)
+	}
+	if string(out) != "input" {
+		t.Errorf("Run output = %q; want \"input\"", out)
+	}
+	p, err := sys.Start(ctx, &system.Cmd{Path: path, Args: []string{path, "second"}})
+	if err != nil {
+		t.Fatal("Start:", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Error("Wait:", err)
+	}
+
+	inv := sys.Invocations()
+	if len(inv) != 2 {
+		t.Fatalf("len(Invocations()) = %d; want 2", len(inv))
+	}
+	if got := inv[0]; got.Path != path || len(got.Args) != 2 || got.Args[1] != "first" ||
+		len(got.Env) != 1 || got.Env[0] != "FOO=bar" || got.Dir != Root ||
+		string(got.Stdin) != "input" || got.Background || !got.Time.Equal(start) {
+		t.Errorf("Invocations()[0] = %+v", got)
+	}
+	if got := inv[1]; got.Args[1] != "second" || got.Stdin != nil || !got.Background || !got.Time.Equal(start.Add(time.Minute)) {
+		t.Errorf("Invocations()[1] = %+v", got)
+	}
+}
+
+func TestClock(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	sys := &System{Clock: NewClock(start)}
+	if now := sys.Now(); !now.Equal(start) {
+		t.Errorf("Now() = %v; want %v", now, start)
+	}
+	sys.Clock.Advance(time.Hour)
+	path := filepath.Join(Root, "foo")
+	if err := system.WriteFile(ctx, sys, path, []byte("foo"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	info, err := sys.Lstat(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(time.Hour); !info.ModTime().Equal(want) {
+		t.Errorf("ModTime() = %v; want %v", info.ModTime(), want)
+	}
+}
+
+func TestOpenFileModTime(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2017, time.March, 1, 12, 0, 0, 0, time.UTC)
+	sys := &System{Clock: NewClock(start)}
+	path := filepath.Join(Root, "foo")
+	if err := system.WriteFile(ctx, sys, path, []byte("foo"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	sys.Clock.Advance(time.Hour)
+	if _, err := system.ReadFile(ctx, sys, path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := sys.Lstat(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(start) {
+		t.Errorf("after reading, ModTime() = %v; want %v", info.ModTime(), start)
+	}
+	if err := system.WriteFile(ctx, sys, path, []byte("bar"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	info, err = sys.Lstat(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(time.Hour); !info.ModTime().Equal(want) {
+		t.Errorf("after writing, ModTime() = %v; want %v", info.ModTime(), want)
+	}
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	sys := new(System)
+	path := filepath.Join(Root, "lock")
+	l, err := sys.Lock(ctx, path, 0644)
+	if err != nil {
+		t.Fatal("Lock:", err)
+	}
+	if info, err := sys.Lstat(ctx, path); err != nil {
+		t.Error(err)
+	} else if !info.Mode().IsRegular() {
+		t.Errorf("lock file mode = %v; want regular file", info.Mode())
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if l2, err := sys.Lock(timeoutCtx, path, 0644); err == nil {
+		l2.Unlock()
+		t.Error("second Lock succeeded while first lock held")
+	}
+
+	locked := make(chan error, 1)
+	go func() {
+		l2, err := sys.Lock(ctx, path, 0644)
+		if err == nil {
+			err = l2.Unlock()
+		}
+		locked <- err
+	}()
+	if err := l.Unlock(); err != nil {
+		t.Error("Unlock:", err)
+	}
+	if err := <-locked; err != nil {
+		t.Error("Lock after Unlock:", err)
+	}
+	if err := l.Unlock(); err == nil {
+		t.Error("second Unlock did not return an error")
+	}
+}
+
+func TestCloneFile(t *testing.T) {
+	ctx := context.Background()
+	sys := new(System)
+	src := filepath.Join(Root, "src")
+	dst := filepath.Join(Root, "dst")
+	if err := system.WriteFile(ctx, sys, src, []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.CloneFile(ctx, src, dst, 0600); err != nil {
+		t.Fatal("CloneFile:", err)
+	}
+	if got, err := system.ReadFile(ctx, sys, dst); err != nil {
+		t.Error(err)
+	} else if string(got) != "Hello, World!" {
+		t.Errorf("clone content = %q; want \"Hello, World!\"", got)
+	}
+	if info, err := sys.Lstat(ctx, dst); err != nil {
+		t.Error(err)
+	} else if info.Mode() != 0600 {
+		t.Errorf("clone mode = %v; want %v", info.Mode(), os.FileMode(0600))
+	}
+
+	if err := system.WriteFile(ctx, sys, src, []byte("Bye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.CloneFile(ctx, src, dst, 0644); err != nil {
+		t.Fatal("CloneFile over existing file:", err)
+	}
+	if got, err := system.ReadFile(ctx, sys, dst); err != nil {
+		t.Error(err)
+	} else if string(got) != "Bye" {
+		t.Errorf("clone content after second clone = %q; want \"Bye\"", got)
+	}
+	if info, err := sys.Lstat(ctx, dst); err != nil {
+		t.Error(err)
+	} else if info.Mode() != 0600 {
+		t.Errorf("clone mode after second clone = %v; want %v", info.Mode(), os.FileMode(0600))
+	}
+
+	if err := sys.CloneFile(ctx, filepath.Join(Root, "nonexistent"), filepath.Join(Root, "dst2"), 0644); err == nil {
+		t.Error("CloneFile of nonexistent file did not return an error")
+	}
+	if _, err := sys.Lstat(ctx, filepath.Join(Root, "dst2")); !os.IsNotExist(err) {
+		t.Errorf("Lstat of failed clone = %v; want not exist", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	ctx := context.Background()
+	sys := new(System)
+	src := filepath.Join(Root, "src")
+	dst := filepath.Join(Root, "dst")
+	if err := system.WriteFile(ctx, sys, src, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := system.WriteFile(ctx, sys, dst, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.Rename(ctx, src, dst); err != nil {
+		t.Fatal("Rename:", err)
+	}
+	if _, err := sys.Lstat(ctx, src); !os.IsNotExist(err) {
+		t.Errorf("Lstat(%q) after rename = %v; want not exist", src, err)
+	}
+	if got, err := system.ReadFile(ctx, sys, dst); err != nil {
+		t.Error(err)
+	} else if string(got) != "new" {
+		t.Errorf("content after rename = %q; want \"new\"", got)
+	}
+	if info, err := sys.Lstat(ctx, dst); err != nil {
+		t.Error(err)
+	} else if info.Mode() != 0600 {
+		t.Errorf("mode after rename = %v; want %v", info.Mode(), os.FileMode(0600))
+	}
+
+	if err := sys.Rename(ctx, src, dst); !os.IsNotExist(err) {
+		t.Errorf("Rename of nonexistent file = %v; want not exist", err)
+	}
+	dir := filepath.Join(Root, "dir")
+	if err := sys.Mkdir(ctx, dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.Rename(ctx, dst, dir); err == nil {
+		t.Error("Rename over a directory did not return an error")
+	}
+}
+
+func TestLookPath(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	binDir := filepath.Join(Root, "bin")
+	otherDir := filepath.Join(Root, "other")
+	progPath := filepath.Join(binDir, "program")
+	sys := new(System)
+	if err := mkdir(ctx, t, sys, binDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := mkdir(ctx, t, sys, otherDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := sys.Mkprogram(progPath, func(ctx context.Context, pc *ProgramContext) int { return 0 }); err != nil {
+		t.Fatalf("sys.Mkprogram(%q, ...): %v", progPath, err)
+	}
+	pathList := otherDir + string(filepath.ListSeparator) + binDir
+	if path, err := sys.LookPath(ctx, "program", pathList); err != nil || path != progPath {
+		t.Errorf("sys.LookPath(ctx, \"program\", %q) = %q, %v; want %q, <nil>", pathList, path, err, progPath)
+	}
+	if path, err := sys.LookPath(ctx, "program", ""); err != nil || path != progPath {
+		t.Errorf("sys.LookPath(ctx, \"program\", \"\") = %q, %v; want %q, <nil>", path, err, progPath)
+	}
+	if path, err := sys.LookPath(ctx, "program", otherDir); !os.IsNotExist(err) {
+		t.Errorf("sys.LookPath(ctx, \"program\", %q) = %q, %v; want not exist error", otherDir, path, err)
+	}
+}
+
 func TestPathParts(t *testing.T) {
 	type testCase struct {
 		path  string
@@ -669,3 +1059,79 @@ func mklink(ctx context.Context, log logger, fs system.FS, oldname, newname stri
 	}
 	return nil
 }
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	sys := new(System)
+	if err := sys.CreateRegistryKey(ctx, `HKLM\SOFTWARE\Example\Sub`); err != nil {
+		t.Fatal("CreateRegistryKey:", err)
+	}
+	for _, key := range []string{`HKLM`, `HKLM\SOFTWARE`, `HKEY_LOCAL_MACHINE\software\example`, `HKLM\SOFTWARE\Example\Sub`} {
+		if exists, err := sys.RegistryKeyExists(ctx, key); err != nil || !exists {
+			t.Errorf("RegistryKeyExists(%q) = %t, %v; want true, <nil>", key, exists, err)
+		}
+	}
+	if _, err := sys.RegistryValue(ctx, `HKLM\SOFTWARE\Example`, "x"); !os.IsNotExist(err) {
+		t.Errorf("RegistryValue of missing value error = %v; want not exist", err)
+	}
+	if err := sys.SetRegistryValue(ctx, `HKLM\SOFTWARE\Missing`, "x", system.DWORDValue(1)); !os.IsNotExist(err) {
+		t.Errorf("SetRegistryValue on missing key error = %v; want not exist", err)
+	}
+	if err := sys.SetRegistryValue(ctx, `HKLM\SOFTWARE\Example`, "X", system.DWORDValue(1)); err != nil {
+		t.Fatal("SetRegistryValue:", err)
+	}
+	if v, err := sys.RegistryValue(ctx, `HKLM\SOFTWARE\Example`, "x"); err != nil || !v.Equal(system.DWORDValue(1)) {
+		t.Errorf("RegistryValue = %+v, %v; want %+v, <nil>", v, err, system.DWORDValue(1))
+	}
+	if err := sys.DeleteRegistryKey(ctx, `HKLM\SOFTWARE\Example`); err != nil {
+		t.Fatal("DeleteRegistryKey:", err)
+	}
+	for _, key := range []string{`HKLM\SOFTWARE\Example`, `HKLM\SOFTWARE\Example\Sub`} {
+		if exists, err := sys.RegistryKeyExists(ctx, key); err != nil || exists {
+			t.Errorf("after delete, RegistryKeyExists(%q) = %t, %v; want false, <nil>", key, exists, err)
+		}
+	}
+	if exists, _ := sys.RegistryKeyExists(ctx, `HKLM\SOFTWARE`); !exists {
+		t.Error("DeleteRegistryKey removed the parent key")
+	}
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	sys := new(System)
+	if _, err := sys.QueryService(ctx, "example"); !os.IsNotExist(err) {
+		t.Errorf("QueryService of missing service error = %v; want not exist", err)
+	}
+	if err := sys.StartService(ctx, "example"); !os.IsNotExist(err) {
+		t.Errorf("StartService of missing service error = %v; want not exist", err)
+	}
+	if err := sys.CreateService(ctx, "example", &system.ServiceConfig{BinaryPath: `C:\example.exe`}); err != nil {
+		t.Fatal("CreateService:", err)
+	}
+	want := system.ServiceStatus{
+		ServiceConfig: system.ServiceConfig{
+			DisplayName: "example",
+			BinaryPath:  `C:\example.exe`,
+			StartType:   system.ServiceDemandStart,
+		},
+		State: system.ServiceStopped,
+	}
+	if status, err := sys.QueryService(ctx, "Example"); err != nil || *status != want {
+		t.Errorf("QueryService = %+v, %v; want %+v, <nil>", status, err, want)
+	}
+	if err := sys.StartService(ctx, "example"); err != nil {
+		t.Error("StartService:", err)
+	}
+	if status, err := sys.QueryService(ctx, "example"); err != nil || status.State != system.ServiceRunning {
+		t.Errorf("after StartService, QueryService = %+v, %v; want running", status, err)
+	}
+	if err := sys.ConfigureService(ctx, "example", &system.ServiceConfig{StartType: system.ServiceDisabled}); err != nil {
+		t.Error("ConfigureService:", err)
+	}
+	if err := sys.StopService(ctx, "example"); err != nil {
+		t.Error("StopService:", err)
+	}
+	if err := sys.StartService(ctx, "example"); !os.IsPermission(err) {
+		t.Errorf("StartService of disabled service error = %v; want permission denied", err)
+	}
+}
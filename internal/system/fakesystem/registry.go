@@ -0,0 +1,157 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakesystem
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+var _ system.Registry = (*System)(nil)
+
+// registryKey returns the map key for a registry key.  Like Windows,
+// key names are case-insensitive.
+func registryKey(key string) (string, error) {
+	root, sub, err := system.SplitRegistryKey(key)
+	if err != nil {
+		return "", err
+	}
+	if sub == "" {
+		return root, nil
+	}
+	return root + `\` + strings.ToLower(sub), nil
+}
+
+// RegistryKeyExists reports whether the key exists.  Root keys always
+// exist.
+func (sys *System) RegistryKeyExists(ctx context.Context, key string) (bool, error) {
+	k, err := registryKey(key)
+	if err != nil {
+		return false, err
+	}
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	return sys.registryKeyExists(k), nil
+}
+
+// registryKeyExists reports whether the normalized key exists.  The
+// caller must hold sys.mu.
+func (sys *System) registryKeyExists(k string) bool {
+	if !strings.Contains(k, `\`) {
+		return true
+	}
+	_, ok := sys.registry[k]
+	return ok
+}
+
+// CreateRegistryKey creates the key and any missing parents.
+func (sys *System) CreateRegistryKey(ctx context.Context, key string) error {
+	k, err := registryKey(key)
+	if err != nil {
+		return err
+	}
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	if sys.registry == nil {
+		sys.registry = make(map[string]map[string]system.RegistryValue)
+	}
+	parts := strings.Split(k, `\`)
+	for i := 2; i <= len(parts); i++ {
+		p := strings.Join(parts[:i], `\`)
+		if sys.registry[p] == nil {
+			sys.registry[p] = make(map[string]system.RegistryValue)
+		}
+	}
+	return nil
+}
+
+// DeleteRegistryKey deletes the key and all of its subkeys.
+func (sys *System) DeleteRegistryKey(ctx context.Context, key string) error {
+	k, err := registryKey(key)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(k, `\`) {
+		return &os.PathError{Op: "delete registry key", Path: key, Err: os.ErrPermission}
+	}
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	if !sys.registryKeyExists(k) {
+		return &os.PathError{Op: "delete registry key", Path: key, Err: os.ErrNotExist}
+	}
+	for kk := range sys.registry {
+		if kk == k || strings.HasPrefix(kk, k+`\`) {
+			delete(sys.registry, kk)
+		}
+	}
+	return nil
+}
+
+// RegistryValue returns a value of the key.
+func (sys *System) RegistryValue(ctx context.Context, key, name string) (system.RegistryValue, error) {
+	k, err := registryKey(key)
+	if err != nil {
+		return system.RegistryValue{}, err
+	}
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	if !sys.registryKeyExists(k) {
+		return system.RegistryValue{}, &os.PathError{Op: "read registry value", Path: key, Err: os.ErrNotExist}
+	}
+	v, ok := sys.registry[k][strings.ToLower(name)]
+	if !ok {
+		return system.RegistryValue{}, &os.PathError{Op: "read registry value", Path: key + `\` + name, Err: os.ErrNotExist}
+	}
+	return system.RegistryValue{Type: v.Type, Data: append([]byte(nil), v.Data...)}, nil
+}
+
+// SetRegistryValue sets a value of an existing key.  Values cannot be
+// set on root keys.
+func (sys *System) SetRegistryValue(ctx context.Context, key, name string, val system.RegistryValue) error {
+	k, err := registryKey(key)
+	if err != nil {
+		return err
+	}
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	values := sys.registry[k]
+	if values == nil {
+		return &os.PathError{Op: "set registry value", Path: key, Err: os.ErrNotExist}
+	}
+	values[strings.ToLower(name)] = system.RegistryValue{Type: val.Type, Data: append([]byte(nil), val.Data...)}
+	return nil
+}
+
+// DeleteRegistryValue deletes a value of the key.
+func (sys *System) DeleteRegistryValue(ctx context.Context, key, name string) error {
+	k, err := registryKey(key)
+	if err != nil {
+		return err
+	}
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	values := sys.registry[k]
+	if values == nil {
+		return &os.PathError{Op: "delete registry value", Path: key, Err: os.ErrNotExist}
+	}
+	if _, ok := values[strings.ToLower(name)]; !ok {
+		return &os.PathError{Op: "delete registry value", Path: key + `\` + name, Err: os.ErrNotExist}
+	}
+	delete(values, strings.ToLower(name))
+	return nil
+}
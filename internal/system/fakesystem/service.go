@@ -0,0 +1,114 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fakesystem
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+var _ system.ServiceManager = (*System)(nil)
+
+// QueryService returns a service's configuration and state.  Like
+// Windows, service names are case-insensitive.
+func (sys *System) QueryService(ctx context.Context, name string) (*system.ServiceStatus, error) {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	svc := sys.services[strings.ToLower(name)]
+	if svc == nil {
+		return nil, &os.PathError{Op: "query service", Path: name, Err: os.ErrNotExist}
+	}
+	status := *svc
+	return &status, nil
+}
+
+// CreateService installs a stopped service.  An empty display name
+// defaults to the service name and an unset start type defaults to
+// system.ServiceDemandStart.
+func (sys *System) CreateService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	k := strings.ToLower(name)
+	if sys.services[k] != nil {
+		return &os.PathError{Op: "create service", Path: name, Err: os.ErrExist}
+	}
+	svc := &system.ServiceStatus{
+		ServiceConfig: *config,
+		State:         system.ServiceStopped,
+	}
+	if svc.DisplayName == "" {
+		svc.DisplayName = name
+	}
+	if svc.StartType == 0 {
+		svc.StartType = system.ServiceDemandStart
+	}
+	if sys.services == nil {
+		sys.services = make(map[string]*system.ServiceStatus)
+	}
+	sys.services[k] = svc
+	return nil
+}
+
+// ConfigureService changes the non-empty fields of an existing
+// service's configuration.
+func (sys *System) ConfigureService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	svc := sys.services[strings.ToLower(name)]
+	if svc == nil {
+		return &os.PathError{Op: "configure service", Path: name, Err: os.ErrNotExist}
+	}
+	if config.DisplayName != "" {
+		svc.DisplayName = config.DisplayName
+	}
+	if config.BinaryPath != "" {
+		svc.BinaryPath = config.BinaryPath
+	}
+	if config.StartType != 0 {
+		svc.StartType = config.StartType
+	}
+	return nil
+}
+
+// StartService marks a service as running.  Starting a disabled
+// service is a permission error.
+func (sys *System) StartService(ctx context.Context, name string) error {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	svc := sys.services[strings.ToLower(name)]
+	if svc == nil {
+		return &os.PathError{Op: "start service", Path: name, Err: os.ErrNotExist}
+	}
+	if svc.StartType == system.ServiceDisabled {
+		return &os.PathError{Op: "start service", Path: name, Err: os.ErrPermission}
+	}
+	svc.State = system.ServiceRunning
+	return nil
+}
+
+// StopService marks a service as stopped.
+func (sys *System) StopService(ctx context.Context, name string) error {
+	sys.mu.Lock()
+	defer sys.mu.Unlock()
+	svc := sys.services[strings.ToLower(name)]
+	if svc == nil {
+		return &os.PathError{Op: "stop service", Path: name, Err: os.ErrNotExist}
+	}
+	svc.State = system.ServiceStopped
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"os"
+	"syscall"
+)
+
+func diskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+func kernelRelease() (string, error) {
+	release, err := syscall.Sysctl("kern.osrelease")
+	if err != nil {
+		return "", os.NewSyscallError("sysctl", err)
+	}
+	return release, nil
+}
+
+// tryLock takes an exclusive flock(2) lock on f without waiting,
+// returning errLocked if another open file holds it.
+func tryLock(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
+
+// cloneFile is not supported, since clonefile(2) can't replace an
+// existing file and the syscall package doesn't provide it.
+func cloneFile(src, dst string, mode os.FileMode) error {
+	return &os.LinkError{Op: "clone", Old: src, New: dst, Err: syscall.ENOTSUP}
+}
@@ -0,0 +1,39 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux,!darwin
+
+package system
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("disk space not supported on " + runtime.GOOS)
+}
+
+func kernelRelease() (string, error) {
+	return "", errors.New("kernel version not supported on " + runtime.GOOS)
+}
+
+func tryLock(f *os.File) error {
+	return errors.New("file locking not supported on " + runtime.GOOS)
+}
+
+func cloneFile(src, dst string, mode os.FileMode) error {
+	return errors.New("file cloning not supported on " + runtime.GOOS)
+}
@@ -16,11 +16,17 @@ package system
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 )
 
 // Local implements FS and Runner by calling to the os package.
@@ -43,6 +49,11 @@ func (Local) Remove(ctx context.Context, path string) error {
 	return os.Remove(path)
 }
 
+// ReadDir calls ioutil.ReadDir.
+func (Local) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(path)
+}
+
 // Symlink calls os.Symlink.
 func (Local) Symlink(ctx context.Context, oldname, newname string) error {
 	return os.Symlink(oldname, newname)
@@ -68,6 +79,59 @@ func (Local) CreateFile(ctx context.Context, path string, mode os.FileMode) (Fil
 	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
 }
 
+// Lock takes an flock(2) lock on the file, checking again every
+// lockPollInterval until the lock is free.  It is only supported on
+// Linux and macOS.
+func (Local) Lock(ctx context.Context, path string, mode os.FileMode) (FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := tryLock(f)
+		if err == nil {
+			return localLock{f}, nil
+		}
+		if err != errLocked {
+			f.Close()
+			return nil, &os.PathError{Op: "lock", Path: path, Err: err}
+		}
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			f.Close()
+			return nil, &os.PathError{Op: "lock", Path: path, Err: ctx.Err()}
+		}
+	}
+}
+
+// lockPollInterval is how often Local.Lock checks whether a held lock
+// has been released.
+const lockPollInterval = 100 * time.Millisecond
+
+var errLocked = errors.New("locked by another process")
+
+// localLock is a lock held by an open file.  Closing the file releases
+// the lock.
+type localLock struct {
+	f *os.File
+}
+
+func (l localLock) Unlock() error {
+	return l.f.Close()
+}
+
+// CloneFile clones src with the FICLONE ioctl(2), which btrfs and XFS
+// support.  It is only supported on Linux.
+func (Local) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	return cloneFile(src, dst, mode)
+}
+
+// Rename calls os.Rename.
+func (Local) Rename(ctx context.Context, oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
 // OpenFile calls os.OpenFile with read-write.
 func (Local) OpenFile(ctx context.Context, path string) (File, error) {
 	return os.OpenFile(path, os.O_RDWR, 0666)
@@ -108,5 +172,108 @@ func (Local) Run(ctx context.Context, cmd *Cmd) (output []byte, err error) {
 		Dir:   cmd.Dir,
 		Stdin: cmd.Stdin,
 	}
-	return ec.CombinedOutput()
+	out := &OutputBuffer{Max: cmd.MaxOutput}
+	ec.Stdout = out
+	ec.Stderr = out
+	if err := ec.Start(); err != nil {
+		return nil, err
+	}
+	if err := setSched(ec.Process.Pid, cmd.Sched); err != nil {
+		ec.Process.Kill()
+		ec.Wait()
+		return out.Bytes(), fmt.Errorf("%s: %v", cmd.Path, err)
+	}
+	err = ec.Wait()
+	return out.Bytes(), err
+}
+
+// Start starts a process using os/exec.
+func (Local) Start(ctx context.Context, cmd *Cmd) (Process, error) {
+	ec := &exec.Cmd{
+		Path:  cmd.Path,
+		Args:  cmd.Args,
+		Env:   cmd.Env,
+		Dir:   cmd.Dir,
+		Stdin: cmd.Stdin,
+	}
+	p := &localProcess{
+		cmd:  ec,
+		out:  OutputBuffer{Max: cmd.MaxOutput},
+		done: make(chan struct{}),
+	}
+	ec.Stdout = p
+	ec.Stderr = p
+	if err := ec.Start(); err != nil {
+		return nil, err
+	}
+	if err := setSched(ec.Process.Pid, cmd.Sched); err != nil {
+		ec.Process.Kill()
+		ec.Wait()
+		return nil, fmt.Errorf("%s: %v", cmd.Path, err)
+	}
+	go func() {
+		p.err = ec.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+type localProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+
+	mu  sync.Mutex
+	out OutputBuffer
+}
+
+func (p *localProcess) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.out.Write(b)
+}
+
+func (p *localProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *localProcess) Kill() error {
+	select {
+	case <-p.done:
+		return nil
+	default:
+		return p.cmd.Process.Kill()
+	}
+}
+
+func (p *localProcess) Output() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]byte(nil), p.out.Bytes()...)
+}
+
+// DialContext calls net.Dialer.DialContext.
+func (Local) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return new(net.Dialer).DialContext(ctx, network, address)
+}
+
+// LookPath searches for file in pathList, defaulting to the PATH
+// environment variable of the current process.
+func (Local) LookPath(ctx context.Context, file string, pathList string) (string, error) {
+	if pathList == "" {
+		pathList = os.Getenv("PATH")
+	}
+	for _, dir := range filepath.SplitList(pathList) {
+		// Relative directories are skipped, since they depend on the
+		// working directory of the applier.
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		path := filepath.Join(dir, file)
+		if info, err := os.Stat(path); err == nil && isExecutable(info) {
+			return path, nil
+		}
+	}
+	return "", &os.PathError{Op: "lookpath", Path: file, Err: os.ErrNotExist}
 }
@@ -0,0 +1,108 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"fmt"
+)
+
+// An OutputBuffer collects process output up to a limit.  Once more than
+// Max bytes have been written, only the first and last Max/2 bytes are
+// kept, so that both the command's startup and its final messages are
+// retained.  The zero value is an empty, unlimited buffer.
+type OutputBuffer struct {
+	// Max is the maximum number of bytes of output to keep.  If Max is
+	// non-positive, then all output is kept.
+	Max int
+
+	head    []byte
+	tail    []byte
+	written int64
+}
+
+// Write appends p to the buffer, discarding the middle of the output if
+// it exceeds b.Max.  It never returns an error.
+func (b *OutputBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.written += int64(n)
+	if b.Max <= 0 {
+		b.head = append(b.head, p...)
+		return n, nil
+	}
+	if headMax := b.Max - b.tailMax(); len(b.head) < headMax {
+		k := headMax - len(b.head)
+		if k > len(p) {
+			k = len(p)
+		}
+		b.head = append(b.head, p[:k]...)
+		p = p[k:]
+	}
+	tailMax := b.tailMax()
+	if tailMax == 0 || len(p) == 0 {
+		return n, nil
+	}
+	if len(p) >= tailMax {
+		b.tail = append(b.tail[:0], p[len(p)-tailMax:]...)
+		return n, nil
+	}
+	b.tail = append(b.tail, p...)
+	if len(b.tail) > 2*tailMax {
+		// Compact occasionally rather than on every write.
+		b.tail = append(b.tail[:0], b.tail[len(b.tail)-tailMax:]...)
+	}
+	return n, nil
+}
+
+func (b *OutputBuffer) tailMax() int {
+	return b.Max / 2
+}
+
+// Bytes returns the retained output.  If any output was discarded, then
+// a line noting the number of bytes omitted separates the beginning and
+// end of the output.
+func (b *OutputBuffer) Bytes() []byte {
+	tail := b.tail
+	if b.Max > 0 && len(tail) > b.tailMax() {
+		tail = tail[len(tail)-b.tailMax():]
+	}
+	omitted := b.written - int64(len(b.head)) - int64(len(tail))
+	if omitted == 0 {
+		if len(tail) == 0 {
+			return b.head
+		}
+		return append(b.head[:len(b.head):len(b.head)], tail...)
+	}
+	out := make([]byte, 0, len(b.head)+len(tail)+40)
+	out = append(out, b.head...)
+	out = append(out, fmt.Sprintf("\n[... %d bytes omitted ...]\n", omitted)...)
+	out = append(out, tail...)
+	return out
+}
+
+// Truncated reports whether any output was discarded.
+func (b *OutputBuffer) Truncated() bool {
+	return b.Max > 0 && b.written > int64(b.Max)
+}
+
+// LimitOutput returns out truncated in the same manner as an
+// OutputBuffer with the given maximum.
+func LimitOutput(out []byte, max int) []byte {
+	if max <= 0 || len(out) <= max {
+		return out
+	}
+	b := &OutputBuffer{Max: max}
+	b.Write(out)
+	return b.Bytes()
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputBuffer(t *testing.T) {
+	tests := []struct {
+		max    int
+		writes []string
+		want   string
+	}{
+		{0, []string{"hello", " world"}, "hello world"},
+		{-1, []string{"hello", " world"}, "hello world"},
+		{11, []string{"hello", " world"}, "hello world"},
+		{4, []string{"abcdef"}, "ab\n[... 2 bytes omitted ...]\nef"},
+		{4, []string{"a", "b", "c", "d", "e", "f"}, "ab\n[... 2 bytes omitted ...]\nef"},
+		{5, []string{"abcdefgh"}, "abc\n[... 3 bytes omitted ...]\ngh"},
+		{1, []string{"abc"}, "a\n[... 2 bytes omitted ...]\n"},
+		{6, []string{"abcd", strings.Repeat("x", 100), "wxyz"}, "abc\n[... 102 bytes omitted ...]\nxyz"},
+	}
+	for _, test := range tests {
+		b := &OutputBuffer{Max: test.max}
+		for _, w := range test.writes {
+			if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+				t.Errorf("OutputBuffer{Max: %d}.Write(%q) = %d, %v; want %d, <nil>", test.max, w, n, err, len(w))
+			}
+		}
+		if got := string(b.Bytes()); got != test.want {
+			t.Errorf("OutputBuffer{Max: %d} after writing %q: Bytes() = %q; want %q", test.max, test.writes, got, test.want)
+		}
+		if got := string(LimitOutput([]byte(strings.Join(test.writes, "")), test.max)); got != test.want {
+			t.Errorf("LimitOutput(%q, %d) = %q; want %q", strings.Join(test.writes, ""), test.max, got, test.want)
+		}
+	}
+}
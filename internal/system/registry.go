@@ -0,0 +1,170 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// A Registry is a System with a Windows-style registry.  Keys are named
+// by their full path, as split by SplitRegistryKey.  Errors for missing
+// keys and values satisfy os.IsNotExist.  A Registry must be safe to
+// call from multiple goroutines.
+type Registry interface {
+	// RegistryKeyExists reports whether the key exists.
+	RegistryKeyExists(ctx context.Context, key string) (bool, error)
+
+	// CreateRegistryKey creates the key and any missing parents.  It is
+	// not an error if the key already exists.
+	CreateRegistryKey(ctx context.Context, key string) error
+
+	// DeleteRegistryKey deletes the key and all of its subkeys and
+	// values.
+	DeleteRegistryKey(ctx context.Context, key string) error
+
+	// RegistryValue returns a value of the key.  The empty name is the
+	// key's default value.
+	RegistryValue(ctx context.Context, key, name string) (RegistryValue, error)
+
+	// SetRegistryValue sets a value of an existing key.
+	SetRegistryValue(ctx context.Context, key, name string, val RegistryValue) error
+
+	// DeleteRegistryValue deletes a value of the key.
+	DeleteRegistryValue(ctx context.Context, key, name string) error
+}
+
+// Registry value types.
+const (
+	RegSZ       uint32 = 1
+	RegExpandSZ uint32 = 2
+	RegBinary   uint32 = 3
+	RegDWORD    uint32 = 4
+	RegMultiSZ  uint32 = 7
+	RegQWORD    uint32 = 11
+)
+
+// A RegistryValue is the type and raw data of a registry value.
+// Strings are stored as NUL-terminated UTF-16 and numbers are stored
+// little-endian, as on Windows.
+type RegistryValue struct {
+	Type uint32
+	Data []byte
+}
+
+// StringValue returns a REG_SZ or REG_EXPAND_SZ value.
+func StringValue(typ uint32, s string) RegistryValue {
+	return RegistryValue{Type: typ, Data: encodeUTF16(s + "\x00")}
+}
+
+// MultiStringValue returns a REG_MULTI_SZ value.
+func MultiStringValue(list []string) RegistryValue {
+	buf := new(bytes.Buffer)
+	for _, s := range list {
+		buf.WriteString(s)
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(0)
+	return RegistryValue{Type: RegMultiSZ, Data: encodeUTF16(buf.String())}
+}
+
+// DWORDValue returns a REG_DWORD value.
+func DWORDValue(n uint32) RegistryValue {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, n)
+	return RegistryValue{Type: RegDWORD, Data: data}
+}
+
+// QWORDValue returns a REG_QWORD value.
+func QWORDValue(n uint64) RegistryValue {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, n)
+	return RegistryValue{Type: RegQWORD, Data: data}
+}
+
+// Equal reports whether two values have the same type and data.
+// Strings are compared without their terminators, since programs don't
+// always store them.
+func (v RegistryValue) Equal(w RegistryValue) bool {
+	if v.Type != w.Type {
+		return false
+	}
+	switch v.Type {
+	case RegSZ, RegExpandSZ, RegMultiSZ:
+		return bytes.Equal(trimUTF16NULs(v.Data), trimUTF16NULs(w.Data))
+	default:
+		return bytes.Equal(v.Data, w.Data)
+	}
+}
+
+func encodeUTF16(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	data := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(data[2*i:], c)
+	}
+	return data
+}
+
+func trimUTF16NULs(data []byte) []byte {
+	for len(data) >= 2 && data[len(data)-2] == 0 && data[len(data)-1] == 0 {
+		data = data[:len(data)-2]
+	}
+	return data
+}
+
+// registryRoots maps the abbreviations of the root keys to their full
+// names.
+var registryRoots = map[string]string{
+	"HKCR": "HKEY_CLASSES_ROOT",
+	"HKCU": "HKEY_CURRENT_USER",
+	"HKLM": "HKEY_LOCAL_MACHINE",
+	"HKU":  "HKEY_USERS",
+	"HKCC": "HKEY_CURRENT_CONFIG",
+}
+
+// SplitRegistryKey splits a key path like
+// `HKLM\SOFTWARE\Example` into its full root key name
+// ("HKEY_LOCAL_MACHINE") and the path of the key below the root
+// (`SOFTWARE\Example`).  Root names are case-insensitive and may be
+// abbreviated.  Repeated and trailing backslashes are removed.
+func SplitRegistryKey(key string) (root, subkey string, err error) {
+	parts := strings.Split(key, `\`)
+	root = strings.ToUpper(parts[0])
+	if full := registryRoots[root]; full != "" {
+		root = full
+	}
+	found := false
+	for _, full := range registryRoots {
+		if root == full {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", "", fmt.Errorf("registry key %q does not start with a root key like HKEY_LOCAL_MACHINE", key)
+	}
+	var sub []string
+	for _, p := range parts[1:] {
+		if p != "" {
+			sub = append(sub, p)
+		}
+	}
+	return root, strings.Join(sub, `\`), nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitRegistryKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		root   string
+		subkey string
+		fail   bool
+	}{
+		{key: `HKEY_LOCAL_MACHINE\SOFTWARE\Example`, root: "HKEY_LOCAL_MACHINE", subkey: `SOFTWARE\Example`},
+		{key: `HKLM\SOFTWARE\Example`, root: "HKEY_LOCAL_MACHINE", subkey: `SOFTWARE\Example`},
+		{key: `hkcu\Software\\Example\`, root: "HKEY_CURRENT_USER", subkey: `Software\Example`},
+		{key: `HKU`, root: "HKEY_USERS", subkey: ""},
+		{key: `SOFTWARE\Example`, fail: true},
+		{key: ``, fail: true},
+	}
+	for _, test := range tests {
+		root, subkey, err := SplitRegistryKey(test.key)
+		if test.fail {
+			if err == nil {
+				t.Errorf("SplitRegistryKey(%q) = %q, %q, <nil>; want error", test.key, root, subkey)
+			}
+			continue
+		}
+		if err != nil || root != test.root || subkey != test.subkey {
+			t.Errorf("SplitRegistryKey(%q) = %q, %q, %v; want %q, %q, <nil>", test.key, root, subkey, err, test.root, test.subkey)
+		}
+	}
+}
+
+func TestRegistryValueEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		val  RegistryValue
+		want RegistryValue
+	}{
+		{"StringValue", StringValue(RegSZ, "hi"), RegistryValue{RegSZ, []byte{'h', 0, 'i', 0, 0, 0}}},
+		{"MultiStringValue", MultiStringValue([]string{"a", "b"}), RegistryValue{RegMultiSZ, []byte{'a', 0, 0, 0, 'b', 0, 0, 0, 0, 0}}},
+		{"DWORDValue", DWORDValue(0x01020304), RegistryValue{RegDWORD, []byte{4, 3, 2, 1}}},
+		{"QWORDValue", QWORDValue(1), RegistryValue{RegQWORD, []byte{1, 0, 0, 0, 0, 0, 0, 0}}},
+	}
+	for _, test := range tests {
+		if test.val.Type != test.want.Type || !bytes.Equal(test.val.Data, test.want.Data) {
+			t.Errorf("%s = %+v; want %+v", test.name, test.val, test.want)
+		}
+	}
+}
+
+func TestRegistryValueEqual(t *testing.T) {
+	tests := []struct {
+		v, w RegistryValue
+		want bool
+	}{
+		{StringValue(RegSZ, "hi"), StringValue(RegSZ, "hi"), true},
+		{StringValue(RegSZ, "hi"), RegistryValue{RegSZ, []byte{'h', 0, 'i', 0}}, true},
+		{StringValue(RegSZ, "hi"), StringValue(RegExpandSZ, "hi"), false},
+		{StringValue(RegSZ, "hi"), StringValue(RegSZ, "ho"), false},
+		{DWORDValue(1), DWORDValue(1), true},
+		{DWORDValue(1), QWORDValue(1), false},
+		{RegistryValue{RegBinary, []byte{1, 0, 0}}, RegistryValue{RegBinary, []byte{1}}, false},
+	}
+	for _, test := range tests {
+		if got := test.v.Equal(test.w); got != test.want {
+			t.Errorf("%+v.Equal(%+v) = %t; want %t", test.v, test.w, got, test.want)
+		}
+	}
+}
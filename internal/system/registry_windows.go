@@ -0,0 +1,204 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procRegCreateKeyExW = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW  = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteValueW = advapi32.NewProc("RegDeleteValueW")
+	procRegDeleteTreeW  = advapi32.NewProc("RegDeleteTreeW")
+	procRegDeleteKeyW   = advapi32.NewProc("RegDeleteKeyW")
+)
+
+var (
+	_ Registry       = Local{}
+	_ ServiceManager = Local{}
+)
+
+var registryRootHandles = map[string]syscall.Handle{
+	"HKEY_CLASSES_ROOT":   syscall.HKEY_CLASSES_ROOT,
+	"HKEY_CURRENT_USER":   syscall.HKEY_CURRENT_USER,
+	"HKEY_LOCAL_MACHINE":  syscall.HKEY_LOCAL_MACHINE,
+	"HKEY_USERS":          syscall.HKEY_USERS,
+	"HKEY_CURRENT_CONFIG": syscall.HKEY_CURRENT_CONFIG,
+}
+
+// openRegistryKey opens a key with the given access rights.  The caller
+// must close the returned handle with syscall.RegCloseKey.
+func openRegistryKey(op, key string, access uint32) (syscall.Handle, error) {
+	root, sub, err := SplitRegistryKey(key)
+	if err != nil {
+		return 0, err
+	}
+	sub16, err := syscall.UTF16PtrFromString(sub)
+	if err != nil {
+		return 0, &os.PathError{Op: op, Path: key, Err: err}
+	}
+	var h syscall.Handle
+	if err := syscall.RegOpenKeyEx(registryRootHandles[root], sub16, 0, access, &h); err != nil {
+		return 0, &os.PathError{Op: op, Path: key, Err: err}
+	}
+	return h, nil
+}
+
+// RegistryKeyExists opens the key to check whether it exists.
+func (Local) RegistryKeyExists(ctx context.Context, key string) (bool, error) {
+	h, err := openRegistryKey("open registry key", key, syscall.KEY_READ)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	syscall.RegCloseKey(h)
+	return true, nil
+}
+
+// CreateRegistryKey calls RegCreateKeyEx.
+func (Local) CreateRegistryKey(ctx context.Context, key string) error {
+	root, sub, err := SplitRegistryKey(key)
+	if err != nil {
+		return err
+	}
+	sub16, err := syscall.UTF16PtrFromString(sub)
+	if err != nil {
+		return &os.PathError{Op: "create registry key", Path: key, Err: err}
+	}
+	var h syscall.Handle
+	r, _, _ := procRegCreateKeyExW.Call(
+		uintptr(registryRootHandles[root]),
+		uintptr(unsafe.Pointer(sub16)),
+		0, 0, 0,
+		uintptr(syscall.KEY_READ),
+		0,
+		uintptr(unsafe.Pointer(&h)),
+		0)
+	if r != 0 {
+		return &os.PathError{Op: "create registry key", Path: key, Err: syscall.Errno(r)}
+	}
+	syscall.RegCloseKey(h)
+	return nil
+}
+
+// DeleteRegistryKey calls RegDeleteTree to delete the key's contents
+// and then RegDeleteKey to delete the key.
+func (Local) DeleteRegistryKey(ctx context.Context, key string) error {
+	root, sub, err := SplitRegistryKey(key)
+	if err != nil {
+		return err
+	}
+	if sub == "" {
+		return &os.PathError{Op: "delete registry key", Path: key, Err: syscall.ERROR_ACCESS_DENIED}
+	}
+	sub16, err := syscall.UTF16PtrFromString(sub)
+	if err != nil {
+		return &os.PathError{Op: "delete registry key", Path: key, Err: err}
+	}
+	rootHandle := uintptr(registryRootHandles[root])
+	if r, _, _ := procRegDeleteTreeW.Call(rootHandle, uintptr(unsafe.Pointer(sub16))); r != 0 {
+		return &os.PathError{Op: "delete registry key", Path: key, Err: syscall.Errno(r)}
+	}
+	// Older versions of Windows leave the key itself in place.
+	r, _, _ := procRegDeleteKeyW.Call(rootHandle, uintptr(unsafe.Pointer(sub16)))
+	if r != 0 && syscall.Errno(r) != syscall.ERROR_FILE_NOT_FOUND {
+		return &os.PathError{Op: "delete registry key", Path: key, Err: syscall.Errno(r)}
+	}
+	return nil
+}
+
+// RegistryValue calls RegQueryValueEx.
+func (Local) RegistryValue(ctx context.Context, key, name string) (RegistryValue, error) {
+	h, err := openRegistryKey("read registry value", key, syscall.KEY_QUERY_VALUE)
+	if err != nil {
+		return RegistryValue{}, err
+	}
+	defer syscall.RegCloseKey(h)
+	name16, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return RegistryValue{}, &os.PathError{Op: "read registry value", Path: key + `\` + name, Err: err}
+	}
+	buf := make([]byte, 256)
+	for {
+		var typ uint32
+		n := uint32(len(buf))
+		var p *byte
+		if len(buf) > 0 {
+			p = &buf[0]
+		}
+		err := syscall.RegQueryValueEx(h, name16, nil, &typ, p, &n)
+		if err == syscall.ERROR_MORE_DATA {
+			buf = make([]byte, n)
+			continue
+		}
+		if err != nil {
+			return RegistryValue{}, &os.PathError{Op: "read registry value", Path: key + `\` + name, Err: err}
+		}
+		return RegistryValue{Type: typ, Data: buf[:n]}, nil
+	}
+}
+
+// SetRegistryValue calls RegSetValueEx.
+func (Local) SetRegistryValue(ctx context.Context, key, name string, val RegistryValue) error {
+	h, err := openRegistryKey("set registry value", key, syscall.KEY_SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer syscall.RegCloseKey(h)
+	name16, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return &os.PathError{Op: "set registry value", Path: key + `\` + name, Err: err}
+	}
+	var p *byte
+	if len(val.Data) > 0 {
+		p = &val.Data[0]
+	}
+	r, _, _ := procRegSetValueExW.Call(
+		uintptr(h),
+		uintptr(unsafe.Pointer(name16)),
+		0,
+		uintptr(val.Type),
+		uintptr(unsafe.Pointer(p)),
+		uintptr(len(val.Data)))
+	if r != 0 {
+		return &os.PathError{Op: "set registry value", Path: key + `\` + name, Err: syscall.Errno(r)}
+	}
+	return nil
+}
+
+// DeleteRegistryValue calls RegDeleteValue.
+func (Local) DeleteRegistryValue(ctx context.Context, key, name string) error {
+	h, err := openRegistryKey("delete registry value", key, syscall.KEY_SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer syscall.RegCloseKey(h)
+	name16, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return &os.PathError{Op: "delete registry value", Path: key + `\` + name, Err: err}
+	}
+	if r, _, _ := procRegDeleteValueW.Call(uintptr(h), uintptr(unsafe.Pointer(name16))); r != 0 {
+		return &os.PathError{Op: "delete registry value", Path: key + `\` + name, Err: syscall.Errno(r)}
+	}
+	return nil
+}
@@ -0,0 +1,489 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// MaxContent is the largest file whose content a Recorder saves.
+const MaxContent = 16 << 20
+
+// A Recorder is a system.System that records every call made through
+// it, along with the results.  The optional system interfaces are
+// forwarded to the underlying system, returning an error if it does not
+// implement them.  Create a Recorder with NewRecorder.
+type Recorder struct {
+	sys system.System
+
+	mu    sync.Mutex
+	calls []*Call
+}
+
+// NewRecorder returns a Recorder that makes its calls to sys.
+func NewRecorder(sys system.System) *Recorder {
+	return &Recorder{sys: sys}
+}
+
+// Calls returns the calls recorded so far, in the order they finished.
+func (r *Recorder) Calls() []*Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Call(nil), r.calls...)
+}
+
+func (r *Recorder) record(c *Call, err error) {
+	c.Err = recordError(err)
+	r.mu.Lock()
+	r.calls = append(r.calls, c)
+	r.mu.Unlock()
+}
+
+// stat records the owner and identity of info along with its metadata.
+func (r *Recorder) stat(info os.FileInfo) *Stat {
+	st := &Stat{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+	var err error
+	st.UID, st.GID, err = r.sys.OwnerInfo(info)
+	st.OwnerErr = recordError(err)
+	if fi, ok := r.sys.(system.FileIdentifier); ok {
+		if dev, ino, err := fi.FileIdentity(info); err == nil {
+			st.Dev, st.Ino, st.Identified = dev, ino, true
+		}
+	}
+	return st
+}
+
+func (r *Recorder) Lstat(ctx context.Context, path string) (os.FileInfo, error) {
+	info, err := r.sys.Lstat(ctx, path)
+	c := &Call{Op: "lstat", Path: path}
+	if err == nil {
+		c.Stat = r.stat(info)
+	}
+	r.record(c, err)
+	return info, err
+}
+
+func (r *Recorder) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	err := r.sys.Mkdir(ctx, path, mode)
+	r.record(&Call{Op: "mkdir", Path: path, Args: []string{formatMode(mode)}}, err)
+	return err
+}
+
+func (r *Recorder) Remove(ctx context.Context, path string) error {
+	err := r.sys.Remove(ctx, path)
+	r.record(&Call{Op: "remove", Path: path}, err)
+	return err
+}
+
+func (r *Recorder) Symlink(ctx context.Context, oldname, newname string) error {
+	err := r.sys.Symlink(ctx, oldname, newname)
+	r.record(&Call{Op: "symlink", Path: newname, Args: []string{oldname}}, err)
+	return err
+}
+
+func (r *Recorder) Readlink(ctx context.Context, path string) (string, error) {
+	target, err := r.sys.Readlink(ctx, path)
+	r.record(&Call{Op: "readlink", Path: path, Result: target}, err)
+	return target, err
+}
+
+func (r *Recorder) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	err := r.sys.Chmod(ctx, path, mode)
+	r.record(&Call{Op: "chmod", Path: path, Args: []string{formatMode(mode)}}, err)
+	return err
+}
+
+func (r *Recorder) Chown(ctx context.Context, path string, uid system.UID, gid system.GID) error {
+	err := r.sys.Chown(ctx, path, uid, gid)
+	r.record(&Call{Op: "chown", Path: path, Args: []string{fmt.Sprintf("%d:%d", uid, gid)}}, err)
+	return err
+}
+
+// OwnerInfo is not recorded as a call: the owner of every file info
+// is recorded when the file info is returned.
+func (r *Recorder) OwnerInfo(info os.FileInfo) (system.UID, system.GID, error) {
+	return r.sys.OwnerInfo(info)
+}
+
+func (r *Recorder) CreateFile(ctx context.Context, path string, mode os.FileMode) (system.FileWriter, error) {
+	w, err := r.sys.CreateFile(ctx, path, mode)
+	r.record(&Call{Op: "create", Path: path, Args: []string{formatMode(mode)}}, err)
+	return w, err
+}
+
+func (r *Recorder) OpenFile(ctx context.Context, path string) (system.File, error) {
+	f, err := r.sys.OpenFile(ctx, path)
+	c := &Call{Op: "open", Path: path}
+	if err != nil {
+		r.record(c, err)
+		return nil, err
+	}
+	// Read the content before the caller changes it, then rewind.
+	buf := new(bytes.Buffer)
+	n, err := io.Copy(buf, io.LimitReader(f, MaxContent+1))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		r.record(c, err)
+		return nil, err
+	}
+	if n > MaxContent {
+		c.Truncated = true
+	} else {
+		c.Content = buf.Bytes()
+	}
+	r.record(c, nil)
+	return f, nil
+}
+
+func (r *Recorder) LookupUser(name string) (system.UID, error) {
+	uid, err := r.sys.LookupUser(name)
+	r.record(&Call{Op: "lookup_user", Path: name, Int: int64(uid)}, err)
+	return uid, err
+}
+
+func (r *Recorder) LookupGroup(name string) (system.GID, error) {
+	gid, err := r.sys.LookupGroup(name)
+	r.record(&Call{Op: "lookup_group", Path: name, Int: int64(gid)}, err)
+	return gid, err
+}
+
+func (r *Recorder) Run(ctx context.Context, cmd *system.Cmd) ([]byte, error) {
+	out, err := r.sys.Run(ctx, cmd)
+	r.record(&Call{Op: "run", Path: cmd.Path, Args: cmd.Args, Output: out}, err)
+	return out, err
+}
+
+func (r *Recorder) LookPath(ctx context.Context, file string, pathList string) (string, error) {
+	path, err := r.sys.LookPath(ctx, file, pathList)
+	r.record(&Call{Op: "look_path", Path: file, Args: []string{pathList}, Result: path}, err)
+	return path, err
+}
+
+func (r *Recorder) Start(ctx context.Context, cmd *system.Cmd) (system.Process, error) {
+	st, ok := r.sys.(system.Starter)
+	if !ok {
+		return nil, errors.New("system cannot start background processes")
+	}
+	p, err := st.Start(ctx, cmd)
+	r.record(&Call{Op: "start", Path: cmd.Path, Args: cmd.Args}, err)
+	if err != nil {
+		return nil, err
+	}
+	return &recordedProcess{Process: p, r: r, path: cmd.Path, args: cmd.Args}, nil
+}
+
+// recordedProcess records a "wait" call the first time the process is
+// waited for.
+type recordedProcess struct {
+	system.Process
+	r    *Recorder
+	path string
+	args []string
+	once sync.Once
+}
+
+func (p *recordedProcess) Wait() error {
+	err := p.Process.Wait()
+	p.once.Do(func() {
+		p.r.record(&Call{Op: "wait", Path: p.path, Args: p.args, Output: p.Process.Output()}, err)
+	})
+	return err
+}
+
+func (r *Recorder) Umask(mask os.FileMode) os.FileMode {
+	u, ok := r.sys.(system.Umasker)
+	if !ok {
+		return 0
+	}
+	old := u.Umask(mask)
+	r.record(&Call{Op: "umask", Args: []string{formatMode(mask)}, Int: int64(old)}, nil)
+	return old
+}
+
+func (r *Recorder) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, ok := r.sys.(system.Dialer)
+	if !ok {
+		return nil, errors.New("system cannot dial addresses")
+	}
+	conn, err := d.DialContext(ctx, network, address)
+	r.record(&Call{Op: "dial", Path: address, Args: []string{network}}, err)
+	return conn, err
+}
+
+// Lock records taking the lock, but not releasing it.
+func (r *Recorder) Lock(ctx context.Context, path string, mode os.FileMode) (system.FileLock, error) {
+	l, ok := r.sys.(system.Locker)
+	if !ok {
+		return nil, errors.New("system cannot lock files")
+	}
+	fl, err := l.Lock(ctx, path, mode)
+	r.record(&Call{Op: "lock", Path: path, Args: []string{formatMode(mode)}}, err)
+	return fl, err
+}
+
+func (r *Recorder) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	c, ok := r.sys.(system.Cloner)
+	if !ok {
+		return errors.New("system cannot clone files")
+	}
+	err := c.CloneFile(ctx, src, dst, mode)
+	r.record(&Call{Op: "clone_file", Path: dst, Args: []string{src, formatMode(mode)}}, err)
+	return err
+}
+
+func (r *Recorder) Rename(ctx context.Context, oldpath, newpath string) error {
+	rn, ok := r.sys.(system.Renamer)
+	if !ok {
+		return errors.New("system cannot rename files")
+	}
+	err := rn.Rename(ctx, oldpath, newpath)
+	r.record(&Call{Op: "rename", Path: newpath, Args: []string{oldpath}}, err)
+	return err
+}
+
+func (r *Recorder) inspector() (system.HostInspector, error) {
+	hi, ok := r.sys.(system.HostInspector)
+	if !ok {
+		return nil, errors.New("system cannot inspect the host")
+	}
+	return hi, nil
+}
+
+func (r *Recorder) DiskFree(ctx context.Context, path string) (int64, error) {
+	hi, err := r.inspector()
+	if err != nil {
+		return 0, err
+	}
+	n, err := hi.DiskFree(ctx, path)
+	r.record(&Call{Op: "disk_free", Path: path, Int: n}, err)
+	return n, err
+}
+
+func (r *Recorder) KernelVersion(ctx context.Context) (string, error) {
+	hi, err := r.inspector()
+	if err != nil {
+		return "", err
+	}
+	v, err := hi.KernelVersion(ctx)
+	r.record(&Call{Op: "kernel_version", Result: v}, err)
+	return v, err
+}
+
+func (r *Recorder) Privileged(ctx context.Context) (bool, error) {
+	hi, err := r.inspector()
+	if err != nil {
+		return false, err
+	}
+	priv, err := hi.Privileged(ctx)
+	r.record(&Call{Op: "privileged", Bool: priv}, err)
+	return priv, err
+}
+
+// FileIdentity is not recorded as a call: the identity of every file
+// info is recorded when the file info is returned.
+func (r *Recorder) FileIdentity(info os.FileInfo) (dev, ino uint64, err error) {
+	fi, ok := r.sys.(system.FileIdentifier)
+	if !ok {
+		return 0, 0, errors.New("system cannot identify files")
+	}
+	return fi.FileIdentity(info)
+}
+
+func (r *Recorder) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	dr, ok := r.sys.(system.DirReader)
+	if !ok {
+		return nil, errors.New("system cannot list directories")
+	}
+	infos, err := dr.ReadDir(ctx, path)
+	c := &Call{Op: "read_dir", Path: path}
+	for _, info := range infos {
+		c.Stats = append(c.Stats, r.stat(info))
+	}
+	r.record(c, err)
+	return infos, err
+}
+
+func (r *Recorder) registry() (system.Registry, error) {
+	reg, ok := r.sys.(system.Registry)
+	if !ok {
+		return nil, errors.New("system has no registry")
+	}
+	return reg, nil
+}
+
+func (r *Recorder) RegistryKeyExists(ctx context.Context, key string) (bool, error) {
+	reg, err := r.registry()
+	if err != nil {
+		return false, err
+	}
+	exists, err := reg.RegistryKeyExists(ctx, key)
+	r.record(&Call{Op: "registry_key_exists", Path: key, Bool: exists}, err)
+	return exists, err
+}
+
+func (r *Recorder) CreateRegistryKey(ctx context.Context, key string) error {
+	reg, err := r.registry()
+	if err != nil {
+		return err
+	}
+	err = reg.CreateRegistryKey(ctx, key)
+	r.record(&Call{Op: "create_registry_key", Path: key}, err)
+	return err
+}
+
+func (r *Recorder) DeleteRegistryKey(ctx context.Context, key string) error {
+	reg, err := r.registry()
+	if err != nil {
+		return err
+	}
+	err = reg.DeleteRegistryKey(ctx, key)
+	r.record(&Call{Op: "delete_registry_key", Path: key}, err)
+	return err
+}
+
+func (r *Recorder) RegistryValue(ctx context.Context, key, name string) (system.RegistryValue, error) {
+	reg, err := r.registry()
+	if err != nil {
+		return system.RegistryValue{}, err
+	}
+	val, err := reg.RegistryValue(ctx, key, name)
+	c := &Call{Op: "registry_value", Path: key, Args: []string{name}}
+	if err == nil {
+		c.Value = &val
+	}
+	r.record(c, err)
+	return val, err
+}
+
+func (r *Recorder) SetRegistryValue(ctx context.Context, key, name string, val system.RegistryValue) error {
+	reg, err := r.registry()
+	if err != nil {
+		return err
+	}
+	err = reg.SetRegistryValue(ctx, key, name, val)
+	r.record(&Call{Op: "set_registry_value", Path: key, Args: []string{name}}, err)
+	return err
+}
+
+func (r *Recorder) DeleteRegistryValue(ctx context.Context, key, name string) error {
+	reg, err := r.registry()
+	if err != nil {
+		return err
+	}
+	err = reg.DeleteRegistryValue(ctx, key, name)
+	r.record(&Call{Op: "delete_registry_value", Path: key, Args: []string{name}}, err)
+	return err
+}
+
+func (r *Recorder) services() (system.ServiceManager, error) {
+	sm, ok := r.sys.(system.ServiceManager)
+	if !ok {
+		return nil, errors.New("system cannot manage services")
+	}
+	return sm, nil
+}
+
+func (r *Recorder) QueryService(ctx context.Context, name string) (*system.ServiceStatus, error) {
+	sm, err := r.services()
+	if err != nil {
+		return nil, err
+	}
+	status, err := sm.QueryService(ctx, name)
+	r.record(&Call{Op: "query_service", Path: name, Service: status}, err)
+	return status, err
+}
+
+func (r *Recorder) CreateService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sm, err := r.services()
+	if err != nil {
+		return err
+	}
+	err = sm.CreateService(ctx, name, config)
+	r.record(&Call{Op: "create_service", Path: name}, err)
+	return err
+}
+
+func (r *Recorder) ConfigureService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sm, err := r.services()
+	if err != nil {
+		return err
+	}
+	err = sm.ConfigureService(ctx, name, config)
+	r.record(&Call{Op: "configure_service", Path: name}, err)
+	return err
+}
+
+func (r *Recorder) StartService(ctx context.Context, name string) error {
+	sm, err := r.services()
+	if err != nil {
+		return err
+	}
+	err = sm.StartService(ctx, name)
+	r.record(&Call{Op: "start_service", Path: name}, err)
+	return err
+}
+
+func (r *Recorder) StopService(ctx context.Context, name string) error {
+	sm, err := r.services()
+	if err != nil {
+		return err
+	}
+	err = sm.StopService(ctx, name)
+	r.record(&Call{Op: "stop_service", Path: name}, err)
+	return err
+}
+
+// Now returns the underlying system's time if it is a system.Clock,
+// or the wall clock time otherwise.  It is not recorded.
+func (r *Recorder) Now() time.Time {
+	if c, ok := r.sys.(system.Clock); ok {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+var (
+	_ system.System         = new(Recorder)
+	_ system.Starter        = new(Recorder)
+	_ system.Umasker        = new(Recorder)
+	_ system.Dialer         = new(Recorder)
+	_ system.HostInspector  = new(Recorder)
+	_ system.Locker         = new(Recorder)
+	_ system.Cloner         = new(Recorder)
+	_ system.Renamer        = new(Recorder)
+	_ system.FileIdentifier = new(Recorder)
+	_ system.DirReader      = new(Recorder)
+	_ system.Clock          = new(Recorder)
+	_ system.Registry       = new(Recorder)
+	_ system.ServiceManager = new(Recorder)
+)
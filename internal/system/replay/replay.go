@@ -0,0 +1,245 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replay records the calls that a run makes to a system, so
+// that the run can be repeated against the recording on another host.
+//
+// A Recorder wraps the system of the failing run, and its calls are
+// saved in a Bundle along with the catalogs.  A System answers each
+// call from the bundle, so the applier takes the same path that it did
+// on the original host without touching the host it replays on.
+package replay
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// bundleVersion is the version of the bundle format written by
+// Bundle.Write.
+const bundleVersion = 1
+
+// A Bundle is a recorded run.
+type Bundle struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+
+	// Args is the command line of the recorded run, for reference.
+	Args []string `json:"args,omitempty"`
+
+	// Vars are the variables that exec commands were expanded with.
+	Vars map[string]string `json:"vars,omitempty"`
+
+	// Catalogs holds the serialized catalogs that were applied.
+	Catalogs [][]byte `json:"catalogs"`
+
+	Calls []*Call `json:"calls"`
+}
+
+// Write writes the bundle to w as gzip-compressed JSON.
+func (b *Bundle) Write(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	bb := *b
+	bb.Version = bundleVersion
+	if err := json.NewEncoder(zw).Encode(&bb); err != nil {
+		zw.Close()
+		return fmt.Errorf("write bundle: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("write bundle: %v", err)
+	}
+	return nil
+}
+
+// ReadBundle reads a bundle written by Bundle.Write.
+func ReadBundle(r io.Reader) (*Bundle, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("read bundle: %v", err)
+	}
+	defer zr.Close()
+	b := new(Bundle)
+	if err := json.NewDecoder(zr).Decode(b); err != nil {
+		return nil, fmt.Errorf("read bundle: %v", err)
+	}
+	if b.Version != bundleVersion {
+		return nil, fmt.Errorf("read bundle: unsupported version %d", b.Version)
+	}
+	return b, nil
+}
+
+// A Call is a recorded call and its results.  Op, Path, and Args
+// identify the call and are the same as in systrace.Call.  The other
+// fields hold the results, depending on Op.
+type Call struct {
+	Op   string   `json:"op"`
+	Path string   `json:"path,omitempty"`
+	Args []string `json:"args,omitempty"`
+	Err  *Error   `json:"error,omitempty"`
+
+	// Stat is the result of "lstat", and Stats the result of
+	// "read_dir".
+	Stat  *Stat   `json:"stat,omitempty"`
+	Stats []*Stat `json:"stats,omitempty"`
+
+	// Content is an opened file's content.  Truncated is true if the
+	// file was larger than MaxContent, in which case Content is empty
+	// and the file can't be read during replay.
+	Content   []byte `json:"content,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+
+	// Output is a command's combined output.
+	Output []byte `json:"output,omitempty"`
+
+	// Result is the text result of "readlink", "look_path", and
+	// "kernel_version".
+	Result string `json:"result,omitempty"`
+
+	// Int is the user or group ID of a lookup, the previous mask of
+	// "umask", or the byte count of "disk_free".
+	Int int64 `json:"int,omitempty"`
+
+	// Bool is the result of "registry_key_exists" and "privileged".
+	Bool bool `json:"bool,omitempty"`
+
+	Value   *system.RegistryValue `json:"value,omitempty"`
+	Service *system.ServiceStatus `json:"service,omitempty"`
+}
+
+// key identifies calls that should get the same results.
+func (c *Call) key() string {
+	return c.Op + "\x00" + c.Path + "\x00" + strings.Join(c.Args, "\x00")
+}
+
+// String returns the call's operation and arguments.
+func (c *Call) String() string {
+	s := c.Op
+	if c.Path != "" {
+		s += " " + c.Path
+	}
+	if len(c.Args) > 0 {
+		s += " " + strings.Join(c.Args, " ")
+	}
+	return s
+}
+
+// Error is a recorded error.  Its kind is kept so that the replayed
+// error satisfies the same os.Is* predicates.
+type Error struct {
+	// Kind is "not_exist", "exist", "permission", "exit" (a command
+	// exited unsuccessfully), or empty for any other error.
+	Kind    string `json:"kind,omitempty"`
+	Message string `json:"message"`
+}
+
+func recordError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Message: err.Error()}
+	switch {
+	case os.IsNotExist(err):
+		e.Kind = "not_exist"
+	case os.IsExist(err):
+		e.Kind = "exist"
+	case os.IsPermission(err):
+		e.Kind = "permission"
+	default:
+		if _, ok := err.(*exec.ExitError); ok {
+			e.Kind = "exit"
+		}
+	}
+	return e
+}
+
+// replayedError is an error with a recorded message.
+type replayedError struct {
+	msg string
+}
+
+func (e *replayedError) Error() string { return e.msg }
+
+// err returns an error like the one that was recorded.  path is used
+// for the kinds that the os package reports with an *os.PathError.
+func (e *Error) err(op, path string) error {
+	if e == nil {
+		return nil
+	}
+	switch e.Kind {
+	case "not_exist":
+		return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	case "exist":
+		return &os.PathError{Op: op, Path: path, Err: os.ErrExist}
+	case "permission":
+		return &os.PathError{Op: op, Path: path, Err: os.ErrPermission}
+	case "exit":
+		return new(exec.ExitError)
+	default:
+		return &replayedError{e.Message}
+	}
+}
+
+// Stat is recorded file information, including the owner and identity
+// that the system reported for it.
+type Stat struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+
+	UID      system.UID `json:"uid"`
+	GID      system.GID `json:"gid"`
+	OwnerErr *Error     `json:"owner_error,omitempty"`
+
+	// Dev and Ino are the file's identity.  They are only set when
+	// Identified is true.
+	Dev        uint64 `json:"dev,omitempty"`
+	Ino        uint64 `json:"ino,omitempty"`
+	Identified bool   `json:"identified,omitempty"`
+}
+
+// fileInfo is an os.FileInfo of a recorded Stat.  Its Sys method
+// returns the *Stat.
+type fileInfo struct {
+	st *Stat
+}
+
+func (fi fileInfo) Name() string       { return fi.st.Name }
+func (fi fileInfo) Size() int64        { return fi.st.Size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.st.Mode }
+func (fi fileInfo) ModTime() time.Time { return fi.st.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.st.Mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return fi.st }
+
+// statOf returns the Stat of a file info returned by the System.
+func statOf(info os.FileInfo) (*Stat, error) {
+	st, ok := info.Sys().(*Stat)
+	if !ok {
+		return nil, errors.New("replay: file info was not returned by the replay")
+	}
+	return st, nil
+}
+
+func formatMode(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", uint32(mode&os.ModePerm))
+}
@@ -0,0 +1,120 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zombiezen/mcm/internal/system"
+	"github.com/zombiezen/mcm/internal/system/fakesystem"
+)
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	fake := new(fakesystem.System)
+	progPath := filepath.Join(fakesystem.Root, "prog")
+	err := fake.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int {
+		pc.Output.Write([]byte("oops\n"))
+		return 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(fakesystem.Root, "foo.txt")
+	if err := system.WriteFile(ctx, fake, path, []byte("Hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(fakesystem.Root, "missing")
+
+	rec := NewRecorder(fake)
+	if _, err := rec.Lstat(ctx, missing); !system.IsNotExist(err) {
+		t.Fatalf("Lstat(%q) = _, %v; want not exist", missing, err)
+	}
+	recInfo, err := rec.Lstat(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := system.ReadFile(ctx, rec, path); err != nil {
+		t.Fatal(err)
+	}
+	if err := system.WriteFile(ctx, rec, path, []byte("Goodbye"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec.Run(ctx, &system.Cmd{Path: progPath, Args: []string{progPath}})
+
+	buf := new(bytes.Buffer)
+	if err := (&Bundle{Catalogs: [][]byte{[]byte("catalog")}, Calls: rec.Calls()}).Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ReadBundle(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Catalogs) != 1 || string(b.Catalogs[0]) != "catalog" {
+		t.Errorf("Catalogs = %q; want [\"catalog\"]", b.Catalogs)
+	}
+
+	sys := NewSystem(b.Calls)
+	if _, err := sys.Lstat(ctx, missing); !system.IsNotExist(err) {
+		t.Errorf("replayed Lstat(%q) = _, %v; want not exist", missing, err)
+	}
+	info, err := sys.Lstat(ctx, path)
+	if err != nil {
+		t.Fatal("replayed Lstat:", err)
+	}
+	if info.Size() != recInfo.Size() || info.Mode() != recInfo.Mode() || !info.ModTime().Equal(recInfo.ModTime()) {
+		t.Errorf("replayed Lstat = %d %v %v; want %d %v %v", info.Size(), info.Mode(), info.ModTime(), recInfo.Size(), recInfo.Mode(), recInfo.ModTime())
+	}
+	wantUID, wantGID, _ := fake.OwnerInfo(recInfo)
+	if uid, gid, err := sys.OwnerInfo(info); err != nil || uid != wantUID || gid != wantGID {
+		t.Errorf("replayed OwnerInfo = %d, %d, %v; want %d, %d, <nil>", uid, gid, err, wantUID, wantGID)
+	}
+	// Both opens saw the original content.
+	for i := 0; i < 2; i++ {
+		f, err := sys.OpenFile(ctx, path)
+		if err != nil {
+			t.Fatal("replayed OpenFile:", err)
+		}
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(data) != "Hello" {
+			t.Errorf("replayed open #%d read %q; want \"Hello\"", i+1, data)
+		}
+	}
+	out, err := sys.Run(ctx, &system.Cmd{Path: progPath, Args: []string{progPath}})
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Errorf("replayed Run error = %v; want *exec.ExitError", err)
+	}
+	if string(out) != "oops\n" {
+		t.Errorf("replayed Run output = %q; want \"oops\\n\"", out)
+	}
+	if misses := sys.Misses(); len(misses) != 0 {
+		t.Errorf("Misses() = %q; want none", misses)
+	}
+
+	other := filepath.Join(fakesystem.Root, "other")
+	if err := sys.Mkdir(ctx, other, 0755); err == nil {
+		t.Error("replayed Mkdir of unrecorded path did not return an error")
+	}
+	if misses, want := sys.Misses(), []string{"mkdir " + other + " 0755"}; !reflect.DeepEqual(misses, want) {
+		t.Errorf("Misses() = %q; want %q", misses, want)
+	}
+}
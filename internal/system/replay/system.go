@@ -0,0 +1,470 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// System is a system.System that answers calls from a recording
+// instead of a real system.  Calls are matched to the recording by
+// their operation and arguments, in the order they were recorded: the
+// first "lstat /etc/foo" gets the first recorded result for it, the
+// second the second, and so on, with the last result repeated once
+// they run out.  Calls that weren't recorded fail and are listed by
+// Misses.  Changes are not kept: writes are discarded and later reads
+// see the recorded results.  Create a System with NewSystem.
+type System struct {
+	mu     sync.Mutex
+	queues map[string][]*Call
+	misses map[string]struct{}
+}
+
+// NewSystem returns a System that replays calls.
+func NewSystem(calls []*Call) *System {
+	s := &System{
+		queues: make(map[string][]*Call),
+		misses: make(map[string]struct{}),
+	}
+	for _, c := range calls {
+		k := c.key()
+		s.queues[k] = append(s.queues[k], c)
+	}
+	return s
+}
+
+// call returns the next recorded result for c, or nil and an error if
+// there is none.
+func (s *System) call(c *Call) (*Call, error) {
+	k := c.key()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queues[k]
+	if len(q) == 0 {
+		s.misses[c.String()] = struct{}{}
+		return nil, fmt.Errorf("replay: %v was not recorded", c)
+	}
+	rc := q[0]
+	if len(q) > 1 {
+		s.queues[k] = q[1:]
+	}
+	return rc, nil
+}
+
+// Misses returns the calls that weren't in the recording, sorted and
+// without duplicates.  A miss means the replayed run diverged from the
+// recorded one.
+func (s *System) Misses() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := make([]string, 0, len(s.misses))
+	for c := range s.misses {
+		m = append(m, c)
+	}
+	sort.Strings(m)
+	return m
+}
+
+// replay looks up c and returns its recorded result and error.
+func (s *System) replay(c *Call) (*Call, error) {
+	rc, err := s.call(c)
+	if err != nil {
+		return nil, err
+	}
+	return rc, rc.Err.err(c.Op, c.Path)
+}
+
+func (s *System) Lstat(ctx context.Context, path string) (os.FileInfo, error) {
+	rc, err := s.replay(&Call{Op: "lstat", Path: path})
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{rc.Stat}, nil
+}
+
+func (s *System) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	_, err := s.replay(&Call{Op: "mkdir", Path: path, Args: []string{formatMode(mode)}})
+	return err
+}
+
+func (s *System) Remove(ctx context.Context, path string) error {
+	_, err := s.replay(&Call{Op: "remove", Path: path})
+	return err
+}
+
+func (s *System) Symlink(ctx context.Context, oldname, newname string) error {
+	_, err := s.replay(&Call{Op: "symlink", Path: newname, Args: []string{oldname}})
+	return err
+}
+
+func (s *System) Readlink(ctx context.Context, path string) (string, error) {
+	rc, err := s.replay(&Call{Op: "readlink", Path: path})
+	if err != nil {
+		return "", err
+	}
+	return rc.Result, nil
+}
+
+func (s *System) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	_, err := s.replay(&Call{Op: "chmod", Path: path, Args: []string{formatMode(mode)}})
+	return err
+}
+
+func (s *System) Chown(ctx context.Context, path string, uid system.UID, gid system.GID) error {
+	_, err := s.replay(&Call{Op: "chown", Path: path, Args: []string{fmt.Sprintf("%d:%d", uid, gid)}})
+	return err
+}
+
+func (s *System) OwnerInfo(info os.FileInfo) (system.UID, system.GID, error) {
+	st, err := statOf(info)
+	if err != nil {
+		return 0, 0, err
+	}
+	if st.OwnerErr != nil {
+		return 0, 0, st.OwnerErr.err("owner", st.Name)
+	}
+	return st.UID, st.GID, nil
+}
+
+func (s *System) CreateFile(ctx context.Context, path string, mode os.FileMode) (system.FileWriter, error) {
+	if _, err := s.replay(&Call{Op: "create", Path: path, Args: []string{formatMode(mode)}}); err != nil {
+		return nil, err
+	}
+	return new(file), nil
+}
+
+func (s *System) OpenFile(ctx context.Context, path string) (system.File, error) {
+	rc, err := s.replay(&Call{Op: "open", Path: path})
+	if err != nil {
+		return nil, err
+	}
+	if rc.Truncated {
+		return &file{err: fmt.Errorf("replay: content of %s was too large to record", path)}, nil
+	}
+	return &file{data: append([]byte(nil), rc.Content...)}, nil
+}
+
+// file is an in-memory file.
+type file struct {
+	data []byte
+	off  int64
+	err  error
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	if end := f.off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	n := copy(f.data[f.off:], p)
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	default:
+		return f.off, errors.New("replay: invalid whence")
+	}
+	if offset < 0 {
+		return f.off, errors.New("replay: negative offset")
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Truncate(size int64) error {
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+func (f *file) Close() error { return nil }
+
+func (s *System) LookupUser(name string) (system.UID, error) {
+	rc, err := s.replay(&Call{Op: "lookup_user", Path: name})
+	if err != nil {
+		return 0, err
+	}
+	return system.UID(rc.Int), nil
+}
+
+func (s *System) LookupGroup(name string) (system.GID, error) {
+	rc, err := s.replay(&Call{Op: "lookup_group", Path: name})
+	if err != nil {
+		return 0, err
+	}
+	return system.GID(rc.Int), nil
+}
+
+func (s *System) Run(ctx context.Context, cmd *system.Cmd) ([]byte, error) {
+	rc, err := s.call(&Call{Op: "run", Path: cmd.Path, Args: cmd.Args})
+	if err != nil {
+		return nil, err
+	}
+	return rc.Output, rc.Err.err("run", cmd.Path)
+}
+
+func (s *System) LookPath(ctx context.Context, file string, pathList string) (string, error) {
+	rc, err := s.replay(&Call{Op: "look_path", Path: file, Args: []string{pathList}})
+	if err != nil {
+		return "", err
+	}
+	return rc.Result, nil
+}
+
+func (s *System) Start(ctx context.Context, cmd *system.Cmd) (system.Process, error) {
+	if _, err := s.replay(&Call{Op: "start", Path: cmd.Path, Args: cmd.Args}); err != nil {
+		return nil, err
+	}
+	p := &process{killed: make(chan struct{})}
+	// A process that wasn't waited for during the recording runs until
+	// it is killed.
+	if wc, err := s.call(&Call{Op: "wait", Path: cmd.Path, Args: cmd.Args}); err == nil {
+		p.wait = wc
+	}
+	return p, nil
+}
+
+// process is a replayed background process.
+type process struct {
+	wait     *Call
+	killOnce sync.Once
+	killed   chan struct{}
+}
+
+func (p *process) Wait() error {
+	if p.wait != nil {
+		return p.wait.Err.err("wait", p.wait.Path)
+	}
+	<-p.killed
+	return new(exec.ExitError)
+}
+
+func (p *process) Kill() error {
+	p.killOnce.Do(func() { close(p.killed) })
+	return nil
+}
+
+func (p *process) Output() []byte {
+	if p.wait == nil {
+		return nil
+	}
+	return p.wait.Output
+}
+
+func (s *System) Umask(mask os.FileMode) os.FileMode {
+	rc, err := s.replay(&Call{Op: "umask", Args: []string{formatMode(mask)}})
+	if err != nil {
+		return 0
+	}
+	return os.FileMode(rc.Int)
+}
+
+// DialContext returns a connection whose peer has already closed it
+// if the recorded dial succeeded.
+func (s *System) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if _, err := s.replay(&Call{Op: "dial", Path: address, Args: []string{network}}); err != nil {
+		return nil, err
+	}
+	c, peer := net.Pipe()
+	peer.Close()
+	return c, nil
+}
+
+// Lock returns a lock that does nothing when unlocked if the recorded
+// lock was taken.
+func (s *System) Lock(ctx context.Context, path string, mode os.FileMode) (system.FileLock, error) {
+	if _, err := s.replay(&Call{Op: "lock", Path: path, Args: []string{formatMode(mode)}}); err != nil {
+		return nil, err
+	}
+	return replayedLock{}, nil
+}
+
+type replayedLock struct{}
+
+func (replayedLock) Unlock() error { return nil }
+
+func (s *System) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	_, err := s.replay(&Call{Op: "clone_file", Path: dst, Args: []string{src, formatMode(mode)}})
+	return err
+}
+
+func (s *System) Rename(ctx context.Context, oldpath, newpath string) error {
+	_, err := s.replay(&Call{Op: "rename", Path: newpath, Args: []string{oldpath}})
+	return err
+}
+
+func (s *System) DiskFree(ctx context.Context, path string) (int64, error) {
+	rc, err := s.replay(&Call{Op: "disk_free", Path: path})
+	if err != nil {
+		return 0, err
+	}
+	return rc.Int, nil
+}
+
+func (s *System) KernelVersion(ctx context.Context) (string, error) {
+	rc, err := s.replay(&Call{Op: "kernel_version"})
+	if err != nil {
+		return "", err
+	}
+	return rc.Result, nil
+}
+
+func (s *System) Privileged(ctx context.Context) (bool, error) {
+	rc, err := s.replay(&Call{Op: "privileged"})
+	if err != nil {
+		return false, err
+	}
+	return rc.Bool, nil
+}
+
+func (s *System) FileIdentity(info os.FileInfo) (dev, ino uint64, err error) {
+	st, err := statOf(info)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !st.Identified {
+		return 0, 0, errors.New("system cannot identify files")
+	}
+	return st.Dev, st.Ino, nil
+}
+
+func (s *System) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	rc, err := s.replay(&Call{Op: "read_dir", Path: path})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, len(rc.Stats))
+	for i, st := range rc.Stats {
+		infos[i] = fileInfo{st}
+	}
+	return infos, nil
+}
+
+func (s *System) RegistryKeyExists(ctx context.Context, key string) (bool, error) {
+	rc, err := s.replay(&Call{Op: "registry_key_exists", Path: key})
+	if err != nil {
+		return false, err
+	}
+	return rc.Bool, nil
+}
+
+func (s *System) CreateRegistryKey(ctx context.Context, key string) error {
+	_, err := s.replay(&Call{Op: "create_registry_key", Path: key})
+	return err
+}
+
+func (s *System) DeleteRegistryKey(ctx context.Context, key string) error {
+	_, err := s.replay(&Call{Op: "delete_registry_key", Path: key})
+	return err
+}
+
+func (s *System) RegistryValue(ctx context.Context, key, name string) (system.RegistryValue, error) {
+	rc, err := s.replay(&Call{Op: "registry_value", Path: key, Args: []string{name}})
+	if err != nil {
+		return system.RegistryValue{}, err
+	}
+	if rc.Value == nil {
+		return system.RegistryValue{}, nil
+	}
+	return *rc.Value, nil
+}
+
+func (s *System) SetRegistryValue(ctx context.Context, key, name string, val system.RegistryValue) error {
+	_, err := s.replay(&Call{Op: "set_registry_value", Path: key, Args: []string{name}})
+	return err
+}
+
+func (s *System) DeleteRegistryValue(ctx context.Context, key, name string) error {
+	_, err := s.replay(&Call{Op: "delete_registry_value", Path: key, Args: []string{name}})
+	return err
+}
+
+func (s *System) QueryService(ctx context.Context, name string) (*system.ServiceStatus, error) {
+	rc, err := s.replay(&Call{Op: "query_service", Path: name})
+	if err != nil {
+		return nil, err
+	}
+	status := new(system.ServiceStatus)
+	if rc.Service != nil {
+		*status = *rc.Service
+	}
+	return status, nil
+}
+
+func (s *System) CreateService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	_, err := s.replay(&Call{Op: "create_service", Path: name})
+	return err
+}
+
+func (s *System) ConfigureService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	_, err := s.replay(&Call{Op: "configure_service", Path: name})
+	return err
+}
+
+func (s *System) StartService(ctx context.Context, name string) error {
+	_, err := s.replay(&Call{Op: "start_service", Path: name})
+	return err
+}
+
+func (s *System) StopService(ctx context.Context, name string) error {
+	_, err := s.replay(&Call{Op: "stop_service", Path: name})
+	return err
+}
+
+var (
+	_ system.System         = new(System)
+	_ system.Starter        = new(System)
+	_ system.Umasker        = new(System)
+	_ system.Dialer         = new(System)
+	_ system.HostInspector  = new(System)
+	_ system.Locker         = new(System)
+	_ system.Cloner         = new(System)
+	_ system.Renamer        = new(System)
+	_ system.FileIdentifier = new(System)
+	_ system.DirReader      = new(System)
+	_ system.Registry       = new(System)
+	_ system.ServiceManager = new(System)
+)
@@ -0,0 +1,118 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"context"
+	"fmt"
+)
+
+// A ServiceManager is a System with a Windows-style service control
+// manager.  Errors for missing services satisfy os.IsNotExist.  A
+// ServiceManager must be safe to call from multiple goroutines.
+type ServiceManager interface {
+	// QueryService returns a service's configuration and state.
+	QueryService(ctx context.Context, name string) (*ServiceStatus, error)
+
+	// CreateService installs a new service.
+	CreateService(ctx context.Context, name string, config *ServiceConfig) error
+
+	// ConfigureService changes an existing service's configuration.
+	// Empty fields of config are left unchanged.
+	ConfigureService(ctx context.Context, name string, config *ServiceConfig) error
+
+	// StartService asks a service to start.  It does not wait for the
+	// service to be running.
+	StartService(ctx context.Context, name string) error
+
+	// StopService asks a service to stop.  It does not wait for the
+	// service to be stopped.
+	StopService(ctx context.Context, name string) error
+}
+
+// ServiceConfig is the configuration of a service.
+type ServiceConfig struct {
+	DisplayName string
+	BinaryPath  string
+	StartType   ServiceStartType
+}
+
+// ServiceStatus is the configuration and state of a service.
+type ServiceStatus struct {
+	ServiceConfig
+	State ServiceState
+}
+
+// ServiceStartType is when a service starts.  The values are the same
+// as Windows'.
+type ServiceStartType uint32
+
+// Service start types.  The zero value means unknown or unchanged.
+const (
+	ServiceAutoStart   ServiceStartType = 2
+	ServiceDemandStart ServiceStartType = 3
+	ServiceDisabled    ServiceStartType = 4
+)
+
+// String returns the start type's name as shown by sc.exe.
+func (t ServiceStartType) String() string {
+	switch t {
+	case ServiceAutoStart:
+		return "auto"
+	case ServiceDemandStart:
+		return "demand"
+	case ServiceDisabled:
+		return "disabled"
+	default:
+		return fmt.Sprintf("ServiceStartType(%d)", uint32(t))
+	}
+}
+
+// ServiceState is whether a service is running.  The values are the
+// same as Windows'.
+type ServiceState uint32
+
+// Service states.
+const (
+	ServiceStopped         ServiceState = 1
+	ServiceStartPending    ServiceState = 2
+	ServiceStopPending     ServiceState = 3
+	ServiceRunning         ServiceState = 4
+	ServiceContinuePending ServiceState = 5
+	ServicePausePending    ServiceState = 6
+	ServicePaused          ServiceState = 7
+)
+
+// String returns the state's name as shown by sc.exe.
+func (s ServiceState) String() string {
+	switch s {
+	case ServiceStopped:
+		return "STOPPED"
+	case ServiceStartPending:
+		return "START_PENDING"
+	case ServiceStopPending:
+		return "STOP_PENDING"
+	case ServiceRunning:
+		return "RUNNING"
+	case ServiceContinuePending:
+		return "CONTINUE_PENDING"
+	case ServicePausePending:
+		return "PAUSE_PENDING"
+	case ServicePaused:
+		return "PAUSED"
+	default:
+		return fmt.Sprintf("ServiceState(%d)", uint32(s))
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package system
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procOpenSCManagerW       = advapi32.NewProc("OpenSCManagerW")
+	procOpenServiceW         = advapi32.NewProc("OpenServiceW")
+	procCreateServiceW       = advapi32.NewProc("CreateServiceW")
+	procChangeServiceConfigW = advapi32.NewProc("ChangeServiceConfigW")
+	procQueryServiceConfigW  = advapi32.NewProc("QueryServiceConfigW")
+	procQueryServiceStatus   = advapi32.NewProc("QueryServiceStatus")
+	procStartServiceW        = advapi32.NewProc("StartServiceW")
+	procControlService       = advapi32.NewProc("ControlService")
+	procCloseServiceHandle   = advapi32.NewProc("CloseServiceHandle")
+)
+
+const (
+	scManagerConnect       = 0x0001
+	scManagerCreateService = 0x0002
+
+	serviceQueryConfig  = 0x0001
+	serviceChangeConfig = 0x0002
+	serviceQueryStatus  = 0x0004
+	serviceStart        = 0x0010
+	serviceStop         = 0x0020
+
+	serviceWin32OwnProcess = 0x00000010
+	serviceErrorNormal     = 0x00000001
+	serviceNoChange        = 0xffffffff
+	serviceControlStop     = 0x00000001
+
+	errorInsufficientBuffer    = syscall.Errno(122)
+	errorServiceDoesNotExist   = syscall.Errno(1060)
+	errorServiceAlreadyRunning = syscall.Errno(1056)
+)
+
+// queryServiceConfig is QUERY_SERVICE_CONFIGW.
+type queryServiceConfig struct {
+	ServiceType      uint32
+	StartType        uint32
+	ErrorControl     uint32
+	BinaryPathName   *uint16
+	LoadOrderGroup   *uint16
+	TagID            uint32
+	Dependencies     *uint16
+	ServiceStartName *uint16
+	DisplayName      *uint16
+}
+
+// serviceStatus is SERVICE_STATUS.
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+func serviceError(op, name string, err error) error {
+	if err == errorServiceDoesNotExist {
+		err = os.ErrNotExist
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// openService opens a service with the given access rights, returning
+// the handles of the service and the service control manager.  The
+// caller must close both with closeServiceHandle.
+func openService(op, name string, access uint32) (scm, svc uintptr, err error) {
+	name16, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, 0, serviceError(op, name, err)
+	}
+	scm, _, e := procOpenSCManagerW.Call(0, 0, scManagerConnect)
+	if scm == 0 {
+		return 0, 0, serviceError(op, name, e)
+	}
+	svc, _, e = procOpenServiceW.Call(scm, uintptr(unsafe.Pointer(name16)), uintptr(access))
+	if svc == 0 {
+		closeServiceHandle(scm)
+		return 0, 0, serviceError(op, name, e)
+	}
+	return scm, svc, nil
+}
+
+func closeServiceHandle(h uintptr) {
+	procCloseServiceHandle.Call(h)
+}
+
+// QueryService calls QueryServiceConfig and QueryServiceStatus.
+func (Local) QueryService(ctx context.Context, name string) (*ServiceStatus, error) {
+	scm, svc, err := openService("query service", name, serviceQueryConfig|serviceQueryStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer closeServiceHandle(scm)
+	defer closeServiceHandle(svc)
+
+	buf := make([]byte, 1024)
+	for {
+		var needed uint32
+		r, _, e := procQueryServiceConfigW.Call(svc, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), uintptr(unsafe.Pointer(&needed)))
+		if r != 0 {
+			break
+		}
+		if e != errorInsufficientBuffer {
+			return nil, serviceError("query service", name, e)
+		}
+		buf = make([]byte, needed)
+	}
+	config := (*queryServiceConfig)(unsafe.Pointer(&buf[0]))
+	var status serviceStatus
+	if r, _, e := procQueryServiceStatus.Call(svc, uintptr(unsafe.Pointer(&status))); r == 0 {
+		return nil, serviceError("query service", name, e)
+	}
+	return &ServiceStatus{
+		ServiceConfig: ServiceConfig{
+			DisplayName: utf16PtrToString(config.DisplayName),
+			BinaryPath:  utf16PtrToString(config.BinaryPathName),
+			StartType:   ServiceStartType(config.StartType),
+		},
+		State: ServiceState(status.CurrentState),
+	}, nil
+}
+
+// CreateService calls CreateService to install a service that runs in
+// its own process.
+func (Local) CreateService(ctx context.Context, name string, config *ServiceConfig) error {
+	name16, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return serviceError("create service", name, err)
+	}
+	displayName := config.DisplayName
+	if displayName == "" {
+		displayName = name
+	}
+	display16, err := syscall.UTF16PtrFromString(displayName)
+	if err != nil {
+		return serviceError("create service", name, err)
+	}
+	bin16, err := syscall.UTF16PtrFromString(config.BinaryPath)
+	if err != nil {
+		return serviceError("create service", name, err)
+	}
+	startType := config.StartType
+	if startType == 0 {
+		startType = ServiceDemandStart
+	}
+	scm, _, e := procOpenSCManagerW.Call(0, 0, scManagerConnect|scManagerCreateService)
+	if scm == 0 {
+		return serviceError("create service", name, e)
+	}
+	defer closeServiceHandle(scm)
+	svc, _, e := procCreateServiceW.Call(
+		scm,
+		uintptr(unsafe.Pointer(name16)),
+		uintptr(unsafe.Pointer(display16)),
+		serviceQueryStatus,
+		serviceWin32OwnProcess,
+		uintptr(startType),
+		serviceErrorNormal,
+		uintptr(unsafe.Pointer(bin16)),
+		0, 0, 0, 0, 0)
+	if svc == 0 {
+		return serviceError("create service", name, e)
+	}
+	closeServiceHandle(svc)
+	return nil
+}
+
+// ConfigureService calls ChangeServiceConfig.
+func (Local) ConfigureService(ctx context.Context, name string, config *ServiceConfig) error {
+	var display16, bin16 *uint16
+	var err error
+	if config.DisplayName != "" {
+		if display16, err = syscall.UTF16PtrFromString(config.DisplayName); err != nil {
+			return serviceError("configure service", name, err)
+		}
+	}
+	if config.BinaryPath != "" {
+		if bin16, err = syscall.UTF16PtrFromString(config.BinaryPath); err != nil {
+			return serviceError("configure service", name, err)
+		}
+	}
+	startType := uintptr(serviceNoChange)
+	if config.StartType != 0 {
+		startType = uintptr(config.StartType)
+	}
+	scm, svc, err := openService("configure service", name, serviceChangeConfig)
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle(scm)
+	defer closeServiceHandle(svc)
+	r, _, e := procChangeServiceConfigW.Call(
+		svc,
+		serviceNoChange,
+		startType,
+		serviceNoChange,
+		uintptr(unsafe.Pointer(bin16)),
+		0, 0, 0, 0, 0,
+		uintptr(unsafe.Pointer(display16)))
+	if r == 0 {
+		return serviceError("configure service", name, e)
+	}
+	return nil
+}
+
+// StartService calls StartService.
+func (Local) StartService(ctx context.Context, name string) error {
+	scm, svc, err := openService("start service", name, serviceStart)
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle(scm)
+	defer closeServiceHandle(svc)
+	if r, _, e := procStartServiceW.Call(svc, 0, 0); r == 0 && e != errorServiceAlreadyRunning {
+		return serviceError("start service", name, e)
+	}
+	return nil
+}
+
+// StopService calls ControlService with SERVICE_CONTROL_STOP.
+func (Local) StopService(ctx context.Context, name string) error {
+	scm, svc, err := openService("stop service", name, serviceStop)
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle(scm)
+	defer closeServiceHandle(svc)
+	var status serviceStatus
+	if r, _, e := procControlService.Call(svc, serviceControlStop, uintptr(unsafe.Pointer(&status))); r == 0 {
+		return serviceError("stop service", name, e)
+	}
+	return nil
+}
+
+// utf16PtrToString converts a NUL-terminated UTF-16 string to a Go
+// string.
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	var s []uint16
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Pointer(uintptr(ptr) + 2) {
+		s = append(s, *(*uint16)(ptr))
+	}
+	return syscall.UTF16ToString(s)
+}
@@ -23,7 +23,9 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"time"
 )
 
 // System consists of the top-level interfaces in this package.
@@ -47,7 +49,10 @@ type FS interface {
 	Chown(ctx context.Context, path string, uid UID, gid GID) error
 	OwnerInfo(info os.FileInfo) (UID, GID, error)
 
-	// CreateFile creates the named file, returning an error if it already exists.
+	// CreateFile creates the named file, returning an error if it
+	// already exists.  The check and the creation are one step, as with
+	// O_EXCL, so if two processes create the same file, then only one
+	// succeeds.
 	CreateFile(ctx context.Context, path string, mode os.FileMode) (FileWriter, error)
 
 	// OpenFile opens the named file for reading and writing.
@@ -55,6 +60,121 @@ type FS interface {
 	OpenFile(ctx context.Context, path string) (File, error)
 }
 
+// A FileIdentifier is an FS that can tell which file on disk a
+// FileInfo describes, even if the file was replaced at the same path.
+type FileIdentifier interface {
+	// FileIdentity returns the device and inode numbers from
+	// info.Sys().
+	FileIdentity(info os.FileInfo) (dev, ino uint64, err error)
+}
+
+// A DirReader is an FS that can list the entries of a directory.
+type DirReader interface {
+	// ReadDir returns information about the entries of the named
+	// directory, sorted by name.  Symlinks are not followed.
+	ReadDir(ctx context.Context, path string) ([]os.FileInfo, error)
+}
+
+// A Locker is an FS that can take advisory locks on files, so that
+// cooperating processes, like two runs of an applier, don't write the
+// same files at the same time.  A Locker must be safe to call from
+// multiple goroutines.
+type Locker interface {
+	// Lock takes an exclusive advisory lock on the named file, creating
+	// it with mode if it does not exist.  Lock waits until the lock is
+	// free or ctx is done.  The lock is held until it is unlocked or
+	// the process exits.
+	Lock(ctx context.Context, path string, mode os.FileMode) (FileLock, error)
+}
+
+// A FileLock is a lock taken by a Locker.
+type FileLock interface {
+	Unlock() error
+}
+
+// A Cloner is an FS that can make copy-on-write clones of files.  A
+// clone shares its data with the source until either is written, so
+// large files can be copied without copying their data.
+type Cloner interface {
+	// CloneFile replaces the content of dst with a clone of src,
+	// creating dst with mode if it does not exist.  If the filesystem
+	// can't clone src to dst, such as when they are on different
+	// filesystems, then CloneFile returns an error and does not create
+	// dst, but an existing dst may have been truncated.
+	CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error
+}
+
+// A Renamer is an FS that can rename files.  A Renamer must be safe to
+// call from multiple goroutines.
+type Renamer interface {
+	// Rename moves the file at oldpath to newpath, replacing any file
+	// at newpath.  When both paths are in the same directory, other
+	// processes see either the old file or the new one at newpath,
+	// never a missing or partly written file.
+	Rename(ctx context.Context, oldpath, newpath string) error
+}
+
+// A Umasker is an FS whose file creation mask can be changed.  The mask
+// applies to all files created through the FS, including those created
+// by processes it runs.
+type Umasker interface {
+	// Umask sets the file creation mask and returns the previous one.
+	Umask(mask os.FileMode) (old os.FileMode)
+}
+
+// A Starter is a Runner that can start long-running processes without
+// waiting for them to finish.  A Starter must be safe to call from
+// multiple goroutines.
+type Starter interface {
+	// Start starts a process.  The process is not stopped when ctx is
+	// done: it runs until it exits or is killed.
+	Start(ctx context.Context, cmd *Cmd) (Process, error)
+}
+
+// A Process is a process started by a Starter.  Its methods are safe
+// to call from multiple goroutines.
+type Process interface {
+	// Wait waits for the process to exit.  It returns the same value
+	// no matter how many times it's called.
+	Wait() error
+
+	// Kill stops the process.  It does not wait for it to exit.
+	Kill() error
+
+	// Output returns the combined output of the process so far,
+	// limited by Cmd.MaxOutput.
+	Output() []byte
+}
+
+// A Dialer is a System that can make network connections, such as to
+// check whether a service is accepting connections.  A Dialer must be
+// safe to call from multiple goroutines.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// A HostInspector is a System that can describe the host it runs on,
+// such as for checking a catalog's preconditions.  A HostInspector must
+// be safe to call from multiple goroutines.
+type HostInspector interface {
+	// DiskFree returns the number of bytes available to unprivileged
+	// users on the filesystem that contains path.
+	DiskFree(ctx context.Context, path string) (int64, error)
+
+	// KernelVersion returns the release of the running kernel, like
+	// "4.9.0-3-amd64".
+	KernelVersion(ctx context.Context) (string, error)
+
+	// Privileged reports whether the applier runs as the superuser.
+	Privileged(ctx context.Context) (bool, error)
+}
+
+// A Clock is a System that tells its own time, such as a fake system
+// in a test.  A Clock must be safe to call from multiple goroutines.
+type Clock interface {
+	Now() time.Time
+}
+
 // File represents an open file.
 type File interface {
 	io.Reader
@@ -87,6 +207,13 @@ type GID int
 // multiple goroutines.
 type Runner interface {
 	Run(ctx context.Context, cmd *Cmd) (output []byte, err error)
+
+	// LookPath searches for an executable named file in the
+	// directories of pathList, which uses the OS's PATH list format.
+	// If pathList is empty, then the system's default search path is
+	// used.  An error satisfying IsNotExist is returned if file is not
+	// found.
+	LookPath(ctx context.Context, file string, pathList string) (string, error)
 }
 
 // A Cmd describes a process to execute on a system.
@@ -97,11 +224,66 @@ type Cmd struct {
 	Env   []string
 	Dir   string
 	Stdin io.Reader
+
+	// MaxOutput limits the combined output returned by Run in the same
+	// manner as OutputBuffer.  If non-positive, then all output is
+	// returned.
+	MaxOutput int
+
+	// Sched changes the process's scheduling settings if non-nil.  Local
+	// applies them just after the process starts, so processes that the
+	// command forks immediately may keep the inherited settings.
+	Sched *Sched
+}
+
+// Sched holds a process's scheduling settings.  The zero value leaves
+// all of the settings inherited from the caller.
+type Sched struct {
+	// Nice is the process's niceness if non-zero, from -20 (most
+	// favorable) to 19 (least favorable).
+	Nice int
+
+	// IOClass is the process's I/O scheduling class on Linux if it is
+	// not IOClassNone.  IOLevel is the priority within the class, from 0
+	// (highest) to 7, and is ignored for IOClassIdle.
+	IOClass IOClass
+	IOLevel int
+
+	// OOMScoreAdj is the process's oom_score_adj on Linux if non-zero,
+	// from -1000 (never killed) to 1000 (killed first).
+	OOMScoreAdj int
 }
 
+// IOClass is an I/O scheduling class.  The values match Linux's.
+type IOClass int
+
+// I/O scheduling classes.
+const (
+	IOClassNone IOClass = iota
+	IOClassRealtime
+	IOClassBestEffort
+	IOClassIdle
+)
+
 func IsExist(err error) bool    { return os.IsExist(err) }
 func IsNotExist(err error) bool { return os.IsNotExist(err) }
 
+// CreateNewFile creates the named file with content, returning an
+// error satisfying IsExist and leaving the file untouched if it
+// already exists.
+func CreateNewFile(ctx context.Context, fs FS, path string, content []byte, mode os.FileMode) error {
+	w, err := fs.CreateFile(ctx, path, mode)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	cerr := w.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
 func ReadFile(ctx context.Context, fs FS, path string) ([]byte, error) {
 	f, err := fs.OpenFile(ctx, path)
 	if err != nil {
@@ -194,4 +376,8 @@ func (Stub) Run(ctx context.Context, cmd *Cmd) (output []byte, err error) {
 	return nil, errNotImplemented
 }
 
+func (Stub) LookPath(ctx context.Context, file string, pathList string) (string, error) {
+	return "", &os.PathError{Op: "lookpath", Path: file, Err: errNotImplemented}
+}
+
 var errNotImplemented = errors.New("system stub: not implemented")
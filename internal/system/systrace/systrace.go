@@ -0,0 +1,542 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package systrace provides a system.System that reports every call
+// made through it, so that the operations a run performs can be
+// inspected.
+package systrace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/system"
+)
+
+// A Call describes a single call to a system.
+type Call struct {
+	// Op names the method, like "lstat" or "run".
+	Op string
+
+	// Path is the file, command, registry key, service, or address
+	// that the call operated on.  It is empty for calls that don't
+	// name one, like "umask".
+	Path string
+
+	// Args holds the call's other arguments, like a command's argv or
+	// a symlink's target.
+	Args []string
+
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// A Tracer receives calls once they finish.  A Tracer must be safe to
+// call from multiple goroutines.
+type Tracer interface {
+	Trace(ctx context.Context, c *Call)
+}
+
+// System is a system.System that sends every call made through it to
+// Tracer.  The optional system interfaces (except Clock) are forwarded
+// to the underlying system, returning an error if it does not
+// implement them.  Files returned by CreateFile and OpenFile are not
+// traced past the call that opened them.
+type System struct {
+	system.System
+	Tracer Tracer
+}
+
+// trace sends c to the tracer, filling in its timing from start.
+func (s System) trace(ctx context.Context, c *Call, start time.Time, err error) {
+	c.Start = start
+	c.Duration = time.Since(start)
+	c.Err = err
+	s.Tracer.Trace(ctx, c)
+}
+
+func (s System) Lstat(ctx context.Context, path string) (os.FileInfo, error) {
+	start := time.Now()
+	info, err := s.System.Lstat(ctx, path)
+	s.trace(ctx, &Call{Op: "lstat", Path: path}, start, err)
+	return info, err
+}
+
+func (s System) Mkdir(ctx context.Context, path string, mode os.FileMode) error {
+	start := time.Now()
+	err := s.System.Mkdir(ctx, path, mode)
+	s.trace(ctx, &Call{Op: "mkdir", Path: path, Args: []string{formatMode(mode)}}, start, err)
+	return err
+}
+
+func (s System) Remove(ctx context.Context, path string) error {
+	start := time.Now()
+	err := s.System.Remove(ctx, path)
+	s.trace(ctx, &Call{Op: "remove", Path: path}, start, err)
+	return err
+}
+
+func (s System) Symlink(ctx context.Context, oldname, newname string) error {
+	start := time.Now()
+	err := s.System.Symlink(ctx, oldname, newname)
+	s.trace(ctx, &Call{Op: "symlink", Path: newname, Args: []string{oldname}}, start, err)
+	return err
+}
+
+func (s System) Readlink(ctx context.Context, path string) (string, error) {
+	start := time.Now()
+	target, err := s.System.Readlink(ctx, path)
+	s.trace(ctx, &Call{Op: "readlink", Path: path}, start, err)
+	return target, err
+}
+
+func (s System) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	start := time.Now()
+	err := s.System.Chmod(ctx, path, mode)
+	s.trace(ctx, &Call{Op: "chmod", Path: path, Args: []string{formatMode(mode)}}, start, err)
+	return err
+}
+
+func (s System) Chown(ctx context.Context, path string, uid system.UID, gid system.GID) error {
+	start := time.Now()
+	err := s.System.Chown(ctx, path, uid, gid)
+	s.trace(ctx, &Call{Op: "chown", Path: path, Args: []string{fmt.Sprintf("%d:%d", uid, gid)}}, start, err)
+	return err
+}
+
+func (s System) OwnerInfo(info os.FileInfo) (system.UID, system.GID, error) {
+	start := time.Now()
+	uid, gid, err := s.System.OwnerInfo(info)
+	s.trace(context.Background(), &Call{Op: "owner_info", Path: info.Name()}, start, err)
+	return uid, gid, err
+}
+
+func (s System) CreateFile(ctx context.Context, path string, mode os.FileMode) (system.FileWriter, error) {
+	start := time.Now()
+	w, err := s.System.CreateFile(ctx, path, mode)
+	s.trace(ctx, &Call{Op: "create", Path: path, Args: []string{formatMode(mode)}}, start, err)
+	return w, err
+}
+
+func (s System) OpenFile(ctx context.Context, path string) (system.File, error) {
+	start := time.Now()
+	f, err := s.System.OpenFile(ctx, path)
+	s.trace(ctx, &Call{Op: "open", Path: path}, start, err)
+	return f, err
+}
+
+func (s System) LookupUser(name string) (system.UID, error) {
+	start := time.Now()
+	uid, err := s.System.LookupUser(name)
+	s.trace(context.Background(), &Call{Op: "lookup_user", Path: name}, start, err)
+	return uid, err
+}
+
+func (s System) LookupGroup(name string) (system.GID, error) {
+	start := time.Now()
+	gid, err := s.System.LookupGroup(name)
+	s.trace(context.Background(), &Call{Op: "lookup_group", Path: name}, start, err)
+	return gid, err
+}
+
+func (s System) Run(ctx context.Context, cmd *system.Cmd) ([]byte, error) {
+	start := time.Now()
+	out, err := s.System.Run(ctx, cmd)
+	s.trace(ctx, &Call{Op: "run", Path: cmd.Path, Args: cmd.Args}, start, err)
+	return out, err
+}
+
+func (s System) LookPath(ctx context.Context, file string, pathList string) (string, error) {
+	start := time.Now()
+	path, err := s.System.LookPath(ctx, file, pathList)
+	s.trace(ctx, &Call{Op: "look_path", Path: file, Args: []string{pathList}}, start, err)
+	return path, err
+}
+
+func (s System) Start(ctx context.Context, cmd *system.Cmd) (system.Process, error) {
+	st, ok := s.System.(system.Starter)
+	if !ok {
+		return nil, errors.New("system cannot start background processes")
+	}
+	start := time.Now()
+	p, err := st.Start(ctx, cmd)
+	s.trace(ctx, &Call{Op: "start", Path: cmd.Path, Args: cmd.Args}, start, err)
+	return p, err
+}
+
+func (s System) Umask(mask os.FileMode) os.FileMode {
+	u, ok := s.System.(system.Umasker)
+	if !ok {
+		return 0
+	}
+	start := time.Now()
+	old := u.Umask(mask)
+	s.trace(context.Background(), &Call{Op: "umask", Args: []string{formatMode(mask)}}, start, nil)
+	return old
+}
+
+func (s System) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d, ok := s.System.(system.Dialer)
+	if !ok {
+		return nil, errors.New("system cannot dial addresses")
+	}
+	start := time.Now()
+	c, err := d.DialContext(ctx, network, address)
+	s.trace(ctx, &Call{Op: "dial", Path: address, Args: []string{network}}, start, err)
+	return c, err
+}
+
+func (s System) Lock(ctx context.Context, path string, mode os.FileMode) (system.FileLock, error) {
+	l, ok := s.System.(system.Locker)
+	if !ok {
+		return nil, errors.New("system cannot lock files")
+	}
+	start := time.Now()
+	fl, err := l.Lock(ctx, path, mode)
+	s.trace(ctx, &Call{Op: "lock", Path: path, Args: []string{formatMode(mode)}}, start, err)
+	return fl, err
+}
+
+func (s System) CloneFile(ctx context.Context, src, dst string, mode os.FileMode) error {
+	c, ok := s.System.(system.Cloner)
+	if !ok {
+		return errors.New("system cannot clone files")
+	}
+	start := time.Now()
+	err := c.CloneFile(ctx, src, dst, mode)
+	s.trace(ctx, &Call{Op: "clone_file", Path: dst, Args: []string{src, formatMode(mode)}}, start, err)
+	return err
+}
+
+func (s System) Rename(ctx context.Context, oldpath, newpath string) error {
+	r, ok := s.System.(system.Renamer)
+	if !ok {
+		return errors.New("system cannot rename files")
+	}
+	start := time.Now()
+	err := r.Rename(ctx, oldpath, newpath)
+	s.trace(ctx, &Call{Op: "rename", Path: newpath, Args: []string{oldpath}}, start, err)
+	return err
+}
+
+func (s System) inspector() (system.HostInspector, error) {
+	hi, ok := s.System.(system.HostInspector)
+	if !ok {
+		return nil, errors.New("system cannot inspect the host")
+	}
+	return hi, nil
+}
+
+func (s System) DiskFree(ctx context.Context, path string) (int64, error) {
+	hi, err := s.inspector()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	n, err := hi.DiskFree(ctx, path)
+	s.trace(ctx, &Call{Op: "disk_free", Path: path}, start, err)
+	return n, err
+}
+
+func (s System) KernelVersion(ctx context.Context) (string, error) {
+	hi, err := s.inspector()
+	if err != nil {
+		return "", err
+	}
+	start := time.Now()
+	v, err := hi.KernelVersion(ctx)
+	s.trace(ctx, &Call{Op: "kernel_version"}, start, err)
+	return v, err
+}
+
+func (s System) Privileged(ctx context.Context) (bool, error) {
+	hi, err := s.inspector()
+	if err != nil {
+		return false, err
+	}
+	start := time.Now()
+	priv, err := hi.Privileged(ctx)
+	s.trace(ctx, &Call{Op: "privileged"}, start, err)
+	return priv, err
+}
+
+func (s System) FileIdentity(info os.FileInfo) (dev, ino uint64, err error) {
+	fi, ok := s.System.(system.FileIdentifier)
+	if !ok {
+		return 0, 0, errors.New("system cannot identify files")
+	}
+	start := time.Now()
+	dev, ino, err = fi.FileIdentity(info)
+	s.trace(context.Background(), &Call{Op: "file_identity", Path: info.Name()}, start, err)
+	return dev, ino, err
+}
+
+func (s System) ReadDir(ctx context.Context, path string) ([]os.FileInfo, error) {
+	dr, ok := s.System.(system.DirReader)
+	if !ok {
+		return nil, errors.New("system cannot list directories")
+	}
+	start := time.Now()
+	infos, err := dr.ReadDir(ctx, path)
+	s.trace(ctx, &Call{Op: "read_dir", Path: path}, start, err)
+	return infos, err
+}
+
+func (s System) registry() (system.Registry, error) {
+	r, ok := s.System.(system.Registry)
+	if !ok {
+		return nil, errors.New("system has no registry")
+	}
+	return r, nil
+}
+
+func (s System) RegistryKeyExists(ctx context.Context, key string) (bool, error) {
+	r, err := s.registry()
+	if err != nil {
+		return false, err
+	}
+	start := time.Now()
+	exists, err := r.RegistryKeyExists(ctx, key)
+	s.trace(ctx, &Call{Op: "registry_key_exists", Path: key}, start, err)
+	return exists, err
+}
+
+func (s System) CreateRegistryKey(ctx context.Context, key string) error {
+	r, err := s.registry()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = r.CreateRegistryKey(ctx, key)
+	s.trace(ctx, &Call{Op: "create_registry_key", Path: key}, start, err)
+	return err
+}
+
+func (s System) DeleteRegistryKey(ctx context.Context, key string) error {
+	r, err := s.registry()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = r.DeleteRegistryKey(ctx, key)
+	s.trace(ctx, &Call{Op: "delete_registry_key", Path: key}, start, err)
+	return err
+}
+
+func (s System) RegistryValue(ctx context.Context, key, name string) (system.RegistryValue, error) {
+	r, err := s.registry()
+	if err != nil {
+		return system.RegistryValue{}, err
+	}
+	start := time.Now()
+	val, err := r.RegistryValue(ctx, key, name)
+	s.trace(ctx, &Call{Op: "registry_value", Path: key, Args: []string{name}}, start, err)
+	return val, err
+}
+
+func (s System) SetRegistryValue(ctx context.Context, key, name string, val system.RegistryValue) error {
+	r, err := s.registry()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = r.SetRegistryValue(ctx, key, name, val)
+	s.trace(ctx, &Call{Op: "set_registry_value", Path: key, Args: []string{name}}, start, err)
+	return err
+}
+
+func (s System) DeleteRegistryValue(ctx context.Context, key, name string) error {
+	r, err := s.registry()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = r.DeleteRegistryValue(ctx, key, name)
+	s.trace(ctx, &Call{Op: "delete_registry_value", Path: key, Args: []string{name}}, start, err)
+	return err
+}
+
+func (s System) services() (system.ServiceManager, error) {
+	sm, ok := s.System.(system.ServiceManager)
+	if !ok {
+		return nil, errors.New("system cannot manage services")
+	}
+	return sm, nil
+}
+
+func (s System) QueryService(ctx context.Context, name string) (*system.ServiceStatus, error) {
+	sm, err := s.services()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	status, err := sm.QueryService(ctx, name)
+	s.trace(ctx, &Call{Op: "query_service", Path: name}, start, err)
+	return status, err
+}
+
+func (s System) CreateService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sm, err := s.services()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = sm.CreateService(ctx, name, config)
+	s.trace(ctx, &Call{Op: "create_service", Path: name}, start, err)
+	return err
+}
+
+func (s System) ConfigureService(ctx context.Context, name string, config *system.ServiceConfig) error {
+	sm, err := s.services()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = sm.ConfigureService(ctx, name, config)
+	s.trace(ctx, &Call{Op: "configure_service", Path: name}, start, err)
+	return err
+}
+
+func (s System) StartService(ctx context.Context, name string) error {
+	sm, err := s.services()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = sm.StartService(ctx, name)
+	s.trace(ctx, &Call{Op: "start_service", Path: name}, start, err)
+	return err
+}
+
+func (s System) StopService(ctx context.Context, name string) error {
+	sm, err := s.services()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = sm.StopService(ctx, name)
+	s.trace(ctx, &Call{Op: "stop_service", Path: name}, start, err)
+	return err
+}
+
+// Now returns the underlying system's time if it is a system.Clock,
+// or the wall clock time otherwise.  It is not traced.
+func (s System) Now() time.Time {
+	if c, ok := s.System.(system.Clock); ok {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func formatMode(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", uint32(mode&os.ModePerm))
+}
+
+var (
+	_ system.Starter        = System{}
+	_ system.Umasker        = System{}
+	_ system.Dialer         = System{}
+	_ system.HostInspector  = System{}
+	_ system.Locker         = System{}
+	_ system.Cloner         = System{}
+	_ system.Renamer        = System{}
+	_ system.FileIdentifier = System{}
+	_ system.DirReader      = System{}
+	_ system.Clock          = System{}
+	_ system.Registry       = System{}
+	_ system.ServiceManager = System{}
+)
+
+// A Recorder is a Tracer that keeps every call in memory.
+type Recorder struct {
+	mu    sync.Mutex
+	calls []*Call
+}
+
+// Trace appends c to the recorded calls.
+func (r *Recorder) Trace(ctx context.Context, c *Call) {
+	r.mu.Lock()
+	r.calls = append(r.calls, c)
+	r.mu.Unlock()
+}
+
+// Calls returns the calls recorded so far, in the order they finished.
+func (r *Recorder) Calls() []*Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Call(nil), r.calls...)
+}
+
+// A Log is a Tracer that writes each call to a writer as a line of
+// JSON.
+type Log struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewLog returns a Log that writes to w.
+func NewLog(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+type logLine struct {
+	Op       string        `json:"op"`
+	Path     string        `json:"path,omitempty"`
+	Args     []string      `json:"args,omitempty"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Trace writes c to the log.  Write errors are reported by Err.
+func (l *Log) Trace(ctx context.Context, c *Call) {
+	ll := &logLine{
+		Op:       c.Op,
+		Path:     c.Path,
+		Args:     c.Args,
+		Start:    c.Start,
+		Duration: c.Duration,
+	}
+	if c.Err != nil {
+		ll.Error = c.Err.Error()
+	}
+	data, err := json.Marshal(ll)
+	if err != nil {
+		// Only possible for a time outside of JSON's range.
+		return
+	}
+	data = append(data, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return
+	}
+	_, l.err = l.w.Write(data)
+}
+
+// Err returns the first error encountered while writing the log.
+func (l *Log) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
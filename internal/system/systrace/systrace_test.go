@@ -0,0 +1,115 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package systrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/zombiezen/mcm/internal/system"
+	"github.com/zombiezen/mcm/internal/system/fakesystem"
+)
+
+func TestSystem(t *testing.T) {
+	ctx := context.Background()
+	fake := new(fakesystem.System)
+	progPath := filepath.Join(fakesystem.Root, "prog")
+	if err := fake.Mkprogram(progPath, func(ctx context.Context, pc *fakesystem.ProgramContext) int { return 0 }); err != nil {
+		t.Fatal(err)
+	}
+	rec := new(Recorder)
+	sys := System{System: fake, Tracer: rec}
+	dir := filepath.Join(fakesystem.Root, "dir")
+	if err := sys.Mkdir(ctx, dir, 0755); err != nil {
+		t.Fatal("Mkdir:", err)
+	}
+	missing := filepath.Join(dir, "missing")
+	if _, err := sys.Lstat(ctx, missing); !system.IsNotExist(err) {
+		t.Errorf("Lstat(%q) = _, %v; want not exist", missing, err)
+	}
+	if _, err := sys.Run(ctx, &system.Cmd{Path: progPath, Args: []string{progPath, "-x"}}); err != nil {
+		t.Error("Run:", err)
+	}
+
+	calls := rec.Calls()
+	if len(calls) != 3 {
+		t.Fatalf("recorded %d calls; want 3", len(calls))
+	}
+	type summary struct {
+		op, path string
+		args     []string
+		failed   bool
+	}
+	want := []summary{
+		{"mkdir", dir, []string{"0755"}, false},
+		{"lstat", missing, nil, true},
+		{"run", progPath, []string{progPath, "-x"}, false},
+	}
+	for i, c := range calls {
+		got := summary{c.Op, c.Path, c.Args, c.Err != nil}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("calls[%d] = %+v; want %+v", i, got, want[i])
+		}
+		if c.Start.IsZero() || c.Duration < 0 {
+			t.Errorf("calls[%d] timing = %v, %v", i, c.Start, c.Duration)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	ctx := context.Background()
+	fake := new(fakesystem.System)
+	buf := new(bytes.Buffer)
+	log := NewLog(buf)
+	sys := System{System: fake, Tracer: log}
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			sys.Lstat(ctx, path)
+		}(filepath.Join(fakesystem.Root, name))
+	}
+	wg.Wait()
+	if err := log.Err(); err != nil {
+		t.Fatal("Err:", err)
+	}
+	var paths []string
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var line struct {
+			Op    string `json:"op"`
+			Path  string `json:"path"`
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal("Decode:", err)
+		}
+		if line.Op != "lstat" || line.Error == "" {
+			t.Errorf("line = %+v; want failed lstat", line)
+		}
+		paths = append(paths, filepath.Base(line.Path))
+	}
+	sort.Strings(paths)
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("traced paths = %q; want %q", paths, want)
+	}
+}
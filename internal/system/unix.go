@@ -17,8 +17,13 @@
 package system
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"runtime"
+	"strconv"
 	"syscall"
 )
 
@@ -33,3 +38,106 @@ func (Local) OwnerInfo(info os.FileInfo) (UID, GID, error) {
 	}
 	return UID(st.Uid), GID(st.Gid), nil
 }
+
+// FileIdentity retrieves a file's device and inode numbers from
+// info.Sys().
+func (Local) FileIdentity(info os.FileInfo) (dev, ino uint64, err error) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, errors.New("file info has no device/inode fields")
+	}
+	return uint64(st.Dev), uint64(st.Ino), nil
+}
+
+// Umask sets the process's file creation mask.  Since the mask is
+// process-wide, it should not be changed while other goroutines are
+// creating files.
+func (Local) Umask(mask os.FileMode) os.FileMode {
+	return os.FileMode(syscall.Umask(int(mask & os.ModePerm)))
+}
+
+// DiskFree returns the number of bytes available to unprivileged users
+// on the filesystem that contains path.
+func (Local) DiskFree(ctx context.Context, path string) (int64, error) {
+	return diskFree(path)
+}
+
+// KernelVersion returns the release of the running kernel, as printed
+// by uname -r.
+func (Local) KernelVersion(ctx context.Context) (string, error) {
+	return kernelRelease()
+}
+
+// Privileged reports whether the process's effective user is root.
+func (Local) Privileged(ctx context.Context) (bool, error) {
+	return os.Geteuid() == 0, nil
+}
+
+func isExecutable(info os.FileInfo) bool {
+	return info.Mode().IsRegular() && info.Mode()&0111 != 0
+}
+
+// setSched applies s to the process pid.
+func setSched(pid int, s *Sched) error {
+	if s == nil {
+		return nil
+	}
+	if s.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, s.Nice); err != nil {
+			return fmt.Errorf("set niceness: %v", err)
+		}
+	}
+	if s.IOClass != IOClassNone {
+		if err := setIOPriority(pid, s.IOClass, s.IOLevel); err != nil {
+			return fmt.Errorf("set I/O priority: %v", err)
+		}
+	}
+	if s.OOMScoreAdj != 0 {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("set oom_score_adj: not supported on %s", runtime.GOOS)
+		}
+		path := "/proc/" + strconv.Itoa(pid) + "/oom_score_adj"
+		if err := ioutil.WriteFile(path, []byte(strconv.Itoa(s.OOMScoreAdj)), 0); err != nil {
+			return fmt.Errorf("set oom_score_adj: %v", err)
+		}
+	}
+	return nil
+}
+
+// ioprioSetTraps maps GOARCH to the number of Linux's ioprio_set
+// system call, which the syscall package only defines when building
+// for Linux.
+var ioprioSetTraps = map[string]uintptr{
+	"386":      289,
+	"amd64":    251,
+	"arm":      314,
+	"arm64":    30,
+	"mips":     4314,
+	"mipsle":   4314,
+	"mips64":   5273,
+	"mips64le": 5273,
+	"ppc64":    273,
+	"ppc64le":  273,
+	"riscv64":  30,
+	"s390x":    282,
+}
+
+// setIOPriority calls ioprio_set(2) for the process pid.
+func setIOPriority(pid int, class IOClass, level int) error {
+	trap, ok := ioprioSetTraps[runtime.GOARCH]
+	if runtime.GOOS != "linux" || !ok {
+		return fmt.Errorf("not supported on %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	const (
+		whoProcess = 1
+		classShift = 13
+	)
+	if class == IOClassIdle {
+		level = 0
+	}
+	prio := uintptr(class)<<classShift | uintptr(level)
+	if _, _, errno := syscall.Syscall(trap, whoProcess, uintptr(pid), prio); errno != 0 {
+		return errno
+	}
+	return nil
+}
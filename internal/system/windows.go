@@ -17,6 +17,7 @@
 package system
 
 import (
+	"context"
 	"errors"
 	"os"
 )
@@ -28,3 +29,37 @@ const LocalRoot = "C:\\"
 func (Local) OwnerInfo(os.FileInfo) (UID, GID, error) {
 	return 0, 0, errors.New("uid/gid not supported on windows")
 }
+
+// Umask is a no-op on Windows, which does not have a file creation mask.
+func (Local) Umask(mask os.FileMode) os.FileMode {
+	return 0
+}
+
+// DiskFree is not supported on Windows.
+func (Local) DiskFree(ctx context.Context, path string) (int64, error) {
+	return diskFree(path)
+}
+
+// KernelVersion is not supported on Windows.
+func (Local) KernelVersion(ctx context.Context) (string, error) {
+	return kernelRelease()
+}
+
+// Privileged is not supported on Windows.
+func (Local) Privileged(ctx context.Context) (bool, error) {
+	return false, errors.New("privilege check not supported on windows")
+}
+
+// setSched returns an error if s changes any settings, since Windows
+// does not have the same scheduling controls.
+func setSched(pid int, s *Sched) error {
+	if s == nil || *s == (Sched{}) {
+		return nil
+	}
+	return errors.New("scheduling settings not supported on windows")
+}
+
+func isExecutable(info os.FileInfo) bool {
+	// TODO(someday): check PATHEXT.
+	return info.Mode().IsRegular()
+}
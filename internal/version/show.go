@@ -18,9 +18,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/internal/features"
 )
 
-// Show prints the executable's version information to stderr.
+// Show prints the executable's version information and its optional
+// features (see package features) to stderr.
 func Show() {
 	exeName := filepath.Base(os.Args[0])
 	switch {
@@ -31,4 +35,9 @@ func Show() {
 	default:
 		fmt.Fprintf(os.Stderr, "%s: built from %s\n", exeName, SCMRevision)
 	}
+	if f := features.List(); len(f) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: features: %s\n", exeName, strings.Join(f, " "))
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: features: none\n", exeName)
+	}
 }
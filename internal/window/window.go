@@ -0,0 +1,396 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package window restricts runs to maintenance windows.
+package window
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Window is a daily range of wall clock time on some days of the
+// week.  A window whose end is before its start continues past
+// midnight into the next day.
+type Window struct {
+	// Days has the days of the week that the window starts on, indexed
+	// by time.Weekday.
+	Days [7]bool
+
+	// Start and End are minutes after midnight.  End may be 24*60 for
+	// a window that ends at midnight.
+	Start, End int
+}
+
+var dayNames = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseWindow parses a window of the form "[DAYS ]HH:MM-HH:MM", where
+// DAYS is a comma-separated list of days ("Mon") or day ranges
+// ("Mon-Fri").  A window without days applies to every day.
+func ParseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(s)
+	var times string
+	switch len(fields) {
+	case 1:
+		times = fields[0]
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	case 2:
+		if err := parseDays(&w.Days, fields[0]); err != nil {
+			return Window{}, fmt.Errorf("parse window %q: %v", s, err)
+		}
+		times = fields[1]
+	default:
+		return Window{}, fmt.Errorf("parse window %q: want [DAYS ]HH:MM-HH:MM", s)
+	}
+	i := strings.IndexByte(times, '-')
+	if i == -1 {
+		return Window{}, fmt.Errorf("parse window %q: want [DAYS ]HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.Start, err = parseClock(times[:i]); err != nil || w.Start == 24*60 {
+		return Window{}, fmt.Errorf("parse window %q: invalid start time %q", s, times[:i])
+	}
+	if w.End, err = parseClock(times[i+1:]); err != nil {
+		return Window{}, fmt.Errorf("parse window %q: invalid end time %q", s, times[i+1:])
+	}
+	if w.Start == w.End {
+		return Window{}, fmt.Errorf("parse window %q: window is empty", s)
+	}
+	return w, nil
+}
+
+func parseDays(days *[7]bool, s string) error {
+	for _, part := range strings.Split(s, ",") {
+		i := strings.IndexByte(part, '-')
+		if i == -1 {
+			d, err := parseDay(part)
+			if err != nil {
+				return err
+			}
+			days[d] = true
+			continue
+		}
+		first, err := parseDay(part[:i])
+		if err != nil {
+			return err
+		}
+		last, err := parseDay(part[i+1:])
+		if err != nil {
+			return err
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseDay(s string) (time.Weekday, error) {
+	ls := strings.ToLower(s)
+	for i, name := range dayNames {
+		if ls == name {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q", s)
+}
+
+// parseClock parses "HH:MM" as minutes after midnight.
+func parseClock(s string) (int, error) {
+	i := strings.IndexByte(s, ':')
+	if i == -1 || len(s)-i != 3 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(s[:i])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	m, err := strconv.Atoi(s[i+1:])
+	if err != nil || m < 0 || m > 59 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// String returns the window in the form that ParseWindow accepts.
+func (w Window) String() string {
+	var days []string
+	all := true
+	for d := 0; d < 7; d++ {
+		if !w.Days[d] {
+			all = false
+			continue
+		}
+		// Start a new range unless the previous day is in one.
+		if d > 0 && w.Days[d-1] {
+			continue
+		}
+		last := d
+		for last+1 < 7 && w.Days[last+1] {
+			last++
+		}
+		first := strings.Title(dayNames[d])
+		if last == d {
+			days = append(days, first)
+		} else {
+			days = append(days, first+"-"+strings.Title(dayNames[last]))
+		}
+	}
+	times := fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+	if all {
+		return times
+	}
+	return strings.Join(days, ",") + " " + times
+}
+
+// contains reports whether the window includes the wall clock time
+// of t in t's location.
+func (w Window) contains(t time.Time) bool {
+	min := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.Start < w.End {
+		return w.Days[day] && w.Start <= min && min < w.End
+	}
+	yesterday := (day + 6) % 7
+	return w.Days[day] && min >= w.Start || w.Days[yesterday] && min < w.End
+}
+
+// Windows is a list of windows.  It implements flag.Value so that
+// windows can be given as repeated flags.
+type Windows []Window
+
+// String returns the windows separated by commas.
+func (ws *Windows) String() string {
+	if ws == nil {
+		return ""
+	}
+	parts := make([]string, len(*ws))
+	for i, w := range *ws {
+		parts[i] = w.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Set parses a window and appends it to the list.
+func (ws *Windows) Set(s string) error {
+	w, err := ParseWindow(s)
+	if err != nil {
+		return err
+	}
+	*ws = append(*ws, w)
+	return nil
+}
+
+// A Blackout is a range of dates when runs aren't allowed, even
+// during a window.
+type Blackout struct {
+	// First and Last are the first and last days of the blackout,
+	// inclusive.  Only their dates are used.
+	First, Last time.Time
+}
+
+const dateLayout = "2006-01-02"
+
+// ParseBlackout parses a blackout of the form "YYYY-MM-DD" or
+// "YYYY-MM-DD..YYYY-MM-DD".
+func ParseBlackout(s string) (Blackout, error) {
+	first, last := s, s
+	if i := strings.Index(s, ".."); i != -1 {
+		first, last = s[:i], s[i+2:]
+	}
+	var b Blackout
+	var err error
+	if b.First, err = time.Parse(dateLayout, first); err != nil {
+		return Blackout{}, fmt.Errorf("parse blackout %q: invalid date %q", s, first)
+	}
+	if b.Last, err = time.Parse(dateLayout, last); err != nil {
+		return Blackout{}, fmt.Errorf("parse blackout %q: invalid date %q", s, last)
+	}
+	if b.Last.Before(b.First) {
+		return Blackout{}, fmt.Errorf("parse blackout %q: ends before it starts", s)
+	}
+	return b, nil
+}
+
+// String returns the blackout in the form that ParseBlackout accepts.
+func (b Blackout) String() string {
+	first, last := b.First.Format(dateLayout), b.Last.Format(dateLayout)
+	if first == last {
+		return first
+	}
+	return first + ".." + last
+}
+
+// contains reports whether the date of t in t's location is in the
+// blackout.
+func (b Blackout) contains(t time.Time) bool {
+	y, m, d := t.Date()
+	date := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	fy, fm, fd := b.First.Date()
+	ly, lm, ld := b.Last.Date()
+	return !date.Before(time.Date(fy, fm, fd, 0, 0, 0, 0, time.UTC)) &&
+		!date.After(time.Date(ly, lm, ld, 0, 0, 0, 0, time.UTC))
+}
+
+// Blackouts is a list of blackouts.  It implements flag.Value so that
+// blackouts can be given as repeated flags.
+type Blackouts []Blackout
+
+// String returns the blackouts separated by commas.
+func (bs *Blackouts) String() string {
+	if bs == nil {
+		return ""
+	}
+	parts := make([]string, len(*bs))
+	for i, b := range *bs {
+		parts[i] = b.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses a blackout and appends it to the list.
+func (bs *Blackouts) Set(s string) error {
+	b, err := ParseBlackout(s)
+	if err != nil {
+		return err
+	}
+	*bs = append(*bs, b)
+	return nil
+}
+
+// Schedule decides when runs are allowed.  A run is allowed when it
+// is during one of the windows (or any time if there are no windows),
+// unless it falls on a blackout date.
+type Schedule struct {
+	Windows   Windows
+	Blackouts Blackouts
+
+	// Location is the time zone that windows and blackouts are in.
+	// If nil, then the local time zone is used.
+	Location *time.Location
+}
+
+// maxSearch is how far ahead Next looks for an open window.
+const maxSearch = 2 * 366 * 24 * time.Hour
+
+// IsZero reports whether the schedule allows runs at any time.
+func (s *Schedule) IsZero() bool {
+	return s == nil || len(s.Windows) == 0 && len(s.Blackouts) == 0
+}
+
+// Open reports whether a run is allowed at t.  A nil schedule is
+// always open.
+func (s *Schedule) Open(t time.Time) bool {
+	if s.IsZero() {
+		return true
+	}
+	t = t.In(s.location())
+	for _, b := range s.Blackouts {
+		if b.contains(t) {
+			return false
+		}
+	}
+	if len(s.Windows) == 0 {
+		return true
+	}
+	for _, w := range s.Windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the earliest time at or after t that a run is allowed,
+// or the zero time if the schedule won't open within two years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := s.location()
+	t = t.In(loc)
+	end := t.Add(maxSearch)
+	for !t.After(end) {
+		if s.Open(t) {
+			return t
+		}
+		t = s.nextBoundary(t)
+	}
+	return time.Time{}
+}
+
+// nextBoundary returns the earliest time after t that the schedule
+// could open: either the next midnight or the start of a window.
+func (s *Schedule) nextBoundary(t time.Time) time.Time {
+	loc := s.location()
+	y, m, d := t.Date()
+	next := time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+	for _, w := range s.Windows {
+		start := time.Date(y, m, d, 0, w.Start, 0, 0, loc)
+		if start.After(t) && start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+func (s *Schedule) location() *time.Location {
+	if s == nil || s.Location == nil {
+		return time.Local
+	}
+	return s.Location
+}
+
+// Check returns a *ClosedError if a run isn't allowed at t.
+func (s *Schedule) Check(t time.Time) error {
+	if s.Open(t) {
+		return nil
+	}
+	e := &ClosedError{Next: s.Next(t)}
+	tl := t.In(s.location())
+	for _, b := range s.Blackouts {
+		if b.contains(tl) {
+			e.Blackout = true
+			break
+		}
+	}
+	return e
+}
+
+// ClosedError is returned by Schedule.Check when a run isn't allowed.
+type ClosedError struct {
+	// Blackout is true if the run was refused because of a blackout
+	// date, as opposed to being outside the windows.
+	Blackout bool
+
+	// Next is the time the schedule next opens, or zero if it won't
+	// open within two years.
+	Next time.Time
+}
+
+func (e *ClosedError) Error() string {
+	reason := "outside maintenance windows"
+	if e.Blackout {
+		reason = "during blackout"
+	}
+	if e.Next.IsZero() {
+		return reason + "; no upcoming window"
+	}
+	return reason + "; next window opens at " + e.Next.Format(time.RFC3339)
+}
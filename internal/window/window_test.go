@@ -0,0 +1,156 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package window
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"02:00-05:00", "02:00-05:00"},
+		{"Mon-Fri 02:00-05:00", "Mon-Fri 02:00-05:00"},
+		{"sat,sun 22:00-24:00", "Sun,Sat 22:00-24:00"},
+		{"Mon,Wed-Thu 23:30-01:00", "Mon,Wed-Thu 23:30-01:00"},
+		{"Sat-Mon 00:00-06:00", "Sun-Mon,Sat 00:00-06:00"},
+	}
+	for _, test := range tests {
+		w, err := ParseWindow(test.s)
+		if err != nil {
+			t.Errorf("ParseWindow(%q): %v", test.s, err)
+			continue
+		}
+		if got := w.String(); got != test.want {
+			t.Errorf("ParseWindow(%q).String() = %q; want %q", test.s, got, test.want)
+		}
+	}
+	for _, s := range []string{"", "02:00", "Mon", "Mon 02:00-02:00", "Funday 02:00-03:00", "25:00-26:00", "24:00-01:00", "02:60-03:00", "2:0-3:00", "Mon Tue 01:00-02:00"} {
+		if _, err := ParseWindow(s); err == nil {
+			t.Errorf("ParseWindow(%q) did not return an error", s)
+		}
+	}
+}
+
+func TestParseBlackout(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"2017-12-25", "2017-12-25"},
+		{"2017-12-20..2018-01-02", "2017-12-20..2018-01-02"},
+	}
+	for _, test := range tests {
+		b, err := ParseBlackout(test.s)
+		if err != nil {
+			t.Errorf("ParseBlackout(%q): %v", test.s, err)
+			continue
+		}
+		if got := b.String(); got != test.want {
+			t.Errorf("ParseBlackout(%q).String() = %q; want %q", test.s, got, test.want)
+		}
+	}
+	for _, s := range []string{"", "tomorrow", "2017-12-25..", "2018-01-02..2017-12-20"} {
+		if _, err := ParseBlackout(s); err == nil {
+			t.Errorf("ParseBlackout(%q) did not return an error", s)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone database not available:", err)
+	}
+	s := &Schedule{Location: loc}
+	for _, w := range []string{"Mon-Fri 02:00-05:00", "Sat 22:00-02:00"} {
+		if err := s.Windows.Set(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Blackouts.Set("2017-07-03..2017-07-04"); err != nil {
+		t.Fatal(err)
+	}
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2017, month, day, hour, min, 0, 0, loc)
+	}
+	tests := []struct {
+		t        time.Time
+		open     bool
+		blackout bool
+		next     time.Time
+	}{
+		// Thursday.
+		{t: at(time.June, 1, 1, 59), next: at(time.June, 1, 2, 0)},
+		{t: at(time.June, 1, 2, 0), open: true},
+		{t: at(time.June, 1, 4, 59), open: true},
+		{t: at(time.June, 1, 5, 0), next: at(time.June, 2, 2, 0)},
+		// Friday evening to Saturday's window.
+		{t: at(time.June, 2, 12, 0), next: at(time.June, 3, 22, 0)},
+		// Saturday's window continues into Sunday.
+		{t: at(time.June, 4, 1, 30), open: true},
+		{t: at(time.June, 4, 2, 0), next: at(time.June, 5, 2, 0)},
+		// Blackout on Monday and Tuesday.
+		{t: at(time.July, 3, 3, 0), blackout: true, next: at(time.July, 5, 2, 0)},
+		// The same instant in another time zone.
+		{t: at(time.June, 1, 3, 0).UTC(), open: true},
+	}
+	for _, test := range tests {
+		if got := s.Open(test.t); got != test.open {
+			t.Errorf("Open(%v) = %t; want %t", test.t, got, test.open)
+		}
+		err := s.Check(test.t)
+		if test.open {
+			if err != nil {
+				t.Errorf("Check(%v) = %v; want nil", test.t, err)
+			}
+			continue
+		}
+		ce, ok := err.(*ClosedError)
+		if !ok {
+			t.Errorf("Check(%v) = %v; want *ClosedError", test.t, err)
+			continue
+		}
+		if ce.Blackout != test.blackout {
+			t.Errorf("Check(%v).Blackout = %t; want %t", test.t, ce.Blackout, test.blackout)
+		}
+		if !ce.Next.Equal(test.next) {
+			t.Errorf("Check(%v).Next = %v; want %v", test.t, ce.Next, test.next)
+		}
+	}
+}
+
+func TestScheduleZero(t *testing.T) {
+	var s *Schedule
+	now := time.Now()
+	if !s.Open(now) {
+		t.Error("nil Schedule is not open")
+	}
+	if err := s.Check(now); err != nil {
+		t.Errorf("nil Schedule Check = %v", err)
+	}
+	s = &Schedule{}
+	if err := s.Blackouts.Set("2017-01-01..2019-12-31"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2017, time.June, 1, 0, 0, 0, 0, time.UTC)
+	s.Location = time.UTC
+	if next := s.Next(start); !next.IsZero() {
+		t.Errorf("Next(%v) = %v; want zero", start, next)
+	}
+}
@@ -39,6 +39,19 @@ namespace {
   const char* stateRefRegistryKey = "mcm::Lua";
   const uint64_t fileResId = 0x8dc4ac52b2962163;
   const uint64_t execResId = 0x984c97311006f1ca;
+  const uint64_t healthCheckResId = 0xec877fa48df679d9;
+  const uint64_t registryKeyResId = 0x8182522bd2b158ba;
+  const uint64_t registryValueResId = 0x92530dae0055c78a;
+  const uint64_t serviceResId = 0xf93ae334f1d950d8;
+  const uint64_t launchdJobResId = 0xa9a6d51ee3db11da;
+  const uint64_t userDefaultResId = 0xa763660b2dd959a5;
+  const uint64_t packageRepoResId = 0xcb09e494d19f9b39;
+  const uint64_t alternativeResId = 0x8cc81a81ece1e9b3;
+  const uint64_t rebootResId = 0x82b7e5081b288e99;
+  const uint64_t assertResId = 0x9e4348d501da1ab0;
+  const uint64_t fileGroupResId = 0xe0067784c74dc344;
+  const uint64_t variantResId = 0xd77f61bc0c2573b8;
+  const uint64_t barrierResId = 1;  // Like noop's 0, not a struct type ID.
 
   LibState& getStateRef(lua_State* state) {
     int ty = lua_getfield(state, LUA_REGISTRYINDEX, stateRefRegistryKey);
@@ -48,11 +61,24 @@ namespace {
     return *ptr;
   }
 
+  kj::String hashInput(kj::StringPtr ns, kj::StringPtr name) {
+    // The namespace is separated from the name by a NUL byte, which
+    // can't appear in either.  The default namespace is empty and
+    // hashes the name alone, so IDs are the same as before namespaces.
+    if (ns.size() == 0) {
+      return kj::heapString(name);
+    }
+    return kj::str(ns, '\0', name);
+  }
+
   uint64_t idHash(kj::StringPtr s) {
+    // Documented in README.md: the first 8 bytes of
+    // SHA-1(idHashPrefix + s) as a little-endian integer with the low
+    // bit set.
     SHA_CTX ctx;
     SHA1_Init(&ctx);
     SHA1_Update(&ctx, idHashPrefix, strlen(idHashPrefix));
-    SHA1_Update(&ctx, s.cStr(), s.size());
+    SHA1_Update(&ctx, s.begin(), s.size());
     uint8_t hash[SHA_DIGEST_LENGTH];
     SHA1_Final(hash, &ctx);
     return 1 | hash[0] |
@@ -65,13 +91,41 @@ namespace {
         (((uint64_t)hash[7]) << 56);
   }
 
+  int checkedHash(lua_State* state, kj::StringPtr ns, kj::StringPtr name, kj::StringPtr comment, uint64_t* id) {
+    // Computes the ID for name in ns, raising a Lua error on a collision.
+    if (name.findFirst('\0') != nullptr || ns.findFirst('\0') != nullptr) {
+      return luaL_error(state, "ID names may not contain NUL bytes");
+    }
+    auto input = hashInput(ns, name);
+    *id = idHash(input);
+    KJ_IF_MAYBE(other, getStateRef(state).recordHash(*id, input, comment)) {
+      auto msg = kj::str("ID collision: \"", *other, "\" and \"", comment, "\" both hash to ", *id);
+      return luaL_error(state, "%s", msg.cStr());
+    }
+    return 0;
+  }
+
   int hashfunc(lua_State* state) {
-    if (lua_gettop(state) != 1) {
-      return luaL_error(state, "'mcm.hash' takes 1 argument, got %d", lua_gettop(state));
+    int nargs = lua_gettop(state);
+    if (nargs != 1 && nargs != 2) {
+      return luaL_error(state, "'mcm.hash' takes 1 or 2 arguments, got %d", nargs);
     }
     luaL_argcheck(state, lua_isstring(state, 1), 1, "must be a string");
-    auto comment = luaStringPtr(state, 1);
-    pushId(state, kj::heap<Id>(idHash(comment), comment));
+    kj::StringPtr ns;
+    kj::StringPtr name;
+    kj::String comment;
+    if (nargs == 2) {
+      luaL_argcheck(state, lua_isstring(state, 2), 2, "must be a string");
+      ns = luaStringPtr(state, 1);
+      name = luaStringPtr(state, 2);
+      comment = kj::str(ns, "/", name);
+    } else {
+      name = luaStringPtr(state, 1);
+      comment = kj::heapString(name);
+    }
+    uint64_t id;
+    checkedHash(state, ns, name, comment, &id);
+    pushId(state, kj::heap<Id>(id, comment));
     return 1;
   }
 
@@ -116,6 +170,146 @@ namespace {
     return 1;  // Return original argument
   }
 
+  int healthcheckfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.healthCheck' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, healthCheckResId);
+    return 1;  // Return original argument
+  }
+
+  int registrykeyfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.registryKey' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, registryKeyResId);
+    return 1;  // Return original argument
+  }
+
+  int registryvaluefunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.registryValue' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, registryValueResId);
+    return 1;  // Return original argument
+  }
+
+  int servicefunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.service' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, serviceResId);
+    return 1;  // Return original argument
+  }
+
+  int launchdjobfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.launchdJob' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, launchdJobResId);
+    return 1;  // Return original argument
+  }
+
+  int userdefaultfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.userDefault' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, userDefaultResId);
+    return 1;  // Return original argument
+  }
+
+  int packagerepofunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.packageRepo' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, packageRepoResId);
+    return 1;  // Return original argument
+  }
+
+  int alternativefunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.alternative' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, alternativeResId);
+    return 1;  // Return original argument
+  }
+
+  int rebootfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.reboot' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, rebootResId);
+    return 1;  // Return original argument
+  }
+
+  int assertfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.assert' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, assertResId);
+    return 1;  // Return original argument
+  }
+
+  int preconditionfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.precondition' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    auto p = getStateRef(state).newPrecondition();
+    auto maybeExc = kj::runCatchingExceptions([state, &p]() {
+      copyStruct(state, p);
+    });
+    KJ_IF_MAYBE(e, maybeExc) {
+      pushLua(state, *e);
+      return lua_error(state);
+    }
+    return 0;
+  }
+
+  int defaultsfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.defaults' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    auto d = getStateRef(state).initDefaults();
+    auto maybeExc = kj::runCatchingExceptions([state, &d]() {
+      copyStruct(state, d);
+    });
+    KJ_IF_MAYBE(e, maybeExc) {
+      pushLua(state, *e);
+      return lua_error(state);
+    }
+    return 0;
+  }
+
+  int filegroupfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.fileGroup' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, fileGroupResId);
+    return 1;  // Return original argument
+  }
+
+  int variantfunc(lua_State* state) {
+    if (lua_gettop(state) != 1) {
+      return luaL_error(state, "'mcm.variant' takes 1 argument, got %d", lua_gettop(state));
+    }
+    luaL_argcheck(state, lua_istable(state, 1), 1, "must be a table");
+    setResourceType(state, 1, variantResId);
+    return 1;  // Return original argument
+  }
+
   int resourcefunc(lua_State* state) {
     if (lua_gettop(state) != 3) {
       return luaL_error(state, "'mcm.resource' takes 3 arguments, got %d", lua_gettop(state));
@@ -136,17 +330,24 @@ namespace {
     lua_pop(state, 1);
 
     auto& libState = getStateRef(state);
-    auto res = libState.newResource();
+    uint64_t resId;
+    kj::StringPtr name;
     KJ_IF_MAYBE(id, getId(state, 1)) {
-      res.setId(id->getValue());
-      res.setComment(id->getComment());
+      resId = id->getValue();
+      name = id->getComment();
     } else if (lua_isstring(state, 1)) {
-      auto comment = luaStringPtr(state, 1);
-      res.setId(idHash(comment));
-      res.setComment(comment);
+      name = luaStringPtr(state, 1);
+      checkedHash(state, nullptr, name, name, &resId);
     } else {
       return luaL_argerror(state, 1, "expect mcm.hash or string");
     }
+    if (!libState.declare(resId)) {
+      return luaL_error(state, "resource \"%s\" defined more than once", name.cStr());
+    }
+    auto res = libState.newResource();
+    res.setId(resId);
+    res.setName(name);
+    res.setComment(name);
     lua_len(state, 2);
     lua_Integer ndeps = lua_tointeger(state, -1);
     lua_pop(state, 1);
@@ -158,7 +359,10 @@ namespace {
         KJ_IF_MAYBE(id, getId(state, -1)) {
           depList.set(i-1, id->getValue());
         } else if (lua_isstring(state, -1)) {
-          depList.set(i-1, idHash(luaStringPtr(state, -1)));
+          auto name = luaStringPtr(state, -1);
+          uint64_t id;
+          checkedHash(state, nullptr, name, name, &id);
+          depList.set(i-1, id);
         } else {
           return luaL_argerror(state, 2, "expect deps to contain only mcm.hash or strings");
         }
@@ -170,6 +374,9 @@ namespace {
     case 0:
       res.setNoop();
       break;
+    case barrierResId:
+      res.setBarrier();
+      break;
     case fileResId:
       {
         auto f = res.initFile();
@@ -194,6 +401,150 @@ namespace {
         }
       }
       break;
+    case healthCheckResId:
+      {
+        auto hc = res.initHealthCheck();
+        auto maybeExc = kj::runCatchingExceptions([state, &hc]() {
+          copyStruct(state, hc);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case registryKeyResId:
+      {
+        auto k = res.initRegistryKey();
+        auto maybeExc = kj::runCatchingExceptions([state, &k]() {
+          copyStruct(state, k);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case registryValueResId:
+      {
+        auto v = res.initRegistryValue();
+        auto maybeExc = kj::runCatchingExceptions([state, &v]() {
+          copyStruct(state, v);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case serviceResId:
+      {
+        auto svc = res.initService();
+        auto maybeExc = kj::runCatchingExceptions([state, &svc]() {
+          copyStruct(state, svc);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case launchdJobResId:
+      {
+        auto l = res.initLaunchdJob();
+        auto maybeExc = kj::runCatchingExceptions([state, &l]() {
+          copyStruct(state, l);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case userDefaultResId:
+      {
+        auto d = res.initUserDefault();
+        auto maybeExc = kj::runCatchingExceptions([state, &d]() {
+          copyStruct(state, d);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case alternativeResId:
+      {
+        auto a = res.initAlternative();
+        auto maybeExc = kj::runCatchingExceptions([state, &a]() {
+          copyStruct(state, a);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case rebootResId:
+      {
+        auto rb = res.initReboot();
+        auto maybeExc = kj::runCatchingExceptions([state, &rb]() {
+          copyStruct(state, rb);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case assertResId:
+      {
+        auto a = res.initAssert();
+        auto maybeExc = kj::runCatchingExceptions([state, &a]() {
+          copyStruct(state, a);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case fileGroupResId:
+      {
+        auto g = res.initFileGroup();
+        auto maybeExc = kj::runCatchingExceptions([state, &g]() {
+          copyStruct(state, g);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case variantResId:
+      {
+        auto v = res.initVariant();
+        auto maybeExc = kj::runCatchingExceptions([state, &v]() {
+          copyStruct(state, v);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
+    case packageRepoResId:
+      {
+        auto p = res.initPackageRepo();
+        auto maybeExc = kj::runCatchingExceptions([state, &p]() {
+          copyStruct(state, p);
+        });
+        KJ_IF_MAYBE(e, maybeExc) {
+          pushLua(state, *e);
+          return lua_error(state);
+        }
+      }
+      break;
     default:
       return luaL_argerror(state, 3, "unknown resource type");
     }
@@ -201,10 +552,24 @@ namespace {
   }
 
   const luaL_Reg mcmlib[] = {
+    {"alternative", alternativefunc},
+    {"defaults", defaultsfunc},
     {"exec", execfunc},
     {"file", filefunc},
+    {"fileGroup", filegroupfunc},
     {"hash", hashfunc},
+    {"assert", assertfunc},
+    {"healthCheck", healthcheckfunc},
+    {"launchdJob", launchdjobfunc},
+    {"packageRepo", packagerepofunc},
+    {"precondition", preconditionfunc},
+    {"reboot", rebootfunc},
+    {"registryKey", registrykeyfunc},
+    {"registryValue", registryvaluefunc},
     {"resource", resourcefunc},
+    {"service", servicefunc},
+    {"userDefault", userdefaultfunc},
+    {"variant", variantfunc},
     {NULL, NULL},
   };
 
@@ -217,6 +582,13 @@ namespace {
     lua_setfield(state, -2, resourceTypeMetaKey);  // metatable[resourceTypeMetaKey] = TOP
     lua_setmetatable(state, -2);  // pop metatable
     lua_setfield(state, -2, "noop");  // mcm.noop = TOP
+
+    lua_newtable(state);
+    lua_createtable(state, 0, 1);  // new metatable
+    pushResourceType(state, barrierResId);
+    lua_setfield(state, -2, resourceTypeMetaKey);  // metatable[resourceTypeMetaKey] = TOP
+    lua_setmetatable(state, -2);  // pop metatable
+    lua_setfield(state, -2, "barrier");  // mcm.barrier = TOP
     return 1;
   }
 }  // namespace
@@ -228,6 +600,36 @@ Resource::Builder LibState::newResource() {
   return builder;
 }
 
+Precondition::Builder LibState::newPrecondition() {
+  auto orphan = scratch.getOrphanage().newOrphan<Precondition>();
+  auto builder = orphan.get();
+  preconditions.add(kj::mv(orphan));
+  return builder;
+}
+
+Defaults::Builder LibState::initDefaults() {
+  auto orphan = scratch.getOrphanage().newOrphan<Defaults>();
+  auto builder = orphan.get();
+  defaults = kj::mv(orphan);
+  return builder;
+}
+
+bool LibState::declare(uint64_t id) {
+  return declared.insert(id).second;
+}
+
+kj::Maybe<kj::StringPtr> LibState::recordHash(uint64_t id, kj::StringPtr input, kj::StringPtr comment) {
+  auto iter = hashes.find(id);
+  if (iter == hashes.end()) {
+    hashes.insert(std::make_pair(id, HashedName{kj::heapString(input), kj::heapString(comment)}));
+    return nullptr;
+  }
+  if (iter->second.input == input) {
+    return nullptr;
+  }
+  return iter->second.comment.asPtr();
+}
+
 void openlib(lua_State *state, LibState& lib) {
   lua_pushlightuserdata(state, &lib);
   lua_setfield(state, LUA_REGISTRYINDEX, stateRefRegistryKey);
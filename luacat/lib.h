@@ -16,7 +16,10 @@
 #define MCM_LUACAT_LIB_H_
 // mcm Lua module.
 
+#include <map>
+#include <set>
 #include "kj/common.h"
+#include "kj/string.h"
 #include "kj/vector.h"
 #include "capnp/message.h"
 
@@ -38,9 +41,34 @@ public:
 
   Resource::Builder newResource();
   inline kj::ArrayPtr<capnp::Orphan<Resource>> getResources() { return resources.asPtr(); }
+
+  Precondition::Builder newPrecondition();
+  inline kj::ArrayPtr<capnp::Orphan<Precondition>> getPreconditions() { return preconditions.asPtr(); }
+
+  Defaults::Builder initDefaults();
+  // Replaces the catalog's defaults with an empty struct.
+  inline kj::Maybe<capnp::Orphan<Defaults>>& getDefaults() { return defaults; }
+
+  bool declare(uint64_t id);
+  // Notes that a resource with the given ID was created, returning
+  // false if one already was.
+
+  kj::Maybe<kj::StringPtr> recordHash(uint64_t id, kj::StringPtr input, kj::StringPtr comment);
+  // Notes that id was derived from the hash input.  If a different
+  // input previously hashed to the same ID, then the comment of the
+  // earlier input is returned.
 private:
   capnp::MallocMessageBuilder scratch;
   kj::Vector<capnp::Orphan<Resource>> resources;
+  kj::Vector<capnp::Orphan<Precondition>> preconditions;
+  kj::Maybe<capnp::Orphan<Defaults>> defaults;
+
+  struct HashedName {
+    kj::String input;
+    kj::String comment;
+  };
+  std::map<uint64_t, HashedName> hashes;
+  std::set<uint64_t> declared;
 };
 
 void openlib(lua_State* state, LibState& lib);
@@ -16,6 +16,7 @@
 
 #include <unistd.h>
 #include <fcntl.h>
+#include <time.h>
 #include "kj/debug.h"
 #include "kj/exception.h"
 #include "capnp/serialize.h"
@@ -131,6 +132,21 @@ kj::MainBuilder::Validity Main::setOutputPath(kj::StringPtr outPath) {
   return true;
 }
 
+kj::MainBuilder::Validity Main::setSourceRepo(kj::StringPtr repo) {
+  sourceRepo = kj::heapString(repo);
+  return true;
+}
+
+kj::MainBuilder::Validity Main::setSourceCommit(kj::StringPtr commit) {
+  sourceCommit = kj::heapString(commit);
+  return true;
+}
+
+kj::MainBuilder::Validity Main::setAuthor(kj::StringPtr name) {
+  author = kj::heapString(name);
+  return true;
+}
+
 kj::MainBuilder::Validity Main::processFile(kj::StringPtr src) {
   if (src.size() == 0) {
     return kj::str("empty source");
@@ -149,6 +165,7 @@ kj::MainBuilder::Validity Main::processFile(kj::StringPtr src) {
     kj::FdInputStream stream(kj::mv(afd));
     capnp::MallocMessageBuilder message;
     process(message, chunkName, stream);
+    setMetadata(message.getRoot<Catalog>().initMetadata());
     capnp::writeMessage(*outStream, message);
   });
   KJ_IF_MAYBE(e, maybeExc) {
@@ -202,6 +219,33 @@ void Main::process(capnp::MessageBuilder& message, kj::StringPtr chunkName, kj::
   for (size_t i = 0; i < resources.size(); i++) {
     rlist.setWithCaveats(i, resources[i].get());
   }
+  auto preconditions = libState.getPreconditions();
+  if (preconditions.size() > 0) {
+    auto plist = catalog.initPreconditions(preconditions.size());
+    for (size_t i = 0; i < preconditions.size(); i++) {
+      plist.setWithCaveats(i, preconditions[i].get());
+    }
+  }
+  KJ_IF_MAYBE(d, libState.getDefaults()) {
+    catalog.setDefaults(d->getReader());
+  }
+}
+
+void Main::setMetadata(Metadata::Builder metadata) {
+  metadata.setGenerator("mcm-luacat");
+  if (versionInfo.size() > 0) {
+    metadata.setGeneratorVersion(versionInfo.cStr());
+  }
+  if (sourceRepo.size() > 0) {
+    metadata.setSourceRepo(sourceRepo.cStr());
+  }
+  if (sourceCommit.size() > 0) {
+    metadata.setSourceCommit(sourceCommit.cStr());
+  }
+  metadata.setBuildTime(time(nullptr));
+  if (author.size() > 0) {
+    metadata.setAuthor(author.cStr());
+  }
 }
 
 kj::String Main::buildIncludePath(kj::StringPtr chunkName) {
@@ -232,6 +276,12 @@ kj::MainFunc Main::getMain() {
           "<templates>", "Add a package path template in package.searchpath format.")
       .addOptionWithArg({'o'}, KJ_BIND_METHOD(*this, setOutputPath),
           "FILE", "Write output to FILE instead of stdout.")
+      .addOptionWithArg({"source-repo"}, KJ_BIND_METHOD(*this, setSourceRepo),
+          "URL", "Record URL as the repository that the catalog is built from.")
+      .addOptionWithArg({"source-commit"}, KJ_BIND_METHOD(*this, setSourceCommit),
+          "REV", "Record REV as the commit that the catalog is built from.")
+      .addOptionWithArg({"author"}, KJ_BIND_METHOD(*this, setAuthor),
+          "NAME", "Record NAME as the catalog's author.")
       .expectArg("FILE", KJ_BIND_METHOD(*this, processFile))
       .build();
 }
@@ -22,6 +22,8 @@
 #include "kj/string-tree.h"
 #include "capnp/message.h"
 
+#include "catalog.capnp.h"
+
 extern "C" {
 #include "lua.h"
 }
@@ -46,6 +48,11 @@ public:
   kj::MainBuilder::Validity setOutputPath(kj::StringPtr outPath);
   // Open the file at the given path as the new output stream.
 
+  kj::MainBuilder::Validity setSourceRepo(kj::StringPtr repo);
+  kj::MainBuilder::Validity setSourceCommit(kj::StringPtr commit);
+  kj::MainBuilder::Validity setAuthor(kj::StringPtr name);
+  // Set the catalog's provenance metadata.
+
   kj::MainBuilder::Validity processFile(kj::StringPtr src);
 
   void process(capnp::MessageBuilder& out, kj::StringPtr chunkName, kj::InputStream& stream);
@@ -55,6 +62,7 @@ public:
 
 private:
   kj::String buildIncludePath(kj::StringPtr chunkName);
+  void setMetadata(Metadata::Builder metadata);
 
   kj::ProcessContext& context;
   kj::String versionInfo;
@@ -64,6 +72,10 @@ private:
 
   kj::StringTree includes;
   kj::String fallbackInclude;
+
+  kj::String sourceRepo;
+  kj::String sourceCommit;
+  kj::String author;
 };
 
 class OwnState {
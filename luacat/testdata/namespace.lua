@@ -0,0 +1,2 @@
+-- Resources in a namespace are named "namespace/name" in comments.
+mcm.resource(mcm.hash("web", "nginx"), {}, mcm.noop)
@@ -0,0 +1,176 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// completeCommand is the hidden subcommand that the completion scripts
+// call.  Its arguments are the words on the command line after "mcm",
+// up to and including the word being completed, and it prints the
+// candidates for that word one per line.  If it prints nothing, the
+// scripts fall back to completing file names.
+const completeCommand = "__complete"
+
+// complete returns the completion candidates for the last of words.
+func complete(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	partial := words[len(words)-1]
+	prev := words[:len(words)-1]
+
+	// Skip mcm's own flags to find the subcommand.
+	i := 0
+	for i < len(prev) && strings.HasPrefix(prev[i], "-") {
+		if isValueFlag(prev[i]) {
+			i++
+		}
+		i++
+	}
+	if i >= len(prev) {
+		if strings.HasPrefix(partial, "-") {
+			return filterPrefix([]string{"-libexec", "-version"}, partial)
+		}
+		return filterPrefix(commandNames(), partial)
+	}
+	sub, args := prev[i], prev[i+1:]
+	switch sub {
+	case "help":
+		if len(args) == 0 {
+			return filterPrefix(commandNames(), partial)
+		}
+		return nil
+	case "completion":
+		if len(args) == 0 {
+			return filterPrefix([]string{"bash", "fish", "zsh"}, partial)
+		}
+		return nil
+	case "commands", completeCommand:
+		return nil
+	}
+	if strings.HasPrefix(partial, "-") {
+		return filterPrefix(programFlags(sub), partial)
+	}
+	return nil
+}
+
+// isValueFlag reports whether arg is one of mcm's flags that takes its
+// value from the next argument.
+func isValueFlag(arg string) bool {
+	name := strings.TrimLeft(arg, "-")
+	return name == "libexec"
+}
+
+// commandNames returns the builtin, known, and installed commands,
+// sorted.
+func commandNames() []string {
+	seen := make(map[string]bool)
+	for name := range builtins {
+		seen[name] = true
+	}
+	for name := range commands {
+		seen[name] = true
+	}
+	for _, name := range installedCommands() {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// programFlags returns the flags of the program for the command name,
+// as listed in its -help output.
+func programFlags(name string) []string {
+	path, err := findProgram(name)
+	if err != nil {
+		return nil
+	}
+	var out bytes.Buffer
+	cmd := exec.Command(path, "-help")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Run() // -help exits with a non-zero status.
+	var flags []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		// The flag package lists each flag as "  -name" or
+		// "  -name value", followed by an indented usage line.
+		if !strings.HasPrefix(line, "  -") {
+			continue
+		}
+		f := strings.Fields(line)[0]
+		if f != "-" && f != "--" {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// filterPrefix returns the elements of list that start with prefix.
+func filterPrefix(list []string, prefix string) []string {
+	var out []string
+	for _, s := range list {
+		if strings.HasPrefix(s, prefix) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// completionScripts maps a shell's name to a script that, when
+// evaluated by the shell, completes mcm command lines.
+var completionScripts = map[string]string{
+	"bash": `# mcm completion for bash.
+# Add to ~/.bashrc:  eval "$(mcm completion bash)"
+_mcm() {
+	local IFS=$'\n'
+	COMPREPLY=($(mcm __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _mcm mcm
+`,
+
+	"zsh": `#compdef mcm
+# mcm completion for zsh.
+# Add to ~/.zshrc:  eval "$(mcm completion zsh)"
+_mcm() {
+	local -a candidates
+	candidates=(${(@f)"$(mcm __complete "${(@)words[2,CURRENT]}" 2>/dev/null)"})
+	if (( ${#candidates} )); then
+		compadd -a candidates
+	else
+		_files
+	fi
+}
+compdef _mcm mcm
+`,
+
+	"fish": `# mcm completion for fish.
+# Add to ~/.config/fish/config.fish:  mcm completion fish | source
+function __mcm_complete
+	set -l words (commandline -opc)
+	set -e words[1]
+	mcm __complete $words (commandline -ct) 2>/dev/null
+end
+complete -c mcm -a '(__mcm_complete)'
+`,
+}
@@ -0,0 +1,254 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mcm runs the mcm tools as subcommands of a single command, so that
+// "mcm exec" runs mcm-exec, and generates shell completion for them.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/zombiezen/mcm/internal/version"
+)
+
+// commands describes the tools that are part of mcm, by subcommand
+// name.  Other mcm-NAME programs in the search path also run as
+// subcommands, but aren't listed by help.
+var commands = map[string]string{
+	"agent":     "periodically fetch and apply a catalog from a server",
+	"bisect":    "narrow a failing catalog down to the resources that fail",
+	"cloudinit": "convert a catalog to a cloud-init configuration",
+	"dot":       "print a catalog's dependency graph in Graphviz format",
+	"encrypt":   "encrypt and sign a catalog",
+	"exec":      "apply a catalog to the local host",
+	"luacat":    "build a catalog from a Lua script",
+	"merge":     "combine catalogs into one",
+	"prune":     "remove the resources that a set of targets doesn't need",
+	"push":      "apply a catalog to remote hosts over SSH",
+	"server":    "serve catalogs to agents",
+	"shellify":  "convert a catalog to a shell script",
+	"validate":  "check catalogs for errors and likely mistakes",
+}
+
+// builtins are the subcommands that mcm implements itself.
+var builtins = map[string]string{
+	"help":       "show the usage of mcm or of a command",
+	"commands":   "list the commands that are installed",
+	"completion": "print a bash, zsh, or fish completion script",
+}
+
+// programPrefix is prepended to a subcommand's name to find the program
+// that implements it.
+const programPrefix = "mcm-"
+
+var libexecDir = flag.String("libexec", "", "directory to find mcm-COMMAND programs in before searching PATH (default the directory of mcm)")
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	w := os.Stderr
+	fmt.Fprintf(w, "usage: mcm [-libexec DIR] COMMAND [ARG...]\n       mcm -version\n\n")
+	fmt.Fprintln(w, "Commands:")
+	names := make([]string, 0, len(commands)+len(builtins))
+	for name := range commands {
+		names = append(names, name)
+	}
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		desc := commands[name]
+		if desc == "" {
+			desc = builtins[name]
+		}
+		fmt.Fprintf(w, "  %-11s %s\n", name, desc)
+	}
+	fmt.Fprintln(w, "\nRun \"mcm help COMMAND\" for a command's flags.\n\nFlags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	name, args := flag.Arg(0), flag.Args()[1:]
+	switch name {
+	case "help":
+		help(args)
+	case "commands":
+		for _, name := range installedCommands() {
+			fmt.Println(name)
+		}
+	case "completion":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, "usage: mcm completion bash|zsh|fish")
+			os.Exit(2)
+		}
+		script := completionScripts[args[0]]
+		if script == "" {
+			fmt.Fprintf(os.Stderr, "mcm: no completion for shell %q; want bash, zsh, or fish\n", args[0])
+			os.Exit(2)
+		}
+		io.WriteString(os.Stdout, script)
+	case completeCommand:
+		for _, c := range complete(args) {
+			fmt.Println(c)
+		}
+	default:
+		os.Exit(run(name, args))
+	}
+}
+
+// help shows the usage of mcm or of the command named in args.
+func help(args []string) {
+	switch {
+	case len(args) == 0:
+		flag.Usage()
+	case builtins[args[0]] != "":
+		fmt.Fprintf(os.Stderr, "mcm %s: %s\n", args[0], builtins[args[0]])
+	default:
+		// Tools print their usage to stderr and exit with status 0 or
+		// 2 for -help, so the status is not an error.
+		run(args[0], []string{"-help"})
+	}
+}
+
+// run runs the program for the command name with args, connected to
+// mcm's standard streams, and returns its exit status.
+func run(name string, args []string) int {
+	path, err := findProgram(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mcm: %v\nRun \"mcm help\" for a list of commands.\n", err)
+		return 2
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Args[0] = programPrefix + name
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Interrupts from the terminal go to the whole process group, so
+	// leave them to the program, which may want to clean up.
+	signal.Ignore(os.Interrupt)
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		ws, ok := exitErr.Sys().(interface {
+			ExitStatus() int
+		})
+		if !ok || ws.ExitStatus() < 0 {
+			// Killed by a signal.
+			return 1
+		}
+		return ws.ExitStatus()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mcm: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// findProgram returns the path of the program for the command name.
+func findProgram(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, "-") {
+		return "", fmt.Errorf("invalid command %q", name)
+	}
+	prog := programPrefix + name
+	for _, dir := range searchDirs() {
+		path := filepath.Join(dir, prog+exeSuffix)
+		if isExecutable(path) {
+			return path, nil
+		}
+	}
+	if path, err := exec.LookPath(prog); err == nil {
+		return path, nil
+	}
+	return "", fmt.Errorf("unknown command %q: %s not found", name, prog)
+}
+
+// searchDirs returns the directories searched for programs before PATH.
+func searchDirs() []string {
+	if *libexecDir != "" {
+		return []string{*libexecDir}
+	}
+	exe, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return nil
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+	return []string{filepath.Dir(exe)}
+}
+
+// installedCommands returns the names of the mcm-NAME programs in the
+// search directories and PATH, sorted.
+func installedCommands() []string {
+	seen := make(map[string]bool)
+	dirs := append(searchDirs(), filepath.SplitList(os.Getenv("PATH"))...)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, programPrefix+"*"))
+		for _, path := range matches {
+			name := strings.TrimPrefix(filepath.Base(path), programPrefix)
+			name = strings.TrimSuffix(name, exeSuffix)
+			if name != "" && isExecutable(path) {
+				seen[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exeSuffix is the file name extension of programs on this platform.
+var exeSuffix = func() string {
+	if runtime.GOOS == "windows" {
+		return ".exe"
+	}
+	return ""
+}()
+
+// isExecutable reports whether path is a program that can be run.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return runtime.GOOS == "windows" || info.Mode().Perm()&0111 != 0
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/merge/mergelib"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s [-o OUT] [-infer_deps] [-reduce] [NAMESPACE=]CATALOG...\n", name)
+	flag.PrintDefaults()
+}
+
+func main() {
+	outPath := flag.String("o", "", "file to write to instead of stdout")
+	inferDeps := flag.Bool("infer_deps", false, "make exec resources depend on the file resources that manage paths in their argv or working directory, and files on the directory resources above them")
+	reduce := flag.Bool("reduce", false, "remove duplicate dependencies and ones implied by other dependencies")
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	srcs := make([]mergelib.Source, 0, flag.NArg())
+	for _, arg := range flag.Args() {
+		var src mergelib.Source
+		path := arg
+		if i := strings.IndexByte(arg, '='); i != -1 {
+			src.Namespace, path = arg[:i], arg[i+1:]
+		}
+		var err error
+		src.Catalog, err = readCatalog(path)
+		if err != nil {
+			die(err)
+		}
+		srcs = append(srcs, src)
+	}
+	c, err := mergelib.Merge(srcs)
+	if err != nil {
+		die(err)
+	}
+	if *inferDeps {
+		var inferred []*catalog.InferredDependency
+		c, inferred, err = catalog.InferDependencies(c)
+		if err != nil {
+			die(err)
+		}
+		for _, d := range inferred {
+			fmt.Fprintln(os.Stderr, "mcm-merge: inferred dependency:", d)
+		}
+	}
+	if *reduce {
+		c, err = catalog.ReduceDependencies(c)
+		if err != nil {
+			die(err)
+		}
+	}
+	if err := catalog.CheckConflicts(c); err != nil {
+		fmt.Fprintln(os.Stderr, "mcm-merge: warning:", err)
+	}
+	data, err := c.Segment().Message().Marshal()
+	if err != nil {
+		die(err)
+	}
+	if *outPath == "" || *outPath == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(*outPath, data, 0666)
+	}
+	if err != nil {
+		die(err)
+	}
+}
+
+// readCatalog reads the catalog at path, or stdin if path is "-".
+func readCatalog(path string) (catalog.Catalog, error) {
+	if path != "-" {
+		// The file stays mapped until mcm-merge exits.
+		f, err := catalog.OpenFile(path)
+		if err != nil {
+			return catalog.Catalog{}, err
+		}
+		return f.Catalog, nil
+	}
+	msg, err := capnp.NewDecoder(os.Stdin).Decode()
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	return catalog.ReadRootCatalog(msg)
+}
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, "mcm-merge:", err)
+	os.Exit(1)
+}
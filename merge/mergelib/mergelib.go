@@ -0,0 +1,184 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mergelib provides the functionality of the mcm-merge tool:
+// combining several catalogs into one.
+package mergelib
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catid"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+// A Source is a catalog to merge.
+type Source struct {
+	Catalog catalog.Catalog
+
+	// Namespace is prepended to the names of the catalog's resources,
+	// so that the same catalog can be merged more than once.  If
+	// Namespace is not empty, then each resource is given a new ID
+	// derived from the namespace and its name (or old ID, if it doesn't
+	// have a name), and dependencies and ifDepsChanged conditions that
+	// refer to resources in the same catalog are rewritten to the new
+	// IDs.  Dependencies on IDs that aren't in
+	// the catalog are left as-is, so a namespaced catalog can depend on
+	// resources in a catalog without a namespace.
+	Namespace string
+}
+
+// Merge returns a new catalog with the resources of each source, in
+// order.  It returns an error if two resources have the same ID or
+// name or if a dependency is not in the merged catalog.
+func Merge(srcs []Source) (catalog.Catalog, error) {
+	// The merged catalog has no defaults of its own, so each source's
+	// defaults are expanded into its resources first.
+	cats := make([]catalog.Catalog, len(srcs))
+	n := 0
+	for i, src := range srcs {
+		var err error
+		cats[i], err = catalog.ExpandDefaults(src.Catalog)
+		if err != nil {
+			return catalog.Catalog{}, fmt.Errorf("merge: catalog %d: %v", i, err)
+		}
+		res, err := cats[i].Resources()
+		if err != nil {
+			return catalog.Catalog{}, fmt.Errorf("merge: catalog %d: %v", i, err)
+		}
+		n += res.Len()
+	}
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("merge: %v", err)
+	}
+	out, err := catalog.NewRootCatalog(seg)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("merge: %v", err)
+	}
+	outRes, err := out.NewResources(int32(n))
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("merge: %v", err)
+	}
+	var a catid.Assigner
+	ids := make(map[uint64]string, n)
+	names := make(map[string]uint64, n)
+	j := 0
+	for i, src := range srcs {
+		res, _ := cats[i].Resources()
+		start := j
+		for k := 0; k < res.Len(); k++ {
+			if err := outRes.Set(j+k, res.At(k)); err != nil {
+				return catalog.Catalog{}, fmt.Errorf("merge: catalog %d: resource[%d]: %v", i, k, err)
+			}
+		}
+		if src.Namespace != "" {
+			if err := namespace(&a, src.Namespace, outRes, start, res.Len()); err != nil {
+				return catalog.Catalog{}, fmt.Errorf("merge: catalog %d: %v", i, err)
+			}
+		}
+		for ; j < start+res.Len(); j++ {
+			r := outRes.At(j)
+			desc := formatResource(r)
+			if prev, dup := ids[r.ID()]; dup {
+				return catalog.Catalog{}, fmt.Errorf("merge: catalog %d: %s has the same ID as %s", i, desc, prev)
+			}
+			ids[r.ID()] = desc
+			if name, _ := r.Name(); name != "" {
+				if _, dup := names[name]; dup {
+					return catalog.Catalog{}, fmt.Errorf("merge: catalog %d: resource name %q used more than once", i, name)
+				}
+				names[name] = r.ID()
+			}
+		}
+	}
+	for j := 0; j < outRes.Len(); j++ {
+		r := outRes.At(j)
+		deps, _ := r.Dependencies()
+		for k := 0; k < deps.Len(); k++ {
+			if _, ok := ids[deps.At(k)]; !ok {
+				return catalog.Catalog{}, fmt.Errorf("merge: %s depends on id=%d, which is not in any catalog", formatResource(r), deps.At(k))
+			}
+		}
+	}
+	return out, nil
+}
+
+// namespace assigns new IDs and names to the n resources starting at
+// index start and rewrites the references between them.
+func namespace(a *catid.Assigner, ns string, res catalog.Resource_List, start, n int) error {
+	newIDs := make(map[uint64]uint64, n)
+	for j := start; j < start+n; j++ {
+		r := res.At(j)
+		name, _ := r.Name()
+		key := name
+		if key == "" {
+			// A resource named like this would get the same ID, which
+			// Merge reports as a duplicate.
+			key = "#" + strconv.FormatUint(r.ID(), 10)
+		}
+		id, err := a.ID(ns, key)
+		if err != nil {
+			return err
+		}
+		if _, dup := newIDs[r.ID()]; dup {
+			return fmt.Errorf("%s: ID used more than once", formatResource(r))
+		}
+		newIDs[r.ID()] = id
+		r.SetID(id)
+		if name != "" {
+			if err := r.SetName(catid.Name{Namespace: ns, Name: name}.String()); err != nil {
+				return err
+			}
+		}
+	}
+	for j := start; j < start+n; j++ {
+		r := res.At(j)
+		deps, _ := r.Dependencies()
+		rewriteIDs(deps, newIDs)
+		if r.Which() != catalog.Resource_Which_exec {
+			continue
+		}
+		e, err := r.Exec()
+		if err != nil {
+			return fmt.Errorf("%s: %v", formatResource(r), err)
+		}
+		if cond := e.Condition(); cond.Which() == catalog.Exec_condition_Which_ifDepsChanged {
+			changed, _ := cond.IfDepsChanged()
+			rewriteIDs(changed, newIDs)
+		}
+	}
+	return nil
+}
+
+func rewriteIDs(list capnp.UInt64List, newIDs map[uint64]uint64) {
+	for i := 0; i < list.Len(); i++ {
+		if id, ok := newIDs[list.At(i)]; ok {
+			list.Set(i, id)
+		}
+	}
+}
+
+// formatResource describes a resource for an error message.
+func formatResource(r catalog.Resource) string {
+	if name, _ := r.Name(); name != "" {
+		return fmt.Sprintf("resource %q", name)
+	}
+	if c, _ := r.Comment(); c != "" {
+		return fmt.Sprintf("resource %q (id=%d)", c, r.ID())
+	}
+	return fmt.Sprintf("resource id=%d", r.ID())
+}
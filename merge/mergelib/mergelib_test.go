@@ -0,0 +1,145 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mergelib
+
+import (
+	"testing"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catid"
+	"github.com/zombiezen/mcm/internal/catpogs"
+)
+
+func TestMerge(t *testing.T) {
+	base := mustCatalog(t, &catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				Name:  "nginx",
+				Which: catalog.Resource_Which_noop,
+			},
+		},
+	})
+	vhost := mustCatalog(t, &catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				Name:  "conf",
+				Which: catalog.Resource_Which_file,
+				File:  catpogs.PlainFile("/etc/nginx/site.conf", []byte("server {}")),
+				Deps:  []uint64{catid.Hash("nginx")},
+			},
+			{
+				ID:      42,
+				Comment: "reload",
+				Deps:    []uint64{catid.Hash("conf")},
+				Which:   catalog.Resource_Which_exec,
+				Exec: &catpogs.Exec{
+					Command: &catpogs.Command{
+						Which: catalog.Exec_Command_Which_argv,
+						Argv:  []string{"/usr/sbin/nginx", "-s", "reload"},
+					},
+					Condition: catpogs.ExecCondition{
+						Which:         catalog.Exec_condition_Which_ifDepsChanged,
+						IfDepsChanged: []uint64{catid.Hash("conf")},
+					},
+				},
+			},
+		},
+	})
+	c, err := Merge([]Source{
+		{Catalog: base},
+		{Catalog: vhost, Namespace: "a"},
+		{Catalog: vhost, Namespace: "b"},
+	})
+	if err != nil {
+		t.Fatal("Merge:", err)
+	}
+	res, err := c.Resources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Len() != 5 {
+		t.Fatalf("len(resources) = %d; want 5", res.Len())
+	}
+	if id := res.At(0).ID(); id != catid.Hash("nginx") {
+		t.Errorf("resources[0].ID = %d; want unchanged %d", id, catid.Hash("nginx"))
+	}
+	for i, ns := range []string{"a", "b"} {
+		conf, reload := res.At(1+2*i), res.At(2+2*i)
+		confID := catid.NamespacedHash(ns, "conf")
+		if conf.ID() != confID {
+			t.Errorf("%s/conf ID = %d; want %d", ns, conf.ID(), confID)
+		}
+		if name, _ := conf.Name(); name != ns+"/conf" {
+			t.Errorf("%s/conf name = %q; want %q", ns, name, ns+"/conf")
+		}
+		if deps, _ := conf.Dependencies(); deps.Len() != 1 || deps.At(0) != catid.Hash("nginx") {
+			t.Errorf("%s/conf depends on %v; want [%d]", ns, deps, catid.Hash("nginx"))
+		}
+		if want := catid.NamespacedHash(ns, "#42"); reload.ID() != want {
+			t.Errorf("%s reload ID = %d; want %d", ns, reload.ID(), want)
+		}
+		if deps, _ := reload.Dependencies(); deps.Len() != 1 || deps.At(0) != confID {
+			t.Errorf("%s reload depends on %v; want [%d]", ns, deps, confID)
+		}
+		e, _ := reload.Exec()
+		if changed, _ := e.Condition().IfDepsChanged(); changed.Len() != 1 || changed.At(0) != confID {
+			t.Errorf("%s reload ifDepsChanged = %v; want [%d]", ns, changed, confID)
+		}
+	}
+	if vres, _ := vhost.Resources(); vres.At(0).ID() != catid.Hash("conf") {
+		t.Error("Merge modified its input")
+	}
+}
+
+func TestMergeErrors(t *testing.T) {
+	base := mustCatalog(t, &catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				Name:  "nginx",
+				Which: catalog.Resource_Which_noop,
+			},
+		},
+	})
+	dangling := mustCatalog(t, &catpogs.Catalog{
+		Resources: []*catpogs.Resource{
+			{
+				ID:    1,
+				Deps:  []uint64{2},
+				Which: catalog.Resource_Which_noop,
+			},
+		},
+	})
+	tests := []struct {
+		name string
+		srcs []Source
+	}{
+		{"duplicate ID", []Source{{Catalog: base}, {Catalog: base}}},
+		{"duplicate namespace", []Source{{Catalog: base, Namespace: "a"}, {Catalog: base, Namespace: "a"}}},
+		{"dangling dependency", []Source{{Catalog: base}, {Catalog: dangling, Namespace: "a"}}},
+	}
+	for _, test := range tests {
+		if _, err := Merge(test.srcs); err == nil {
+			t.Errorf("%s: Merge did not return an error", test.name)
+		}
+	}
+}
+
+func mustCatalog(t *testing.T, c *catpogs.Catalog) catalog.Catalog {
+	cat, err := c.ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	return cat
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mcm-prune removes the resources of a catalog that a set of target
+// resources doesn't need, such as to build a host's catalog from a
+// monolithic one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/prune/prunelib"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s [-o OUT] [-tag TAG]... CATALOG [TARGET...]\n", name)
+	flag.PrintDefaults()
+}
+
+func main() {
+	outPath := flag.String("o", "", "file to write to instead of stdout")
+	var targets prunelib.Targets
+	flag.Var((*tagsFlag)(&targets.Tags), "tag", "keep resources with this tag (repeatable)")
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if flag.NArg() == 0 || flag.NArg() == 1 && len(targets.Tags) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	c, err := readCatalog(flag.Arg(0))
+	if err != nil {
+		die(err)
+	}
+	targets.Names = flag.Args()[1:]
+	c, err = prunelib.Prune(c, targets)
+	if err != nil {
+		die(err)
+	}
+	data, err := c.Segment().Message().Marshal()
+	if err != nil {
+		die(err)
+	}
+	if *outPath == "" || *outPath == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(*outPath, data, 0666)
+	}
+	if err != nil {
+		die(err)
+	}
+}
+
+// readCatalog reads the catalog at path, or stdin if path is "-".
+func readCatalog(path string) (catalog.Catalog, error) {
+	if path != "-" {
+		// The file stays mapped until mcm-prune exits.
+		f, err := catalog.OpenFile(path)
+		if err != nil {
+			return catalog.Catalog{}, err
+		}
+		return f.Catalog, nil
+	}
+	msg, err := capnp.NewDecoder(os.Stdin).Decode()
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	return catalog.ReadRootCatalog(msg)
+}
+
+type tagsFlag []string
+
+func (f *tagsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *tagsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, "mcm-prune:", err)
+	os.Exit(1)
+}
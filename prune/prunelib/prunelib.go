@@ -0,0 +1,105 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prunelib provides the functionality of the mcm-prune tool:
+// removing the resources of a catalog that a set of target resources
+// doesn't need.
+package prunelib
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/zombiezen/mcm/catalog"
+)
+
+// Targets selects the resources to keep.  A resource is a target if it
+// matches any of the names or tags.
+type Targets struct {
+	// Names are resource names or decimal resource IDs.
+	Names []string
+
+	// Tags selects every resource that has one of the tags.
+	Tags []string
+}
+
+// Prune returns a new catalog with the target resources of c and the
+// resources that they depend on, directly or indirectly, in their
+// original order.  The rest of the catalog, like its metadata and
+// defaults, is copied as-is.  It returns an error if a name or tag
+// doesn't match any resource.
+func Prune(c catalog.Catalog, t Targets) (catalog.Catalog, error) {
+	ids, err := resolveTargets(c, t)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("prune: %v", err)
+	}
+	closure, err := catalog.DependencyClosure(c, ids)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("prune: %v", err)
+	}
+	keep := make(map[uint64]bool, len(closure))
+	for _, id := range closure {
+		keep[id] = true
+	}
+	out, err := catalog.Subset(c, keep)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("prune: %v", err)
+	}
+	return out, nil
+}
+
+// resolveTargets returns the IDs of the resources that t selects.
+func resolveTargets(c catalog.Catalog, t Targets) ([]uint64, error) {
+	res, err := c.Resources()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]uint64)
+	byID := make(map[uint64]bool, res.Len())
+	tagged := make(map[string][]uint64)
+	for i := 0; i < res.Len(); i++ {
+		r := res.At(i)
+		byID[r.ID()] = true
+		if name, _ := r.Name(); name != "" {
+			byName[name] = r.ID()
+		}
+		tags, err := r.Tags()
+		if err != nil {
+			return nil, fmt.Errorf("resource %d: tags: %v", r.ID(), err)
+		}
+		for j := 0; j < tags.Len(); j++ {
+			tag, _ := tags.At(j)
+			tagged[tag] = append(tagged[tag], r.ID())
+		}
+	}
+	var ids []uint64
+	for _, name := range t.Names {
+		if id, ok := byName[name]; ok {
+			ids = append(ids, id)
+			continue
+		}
+		if id, err := strconv.ParseUint(name, 10, 64); err == nil && byID[id] {
+			ids = append(ids, id)
+			continue
+		}
+		return nil, fmt.Errorf("no resource named %q", name)
+	}
+	for _, tag := range t.Tags {
+		if len(tagged[tag]) == 0 {
+			return nil, fmt.Errorf("no resources tagged %q", tag)
+		}
+		ids = append(ids, tagged[tag]...)
+	}
+	return ids, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prunelib
+
+import (
+	"testing"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/catpogs"
+)
+
+func TestPrune(t *testing.T) {
+	c := mustCatalog(t, &catpogs.Catalog{
+		Metadata: &catpogs.Metadata{Generator: "mcm-luacat"},
+		Resources: []*catpogs.Resource{
+			{ID: 1, Name: "base", Which: catalog.Resource_Which_noop},
+			{ID: 2, Name: "nginx", Deps: []uint64{1}, Which: catalog.Resource_Which_noop},
+			{ID: 3, Name: "web-conf", Deps: []uint64{2}, Tags: []string{"web"}, Which: catalog.Resource_Which_noop},
+			{ID: 4, Name: "postgres", Deps: []uint64{1}, Which: catalog.Resource_Which_noop},
+			{ID: 5, Name: "db-conf", Deps: []uint64{4}, Tags: []string{"db"}, Which: catalog.Resource_Which_noop},
+			{ID: 6, Name: "cron", Which: catalog.Resource_Which_noop},
+		},
+	})
+	tests := []struct {
+		targets Targets
+		want    []uint64
+	}{
+		{Targets{Tags: []string{"web"}}, []uint64{1, 2, 3}},
+		{Targets{Names: []string{"db-conf"}}, []uint64{1, 4, 5}},
+		{Targets{Names: []string{"6"}, Tags: []string{"web"}}, []uint64{1, 2, 3, 6}},
+	}
+	for _, test := range tests {
+		out, err := Prune(c, test.targets)
+		if err != nil {
+			t.Errorf("Prune(c, %+v): %v", test.targets, err)
+			continue
+		}
+		res, _ := out.Resources()
+		var got []uint64
+		for i := 0; i < res.Len(); i++ {
+			got = append(got, res.At(i).ID())
+		}
+		if !uint64SlicesEqual(got, test.want) {
+			t.Errorf("Prune(c, %+v) resource IDs = %v; want %v", test.targets, got, test.want)
+		}
+		meta, _ := out.Metadata()
+		if gen, _ := meta.Generator(); gen != "mcm-luacat" {
+			t.Errorf("Prune(c, %+v) metadata generator = %q; want \"mcm-luacat\"", test.targets, gen)
+		}
+	}
+
+	for _, targets := range []Targets{{Names: []string{"redis"}}, {Names: []string{"7"}}, {Tags: []string{"cache"}}} {
+		if _, err := Prune(c, targets); err == nil {
+			t.Errorf("Prune(c, %+v) did not return an error", targets)
+		}
+	}
+}
+
+func mustCatalog(t *testing.T, c *catpogs.Catalog) catalog.Catalog {
+	cat, err := c.ToCapnp()
+	if err != nil {
+		t.Fatal("catpogs.Catalog.ToCapnp():", err)
+	}
+	return cat
+}
+
+func uint64SlicesEqual(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
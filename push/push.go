@@ -0,0 +1,278 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/zombiezen/mcm/internal/download"
+	"github.com/zombiezen/mcm/internal/inventory"
+	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/push/pushlib"
+)
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s -inventory SPEC [options] [CATALOG]\n", filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
+
+func main() {
+	ssh := new(pushlib.SSH)
+	opts := new(pushlib.Options)
+	inventorySpec := flag.String("inventory", "", "hosts to push to: an inventory FILE, a FILE.json or FILE.yaml host file, ec2:REGION, or gce:PROJECT[/ZONE]")
+	invOpts := new(inventory.Options)
+	filters := make(filtersFlag)
+	flag.Var(filters, "inventory_filter", "KEY=VALUE tag (ec2) or label (gce) that cloud instances must have (repeatable)")
+	groupKeys := flag.String("group_keys", "", "comma-separated tags (ec2) or labels (gce) whose values are the groups of cloud instances")
+	flag.BoolVar(&invOpts.PublicAddr, "public_addr", false, "connect to cloud instances' public IP addresses instead of their private ones")
+	proxy := flag.String("proxy", "", "URL of the HTTP(S) proxy to send cloud API requests through (default from $HTTPS_PROXY/$HTTP_PROXY)")
+	groups := flag.String("groups", "", "comma-separated groups or host names to push to (default all hosts)")
+	groupCatalogs := make(groupCatalogsFlag)
+	flag.Var(groupCatalogs, "group_catalog", "GROUP=FILE catalog to apply to hosts in GROUP instead of CATALOG (repeatable)")
+	flag.IntVar(&opts.Parallel, "parallel", pushlib.DefaultParallel, "maximum number of hosts to push to simultaneously")
+	flag.IntVar(&opts.BatchSize, "batch", 0, "number of hosts in each rolling batch (0 for one batch of every host)")
+	flag.IntVar(&opts.MaxFailures, "max_failures", 0, "stop starting batches once more than this many hosts have failed (negative for no limit)")
+	flag.IntVar(&opts.Canary, "canary", 0, "number of hosts to push to first; the push halts if any of them fail")
+	var assertions assertionsFlag
+	flag.Var(&assertions, "assert", "FIELD OP N condition on each host's resource counts, like changed<=10 (repeatable)")
+	healthCheck := flag.String("health_check", "", "shell command to run locally after each host is pushed to, with $MCM_HOST and $MCM_ADDR set")
+	flag.StringVar(&ssh.Path, "ssh", "ssh", "path to ssh client")
+	flag.StringVar(&ssh.Exec, "remote_exec", "mcm-exec", "path to mcm-exec on hosts whose inventory entry doesn't set exec")
+	simulate := flag.Bool("n", false, "dry-run: pass -n to mcm-exec")
+	reportPath := flag.String("report", "", "write a JSON report of the push to this file")
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if *inventorySpec == "" || flag.NArg() > 1 {
+		usage()
+		os.Exit(2)
+	}
+	if *simulate {
+		ssh.ExecArgs = append(ssh.ExecArgs, "-n")
+	}
+	invOpts.Filters = filters
+	if *groupKeys != "" {
+		invOpts.GroupKeys = strings.Split(*groupKeys, ",")
+	}
+	var err error
+	if invOpts.Downloader, err = download.New(*proxy, "", nil); err != nil {
+		die(err)
+	}
+	ctx := context.Background()
+	hosts, err := selectHosts(ctx, *inventorySpec, invOpts, *groups)
+	if err != nil {
+		die(err)
+	}
+	catalogs, err := hostCatalogs(hosts, flag.Arg(0), groupCatalogs)
+	if err != nil {
+		die(err)
+	}
+	var hc *pushlib.HealthCheck
+	if *healthCheck != "" {
+		hc = &pushlib.HealthCheck{Command: *healthCheck}
+	}
+	opts.Check = pushlib.Checks(assertions, hc)
+	opts.Progress = func(hr *pushlib.HostReport) {
+		line := fmt.Sprintf("%s: %s", hr.Host, hr.Status)
+		if hr.Summary != nil {
+			line += " (" + hr.Summary.String() + ")"
+		}
+		fmt.Println(line)
+		for _, e := range hr.Errors {
+			fmt.Printf("  %s\n", e)
+		}
+	}
+	report := pushlib.Push(ctx, ssh, hosts, catalogs, opts)
+	if report.Halted != "" {
+		fmt.Println("halted:", report.Halted)
+	}
+	fmt.Println(report.Summary)
+	if *reportPath != "" {
+		if err := writeReport(*reportPath, report); err != nil {
+			die(err)
+		}
+	}
+	if report.Summary.OK != len(hosts) {
+		os.Exit(1)
+	}
+}
+
+// selectHosts lists the hosts in the inventory described by spec and
+// returns the ones in the comma-separated groups.
+func selectHosts(ctx context.Context, spec string, opts *inventory.Options, groups string) ([]*inventory.Host, error) {
+	inv, err := inventory.Open(spec, opts)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := inv.Hosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	if groups != "" {
+		list = strings.Split(groups, ",")
+	}
+	return inventory.Select(hosts, list)
+}
+
+// hostCatalogs reads the catalog file for each host.  A host uses the
+// catalog of the -group_catalog group it is in, or defaultPath if it is
+// in none of them.
+func hostCatalogs(hosts []*inventory.Host, defaultPath string, groupCatalogs groupCatalogsFlag) ([][]byte, error) {
+	files := make(map[string][]byte)
+	read := func(path string) ([]byte, error) {
+		if data, ok := files[path]; ok {
+			return data, nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read catalog: %v", err)
+		}
+		files[path] = data
+		return data, nil
+	}
+	catalogs := make([][]byte, len(hosts))
+	for i, h := range hosts {
+		path, group := defaultPath, ""
+		for _, g := range groupCatalogs.groups() {
+			if !h.InGroup(g) {
+				continue
+			}
+			if group != "" && groupCatalogs[g] != path {
+				return nil, fmt.Errorf("host %s is in groups %s and %s, which have different catalogs", h.Name, group, g)
+			}
+			path, group = groupCatalogs[g], g
+		}
+		if path == "" {
+			return nil, fmt.Errorf("host %s has no catalog; give a CATALOG or a -group_catalog for one of its groups", h.Name)
+		}
+		var err error
+		if catalogs[i], err = read(path); err != nil {
+			return nil, err
+		}
+	}
+	return catalogs, nil
+}
+
+func writeReport(path string, report *pushlib.Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("write report: %v", err)
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("write report: %v", err)
+	}
+	return nil
+}
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, "mcm-push:", err)
+	os.Exit(1)
+}
+
+// groupCatalogsFlag is a repeatable GROUP=FILE flag that maps groups to
+// catalog files.
+type groupCatalogsFlag map[string]string
+
+func (f groupCatalogsFlag) String() string {
+	var parts []string
+	for _, g := range f.groups() {
+		parts = append(parts, g+"="+f[g])
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f groupCatalogsFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 || i == len(s)-1 {
+		return errors.New("want GROUP=FILE")
+	}
+	g := s[:i]
+	if _, dup := f[g]; dup {
+		return fmt.Errorf("catalog for group %s given more than once", g)
+	}
+	f[g] = s[i+1:]
+	return nil
+}
+
+// groups returns the groups in f in sorted order.
+func (f groupCatalogsFlag) groups() []string {
+	groups := make([]string, 0, len(f))
+	for g := range f {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// assertionsFlag is a repeatable flag of report assertions.
+type assertionsFlag []*pushlib.Assertion
+
+func (f *assertionsFlag) String() string {
+	parts := make([]string, len(*f))
+	for i, a := range *f {
+		parts[i] = a.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f *assertionsFlag) Set(s string) error {
+	a, err := pushlib.ParseAssertion(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, a)
+	return nil
+}
+
+// filtersFlag is a repeatable KEY=VALUE flag.
+type filtersFlag map[string]string
+
+func (f filtersFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = k + "=" + f[k]
+	}
+	return strings.Join(keys, ",")
+}
+
+func (f filtersFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return errors.New("want KEY=VALUE")
+	}
+	f[s[:i]] = s[i+1:]
+	return nil
+}
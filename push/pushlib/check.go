@@ -0,0 +1,172 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushlib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/zombiezen/mcm/internal/inventory"
+)
+
+// An Assertion is a condition on the resource counts of a host's run,
+// like "changed<=10" or "failed==0".
+type Assertion struct {
+	// Field is one of "applied", "changed", "unchanged", "failed", or
+	// "skipped".
+	Field string
+
+	// Op is one of "<", "<=", "==", "!=", ">=", or ">".
+	Op string
+
+	Value int
+}
+
+// ParseAssertion parses an assertion of the form FIELD OP N.
+func ParseAssertion(s string) (*Assertion, error) {
+	i := strings.IndexAny(s, "<=!>")
+	if i == -1 {
+		return nil, fmt.Errorf("parse assertion %q: missing operator", s)
+	}
+	a := &Assertion{Field: strings.TrimSpace(s[:i])}
+	rest := s[i:]
+	for _, op := range []string{"<=", "==", "!=", ">=", "<", ">"} {
+		if strings.HasPrefix(rest, op) {
+			a.Op, rest = op, rest[len(op):]
+			break
+		}
+	}
+	if a.Op == "" {
+		return nil, fmt.Errorf("parse assertion %q: unknown operator", s)
+	}
+	switch a.Field {
+	case "applied", "changed", "unchanged", "failed", "skipped":
+	default:
+		return nil, fmt.Errorf("parse assertion %q: unknown field %q", s, a.Field)
+	}
+	var err error
+	if a.Value, err = strconv.Atoi(strings.TrimSpace(rest)); err != nil {
+		return nil, fmt.Errorf("parse assertion %q: %v", s, err)
+	}
+	return a, nil
+}
+
+func (a *Assertion) String() string {
+	return a.Field + a.Op + strconv.Itoa(a.Value)
+}
+
+// Check returns an error if hr does not satisfy the assertion.
+func (a *Assertion) Check(hr *HostReport) error {
+	if hr.Summary == nil {
+		return fmt.Errorf("%v: host did not report a summary", a)
+	}
+	var n int
+	switch a.Field {
+	case "applied":
+		n = hr.Summary.Applied
+	case "changed":
+		n = hr.Summary.Changed
+	case "unchanged":
+		n = hr.Summary.Unchanged
+	case "failed":
+		n = hr.Summary.Failed
+	case "skipped":
+		n = hr.Summary.Skipped
+	}
+	var ok bool
+	switch a.Op {
+	case "<":
+		ok = n < a.Value
+	case "<=":
+		ok = n <= a.Value
+	case "==":
+		ok = n == a.Value
+	case "!=":
+		ok = n != a.Value
+	case ">=":
+		ok = n >= a.Value
+	case ">":
+		ok = n > a.Value
+	}
+	if !ok {
+		return fmt.Errorf("%v: %s is %d", a, a.Field, n)
+	}
+	return nil
+}
+
+// A HealthCheck runs a local shell command to check a host after it
+// has been pushed to.  The command is run with the MCM_HOST environment
+// variable set to the host's name and MCM_ADDR set to its address.  A
+// nonzero exit status fails the check.
+type HealthCheck struct {
+	// Shell is the path of the shell that runs Command.  If empty,
+	// then /bin/sh is used.
+	Shell   string
+	Command string
+}
+
+// Check runs the health check command for h.
+func (hc *HealthCheck) Check(ctx context.Context, h *inventory.Host) error {
+	shell := hc.Shell
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	addr := h.Addr
+	if addr == "" {
+		addr = h.Name
+	}
+	c := exec.CommandContext(ctx, shell, "-c", hc.Command)
+	c.Env = append(os.Environ(), "MCM_HOST="+h.Name, "MCM_ADDR="+addr)
+	out := new(bytes.Buffer)
+	c.Stdout = out
+	c.Stderr = out
+	if err := c.Run(); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return fmt.Errorf("health check: %v: %s", err, msg)
+		}
+		return fmt.Errorf("health check: %v", err)
+	}
+	return nil
+}
+
+// Checks returns a function suitable for Options.Check that fails a
+// host if any of the assertions fail or, if hc is not nil, the health
+// check fails.  It returns nil if there is nothing to check.
+func Checks(assertions []*Assertion, hc *HealthCheck) func(ctx context.Context, h *inventory.Host, hr *HostReport) error {
+	if len(assertions) == 0 && hc == nil {
+		return nil
+	}
+	return func(ctx context.Context, h *inventory.Host, hr *HostReport) error {
+		var msgs []string
+		for _, a := range assertions {
+			if err := a.Check(hr); err != nil {
+				msgs = append(msgs, err.Error())
+			}
+		}
+		if len(msgs) > 0 {
+			return errors.New(strings.Join(msgs, "; "))
+		}
+		if hc != nil {
+			return hc.Check(ctx, h)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushlib
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/inventory"
+)
+
+func TestAssertion(t *testing.T) {
+	hr := &HostReport{Summary: &execlib.Summary{Applied: 10, Changed: 3, Unchanged: 7}}
+	tests := []struct {
+		s  string
+		ok bool
+	}{
+		{"changed<=3", true},
+		{"changed<3", false},
+		{"failed==0", true},
+		{"unchanged != 7", false},
+		{"applied >= 10", true},
+		{"skipped>0", false},
+	}
+	for _, test := range tests {
+		a, err := ParseAssertion(test.s)
+		if err != nil {
+			t.Errorf("ParseAssertion(%q): %v", test.s, err)
+			continue
+		}
+		if err := a.Check(hr); (err == nil) != test.ok {
+			t.Errorf("ParseAssertion(%q).Check(...) = %v; want ok = %t", test.s, err, test.ok)
+		}
+	}
+	a, err := ParseAssertion("changed<=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Check(&HostReport{}); err == nil {
+		t.Error("Check on report without summary did not return an error")
+	}
+	for _, s := range []string{"changed", "changed=3", "colors==1", "changed<=many", "<=3"} {
+		if _, err := ParseAssertion(s); err == nil {
+			t.Errorf("ParseAssertion(%q) did not return an error", s)
+		}
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh:", err)
+	}
+	ctx := context.Background()
+	hc := &HealthCheck{Command: `test "$MCM_HOST" = web1 && test "$MCM_ADDR" = 10.0.0.1`}
+	if err := hc.Check(ctx, &inventory.Host{Name: "web1", Addr: "10.0.0.1"}); err != nil {
+		t.Errorf("Check(web1): %v", err)
+	}
+	if err := hc.Check(ctx, &inventory.Host{Name: "web2"}); err == nil {
+		t.Error("Check(web2) did not return an error")
+	}
+	hc = &HealthCheck{Command: "echo down; exit 1"}
+	if err := hc.Check(ctx, &inventory.Host{Name: "web1"}); err == nil || !strings.Contains(err.Error(), "down") {
+		t.Errorf("Check with failing command = %v; want error containing \"down\"", err)
+	}
+}
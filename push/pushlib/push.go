@@ -0,0 +1,278 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushlib applies catalogs to many hosts at once, in rolling
+// batches, for mcm-push.
+package pushlib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/inventory"
+)
+
+// A Runner applies a catalog to a single host.
+type Runner interface {
+	// Run applies the catalog file's bytes to h and returns the
+	// outcome.  The returned report's Host and Batch are filled in by
+	// Push.
+	Run(ctx context.Context, h *inventory.Host, catalog []byte) *HostReport
+}
+
+// HostStatus is the outcome of pushing to a host.
+type HostStatus string
+
+// Host statuses.
+const (
+	// HostOK means every resource applied cleanly.
+	HostOK HostStatus = "ok"
+
+	// HostFailed means the catalog was applied, but not cleanly.
+	HostFailed HostStatus = "failed"
+
+	// HostUnreachable means the catalog could not be applied, such as
+	// when the host could not be connected to.
+	HostUnreachable HostStatus = "unreachable"
+
+	// HostSkipped means the host was not pushed to because the push
+	// was halted.
+	HostSkipped HostStatus = "skipped"
+)
+
+// A HostReport is the outcome of pushing to a host.
+type HostReport struct {
+	Host   string     `json:"host"`
+	Batch  int        `json:"batch"`
+	Canary bool       `json:"canary,omitempty"`
+	Status HostStatus `json:"status"`
+
+	// Summary is the run's summary from mcm-exec, if it got far enough
+	// to print one.
+	Summary *execlib.Summary `json:"summary,omitempty"`
+
+	// Errors are the error messages from the run.
+	Errors []string `json:"errors,omitempty"`
+
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// A Report is the outcome of a push.
+type Report struct {
+	Start time.Time     `json:"start"`
+	End   time.Time     `json:"end"`
+	Hosts []*HostReport `json:"hosts"`
+
+	// Halted is the reason that the push stopped before every host was
+	// pushed to, or empty if it didn't.
+	Halted string `json:"halted,omitempty"`
+
+	// Summary is filled in by Push once it finishes.
+	Summary *Summary `json:"summary,omitempty"`
+}
+
+// Summary counts the hosts of each status and the resources of every
+// host that reported a summary.
+type Summary struct {
+	OK          int `json:"ok"`
+	Failed      int `json:"failed"`
+	Unreachable int `json:"unreachable"`
+	Skipped     int `json:"skipped"`
+
+	Resources execlib.Summary `json:"resources"`
+}
+
+// String formats the summary as
+//
+//	hosts: ok N, failed M, unreachable U, skipped S; resources: applied ...
+//
+// where the resource counts are in the format of execlib.Summary
+// without the duration.
+func (s *Summary) String() string {
+	r := &s.Resources
+	return fmt.Sprintf("hosts: ok %d, failed %d, unreachable %d, skipped %d; resources: applied %d, changed %d, unchanged %d, failed %d, skipped %d",
+		s.OK, s.Failed, s.Unreachable, s.Skipped, r.Applied, r.Changed, r.Unchanged, r.Failed, r.Skipped)
+}
+
+// Summarize counts the statuses in r.
+func (r *Report) Summarize() *Summary {
+	s := new(Summary)
+	for _, hr := range r.Hosts {
+		switch hr.Status {
+		case HostOK:
+			s.OK++
+		case HostFailed:
+			s.Failed++
+		case HostUnreachable:
+			s.Unreachable++
+		case HostSkipped:
+			s.Skipped++
+		}
+		if hr.Summary != nil {
+			s.Resources.Applied += hr.Summary.Applied
+			s.Resources.Changed += hr.Summary.Changed
+			s.Resources.Unchanged += hr.Summary.Unchanged
+			s.Resources.Failed += hr.Summary.Failed
+			s.Resources.Skipped += hr.Summary.Skipped
+		}
+	}
+	return s
+}
+
+// Options is the set of optional parameters for Push.
+type Options struct {
+	// Parallel is the number of hosts to push to at once.  If
+	// non-positive, then it assumes DefaultParallel.
+	Parallel int
+
+	// BatchSize is the number of hosts in each rolling batch.  Every
+	// host in a batch finishes before the next batch starts.  If
+	// non-positive, then all hosts are in one batch.
+	BatchSize int
+
+	// MaxFailures is the number of failed or unreachable hosts that
+	// Push tolerates.  Once more hosts than this have failed, no
+	// further batches are started and their hosts are reported as
+	// skipped.  Hosts in the batch that crossed the threshold still
+	// finish.  If negative, then failures never stop the push.
+	MaxFailures int
+
+	// Canary is the number of hosts, taken from the start of the host
+	// list, to push to in a batch of their own before any others.  If
+	// any canary host does not finish as HostOK, then the push halts
+	// regardless of MaxFailures.
+	Canary int
+
+	// Check is called after a host's run finishes as HostOK, if
+	// non-nil.  If it returns an error, then the host is reported as
+	// HostFailed.  Check may be called concurrently.
+	Check func(ctx context.Context, h *inventory.Host, hr *HostReport) error
+
+	// Progress is called with each host's report as it finishes, if
+	// non-nil.  Calls are not concurrent.
+	Progress func(*HostReport)
+}
+
+// DefaultParallel is the default value of Options.Parallel.
+const DefaultParallel = 5
+
+// Push applies catalogs to hosts using r.  catalogs gives the catalog
+// file for each host, in the same order as hosts.  The returned report
+// lists the hosts in the same order as hosts.
+func Push(ctx context.Context, r Runner, hosts []*inventory.Host, catalogs [][]byte, opts *Options) *Report {
+	if opts == nil {
+		opts = new(Options)
+	}
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = DefaultParallel
+	}
+	report := &Report{
+		Start: time.Now(),
+		Hosts: make([]*HostReport, len(hosts)),
+	}
+	failures, canaryFailed := 0, false
+	var mu sync.Mutex
+	for batch, b := range batches(len(hosts), opts.Canary, opts.BatchSize) {
+		canary := batch == 0 && opts.Canary > 0
+		if report.Halted == "" {
+			switch {
+			case canaryFailed:
+				report.Halted = "canary failed"
+			case opts.MaxFailures >= 0 && failures > opts.MaxFailures:
+				report.Halted = fmt.Sprintf("%d hosts failed", failures)
+			case ctx.Err() != nil:
+				report.Halted = ctx.Err().Error()
+			}
+		}
+		if report.Halted != "" {
+			for i := b[0]; i < b[1]; i++ {
+				hr := &HostReport{Host: hosts[i].Name, Batch: batch + 1, Status: HostSkipped}
+				report.Hosts[i] = hr
+				if opts.Progress != nil {
+					opts.Progress(hr)
+				}
+			}
+			continue
+		}
+		sem := make(chan struct{}, parallel)
+		var wg sync.WaitGroup
+		for i := b[0]; i < b[1]; i++ {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(i, batch int) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				hostStart := time.Now()
+				hr := r.Run(ctx, hosts[i], catalogs[i])
+				hr.Host, hr.Batch, hr.Canary = hosts[i].Name, batch, canary
+				if hr.Status == HostOK && opts.Check != nil {
+					if err := opts.Check(ctx, hosts[i], hr); err != nil {
+						hr.Status = HostFailed
+						hr.Errors = append(hr.Errors, "check: "+err.Error())
+					}
+				}
+				if hr.Duration == 0 {
+					hr.Duration = time.Since(hostStart)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				report.Hosts[i] = hr
+				if hr.Status == HostFailed || hr.Status == HostUnreachable {
+					failures++
+					if canary {
+						canaryFailed = true
+					}
+				}
+				if opts.Progress != nil {
+					opts.Progress(hr)
+				}
+			}(i, batch+1)
+		}
+		wg.Wait()
+	}
+	report.End = time.Now()
+	report.Summary = report.Summarize()
+	return report
+}
+
+// batches splits n hosts into the half-open index ranges of each batch:
+// first the canary hosts, then the rest in batches of size.
+func batches(n int, canary int, size int) [][2]int {
+	var b [][2]int
+	start := 0
+	if canary > 0 {
+		if canary > n {
+			canary = n
+		}
+		b = append(b, [2]int{0, canary})
+		start = canary
+	}
+	if size <= 0 {
+		size = n - start
+	}
+	for ; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+		b = append(b, [2]int{start, end})
+	}
+	return b
+}
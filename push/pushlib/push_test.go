@@ -0,0 +1,223 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/inventory"
+)
+
+// fakeRunner returns a canned status for each host and records the
+// most hosts that it ran at once.
+type fakeRunner struct {
+	status map[string]HostStatus
+
+	mu      sync.Mutex
+	running int
+	most    int
+	ran     []string
+	got     map[string]string
+}
+
+func (r *fakeRunner) Run(ctx context.Context, h *inventory.Host, catalog []byte) *HostReport {
+	r.mu.Lock()
+	r.running++
+	if r.running > r.most {
+		r.most = r.running
+	}
+	r.ran = append(r.ran, h.Name)
+	if r.got == nil {
+		r.got = make(map[string]string)
+	}
+	r.got[h.Name] = string(catalog)
+	r.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	r.mu.Lock()
+	r.running--
+	r.mu.Unlock()
+	status := r.status[h.Name]
+	if status == "" {
+		status = HostOK
+	}
+	hr := &HostReport{Status: status}
+	if status != HostUnreachable {
+		hr.Summary = &execlib.Summary{Applied: 2, Changed: 1, Unchanged: 1}
+	}
+	return hr
+}
+
+func hostList(n int) ([]*inventory.Host, [][]byte) {
+	hosts := make([]*inventory.Host, n)
+	catalogs := make([][]byte, n)
+	for i := range hosts {
+		hosts[i] = &inventory.Host{Name: fmt.Sprintf("host%d", i)}
+		catalogs[i] = []byte(fmt.Sprintf("catalog%d", i))
+	}
+	return hosts, catalogs
+}
+
+func TestPush(t *testing.T) {
+	hosts, catalogs := hostList(7)
+	r := &fakeRunner{status: map[string]HostStatus{"host1": HostFailed}}
+	var progress []string
+	report := Push(context.Background(), r, hosts, catalogs, &Options{
+		Parallel:    2,
+		BatchSize:   3,
+		MaxFailures: 1,
+		Progress:    func(hr *HostReport) { progress = append(progress, hr.Host) },
+	})
+	if r.most > 2 {
+		t.Errorf("ran %d hosts at once; want <= 2", r.most)
+	}
+	if len(report.Hosts) != len(hosts) {
+		t.Fatalf("len(report.Hosts) = %d; want %d", len(report.Hosts), len(hosts))
+	}
+	for i, hr := range report.Hosts {
+		if hr.Host != hosts[i].Name {
+			t.Errorf("report.Hosts[%d].Host = %q; want %q", i, hr.Host, hosts[i].Name)
+		}
+		if want := i/3 + 1; hr.Batch != want {
+			t.Errorf("report.Hosts[%d].Batch = %d; want %d", i, hr.Batch, want)
+		}
+		if want := fmt.Sprintf("catalog%d", i); r.got[hr.Host] != want {
+			t.Errorf("%s got catalog %q; want %q", hr.Host, r.got[hr.Host], want)
+		}
+	}
+	if len(progress) != len(hosts) {
+		t.Errorf("Progress called %d times; want %d", len(progress), len(hosts))
+	}
+	want := &Summary{
+		OK:        6,
+		Failed:    1,
+		Resources: execlib.Summary{Applied: 14, Changed: 7, Unchanged: 7},
+	}
+	if *report.Summary != *want {
+		t.Errorf("Summary = %v; want %v", report.Summary, want)
+	}
+}
+
+func TestPushMaxFailures(t *testing.T) {
+	hosts, catalogs := hostList(7)
+	r := &fakeRunner{status: map[string]HostStatus{
+		"host0": HostFailed,
+		"host4": HostUnreachable,
+	}}
+	report := Push(context.Background(), r, hosts, catalogs, &Options{
+		BatchSize:   2,
+		MaxFailures: 1,
+	})
+	want := []HostStatus{HostFailed, HostOK, HostOK, HostOK, HostUnreachable, HostOK, HostSkipped}
+	for i, hr := range report.Hosts {
+		if hr.Status != want[i] {
+			t.Errorf("report.Hosts[%d].Status = %q; want %q", i, hr.Status, want[i])
+		}
+	}
+	if len(r.ran) != 6 {
+		t.Errorf("ran %d hosts; want 6", len(r.ran))
+	}
+	if s := report.Summary; s.OK != 4 || s.Failed != 1 || s.Unreachable != 1 || s.Skipped != 1 {
+		t.Errorf("Summary = %v; want ok 4, failed 1, unreachable 1, skipped 1", s)
+	}
+}
+
+func TestPushNoFailureLimit(t *testing.T) {
+	hosts, catalogs := hostList(4)
+	r := &fakeRunner{status: map[string]HostStatus{
+		"host0": HostFailed,
+		"host1": HostFailed,
+	}}
+	report := Push(context.Background(), r, hosts, catalogs, &Options{
+		BatchSize:   1,
+		MaxFailures: -1,
+	})
+	if s := report.Summary; s.OK != 2 || s.Failed != 2 || s.Skipped != 0 {
+		t.Errorf("Summary = %v; want ok 2, failed 2, skipped 0", s)
+	}
+}
+
+func TestPushCanary(t *testing.T) {
+	tests := []struct {
+		name   string
+		status map[string]HostStatus
+		want   []HostStatus
+		halted bool
+	}{
+		{
+			name: "OK",
+			want: []HostStatus{HostOK, HostOK, HostOK, HostOK, HostOK},
+		},
+		{
+			name:   "CanaryFailed",
+			status: map[string]HostStatus{"host1": HostFailed},
+			want:   []HostStatus{HostOK, HostFailed, HostSkipped, HostSkipped, HostSkipped},
+			halted: true,
+		},
+	}
+	for _, test := range tests {
+		hosts, catalogs := hostList(5)
+		r := &fakeRunner{status: test.status}
+		report := Push(context.Background(), r, hosts, catalogs, &Options{
+			Canary:      2,
+			BatchSize:   2,
+			MaxFailures: -1,
+		})
+		for i, hr := range report.Hosts {
+			if hr.Status != test.want[i] {
+				t.Errorf("%s: report.Hosts[%d].Status = %q; want %q", test.name, i, hr.Status, test.want[i])
+			}
+			if want := i < 2; hr.Canary != want {
+				t.Errorf("%s: report.Hosts[%d].Canary = %t; want %t", test.name, i, hr.Canary, want)
+			}
+			if want := []int{1, 1, 2, 2, 3}[i]; hr.Batch != want {
+				t.Errorf("%s: report.Hosts[%d].Batch = %d; want %d", test.name, i, hr.Batch, want)
+			}
+		}
+		if halted := report.Halted != ""; halted != test.halted {
+			t.Errorf("%s: report.Halted = %q; want halted = %t", test.name, report.Halted, test.halted)
+		}
+	}
+}
+
+func TestPushCheck(t *testing.T) {
+	hosts, catalogs := hostList(3)
+	r := new(fakeRunner)
+	report := Push(context.Background(), r, hosts, catalogs, &Options{
+		MaxFailures: -1,
+		Check: func(ctx context.Context, h *inventory.Host, hr *HostReport) error {
+			if h.Name == "host1" {
+				return errors.New("unhealthy")
+			}
+			return nil
+		},
+	})
+	want := []HostStatus{HostOK, HostFailed, HostOK}
+	for i, hr := range report.Hosts {
+		if hr.Status != want[i] {
+			t.Errorf("report.Hosts[%d].Status = %q; want %q", i, hr.Status, want[i])
+		}
+	}
+	if errs := report.Hosts[1].Errors; len(errs) != 1 || errs[0] != "check: unhealthy" {
+		t.Errorf("report.Hosts[1].Errors = %q; want [\"check: unhealthy\"]", errs)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/inventory"
+)
+
+// SSH is a Runner that runs mcm-exec on each host over ssh, sending the
+// catalog on standard input.
+type SSH struct {
+	// Path is the path of the ssh client.  If empty, then ssh is
+	// searched for in PATH.
+	Path string
+
+	// Options are extra arguments for ssh, such as "-o" options.
+	Options []string
+
+	// Exec is the path of mcm-exec on hosts that don't set an Exec.
+	// If empty, then mcm-exec is searched for in the remote PATH.
+	Exec string
+
+	// ExecArgs are extra arguments for mcm-exec, such as "-n".
+	ExecArgs []string
+}
+
+// maxErrors is the number of error messages kept from each host.
+const maxErrors = 10
+
+// Run runs mcm-exec on h.
+func (s *SSH) Run(ctx context.Context, h *inventory.Host, catalog []byte) *HostReport {
+	path := s.Path
+	if path == "" {
+		path = "ssh"
+	}
+	c := exec.CommandContext(ctx, path, s.args(h)...)
+	c.Stdin = bytes.NewReader(catalog)
+	stderr := new(bytes.Buffer)
+	c.Stderr = stderr
+	err := c.Run()
+	hr := parseExecLog(stderr.Bytes())
+	switch {
+	case err == nil:
+		hr.Status = HostOK
+	case hr.Summary != nil:
+		hr.Status = HostFailed
+	default:
+		hr.Status = HostUnreachable
+		if len(hr.Errors) == 0 {
+			hr.Errors = []string{err.Error()}
+		}
+	}
+	return hr
+}
+
+// args returns the arguments to ssh for running mcm-exec on h.
+func (s *SSH) args(h *inventory.Host) []string {
+	args := []string{"-o", "BatchMode=yes"}
+	if h.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(h.Port))
+	}
+	if h.Identity != "" {
+		args = append(args, "-i", h.Identity)
+	}
+	if h.User != "" {
+		args = append(args, "-l", h.User)
+	}
+	args = append(args, s.Options...)
+	addr := h.Addr
+	if addr == "" {
+		addr = h.Name
+	}
+	execPath := h.Exec
+	if execPath == "" {
+		execPath = s.Exec
+	}
+	if execPath == "" {
+		execPath = "mcm-exec"
+	}
+	// ssh passes the command to the remote shell, so it is quoted.
+	remote := []string{execPath, "-log-format=json"}
+	remote = append(remote, s.ExecArgs...)
+	for i := range remote {
+		remote[i] = shellQuote(remote[i])
+	}
+	return append(args, "--", addr, strings.Join(remote, " "))
+}
+
+// parseExecLog reads mcm-exec's -log-format=json output for the run's
+// summary and error messages.  Lines that aren't JSON, like ssh's own
+// errors, are kept as error messages.
+func parseExecLog(out []byte) *HostReport {
+	hr := new(HostReport)
+	addError := func(msg string) {
+		if len(hr.Errors) < maxErrors {
+			hr.Errors = append(hr.Errors, msg)
+		}
+	}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var ent struct {
+			Level   string           `json:"level"`
+			Message string           `json:"msg"`
+			Event   string           `json:"event"`
+			Summary *execlib.Summary `json:"summary"`
+		}
+		if line[0] != '{' || json.Unmarshal(line, &ent) != nil {
+			addError(string(line))
+			continue
+		}
+		switch {
+		case ent.Event == "summary" && ent.Summary != nil:
+			hr.Summary = ent.Summary
+		case ent.Level == "error":
+			addError(ent.Message)
+		}
+	}
+	return hr
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_./=:,+@%", c) >= 0) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
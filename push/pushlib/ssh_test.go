@@ -0,0 +1,134 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushlib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zombiezen/mcm/exec/execlib"
+	"github.com/zombiezen/mcm/internal/inventory"
+)
+
+func TestSSHArgs(t *testing.T) {
+	s := &SSH{Options: []string{"-o", "ConnectTimeout=5"}, ExecArgs: []string{"-n", "-state", "/var/lib/mcm state.json"}}
+	tests := []struct {
+		host *inventory.Host
+		want []string
+	}{
+		{
+			host: &inventory.Host{Name: "web1"},
+			want: []string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=5", "--", "web1", "mcm-exec -log-format=json -n -state '/var/lib/mcm state.json'"},
+		},
+		{
+			host: &inventory.Host{Name: "web2", Addr: "10.0.0.2", Port: 2222, User: "deploy", Identity: "/etc/key", Exec: "/opt/mcm/bin/mcm-exec"},
+			want: []string{"-o", "BatchMode=yes", "-p", "2222", "-i", "/etc/key", "-l", "deploy", "-o", "ConnectTimeout=5", "--", "10.0.0.2", "/opt/mcm/bin/mcm-exec -log-format=json -n -state '/var/lib/mcm state.json'"},
+		},
+	}
+	for _, test := range tests {
+		if got := s.args(test.host); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("args(%+v) = %q; want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestParseExecLog(t *testing.T) {
+	out := `{"time":"2017-06-01T12:00:00Z","level":"info","msg":"applying: foo","event":"start","resource_id":1}
+{"time":"2017-06-01T12:00:00Z","level":"error","msg":"foo: exit status 1","event":"error","resource_id":1}
+{"time":"2017-06-01T12:00:01Z","level":"info","msg":"applied 1, changed 0, unchanged 0, failed 1, skipped 0 in 1.000s","event":"summary","summary":{"applied":1,"changed":0,"unchanged":0,"failed":1,"skipped":0,"duration":1000000000}}
+Connection to web1 closed.
+`
+	hr := parseExecLog([]byte(out))
+	wantSummary := &execlib.Summary{Applied: 1, Failed: 1, Duration: 1000000000}
+	if hr.Summary == nil || *hr.Summary != *wantSummary {
+		t.Errorf("Summary = %v; want %v", hr.Summary, wantSummary)
+	}
+	wantErrors := []string{"foo: exit status 1", "Connection to web1 closed."}
+	if !reflect.DeepEqual(hr.Errors, wantErrors) {
+		t.Errorf("Errors = %q; want %q", hr.Errors, wantErrors)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"", "''"},
+		{"mcm-exec", "mcm-exec"},
+		{"-log-format=json", "-log-format=json"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+	}
+	for _, test := range tests {
+		if got := shellQuote(test.s); got != test.want {
+			t.Errorf("shellQuote(%q) = %s; want %s", test.s, got, test.want)
+		}
+	}
+}
+
+func TestSSHRun(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh:", err)
+	}
+	dir, err := ioutil.TempDir("", "mcm-push-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The fake ssh saves the catalog and exits with the status in the
+	// host name.
+	ssh := filepath.Join(dir, "ssh")
+	script := "#!/bin/sh\n" +
+		"cat > " + filepath.Join(dir, "catalog") + "\n" +
+		"for arg; do addr=$status; status=$arg; done\n" +
+		"case $addr in\n" +
+		"ok) exit 0 ;;\n" +
+		"failed) echo '{\"level\":\"info\",\"event\":\"summary\",\"summary\":{\"applied\":1,\"failed\":1}}' >&2; exit 1 ;;\n" +
+		"*) echo 'ssh: connect to host unreachable' >&2; exit 255 ;;\n" +
+		"esac\n"
+	if err := ioutil.WriteFile(ssh, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := &SSH{Path: ssh}
+	tests := []struct {
+		name string
+		want HostStatus
+	}{
+		{"ok", HostOK},
+		{"failed", HostFailed},
+		{"unreachable", HostUnreachable},
+	}
+	for _, test := range tests {
+		hr := s.Run(context.Background(), &inventory.Host{Name: test.name}, []byte("catalog data"))
+		if hr.Status != test.want {
+			t.Errorf("Run(%s).Status = %q; want %q (errors: %q)", test.name, hr.Status, test.want, hr.Errors)
+		}
+		if test.want == HostUnreachable && len(hr.Errors) == 0 {
+			t.Errorf("Run(%s).Errors is empty", test.name)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "catalog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "catalog data" {
+		t.Errorf("ssh stdin = %q; want %q", data, "catalog data")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mcm-server serves catalogs generated from the facts that mcm-agent
+// hosts report.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/server/serverlib"
+)
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	name := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "usage: %s -facts_dir DIR (-generate COMMAND | -lua SCRIPT) [options]\n", name)
+	fmt.Fprintf(os.Stderr, "       %s -server URL hosts [failing RESOURCE | stale DURATION]\n", name)
+	flag.PrintDefaults()
+}
+
+func main() {
+	srv := &serverlib.Server{Log: logger{}}
+	addr := flag.String("http", ":8080", "address to listen on")
+	flag.StringVar(&srv.FactsDir, "facts_dir", "", "directory to store host facts in")
+	flag.StringVar(&srv.CatalogsDir, "catalogs_dir", "", "directory to keep recently served catalogs in, so that agents can be sent deltas")
+	flag.StringVar(&srv.ReportsDir, "reports_dir", "", "directory to store the run reports that agents send in")
+	flag.IntVar(&srv.KeepReports, "keep_reports", serverlib.DefaultKeepReports, "number of run reports to keep for each host in -reports_dir")
+	serverURL := flag.String("server", "", "URL of the mcm-server to query with the hosts command")
+	generate := flag.String("generate", "", "shell command that reads a host's facts on stdin and writes its catalog to stdout, with $MCM_HOST set")
+	lua := &serverlib.Lua{}
+	flag.StringVar(&lua.Script, "lua", "", "Lua script to run with mcm-luacat to generate catalogs; it can require \""+serverlib.FactsModule+"\"")
+	flag.StringVar(&lua.Luacat, "luacat", "mcm-luacat", "path to mcm-luacat")
+	flag.Var((*includesFlag)(&lua.Include), "I", "include path pattern to pass to mcm-luacat (repeatable)")
+	certPath := flag.String("tls_cert", "", "path to PEM-encoded certificate to serve HTTPS with")
+	keyPath := flag.String("tls_key", "", "path to PEM-encoded private key for -tls_cert")
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if flag.Arg(0) == "hosts" {
+		q, ok := parseHostQuery(flag.Args()[1:])
+		if !ok || *serverURL == "" {
+			usage()
+			os.Exit(2)
+		}
+		if err := printHosts(context.Background(), *serverURL, q); err != nil {
+			die(err)
+		}
+		return
+	}
+	if srv.FactsDir == "" || (*generate == "") == (lua.Script == "") || flag.NArg() > 0 {
+		usage()
+		os.Exit(2)
+	}
+	if (*certPath == "") != (*keyPath == "") {
+		die(errors.New("-tls_cert and -tls_key must be used together"))
+	}
+	if *generate != "" {
+		srv.Generator = &serverlib.Command{Command: *generate}
+	} else {
+		srv.Generator = lua
+	}
+	if err := os.MkdirAll(srv.FactsDir, 0700); err != nil {
+		die(err)
+	}
+	if srv.ReportsDir != "" {
+		if err := os.MkdirAll(srv.ReportsDir, 0700); err != nil {
+			die(err)
+		}
+	}
+	hs := &http.Server{Addr: *addr, Handler: srv}
+	var err error
+	if *certPath != "" {
+		err = hs.ListenAndServeTLS(*certPath, *keyPath)
+	} else {
+		err = hs.ListenAndServe()
+	}
+	die(err)
+}
+
+// parseHostQuery parses the arguments of the hosts command.
+func parseHostQuery(args []string) (q serverlib.HostQuery, ok bool) {
+	switch {
+	case len(args) == 0:
+		return q, true
+	case len(args) == 2 && args[0] == "failing":
+		q.Failing = args[1]
+		return q, true
+	case len(args) == 2 && args[0] == "stale":
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return q, false
+		}
+		q.Stale = d
+		return q, true
+	default:
+		return q, false
+	}
+}
+
+// printHosts prints a table of the hosts that match q.
+func printHosts(ctx context.Context, serverURL string, q serverlib.HostQuery) error {
+	hosts, err := serverlib.QueryHosts(ctx, nil, serverURL, q)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tLAST REPORT\tSTATUS\tFAILED")
+	for _, hs := range hosts {
+		last, status := "never", hs.Status
+		if !hs.LastReport.IsZero() {
+			last = hs.LastReport.Local().Format("2006-01-02 15:04:05")
+		}
+		if status == "" {
+			status = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", hs.Host, last, status, strings.Join(hs.Failed, " "))
+	}
+	return tw.Flush()
+}
+
+type includesFlag []string
+
+func (f *includesFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *includesFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+type logger struct{}
+
+func (logger) Error(ctx context.Context, err error) {
+	var line bytes.Buffer
+	line.WriteString("mcm-server: ")
+	line.WriteString(time.Now().Format("2006-01-02T15:04:05"))
+	line.WriteString(" ERROR: ")
+	line.WriteString(err.Error())
+	line.WriteByte('\n')
+	os.Stderr.Write(line.Bytes())
+}
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, "mcm-server:", err)
+	os.Exit(1)
+}
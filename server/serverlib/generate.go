@@ -0,0 +1,196 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serverlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Generator produces the catalog for a host.  facts is the JSON
+// object that the host last reported, or "{}" if it has not reported
+// any.  The returned catalog is the serialized catalog file.
+type Generator interface {
+	Generate(ctx context.Context, host string, facts []byte) ([]byte, error)
+}
+
+// Command is a Generator that runs a shell command.  The command gets
+// the facts on standard input and the host name in $MCM_HOST, and it
+// writes the catalog to standard output.
+type Command struct {
+	// Shell is the path of the shell that runs Command.  If empty,
+	// then /bin/sh is used.
+	Shell   string
+	Command string
+}
+
+// Generate runs the command.
+func (c *Command) Generate(ctx context.Context, host string, facts []byte) ([]byte, error) {
+	shell := c.Shell
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	cmd := exec.CommandContext(ctx, shell, "-c", c.Command)
+	cmd.Env = append(os.Environ(), "MCM_HOST="+host)
+	cmd.Stdin = bytes.NewReader(facts)
+	return output(cmd)
+}
+
+// Lua is a Generator that runs a Lua script with mcm-luacat.  The
+// script can load the facts as a table with require "mcm_facts"; the
+// table's host field is the host name.
+type Lua struct {
+	// Luacat is the path of mcm-luacat.  If empty, then mcm-luacat is
+	// searched for in PATH.
+	Luacat string
+
+	Script string
+
+	// Include are extra -I patterns for mcm-luacat.
+	Include []string
+}
+
+// FactsModule is the name that Lua scripts require to get the facts.
+const FactsModule = "mcm_facts"
+
+// Generate runs the script.
+func (l *Lua) Generate(ctx context.Context, host string, facts []byte) ([]byte, error) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(facts, &m); err != nil {
+		return nil, fmt.Errorf("read facts: %v", err)
+	}
+	m["host"] = host
+	dir, err := ioutil.TempDir("", "mcm-server")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	buf := new(bytes.Buffer)
+	buf.WriteString("return ")
+	if err := writeLua(buf, m); err != nil {
+		return nil, fmt.Errorf("convert facts to Lua: %v", err)
+	}
+	buf.WriteString("\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, FactsModule+".lua"), buf.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	luacat := l.Luacat
+	if luacat == "" {
+		luacat = "mcm-luacat"
+	}
+	args := []string{"-I", filepath.Join(dir, "?.lua")}
+	for _, inc := range l.Include {
+		args = append(args, "-I", inc)
+	}
+	args = append(args, l.Script)
+	return output(exec.CommandContext(ctx, luacat, args...))
+}
+
+// output runs cmd and returns its standard output, including its
+// standard error in any error.
+func output(cmd *exec.Cmd) ([]byte, error) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// writeLua writes a JSON value decoded into an interface{} as a Lua
+// expression.  Objects become tables with string keys, arrays become
+// sequences, and null becomes nil.
+func writeLua(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("nil")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return errors.New("number out of range")
+		}
+		buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	case string:
+		writeLuaString(buf, v)
+	case []interface{}:
+		buf.WriteString("{")
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			if err := writeLua(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString("[")
+			writeLuaString(buf, k)
+			buf.WriteString("] = ")
+			if err := writeLua(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+// writeLuaString writes s as a double-quoted Lua string, escaping every
+// byte that isn't printable ASCII.
+func writeLuaString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(buf, "\\%03d", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+}
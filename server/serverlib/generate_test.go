@@ -0,0 +1,108 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serverlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh:", err)
+	}
+	c := &Command{Command: `echo "host=$MCM_HOST"; cat`}
+	out, err := c.Generate(context.Background(), "web1", []byte(`{"os":"linux"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), "host=web1\n{\"os\":\"linux\"}"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+
+	c = &Command{Command: `echo "no catalog" 1>&2; exit 1`}
+	_, err = c.Generate(context.Background(), "web1", []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "no catalog") {
+		t.Errorf("failing command error = %v; want to contain \"no catalog\"", err)
+	}
+}
+
+func TestWriteLua(t *testing.T) {
+	tests := []struct {
+		json string
+		lua  string
+	}{
+		{json: `null`, lua: `nil`},
+		{json: `true`, lua: `true`},
+		{json: `42`, lua: `42`},
+		{json: `1.5`, lua: `1.5`},
+		{json: `"hi"`, lua: `"hi"`},
+		{json: `"a\"b\\c\nd"`, lua: `"a\"b\\c\010d"`},
+		{json: `"é"`, lua: `"\195\169"`},
+		{json: `[]`, lua: `{}`},
+		{json: `[1, "x"]`, lua: `{1, "x"}`},
+		{json: `{"b": 2, "a": {"c": false}}`, lua: `{["a"] = {["c"] = false}, ["b"] = 2}`},
+	}
+	for _, test := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(test.json), &v); err != nil {
+			t.Errorf("%s: %v", test.json, err)
+			continue
+		}
+		buf := new(bytes.Buffer)
+		if err := writeLua(buf, v); err != nil {
+			t.Errorf("writeLua(%s): %v", test.json, err)
+			continue
+		}
+		if buf.String() != test.lua {
+			t.Errorf("writeLua(%s) = %s; want %s", test.json, buf, test.lua)
+		}
+	}
+}
+
+func TestLua(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh:", err)
+	}
+	dir, err := ioutil.TempDir("", "serverlib_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The fake mcm-luacat prints its arguments and the facts module.
+	luacat := filepath.Join(dir, "mcm-luacat")
+	script := "#!/bin/sh\n" +
+		"echo \"$3 $4 $5\"\n" +
+		"cat \"$(dirname \"$2\")/mcm_facts.lua\"\n"
+	if err := ioutil.WriteFile(luacat, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	l := &Lua{Luacat: luacat, Script: "site.lua", Include: []string{"lib/?.lua"}}
+	out, err := l.Generate(context.Background(), "web1", []byte(`{"os":"linux"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-I lib/?.lua site.lua\n" +
+		`return {["host"] = "web1", ["os"] = "linux"}` + "\n"
+	if string(out) != want {
+		t.Errorf("output = %q; want %q", out, want)
+	}
+}
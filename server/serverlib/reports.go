@@ -0,0 +1,391 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serverlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxReportSize is the largest run report that a Server accepts.
+const MaxReportSize = 16 << 20
+
+// DefaultKeepReports is the number of reports kept for each host by a
+// Server with a non-positive KeepReports.
+const DefaultKeepReports = 10
+
+// reportIDFormat is the time layout of stored report file names.  Names
+// sort in the order the reports were received.
+const reportIDFormat = "20060102T150405.000000000Z"
+
+// report is the part of an agent's run report (an execlib.Report) that
+// a Server queries.  Reports are stored as they were received.
+type report struct {
+	Start     time.Time         `json:"start"`
+	End       time.Time         `json:"end"`
+	RunID     string            `json:"run_id,omitempty"`
+	Resources []*resourceReport `json:"resources"`
+}
+
+type resourceReport struct {
+	ID      uint64 `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// matches reports whether the resource is named res or has the decimal
+// ID res.
+func (rr *resourceReport) matches(res string) bool {
+	return rr.Name == res || strconv.FormatUint(rr.ID, 10) == res
+}
+
+// label returns the resource's name, or its ID if it has none.
+func (rr *resourceReport) label() string {
+	if rr.Name != "" {
+		return rr.Name
+	}
+	return strconv.FormatUint(rr.ID, 10)
+}
+
+// HostStatus is the outcome of a host's most recent run.
+type HostStatus struct {
+	Host string `json:"host"`
+
+	// LastReport is the end time of the host's most recent run, or zero
+	// if the host has reported facts but no runs.
+	LastReport time.Time `json:"last_report,omitempty"`
+	RunID      string    `json:"run_id,omitempty"`
+
+	// Status is "failed" if any resource failed in the run, "changed"
+	// if any changed, "unchanged" otherwise, or empty if the host has
+	// not reported a run.
+	Status string `json:"status,omitempty"`
+
+	// Failed lists the names (or IDs, for unnamed resources) of the
+	// resources that failed in the run.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// A HostQuery selects hosts by their most recent run.  The zero value
+// selects every host.
+type HostQuery struct {
+	// Failing selects hosts in whose most recent run the resource with
+	// this name or ID failed, if non-empty.
+	Failing string
+
+	// Stale selects hosts that have not reported a run within this
+	// duration, including hosts that reported facts but never a run, if
+	// positive.
+	Stale time.Duration
+}
+
+// values returns the query as URL query parameters.
+func (q HostQuery) values() url.Values {
+	v := make(url.Values)
+	if q.Failing != "" {
+		v.Set("failing", q.Failing)
+	}
+	if q.Stale > 0 {
+		v.Set("stale", q.Stale.String())
+	}
+	return v
+}
+
+func (srv *Server) serveReports(w http.ResponseWriter, r *http.Request, host string) {
+	if srv.ReportsDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		srv.postReport(w, r, host)
+	case http.MethodGet, http.MethodHead:
+		srv.getReport(w, r, host)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (srv *Server) postReport(w http.ResponseWriter, r *http.Request, host string) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxReportSize+1))
+	if err != nil {
+		http.Error(w, "read report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > MaxReportSize {
+		http.Error(w, "report too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := json.Unmarshal(data, new(report)); err != nil {
+		http.Error(w, "report must be a JSON run report", http.StatusBadRequest)
+		return
+	}
+	if err := srv.storeReport(host, data); err != nil {
+		srv.logError(r.Context(), fmt.Errorf("store report for %s: %v", host, err))
+		http.Error(w, "could not store report", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// storeReport adds a report to the host's report directory, then
+// removes all but the most recent ones.
+func (srv *Server) storeReport(host string, data []byte) error {
+	dir := filepath.Join(srv.ReportsDir, host)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	id := time.Now().UTC().Format(reportIDFormat)
+	if err := writeFileAtomic(filepath.Join(dir, id+".json"), data); err != nil {
+		return err
+	}
+	ids, err := reportIDs(dir)
+	if err != nil {
+		return err
+	}
+	keep := srv.KeepReports
+	if keep <= 0 {
+		keep = DefaultKeepReports
+	}
+	for len(ids) > keep {
+		if err := os.Remove(filepath.Join(dir, ids[0]+".json")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+// reportIDs returns the IDs of the reports in dir, oldest first.
+func reportIDs(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// latestReport returns the host's most recent report, or nil if it has
+// none.
+func (srv *Server) latestReport(host string) ([]byte, error) {
+	dir := filepath.Join(srv.ReportsDir, host)
+	ids, err := reportIDs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read reports for %s: %v", host, err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ids[len(ids)-1]+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("read reports for %s: %v", host, err)
+	}
+	return data, nil
+}
+
+func (srv *Server) getReport(w http.ResponseWriter, r *http.Request, host string) {
+	data, err := srv.latestReport(host)
+	if err != nil {
+		srv.logError(r.Context(), err)
+		http.Error(w, "could not read report", http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (srv *Server) getHosts(w http.ResponseWriter, r *http.Request) {
+	if srv.ReportsDir == "" {
+		http.NotFound(w, r)
+		return
+	}
+	var q HostQuery
+	q.Failing = r.URL.Query().Get("failing")
+	if s := r.URL.Query().Get("stale"); s != "" {
+		var err error
+		q.Stale, err = time.ParseDuration(s)
+		if err != nil || q.Stale <= 0 {
+			http.Error(w, "stale must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	hosts, err := srv.Hosts(q, time.Now())
+	if err != nil {
+		srv.logError(r.Context(), err)
+		http.Error(w, "could not read reports", http.StatusInternalServerError)
+		return
+	}
+	if hosts == nil {
+		hosts = []*HostStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hosts)
+}
+
+// Hosts returns the status of the hosts that match q, sorted by name.
+// The hosts are those that have reported facts or runs.  now is the
+// time that q.Stale is measured from.
+func (srv *Server) Hosts(q HostQuery, now time.Time) ([]*HostStatus, error) {
+	names, err := srv.hostNames()
+	if err != nil {
+		return nil, err
+	}
+	var hosts []*HostStatus
+	for _, host := range names {
+		hs, rep, err := srv.hostStatus(host)
+		if err != nil {
+			return nil, err
+		}
+		if q.Stale > 0 && !hs.LastReport.IsZero() && now.Sub(hs.LastReport) < q.Stale {
+			continue
+		}
+		if q.Failing != "" && !failed(rep, q.Failing) {
+			continue
+		}
+		hosts = append(hosts, hs)
+	}
+	return hosts, nil
+}
+
+// hostNames returns the hosts with facts or reports, sorted.
+func (srv *Server) hostNames() ([]string, error) {
+	seen := make(map[string]struct{})
+	if infos, err := ioutil.ReadDir(srv.FactsDir); err == nil {
+		for _, info := range infos {
+			name := info.Name()
+			if info.Mode().IsRegular() && strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".") {
+				seen[strings.TrimSuffix(name, ".json")] = struct{}{}
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("list hosts: %v", err)
+	}
+	if infos, err := ioutil.ReadDir(srv.ReportsDir); err == nil {
+		for _, info := range infos {
+			if info.IsDir() && validHost(info.Name()) {
+				seen[info.Name()] = struct{}{}
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("list hosts: %v", err)
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// hostStatus summarizes the host's most recent report.  The report is
+// nil if the host has none.
+func (srv *Server) hostStatus(host string) (*HostStatus, *report, error) {
+	hs := &HostStatus{Host: host}
+	data, err := srv.latestReport(host)
+	if err != nil || data == nil {
+		return hs, nil, err
+	}
+	rep := new(report)
+	if err := json.Unmarshal(data, rep); err != nil {
+		return nil, nil, fmt.Errorf("read reports for %s: %v", host, err)
+	}
+	hs.LastReport = rep.End
+	hs.RunID = rep.RunID
+	hs.Status = "unchanged"
+	for _, rr := range rep.Resources {
+		switch rr.Status {
+		case "failed":
+			hs.Status = "failed"
+			hs.Failed = append(hs.Failed, rr.label())
+		case "changed":
+			if hs.Status == "unchanged" {
+				hs.Status = "changed"
+			}
+		}
+	}
+	return hs, rep, nil
+}
+
+// failed reports whether the resource res failed in rep.
+func failed(rep *report, res string) bool {
+	if rep == nil {
+		return false
+	}
+	for _, rr := range rep.Resources {
+		if rr.Status == "failed" && rr.matches(res) {
+			return true
+		}
+	}
+	return false
+}
+
+// QueryHosts asks the server at serverURL for the hosts that match q.
+// If client is nil, then http.DefaultClient is used.
+func QueryHosts(ctx context.Context, client *http.Client, serverURL string, q HostQuery) ([]*HostStatus, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	u := strings.TrimSuffix(serverURL, "/") + "/hosts"
+	if v := q.values(); len(v) > 0 {
+		u += "?" + v.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("query hosts: %v", err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("query hosts: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("query hosts: server returned %s", resp.Status)
+	}
+	var hosts []*HostStatus
+	if err := json.NewDecoder(resp.Body).Decode(&hosts); err != nil {
+		return nil, fmt.Errorf("query hosts: %v", err)
+	}
+	return hosts, nil
+}
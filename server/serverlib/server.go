@@ -0,0 +1,363 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package serverlib serves catalogs generated from the facts that hosts
+// report and collects the reports of their runs, for mcm-server.
+package serverlib
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/delta"
+)
+
+// Server is an HTTP handler that stores host facts and serves the
+// catalogs generated from them:
+//
+//	PUT /facts/HOST     store HOST's facts (a JSON object)
+//	GET /facts/HOST     return HOST's stored facts
+//	GET /catalog/HOST   generate and return HOST's catalog
+//	POST /reports/HOST  store a report of a run on HOST
+//	GET /reports/HOST   return HOST's most recent report
+//	GET /hosts          list hosts and the outcome of their last run
+//
+// The report endpoints are only served if ReportsDir is set.  /hosts
+// takes the parameters failing=RESOURCE and stale=DURATION to select
+// hosts as in HostQuery.
+//
+// Catalog responses have an ETag of the catalog's SHA-256, so agents'
+// conditional requests avoid transferring an unchanged catalog.  If
+// CatalogsDir is set, then a request that names an earlier catalog in
+// If-None-Match and accepts the delta.Encoding instance manipulation
+// (A-IM: mcm-delta) is answered with a 226 IM Used response holding a
+// delta from the earlier catalog to the new one.
+type Server struct {
+	// FactsDir is the directory that facts are stored in, as
+	// HOST.json files.
+	FactsDir string
+
+	// CatalogsDir is the directory that recently served catalogs are
+	// kept in to compute deltas from, as HOST/SHA256 files.  If empty,
+	// then full catalogs are always sent.
+	CatalogsDir string
+
+	// ReportsDir is the directory that the run reports that agents
+	// send are stored in, as HOST/ID.json files.  If empty, then
+	// reports are not accepted.
+	ReportsDir string
+
+	// KeepReports is the number of reports to keep for each host.  If
+	// non-positive, then DefaultKeepReports are kept.
+	KeepReports int
+
+	Generator Generator
+
+	// Log receives errors if non-nil.
+	Log Logger
+}
+
+// Logger collects errors from a Server.  A Logger must be safe to call
+// from multiple goroutines.
+type Logger interface {
+	Error(ctx context.Context, err error)
+}
+
+// MaxFactsSize is the largest facts upload that a Server accepts.
+const MaxFactsSize = 1 << 20
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/facts/"):
+		host := strings.TrimPrefix(r.URL.Path, "/facts/")
+		if !validHost(host) {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			srv.putFacts(w, r, host)
+		case http.MethodGet, http.MethodHead:
+			srv.getFacts(w, r, host)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(r.URL.Path, "/catalog/"):
+		host := strings.TrimPrefix(r.URL.Path, "/catalog/")
+		if !validHost(host) {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		srv.getCatalog(w, r, host)
+	case strings.HasPrefix(r.URL.Path, "/reports/"):
+		host := strings.TrimPrefix(r.URL.Path, "/reports/")
+		if !validHost(host) {
+			http.NotFound(w, r)
+			return
+		}
+		srv.serveReports(w, r, host)
+	case r.URL.Path == "/hosts":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		srv.getHosts(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// validHost reports whether host is usable as a file name.
+func validHost(host string) bool {
+	return host != "" && host != "." && host != ".." && !strings.ContainsAny(host, "/\\\x00")
+}
+
+func (srv *Server) putFacts(w http.ResponseWriter, r *http.Request, host string) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxFactsSize+1))
+	if err != nil {
+		http.Error(w, "read facts: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > MaxFactsSize {
+		http.Error(w, "facts too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		http.Error(w, "facts must be a JSON object", http.StatusBadRequest)
+		return
+	}
+	if err := writeFileAtomic(srv.factsPath(host), data); err != nil {
+		srv.logError(r.Context(), fmt.Errorf("store facts for %s: %v", host, err))
+		http.Error(w, "could not store facts", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *Server) getFacts(w http.ResponseWriter, r *http.Request, host string) {
+	data, err := srv.readFacts(host)
+	if err != nil {
+		srv.logError(r.Context(), err)
+		http.Error(w, "could not read facts", http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func (srv *Server) getCatalog(w http.ResponseWriter, r *http.Request, host string) {
+	ctx := r.Context()
+	facts, err := srv.readFacts(host)
+	if err != nil {
+		srv.logError(ctx, err)
+		http.Error(w, "could not read facts", http.StatusInternalServerError)
+		return
+	}
+	if facts == nil {
+		// The host hasn't reported yet, which generators can check for.
+		facts = []byte("{}")
+	}
+	cat, err := srv.Generator.Generate(ctx, host, facts)
+	if err != nil {
+		srv.logError(ctx, fmt.Errorf("generate catalog for %s: %v", host, err))
+		http.Error(w, "could not generate catalog", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(cat)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", etag)
+	if srv.CatalogsDir != "" {
+		if err := srv.keepCatalog(host, hex.EncodeToString(sum[:]), cat); err != nil {
+			srv.logError(ctx, fmt.Errorf("keep catalog for %s: %v", host, err))
+		}
+		w.Header().Add("Vary", "A-IM")
+		if base := deltaBase(r); base != "" && base != etag {
+			if d := srv.delta(host, base, cat); d != nil {
+				w.Header().Set("IM", delta.Encoding)
+				w.Header().Set("Delta-Base", base)
+				w.Header().Set("Content-Length", strconv.Itoa(len(d)))
+				w.WriteHeader(http.StatusIMUsed)
+				if r.Method != http.MethodHead {
+					w.Write(d)
+				}
+				return
+			}
+		}
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(cat))
+}
+
+// keptCatalogs is the number of catalogs kept for each host in
+// Server.CatalogsDir.  Keeping more than one lets an agent whose last
+// fetch failed partway still receive a delta.
+const keptCatalogs = 4
+
+// keepCatalog stores cat in the host's catalog directory, then removes
+// all but the most recently served catalogs.
+func (srv *Server) keepCatalog(host string, sum string, cat []byte) error {
+	dir := filepath.Join(srv.CatalogsDir, host)
+	path := filepath.Join(dir, sum)
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, cat); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sort.Sort(newestFirst(infos))
+	for i, info := range infos {
+		if i < keptCatalogs || !validSum(info.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type newestFirst []os.FileInfo
+
+func (a newestFirst) Len() int           { return len(a) }
+func (a newestFirst) Less(i, j int) bool { return a[i].ModTime().After(a[j].ModTime()) }
+func (a newestFirst) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// delta returns a delta from the kept catalog with the given ETag to
+// cat, or nil if the catalog isn't kept or the delta isn't smaller.
+func (srv *Server) delta(host string, etag string, cat []byte) []byte {
+	sum := strings.Trim(etag, `"`)
+	if !validSum(sum) {
+		return nil
+	}
+	old, err := ioutil.ReadFile(filepath.Join(srv.CatalogsDir, host, sum))
+	if err != nil {
+		return nil
+	}
+	d := delta.Diff(old, cat)
+	if len(d) >= len(cat) {
+		return nil
+	}
+	return d
+}
+
+// deltaBase returns the ETag that a request wants a delta from, or the
+// empty string if the request doesn't accept deltas.
+func deltaBase(r *http.Request) string {
+	accepted := false
+	for _, im := range strings.Split(r.Header.Get("A-IM"), ",") {
+		if i := strings.IndexByte(im, ';'); i >= 0 {
+			im = im[:i]
+		}
+		if strings.TrimSpace(im) == delta.Encoding {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		return ""
+	}
+	etag := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if strings.Contains(etag, ",") || !strings.HasPrefix(etag, `"`) {
+		return ""
+	}
+	return etag
+}
+
+// validSum reports whether s is a hex-encoded SHA-256.
+func validSum(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func (srv *Server) factsPath(host string) string {
+	return filepath.Join(srv.FactsDir, host+".json")
+}
+
+// readFacts returns the stored facts for host, or nil if there are
+// none.
+func (srv *Server) readFacts(host string) ([]byte, error) {
+	data, err := ioutil.ReadFile(srv.factsPath(host))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read facts for %s: %v", host, err)
+	}
+	return data, nil
+}
+
+func (srv *Server) logError(ctx context.Context, err error) {
+	if srv.Log != nil {
+		srv.Log.Error(ctx, err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory
+// as path, then renames it into place.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+// Copyright 2017 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serverlib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zombiezen/mcm/internal/delta"
+)
+
+type fakeGenerator struct {
+	host  string
+	facts string
+	err   error
+
+	// catalog is returned instead of the default if non-empty.
+	catalog string
+}
+
+func (g *fakeGenerator) Generate(ctx context.Context, host string, facts []byte) ([]byte, error) {
+	g.host, g.facts = host, string(facts)
+	if g.err != nil {
+		return nil, g.err
+	}
+	if g.catalog != "" {
+		return []byte(g.catalog), nil
+	}
+	return []byte("catalog for " + host), nil
+}
+
+func newTestServer(t *testing.T) (srv *Server, gen *fakeGenerator, cleanup func()) {
+	dir, err := ioutil.TempDir("", "serverlib_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen = new(fakeGenerator)
+	return &Server{FactsDir: dir, Generator: gen}, gen, func() { os.RemoveAll(dir) }
+}
+
+func serve(srv *Server, method, path string, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	return w
+}
+
+func TestFacts(t *testing.T) {
+	srv, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if w := serve(srv, "GET", "/facts/web1", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET before PUT = %d; want %d", w.Code, http.StatusNotFound)
+	}
+	const facts = `{"hostname":"web1","cpus":4}`
+	if w := serve(srv, "PUT", "/facts/web1", facts, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT = %d %q; want %d", w.Code, w.Body.String(), http.StatusNoContent)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(srv.FactsDir, "web1.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != facts {
+		t.Errorf("stored facts = %q; want %q", data, facts)
+	}
+	w := serve(srv, "GET", "/facts/web1", "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != facts {
+		t.Errorf("GET = %d %q; want %d %q", w.Code, w.Body.String(), http.StatusOK, facts)
+	}
+}
+
+func TestFactsRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{name: "not JSON", method: "PUT", path: "/facts/web1", body: "hello", code: http.StatusBadRequest},
+		{name: "not object", method: "PUT", path: "/facts/web1", body: "[1, 2]", code: http.StatusBadRequest},
+		{name: "too large", method: "PUT", path: "/facts/web1", body: `{"x":"` + strings.Repeat("x", MaxFactsSize) + `"}`, code: http.StatusRequestEntityTooLarge},
+		{name: "dot dot", method: "PUT", path: "/facts/..", body: "{}", code: http.StatusNotFound},
+		{name: "slash", method: "PUT", path: "/facts/a/b", body: "{}", code: http.StatusNotFound},
+		{name: "empty", method: "PUT", path: "/facts/", body: "{}", code: http.StatusNotFound},
+		{name: "POST", method: "POST", path: "/facts/web1", body: "{}", code: http.StatusMethodNotAllowed},
+		{name: "unknown path", method: "GET", path: "/foo", code: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		srv, _, cleanup := newTestServer(t)
+		w := serve(srv, test.method, test.path, test.body, nil)
+		if w.Code != test.code {
+			t.Errorf("%s: %s %s = %d; want %d", test.name, test.method, test.path, w.Code, test.code)
+		}
+		infos, err := ioutil.ReadDir(srv.FactsDir)
+		if err != nil {
+			t.Error(err)
+		} else if len(infos) > 0 {
+			t.Errorf("%s: %d files in facts directory; want 0", test.name, len(infos))
+		}
+		cleanup()
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	srv, gen, cleanup := newTestServer(t)
+	defer cleanup()
+
+	w := serve(srv, "GET", "/catalog/web1", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET before facts = %d %q; want %d", w.Code, w.Body.String(), http.StatusOK)
+	}
+	if gen.host != "web1" || gen.facts != "{}" {
+		t.Errorf("Generate(%q, %q); want Generate(\"web1\", \"{}\")", gen.host, gen.facts)
+	}
+	if got, want := w.Body.String(), "catalog for web1"; got != want {
+		t.Errorf("body = %q; want %q", got, want)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	const facts = `{"os":"linux"}`
+	serve(srv, "PUT", "/facts/web1", facts, nil)
+	w = serve(srv, "GET", "/catalog/web1", "", nil)
+	if gen.facts != facts {
+		t.Errorf("Generate facts = %q; want %q", gen.facts, facts)
+	}
+
+	w = serve(srv, "GET", "/catalog/web1", "", http.Header{"If-None-Match": {etag}})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("GET with If-None-Match = %d; want %d", w.Code, http.StatusNotModified)
+	}
+	if w.Body.Len() > 0 {
+		t.Errorf("GET with If-None-Match body = %q; want empty", w.Body.String())
+	}
+}
+
+func TestCatalogDelta(t *testing.T) {
+	srv, gen, cleanup := newTestServer(t)
+	defer cleanup()
+	srv.CatalogsDir = filepath.Join(srv.FactsDir, "catalogs")
+	old := strings.Repeat("resource with some content\n", 100)
+	gen.catalog = old
+	w := serve(srv, "GET", "/catalog/web1", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET = %d %q; want %d", w.Code, w.Body.String(), http.StatusOK)
+	}
+	oldTag := w.Header().Get("ETag")
+
+	gen.catalog = strings.Replace(old, "some", "other", 1)
+	w = serve(srv, "GET", "/catalog/web1", "", http.Header{
+		"A-Im":          {delta.Encoding},
+		"If-None-Match": {oldTag},
+	})
+	if w.Code != http.StatusIMUsed {
+		t.Fatalf("GET with delta = %d %q; want %d", w.Code, w.Body.String(), http.StatusIMUsed)
+	}
+	if im := w.Header().Get("IM"); im != delta.Encoding {
+		t.Errorf("IM = %q; want %q", im, delta.Encoding)
+	}
+	if w.Body.Len() >= len(gen.catalog) {
+		t.Errorf("delta is %d bytes; want less than the catalog's %d", w.Body.Len(), len(gen.catalog))
+	}
+	got, err := delta.Patch([]byte(old), w.Body.Bytes())
+	if err != nil {
+		t.Fatal("delta.Patch:", err)
+	}
+	if string(got) != gen.catalog {
+		t.Errorf("patched catalog = %q; want %q", got, gen.catalog)
+	}
+
+	// Full catalogs are sent for unknown bases and to clients that don't
+	// accept deltas.
+	w = serve(srv, "GET", "/catalog/web1", "", http.Header{
+		"A-Im":          {delta.Encoding},
+		"If-None-Match": {`"0000000000000000000000000000000000000000000000000000000000000000"`},
+	})
+	if w.Code != http.StatusOK || w.Body.String() != gen.catalog {
+		t.Errorf("GET with unknown base = %d %q; want %d %q", w.Code, w.Body.String(), http.StatusOK, gen.catalog)
+	}
+	w = serve(srv, "GET", "/catalog/web1", "", http.Header{"If-None-Match": {oldTag}})
+	if w.Code != http.StatusOK || w.Body.String() != gen.catalog {
+		t.Errorf("GET without A-IM = %d %q; want %d %q", w.Code, w.Body.String(), http.StatusOK, gen.catalog)
+	}
+
+	for i := 0; i < keptCatalogs+2; i++ {
+		gen.catalog = fmt.Sprintf("catalog %d", i)
+		serve(srv, "GET", "/catalog/web1", "", nil)
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(srv.CatalogsDir, "web1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != keptCatalogs {
+		t.Errorf("%d catalogs kept; want %d", len(infos), keptCatalogs)
+	}
+}
+
+func TestCatalogError(t *testing.T) {
+	srv, gen, cleanup := newTestServer(t)
+	defer cleanup()
+	gen.err = errors.New("bork")
+	var logged []error
+	srv.Log = logFunc(func(ctx context.Context, err error) { logged = append(logged, err) })
+
+	w := serve(srv, "GET", "/catalog/web1", "", nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("GET = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("bork")) {
+		t.Errorf("body = %q; should not include generator error", w.Body.String())
+	}
+	if len(logged) != 1 || !strings.Contains(logged[0].Error(), "bork") {
+		t.Errorf("logged %v; want one error containing \"bork\"", logged)
+	}
+}
+
+func TestReports(t *testing.T) {
+	srv, _, cleanup := newTestServer(t)
+	defer cleanup()
+	if w := serve(srv, "POST", "/reports/web1", "{}", nil); w.Code != http.StatusNotFound {
+		t.Errorf("POST without ReportsDir = %d; want %d", w.Code, http.StatusNotFound)
+	}
+	srv.ReportsDir = filepath.Join(srv.FactsDir, "reports")
+	srv.KeepReports = 2
+
+	serve(srv, "PUT", "/facts/db1", "{}", nil)
+	const web1Report = `{"start":"2017-06-01T10:00:00Z","end":"2017-06-01T10:01:00Z","run_id":"r2","resources":[` +
+		`{"id":1,"name":"motd","status":"changed"},{"id":2,"name":"nginx","status":"failed","error":"exit status 1"},{"id":3,"status":"failed"}]}`
+	reports := []struct {
+		host string
+		body string
+	}{
+		{"web1", `{"start":"2017-05-01T10:00:00Z","end":"2017-05-01T10:01:00Z","run_id":"r1","resources":[{"id":2,"name":"nginx","status":"changed"}]}`},
+		{"web1", `{"start":"2017-05-31T10:00:00Z","end":"2017-05-31T10:01:00Z","run_id":"r1","resources":[]}`},
+		{"web1", web1Report},
+		{"web2", `{"start":"2017-05-01T10:00:00Z","end":"2017-05-01T10:01:00Z","run_id":"r3","resources":[{"id":1,"name":"motd","status":"unchanged"}]}`},
+	}
+	for _, rep := range reports {
+		if w := serve(srv, "POST", "/reports/"+rep.host, rep.body, nil); w.Code != http.StatusNoContent {
+			t.Fatalf("POST /reports/%s = %d %q; want %d", rep.host, w.Code, w.Body.String(), http.StatusNoContent)
+		}
+	}
+	if w := serve(srv, "POST", "/reports/web1", "hello", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("POST non-JSON report = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := serve(srv, "GET", "/reports/web1", "", nil); w.Code != http.StatusOK || w.Body.String() != web1Report {
+		t.Errorf("GET /reports/web1 = %d %q; want %d %q", w.Code, w.Body.String(), http.StatusOK, web1Report)
+	}
+	infos, err := ioutil.ReadDir(filepath.Join(srv.ReportsDir, "web1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != srv.KeepReports {
+		t.Errorf("%d reports kept; want %d", len(infos), srv.KeepReports)
+	}
+
+	now := time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		q    HostQuery
+		want []string
+	}{
+		{HostQuery{}, []string{"db1", "web1", "web2"}},
+		{HostQuery{Failing: "nginx"}, []string{"web1"}},
+		{HostQuery{Failing: "3"}, []string{"web1"}},
+		{HostQuery{Failing: "motd"}, nil},
+		{HostQuery{Stale: 24 * time.Hour}, []string{"db1", "web2"}},
+	}
+	for _, test := range tests {
+		hosts, err := srv.Hosts(test.q, now)
+		if err != nil {
+			t.Errorf("Hosts(%+v): %v", test.q, err)
+			continue
+		}
+		var got []string
+		for _, hs := range hosts {
+			got = append(got, hs.Host)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Hosts(%+v) = %q; want %q", test.q, got, test.want)
+		}
+	}
+	hosts, _ := srv.Hosts(HostQuery{Failing: "nginx"}, now)
+	if len(hosts) == 1 {
+		hs := hosts[0]
+		if hs.Status != "failed" || hs.RunID != "r2" || !reflect.DeepEqual(hs.Failed, []string{"nginx", "3"}) {
+			t.Errorf("web1 status = %+v; want failed run r2 with nginx and 3 failed", hs)
+		}
+	}
+
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+	got, err := QueryHosts(context.Background(), http.DefaultClient, hs.URL, HostQuery{Failing: "nginx"})
+	if err != nil {
+		t.Fatal("QueryHosts:", err)
+	}
+	if len(got) != 1 || got[0].Host != "web1" {
+		t.Errorf("QueryHosts(failing nginx) = %+v; want web1", got)
+	}
+}
+
+type logFunc func(ctx context.Context, err error)
+
+func (f logFunc) Error(ctx context.Context, err error) {
+	f(ctx, err)
+}
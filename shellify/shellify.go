@@ -59,13 +59,12 @@ func readCatalogArg() (catalog.Catalog, error) {
 	case 0:
 		return readCatalog(os.Stdin)
 	case 1:
-		// TODO(someday): read segments lazily
-		f, err := os.Open(flag.Arg(0))
+		// The file stays mapped until mcm-shellify exits.
+		f, err := catalog.OpenFile(flag.Arg(0))
 		if err != nil {
 			return catalog.Catalog{}, err
 		}
-		defer f.Close()
-		return readCatalog(f)
+		return f.Catalog, nil
 	default:
 		usage()
 		os.Exit(2)
@@ -24,6 +24,7 @@ import (
 	"io"
 	slashpath "path"
 	"strconv"
+	"strings"
 
 	"github.com/zombiezen/mcm/catalog"
 	"github.com/zombiezen/mcm/internal/depgraph"
@@ -32,6 +33,10 @@ import (
 
 // WriteScript converts a catalog into a bash script and writes it to w.
 func WriteScript(w io.Writer, c catalog.Catalog) error {
+	c, err := catalog.ExpandDefaults(c)
+	if err != nil {
+		return err
+	}
 	g := newGen(w)
 	g.p(script("#!/bin/bash"))
 	g.p(script("# Autogenerated by mcm-shellify"))
@@ -65,8 +70,8 @@ func WriteScript(w io.Writer, c catalog.Catalog) error {
 		}
 		for _, id := range ready {
 			graph.Mark(id)
-			deps, _ := graph.Resource(id).Dependencies()
-			if deps.Len() == 0 {
+			deps := resourceDeps(graph, id)
+			if len(deps) == 0 {
 				g.p(resourceFuncName(id))
 				continue
 			}
@@ -156,7 +161,13 @@ func (g *gen) resourceFunc(r catalog.Resource) error {
 	g.in()
 	defer g.out()
 
-	if c, _ := r.Comment(); c != "" {
+	if r.Disabled() {
+		g.p(assignment{resourceStatusVar(id), 0})
+		return nil
+	}
+	if name, _ := r.Name(); name != "" {
+		g.p(script("echo"), fmt.Sprintf("applying: %s", name), script("1>&2"))
+	} else if c, _ := r.Comment(); c != "" {
 		g.p(script("echo"), fmt.Sprintf("applying: %s (id=%d)", c, r.ID()), script("1>&2"))
 	} else {
 		g.p(script("echo"), fmt.Sprintf("applying: id=%d", r.ID()), script("1>&2"))
@@ -170,6 +181,9 @@ func (g *gen) resourceFunc(r catalog.Resource) error {
 			g.p(assignment{statVar, 0})
 		}
 		return nil
+	case catalog.Resource_Which_barrier:
+		g.p(assignment{statVar, 0})
+		return nil
 	case catalog.Resource_Which_file:
 		f, err := r.File()
 		if err != nil {
@@ -187,14 +201,25 @@ func (g *gen) resourceFunc(r catalog.Resource) error {
 	}
 }
 
-func depsPrecondition(deps capnp.UInt64List) script {
+// resourceDeps returns the listed and implicit dependencies of a
+// resource in the graph.
+func resourceDeps(graph *depgraph.Graph, id uint64) []uint64 {
+	list, _ := graph.Resource(id).Dependencies()
+	deps := make([]uint64, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		deps = append(deps, list.At(i))
+	}
+	return append(deps, graph.ImplicitDependencies(id)...)
+}
+
+func depsPrecondition(deps []uint64) script {
 	var buf []byte
-	for i, n := 0, deps.Len(); i < n; i++ {
+	for i, d := range deps {
 		if i > 0 {
 			buf = append(buf, " && "...)
 		}
 		buf = append(buf, "$status"...)
-		buf = strconv.AppendUint(buf, deps.At(i), 10)
+		buf = strconv.AppendUint(buf, d, 10)
 		buf = append(buf, " -ge 0"...)
 	}
 	return script(buf)
@@ -270,9 +295,40 @@ func (g *gen) file(id uint64, f catalog.File) error {
 		return fmt.Errorf("%s is not an absolute path", path)
 	}
 	g.p(script("local"), assignment{"respath", path})
+	if f.CreateParents() && f.Which() != catalog.File_Which_absent {
+		g.p(script(`if [[ ! -d "$(dirname "$respath")" ]]; then`))
+		g.in()
+		g.p(script(`mkdir -p "$(dirname "$respath")"`))
+		g.p(script("if [[ $? -ne 0 ]]; then"))
+		g.in()
+		g.returnStatus(id, -1)
+		g.out()
+		g.p(script("fi"))
+		g.out()
+		g.p(script("fi"))
+	}
 
 	switch f.Which() {
 	case catalog.File_Which_plain:
+		if f.Plain().HasContentUrl() {
+			return errors.New("content URLs are not supported in scripts")
+		}
+		if f.Plain().ContentFromOutput() != 0 {
+			return errors.New("content from command output is not supported in scripts")
+		}
+		if f.Plain().CreateOnly() {
+			return errors.New("createOnly files are not supported in scripts")
+		}
+		if f.Plain().HasVerify() {
+			return errors.New("verify commands are not supported in scripts")
+		}
+		if f.Plain().OnlyIfExists() {
+			g.p(script(`if [[ ! -e "$respath" && ! -h "$respath" ]]; then`))
+			g.in()
+			g.returnStatus(id, 0)
+			g.out()
+			g.p(script("fi"))
+		}
 		g.p(script(`if [[ -h "$respath" ]]; then`))
 		g.in()
 		g.p(script(`echo "$respath is not a regular file" 1>&2`))
@@ -285,13 +341,12 @@ func (g *gen) file(id uint64, f catalog.File) error {
 		if err != nil {
 			return err
 		}
+		hasContent := f.Plain().HasContent() || f.Plain().HasContentPath()
 		switch {
-		case f.Plain().HasContent() && !margs.isEmpty():
-			content, err := f.Plain().Content()
-			if err != nil {
-				return fmt.Errorf("read content from catalog: %v", err)
+		case hasContent && !margs.isEmpty():
+			if err := g.plainContent(id, f.Plain()); err != nil {
+				return err
 			}
-			g.fileContent(id, content)
 
 			// If normal file, then check content for need to replace file.
 			g.p(script("local chcontent=1"))
@@ -346,12 +401,10 @@ func (g *gen) file(id uint64, f catalog.File) error {
 			v := resourceStatusVar(id)
 			g.p(script(`[[ $chcontent -eq 1 || "$modeout" != 'noop' ]] &&`), assignment{v, 1}, script("||"), assignment{v, 0})
 			g.p(resourceFuncReturn(id))
-		case f.Plain().HasContent():
-			content, err := f.Plain().Content()
-			if err != nil {
-				return fmt.Errorf("read content from catalog: %v", err)
+		case hasContent:
+			if err := g.plainContent(id, f.Plain()); err != nil {
+				return err
 			}
-			g.fileContent(id, content)
 
 			// Check for existence...
 			g.p(script(`if [[ ! -e "$respath" ]]; then`))
@@ -418,6 +471,9 @@ func (g *gen) file(id uint64, f catalog.File) error {
 			g.returnStatus(id, 0)
 		}
 	case catalog.File_Which_directory:
+		if f.Directory().MaxAgeMillis() != 0 {
+			return errors.New("purging old directory entries is not supported in scripts")
+		}
 		m, _ := f.Directory().Mode()
 		margs, err := modeToArgs(m)
 		if err != nil {
@@ -473,6 +529,9 @@ func (g *gen) file(id uint64, f catalog.File) error {
 		if target == "" {
 			return errors.New("symlink target is empty")
 		}
+		if f.Symlink().Relative() && slashpath.IsAbs(target) {
+			target = relPath(slashpath.Dir(path), target)
+		}
 		g.p(script("local"), assignment{"tgt", target})
 		g.p(script(`if [[ -h "$respath" ]]; then`))
 		g.in()
@@ -504,12 +563,74 @@ func (g *gen) file(id uint64, f catalog.File) error {
 	return nil
 }
 
+// relPath returns the path of target relative to the directory base.
+// Both paths must be absolute.
+func relPath(base, target string) string {
+	bparts := splitPath(base)
+	tparts := splitPath(target)
+	n := 0
+	for n < len(bparts) && n < len(tparts) && bparts[n] == tparts[n] {
+		n++
+	}
+	var rel []string
+	for range bparts[n:] {
+		rel = append(rel, "..")
+	}
+	rel = append(rel, tparts[n:]...)
+	if len(rel) == 0 {
+		return "."
+	}
+	return strings.Join(rel, "/")
+}
+
+// splitPath returns the elements of an absolute slash-separated path.
+func splitPath(p string) []string {
+	p = strings.TrimPrefix(slashpath.Clean(p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
 // fileContent is a macro for writing data to a temporary file.
 // This creates a local variable called "tmploc" that has the path of
 // the new file.
-func (g *gen) fileContent(id uint64, content []byte) {
-	enc := make([]byte, base64.StdEncoding.EncodedLen(len(content)))
-	base64.StdEncoding.Encode(enc, content)
+// plainContent writes the content of a plain file to a temporary file
+// named by $tmploc, copying it from the file's contentPath if it has
+// one.
+func (g *gen) plainContent(id uint64, f catalog.File_plain) error {
+	if !f.HasContentPath() {
+		content, err := f.Content()
+		if err != nil {
+			return fmt.Errorf("read content from catalog: %v", err)
+		}
+		g.fileContent(id, content)
+		return nil
+	}
+	if f.HasContent() {
+		return errors.New("contentPath set with content")
+	}
+	src, err := f.ContentPath()
+	if err != nil {
+		return fmt.Errorf("read content path from catalog: %v", err)
+	}
+	if !slashpath.IsAbs(src) {
+		return fmt.Errorf("content path %s is not absolute", src)
+	}
+	g.tempFile(id)
+	g.p(script("cp --"), src, script(`"$tmploc"`))
+	g.p(script("if [[ $? -ne 0 ]]; then"))
+	g.in()
+	g.p(script(`rm "$tmploc"`))
+	g.returnStatus(id, -1)
+	g.out()
+	g.p(script("fi"))
+	return nil
+}
+
+// tempFile creates an empty temporary file and assigns its path to
+// $tmploc.
+func (g *gen) tempFile(id uint64) {
 	g.p(script("local tmploc"))
 	g.p(assignment{"tmploc", script(`"$(mktemp 2>/dev/null || mktemp -t tmp)"`)})
 	g.p(script("if [[ $? -ne 0 ]]; then"))
@@ -517,6 +638,12 @@ func (g *gen) fileContent(id uint64, content []byte) {
 	g.returnStatus(id, -1)
 	g.out()
 	g.p(script("fi"))
+}
+
+func (g *gen) fileContent(id uint64, content []byte) {
+	enc := make([]byte, base64.StdEncoding.EncodedLen(len(content)))
+	base64.StdEncoding.Encode(enc, content)
+	g.tempFile(id)
 	// TODO(someday): non-binary files could skip base64 decoding.
 	g.p(script(`base64 --decode > "$tmploc"`), heredoc{marker: "!EOF!", data: enc})
 	g.p(script("if [[ $? -ne 0 ]]; then"))
@@ -606,6 +733,12 @@ func modeToArgs(mode catalog.File_Mode) (setmodeArgs, error) {
 }
 
 func (g *gen) exec(id uint64, e catalog.Exec) error {
+	if e.HasSupervise() {
+		return errors.New("supervised commands are not supported in scripts")
+	}
+	if err := g.execCreates(id, e); err != nil {
+		return fmt.Errorf("creates: %v", err)
+	}
 	if err := g.execCondition(id, e.Condition()); err != nil {
 		return fmt.Errorf("condition: %v", err)
 	}
@@ -613,8 +746,27 @@ func (g *gen) exec(id uint64, e catalog.Exec) error {
 	if err != nil {
 		return fmt.Errorf("read command from catalog: %v", err)
 	}
+	// Scripts apply resources one at a time, so batches are never
+	// combined, but each resource's batch args are still passed.
+	args, err := e.Batch().Args()
+	if err != nil {
+		return fmt.Errorf("read batch args from catalog: %v", err)
+	}
+	var extra []string
+	if args.Len() > 0 {
+		if c.Which() != catalog.Exec_Command_Which_argv {
+			return errors.New("batch args require an argv command")
+		}
+		extra = make([]string, args.Len())
+		for i := range extra {
+			extra[i], err = args.At(i)
+			if err != nil {
+				return fmt.Errorf("read batch args from catalog: %v", err)
+			}
+		}
+	}
 	g.p(script("local commandExit"))
-	if err := g.command("commandExit", c); err != nil {
+	if err := g.command("commandExit", c, extra); err != nil {
 		return fmt.Errorf("command: %v", err)
 	}
 	g.p(script("[[ $commandExit -eq 0 ]]"), updateStatus(id))
@@ -622,6 +774,27 @@ func (g *gen) exec(id uint64, e catalog.Exec) error {
 	return nil
 }
 
+// execCreates generates a check that skips the command if the exec's
+// creates path exists.
+func (g *gen) execCreates(id uint64, e catalog.Exec) error {
+	path, err := e.Creates()
+	if err != nil {
+		return fmt.Errorf("read from catalog: %v", err)
+	}
+	if path == "" {
+		return nil
+	}
+	if !slashpath.IsAbs(path) {
+		return fmt.Errorf("%s is not an absolute path", path)
+	}
+	g.p(script("if [[ -e"), path, script("]]; then"))
+	g.in()
+	g.returnStatus(id, 0)
+	g.out()
+	g.p(script("fi"))
+	return nil
+}
+
 func (g *gen) execCondition(id uint64, cond catalog.Exec_condition) error {
 	switch cond.Which() {
 	case catalog.Exec_condition_Which_always:
@@ -632,7 +805,7 @@ func (g *gen) execCondition(id uint64, cond catalog.Exec_condition) error {
 		if err != nil {
 			return fmt.Errorf("read from catalog: %v", err)
 		}
-		if err := g.command("conditionExit", c); err != nil {
+		if err := g.command("conditionExit", c, nil); err != nil {
 			return err
 		}
 		g.p(script("if [[ $conditionExit -ne 0 ]]; then"))
@@ -646,7 +819,7 @@ func (g *gen) execCondition(id uint64, cond catalog.Exec_condition) error {
 		if err != nil {
 			return fmt.Errorf("read from catalog: %v", err)
 		}
-		if err := g.command("conditionExit", c); err != nil {
+		if err := g.command("conditionExit", c, nil); err != nil {
 			return err
 		}
 		g.p(script("if [[ $conditionExit -eq 0 ]]; then"))
@@ -687,7 +860,15 @@ func (g *gen) execCondition(id uint64, cond catalog.Exec_condition) error {
 	return nil
 }
 
-func (g *gen) command(statusVar script, c catalog.Exec_Command) error {
+// command generates a subshell that runs c with extra arguments
+// appended and stores the exit code in statusVar.
+func (g *gen) command(statusVar script, c catalog.Exec_Command, extra []string) error {
+	if c.Expand() {
+		return errors.New("variable expansion is not supported in scripts")
+	}
+	if c.Nice() != 0 || c.IoClass() != catalog.Exec_Command_IoClass_unset || c.OomScoreAdj() != 0 {
+		return errors.New("scheduling settings are not supported in scripts")
+	}
 	wd, _ := c.WorkingDirectory()
 	if wd == "" {
 		wd = "/"
@@ -697,6 +878,8 @@ func (g *gen) command(statusVar script, c catalog.Exec_Command) error {
 		script("env -"),
 	}
 	env, _ := c.Environment()
+	var pathEnv string
+	hasPathEnv := false
 	for i, n := 0, env.Len(); i < n; i++ {
 		k, err := env.At(i).Name()
 		if err != nil {
@@ -706,11 +889,37 @@ func (g *gen) command(statusVar script, c catalog.Exec_Command) error {
 		if err != nil {
 			return err
 		}
+		if env.At(i).HasSecret() {
+			return errors.New("secret environment variables are not supported in scripts")
+		}
 		v, err := env.At(i).Value()
 		if err != nil {
 			return fmt.Errorf("read environment[%d] from catalog: %v", i, err)
 		}
 		pargs = append(pargs, assignment{id, v})
+		if k == "PATH" {
+			pathEnv, hasPathEnv = v, true
+		}
+	}
+
+	// prelude is a list of lines to run in the subshell before the command.
+	var prelude [][]interface{}
+	if c.CreateWorkingDirectory() {
+		if !slashpath.IsAbs(wd) {
+			return fmt.Errorf("working directory %s is not an absolute path", wd)
+		}
+		m, _ := c.WorkingDirectoryMode()
+		margs, err := modeToArgs(m)
+		if err != nil {
+			return fmt.Errorf("working directory mode: %v", err)
+		}
+		mkdir := []interface{}{script("if [[ ! -e"), wd, script("]]; then mkdir -p"), wd, script("|| exit 1;")}
+		if !margs.isEmpty() {
+			g.needsSetmode = true
+			mkdir = append(mkdir, margs.script(wd), script(">/dev/null || exit 1;"))
+		}
+		mkdir = append(mkdir, script("fi"))
+		prelude = append(prelude, mkdir)
 	}
 
 	switch c.Which() {
@@ -726,10 +935,22 @@ func (g *gen) command(statusVar script, c catalog.Exec_Command) error {
 		if err != nil {
 			return fmt.Errorf("read argv from catalog: %v", err)
 		}
-		if !slashpath.IsAbs(x) {
+		switch {
+		case slashpath.IsAbs(x):
+			pargs = append(pargs, x)
+		case c.LookPath() && x != "" && !strings.ContainsRune(x, '/'):
+			// Resolve before clearing the environment, so that the
+			// script's PATH is used if the command doesn't set one.
+			lookup := []interface{}{script(`prog="$(`)}
+			if hasPathEnv {
+				lookup = append(lookup, assignment{"PATH", pathEnv})
+			}
+			lookup = append(lookup, script("type -P"), x, script(`)" || exit 127`))
+			prelude = append([][]interface{}{lookup}, prelude...)
+			pargs = append(pargs, script(`"$prog"`))
+		default:
 			return fmt.Errorf("%s in argv is not an absolute path", x)
 		}
-		pargs = append(pargs, x)
 		for i, n := 1, argv.Len(); i < n; i++ {
 			arg, err := argv.At(i)
 			if err != nil {
@@ -737,8 +958,14 @@ func (g *gen) command(statusVar script, c catalog.Exec_Command) error {
 			}
 			pargs = append(pargs, arg)
 		}
+		for _, arg := range extra {
+			pargs = append(pargs, arg)
+		}
 
 		g.p(script("("))
+		for _, line := range prelude {
+			g.p(line...)
+		}
 		g.p(pargs...)
 		g.p(script(")"))
 		g.p(assignment{statusVar, script("$?")})
@@ -750,6 +977,9 @@ func (g *gen) command(statusVar script, c catalog.Exec_Command) error {
 		pargs = append(pargs, script("bash"), heredoc{marker: contentMarker(b), data: b})
 
 		g.p(script("("))
+		for _, line := range prelude {
+			g.p(line...)
+		}
 		g.p(pargs...)
 		g.p(script(")"))
 		g.p(assignment{statusVar, script("$?")})
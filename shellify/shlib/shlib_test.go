@@ -48,3 +48,22 @@ func TestShellQuote(t *testing.T) {
 		}
 	})
 }
+
+func TestRelPath(t *testing.T) {
+	tests := []struct {
+		base, target, rel string
+	}{
+		{"/", "/", "."},
+		{"/a", "/a", "."},
+		{"/a/b", "/a/b/c", "c"},
+		{"/a/b", "/a/c", "../c"},
+		{"/a/b/c", "/d/e", "../../../d/e"},
+		{"/", "/a/b", "a/b"},
+		{"/a/b/", "/a//c/./d", "../c/d"},
+	}
+	for _, test := range tests {
+		if got := relPath(test.base, test.target); got != test.rel {
+			t.Errorf("relPath(%q, %q) = %q; want %q", test.base, test.target, got, test.rel)
+		}
+	}
+}
@@ -147,6 +147,7 @@ _capnp_gengo = rule(_capnp_gengo_impl,
 def capnp_go_library(
     name,
     lib,
+    srcs = [],
     deps = [],
     testonly = False,
     visibility = None):
@@ -157,7 +158,7 @@ def capnp_go_library(
   )
   go_library(
       name = name,
-      srcs = [":" + name + "_gosrc"],
+      srcs = [":" + name + "_gosrc"] + srcs,
       testonly = testonly,
       deps = deps + [
         "//third_party/golang/capnproto:go_default_library",
@@ -59,11 +59,17 @@ echostep "$gcloud_root/bin/gcloud" auth activate-service-account --key-file=trav
 
 # Build and deploy
 echostep ./bazel --bazelrc=travis/bazelrc build -c opt --stamp --embed_label="$build_label" \
-  //dot:mcm-dot //exec:mcm-exec //luacat:mcm-luacat //shellify:mcm-shellify || exit 1
+  //mcm //agent:mcm-agent //bisect:mcm-bisect //dot:mcm-dot //encrypt:mcm-encrypt //exec:mcm-exec //luacat:mcm-luacat //merge:mcm-merge //prune:mcm-prune //shellify:mcm-shellify || exit 1
 echostep zip -j travis/build.zip \
+  bazel-bin/mcm/mcm \
+  bazel-bin/agent/mcm-agent \
+  bazel-bin/bisect/mcm-bisect \
   bazel-bin/dot/mcm-dot \
+  bazel-bin/encrypt/mcm-encrypt \
   bazel-bin/exec/mcm-exec \
   bazel-bin/luacat/mcm-luacat \
+  bazel-bin/merge/mcm-merge \
+  bazel-bin/prune/mcm-prune \
   bazel-bin/shellify/mcm-shellify || exit 1
 echostep "$gcloud_root/bin/gsutil" cp -n travis/build.zip "$gcs_out"
 gsutil_result=$?
@@ -0,0 +1,132 @@
+// Copyright 2016 The Minimal Configuration Manager Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// mcm-validate checks catalogs for errors and likely mistakes without
+// applying them.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/zombiezen/mcm/catalog"
+	"github.com/zombiezen/mcm/internal/version"
+	"github.com/zombiezen/mcm/third_party/golang/capnproto"
+)
+
+func init() {
+	flag.Usage = usage
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [-lint=false] [CATALOG...]\n", filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
+
+func main() {
+	lint := flag.Bool("lint", true, "also report likely mistakes, such as exec resources that run on every application")
+	listRules := flag.Bool("rules", false, "list the lint rules and exit")
+	versionMode := flag.Bool("version", false, "display version info")
+	flag.Parse()
+	if *versionMode {
+		version.Show()
+		return
+	}
+	if *listRules {
+		for _, name := range catalog.LintRules() {
+			fmt.Println(name)
+		}
+		return
+	}
+
+	var names []string
+	var cats []catalog.Catalog
+	if flag.NArg() == 0 {
+		c, err := readCatalog(os.Stdin)
+		if err != nil {
+			die(err)
+		}
+		names = append(names, "<stdin>")
+		cats = append(cats, c)
+	}
+	for _, path := range flag.Args() {
+		f, err := catalog.OpenFile(path)
+		if err != nil {
+			die(err)
+		}
+		defer f.Close()
+		names = append(names, path)
+		cats = append(cats, f.Catalog)
+	}
+
+	ok := true
+	for i, c := range cats {
+		if err := catalog.ValidateStructure(c, nil); err != nil {
+			fmt.Printf("%s: %v\n", names[i], err)
+			ok = false
+			// The catalog can't be read safely.
+			cats[i] = catalog.Catalog{}
+		}
+	}
+	var valid []catalog.Catalog
+	for _, c := range cats {
+		if c.IsValid() {
+			valid = append(valid, c)
+		}
+	}
+	if err := catalog.CheckConflicts(valid...); err != nil {
+		fmt.Println(err)
+		ok = false
+	}
+	if *lint {
+		for i, c := range cats {
+			if !c.IsValid() {
+				continue
+			}
+			findings, err := catalog.Lint(c)
+			if err != nil {
+				fmt.Printf("%s: %v\n", names[i], err)
+				ok = false
+				continue
+			}
+			for _, f := range findings {
+				fmt.Printf("%s: %v\n", names[i], f)
+				ok = false
+			}
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, "mcm-validate:", err)
+	os.Exit(1)
+}
+
+func readCatalog(r io.Reader) (catalog.Catalog, error) {
+	msg, err := capnp.NewDecoder(r).Decode()
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	c, err := catalog.ReadRootCatalog(msg)
+	if err != nil {
+		return catalog.Catalog{}, fmt.Errorf("read catalog: %v", err)
+	}
+	return c, nil
+}